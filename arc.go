@@ -0,0 +1,271 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// arcMaxInstance is the max number of ARC sets of a message (RFC 8617 section 4.2.1).
+const arcMaxInstance = 50
+
+// ARCConfig defines the ARC (RFC 8617) sealing settings of the relayed messages.
+//
+// Exactly one of PrivateKey or PrivateKeyFile must be set.
+type ARCConfig struct {
+	Domain         string `mapstructure:"domain" json:"domain,omitempty" bson:"domain,omitempty"`                               // the signing domain ("d=" tag)
+	Selector       string `mapstructure:"selector" json:"selector,omitempty" bson:"selector,omitempty"`                         // the key selector ("s=" tag)
+	PrivateKey     string `mapstructure:"private_key" json:"private_key,omitempty" bson:"private_key,omitempty"`                // PEM encoded RSA or Ed25519 key
+	PrivateKeyFile string `mapstructure:"private_key_file" json:"private_key_file,omitempty" bson:"private_key_file,omitempty"` // path to a PEM encoded key file
+	AuthServID     string `mapstructure:"authserv_id" json:"authserv_id,omitempty" bson:"authserv_id,omitempty"`                // the Authentication-Results id, default to Domain
+
+	// Headers are the header fields signed by the ARC-Message-Signature
+	// (when present), default to the common DKIM ones and DKIM-Signature.
+	Headers []string `mapstructure:"headers" json:"headers,omitempty" bson:"headers,omitempty"`
+
+	// Clock is an optional time source of the signatures timestamps
+	// (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the ARC configuration for common mistakes.
+func (c ARCConfig) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(c.Domain) == "" {
+		errs = append(errs, errors.New("arc: domain is required"))
+	}
+
+	if strings.TrimSpace(c.Selector) == "" {
+		errs = append(errs, errors.New("arc: selector is required"))
+	}
+
+	if c.PrivateKey == "" && c.PrivateKeyFile == "" {
+		errs = append(errs, errors.New("arc: either private_key or private_key_file must be set"))
+	}
+
+	if c.PrivateKey != "" && c.PrivateKeyFile != "" {
+		errs = append(errs, errors.New("arc: private_key and private_key_file are mutually exclusive"))
+	}
+
+	for i, h := range c.Headers {
+		if strings.HasPrefix(strings.ToLower(h), "arc-") {
+			errs = append(errs, fmt.Errorf("arc: headers[%d] must not be an ARC header, got %q", i, h))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c ARCConfig) Redacted() ARCConfig {
+	c.PrivateKey = redact(c.PrivateKey)
+	c.Clock = nil
+
+	return c
+}
+
+// ARCSealer is a [Signer] that adds an ARC set (ARC-Authentication-Results,
+// ARC-Message-Signature and ARC-Seal) to the relayed messages, so that the
+// downstream receivers could trust the authentication results of this hop.
+//
+// The chain validation status ("cv=" tag) is taken from the "arc=" result of
+// the Authentication-Results header added by the receiving MTA with the
+// configured authserv-id, which is also copied as ARC-Authentication-Results.
+// Chains that have already failed are not extended.
+//
+// Only the relayed messages are sealed, ie. the ones with such
+// Authentication-Results header or previous ARC sets. The messages
+// originated by the app are left to the DKIM signing.
+//
+// Note that [ParseMessage] keeps only the first occurrence of each header,
+// so the messages with previous ARC sets should be sealed in their raw form.
+type ARCSealer struct {
+	config ARCConfig
+	key    *signingKey
+}
+
+// NewARCSealer creates a new ARC sealer from the provided config.
+func NewARCSealer(config ARCConfig) (*ARCSealer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	key, err := loadSigningKey(config.PrivateKey, config.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("arc: %w", err)
+	}
+
+	if config.AuthServID == "" {
+		config.AuthServID = config.Domain
+	}
+	if len(config.Headers) == 0 {
+		config.Headers = append(append([]string(nil), dkimDefaultHeaders...), "DKIM-Signature")
+	}
+
+	return &ARCSealer{config: config, key: key}, nil
+}
+
+// arcSet holds the header fields of a single ARC instance.
+type arcSet struct {
+	results, signature, seal []rawHeaderField
+}
+
+// Sign implements [Signer] interface.
+//
+// It returns no headers if the message chain has already failed
+// or the max number of ARC sets is reached.
+func (s *ARCSealer) Sign(raw []byte) ([]byte, error) {
+	fields, body := splitRawMessage(raw)
+
+	sets := map[int]*arcSet{}
+	var results string
+	for _, f := range fields {
+		switch strings.ToLower(f.name) {
+		case "arc-authentication-results":
+			set := arcInstanceSet(sets, f)
+			set.results = append(set.results, f)
+		case "arc-message-signature":
+			set := arcInstanceSet(sets, f)
+			set.signature = append(set.signature, f)
+		case "arc-seal":
+			set := arcInstanceSet(sets, f)
+			set.seal = append(set.seal, f)
+		case "authentication-results":
+			if id, _, _ := strings.Cut(f.value(), ";"); results == "" && strings.EqualFold(strings.TrimSpace(id), s.config.AuthServID) {
+				results = f.value()
+			}
+		}
+	}
+
+	instance := len(sets) + 1
+	if instance > arcMaxInstance {
+		return nil, nil
+	}
+
+	// neither received by the MTA nor sealed upstream, ie. not relayed
+	if instance == 1 && results == "" {
+		return nil, nil
+	}
+
+	cv := "none"
+	if instance > 1 {
+		cv = arcChainStatus(sets, results)
+		if cv == "" {
+			return nil, nil // already failed
+		}
+	}
+
+	if results == "" {
+		results = s.config.AuthServID + "; none"
+	}
+
+	i := strconv.Itoa(instance)
+	timestamp := strconv.FormatInt(now(s.config.Clock).Unix(), 10)
+
+	aar := "ARC-Authentication-Results: i=" + i + "; " + results + "\r\n"
+
+	// ARC-Message-Signature
+	signed, names := selectHeaders(fields, s.config.Headers)
+	ams := signatureField("ARC-Message-Signature", [][2]string{
+		{"i", i},
+		{"a", s.key.algorithm},
+		{"c", "relaxed/relaxed"},
+		{"d", s.config.Domain},
+		{"s", s.config.Selector},
+		{"t", timestamp},
+		{"h", strings.ToLower(strings.Join(names, ":"))},
+		{"bh", bodyHash(body)},
+		{"b", ""},
+	})
+
+	var data strings.Builder
+	for _, f := range signed {
+		data.WriteString(relaxedHeader(f.field))
+	}
+	data.WriteString(strings.TrimSuffix(relaxedHeader(ams), "\r\n"))
+
+	sig, err := s.key.sign([]byte(data.String()))
+	if err != nil {
+		return nil, err
+	}
+	ams += sig + "\r\n"
+
+	// ARC-Seal
+	as := signatureField("ARC-Seal", [][2]string{
+		{"i", i},
+		{"a", s.key.algorithm},
+		{"t", timestamp},
+		{"cv", cv},
+		{"d", s.config.Domain},
+		{"s", s.config.Selector},
+		{"b", ""},
+	})
+
+	data.Reset()
+	for n := 1; n < instance; n++ {
+		set := sets[n]
+		data.WriteString(relaxedHeader(set.results[0].field))
+		data.WriteString(relaxedHeader(set.signature[0].field))
+		data.WriteString(relaxedHeader(set.seal[0].field))
+	}
+	data.WriteString(relaxedHeader(aar))
+	data.WriteString(relaxedHeader(ams))
+	data.WriteString(strings.TrimSuffix(relaxedHeader(as), "\r\n"))
+
+	if sig, err = s.key.sign([]byte(data.String())); err != nil {
+		return nil, err
+	}
+	as += sig + "\r\n"
+
+	return []byte(as + ams + aar), nil
+}
+
+// arcInstanceSet returns the set of the field instance ("i=" tag).
+func arcInstanceSet(sets map[int]*arcSet, f rawHeaderField) *arcSet {
+	n, _ := strconv.Atoi(parseTagList(f.value())["i"])
+
+	set := sets[n]
+	if set == nil {
+		set = &arcSet{}
+		sets[n] = set
+	}
+
+	return set
+}
+
+// arcChainStatus returns the "cv=" value of the next ARC-Seal, or
+// an empty string if the chain has already failed and must not be sealed.
+func arcChainStatus(sets map[int]*arcSet, results string) string {
+	instances := make([]int, 0, len(sets))
+	for n := range sets {
+		instances = append(instances, n)
+	}
+	sort.Ints(instances)
+
+	for i, n := range instances {
+		set := sets[n]
+		if n != i+1 || len(set.results) != 1 || len(set.signature) != 1 || len(set.seal) != 1 {
+			return "fail" // incomplete or tampered chain
+		}
+	}
+
+	last := sets[len(instances)]
+	if strings.EqualFold(parseTagList(last.seal[0].value())["cv"], "fail") {
+		return ""
+	}
+
+	for _, part := range strings.Split(results, ";") {
+		method, result, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.EqualFold(method, "arc") {
+			if strings.HasPrefix(strings.ToLower(result), "pass") {
+				return "pass"
+			}
+			break
+		}
+	}
+
+	return "fail"
+}
@@ -0,0 +1,200 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestARCSealer(t *testing.T) (*ARCSealer, ed25519.PublicKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealer, err := NewARCSealer(ARCConfig{
+		Domain:     "fwd.example.com",
+		Selector:   "arc",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		AuthServID: "mx.fwd.example.com",
+		Clock:      ClockFunc(func() time.Time { return time.Unix(1700000000, 0) }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sealer, pub
+}
+
+var signatureTagRegex = regexp.MustCompile(`[ \t;]b=`)
+
+// verifySignatureField verifies the "b=" signature of a DKIM style field
+// over the canonicalized headers data and returns the field tags.
+func verifySignatureField(t *testing.T, pub crypto.PublicKey, field rawHeaderField, data string) map[string]string {
+	t.Helper()
+
+	tags := parseTagList(field.value())
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["b"]), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loc := signatureTagRegex.FindAllStringIndex(field.field, -1)
+	unsigned := field.field[:loc[len(loc)-1][1]]
+	data += strings.TrimSuffix(relaxedHeader(unsigned), "\r\n")
+
+	hash := sha256.Sum256([]byte(data))
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hash[:], sig) {
+			t.Fatalf("Invalid %s signature", field.name)
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+			t.Fatalf("Invalid %s signature: %v", field.name, err)
+		}
+	default:
+		t.Fatalf("Unsupported public key %T", pub)
+	}
+
+	return tags
+}
+
+// verifyARCSet verifies the signatures of the newest ARC set of raw.
+func verifyARCSet(t *testing.T, raw []byte, pub ed25519.PublicKey) map[string]string {
+	t.Helper()
+
+	fields, body := splitRawMessage(raw)
+
+	var sets [][3]rawHeaderField
+	for _, f := range fields {
+		var pos int
+		switch strings.ToLower(f.name) {
+		case "arc-authentication-results":
+			pos = 0
+		case "arc-message-signature":
+			pos = 1
+		case "arc-seal":
+			pos = 2
+		default:
+			continue
+		}
+		n, _ := strconv.Atoi(parseTagList(f.value())["i"])
+		for len(sets) < n {
+			sets = append(sets, [3]rawHeaderField{})
+		}
+		sets[n-1][pos] = f
+	}
+
+	last := sets[len(sets)-1]
+
+	// ARC-Message-Signature
+	ams := parseTagList(last[1].value())
+	if ams["bh"] != bodyHash(body) {
+		t.Fatalf("Body hash mismatch")
+	}
+	var data string
+	signed, _ := selectHeaders(fields, strings.Split(ams["h"], ":"))
+	for _, f := range signed {
+		data += relaxedHeader(f.field)
+	}
+	verifySignatureField(t, pub, last[1], data)
+
+	// ARC-Seal
+	data = ""
+	for i, set := range sets {
+		data += relaxedHeader(set[0].field) + relaxedHeader(set[1].field)
+		if i < len(sets)-1 {
+			data += relaxedHeader(set[2].field)
+		}
+	}
+
+	return verifySignatureField(t, pub, last[2], data)
+}
+
+func TestARCSealer(t *testing.T) {
+	sealer, pub := newTestARCSealer(t)
+
+	m := &Message{
+		From:    mail.Address{Address: "john@example.com"},
+		To:      []mail.Address{{Address: "jane@fwd.example.com"}},
+		Subject: "Hello",
+		Text:    "Hello world\n",
+		Headers: map[string]string{"Authentication-Results": "mx.fwd.example.com; spf=pass smtp.mailfrom=example.com"},
+	}
+
+	var raw []byte
+	next := MailerFunc(func(m *Message) error {
+		var err error
+		raw, err = m.Render()
+		return err
+	})
+	if err := Chain(next, Signing(sealer)).Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(raw), "ARC-Seal: i=1;") {
+		t.Fatalf("Expected the message to start with the ARC set, got\n%s", raw)
+	}
+	if !strings.Contains(string(raw), "ARC-Authentication-Results: i=1; mx.fwd.example.com; spf=pass smtp.mailfrom=example.com\r\n") {
+		t.Fatalf("Expected the authentication results to be copied, got\n%s", raw)
+	}
+
+	if tags := verifyARCSet(t, raw, pub); tags["cv"] != "none" {
+		t.Fatalf("Expected cv=none, got %q", tags["cv"])
+	}
+
+	// second hop
+	sealer2, pub2 := newTestARCSealer(t)
+	raw2 := append([]byte("Authentication-Results: mx.fwd.example.com; arc=pass\r\n"), raw...)
+	headers, err := sealer2.Sign(raw2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw2 = append(headers, raw2...)
+
+	if tags := verifyARCSet(t, raw2, pub2); tags["cv"] != "pass" || tags["i"] != "2" {
+		t.Fatalf("Expected i=2 and cv=pass, got %v", tags)
+	}
+
+	// failed upstream verification
+	raw3 := append([]byte("Authentication-Results: mx.fwd.example.com; arc=fail\r\n"), raw...)
+	headers, err = sealer2.Sign(raw3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw3 = append(headers, raw3...)
+	if tags := verifyARCSet(t, raw3, pub2); tags["cv"] != "fail" {
+		t.Fatalf("Expected cv=fail, got %v", tags)
+	}
+
+	// failed chains are not extended
+	if headers, err := sealer2.Sign(raw3); err != nil || headers != nil {
+		t.Fatalf("Expected no ARC set, got %q (%v)", headers, err)
+	}
+
+	// the messages originated by the app are not relayed
+	raw4, err := (&Message{From: m.From, To: m.To, Subject: "Hello", Text: "Hello world\n"}).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers, err := sealer.Sign(raw4); err != nil || headers != nil {
+		t.Fatalf("Expected no ARC set for a message that is not relayed, got %q (%v)", headers, err)
+	}
+}
@@ -0,0 +1,225 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultArchiveTimeout = 30 * time.Second
+
+// ArchiveStore persists the archived messages.
+type ArchiveStore interface {
+	// Put stores data under the specified slash separated key.
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// ArchiveConfig defines the sent messages archive settings.
+//
+// Exactly one of Path (local directory) or S3 must be set.
+type ArchiveConfig struct {
+	Path    string          `mapstructure:"path" json:"path,omitempty" bson:"path,omitempty"`       // local archive directory
+	S3      *S3ArchiveStore `mapstructure:"s3" json:"s3,omitempty" bson:"s3,omitempty"`             // S3-compatible bucket
+	Prefix  string          `mapstructure:"prefix" json:"prefix,omitempty" bson:"prefix,omitempty"` // optional keys prefix, eg. "mail/"
+	Timeout time.Duration   `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`
+
+	// Clock is an optional time source used for the date based keys
+	// and the archived Date header (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when an already sent
+	// message or its send record could not be archived.
+	OnError func(m *Message, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the archive configuration for common mistakes.
+func (c ArchiveConfig) Validate() error {
+	var errs []error
+
+	if c.Path == "" && c.S3 == nil {
+		errs = append(errs, errors.New("archive: either path or s3 must be set"))
+	}
+
+	if c.Path != "" && c.S3 != nil {
+		errs = append(errs, errors.New("archive: path and s3 are mutually exclusive"))
+	}
+
+	if c.S3 != nil {
+		if err := c.S3.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("archive: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c ArchiveConfig) Redacted() ArchiveConfig {
+	if c.S3 != nil {
+		s3 := *c.S3
+		s3.SecretKey = redact(s3.SecretKey)
+		c.S3 = &s3
+	}
+	c.OnError = nil
+
+	return c
+}
+
+// Store returns the ArchiveStore described by the config.
+func (c ArchiveConfig) Store() (ArchiveStore, error) {
+	switch {
+	case c.Path != "":
+		return DirArchiveStore(c.Path), nil
+	case c.S3 != nil:
+		return c.S3, nil
+	default:
+		return nil, errors.New("either path or s3 must be set")
+	}
+}
+
+// ArchiveRecord describes the outcome of an archived send.
+type ArchiveRecord struct {
+	MessageID  string    `json:"message_id"`
+	Date       time.Time `json:"date"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Archive returns a middleware that stores every sent message to the provided store.
+//
+// After a successful send, the exact bytes sent by the backend (eg. with
+// its DKIM signature) are stored as "{prefix}{yyyy}/{mm}/{dd}/{message-id}.eml".
+// An [ArchiveRecord] with the outcome of every send attempt is stored next to
+// it as "{message-id}.json". Failing to archive doesn't fail the already sent
+// message, the error is reported to the OnError hook instead.
+//
+// The messages of the backends that don't render them are rendered after
+// the send, so those without Message-ID header and Date get ones assigned,
+// so that the archived copy matches the sent one.
+func Archive(store ArchiveStore, cfg ArchiveConfig) Middleware {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultArchiveTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			// buffer the attachments so that the message could be both sent and rendered
+			m = m.Clone()
+			if err := m.bufferAttachments(); err != nil {
+				return err
+			}
+
+			if m.Date.IsZero() {
+				m.Date = now(cfg.Clock)
+			}
+
+			messageID := ensureMessageID(m)
+
+			rendered := m.captureRendered()
+			sendErr := next.Send(m)
+
+			key := cfg.Prefix + m.Date.UTC().Format("2006/01/02") + "/" + archiveKeyName(messageID)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			if sendErr == nil {
+				if err := putArchivedMessage(ctx, store, key+".eml", m, rendered); err != nil && cfg.OnError != nil {
+					cfg.OnError(m, fmt.Errorf("failed to archive the message: %w", err))
+				}
+			}
+
+			record := ArchiveRecord{
+				MessageID:  messageID,
+				Date:       m.Date,
+				From:       m.From.Address,
+				Recipients: envelopeRecipients(m),
+				Subject:    m.Subject,
+			}
+			if sendErr != nil {
+				record.Error = sendErr.Error()
+			}
+
+			if err := putArchiveRecord(ctx, store, key+".json", record); err != nil && cfg.OnError != nil {
+				cfg.OnError(m, fmt.Errorf("failed to archive the send record: %w", err))
+			}
+
+			return sendErr
+		})
+	}
+}
+
+// putArchivedMessage stores the bytes sent by the backend,
+// or the rendered message if the backend didn't render it.
+func putArchivedMessage(ctx context.Context, store ArchiveStore, key string, m *Message, rendered *renderCapture) error {
+	raw := rendered.bytes()
+	if raw == nil {
+		var err error
+		if raw, err = m.Render(); err != nil {
+			return err
+		}
+	}
+
+	return store.Put(ctx, key, raw)
+}
+
+func putArchiveRecord(ctx context.Context, store ArchiveStore, key string, record ArchiveRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, key, data)
+}
+
+// archiveKeyName converts the Message-ID into a safe key name.
+func archiveKeyName(messageID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '-', r == '_', r == '@':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.Trim(strings.TrimSpace(messageID), "<>"))
+}
+
+// DirArchiveStore is an [ArchiveStore] that stores the
+// archived messages as files in a local directory.
+type DirArchiveStore string
+
+// Put implements [ArchiveStore] interface.
+func (d DirArchiveStore) Put(ctx context.Context, key string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key = path.Clean("/" + key) // prevent traversal outside the directory
+	file := filepath.Join(string(d), filepath.FromSlash(key))
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o750); err != nil {
+		return err
+	}
+
+	// write to a temp file first so that no partial archives are left behind
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,242 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	_ ArchiveStore   = (*S3ArchiveStore)(nil)
+	_ LargeFileStore = (*S3ArchiveStore)(nil)
+)
+
+const s3MaxPresignExpiry = 7 * 24 * 60 * 60 // seconds
+
+// S3ArchiveStore is an [ArchiveStore] that uploads the archived
+// messages to an S3-compatible bucket (AWS S3, MinIO, R2, etc.).
+// It is a [LargeFileStore] too, linking the objects with presigned urls.
+type S3ArchiveStore struct {
+	Endpoint  string `mapstructure:"endpoint" json:"endpoint,omitempty" bson:"endpoint,omitempty"` // eg. https://s3.eu-west-1.amazonaws.com
+	Region    string `mapstructure:"region" json:"region,omitempty" bson:"region,omitempty"`       // default to "us-east-1"
+	Bucket    string `mapstructure:"bucket" json:"bucket,omitempty" bson:"bucket,omitempty"`
+	AccessKey string `mapstructure:"access_key" json:"access_key,omitempty" bson:"access_key,omitempty"`
+	SecretKey string `mapstructure:"secret_key" json:"secret_key,omitempty" bson:"secret_key,omitempty"`
+	PathStyle bool   `mapstructure:"path_style" json:"path_style,omitempty" bson:"path_style,omitempty"` // use {endpoint}/{bucket}/{key} urls instead of {bucket}.{endpoint}/{key}
+
+	// Client is an optional HTTP client (default to http.DefaultClient).
+	Client *http.Client `mapstructure:"-" json:"-" bson:"-"`
+
+	// Clock is an optional time source used for the request signatures.
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the S3 configuration for common mistakes.
+func (s *S3ArchiveStore) Validate() error {
+	var errs []error
+
+	if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("archive: invalid s3 endpoint %q", s.Endpoint))
+	}
+
+	if s.Bucket == "" {
+		errs = append(errs, errors.New("archive: s3 bucket is required"))
+	}
+
+	if s.AccessKey == "" || s.SecretKey == "" {
+		errs = append(errs, errors.New("archive: s3 access_key and secret_key are required"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Put implements [ArchiveStore] interface.
+func (s *S3ArchiveStore) Put(ctx context.Context, key string, data []byte) error {
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+
+	s.sign(req, data)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactError(err, s.SecretKey)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("s3 upload failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// URL returns a presigned GET url of the key object, valid until
+// expires (but at most 7 days, as AWS Signature Version 4 allows).
+func (s *S3ArchiveStore) URL(key string, expires time.Time) (string, error) {
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	t := now(s.Clock).UTC()
+	amzDate := t.Format("20060102T150405Z")
+	scope := t.Format("20060102") + "/" + region + "/s3/aws4_request"
+
+	ttl := int64(expires.Sub(t) / time.Second)
+	ttl = min(max(ttl, 1), s3MaxPresignExpiry)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.AccessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.FormatInt(ttl, 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	objectURL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		objectURL.EscapedPath(),
+		objectURL.RawQuery,
+		"host:" + objectURL.Host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	objectURL.RawQuery += "&X-Amz-Signature=" + hex.EncodeToString(hmacSHA256(s.signingKey(t.Format("20060102"), region), stringToSign))
+
+	return objectURL.String(), nil
+}
+
+// objectURL returns the url of the key object.
+func (s *S3ArchiveStore) objectURL(key string) (*url.URL, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	key = strings.TrimLeft(key, "/")
+	basePath := strings.TrimRight(endpoint.Path, "/")
+
+	objectURL := *endpoint
+	if s.PathStyle {
+		objectURL.Path = basePath + "/" + s.Bucket + "/" + key
+		objectURL.RawPath = basePath + "/" + s3EscapePath(s.Bucket) + "/" + s3EscapePath(key)
+	} else {
+		objectURL.Host = s.Bucket + "." + endpoint.Host
+		objectURL.Path = basePath + "/" + key
+		objectURL.RawPath = basePath + "/" + s3EscapePath(key)
+	}
+
+	return &objectURL, nil
+}
+
+// signingKey derives the AWS Signature Version 4 signing key of the date.
+func (s *S3ArchiveStore) signingKey(date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (s *S3ArchiveStore) sign(req *http.Request, payload []byte) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	t := now(s.Clock).UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(date, region), stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes every segment of the slash separated path
+// as the AWS Signature Version 4 canonical URI requires (everything
+// but the unreserved characters is percent-encoded).
+func s3EscapePath(p string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,154 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveMiddleware(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := ArchiveConfig{
+		Path:   dir,
+		Prefix: "sent/",
+		Clock: ClockFunc(func() time.Time {
+			return time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+		}),
+		OnError: func(_ *Message, err error) { t.Errorf("Unexpected archive error %v", err) },
+	}
+
+	store, err := cfg.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signature differs on every rendering, so that only the sent bytes match
+	var signatures int
+	signer := SignerFunc(func([]byte) ([]byte, error) {
+		signatures++
+		return []byte("X-Signature: " + strconv.Itoa(signatures) + "\r\n"), nil
+	})
+
+	var sendErr error
+	var sent *Message
+	var sentRaw []byte
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		sent = m
+		sentRaw, _ = m.Render()
+		return sendErr
+	}), Signing(signer), Archive(store, cfg))
+
+	original := &Message{
+		From:        mail.Address{Address: "sender@example.com"},
+		To:          []mail.Address{{Address: "to@example.com"}},
+		Subject:     "test",
+		Text:        "text",
+		Headers:     map[string]string{"Message-ID": "<abc/1@example.com>"},
+		Attachments: map[string]io.Reader{"a.txt": io.MultiReader(strings.NewReader("attachment"))},
+	}
+
+	if err := mailer.Send(original); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sent.Date.Equal(cfg.Clock.Now()) {
+		t.Fatalf("Expected the sent message Date to match the archived one, got %v", sent.Date)
+	}
+
+	base := filepath.Join(dir, "sent", "2024", "03", "04", "abc_1@example.com")
+
+	raw, err := os.ReadFile(base + ".eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != string(sentRaw) || !strings.Contains(string(raw), "a.txt") {
+		t.Fatalf("Expected the exact sent bytes, got:\n%s", raw)
+	}
+
+	// the sent message must still have the attachment content
+	if data, _ := io.ReadAll(sent.Attachments["a.txt"]); string(data) != "attachment" {
+		t.Fatalf("Expected the sent message attachment, got %q", data)
+	}
+
+	// only the record of the failed sends is archived
+	sendErr = errors.New("send failure")
+	original.Headers["Message-ID"] = "<abc/2@example.com>"
+	if err := mailer.Send(original); !errors.Is(err, sendErr) {
+		t.Fatalf("Expected the send error to be returned, got %v", err)
+	}
+
+	base = filepath.Join(dir, "sent", "2024", "03", "04", "abc_2@example.com")
+
+	if _, err := os.Stat(base + ".eml"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the failed message not to be archived, got %v", err)
+	}
+
+	data, err := os.ReadFile(base + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record ArchiveRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Error != sendErr.Error() || record.MessageID != "<abc/2@example.com>" || record.Recipients[0] != "to@example.com" {
+		t.Fatalf("Unexpected archive record %+v", record)
+	}
+}
+
+func TestS3ArchiveStorePut(t *testing.T) {
+	var req *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	store := &S3ArchiveStore{
+		Endpoint:  server.URL,
+		Region:    "eu-west-1",
+		Bucket:    "archive",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+		PathStyle: true,
+		Clock: ClockFunc(func() time.Time {
+			return time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+		}),
+	}
+	if err := store.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put(context.Background(), "2024/03/04/a b@example.com.eml", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Method != http.MethodPut || req.URL.EscapedPath() != "/archive/2024/03/04/a%20b%40example.com.eml" {
+		t.Fatalf("Unexpected request %s %s", req.Method, req.URL.EscapedPath())
+	}
+	if string(body) != "data" {
+		t.Fatalf("Expected body %q, got %q", "data", body)
+	}
+	if v := req.Header.Get("X-Amz-Date"); v != "20240304T050607Z" {
+		t.Fatalf("Expected X-Amz-Date 20240304T050607Z, got %q", v)
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20240304/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Fatalf("Unexpected Authorization header %q", auth)
+	}
+}
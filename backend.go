@@ -0,0 +1,154 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BackendFactory creates a backend, decoding its configuration section
+// with unmarshal (eg. into the backend config struct, with the
+// "mapstructure" field tags). The logger is the plugin one.
+type BackendFactory func(unmarshal func(out any) error, logger *slog.Logger) (Mailer, error)
+
+// builtinBackends are the names of the package backends, in the order
+// of their precedence when more than one is configured.
+var builtinBackends = []string{"smtp", "sendmail", "maildir", "external", "log", "null"}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+func init() {
+	RegisterBackend("smtp", newSmtpBackend)
+	RegisterBackend("sendmail", newSendMailBackend)
+	RegisterBackend("maildir", newMaildirBackend)
+	RegisterBackend("external", newExternalBackend)
+	RegisterBackend("log", newLogBackend)
+	RegisterBackend("null", newNullBackend)
+}
+
+// RegisterBackend makes a backend available by the provided name, so that
+// it can be configured under "mailer.{name}" (or "mailer.tenants.{id}.{name}")
+// and listed in the "mailer.tee" backends.
+//
+// It is intended to be called from the init function of the package
+// providing the backend, and panics if the name is invalid or already
+// registered, or if the factory is nil (as database/sql.Register does).
+func RegisterBackend(name string, factory BackendFactory) {
+	if name == "" || strings.ContainsAny(name, ". ") || reservedBackendNames[name] {
+		panic(fmt.Sprintf("mailer: invalid backend name %q", name))
+	}
+	if factory == nil {
+		panic("mailer: nil factory of backend " + name)
+	}
+
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, ok := backends[name]; ok {
+		panic("mailer: backend " + name + " is already registered")
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered backends, the package ones
+// first in the order of their precedence followed by the others sorted.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		if !slices.Contains(builtinBackends, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return append(append([]string(nil), builtinBackends...), names...)
+}
+
+func lookupBackend(name string) (BackendFactory, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	factory, ok := backends[name]
+
+	return factory, ok
+}
+
+func newSmtpBackend(unmarshal func(out any) error, logger *slog.Logger) (Mailer, error) {
+	var client SmtpClient
+	if err := unmarshal(&client); err != nil {
+		return nil, err
+	}
+	if err := client.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	client.applyDefaults()
+	if err := client.Validate(); err != nil {
+		return nil, err
+	}
+	if client.Debug {
+		client.OnTranscript = func(m *Message, transcript string) {
+			logger.Debug("smtp transcript", "subject", m.Subject, "transcript", transcript)
+		}
+	}
+
+	return client, nil
+}
+
+func newSendMailBackend(unmarshal func(out any) error, _ *slog.Logger) (Mailer, error) {
+	var sendMail SendMail
+	if err := unmarshal(&sendMail); err != nil {
+		return nil, err
+	}
+	if err := sendMail.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err := sendMail.Validate(); err != nil {
+		return nil, err
+	}
+
+	return sendMail, nil
+}
+
+func newMaildirBackend(unmarshal func(out any) error, _ *slog.Logger) (Mailer, error) {
+	var maildir MaildirMailer
+	if err := unmarshal(&maildir); err != nil {
+		return nil, err
+	}
+	if err := maildir.Validate(); err != nil {
+		return nil, err
+	}
+
+	return maildir, nil
+}
+
+func newExternalBackend(unmarshal func(out any) error, logger *slog.Logger) (Mailer, error) {
+	var config ExternalConfig
+	if err := unmarshal(&config); err != nil {
+		return nil, err
+	}
+
+	return NewExternalMailer(config, logger)
+}
+
+func newLogBackend(unmarshal func(out any) error, logger *slog.Logger) (Mailer, error) {
+	var logMailer LogMailer
+	if err := unmarshal(&logMailer); err != nil {
+		return nil, err
+	}
+	logMailer.Logger = logger
+
+	return logMailer, nil
+}
+
+func newNullBackend(_ func(out any) error, _ *slog.Logger) (Mailer, error) {
+	return &NullMailer{}, nil
+}
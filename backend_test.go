@@ -0,0 +1,154 @@
+package mailer
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfigurer is a minimal [Configurer] decoding the values with their json tags.
+type testConfigurer map[string]any
+
+func (c testConfigurer) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+func (c testConfigurer) UnmarshalKey(name string, out any) error {
+	data, err := json.Marshal(c[name])
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// outboxMailer is a third-party like backend collecting the sent messages.
+type outboxMailer struct {
+	Name     string `json:"name"`
+	messages []*Message
+}
+
+func (o *outboxMailer) Send(m *Message) error {
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+var registerOutbox sync.Once
+
+func TestRegisterBackend(t *testing.T) {
+	registerOutbox.Do(func() {
+		RegisterBackend("outbox", func(unmarshal func(out any) error, _ *slog.Logger) (Mailer, error) {
+			outbox := &outboxMailer{}
+			if err := unmarshal(outbox); err != nil {
+				return nil, err
+			}
+			return outbox, nil
+		})
+	})
+
+	if names := strings.Join(Backends(), ","); names != "smtp,sendmail,maildir,external,log,null,outbox" {
+		t.Fatalf("Unexpected backends %s", names)
+	}
+
+	scenarios := []struct {
+		name   string
+		config testConfigurer
+	}{
+		{"default backend", testConfigurer{"mailer.outbox": map[string]any{"name": "main"}}},
+		{"tee backend", testConfigurer{"mailer.tee": []string{"outbox", "null"}, "mailer.outbox": map[string]any{"name": "main"}, "mailer.null": nil}},
+		{"tenant backend", testConfigurer{"mailer.null": nil, "mailer.tenants": map[string]any{"acme": map[string]any{}}, "mailer.tenants.acme.outbox": map[string]any{"name": "main"}}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			p := &Plugin{}
+			if err := p.Init(s.config); err != nil {
+				t.Fatal(err)
+			}
+
+			mailer := p.Mailer()
+			if p.tenants != nil {
+				var err error
+				if mailer, err = p.tenants.For("acme"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := &Message{To: []mail.Address{{Address: "to@example.com"}}, Text: "text"}
+			if err := mailer.Send(m); err != nil {
+				t.Fatal(err)
+			}
+
+			var outbox *outboxMailer
+			switch backend := p.backend.(type) {
+			case *outboxMailer:
+				outbox = backend
+			case *TeeMailer:
+				outbox = backend.Mailers[0].(*outboxMailer)
+			default:
+				// the tenant backend shares the dry-run mode of the switch
+				acme, _ := p.tenants.lookup("acme")
+				outbox = acme.mailer.(*dryRunGate).next.(*outboxMailer)
+			}
+
+			if outbox.Name != "main" || len(outbox.messages) != 1 {
+				t.Fatalf("Expected 1 message sent through the configured outbox, got %+v", outbox)
+			}
+		})
+	}
+
+	for _, name := range []string{"", "smtp", "queue", "a.b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected the registration of %q to panic", name)
+				}
+			}()
+			RegisterBackend(name, newNullBackend)
+		}()
+	}
+}
+
+func TestPluginConfigDefaults(t *testing.T) {
+	config := func(smtp map[string]any) MapConfig {
+		return MapConfig{"version": "3", PluginName: map[string]any{
+			"default": map[string]any{"timeout": "10s", "from": map[string]any{"address": "info@example.com"}},
+			"smtp":    smtp,
+		}}
+	}
+
+	p := &Plugin{}
+	if err := p.Init(config(map[string]any{"host": "localhost", "port": 1025, "timeout": "5s"})); err != nil {
+		t.Fatal(err)
+	}
+	client := p.backend.(SmtpClient)
+	if client.Timeout != 5*time.Second || client.From.Address != "info@example.com" || p.configVersion != "3" {
+		t.Fatalf("Expected the smtp backend to inherit the defaults, got %+v", client)
+	}
+
+	scenarios := []struct {
+		name     string
+		config   MapConfig
+		expected string
+	}{
+		{"backend key", config(map[string]any{"host": "localhost", "auht": "PLAIN"}), `mailer.smtp: unknown key "auht", did you mean "auth"?`},
+		{"nested key", config(map[string]any{"host": "localhost", "from": map[string]any{"adress": "a@example.com"}}), `mailer.smtp.from: unknown key "adress", did you mean "address"?`},
+		{"section", MapConfig{PluginName: map[string]any{"smpt": map[string]any{}}}, `mailer: unknown key "smpt", did you mean "smtp"?`},
+		{"section key", MapConfig{PluginName: map[string]any{"smtp": map[string]any{"host": "localhost"}, "queue": map[string]any{"worker": 2}}}, `mailer.queue: unknown key "worker", did you mean "workers"?`},
+		{"tenant key", MapConfig{PluginName: map[string]any{"tenants": map[string]any{"acme": map[string]any{"form": "a@example.com", "smtp": map[string]any{"host": "localhost"}}}}}, `mailer.tenants.acme: unknown key "form", did you mean "from"?`},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			err := (&Plugin{}).Init(s.config)
+			if err == nil || !strings.Contains(err.Error(), s.expected) {
+				t.Fatalf("Expected %s error, got %v", s.expected, err)
+			}
+		})
+	}
+}
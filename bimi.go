@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var bimiSelectorRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// BIMIConfig defines the BIMI (Brand Indicators for Message Identification)
+// settings of the outgoing messages.
+//
+// BIMI requires the messages to pass DMARC, so they should be DKIM signed by
+// the From domain (see [DKIMSigner], which always covers the BIMI-Selector header).
+type BIMIConfig struct {
+	// Selector is the BIMI DNS record selector ("{selector}._bimi.{domain}"),
+	// sent as "BIMI-Selector" header unless it is "default".
+	Selector string `mapstructure:"selector" json:"selector,omitempty" bson:"selector,omitempty"`
+}
+
+// Validate checks the BIMI configuration for common mistakes.
+func (c BIMIConfig) Validate() error {
+	var errs []error
+
+	if c.Selector == "" {
+		errs = append(errs, errors.New("bimi: selector is required"))
+	} else if !bimiSelectorRegex.MatchString(c.Selector) {
+		errs = append(errs, fmt.Errorf("bimi: selector must be a valid DNS label, got %q", c.Selector))
+	}
+
+	return errors.Join(errs...)
+}
+
+// header returns the BIMI-Selector header value, or an empty string
+// for the default selector which the receivers look up anyway.
+func (c BIMIConfig) header() string {
+	if c.Selector == "" || strings.EqualFold(c.Selector, "default") {
+		return ""
+	}
+
+	return "v=BIMI1; s=" + c.Selector
+}
+
+// BIMI returns a middleware that adds the configured BIMI-Selector header
+// to the messages that don't have one already.
+func BIMI(cfg BIMIConfig) Middleware {
+	value := cfg.header()
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if value == "" || headerValue(m, "BIMI-Selector") != "" {
+				return next.Send(m)
+			}
+
+			m = m.Clone()
+			if m.Headers == nil {
+				m.Headers = map[string]string{}
+			}
+			m.Headers["BIMI-Selector"] = value
+
+			return next.Send(m)
+		})
+	}
+}
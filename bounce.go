@@ -0,0 +1,584 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBounceInterval    = 5 * time.Minute
+	defaultBounceMaxMessages = 100
+	defaultBounceFolder      = "INBOX"
+)
+
+// BounceMailboxConfig defines the bounce mailbox settings, ie. of the
+// mailbox receiving the delivery status notifications (eg. the Return-Path
+// address of the sent messages).
+type BounceMailboxConfig struct {
+	IMAP *IMAPConfig `mapstructure:"imap" json:"imap,omitempty" bson:"imap,omitempty"` // the folder defaults to "INBOX"
+	POP3 *POP3Config `mapstructure:"pop3" json:"pop3,omitempty" bson:"pop3,omitempty"`
+
+	Interval    time.Duration `mapstructure:"interval" json:"interval,omitempty" bson:"interval,omitempty"`             // default to 5m
+	MaxMessages int           `mapstructure:"max_messages" json:"max_messages,omitempty" bson:"max_messages,omitempty"` // max messages processed per poll, default to 100
+
+	// Delete deletes the processed messages, otherwise they are flagged as
+	// seen (IMAP) or remembered until the process restarts (POP3).
+	Delete bool `mapstructure:"delete" json:"delete,omitempty" bson:"delete,omitempty"`
+
+	// RecipientHeader is the optional header of the sent messages with the
+	// recipient address (eg. "X-Recipient"), to identify the complaining
+	// recipient of the feedback reports redacting it (see [ParseComplaint]).
+	RecipientHeader string `mapstructure:"recipient_header" json:"recipient_header,omitempty" bson:"recipient_header,omitempty"`
+
+	// FeedbackSenders are the addresses or domains (including their subdomains)
+	// of the feedback loops whose reports are processed, eg. "staff@hotmail.com"
+	// or "arf.mail.yahoo.com". The complaints are ignored if not set.
+	FeedbackSenders []string `mapstructure:"feedback_senders" json:"feedback_senders,omitempty" bson:"feedback_senders,omitempty"`
+
+	// Redis shares the suppression list between the instances (in-memory if not set).
+	Redis *RedisConfig `mapstructure:"redis" json:"redis,omitempty" bson:"redis,omitempty"`
+
+	// OnBounce is an optional hook called for every failed recipient of
+	// the delivery reports, after its address was suppressed (if permanent).
+	OnBounce func(report *DeliveryReport, recipient DeliveryReportRecipient) `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnComplaint is an optional hook called for every complaining
+	// recipient of the feedback reports, after its address was suppressed.
+	OnComplaint func(report *FeedbackReport, recipient string) `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when the mailbox could not
+	// be polled or a report could not be parsed (or has no recipient).
+	OnError func(err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the bounce mailbox configuration for common mistakes.
+func (c BounceMailboxConfig) Validate() error {
+	var errs []error
+
+	switch {
+	case c.IMAP == nil && c.POP3 == nil:
+		errs = append(errs, errors.New("bounces: either imap or pop3 is required"))
+	case c.IMAP != nil && c.POP3 != nil:
+		errs = append(errs, errors.New("bounces: imap and pop3 are mutually exclusive"))
+	case c.IMAP != nil:
+		errs = append(errs, c.IMAP.Validate())
+	default:
+		errs = append(errs, c.POP3.Validate())
+	}
+
+	if c.Interval < 0 {
+		errs = append(errs, fmt.Errorf("bounces: interval must be positive, got %s", c.Interval))
+	}
+
+	if c.MaxMessages < 0 {
+		errs = append(errs, fmt.Errorf("bounces: max_messages must be positive, got %d", c.MaxMessages))
+	}
+
+	for i, sender := range c.FeedbackSenders {
+		if strings.TrimSpace(sender) == "" {
+			errs = append(errs, fmt.Errorf("bounces: feedback_senders[%d] must not be empty", i))
+		}
+	}
+
+	if c.Redis != nil {
+		if err := c.Redis.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("bounces: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SuppressionList returns the SuppressionList described by the config.
+func (c BounceMailboxConfig) SuppressionList() SuppressionList {
+	if c.Redis != nil {
+		return NewRedisSuppressionList(*c.Redis)
+	}
+
+	return &MemorySuppressionList{}
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c BounceMailboxConfig) Redacted() BounceMailboxConfig {
+	if c.IMAP != nil {
+		imap := c.IMAP.Redacted()
+		c.IMAP = &imap
+	}
+	if c.POP3 != nil {
+		pop3 := c.POP3.Redacted()
+		c.POP3 = &pop3
+	}
+	if c.Redis != nil {
+		redis := c.Redis.Redacted()
+		c.Redis = &redis
+	}
+	c.OnBounce = nil
+	c.OnComplaint = nil
+	c.OnError = nil
+
+	return c
+}
+
+// SentMessages looks up the sent messages, so that the reports received
+// by the bounce mailbox are trusted only when they are about one of them
+// (see [SQLSendLog]).
+type SentMessages interface {
+	// SentRecipients returns the envelope recipients of the message sent
+	// with the Message-ID, none if no such message was sent.
+	SentRecipients(ctx context.Context, messageID string) ([]string, error)
+}
+
+// BouncePoller periodically reads the bounce mailbox over IMAP or POP3,
+// parses the delivery status notifications (see [ParseDeliveryReport])
+// and suppresses the permanently failed recipients.
+//
+// Anyone can send a report to the bounce mailbox, so only the failed
+// recipients of the reports returning the Message-ID of a sent message
+// (see [SentMessages]) that were sent that message are processed.
+//
+// The feedback loop complaints (see [ParseComplaint]) received by the
+// same mailbox from the configured feedback senders suppress the
+// complaining recipients of the sent messages too. The other messages
+// (eg. the auto-replies) are skipped, but still flagged as seen or
+// deleted like the processed reports.
+type BouncePoller struct {
+	config       BounceMailboxConfig
+	suppressions SuppressionList
+	sent         SentMessages
+
+	pollMu sync.Mutex          // serializes the polls
+	seen   map[string]struct{} // the UIDLs of the processed POP3 messages
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewBouncePoller creates a new bounce mailbox poller feeding
+// the suppression list (nil to only call the OnBounce hook)
+// with the reports about the sent messages.
+func NewBouncePoller(config BounceMailboxConfig, suppressions SuppressionList, sent SentMessages) *BouncePoller {
+	if config.Interval <= 0 {
+		config.Interval = defaultBounceInterval
+	}
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = defaultBounceMaxMessages
+	}
+
+	return &BouncePoller{config: config, suppressions: suppressions, sent: sent, seen: map[string]struct{}{}}
+}
+
+// Start polls the mailbox right away and then at the configured
+// interval in the background. It is no-op if the poller is already started.
+func (p *BouncePoller) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started {
+		return
+	}
+	p.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+
+	go p.run(ctx)
+}
+
+// Stop stops polling, waiting for the current poll (up to the ctx deadline) to complete.
+func (p *BouncePoller) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.started {
+		return nil
+	}
+	p.started = false
+	p.cancel()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *BouncePoller) run(ctx context.Context) {
+	defer close(p.done)
+
+	for {
+		if err := p.Poll(ctx); err != nil && ctx.Err() == nil {
+			p.onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.config.Interval):
+		}
+	}
+}
+
+// Poll processes the new messages of the mailbox once.
+func (p *BouncePoller) Poll(ctx context.Context) error {
+	p.pollMu.Lock()
+	defer p.pollMu.Unlock()
+
+	var err error
+	if p.config.IMAP != nil {
+		err = p.pollIMAP(ctx, *p.config.IMAP)
+	} else {
+		err = p.pollPOP3(ctx, *p.config.POP3)
+	}
+	if err != nil {
+		return fmt.Errorf("bounces: %w", err)
+	}
+
+	return nil
+}
+
+func (p *BouncePoller) pollIMAP(ctx context.Context, cfg IMAPConfig) error {
+	if cfg.Folder == "" {
+		cfg.Folder = defaultBounceFolder
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	c, err := dialIMAP(dialCtx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.conn.SetDeadline(time.Now().Add(cfg.timeout()))
+		c.Close()
+	}()
+
+	if _, err := c.Command("SELECT " + imapQuote(imapMailboxName(cfg.Folder))); err != nil {
+		return err
+	}
+
+	responses, err := c.Command("UID SEARCH UNSEEN UNDELETED")
+	if err != nil {
+		return err
+	}
+
+	uids := imapSearchResults(responses)
+	if len(uids) > p.config.MaxMessages {
+		uids = uids[:p.config.MaxMessages]
+	}
+
+	flag := `\Seen`
+	if p.config.Delete {
+		flag = `\Deleted`
+	}
+
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			break
+		}
+		_ = c.conn.SetDeadline(time.Now().Add(cfg.timeout()))
+
+		responses, err := c.Command("UID FETCH " + uid + " BODY.PEEK[]")
+		if err != nil {
+			return err
+		}
+
+		for _, response := range responses {
+			if len(response.Literals) == 0 {
+				continue
+			}
+			if err := p.process(ctx, response.Literals[0]); err != nil {
+				return err
+			}
+		}
+
+		if _, err := c.Command("UID STORE " + uid + " +FLAGS.SILENT (" + flag + ")"); err != nil {
+			return err
+		}
+	}
+
+	if p.config.Delete && len(uids) > 0 {
+		if _, err := c.Command("EXPUNGE"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *BouncePoller) pollPOP3(ctx context.Context, cfg POP3Config) error {
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	c, err := dialPOP3(dialCtx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.conn.SetDeadline(time.Now().Add(cfg.timeout()))
+		c.Close()
+	}()
+
+	uids, err := c.UIDL()
+	if err != nil {
+		return err
+	}
+
+	// forget the messages deleted in the meantime
+	present := make(map[string]struct{}, len(uids))
+	numbers := make([]int, 0, len(uids))
+	for n, uid := range uids {
+		present[uid] = struct{}{}
+		numbers = append(numbers, n)
+	}
+	for uid := range p.seen {
+		if _, ok := present[uid]; !ok {
+			delete(p.seen, uid)
+		}
+	}
+	sort.Ints(numbers)
+
+	processed := 0
+	for _, n := range numbers {
+		if ctx.Err() != nil || processed >= p.config.MaxMessages {
+			break
+		}
+		if _, ok := p.seen[uids[n]]; ok {
+			continue
+		}
+		processed++
+		_ = c.conn.SetDeadline(time.Now().Add(cfg.timeout()))
+
+		raw, err := c.Retrieve(n)
+		if err != nil {
+			return err
+		}
+
+		if err := p.process(ctx, raw); err != nil {
+			return err
+		}
+
+		if p.config.Delete {
+			if err := c.Delete(n); err != nil {
+				return err
+			}
+		} else {
+			p.seen[uids[n]] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// process handles a mailbox message, failing only if the message must be processed again.
+func (p *BouncePoller) process(ctx context.Context, raw []byte) error {
+	report, err := ParseDeliveryReport(bytes.NewReader(raw))
+	if errors.Is(err, ErrNotReport) {
+		return p.processComplaint(ctx, raw)
+	}
+	if err != nil {
+		p.onError(fmt.Errorf("bounces: invalid delivery report: %w", err))
+		return nil
+	}
+
+	sent, err := p.sentRecipients(ctx, report.OriginalMessageID)
+	if err != nil {
+		return err
+	}
+	if sent == nil {
+		p.onError(fmt.Errorf("bounces: the delivery report from %s is not about a sent message", report.ReportingMTA))
+		return nil
+	}
+
+	for _, recipient := range report.Recipients {
+		if recipient.Action != "failed" {
+			continue
+		}
+		if !sent.has(recipient.Recipient) && !sent.has(recipient.OriginalRecipient) {
+			continue // not a recipient of the message
+		}
+
+		if recipient.Permanent() && p.suppressions != nil {
+			detail := recipient.Diagnostic
+			if detail == "" {
+				detail = recipient.Status
+			}
+
+			err := p.suppressions.Suppress(ctx, Suppression{
+				Address: recipient.Recipient,
+				Reason:  SuppressionBounce,
+				Detail:  detail,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to suppress %s: %w", recipient.Recipient, err)
+			}
+		}
+
+		if p.config.OnBounce != nil {
+			p.config.OnBounce(report, recipient)
+		}
+	}
+
+	return nil
+}
+
+// processComplaint handles a feedback loop complaint, failing only if the message must be processed again.
+func (p *BouncePoller) processComplaint(ctx context.Context, raw []byte) error {
+	report, err := ParseComplaint(bytes.NewReader(raw), p.config.RecipientHeader)
+	if errors.Is(err, ErrNotReport) {
+		return nil
+	}
+	if err != nil {
+		p.onError(fmt.Errorf("bounces: invalid feedback report: %w", err))
+		return nil
+	}
+	if !report.IsComplaint() {
+		return nil
+	}
+
+	if sender := reportSender(raw); !p.isFeedbackSender(sender) {
+		p.onError(fmt.Errorf("bounces: the feedback report from %q is not from a feedback sender", sender))
+		return nil
+	}
+
+	sent, err := p.sentRecipients(ctx, report.OriginalMessageID)
+	if err != nil {
+		return err
+	}
+	if sent == nil {
+		p.onError(fmt.Errorf("bounces: the complaint about %q is not about a sent message", report.OriginalMessageID))
+		return nil
+	}
+
+	var recipients []string
+	for _, recipient := range report.OriginalRecipients {
+		if sent.has(recipient) {
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	if len(recipients) == 0 {
+		p.onError(fmt.Errorf("bounces: the complaint about %s has no recipient, set the recipient header", report.OriginalMessageID))
+		return nil
+	}
+
+	for _, recipient := range recipients {
+		if p.suppressions != nil {
+			err := p.suppressions.Suppress(ctx, Suppression{
+				Address: recipient,
+				Reason:  SuppressionComplaint,
+				Detail:  strings.TrimSpace(report.FeedbackType + " " + report.UserAgent),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to suppress %s: %w", recipient, err)
+			}
+		}
+
+		if p.config.OnComplaint != nil {
+			p.config.OnComplaint(report, recipient)
+		}
+	}
+
+	return nil
+}
+
+// isFeedbackSender reports whether the address is one of the configured
+// feedback senders or of their domains.
+func (p *BouncePoller) isFeedbackSender(address string) bool {
+	address = strings.ToLower(address)
+	_, domain, ok := strings.Cut(address, "@")
+	if !ok || domain == "" {
+		return false
+	}
+
+	for _, sender := range p.config.FeedbackSenders {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if strings.Contains(sender, "@") {
+			if address == sender {
+				return true
+			}
+		} else if domain == sender || strings.HasSuffix(domain, "."+sender) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reportSender returns the From address of the report message, if valid.
+func reportSender(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+
+	return from.Address
+}
+
+// sentRecipients returns the recipients of the sent message, nil if the
+// Message-ID is not returned by the report or is not of a sent message.
+func (p *BouncePoller) sentRecipients(ctx context.Context, messageID string) (recipientSet, error) {
+	if messageID == "" || p.sent == nil {
+		return nil, nil
+	}
+
+	recipients, err := p.sent.SentRecipients(ctx, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the sent message %s: %w", messageID, err)
+	}
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	set := make(recipientSet, len(recipients))
+	for _, recipient := range recipients {
+		set[strings.ToLower(recipient)] = struct{}{}
+	}
+
+	return set, nil
+}
+
+// recipientSet is a set of lowercased addresses.
+type recipientSet map[string]struct{}
+
+func (s recipientSet) has(address string) bool {
+	_, ok := s[strings.ToLower(address)]
+
+	return address != "" && ok
+}
+
+func (p *BouncePoller) onError(err error) {
+	if p.config.OnError != nil {
+		p.config.OnError(err)
+	}
+}
+
+// imapSearchResults returns the ids of the SEARCH responses.
+func imapSearchResults(responses []imapResponse) []string {
+	var ids []string
+	for _, response := range responses {
+		fields := strings.Fields(response.Line)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		ids = append(ids, fields[2:]...)
+	}
+
+	return ids
+}
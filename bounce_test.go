@@ -0,0 +1,337 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePOP3Server is a minimal POP3 server for the bounce poller tests.
+type fakePOP3Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []string // the mailbox, deleted messages are empty
+}
+
+func newFakePOP3Server(t *testing.T, messages ...string) *fakePOP3Server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakePOP3Server{ln: ln, messages: messages}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakePOP3Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	_ = text.PrintfLine("+OK POP3 ready")
+
+	deleted := map[int]bool{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		name, arg, _ := strings.Cut(line, " ")
+		n, _ := strconv.Atoi(arg)
+
+		s.mu.Lock()
+		switch strings.ToUpper(name) {
+		case "CAPA":
+			_ = text.PrintfLine("+OK\r\nUSER\r\nUIDL\r\n.")
+		case "USER":
+			_ = text.PrintfLine("+OK")
+		case "PASS":
+			if arg != "secret" {
+				_ = text.PrintfLine("-ERR invalid credentials")
+				break
+			}
+			_ = text.PrintfLine("+OK logged in")
+		case "UIDL":
+			_ = text.PrintfLine("+OK")
+			for i, m := range s.messages {
+				if m != "" && !deleted[i+1] {
+					_ = text.PrintfLine("%d uid-%d", i+1, i+1)
+				}
+			}
+			_ = text.PrintfLine(".")
+		case "RETR":
+			if n < 1 || n > len(s.messages) || s.messages[n-1] == "" {
+				_ = text.PrintfLine("-ERR no such message")
+				break
+			}
+			_ = text.PrintfLine("+OK")
+			w := text.DotWriter()
+			_, _ = w.Write([]byte(s.messages[n-1]))
+			_ = w.Close()
+		case "DELE":
+			deleted[n] = true
+			_ = text.PrintfLine("+OK")
+		case "QUIT":
+			for i := range deleted {
+				s.messages[i-1] = ""
+			}
+			_ = text.PrintfLine("+OK bye")
+			s.mu.Unlock()
+			return
+		default:
+			_ = text.PrintfLine("-ERR unknown command")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sentMessages maps the Message-IDs of the sent messages to their recipients.
+type sentMessages map[string][]string
+
+func (s sentMessages) SentRecipients(_ context.Context, messageID string) ([]string, error) {
+	return s[messageID], nil
+}
+
+// testSentMessages are the sent messages of the sample reports.
+var testSentMessages = sentMessages{
+	"<1@example.com>": {"user@example.com", "other@example.com"},
+	"<2@example.com>": {"user@example.com"},
+	"<3@example.com>": {"user@outlook.com"},
+}
+
+func TestBouncePollerIMAP(t *testing.T) {
+	server := newFakeIMAPServer(t, "secret")
+
+	for _, remove := range []bool{false, true} {
+		t.Run("delete "+strconv.FormatBool(remove), func(t *testing.T) {
+			server.mu.Lock()
+			server.inbox = []*fakeIMAPMessage{
+				{uid: 3, raw: sampleDeliveryReport},
+				{uid: 4, raw: "Subject: Out of office\r\n\r\nI'm away\r\n"},
+				{uid: 5, raw: sampleDeliveryReport, flags: []string{`\Seen`}},
+			}
+			server.mu.Unlock()
+
+			list := &MemorySuppressionList{}
+			var bounces []DeliveryReportRecipient
+
+			poller := NewBouncePoller(BounceMailboxConfig{
+				IMAP:     &IMAPConfig{Host: "127.0.0.1", Port: server.port(), Username: "bounces", Password: "secret"},
+				Delete:   remove,
+				OnBounce: func(_ *DeliveryReport, r DeliveryReportRecipient) { bounces = append(bounces, r) },
+				OnError:  func(err error) { t.Errorf("Unexpected error %v", err) },
+			}, list, testSentMessages)
+
+			if err := poller.Poll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(bounces) != 1 || bounces[0].Recipient != "User@example.com" {
+				t.Fatalf("Expected the bounce of User@example.com, got %+v", bounces)
+			}
+			if s, _ := list.Lookup(context.Background(), "user@example.com"); s == nil || s.Reason != SuppressionBounce || !strings.Contains(s.Detail, "User unknown") {
+				t.Fatalf("Expected the bounce suppression, got %+v", s)
+			}
+			if s, _ := list.Lookup(context.Background(), "other@example.com"); s != nil {
+				t.Fatalf("Expected the delayed recipient not to be suppressed, got %+v", s)
+			}
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+
+			if remove {
+				if len(server.inbox) != 1 || server.inbox[0].uid != 5 {
+					t.Fatalf("Expected the processed messages to be expunged, got %d messages", len(server.inbox))
+				}
+				return
+			}
+			for _, m := range server.inbox {
+				if len(m.flags) != 1 || m.flags[0] != `\Seen` {
+					t.Fatalf("Expected message %d to be seen, got %v", m.uid, m.flags)
+				}
+			}
+		})
+	}
+}
+
+func TestBouncePollerPOP3(t *testing.T) {
+	for _, remove := range []bool{false, true} {
+		t.Run("delete "+strconv.FormatBool(remove), func(t *testing.T) {
+			server := newFakePOP3Server(t, sampleDeliveryReport, "Subject: Out of office\r\n\r\nI'm away\r\n", sampleJMRPReport)
+			port := server.ln.Addr().(*net.TCPAddr).Port
+
+			list := &MemorySuppressionList{}
+			bounces, complaints := 0, 0
+
+			poller := NewBouncePoller(BounceMailboxConfig{
+				POP3:        &POP3Config{Host: "127.0.0.1", Port: port, Username: "bounces", Password: "secret"},
+				Delete:      remove,
+				OnBounce:    func(*DeliveryReport, DeliveryReportRecipient) { bounces++ },
+				OnComplaint: func(*FeedbackReport, string) { complaints++ },
+
+				FeedbackSenders: []string{"hotmail.com"},
+			}, list, testSentMessages)
+
+			// the second poll must skip the already processed messages
+			for i := 0; i < 2; i++ {
+				if err := poller.Poll(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if bounces != 1 || complaints != 1 {
+				t.Fatalf("Expected 1 bounce and 1 complaint, got %d and %d", bounces, complaints)
+			}
+			if s, _ := list.Lookup(context.Background(), "user@example.com"); s == nil {
+				t.Fatal("Expected user@example.com to be suppressed")
+			}
+			if s, _ := list.Lookup(context.Background(), "user@outlook.com"); s == nil || s.Reason != SuppressionComplaint {
+				t.Fatalf("Expected the complaint suppression of user@outlook.com, got %+v", s)
+			}
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+
+			for i, m := range server.messages {
+				if (m == "") != remove {
+					t.Fatalf("Expected message %d deleted %v, got %q", i+1, remove, m)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		server := newFakePOP3Server(t)
+		port := server.ln.Addr().(*net.TCPAddr).Port
+
+		poller := NewBouncePoller(BounceMailboxConfig{
+			POP3: &POP3Config{Host: "127.0.0.1", Port: port, Username: "bounces", Password: "wrong"},
+		}, nil, testSentMessages)
+
+		err := poller.Poll(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+			t.Fatalf("Expected an authentication error, got %v", err)
+		}
+	})
+}
+
+func TestBouncePollerUnsentMessage(t *testing.T) {
+	scenarios := []struct {
+		name string
+		sent sentMessages
+	}{
+		{"unknown message", sentMessages{"<2@example.com>": {"user@example.com"}}},
+		{"other recipient", sentMessages{"<1@example.com>": {"jane@example.com"}}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			server := newFakePOP3Server(t, sampleDeliveryReport)
+			port := server.ln.Addr().(*net.TCPAddr).Port
+
+			list := &MemorySuppressionList{}
+			bounces := 0
+
+			poller := NewBouncePoller(BounceMailboxConfig{
+				POP3:     &POP3Config{Host: "127.0.0.1", Port: port, Username: "bounces", Password: "secret"},
+				OnBounce: func(*DeliveryReport, DeliveryReportRecipient) { bounces++ },
+			}, list, s.sent)
+
+			if err := poller.Poll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if bounces != 0 {
+				t.Fatalf("Expected the report to be ignored, got %d bounces", bounces)
+			}
+			if s, _ := list.Lookup(context.Background(), "user@example.com"); s != nil {
+				t.Fatalf("Expected user@example.com not to be suppressed, got %+v", s)
+			}
+		})
+	}
+}
+
+func TestBouncePollerUntrustedComplaint(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		senders []string
+		sent    sentMessages
+	}{
+		{"no feedback sender", nil, testSentMessages},
+		{"other feedback sender", []string{"staff@hotmail.com.example.net", "yahoo.com"}, testSentMessages},
+		{"unknown message", []string{"staff@hotmail.com"}, sentMessages{"<1@example.com>": {"user@outlook.com"}}},
+		{"other recipient", []string{"staff@hotmail.com"}, sentMessages{"<3@example.com>": {"jane@outlook.com"}}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			server := newFakePOP3Server(t, sampleJMRPReport)
+			port := server.ln.Addr().(*net.TCPAddr).Port
+
+			list := &MemorySuppressionList{}
+			complaints, errs := 0, 0
+
+			poller := NewBouncePoller(BounceMailboxConfig{
+				POP3:            &POP3Config{Host: "127.0.0.1", Port: port, Username: "bounces", Password: "secret"},
+				FeedbackSenders: s.senders,
+				OnComplaint:     func(*FeedbackReport, string) { complaints++ },
+				OnError:         func(error) { errs++ },
+			}, list, s.sent)
+
+			if err := poller.Poll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if complaints != 0 || errs != 1 {
+				t.Fatalf("Expected the report to be reported and ignored, got %d complaints and %d errors", complaints, errs)
+			}
+			if s, _ := list.Lookup(context.Background(), "user@outlook.com"); s != nil {
+				t.Fatalf("Expected user@outlook.com not to be suppressed, got %+v", s)
+			}
+		})
+	}
+}
+
+func TestBounceMailboxConfigValidate(t *testing.T) {
+	imap := &IMAPConfig{Host: "imap.example.com", Username: "bounces"}
+	pop3 := &POP3Config{Host: "pop.example.com", Username: "bounces"}
+
+	scenarios := []struct {
+		name   string
+		config BounceMailboxConfig
+		valid  bool
+	}{
+		{"imap", BounceMailboxConfig{IMAP: imap}, true},
+		{"pop3", BounceMailboxConfig{POP3: pop3}, true},
+		{"missing mailbox", BounceMailboxConfig{}, false},
+		{"both mailboxes", BounceMailboxConfig{IMAP: imap, POP3: pop3}, false},
+		{"invalid pop3", BounceMailboxConfig{POP3: &POP3Config{Host: "pop.example.com"}}, false},
+		{"negative interval", BounceMailboxConfig{IMAP: imap, Interval: -1}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.config.Validate(); (err == nil) != s.valid {
+				t.Fatalf("Expected valid %v, got %v", s.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// MessageBuilder is a fluent [Message] builder.
+//
+// The builder validates every value as it is set and remembers the
+// first error, which is returned by Build. All further calls after an
+// error are no-op.
+//
+//	msg, err := mailer.NewMessage().
+//		From("App <info@example.com>").
+//		To("user@example.com").
+//		Subject("Welcome").
+//		HTMLTemplate("<p>Hello {{.Name}}</p>", data).
+//		Build()
+type MessageBuilder struct {
+	msg Message
+	err error
+}
+
+// NewMessage creates a new message builder.
+func NewMessage() *MessageBuilder {
+	return &MessageBuilder{}
+}
+
+// From sets the message sender (eg. "info@example.com" or "App <info@example.com>").
+func (b *MessageBuilder) From(address string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		b.err = fmt.Errorf("invalid from address %q: %w", address, err)
+		return b
+	}
+	b.msg.From = *addr
+
+	return b
+}
+
+// To adds one or more To recipients.
+//
+// Symbolic recipients (eg. "team:oncall") are accepted as they are
+// and must be expanded with the [ResolveRecipients] middleware.
+func (b *MessageBuilder) To(addresses ...string) *MessageBuilder {
+	b.msg.To = b.appendAddresses("to", b.msg.To, addresses)
+
+	return b
+}
+
+// Cc adds one or more Cc recipients.
+func (b *MessageBuilder) Cc(addresses ...string) *MessageBuilder {
+	b.msg.Cc = b.appendAddresses("cc", b.msg.Cc, addresses)
+
+	return b
+}
+
+// Bcc adds one or more Bcc recipients.
+func (b *MessageBuilder) Bcc(addresses ...string) *MessageBuilder {
+	b.msg.Bcc = b.appendAddresses("bcc", b.msg.Bcc, addresses)
+
+	return b
+}
+
+// Subject sets the message subject.
+func (b *MessageBuilder) Subject(subject string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if strings.ContainsAny(subject, "\r\n") {
+		b.err = errors.New("subject must not contain new lines")
+		return b
+	}
+	b.msg.Subject = subject
+
+	return b
+}
+
+// Preheader sets the message inbox preview text (see [Message.Preheader]).
+func (b *MessageBuilder) Preheader(preheader string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if strings.ContainsAny(preheader, "\r\n") {
+		b.err = errors.New("preheader must not contain new lines")
+		return b
+	}
+	b.msg.Preheader = preheader
+
+	return b
+}
+
+// HTML sets the message HTML body.
+func (b *MessageBuilder) HTML(html string) *MessageBuilder {
+	if b.err == nil {
+		b.msg.HTML = html
+	}
+
+	return b
+}
+
+// AMP sets the message AMP for Email body (see [Message.AMP]).
+func (b *MessageBuilder) AMP(amp string) *MessageBuilder {
+	if b.err == nil {
+		b.msg.AMP = amp
+	}
+
+	return b
+}
+
+// Text sets the message plain text body.
+func (b *MessageBuilder) Text(text string) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Text = text
+	}
+
+	return b
+}
+
+// HTMLTemplate renders the provided html/template source with data and sets it as HTML body.
+func (b *MessageBuilder) HTMLTemplate(source string, data any) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	tpl, err := htmltemplate.New("html").Option("missingkey=error").Parse(source)
+	if err != nil {
+		b.err = fmt.Errorf("invalid html template: %w", err)
+		return b
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		b.err = fmt.Errorf("failed to render html template: %w", err)
+		return b
+	}
+	b.msg.HTML = buf.String()
+
+	return b
+}
+
+// TextTemplate renders the provided text/template source with data and sets it as plain text body.
+func (b *MessageBuilder) TextTemplate(source string, data any) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	tpl, err := texttemplate.New("text").Option("missingkey=error").Parse(source)
+	if err != nil {
+		b.err = fmt.Errorf("invalid text template: %w", err)
+		return b
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		b.err = fmt.Errorf("failed to render text template: %w", err)
+		return b
+	}
+	b.msg.Text = buf.String()
+
+	return b
+}
+
+// Locale sets the message locale (see [Message.Locale]).
+func (b *MessageBuilder) Locale(locale string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if !isLocale(locale) {
+		b.err = fmt.Errorf("invalid locale %q", locale)
+		return b
+	}
+	b.msg.Locale = locale
+
+	return b
+}
+
+// Template renders the named template of the registry with data in
+// the message locale (see [Templates.Render]) and sets the non-empty
+// rendered subject and bodies. The message locale is replaced with the
+// rendered variant one, unless the variant is locale independent.
+//
+// If name is an A/B experiment, the variant of the first To recipient
+// (which must be set before) is rendered instead (see [Templates.Variant])
+// and recorded as "variant:{template}" tag and as "experiment" and
+// "variant" metadata, so that the engagement can be compared downstream.
+func (b *MessageBuilder) Template(templates *Templates, name string, data any) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	var recipient string
+	if len(b.msg.To) > 0 {
+		recipient = b.msg.To[0].Address
+	}
+
+	variant := templates.Variant(name, recipient)
+
+	rendered, err := templates.Render(variant, b.msg.Locale, data)
+	if err != nil {
+		b.err = err
+		return b
+	}
+
+	if variant != name {
+		b.Tag(variantTagPrefix + variant)
+		b.Metadata(experimentMetadata, name)
+		b.Metadata(variantMetadata, variant)
+	}
+
+	if rendered.Subject != "" {
+		b.msg.Subject = rendered.Subject
+	}
+	if rendered.Text != "" {
+		b.msg.Text = rendered.Text
+	}
+	if rendered.HTML != "" {
+		b.msg.HTML = rendered.HTML
+	}
+	if rendered.Locale != "" {
+		b.msg.Locale = rendered.Locale
+	}
+
+	return b
+}
+
+// Date sets the message "Date" header (default to the time of sending).
+func (b *MessageBuilder) Date(date time.Time) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Date = date
+	}
+
+	return b
+}
+
+// InReplyTo threads the message as a reply to the specified Message-ID
+// (see [Message.Thread]).
+func (b *MessageBuilder) InReplyTo(messageID string, references ...string) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Thread(messageID, references...)
+	}
+
+	return b
+}
+
+// Auto marks the message as automatically generated (see [Message.Auto]).
+func (b *MessageBuilder) Auto() *MessageBuilder {
+	if b.err == nil {
+		b.msg.Auto = true
+	}
+
+	return b
+}
+
+// Separate requests an individual copy per recipient (see [Message.Separate]).
+func (b *MessageBuilder) Separate() *MessageBuilder {
+	if b.err == nil {
+		b.msg.Separate = true
+	}
+
+	return b
+}
+
+// HideRecipients hides the To recipients from the message headers
+// (see [Message.HideRecipients]).
+func (b *MessageBuilder) HideRecipients() *MessageBuilder {
+	if b.err == nil {
+		b.msg.HideRecipients = true
+	}
+
+	return b
+}
+
+// Via forces the backend the message is sent through (see [Message.Via]).
+func (b *MessageBuilder) Via(backend string) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Via = backend
+	}
+
+	return b
+}
+
+// Test marks the message as a test one (eg. a template preview sent
+// to the staff), adding the "X-Test" header. The test messages bypass
+// the suppression list (see [Suppressed]).
+func (b *MessageBuilder) Test() *MessageBuilder {
+	if b.err == nil {
+		b.msg.test = true
+		b.Header(testHeader, "true")
+	}
+
+	return b
+}
+
+// Header sets a custom message header.
+func (b *MessageBuilder) Header(name, value string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if name == "" || sanitizeHeaderName(name) != name {
+		b.err = fmt.Errorf("invalid header name %q", name)
+		return b
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		b.err = fmt.Errorf("header %q value must not contain new lines", name)
+		return b
+	}
+
+	if b.msg.Headers == nil {
+		b.msg.Headers = map[string]string{}
+	}
+	b.msg.Headers[name] = value
+
+	return b
+}
+
+// Attach adds an attachment with the specified file name.
+//
+// The reader content is read immediately so that
+// the built message could be safely reused.
+func (b *MessageBuilder) Attach(name string, r io.Reader) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Attachments = b.attach(b.msg.Attachments, "attachment", name, r)
+	}
+
+	return b
+}
+
+// AttachGenerated adds an attachment with the specified file name,
+// generated at send time by the generator (see [GeneratedAttachment]).
+func (b *MessageBuilder) AttachGenerated(name string, generator AttachmentGenerator, ref string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if strings.TrimSpace(name) == "" {
+		b.err = errors.New("attachment name must not be empty")
+		return b
+	}
+	if _, ok := b.msg.Attachments[name]; ok {
+		b.err = fmt.Errorf("duplicated attachment %q", name)
+		return b
+	}
+
+	if b.msg.Attachments == nil {
+		b.msg.Attachments = map[string]io.Reader{}
+	}
+	b.msg.Attachments[name] = GeneratedAttachment(generator, ref)
+
+	return b
+}
+
+// Embed adds an inline attachment (eg. an image) that
+// could be referenced from the HTML body as "cid:{name}".
+//
+// The reader content is read immediately so that
+// the built message could be safely reused.
+func (b *MessageBuilder) Embed(name string, r io.Reader) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if strings.ContainsAny(name, "<>\"\r\n\t ") {
+		b.err = fmt.Errorf("inline attachment name %q must be a valid Content-ID", name)
+		return b
+	}
+
+	b.msg.Inline = b.attach(b.msg.Inline, "inline attachment", name, r)
+
+	return b
+}
+
+func (b *MessageBuilder) attach(attachments map[string]io.Reader, kind, name string, r io.Reader) map[string]io.Reader {
+	if strings.TrimSpace(name) == "" {
+		b.err = fmt.Errorf("%s name must not be empty", kind)
+		return attachments
+	}
+	if _, ok := attachments[name]; ok {
+		b.err = fmt.Errorf("duplicated %s %q", kind, name)
+		return attachments
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		b.err = fmt.Errorf("failed to read %s %q: %w", kind, name, err)
+		return attachments
+	}
+
+	if attachments == nil {
+		attachments = map[string]io.Reader{}
+	}
+	attachments[name] = bytes.NewReader(data)
+
+	return attachments
+}
+
+// Charset sets the message texts charset (see [Message.Charset]),
+// optionally transliterating the characters not representable in it.
+func (b *MessageBuilder) Charset(charset string, transliterate bool) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Charset = charset
+		b.msg.Transliterate = transliterate
+	}
+
+	return b
+}
+
+// Layout sets the message MIME parts nesting (see [MIMELayout]).
+func (b *MessageBuilder) Layout(layout MIMELayout) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Layout = layout
+	}
+
+	return b
+}
+
+// Tag adds one or more message tags.
+func (b *MessageBuilder) Tag(tags ...string) *MessageBuilder {
+	if b.err == nil {
+		b.msg.Tags = append(b.msg.Tags, tags...)
+	}
+
+	return b
+}
+
+// Metadata sets a message metadata key-value pair.
+//
+// The key must be a valid header field name, since the metadata are
+// sent as "X-Metadata-{key}" headers (see [Message.Metadata]).
+func (b *MessageBuilder) Metadata(key, value string) *MessageBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if key == "" || sanitizeHeaderName(key) != key {
+		b.err = fmt.Errorf("invalid metadata key %q", key)
+		return b
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		b.err = fmt.Errorf("metadata %q value must not contain new lines", key)
+		return b
+	}
+
+	if b.msg.Metadata == nil {
+		b.msg.Metadata = map[string]string{}
+	}
+	b.msg.Metadata[key] = value
+
+	return b
+}
+
+// Build returns the built message or the first error that occurred.
+//
+// Every call returns a new independent message, so
+// changing it doesn't affect the builder or other messages.
+func (b *MessageBuilder) Build() (*Message, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if len(b.msg.To)+len(b.msg.Cc)+len(b.msg.Bcc) == 0 {
+		return nil, errors.New("at least one recipient is required")
+	}
+
+	if b.msg.HTML == "" && b.msg.Text == "" {
+		return nil, errors.New("either html or text body is required")
+	}
+
+	if b.msg.AMP != "" && b.msg.HTML == "" {
+		return nil, errors.New("amp body requires a html fallback body")
+	}
+
+	return b.msg.Clone(), nil
+}
+
+func (b *MessageBuilder) appendAddresses(field string, list []mail.Address, addresses []string) []mail.Address {
+	if b.err != nil {
+		return list
+	}
+
+	for _, address := range addresses {
+		// expanded at send time (see [ResolveRecipients])
+		if isSymbolicRecipient(address) {
+			list = append(list, mail.Address{Address: address})
+			continue
+		}
+
+		addr, err := mail.ParseAddress(address)
+		if err != nil {
+			b.err = fmt.Errorf("invalid %s address %q: %w", field, address, err)
+			return list
+		}
+		list = append(list, *addr)
+	}
+
+	return list
+}
@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessageBuilder(t *testing.T) {
+	builder := NewMessage().
+		From("App <info@example.com>").
+		To("a@example.com", "B <b@example.com>").
+		Bcc("c@example.com").
+		Subject("Welcome").
+		HTMLTemplate("<p>Hello {{.Name}}</p>", map[string]string{"Name": "<John>"}).
+		Text("Hello").
+		Header("X-Custom", "1").
+		Tag("welcome").
+		Metadata("user_id", "42").
+		Attach("test.txt", strings.NewReader("test"))
+
+	m1, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if m1.From.Name != "App" || m1.From.Address != "info@example.com" {
+		t.Fatalf("Unexpected from %v", m1.From)
+	}
+	if len(m1.To) != 2 || m1.To[1].Name != "B" {
+		t.Fatalf("Unexpected to %v", m1.To)
+	}
+	if m1.HTML != "<p>Hello &lt;John&gt;</p>" {
+		t.Fatalf("Expected escaped html body, got %s", m1.HTML)
+	}
+
+	// each build must return an independent message
+	m2, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	m1.To[0].Address = "changed@example.com"
+	m1.Headers["X-Custom"] = "changed"
+	m1.Metadata["user_id"] = "changed"
+	m1.Tags[0] = "changed"
+	data1, _ := io.ReadAll(m1.Attachments["test.txt"])
+	data2, _ := io.ReadAll(m2.Attachments["test.txt"])
+
+	if m2.To[0].Address != "a@example.com" || m2.Headers["X-Custom"] != "1" || m2.Metadata["user_id"] != "42" || m2.Tags[0] != "welcome" {
+		t.Fatal("Expected the second message to not be affected by the first one changes")
+	}
+	if string(data1) != "test" || string(data2) != "test" {
+		t.Fatalf("Expected both attachments to be readable, got %q and %q", data1, data2)
+	}
+}
+
+func TestMessageBuilderErrors(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		builder *MessageBuilder
+	}{
+		{"invalid from", NewMessage().From("invalid").To("a@example.com").Text("test")},
+		{"invalid to", NewMessage().To("invalid").Text("test")},
+		{"no recipients", NewMessage().Text("test")},
+		{"no body", NewMessage().To("a@example.com")},
+		{"amp without html", NewMessage().To("a@example.com").Text("test").AMP("<html amp4email></html>")},
+		{"subject with new line", NewMessage().To("a@example.com").Subject("a\r\nBcc: x@example.com").Text("test")},
+		{"header injection", NewMessage().To("a@example.com").Header("X-Test", "a\nb").Text("test")},
+		{"invalid header name", NewMessage().To("a@example.com").Header("X Test", "a").Text("test")},
+		{"invalid metadata key", NewMessage().To("a@example.com").Metadata("user id:", "42").Text("test")},
+		{"empty metadata key", NewMessage().To("a@example.com").Metadata("", "42").Text("test")},
+		{"metadata injection", NewMessage().To("a@example.com").Metadata("user_id", "42\r\nBcc: x@example.com").Text("test")},
+		{"missing template key", NewMessage().To("a@example.com").HTMLTemplate("{{.Missing}}", map[string]string{})},
+		{"duplicated attachment", NewMessage().To("a@example.com").Text("test").Attach("a", strings.NewReader("")).Attach("a", strings.NewReader(""))},
+	}
+
+	for _, s := range scenarios {
+		if _, err := s.builder.Build(); err == nil {
+			t.Fatalf("[%s] Expected error, got nil", s.name)
+		}
+	}
+}
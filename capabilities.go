@@ -0,0 +1,78 @@
+package mailer
+
+// Capabilities describes the optional message features delivered by a
+// mailer backend, so that the generic code could degrade gracefully
+// (eg. link the files instead of attaching them) rather than the
+// features being silently dropped.
+type Capabilities struct {
+	Attachments bool `json:"attachments"` // delivers the message Attachments
+	Inline      bool `json:"inline"`      // delivers the Inline attachments (eg. images referenced as "cid:{name}")
+	Scheduling  bool `json:"scheduling"`  // delivers the messages at a later time
+	Tags        bool `json:"tags"`        // delivers the message Tags and Metadata (eg. as headers)
+	Batch       bool `json:"batch"`       // sends many messages efficiently (eg. over pooled connections)
+}
+
+// Capable is implemented by the mailers that report their [Capabilities].
+type Capable interface {
+	Capabilities() Capabilities
+}
+
+// renderedCapabilities are the capabilities of the mailers
+// delivering the whole rendered message (eg. over SMTP).
+var renderedCapabilities = Capabilities{Attachments: true, Inline: true, Tags: true}
+
+// CapabilitiesOf returns the capabilities of the mailer. The mailers that
+// don't implement [Capable] (eg. a [MailerFunc]) are assumed to deliver
+// the whole rendered message, ie. without scheduling and batch support.
+func CapabilitiesOf(m Mailer) Capabilities {
+	if capable, ok := m.(Capable); ok {
+		return capable.Capabilities()
+	}
+
+	return renderedCapabilities
+}
+
+// commonCapabilities returns the capabilities supported by all
+// mailers, or no capabilities if there are no mailers.
+func commonCapabilities(mailers []Mailer) Capabilities {
+	if len(mailers) == 0 {
+		return Capabilities{}
+	}
+
+	caps := CapabilitiesOf(mailers[0])
+	for _, mailer := range mailers[1:] {
+		caps = caps.Intersect(CapabilitiesOf(mailer))
+	}
+
+	return caps
+}
+
+// Intersect returns the capabilities supported by both c and other
+// (eg. of the mailers a message could be sent with).
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	return Capabilities{
+		Attachments: c.Attachments && other.Attachments,
+		Inline:      c.Inline && other.Inline,
+		Scheduling:  c.Scheduling && other.Scheduling,
+		Tags:        c.Tags && other.Tags,
+		Batch:       c.Batch && other.Batch,
+	}
+}
+
+// Unsupported returns the names of the message features that are not
+// supported (ie. "attachments", "inline" or "tags"), or nil if there is none.
+func (c Capabilities) Unsupported(m *Message) []string {
+	var result []string
+
+	if len(m.Attachments) > 0 && !c.Attachments {
+		result = append(result, "attachments")
+	}
+	if len(m.Inline) > 0 && !c.Inline {
+		result = append(result, "inline")
+	}
+	if (len(m.Tags) > 0 || len(m.Metadata) > 0) && !c.Tags {
+		result = append(result, "tags")
+	}
+
+	return result
+}
@@ -0,0 +1,72 @@
+package mailer
+
+import (
+	"io"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapabilitiesOf(t *testing.T) {
+	noop := MailerFunc(func(m *Message) error { return nil })
+
+	tenants := NewTenantMailer(&SmtpClient{PoolSize: 1})
+	if err := tenants.Add("acme", LogMailer{}, mail.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name     string
+		mailer   Mailer
+		expected Capabilities
+	}{
+		{"smtp", SmtpClient{}, Capabilities{Attachments: true, Inline: true, Tags: true}},
+		{"pooled smtp", SmtpClient{PoolSize: 2}, Capabilities{Attachments: true, Inline: true, Tags: true, Batch: true}},
+		{"sendmail", SendMail{}, Capabilities{Attachments: true, Inline: true, Tags: true}},
+		{"log", LogMailer{}, Capabilities{Tags: true}},
+		{"null", &NullMailer{}, Capabilities{Attachments: true, Inline: true, Tags: true, Batch: true}},
+		{"not capable", noop, Capabilities{Attachments: true, Inline: true, Tags: true}},
+		{"tee", NewTeeMailer(&NullMailer{}, LogMailer{}), Capabilities{Tags: true}},
+		{"empty tee", NewTeeMailer(), Capabilities{}},
+		{"tenants", tenants, Capabilities{Tags: true}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if caps := CapabilitiesOf(s.mailer); caps != s.expected {
+				t.Fatalf("Expected %+v, got %+v", s.expected, caps)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesUnsupported(t *testing.T) {
+	m := &Message{
+		Attachments: map[string]io.Reader{"a.txt": strings.NewReader("a")},
+		Inline:      map[string]io.Reader{"logo.png": strings.NewReader("png")},
+		Metadata:    map[string]string{"user": "1"},
+	}
+
+	scenarios := []struct {
+		name         string
+		capabilities Capabilities
+		expected     []string
+	}{
+		{"none", Capabilities{}, []string{"attachments", "inline", "tags"}},
+		{"rendered", renderedCapabilities, nil},
+		{"log", LogMailer{}.Capabilities(), []string{"attachments", "inline"}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if got := s.capabilities.Unsupported(m); !reflect.DeepEqual(got, s.expected) {
+				t.Fatalf("Expected %v, got %v", s.expected, got)
+			}
+		})
+	}
+
+	if got := (Capabilities{}).Unsupported(&Message{Text: "plain"}); got != nil {
+		t.Fatalf("Expected a plain message to need no capabilities, got %v", got)
+	}
+}
@@ -0,0 +1,266 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The supported message charsets (see [Message.Charset]).
+const (
+	CharsetUTF8   = "UTF-8"
+	CharsetLatin1 = "ISO-8859-1"
+	CharsetASCII  = "US-ASCII"
+)
+
+// charsetName returns the canonical name of the message charset.
+func (m *Message) charsetName() string {
+	switch strings.ToUpper(strings.TrimSpace(m.Charset)) {
+	case "", "UTF-8", "UTF8":
+		return CharsetUTF8
+	case "ISO-8859-1", "LATIN1", "LATIN-1":
+		return CharsetLatin1
+	case "US-ASCII", "ASCII":
+		return CharsetASCII
+	default:
+		return m.Charset
+	}
+}
+
+// charsetMax returns the max rune representable in the charset.
+func charsetMax(charset string) rune {
+	switch charset {
+	case CharsetASCII:
+		return unicode.MaxASCII
+	case CharsetLatin1:
+		return unicode.MaxLatin1
+	default:
+		return unicode.MaxRune
+	}
+}
+
+// applyCharset returns a copy of the message with all its texts converted
+// to the runes representable in the message charset (transliterating the
+// other ones if [Message.Transliterate] is set), or the message itself
+// for the UTF-8 ones.
+//
+// It returns an error for the unsupported charsets and for the
+// non-representable texts when the transliteration is disabled.
+func (m *Message) applyCharset() (*Message, error) {
+	charset := m.charsetName()
+	if charset == CharsetUTF8 {
+		return m, nil
+	}
+
+	if charset != CharsetLatin1 && charset != CharsetASCII {
+		return nil, fmt.Errorf("unsupported charset %q, expected %q, %q or %q", m.Charset, CharsetUTF8, CharsetLatin1, CharsetASCII)
+	}
+
+	max := charsetMax(charset)
+
+	var err error
+	convert := func(field, s string) string {
+		converted, ok := convertText(s, max, m.Transliterate)
+		if !ok && err == nil {
+			err = fmt.Errorf("%s contains characters not representable in %s", field, charset)
+		}
+		return converted
+	}
+
+	clone := m.Clone()
+
+	clone.Subject = convert("subject", clone.Subject)
+	clone.Text = convert("text body", clone.Text)
+	clone.HTML = convert("html body", clone.HTML)
+	clone.AMP = convert("amp body", clone.AMP)
+	clone.From.Name = convert("from name", clone.From.Name)
+
+	for _, list := range [][]mail.Address{clone.To, clone.Cc, clone.Bcc} {
+		for i := range list {
+			list[i].Name = convert("recipient name", list[i].Name)
+		}
+	}
+
+	for k, v := range clone.Headers {
+		clone.Headers[k] = convert(k+" header", v)
+	}
+
+	// the names already representable are kept, the converted ones
+	// get a suffix when they collide with another one (eg. "Résumé.pdf"
+	// and "Resume.pdf" are sent as "Resume-2.pdf" and "Resume.pdf")
+	taken := map[string]struct{}{}
+	for _, attachments := range []map[string]io.Reader{clone.Attachments, clone.Inline} {
+		for name := range attachments {
+			if isRepresentable(name, max) {
+				taken[strings.ToLower(name)] = struct{}{}
+			}
+		}
+	}
+
+	for _, attachments := range []map[string]io.Reader{clone.Attachments, clone.Inline} {
+		for _, name := range sortedNames(attachments) {
+			if isRepresentable(name, max) {
+				continue
+			}
+
+			r := attachments[name]
+			delete(attachments, name)
+			attachments[uniqueAttachmentName(convert("attachment name", name), taken)] = r
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+// uniqueAttachmentName returns the name, suffixed before its extension
+// if it is already taken (case-insensitively), and marks it as taken.
+func uniqueAttachmentName(name string, taken map[string]struct{}) string {
+	unique := name
+	for i := 2; ; i++ {
+		if _, ok := taken[strings.ToLower(unique)]; !ok {
+			break
+		}
+
+		ext := path.Ext(name)
+		unique = strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(i) + ext
+	}
+	taken[strings.ToLower(unique)] = struct{}{}
+
+	return unique
+}
+
+// convertText replaces the runes greater than max with their transliteration
+// (or "?" if there is none) when transliterate is set, reporting whether
+// the text is fully representable otherwise.
+func convertText(s string, max rune, transliterate bool) (string, bool) {
+	if isRepresentable(s, max) {
+		return s, true
+	}
+
+	if !transliterate {
+		return s, false
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	for _, r := range s {
+		if r <= max {
+			sb.WriteRune(r)
+			continue
+		}
+
+		// all transliterations are ASCII
+		t, ok := transliterations[r]
+		if !ok {
+			t = "?"
+		}
+		sb.WriteString(t)
+	}
+
+	return sb.String(), true
+}
+
+func isRepresentable(s string, max rune) bool {
+	for _, r := range s {
+		if r > max || r == utf8.RuneError {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeCharset returns the bytes of the already converted
+// (see [Message.applyCharset]) text in the specified charset.
+func encodeCharset(charset, s string) string {
+	if charset != CharsetLatin1 {
+		return s // UTF-8 or ASCII
+	}
+
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+
+	return string(b)
+}
+
+// transliterations maps the common non-ASCII characters to their ASCII approximations.
+//
+// The unmapped characters are replaced with "?".
+var transliterations = func() map[rune]string {
+	result := map[rune]string{
+		// typography
+		'‘': "'", '’': "'", '‚': "'", '′': "'", '“': `"`, '”': `"`, '„': `"`, '″': `"`,
+		'«': "<<", '»': ">>", '‹': "<", '›': ">", '–': "-", '—': "-", '−': "-", '‐': "-",
+		'…': "...", '•': "*", '·': ".", '\u00a0': " ", '\u2009': " ", '\u202f': " ", '™': "(TM)",
+		'©': "(C)", '®': "(R)", '°': "deg", '×': "x", '÷': "/", '±': "+/-", '€': "EUR",
+		'£': "GBP", '¥': "JPY", '¢': "c", '§': "S", '¶': "P", '¿': "?", '¡': "!",
+		'½': "1/2", '¼': "1/4", '¾': "3/4", '¹': "1", '²': "2", '³': "3", 'µ': "u",
+		// ligatures and special letters
+		'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss", 'Þ': "Th", 'þ': "th",
+		'Ð': "D", 'ð': "d", 'Ø': "O", 'ø': "o", 'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d",
+		'ı': "i", 'Ħ': "H", 'ħ': "h",
+	}
+
+	// the Latin letters with diacritics
+	for base, letters := range map[string]string{
+		"A": "ÀÁÂÃÄÅĀĂĄǍ", "a": "àáâãäåāăąǎ", "C": "ÇĆĈĊČ", "c": "çćĉċč",
+		"D": "Ď", "d": "ď", "E": "ÈÉÊËĒĔĖĘĚ", "e": "èéêëēĕėęě",
+		"G": "ĜĞĠĢ", "g": "ĝğġģ", "H": "Ĥ", "h": "ĥ", "I": "ÌÍÎÏĨĪĬĮİ", "i": "ìíîïĩīĭį",
+		"J": "Ĵ", "j": "ĵ", "K": "Ķ", "k": "ķ", "L": "ĹĻĽĿ", "l": "ĺļľŀ",
+		"N": "ÑŃŅŇ", "n": "ñńņň", "O": "ÒÓÔÕÖŌŎŐ", "o": "òóôõöōŏő",
+		"R": "ŔŖŘ", "r": "ŕŗř", "S": "ŚŜŞŠȘ", "s": "śŝşšș", "T": "ŢŤȚ", "t": "ţťț",
+		"U": "ÙÚÛÜŨŪŬŮŰŲ", "u": "ùúûüũūŭůűų", "W": "Ŵ", "w": "ŵ", "Y": "ÝŸŶ", "y": "ýÿŷ",
+		"Z": "ŹŻŽ", "z": "źżž",
+	} {
+		for _, r := range letters {
+			result[r] = base
+		}
+	}
+
+	// Cyrillic (scientific transliteration, simplified)
+	cyrillic := map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+		'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+		'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "h", 'ц': "ts",
+		'ч': "ch", 'ш': "sh", 'щ': "sht", 'ъ': "a", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+		'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u",
+	}
+	for r, t := range cyrillic {
+		result[r] = t
+		if upper := unicode.ToUpper(r); upper != r {
+			if t == "" {
+				result[upper] = ""
+			} else {
+				result[upper] = strings.ToUpper(t[:1]) + t[1:]
+			}
+		}
+	}
+
+	// Greek
+	greek := map[rune]string{
+		'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+		'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+		'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+		'ω': "o",
+	}
+	for r, t := range greek {
+		result[r] = t
+		if upper := unicode.ToUpper(r); upper != r {
+			result[upper] = strings.ToUpper(t[:1]) + t[1:]
+		}
+	}
+
+	return result
+}()
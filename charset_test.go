@@ -0,0 +1,110 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessageCharset(t *testing.T) {
+	newMessage := func(charset string, transliterate bool) *Message {
+		return &Message{
+			From:          mail.Address{Name: "Jörg Müller", Address: "from@example.com"},
+			To:            []mail.Address{{Address: "to@example.com"}},
+			Subject:       "Café — Смета",
+			Text:          "Grüße “Иван”",
+			Charset:       charset,
+			Transliterate: transliterate,
+			Attachments:   map[string]io.Reader{"Смета.txt": strings.NewReader("data")},
+		}
+	}
+
+	scenarios := []struct {
+		charset       string
+		transliterate bool
+		subject       string
+		text          string
+		attachment    string
+	}{
+		{"", false, "Café — Смета", "Grüße “Иван”", "Смета.txt"},
+		{"latin1", true, "Café - Smeta", `Grüße "Ivan"`, "Smeta.txt"},
+		{"us-ascii", true, "Cafe - Smeta", `Grusse "Ivan"`, "Smeta.txt"},
+	}
+
+	for _, s := range scenarios {
+		raw, err := newTestRenderer().Render(newMessage(s.charset, s.transliterate))
+		if err != nil {
+			t.Fatalf("[%s] %v", s.charset, err)
+		}
+
+		m := newMessage(s.charset, s.transliterate)
+		if expected := "charset=" + m.charsetName(); !bytes.Contains(raw, []byte(expected)) {
+			t.Fatalf("[%s] Expected %q, got\n%s", s.charset, expected, raw)
+		}
+		if m.charsetName() == CharsetASCII && !isASCII(string(raw)) {
+			t.Fatalf("[%s] Expected only ASCII characters, got\n%s", s.charset, raw)
+		}
+
+		parsed, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("[%s] %v", s.charset, err)
+		}
+		if parsed.Subject != s.subject {
+			t.Errorf("[%s] Expected subject %q, got %q", s.charset, s.subject, parsed.Subject)
+		}
+		if parsed.Text != s.text {
+			t.Errorf("[%s] Expected text %q, got %q", s.charset, s.text, parsed.Text)
+		}
+		if _, ok := parsed.Attachments[s.attachment]; !ok {
+			t.Errorf("[%s] Expected attachment %q, got %v", s.charset, s.attachment, parsed.Attachments)
+		}
+	}
+
+	if _, err := newTestRenderer().Render(newMessage("latin1", false)); err == nil {
+		t.Fatal("Expected not representable text error")
+	}
+	if _, err := newTestRenderer().Render(newMessage("koi8-r", true)); err == nil {
+		t.Fatal("Expected unsupported charset error")
+	}
+}
+
+func TestMessageCharsetAttachmentCollisions(t *testing.T) {
+	m := &Message{
+		Charset:       CharsetASCII,
+		Transliterate: true,
+		Attachments: map[string]io.Reader{
+			"Resume.pdf":  strings.NewReader("original"),
+			"Résumé.pdf":  strings.NewReader("transliterated"),
+			"Rèsumè.pdf":  strings.NewReader("second"),
+			"Смета.txt":   strings.NewReader("smeta"),
+			"smeta-2.txt": strings.NewReader("taken"),
+		},
+		Inline: map[string]io.Reader{"Smeta.txt": strings.NewReader("inline")},
+	}
+
+	converted, err := m.applyCharset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"Resume.pdf":   "original",
+		"Resume-2.pdf": "second", // "Rèsumè.pdf" sorts before "Résumé.pdf"
+		"Resume-3.pdf": "transliterated",
+		"smeta-2.txt":  "taken",
+		"Smeta-3.txt":  "smeta",
+	}
+	if len(converted.Attachments) != len(expected) {
+		t.Fatalf("Expected the attachments %v, got %v", expected, converted.Attachments)
+	}
+	for name, content := range expected {
+		if data, _ := io.ReadAll(converted.Attachments[name]); string(data) != content {
+			t.Fatalf("Expected attachment %q with %q, got %q", name, content, data)
+		}
+	}
+	if _, ok := converted.Inline["Smeta.txt"]; !ok {
+		t.Fatalf("Expected the inline name to be kept, got %v", converted.Inline)
+	}
+}
@@ -0,0 +1,64 @@
+package mailer
+
+import (
+	"time"
+)
+
+// Clock provides the current time, allowing it to be faked in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc is an adapter to allow the use of ordinary functions as [Clock].
+type ClockFunc func() time.Time
+
+// Now implements [Clock] interface.
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the default [Clock] backed by time.Now.
+var SystemClock Clock = ClockFunc(time.Now)
+
+// now returns the current time of the specified clock, falling back to the system one.
+func now(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+
+	return clock.Now()
+}
+
+// TimerClock is a [Clock] also providing the timers of the waits
+// (eg. a fake clock firing them as its time is advanced in tests).
+// The waits of the other clocks use the system timers.
+type TimerClock interface {
+	Clock
+
+	// After returns a channel receiving the time once d elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// newTimer returns a channel receiving the time once d elapsed
+// on the clock, along with a function stopping the timer.
+func newTimer(clock Clock, d time.Duration) (<-chan time.Time, func()) {
+	if tc, ok := clock.(TimerClock); ok {
+		return tc.After(d), func() {}
+	}
+
+	t := time.NewTimer(d)
+
+	return t.C, func() { t.Stop() }
+}
+
+// sleep waits for d to elapse on the clock.
+func sleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	c, stop := newTimer(clock, d)
+	defer stop()
+
+	<-c
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+
+	attachment := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(attachment, []byte("report"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	eml := "From: old@example.com\r\nTo: old@example.com\r\nSubject: Old\r\n\r\nstdin body\r\n"
+
+	scenarios := []struct {
+		name     string
+		args     []string
+		stdin    string
+		code     int
+		expected []string // the expected stdout parts
+	}{
+		{"usage", nil, "", 2, nil},
+		{"unknown command", []string{"deliver"}, "", 2, nil},
+		{"dump", []string{"dump", "-from", "app@example.com", "-to", "a@example.com", "-to", "b@example.com", "-subject", "Hello", "-header", "X-Campaign: weekly", "-attach", attachment}, "stdin body", 0, []string{"Subject: Hello", "b@example.com", "X-Campaign: weekly", "stdin body", "report.txt"}},
+		{"dump eml", []string{"dump", "-eml", "-to", "new@example.com", "-subject", "New"}, eml, 0, []string{"Subject: New", "To: new@example.com", "stdin body"}},
+		{"invalid header", []string{"dump", "-to", "a@example.com", "-header", "X-Campaign", "-text", "hi"}, "", 1, nil},
+		{"missing recipient", []string{"dump", "-text", "hi"}, "", 1, nil},
+		{"send", []string{"send", "-dsn", "maildir://" + filepath.ToSlash(dir) + "/Maildir", "-from", "app@example.com", "-to", "a@example.com", "-subject", "Hello"}, "stdin body", 0, []string{"sent"}},
+		{"send without backend", []string{"send", "-to", "a@example.com", "-text", "hi"}, "", 1, nil},
+		{"ping", []string{"ping", "-dsn", "null://"}, "", 0, []string{"ok"}},
+		{"unexpected argument", []string{"ping", "-dsn", "null://", "extra"}, "", 2, nil},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			code := run(s.args, strings.NewReader(s.stdin), &stdout, &stderr)
+			if code != s.code {
+				t.Fatalf("Expected exit code %d, got %d: %s", s.code, code, stderr.String())
+			}
+			for _, part := range s.expected {
+				if !strings.Contains(stdout.String(), part) {
+					t.Fatalf("Expected %q in the output, got %s", part, stdout.String())
+				}
+			}
+		})
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "Maildir", "new", "*"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 delivered message, got %d", len(files))
+	}
+}
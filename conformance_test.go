@@ -0,0 +1,159 @@
+package mailer_test
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rumorshub/mailer"
+	"github.com/rumorshub/mailer/mailertest"
+)
+
+func TestSmtpClientConformance(t *testing.T) {
+	for _, poolSize := range []int{0, 2} {
+		t.Run("pool_size="+strconv.Itoa(poolSize), func(t *testing.T) {
+			mailertest.RunMailerTests(t, func(t *testing.T) (mailer.Mailer, func() []mailertest.Message) {
+				server := newTestSmtpServer(t, "8BITMIME")
+
+				client, err := mailer.NewSmtpClient(server.Host(), mailer.WithPort(server.Port()), mailer.WithPool(poolSize))
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { client.Close() })
+
+				return client, server.Messages
+			})
+		})
+	}
+}
+
+// testBackendMaildirEnv is set for the test binary started as an external
+// backend, to the path of the Maildir it delivers the messages to.
+const testBackendMaildirEnv = "MAILER_TEST_BACKEND_MAILDIR"
+
+// testBackendSlowEnv is set for the test binary started as an external
+// backend whose sends take 200ms and pings a second.
+const testBackendSlowEnv = "MAILER_TEST_BACKEND_SLOW"
+
+// slowMailer is a Maildir mailer whose sends take 200ms and pings a second.
+type slowMailer struct {
+	mailer.MaildirMailer
+}
+
+func (m slowMailer) Send(msg *mailer.Message) error {
+	time.Sleep(200 * time.Millisecond)
+
+	return m.MaildirMailer.Send(msg)
+}
+
+func (m slowMailer) Ping(ctx context.Context) error {
+	time.Sleep(time.Second)
+
+	return nil
+}
+
+func init() {
+	if path := os.Getenv(testBackendMaildirEnv); path != "" {
+		var m mailer.Mailer = mailer.MaildirMailer{Path: path}
+		if os.Getenv(testBackendSlowEnv) != "" {
+			m = slowMailer{MaildirMailer: mailer.MaildirMailer{Path: path}}
+		}
+
+		if err := mailer.ServeBackend(m); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+}
+
+func TestMaildirMailerConformance(t *testing.T) {
+	mailertest.RunMailerTests(t, func(t *testing.T) (mailer.Mailer, func() []mailertest.Message) {
+		client := mailer.MaildirMailer{Path: filepath.Join(t.TempDir(), "Maildir")}
+
+		return client, maildirMessages(t, client.Path)
+	})
+}
+
+func TestExternalMailerConformance(t *testing.T) {
+	mailertest.RunMailerTests(t, func(t *testing.T) (mailer.Mailer, func() []mailertest.Message) {
+		path := filepath.Join(t.TempDir(), "Maildir")
+
+		client, err := mailer.NewExternalMailer(mailer.ExternalConfig{
+			Cmd: os.Args[0],
+			// don't wait for the race detector reports on exit (1s by default)
+			Env: []string{testBackendMaildirEnv + "=" + path, "GORACE=atexit_sleep_ms=0"},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		if err := client.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if caps := mailer.CapabilitiesOf(client); caps != mailer.CapabilitiesOf(mailer.MaildirMailer{}) {
+			t.Fatalf("Expected the capabilities of the backend process mailer, got %+v", caps)
+		}
+
+		return client, maildirMessages(t, path)
+	})
+}
+
+func TestExternalMailerPingTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Maildir")
+
+	client, err := mailer.NewExternalMailer(mailer.ExternalConfig{
+		Cmd: os.Args[0],
+		Env: []string{testBackendMaildirEnv + "=" + path, testBackendSlowEnv + "=1", "GORACE=atexit_sleep_ms=0"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the send in flight during the ping timeout is not affected
+	sent := make(chan error, 1)
+	go func() {
+		m := &mailer.Message{From: mail.Address{Address: "app@example.com"}, To: []mail.Address{{Address: "john@example.com"}}, Subject: "Hello", Text: "Hello"}
+		sent <- client.Send(m)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Ping(ctx); err == nil {
+		t.Fatal("Expected the ping to time out")
+	}
+	if err := client.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the expired deadline error, got %v", err)
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatalf("Expected the in-flight send to succeed, got %v", err)
+	}
+	if n := len(maildirMessages(t, path)()); n != 1 {
+		t.Fatalf("Expected 1 message, got %d", n)
+	}
+}
+
+// maildirMessages returns a function reading the new messages of the Maildir at path.
+func maildirMessages(t *testing.T, path string) func() []mailertest.Message {
+	return func() []mailertest.Message {
+		entries, _ := os.ReadDir(filepath.Join(path, "new"))
+
+		messages := make([]mailertest.Message, 0, len(entries))
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(path, "new", entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, mailertest.Message{Data: data})
+		}
+
+		return messages
+	}
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+)
+
+var _ CredentialsProvider = (*StaticCredentials)(nil)
+
+// Credentials holds the data used to authenticate against the mail server.
+type Credentials struct {
+	Username string
+	Password string
+
+	// Token is an OAuth2 access token.
+	// When set, the XOAUTH2 mechanism is used instead of the password.
+	Token string
+}
+
+// CredentialsProvider fetches the credentials on demand,
+// allowing them to be stored in an external secrets manager
+// (Vault, AWS Secrets Manager, etc.) or rotated at runtime.
+//
+// Implementations are called on every connection and should
+// cache the credentials if fetching them is expensive.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (*Credentials, error)
+}
+
+// CredentialsProviderFunc is an adapter to allow the use of ordinary functions as [CredentialsProvider].
+type CredentialsProviderFunc func(ctx context.Context) (*Credentials, error)
+
+// Credentials implements [CredentialsProvider] interface.
+func (f CredentialsProviderFunc) Credentials(ctx context.Context) (*Credentials, error) {
+	return f(ctx)
+}
+
+// StaticCredentials is a [CredentialsProvider] that always returns the same credentials.
+type StaticCredentials Credentials
+
+// Credentials implements [CredentialsProvider] interface.
+func (c *StaticCredentials) Credentials(_ context.Context) (*Credentials, error) {
+	creds := Credentials(*c)
+
+	return &creds, nil
+}
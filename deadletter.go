@@ -0,0 +1,152 @@
+package mailer
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned when the requested dead letter does not exist.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeliveryAttempt describes a single failed delivery attempt.
+type DeliveryAttempt struct {
+	At  time.Time
+	Err error
+}
+
+// DeadLetter is a queued message that failed to be delivered.
+type DeadLetter struct {
+	ID            string
+	CorrelationID string // the id set with [WithCorrelationID]
+	Message       *Message
+	Err           error     // the last delivery error
+	FailedAt      time.Time // the last delivery attempt time
+	Attempts      []DeliveryAttempt
+}
+
+func newDeadLetter(job *queueJob) *DeadLetter {
+	last := job.attempts[len(job.attempts)-1]
+
+	return &DeadLetter{
+		ID:            job.id,
+		CorrelationID: job.correlationID,
+		Message:       job.message,
+		Err:           last.Err,
+		FailedAt:      last.At,
+		Attempts:      append([]DeliveryAttempt(nil), job.attempts...),
+	}
+}
+
+// DeadLetters returns the messages that failed to be delivered, oldest first.
+func (q *Queue) DeadLetters() []*DeadLetter {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	result := make([]*DeadLetter, len(q.deadLetters))
+	for i, job := range q.deadLetters {
+		result[i] = newDeadLetter(job)
+	}
+
+	return result
+}
+
+// DeadLetter returns the dead letter with the specified id.
+func (q *Queue) DeadLetter(id string) (*DeadLetter, error) {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	for _, job := range q.deadLetters {
+		if job.id == id {
+			return newDeadLetter(job), nil
+		}
+	}
+
+	return nil, ErrDeadLetterNotFound
+}
+
+// RetryDeadLetter moves the dead letter with the specified id back into the queue.
+func (q *Queue) RetryDeadLetter(id string) error {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	for i, job := range q.deadLetters {
+		if job.id != id {
+			continue
+		}
+
+		if err := q.enqueue(job, DeliveryRetrying); err != nil {
+			return err
+		}
+		q.deadLetters = append(q.deadLetters[:i:i], q.deadLetters[i+1:]...)
+
+		return nil
+	}
+
+	return ErrDeadLetterNotFound
+}
+
+// RequeueFailed moves all dead letters back into the queue
+// and returns the number of the requeued messages.
+//
+// If the queue fills up, the remaining dead letters are kept
+// and [ErrQueueFull] is returned.
+func (q *Queue) RequeueFailed() (int, error) {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	var requeued int
+	for _, job := range q.deadLetters {
+		if err := q.enqueue(job, DeliveryRetrying); err != nil {
+			q.deadLetters = q.deadLetters[requeued:]
+			return requeued, err
+		}
+		requeued++
+	}
+	q.deadLetters = nil
+
+	return requeued, nil
+}
+
+// PurgeDeadLetters removes the dead letters with the specified ids
+// (or all of them if none is specified) and returns their number.
+func (q *Queue) PurgeDeadLetters(ids ...string) int {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	if len(ids) == 0 {
+		n := len(q.deadLetters)
+		q.deadLetters = nil
+		return n
+	}
+
+	remove := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		remove[id] = struct{}{}
+	}
+
+	kept := q.deadLetters[:0:0]
+	for _, job := range q.deadLetters {
+		if _, ok := remove[job.id]; !ok {
+			kept = append(kept, job)
+		}
+	}
+
+	purged := len(q.deadLetters) - len(kept)
+	q.deadLetters = kept
+
+	return purged
+}
+
+func (q *Queue) addDeadLetter(job *queueJob) {
+	if q.config.DeadLetters < 0 {
+		return
+	}
+
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	q.deadLetters = append(q.deadLetters, job)
+	if over := len(q.deadLetters) - q.config.DeadLetters; over > 0 {
+		q.deadLetters = append([]*queueJob(nil), q.deadLetters[over:]...)
+	}
+}
@@ -4,3 +4,9 @@ type Configurer interface {
 	Has(name string) bool
 	UnmarshalKey(name string, out interface{}) error
 }
+
+// versionedConfigurer is implemented by the RoadRunner config plugin,
+// reporting the version of the running RoadRunner binary.
+type versionedConfigurer interface {
+	RRVersion() string
+}
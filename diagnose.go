@@ -0,0 +1,517 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// spfMaxLookups is the max number of the DNS querying SPF terms (RFC 7208, section 4.6.4).
+	spfMaxLookups = 10
+	// spfMaxDepth limits the include and redirect chains of the invalid (eg. circular) records.
+	spfMaxDepth = 10
+)
+
+// DiagnoseConfig defines the expected DNS setup of the sending domains.
+type DiagnoseConfig struct {
+	// SPFIPs are the sending IP addresses (eg. of the SMTP relay)
+	// expected to be authorized by the domains SPF record.
+	SPFIPs []string `mapstructure:"spf_ips" json:"spf_ips,omitempty" bson:"spf_ips,omitempty"`
+
+	// SPFIncludes are the SPF records of the sending providers expected to be
+	// included by the domains SPF record, eg. "amazonses.com" or "_spf.google.com".
+	SPFIncludes []string `mapstructure:"spf_includes" json:"spf_includes,omitempty" bson:"spf_includes,omitempty"`
+
+	// DKIMKeys are the signing keys expected to be published (the keys
+	// of the other domains are ignored). The plugin sets the configured ones.
+	DKIMKeys []DKIMKey `mapstructure:"-" json:"-" bson:"-"`
+
+	// Resolver is an optional DNS resolver (default to the system one).
+	Resolver DNSResolver `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the diagnostics configuration for common mistakes.
+func (c DiagnoseConfig) Validate() error {
+	var errs []error
+
+	for i, ip := range c.SPFIPs {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, fmt.Errorf("diagnostics: spf_ips[%d] must be an IP address, got %q", i, ip))
+		}
+	}
+
+	for i, include := range c.SPFIncludes {
+		if strings.TrimSpace(include) == "" {
+			errs = append(errs, fmt.Errorf("diagnostics: spf_includes[%d] must not be empty", i))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// FindingSeverity is the severity of a [Finding].
+type FindingSeverity string
+
+const (
+	FindingOK      FindingSeverity = "ok"
+	FindingWarning FindingSeverity = "warning" // the deliverability could be affected
+	FindingError   FindingSeverity = "error"   // the messages are likely rejected or junked
+)
+
+// Finding is a single result of the sending domain diagnostics.
+type Finding struct {
+	Check    string          `json:"check"` // either "spf", "dkim" or "dmarc"
+	Severity FindingSeverity `json:"severity"`
+	Message  string          `json:"message"`
+	Fix      string          `json:"fix,omitempty"` // the suggested DNS change, if any
+}
+
+// Diagnosis is the result of the sending domain diagnostics.
+type Diagnosis struct {
+	Domain   string    `json:"domain"`
+	Findings []Finding `json:"findings"`
+}
+
+// Err returns the error findings joined, or nil if there are none.
+func (d Diagnosis) Err() error {
+	var errs []error
+	for _, f := range d.Findings {
+		if f.Severity == FindingError {
+			errs = append(errs, fmt.Errorf("%s: %s", f.Check, f.Message))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d *Diagnosis) add(check string, severity FindingSeverity, fix string, format string, args ...any) {
+	d.Findings = append(d.Findings, Finding{Check: check, Severity: severity, Message: fmt.Sprintf(format, args...), Fix: fix})
+}
+
+// Diagnose checks the published DNS records of the sending domain:
+//
+//   - the SPF record authorizes the configured sending IPs and includes
+//     the configured providers, within the 10 DNS lookups limit;
+//   - the DKIM records of the configured keys of the domain match them;
+//   - the DMARC record (of the domain or of its parent) exists and enforces a policy.
+//
+// The findings describe the problems with the suggested DNS changes.
+func Diagnose(ctx context.Context, domain string, config DiagnoseConfig) Diagnosis {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	resolver := defaultResolver(config.Resolver)
+
+	d := Diagnosis{Domain: domain}
+
+	diagnoseSPF(ctx, &d, resolver, config)
+	diagnoseDKIM(ctx, &d, resolver, config)
+	diagnoseDMARC(ctx, &d, resolver)
+
+	return d
+}
+
+func diagnoseSPF(ctx context.Context, d *Diagnosis, resolver DNSResolver, config DiagnoseConfig) {
+	suggested := spfSuggestion(config)
+
+	spf := &spfChecker{ctx: ctx, resolver: resolver}
+
+	record, err := spf.record(d.Domain)
+	if err != nil {
+		d.add("spf", FindingError, fmt.Sprintf("publish the TXT record %q at %s", suggested, d.Domain), "%v", err)
+		return
+	}
+
+	problems := len(d.Findings)
+
+	tree := spf.walk(d.Domain, record, 0)
+	for _, err := range tree.errs {
+		d.add("spf", FindingError, "", "%v", err)
+	}
+	exceeded := spf.lookups > spfMaxLookups
+	if exceeded {
+		d.add("spf", FindingError, "flatten the nested includes into ip4/ip6 mechanisms",
+			"the record requires %d DNS lookups, more than the limit of %d (permerror)", spf.lookups, spfMaxLookups)
+	}
+
+	switch tree.all {
+	case "":
+		d.add("spf", FindingWarning, `end the record with "~all" or "-all"`,
+			"the record has no \"all\" mechanism, so the other senders are neutral")
+	case "?":
+		d.add("spf", FindingWarning, `end the record with "~all" or "-all"`,
+			"the record ends with \"?all\", so the other senders are neutral")
+	case "+":
+		d.add("spf", FindingError, `end the record with "~all" or "-all"`,
+			"the record authorizes any sender with \"+all\"")
+	}
+
+	for _, include := range config.SPFIncludes {
+		if !tree.includes[strings.ToLower(include)] {
+			d.add("spf", FindingError, fmt.Sprintf("add \"include:%s\" to the record", include),
+				"the record doesn't include %s", include)
+		}
+	}
+
+	for _, value := range config.SPFIPs {
+		ip := net.ParseIP(value)
+		if ip == nil || exceeded { // the record fails for every IP anyway
+			continue
+		}
+
+		spf.lookups = 0
+		if pass, _ := spf.authorizes(d.Domain, record, ip, 0); !pass {
+			d.add("spf", FindingError, fmt.Sprintf("add %q to the record", spfIPMechanism(ip)),
+				"the record doesn't authorize the sending IP %s", ip)
+		}
+	}
+
+	if len(d.Findings) == problems {
+		d.add("spf", FindingOK, "", "the record %q is valid", record)
+	}
+}
+
+// spfSuggestion returns a SPF record with the configured includes and IPs.
+func spfSuggestion(config DiagnoseConfig) string {
+	terms := []string{"v=spf1"}
+	for _, ip := range config.SPFIPs {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			terms = append(terms, spfIPMechanism(parsed))
+		}
+	}
+	for _, include := range config.SPFIncludes {
+		terms = append(terms, "include:"+include)
+	}
+
+	return strings.Join(append(terms, "~all"), " ")
+}
+
+func spfIPMechanism(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4:" + ip.String()
+	}
+
+	return "ip6:" + ip.String()
+}
+
+// spfChecker evaluates the SPF records, counting the DNS lookups.
+type spfChecker struct {
+	ctx      context.Context
+	resolver DNSResolver
+	lookups  int
+}
+
+// spfTree is the summary of a SPF record with its included ones.
+type spfTree struct {
+	all      string // the top level "all" mechanism qualifier, if any
+	includes map[string]bool
+	errs     []error
+}
+
+// record returns the single SPF record of the domain.
+func (c *spfChecker) record(domain string) (string, error) {
+	records, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", fmt.Errorf("no SPF record is published at %s", domain)
+		}
+		return "", fmt.Errorf("failed to look up the SPF record of %s: %w", domain, err)
+	}
+
+	var found []string
+	for _, record := range records {
+		if record == "v=spf1" || strings.HasPrefix(strings.ToLower(record), "v=spf1 ") {
+			found = append(found, record)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no SPF record is published at %s", domain)
+	case 1:
+		return found[0], nil
+	}
+
+	return "", fmt.Errorf("%d SPF records are published at %s, only one is allowed (permerror)", len(found), domain)
+}
+
+// walk collects the includes of the record (recursively), counting the DNS lookups of all the terms.
+func (c *spfChecker) walk(domain, record string, depth int) spfTree {
+	tree := spfTree{includes: map[string]bool{}}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		qualifier, name, value := spfTerm(term)
+
+		switch name {
+		case "all":
+			tree.all = qualifier
+		case "a", "mx", "ptr", "exists":
+			c.lookups++
+		case "include":
+			c.lookups++
+			tree.merge(c.walkInclude(domain, value, depth))
+		case "redirect":
+			redirect = value
+		}
+	}
+
+	if redirect != "" && tree.all == "" {
+		c.lookups++
+		redirected := c.walkInclude(domain, redirect, depth)
+		tree.all = redirected.all
+		tree.merge(redirected)
+	}
+
+	return tree
+}
+
+func (c *spfChecker) walkInclude(domain, target string, depth int) spfTree {
+	target = strings.ToLower(target)
+	if depth >= spfMaxDepth {
+		return spfTree{errs: []error{fmt.Errorf("the record of %s includes too many nested records", domain)}}
+	}
+
+	record, err := c.record(target)
+	if err != nil {
+		return spfTree{includes: map[string]bool{target: true}, errs: []error{fmt.Errorf("the included %s record is invalid: %w", target, err)}}
+	}
+
+	tree := c.walk(target, record, depth+1)
+	tree.includes[target] = true
+
+	return tree
+}
+
+func (t *spfTree) merge(other spfTree) {
+	for include := range other.includes {
+		t.includes[include] = true
+	}
+	t.errs = append(t.errs, other.errs...)
+}
+
+// authorizes evaluates the record for the sender IP, returning whether it passes.
+func (c *spfChecker) authorizes(domain, record string, ip net.IP, depth int) (bool, error) {
+	if depth >= spfMaxDepth || c.lookups > spfMaxLookups {
+		return false, errors.New("too many DNS lookups")
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		qualifier, name, value := spfTerm(term)
+
+		var match bool
+		var err error
+		switch name {
+		case "all":
+			match = true
+		case "ip4", "ip6":
+			match = spfMatchIP(value, ip)
+		case "a":
+			c.lookups++
+			match, err = c.matchHost(spfTarget(domain, value), ip)
+		case "mx":
+			c.lookups++
+			host, cidr, _ := strings.Cut(spfTarget(domain, value), "/")
+			if cidr != "" {
+				cidr = "/" + cidr
+			}
+
+			var mx []*net.MX
+			if mx, err = c.resolver.LookupMX(c.ctx, host); err == nil {
+				for _, record := range mx {
+					if match, err = c.matchHost(record.Host+cidr, ip); match || err != nil {
+						break
+					}
+				}
+			}
+		case "include":
+			c.lookups++
+			var included string
+			if included, err = c.record(strings.ToLower(value)); err == nil {
+				match, err = c.authorizes(value, included, ip, depth+1)
+			}
+		case "redirect":
+			redirect = value
+			continue
+		default: // ptr and exists aren't evaluated
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return qualifier == "+", nil
+		}
+	}
+
+	if redirect != "" {
+		c.lookups++
+		redirected, err := c.record(strings.ToLower(redirect))
+		if err != nil {
+			return false, err
+		}
+		return c.authorizes(redirect, redirected, ip, depth+1)
+	}
+
+	return false, nil
+}
+
+func (c *spfChecker) matchHost(host string, ip net.IP) (bool, error) {
+	host, cidr, _ := strings.Cut(host, "/")
+
+	addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, addr := range addrs {
+		value := addr.IP.String()
+		if cidr != "" {
+			value += "/" + cidr
+		}
+		if spfMatchIP(value, ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// spfTerm splits the SPF term into its qualifier (default to "+"), name and value,
+// eg. "~include:_spf.example.com" into "~", "include" and "_spf.example.com".
+func spfTerm(term string) (qualifier, name, value string) {
+	qualifier = "+"
+	if strings.ContainsAny(term[:1], "+-~?") {
+		qualifier, term = term[:1], term[1:]
+	}
+
+	if i := strings.IndexAny(term, ":="); i >= 0 {
+		return qualifier, strings.ToLower(term[:i]), term[i+1:]
+	}
+	if name, cidr, ok := strings.Cut(term, "/"); ok { // eg. "a/24"
+		return qualifier, strings.ToLower(name), "/" + cidr
+	}
+
+	return qualifier, strings.ToLower(term), ""
+}
+
+// spfTarget returns the "a" and "mx" mechanisms domain (default to the current one), keeping the CIDR suffix.
+func spfTarget(domain, value string) string {
+	if value == "" || strings.HasPrefix(value, "/") {
+		return domain + value
+	}
+
+	return value
+}
+
+func spfMatchIP(value string, ip net.IP) bool {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return err == nil && network.Contains(ip)
+	}
+
+	parsed := net.ParseIP(value)
+
+	return parsed != nil && parsed.Equal(ip)
+}
+
+func diagnoseDKIM(ctx context.Context, d *Diagnosis, resolver DNSResolver, config DiagnoseConfig) {
+	var keys []DKIMKey
+	for _, key := range config.DKIMKeys {
+		if strings.EqualFold(key.Domain, d.Domain) {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		d.add("dkim", FindingWarning, "configure the dkim or dkim_keys signing",
+			"no DKIM key is configured for %s, so the messages rely on SPF alignment to pass DMARC", d.Domain)
+		return
+	}
+
+	for _, key := range keys {
+		if err := key.CheckRecord(ctx, resolver); err != nil {
+			d.add("dkim", FindingError, "publish "+key.ZoneRecord(), "%s", strings.TrimPrefix(err.Error(), "dkim: "))
+			continue
+		}
+		d.add("dkim", FindingOK, "", "the key of %s is published", key.RecordName())
+	}
+}
+
+func diagnoseDMARC(ctx context.Context, d *Diagnosis, resolver DNSResolver) {
+	suggested := fmt.Sprintf("publish the TXT record \"v=DMARC1; p=none; rua=mailto:dmarc@%s\" at _dmarc.%s, then enforce p=quarantine or p=reject", d.Domain, d.Domain)
+
+	// the organizational domain record applies to the subdomains without one
+	domain := d.Domain
+	for {
+		record, err := dmarcRecord(ctx, resolver, domain)
+		if err != nil {
+			d.add("dmarc", FindingError, "", "%v", err)
+			return
+		}
+		if record != "" {
+			diagnoseDMARCRecord(d, domain, record, suggested)
+			return
+		}
+
+		_, parent, _ := strings.Cut(domain, ".")
+		if !strings.Contains(parent, ".") {
+			break
+		}
+		domain = parent
+	}
+
+	d.add("dmarc", FindingError, suggested, "no DMARC record is published at _dmarc.%s", d.Domain)
+}
+
+func diagnoseDMARCRecord(d *Diagnosis, domain, record, suggested string) {
+	tags := parseTagList(record)
+
+	problems := len(d.Findings)
+
+	switch strings.ToLower(tags["p"]) {
+	case "quarantine", "reject":
+	case "none":
+		d.add("dmarc", FindingWarning, "enforce p=quarantine or p=reject once the reports show the messages pass",
+			"the policy of _dmarc.%s is monitoring only (p=none)", domain)
+	default:
+		d.add("dmarc", FindingError, suggested, "the record of _dmarc.%s has an invalid policy p=%q", domain, tags["p"])
+	}
+
+	if tags["rua"] == "" {
+		d.add("dmarc", FindingWarning, fmt.Sprintf("add \"rua=mailto:dmarc@%s\" to the record", domain),
+			"the record of _dmarc.%s has no aggregate reports address (rua)", domain)
+	}
+
+	if len(d.Findings) == problems {
+		d.add("dmarc", FindingOK, "", "the record %q of _dmarc.%s is valid", record, domain)
+	}
+}
+
+// dmarcRecord returns the DMARC record of the domain, or an empty string if none is published.
+func dmarcRecord(ctx context.Context, resolver DNSResolver, domain string) (string, error) {
+	records, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to look up the DMARC record of %s: %w", domain, err)
+	}
+
+	for _, record := range records {
+		if v, ok := parseTagList(record)["v"]; ok && v == "DMARC1" {
+			return record, nil
+		}
+	}
+
+	return "", nil
+}
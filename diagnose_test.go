@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	store, err := NewDKIMKeyStore(DKIMKeysConfig{Dir: t.TempDir(), Domains: []string{"example.com"}, Algorithm: "ed25519"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := store.Keys()[0]
+
+	valid := map[string][]string{
+		"example.com":            {"google-site-verification=abc", "v=spf1 mx include:_spf.provider.test -all"},
+		"_spf.provider.test":     {"v=spf1 ip4:203.0.113.0/24 ip6:2001:db8::/32 ~all"},
+		key.RecordName():         {key.RecordValue()},
+		"_dmarc.example.com":     {"v=DMARC1; p=reject; rua=mailto:dmarc@example.com"},
+		"_dmarc.sub.example.com": {"v=DMARC1; p=none"},
+	}
+	with := func(name string, records ...string) map[string][]string {
+		txt := map[string][]string{}
+		for k, v := range valid {
+			txt[k] = v
+		}
+		if records == nil {
+			delete(txt, name)
+		} else {
+			txt[name] = records
+		}
+		return txt
+	}
+
+	config := DiagnoseConfig{
+		SPFIPs:      []string{"203.0.113.10", "2001:db8::1", "198.51.100.25"},
+		SPFIncludes: []string{"_spf.provider.test"},
+		DKIMKeys:    []DKIMKey{key},
+	}
+
+	scenarios := []struct {
+		name     string
+		domain   string
+		txt      map[string][]string
+		config   DiagnoseConfig
+		expected []string // the "{check} {severity}" of the findings
+	}{
+		{"valid", "Example.com.", valid, config, []string{"spf ok", "dkim ok", "dmarc ok"}},
+		{"missing spf", "example.com", with("example.com", "other"), config, []string{"spf error", "dkim ok", "dmarc ok"}},
+		{"multiple spf", "example.com", with("example.com", "v=spf1 -all", "v=spf1 mx -all"), config, []string{"spf error", "dkim ok", "dmarc ok"}},
+		{"unauthorized ip", "example.com", with("example.com", "v=spf1 include:_spf.provider.test -all"), config, []string{"spf error", "dkim ok", "dmarc ok"}},
+		{"missing include", "example.com", with("example.com", "v=spf1 ip4:203.0.113.10 ip6:2001:db8::1 a:mail.example.com -all"), config, []string{"spf error", "spf error", "dkim ok", "dmarc ok"}},
+		{"pass all", "example.com", with("example.com", "v=spf1 mx include:_spf.provider.test +all"), config, []string{"spf error", "dkim ok", "dmarc ok"}},
+		{"no all", "example.com", with("example.com", "v=spf1 mx include:_spf.provider.test"), config, []string{"spf warning", "dkim ok", "dmarc ok"}},
+		{"redirect", "example.com", with("example.com", "v=spf1 mx redirect=_spf.provider.test"), DiagnoseConfig{SPFIPs: []string{"203.0.113.10"}, DKIMKeys: []DKIMKey{key}}, []string{"spf ok", "dkim ok", "dmarc ok"}},
+		{"too many lookups", "example.com", with("example.com", "v=spf1 a mx a:a.test a:b.test a:c.test a:d.test a:e.test a:f.test a:g.test a:h.test include:_spf.provider.test -all"), config, []string{"spf error", "dkim ok", "dmarc ok"}},
+		{"missing dkim", "example.com", with(key.RecordName()), config, []string{"spf ok", "dkim error", "dmarc ok"}},
+		{"no dkim key", "example.com", valid, DiagnoseConfig{}, []string{"spf ok", "dkim warning", "dmarc ok"}},
+		{"missing dmarc", "example.com", with("_dmarc.example.com"), config, []string{"spf ok", "dkim ok", "dmarc error"}},
+		{"dmarc monitoring", "example.com", with("_dmarc.example.com", "v=DMARC1; p=none"), config, []string{"spf ok", "dkim ok", "dmarc warning", "dmarc warning"}},
+		{"parent dmarc", "mail.example.com", with("mail.example.com", "v=spf1 -all"), DiagnoseConfig{}, []string{"spf ok", "dkim warning", "dmarc ok"}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			s.config.Resolver = fakeResolver{
+				txt: s.txt,
+				mx:  map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+				ips: map[string][]net.IPAddr{"mx.example.com": {{IP: net.ParseIP("198.51.100.25")}}},
+			}
+
+			d := Diagnose(context.Background(), s.domain, s.config)
+
+			var got []string
+			for _, f := range d.Findings {
+				got = append(got, f.Check+" "+string(f.Severity))
+				if f.Severity != FindingOK && f.Fix == "" && !strings.Contains(f.Message, "invalid") {
+					t.Errorf("Expected a fix for %+v", f)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(s.expected, ",") {
+				t.Fatalf("Expected findings %v, got %+v", s.expected, d.Findings)
+			}
+			if (d.Err() == nil) != !strings.Contains(strings.Join(got, ","), "error") {
+				t.Fatalf("Unexpected error %v", d.Err())
+			}
+		})
+	}
+}
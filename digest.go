@@ -0,0 +1,661 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDigestSchedule  = 24 * time.Hour
+	defaultDigestMaxEvents = 1000
+	defaultDigestTimeout   = 5 * time.Second
+)
+
+// DigestEvent is a notification buffered by the [Digest].
+type DigestEvent struct {
+	Recipient string    `json:"recipient"`       // the recipient address
+	Group     string    `json:"group,omitempty"` // eg. "comments", default to [DigestConfig.Group]
+	Data      any       `json:"data,omitempty"`  // the event template data
+	At        time.Time `json:"at,omitempty"`    // default to the current time
+}
+
+// DigestGroup are the events of a digest with the same group.
+type DigestGroup struct {
+	Name   string
+	Events []DigestEvent
+}
+
+// DigestBatch is the data a digest message is rendered with.
+type DigestBatch struct {
+	Recipient string
+	Groups    []DigestGroup // in the order of their first event
+	Count     int           // the number of events
+	Dropped   int           // the number of oldest events dropped over MaxEvents
+	Since     time.Time     // the time of the first event
+	Until     time.Time     // the time of the last event
+}
+
+// DigestConfig defines the digest settings.
+type DigestConfig struct {
+	// Schedule is the flush period, eg. 1h (hourly) or 24h (daily, the default).
+	// The digests are flushed on the multiples of the period (in UTC), plus Offset.
+	Schedule time.Duration `mapstructure:"schedule" json:"schedule,omitempty" bson:"schedule,omitempty"`
+
+	// Offset shifts the flush time in the schedule period, eg. 8h to flush
+	// the daily digests at 08:00 UTC. It must be less than Schedule.
+	Offset time.Duration `mapstructure:"offset" json:"offset,omitempty" bson:"offset,omitempty"`
+
+	// Threshold flushes the digest of a recipient as soon as it has that many events (disabled if 0).
+	Threshold int `mapstructure:"threshold" json:"threshold,omitempty" bson:"threshold,omitempty"`
+
+	// MaxEvents is the max number of buffered events per recipient, the
+	// oldest ones being dropped (and counted in [DigestBatch]), default to 1000.
+	MaxEvents int `mapstructure:"max_events" json:"max_events,omitempty" bson:"max_events,omitempty"`
+
+	// Template is the name of the template the digests are rendered with,
+	// with the [DigestBatch] as data, required unless Render is set.
+	Template string `mapstructure:"template" json:"template,omitempty" bson:"template,omitempty"`
+
+	// From is the sender address of the digests rendered from Template.
+	From string `mapstructure:"from" json:"from,omitempty" bson:"from,omitempty"`
+
+	// Timeout is the store operations timeout, default to 5s.
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`
+
+	// Redis keeps the events across the restarts and shares them between
+	// the instances (in-memory if not set).
+	Redis *RedisConfig `mapstructure:"redis" json:"redis,omitempty" bson:"redis,omitempty"`
+
+	// Templates is the registry of the digest Template.
+	Templates *Templates `mapstructure:"-" json:"-" bson:"-"`
+
+	// Group is an optional hook returning the group of the events without one.
+	Group func(e DigestEvent) string `mapstructure:"-" json:"-" bson:"-"`
+
+	// Render is an optional hook rendering the digest messages, instead of Template.
+	Render func(batch DigestBatch) (*Message, error) `mapstructure:"-" json:"-" bson:"-"`
+
+	// Clock is the time source of the schedule (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when a scheduled digest could not
+	// be sent. Its events are kept and sent with the next digest.
+	OnError func(recipient string, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the digest configuration for common mistakes.
+func (c DigestConfig) Validate() error {
+	var errs []error
+
+	if c.Schedule < 0 {
+		errs = append(errs, fmt.Errorf("digest: schedule must be positive, got %s", c.Schedule))
+	}
+
+	schedule := c.Schedule
+	if schedule == 0 {
+		schedule = defaultDigestSchedule
+	}
+	if c.Offset < 0 || c.Offset >= schedule {
+		errs = append(errs, fmt.Errorf("digest: offset must be between 0 and the schedule %s, got %s", schedule, c.Offset))
+	}
+
+	if c.Threshold < 0 {
+		errs = append(errs, fmt.Errorf("digest: threshold must be positive, got %d", c.Threshold))
+	}
+
+	if c.MaxEvents < 0 {
+		errs = append(errs, fmt.Errorf("digest: max_events must be positive, got %d", c.MaxEvents))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("digest: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.Redis != nil {
+		if err := c.Redis.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("digest: %w", err))
+		}
+	}
+
+	if c.Render == nil {
+		if c.Template == "" {
+			errs = append(errs, errors.New("digest: template is required"))
+		}
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			errs = append(errs, fmt.Errorf("digest: invalid from address %q", c.From))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c DigestConfig) Redacted() DigestConfig {
+	if c.Redis != nil {
+		redis := c.Redis.Redacted()
+		c.Redis = &redis
+	}
+	c.Group, c.Render, c.OnError = nil, nil, nil
+
+	return c
+}
+
+// Store returns the DigestStore described by the config.
+func (c DigestConfig) Store() DigestStore {
+	if c.Redis != nil {
+		return NewRedisDigestStore(*c.Redis)
+	}
+
+	return &MemoryDigestStore{}
+}
+
+// DigestStore keeps the buffered events, keyed by their lowercased recipient.
+type DigestStore interface {
+	// Add appends the event to the recipient events, dropping the
+	// oldest ones over limit, and returns their number.
+	Add(ctx context.Context, key string, e DigestEvent, limit int) (int, error)
+
+	// Take removes and returns the recipient events along with the number
+	// of the dropped ones, so that each digest is sent by a single instance.
+	Take(ctx context.Context, key string) ([]DigestEvent, int, error)
+
+	// Restore puts back the events of an unsent digest before the ones
+	// added meanwhile, dropping the oldest ones over limit.
+	Restore(ctx context.Context, key string, events []DigestEvent, dropped, limit int) error
+
+	// Keys returns the keys of the recipients with buffered events.
+	Keys(ctx context.Context) ([]string, error)
+}
+
+// Digest buffers the events per recipient and sends them as a single
+// summarized message on a schedule (see [DigestConfig]), eg. a daily
+// "You have 5 new comments" notification.
+//
+// The events are kept in the [DigestStore] until the next scheduled
+// flush, also across the restarts with a persistent store, and every
+// digest is taken from the store by a single instance.
+type Digest struct {
+	next   Mailer
+	store  DigestStore
+	config DigestConfig
+
+	runMu   sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewDigest creates a new digest buffering the events in the store
+// and sending the digest messages to next.
+func NewDigest(next Mailer, store DigestStore, config DigestConfig) *Digest {
+	if config.Schedule <= 0 {
+		config.Schedule = defaultDigestSchedule
+	}
+	if config.MaxEvents <= 0 {
+		config.MaxEvents = defaultDigestMaxEvents
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultDigestTimeout
+	}
+
+	return &Digest{next: next, store: store, config: config}
+}
+
+// Add buffers the event, sending the recipient digest right away if it
+// reaches the configured threshold (returning its sending error, if any).
+func (d *Digest) Add(e DigestEvent) error {
+	addr, err := mail.ParseAddress(e.Recipient)
+	if err != nil {
+		return fmt.Errorf("digest: invalid recipient %q: %w", e.Recipient, err)
+	}
+	e.Recipient = addr.Address
+
+	if e.At.IsZero() {
+		e.At = now(d.config.Clock)
+	}
+	if e.Group == "" && d.config.Group != nil {
+		e.Group = d.config.Group(e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.Timeout)
+	defer cancel()
+
+	n, err := d.store.Add(ctx, strings.ToLower(e.Recipient), e, d.config.MaxEvents)
+	if err != nil {
+		return fmt.Errorf("digest: failed to buffer the event: %w", err)
+	}
+
+	if d.config.Threshold > 0 && n >= d.config.Threshold {
+		return d.FlushRecipient(e.Recipient)
+	}
+
+	return nil
+}
+
+// Flush sends the digests of all recipients right away.
+func (d *Digest) Flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.Timeout)
+	keys, err := d.store.Keys(ctx)
+	cancel()
+	if err != nil {
+		err = fmt.Errorf("digest: failed to list the recipients: %w", err)
+		if d.config.OnError != nil {
+			d.config.OnError("", err)
+		}
+		return err
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if err := d.FlushRecipient(key); err != nil {
+			if d.config.OnError != nil {
+				d.config.OnError(key, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// FlushRecipient sends the digest of the recipient right away, if it has any event.
+// The events are kept, and sent with the next digest, if it could not be sent.
+func (d *Digest) FlushRecipient(recipient string) error {
+	key := strings.ToLower(strings.TrimSpace(recipient))
+	if addr, err := mail.ParseAddress(recipient); err == nil {
+		key = strings.ToLower(addr.Address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.Timeout)
+	defer cancel()
+
+	events, dropped, err := d.store.Take(ctx, key)
+	if err != nil {
+		return fmt.Errorf("digest: failed to take the events of %s: %w", recipient, err)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := d.send(events, dropped); err != nil {
+		err = fmt.Errorf("digest: failed to send the digest of %s: %w", events[0].Recipient, err)
+
+		// a new timeout, the send may have taken most of it
+		ctx, cancel := context.WithTimeout(context.Background(), d.config.Timeout)
+		defer cancel()
+
+		if restoreErr := d.store.Restore(ctx, key, events, dropped, d.config.MaxEvents); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("digest: failed to restore the events of %s: %w", events[0].Recipient, restoreErr))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (d *Digest) send(events []DigestEvent, dropped int) error {
+	batch := DigestBatch{
+		Recipient: events[0].Recipient,
+		Count:     len(events),
+		Dropped:   dropped,
+		Since:     events[0].At,
+		Until:     events[len(events)-1].At,
+	}
+
+	groups := map[string]int{} // name -> index
+	for _, e := range events {
+		i, ok := groups[e.Group]
+		if !ok {
+			i = len(batch.Groups)
+			groups[e.Group] = i
+			batch.Groups = append(batch.Groups, DigestGroup{Name: e.Group})
+		}
+		batch.Groups[i].Events = append(batch.Groups[i].Events, e)
+	}
+
+	var m *Message
+	var err error
+	if d.config.Render != nil {
+		m, err = d.config.Render(batch)
+	} else if d.config.Templates == nil {
+		err = errors.New("the templates are not configured")
+	} else {
+		m, err = NewMessage().From(d.config.From).To(batch.Recipient).
+			Template(d.config.Templates, d.config.Template, batch).
+			Tag("digest").
+			Build()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to render: %w", err)
+	}
+
+	return d.next.Send(m)
+}
+
+// Next returns the next scheduled flush time after t.
+func (d *Digest) Next(t time.Time) time.Time {
+	next := t.UTC().Truncate(d.config.Schedule).Add(d.config.Offset)
+	for !next.After(t) {
+		next = next.Add(d.config.Schedule)
+	}
+
+	return next
+}
+
+// Start flushes the digests on the configured schedule in the background.
+// It is no-op if the digest is already started.
+func (d *Digest) Start() {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	if d.started {
+		return
+	}
+	d.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+
+	go d.run(ctx)
+}
+
+// Stop stops the schedule, waiting for the current flush (up to the ctx
+// deadline) to complete. The pending events are kept in the store, to be
+// sent on the next schedule rather than as partial digests.
+func (d *Digest) Stop(ctx context.Context) error {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	if !d.started {
+		return nil
+	}
+	d.started = false
+	d.cancel()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Digest) run(ctx context.Context) {
+	defer close(d.done)
+
+	for {
+		t := now(d.config.Clock)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.Next(t).Sub(t)):
+		}
+
+		_ = d.Flush() // reported by OnError
+	}
+}
+
+// MemoryDigestStore is an in-memory [DigestStore], suitable for a single
+// instance. The buffered events are lost on restart.
+// The zero value is ready to use.
+type MemoryDigestStore struct {
+	mu      sync.Mutex
+	buffers map[string]*digestBuffer
+}
+
+type digestBuffer struct {
+	events  []DigestEvent
+	dropped int
+}
+
+// trim drops the oldest events over limit.
+func (b *digestBuffer) trim(limit int) {
+	if over := len(b.events) - limit; over > 0 {
+		b.events = b.events[over:]
+		b.dropped += over
+	}
+}
+
+// Add implements [DigestStore] interface.
+func (s *MemoryDigestStore) Add(_ context.Context, key string, e DigestEvent, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buffers == nil {
+		s.buffers = map[string]*digestBuffer{}
+	}
+
+	buf := s.buffers[key]
+	if buf == nil {
+		buf = &digestBuffer{}
+		s.buffers[key] = buf
+	}
+	buf.events = append(buf.events, e)
+	buf.trim(limit)
+
+	return len(buf.events), nil
+}
+
+// Take implements [DigestStore] interface.
+func (s *MemoryDigestStore) Take(_ context.Context, key string) ([]DigestEvent, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := s.buffers[key]
+	if buf == nil {
+		return nil, 0, nil
+	}
+	delete(s.buffers, key)
+
+	return buf.events, buf.dropped, nil
+}
+
+// Restore implements [DigestStore] interface.
+func (s *MemoryDigestStore) Restore(_ context.Context, key string, events []DigestEvent, dropped, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buffers == nil {
+		s.buffers = map[string]*digestBuffer{}
+	}
+
+	buf := &digestBuffer{events: events, dropped: dropped}
+	if added := s.buffers[key]; added != nil {
+		buf.events = append(buf.events, added.events...)
+		buf.dropped += added.dropped
+	}
+	buf.trim(limit)
+	s.buffers[key] = buf
+
+	return nil
+}
+
+// Keys implements [DigestStore] interface.
+func (s *MemoryDigestStore) Keys(context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buffers))
+	for key := range s.buffers {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Len returns the number of buffered events.
+func (s *MemoryDigestStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, buf := range s.buffers {
+		n += len(buf.events)
+	}
+
+	return n
+}
+
+// RedisDigestStore is a [DigestStore] backed by Redis, keeping the events
+// across the restarts and sharing them between multiple instances.
+//
+// The events are JSON encoded, so their Data is decoded as the generic
+// JSON values (eg. a map[string]any for a struct).
+type RedisDigestStore struct {
+	client *redisClient
+}
+
+// redisDigestAddScript appends the event (ARGV[1]) to the events list
+// (KEYS[1]), dropping the oldest ones over the limit (ARGV[2]) and counting
+// them (KEYS[2]), and adds the recipient key (ARGV[3]) to the set of the
+// recipients with events (KEYS[3]).
+const redisDigestAddScript = `redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('SADD', KEYS[3], ARGV[3])
+local over = redis.call('LLEN', KEYS[1]) - tonumber(ARGV[2])
+if over > 0 then
+	redis.call('LTRIM', KEYS[1], over, -1)
+	redis.call('INCRBY', KEYS[2], over)
+end
+return redis.call('LLEN', KEYS[1])`
+
+// redisDigestTakeScript removes the events and returns them after
+// the number of the dropped ones.
+const redisDigestTakeScript = `local events = redis.call('LRANGE', KEYS[1], 0, -1)
+local dropped = redis.call('GET', KEYS[2]) or '0'
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('SREM', KEYS[3], ARGV[1])
+table.insert(events, 1, dropped)
+return events`
+
+// redisDigestRestoreScript puts back the events (ARGV[4:]) before the ones
+// added meanwhile, dropping the oldest ones over the limit (ARGV[2]) and
+// counting them with the already dropped ones (ARGV[3]).
+const redisDigestRestoreScript = `for i = #ARGV, 4, -1 do
+	redis.call('LPUSH', KEYS[1], ARGV[i])
+end
+redis.call('SADD', KEYS[3], ARGV[1])
+local dropped = tonumber(ARGV[3])
+local over = redis.call('LLEN', KEYS[1]) - tonumber(ARGV[2])
+if over > 0 then
+	redis.call('LTRIM', KEYS[1], over, -1)
+	dropped = dropped + over
+end
+if dropped > 0 then
+	redis.call('INCRBY', KEYS[2], dropped)
+end
+return 0`
+
+// NewRedisDigestStore creates a new Redis digest store.
+func NewRedisDigestStore(config RedisConfig) *RedisDigestStore {
+	return &RedisDigestStore{client: newRedisClient(config)}
+}
+
+// keys returns the events list, dropped counter and recipients set keys.
+func (s *RedisDigestStore) keys(key string) []string {
+	prefix := s.client.config.prefix() + "digest:"
+
+	return []string{prefix + "events:" + key, prefix + "dropped:" + key, prefix + "recipients"}
+}
+
+// Add implements [DigestStore] interface.
+func (s *RedisDigestStore) Add(ctx context.Context, key string, e DigestEvent, limit int) (int, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	args := append([]string{"EVAL", redisDigestAddScript, "3"}, s.keys(key)...)
+	reply, err := s.client.do(ctx, append(args, string(data), strconv.Itoa(limit), key)...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	return int(n), nil
+}
+
+// Take implements [DigestStore] interface.
+func (s *RedisDigestStore) Take(ctx context.Context, key string) ([]DigestEvent, int, error) {
+	args := append([]string{"EVAL", redisDigestTakeScript, "3"}, s.keys(key)...)
+	reply, err := s.client.do(ctx, append(args, key)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	items, ok := reply.([]any)
+	if !ok || len(items) == 0 {
+		return nil, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	dropped, err := strconv.Atoi(fmt.Sprint(items[0]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("redis: unexpected dropped count %v", items[0])
+	}
+
+	events := make([]DigestEvent, 0, len(items)-1)
+	for _, item := range items[1:] {
+		data, _ := item.(string)
+
+		var e DigestEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, 0, fmt.Errorf("redis: invalid digest event: %w", err)
+		}
+		events = append(events, e)
+	}
+
+	return events, dropped, nil
+}
+
+// Restore implements [DigestStore] interface.
+func (s *RedisDigestStore) Restore(ctx context.Context, key string, events []DigestEvent, dropped, limit int) error {
+	args := append([]string{"EVAL", redisDigestRestoreScript, "3"}, s.keys(key)...)
+	args = append(args, key, strconv.Itoa(limit), strconv.Itoa(dropped))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(data))
+	}
+
+	_, err := s.client.do(ctx, args...)
+
+	return err
+}
+
+// Keys implements [DigestStore] interface.
+func (s *RedisDigestStore) Keys(ctx context.Context) ([]string, error) {
+	reply, err := s.client.do(ctx, "SMEMBERS", s.keys("")[2])
+	if err != nil {
+		return nil, err
+	}
+
+	items, _ := reply.([]any)
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		if key, ok := item.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Close closes the Redis connection.
+func (s *RedisDigestStore) Close() error {
+	return s.client.close()
+}
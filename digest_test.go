@@ -0,0 +1,215 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigest(t *testing.T) {
+	templates := &Templates{}
+	err := templates.Add("digest", "", MessageTemplate{
+		Subject: "You have {{.Count}} new notifications",
+		Text:    "{{range .Groups}}{{.Name}}:{{range .Events}} {{.Data}}{{end}}\n{{end}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []*Message
+	fail := false
+	store := &MemoryDigestStore{}
+	digest := NewDigest(MailerFunc(func(m *Message) error {
+		if fail {
+			return errors.New("relay down")
+		}
+		sent = append(sent, m)
+		return nil
+	}), store, DigestConfig{
+		Template:  "digest",
+		From:      "notifications@example.com",
+		Templates: templates,
+		Threshold: 3,
+	})
+
+	events := []DigestEvent{
+		{Recipient: "Jane <jane@example.com>", Group: "comments", Data: "c1"},
+		{Recipient: "john@example.com", Group: "likes", Data: "l1"},
+		{Recipient: "JANE@example.com", Group: "likes", Data: "l1"},
+		{Recipient: "jane@example.com", Group: "comments", Data: "c2"},
+	}
+	for _, e := range events {
+		if err := digest.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sent) != 1 || sent[0].To[0].Address != "jane@example.com" {
+		t.Fatalf("Expected the jane digest to be sent on threshold, got %+v", sent)
+	}
+	if sent[0].Subject != "You have 3 new notifications" || sent[0].Text != "comments: c1 c2\nlikes: l1\n" {
+		t.Fatalf("Expected the grouped events, got %q %q", sent[0].Subject, sent[0].Text)
+	}
+	if len(sent[0].Tags) != 1 || sent[0].Tags[0] != "digest" {
+		t.Fatalf("Expected the digest tag, got %v", sent[0].Tags)
+	}
+
+	fail = true
+	if err := digest.Flush(); err == nil || !strings.Contains(err.Error(), "john@example.com") {
+		t.Fatalf("Expected the send error, got %v", err)
+	}
+	if n := store.Len(); n != 1 {
+		t.Fatalf("Expected the unsent event to be kept, got %d", n)
+	}
+
+	fail = false
+	digest.Start()
+	if err := digest.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || store.Len() != 1 {
+		t.Fatalf("Expected the pending digest to be kept for the next schedule on stop, got %+v", sent)
+	}
+
+	// another instance sharing the store
+	other := NewDigest(MailerFunc(func(m *Message) error {
+		sent = append(sent, m)
+		return nil
+	}), store, DigestConfig{Template: "digest", From: "notifications@example.com", Templates: templates})
+	for _, d := range []*Digest{digest, other} {
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 2 || sent[1].Subject != "You have 1 new notifications" || store.Len() != 0 {
+		t.Fatalf("Expected the pending digest to be sent once on the next flush, got %+v", sent)
+	}
+
+	if err := digest.Add(DigestEvent{Recipient: "invalid"}); err == nil {
+		t.Fatal("Expected the invalid recipient error")
+	}
+}
+
+func TestDigestMaxEvents(t *testing.T) {
+	var batch DigestBatch
+	digest := NewDigest(MailerFunc(func(m *Message) error { return nil }), &MemoryDigestStore{}, DigestConfig{
+		MaxEvents: 2,
+		Group:     func(e DigestEvent) string { return "all" },
+		Render: func(b DigestBatch) (*Message, error) {
+			batch = b
+			return &Message{}, nil
+		},
+	})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := digest.Add(DigestEvent{Recipient: "jane@example.com", At: start.Add(time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := digest.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if batch.Count != 2 || batch.Dropped != 1 || len(batch.Groups) != 1 || batch.Groups[0].Name != "all" {
+		t.Fatalf("Expected the oldest event to be dropped, got %+v", batch)
+	}
+	if !batch.Since.Equal(start.Add(time.Hour)) || !batch.Until.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("Expected the batch time range, got %s - %s", batch.Since, batch.Until)
+	}
+}
+
+func TestRedisDigestStore(t *testing.T) {
+	address, _ := newTestRedis(t, "")
+
+	store := NewRedisDigestStore(RedisConfig{Address: address})
+	defer store.Close()
+
+	ctx := context.Background()
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		n, err := store.Add(ctx, "jane@example.com", DigestEvent{Recipient: "Jane@example.com", Data: i, At: at}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := min(i+1, 2); n != expected {
+			t.Fatalf("Expected %d events, got %d", expected, n)
+		}
+	}
+
+	keys, err := store.Keys(ctx)
+	if err != nil || len(keys) != 1 || keys[0] != "jane@example.com" {
+		t.Fatalf("Expected the recipient key, got %v %v", keys, err)
+	}
+
+	events, dropped, err := store.Take(ctx, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || dropped != 1 || events[0].Data != float64(1) || events[0].Recipient != "Jane@example.com" || !events[0].At.Equal(at) {
+		t.Fatalf("Expected the last 2 events, got %+v (dropped %d)", events, dropped)
+	}
+	if keys, _ := store.Keys(ctx); len(keys) != 0 {
+		t.Fatalf("Expected the taken events to be removed, got %v", keys)
+	}
+
+	// restored before the one added meanwhile
+	if _, err := store.Add(ctx, "jane@example.com", DigestEvent{Recipient: "jane@example.com", Data: 3}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Restore(ctx, "jane@example.com", events, dropped, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	events, dropped, err = store.Take(ctx, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || dropped != 2 || events[0].Data != float64(2) || events[1].Data != float64(3) {
+		t.Fatalf("Expected the restored events before the added one, got %+v (dropped %d)", events, dropped)
+	}
+}
+
+func TestDigestNext(t *testing.T) {
+	scenarios := []struct {
+		schedule, offset time.Duration
+		at, next         string
+	}{
+		{time.Hour, 0, "2024-01-01T10:20:00Z", "2024-01-01T11:00:00Z"},
+		{time.Hour, 0, "2024-01-01T10:00:00Z", "2024-01-01T11:00:00Z"},
+		{24 * time.Hour, 8 * time.Hour, "2024-01-01T05:00:00Z", "2024-01-01T08:00:00Z"},
+		{24 * time.Hour, 8 * time.Hour, "2024-01-01T09:00:00Z", "2024-01-02T08:00:00Z"},
+	}
+
+	for _, s := range scenarios {
+		digest := NewDigest(nil, nil, DigestConfig{Schedule: s.schedule, Offset: s.offset})
+
+		at, _ := time.Parse(time.RFC3339, s.at)
+		if next := digest.Next(at).Format(time.RFC3339); next != s.next {
+			t.Errorf("Expected the next flush of %s at %s, got %s", s.at, s.next, next)
+		}
+	}
+}
+
+func TestDigestConfigValidate(t *testing.T) {
+	scenarios := []struct {
+		config DigestConfig
+		valid  bool
+	}{
+		{DigestConfig{Template: "digest", From: "no-reply@example.com"}, true},
+		{DigestConfig{Render: func(DigestBatch) (*Message, error) { return nil, nil }}, true},
+		{DigestConfig{From: "no-reply@example.com"}, false},
+		{DigestConfig{Template: "digest", From: "invalid"}, false},
+		{DigestConfig{Template: "digest", From: "no-reply@example.com", Schedule: time.Hour, Offset: time.Hour}, false},
+		{DigestConfig{Template: "digest", From: "no-reply@example.com", Threshold: -1}, false},
+		{DigestConfig{Template: "digest", From: "no-reply@example.com", Redis: &RedisConfig{Address: "localhost"}}, false},
+	}
+
+	for i, s := range scenarios {
+		if err := s.config.Validate(); (err == nil) != s.valid {
+			t.Errorf("scenario %d: expected valid %v, got %v", i, s.valid, err)
+		}
+	}
+}
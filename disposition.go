@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMessageExpired is the dead letters error of the messages
+// that were not delivered before their expiration.
+var ErrMessageExpired = errors.New("mailer message expired")
+
+// Disposition describes the terminal state of a queued message.
+type Disposition struct {
+	ID            string         // the queue message id
+	CorrelationID string         // the id set with [WithCorrelationID]
+	Status        DeliveryStatus // DeliverySent, DeliveryFailed, DeliveryExpired or DeliveryDiscarded
+	Err           error          // the last delivery error, nil if sent
+	Attempts      int            // the number of delivery attempts
+	At            time.Time
+}
+
+// QueueOption configures a message enqueued with [Queue.Enqueue].
+type QueueOption func(job *queueJob)
+
+// WithCorrelationID sets the application id of the message, reported by
+// its delivery events, its dead letter and its [Disposition].
+func WithCorrelationID(id string) QueueOption {
+	return func(job *queueJob) {
+		job.correlationID = id
+	}
+}
+
+// WithDisposition sets the callback called exactly once when the message
+// reaches a terminal state, ie. it is delivered (to the next mailer),
+// it permanently failed (it is a dead letter), it expired or it was
+// discarded in dry-run mode.
+//
+// The callback is called synchronously by the queue, so it should
+// return promptly. It is not called again if the dead letter is requeued.
+// With the plugin queue, the option is set with [Plugin.Enqueue].
+func WithDisposition(fn func(Disposition)) QueueOption {
+	return func(job *queueJob) {
+		job.onDisposition = fn
+	}
+}
+
+// WithExpiration sets the time after which the message is not
+// sent anymore, eg. a one-time password valid for 5 minutes.
+// The expired messages are moved in the dead letters.
+func WithExpiration(at time.Time) QueueOption {
+	return func(job *queueJob) {
+		job.expires = at
+	}
+}
+
+// expired reports whether the job expired at the specified time.
+func (job *queueJob) expired(t time.Time) bool {
+	return !job.expires.IsZero() && !t.Before(job.expires)
+}
+
+// expire moves the expired job in the dead letters.
+func (q *Queue) expire(job *queueJob) {
+	job.attempts = append(job.attempts, DeliveryAttempt{At: now(q.Clock), Err: ErrMessageExpired})
+
+	q.addDeadLetter(job)
+	q.emit(job, DeliveryExpired, ErrMessageExpired)
+	q.dispose(job, DeliveryExpired, ErrMessageExpired)
+
+	if q.OnError != nil {
+		q.OnError(job.message, ErrMessageExpired)
+	}
+}
+
+// dispose calls the job disposition callback, if not called yet.
+func (q *Queue) dispose(job *queueJob, status DeliveryStatus, err error) {
+	if job.onDisposition == nil {
+		return
+	}
+
+	job.disposeOnce.Do(func() {
+		job.onDisposition(Disposition{
+			ID:            job.id,
+			CorrelationID: job.correlationID,
+			Status:        status,
+			Err:           err,
+			Attempts:      len(job.attempts),
+			At:            now(q.Clock),
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueDisposition(t *testing.T) {
+	var mu sync.Mutex
+	dispositions := map[string][]Disposition{}
+	record := WithDisposition(func(d Disposition) {
+		mu.Lock()
+		dispositions[d.CorrelationID] = append(dispositions[d.CorrelationID], d)
+		mu.Unlock()
+	})
+
+	var attempts int
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		switch m.Subject {
+		case "rejected":
+			return errors.New("rejected")
+		case "retried":
+			if attempts++; attempts == 1 {
+				return &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}
+			}
+		}
+		return nil
+	}), QueueConfig{Size: 10, MaxAttempts: 2, RetryBackoff: time.Millisecond})
+
+	events := queue.Subscribe()
+
+	for _, subject := range []string{"sent", "rejected", "retried"} {
+		id, err := queue.Enqueue(&Message{Subject: subject}, WithCorrelationID(subject), record)
+		if err != nil || id == "" {
+			t.Fatalf("Expected the message to be enqueued, got %q, %v", id, err)
+		}
+	}
+	if _, err := queue.Enqueue(&Message{Subject: "expired"}, WithCorrelationID("expired"), record,
+		WithExpiration(time.Now().Add(-time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := <-events; e.Status != DeliveryQueued || e.CorrelationID != "sent" {
+		t.Fatalf("Expected the queued event with the correlation id, got %+v", e)
+	}
+
+	queue.Start()
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(dispositions) == 4
+	})
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]DeliveryStatus{
+		"sent":     DeliverySent,
+		"rejected": DeliveryFailed,
+		"retried":  DeliverySent,
+		"expired":  DeliveryExpired,
+	}
+	for id, status := range expected {
+		if d := dispositions[id]; len(d) != 1 || d[0].Status != status {
+			t.Fatalf("Expected 1 %s disposition of %s, got %+v", status, id, d)
+		}
+	}
+	if d := dispositions["retried"][0]; d.Attempts != 1 || d.Err != nil {
+		t.Fatalf("Expected the retried message to be sent after 1 failed attempt, got %+v", d)
+	}
+	if d := dispositions["expired"][0]; !errors.Is(d.Err, ErrMessageExpired) {
+		t.Fatalf("Expected ErrMessageExpired, got %+v", d)
+	}
+
+	dls := queue.DeadLetters()
+	if len(dls) != 2 || dls[0].CorrelationID == "" {
+		t.Fatalf("Expected the failed and the expired dead letters, got %+v", dls)
+	}
+}
+
+func TestQueueDispositionOnce(t *testing.T) {
+	var calls int
+	queue := NewQueue(MailerFunc(func(m *Message) error { return errors.New("rejected") }), QueueConfig{})
+
+	id, _ := queue.Enqueue(&Message{}, WithDisposition(func(Disposition) { calls++ }))
+
+	queue.Start()
+	waitFor(t, func() bool { return len(queue.DeadLetters()) == 1 })
+
+	if err := queue.RetryDeadLetter(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("Expected the callback to be called once, got %d", calls)
+	}
+}
+
+func TestQueueExpiredBeforeRetry(t *testing.T) {
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		return &textproto.Error{Code: 451, Msg: "try again later"}
+	}), QueueConfig{MaxAttempts: 3, RetryBackoff: time.Hour})
+
+	var disposition Disposition
+	_, _ = queue.Enqueue(&Message{}, WithExpiration(time.Now().Add(time.Minute)), WithDisposition(func(d Disposition) { disposition = d }))
+
+	queue.Start()
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if disposition.Status != DeliveryExpired || disposition.Attempts != 2 {
+		t.Fatalf("Expected the message to expire instead of being retried after it, got %+v", disposition)
+	}
+}
+
+func TestPluginEnqueueDisposition(t *testing.T) {
+	p := &Plugin{}
+	if err := (&Plugin{}).Enqueue(&Message{}); err == nil {
+		t.Fatal("Expected the queue not configured error")
+	}
+
+	if err := p.Init(testConfigurer{"mailer.null": nil, "mailer.queue": map[string]any{}, "mailer.quota": map[string]any{"per_sender": 10}}); err != nil {
+		t.Fatal(err)
+	}
+	p.Serve()
+
+	done := make(chan Disposition, 1)
+	m := &Message{From: mail.Address{Address: "sender@example.com"}, To: []mail.Address{{Address: "john@example.com"}}, Text: "text"}
+	if err := p.Enqueue(m, WithCorrelationID("order-1"), WithDisposition(func(d Disposition) { done <- d })); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-done:
+		if d.CorrelationID != "order-1" || d.Status != DeliverySent {
+			t.Fatalf("Expected the sent disposition of order-1, got %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the disposition")
+	}
+
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,420 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimDefaultHeaders are the header fields signed by default, when present.
+var dkimDefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Unsubscribe", "List-Unsubscribe-Post",
+	"BIMI-Selector",
+}
+
+// dkimRequiredHeaders are always signed when present, even if not configured
+// (the BIMI-Selector header is honored only when covered by the DKIM signature).
+var dkimRequiredHeaders = []string{"From", "BIMI-Selector"}
+
+// DKIMConfig defines the DKIM (RFC 6376) signing settings of the outgoing messages.
+//
+// Exactly one of PrivateKey or PrivateKeyFile must be set.
+type DKIMConfig struct {
+	Domain         string        `mapstructure:"domain" json:"domain,omitempty" bson:"domain,omitempty"`                               // the signing domain ("d=" tag)
+	Selector       string        `mapstructure:"selector" json:"selector,omitempty" bson:"selector,omitempty"`                         // the key selector ("s=" tag)
+	PrivateKey     string        `mapstructure:"private_key" json:"private_key,omitempty" bson:"private_key,omitempty"`                // PEM encoded RSA or Ed25519 key
+	PrivateKeyFile string        `mapstructure:"private_key_file" json:"private_key_file,omitempty" bson:"private_key_file,omitempty"` // path to a PEM encoded key file
+	Expiration     time.Duration `mapstructure:"expiration" json:"expiration,omitempty" bson:"expiration,omitempty"`                   // optional signatures lifetime ("x=" tag)
+
+	// Headers are the signed header fields (when present), default
+	// to the common ones. From and BIMI-Selector are always signed.
+	Headers []string `mapstructure:"headers" json:"headers,omitempty" bson:"headers,omitempty"`
+
+	// Clock is an optional time source of the signatures timestamps
+	// (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the DKIM configuration for common mistakes.
+func (c DKIMConfig) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(c.Domain) == "" {
+		errs = append(errs, errors.New("dkim: domain is required"))
+	}
+
+	if strings.TrimSpace(c.Selector) == "" {
+		errs = append(errs, errors.New("dkim: selector is required"))
+	}
+
+	if c.PrivateKey == "" && c.PrivateKeyFile == "" {
+		errs = append(errs, errors.New("dkim: either private_key or private_key_file must be set"))
+	}
+
+	if c.PrivateKey != "" && c.PrivateKeyFile != "" {
+		errs = append(errs, errors.New("dkim: private_key and private_key_file are mutually exclusive"))
+	}
+
+	if c.Expiration < 0 {
+		errs = append(errs, fmt.Errorf("dkim: expiration must be positive, got %s", c.Expiration))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c DKIMConfig) Redacted() DKIMConfig {
+	c.PrivateKey = redact(c.PrivateKey)
+	c.Clock = nil
+
+	return c
+}
+
+// DKIMSigner is a [Signer] that adds a DKIM-Signature header
+// (relaxed/relaxed canonicalization) to the outgoing messages.
+type DKIMSigner struct {
+	config DKIMConfig
+	key    *signingKey
+}
+
+// NewDKIMSigner creates a new DKIM signer from the provided config.
+func NewDKIMSigner(config DKIMConfig) (*DKIMSigner, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	key, err := loadSigningKey(config.PrivateKey, config.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	config.Headers = dkimHeaders(config.Headers)
+
+	return &DKIMSigner{config: config, key: key}, nil
+}
+
+// Key returns the signing key, eg. to publish or check its DNS record.
+func (s *DKIMSigner) Key() DKIMKey {
+	return DKIMKey{Domain: s.config.Domain, Selector: s.config.Selector, key: s.key}
+}
+
+// dkimHeaders returns the signed header fields, ie. the configured
+// ones (or the default ones) with all the required ones.
+func dkimHeaders(headers []string) []string {
+	if len(headers) == 0 {
+		headers = dkimDefaultHeaders
+	}
+	for _, required := range dkimRequiredHeaders {
+		if !containsFold(headers, required) {
+			headers = append(append([]string(nil), headers...), required)
+		}
+	}
+
+	return headers
+}
+
+// Sign implements [Signer] interface.
+func (s *DKIMSigner) Sign(raw []byte) ([]byte, error) {
+	fields, body := splitRawMessage(raw)
+
+	signed, names := selectHeaders(fields, s.config.Headers)
+
+	t := now(s.config.Clock)
+	tags := [][2]string{
+		{"v", "1"},
+		{"a", s.key.algorithm},
+		{"c", "relaxed/relaxed"},
+		{"d", s.config.Domain},
+		{"s", s.config.Selector},
+		{"t", strconv.FormatInt(t.Unix(), 10)},
+	}
+	if s.config.Expiration > 0 {
+		tags = append(tags, [2]string{"x", strconv.FormatInt(t.Add(s.config.Expiration).Unix(), 10)})
+	}
+	tags = append(tags,
+		[2]string{"h", strings.ToLower(strings.Join(names, ":"))},
+		[2]string{"bh", bodyHash(body)},
+		[2]string{"b", ""},
+	)
+	field := signatureField("DKIM-Signature", tags)
+
+	var data strings.Builder
+	for _, f := range signed {
+		data.WriteString(relaxedHeader(f.field))
+	}
+	data.WriteString(strings.TrimSuffix(relaxedHeader(field), "\r\n"))
+
+	sig, err := s.key.sign([]byte(data.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(field + sig + "\r\n"), nil
+}
+
+// signingKey is a parsed DKIM signing key, the DKIM style signing
+// primitives (RFC 6376 and RFC 8463) below being shared by the signers.
+type signingKey struct {
+	signer    crypto.Signer
+	algorithm string // the "a=" tag value
+}
+
+// loadSigningKey loads the PEM private key from either the provided value or file.
+func loadSigningKey(value, file string) (*signingKey, error) {
+	data := []byte(value)
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(expandEnv(file)); err != nil {
+			return nil, fmt.Errorf("failed to read private_key_file: %w", err)
+		}
+	}
+
+	return parseSigningKey(data)
+}
+
+// parseSigningKey parses a PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private key.
+func parseSigningKey(data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+
+	var key any
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{signer: k, algorithm: "rsa-sha256"}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{signer: k, algorithm: "ed25519-sha256"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// sign returns the base64 signature of the canonicalized data.
+func (k *signingKey) sign(data []byte) (string, error) {
+	hash := sha256.Sum256(data)
+
+	var sig []byte
+	var err error
+	if _, ok := k.signer.(ed25519.PrivateKey); ok {
+		// RFC 8463: the Ed25519 signature is computed over the SHA-256 hash
+		sig, err = k.signer.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	} else {
+		sig, err = k.signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// rawHeaderField is a single (possibly folded) header field of a raw message.
+type rawHeaderField struct {
+	name  string // as written
+	field string // the whole field, including the name and the trailing CRLF
+}
+
+// value returns the unfolded field value.
+func (f rawHeaderField) value() string {
+	_, v, _ := strings.Cut(f.field, ":")
+
+	return strings.TrimSpace(unfold(v))
+}
+
+// splitRawMessage splits a raw message into its header fields and body.
+func splitRawMessage(raw []byte) ([]rawHeaderField, []byte) {
+	var fields []rawHeaderField
+
+	rest := raw
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			end = len(rest) - 1
+		}
+		line := rest[:end+1]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, rest[end+1:] // the empty line separating the body
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].field += string(line) // continuation line
+		} else {
+			name, _, _ := strings.Cut(string(line), ":")
+			fields = append(fields, rawHeaderField{name: strings.TrimSpace(name), field: string(line)})
+		}
+
+		rest = rest[end+1:]
+	}
+
+	return fields, nil
+}
+
+// selectHeaders returns the fields to sign for the specified names, picking the
+// repeated fields from the bottom up (RFC 6376 section 5.4.2), and the
+// names of the fields that were found.
+func selectHeaders(fields []rawHeaderField, names []string) ([]rawHeaderField, []string) {
+	used := make([]bool, len(fields))
+
+	var selected []rawHeaderField
+	var found []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				found = append(found, name)
+				break
+			}
+		}
+	}
+
+	return selected, found
+}
+
+// relaxedHeader canonicalizes a header field with the "relaxed" algorithm.
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWSP(unfold(value))) + "\r\n"
+}
+
+// relaxedBody canonicalizes a message body with the "relaxed" algorithm.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+
+	var buf bytes.Buffer
+	empty := 0
+	for _, line := range lines {
+		line = strings.TrimRight(collapseWSP(line), " ")
+		if line == "" {
+			empty++ // the trailing empty lines are ignored
+			continue
+		}
+
+		for ; empty > 0; empty-- {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+// bodyHash returns the base64 SHA-256 hash of the relaxed canonicalized body.
+func bodyHash(body []byte) string {
+	hash := sha256.Sum256(relaxedBody(body))
+
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// signatureField formats a signature header field from the ordered tags,
+// folding it between the tags. The "b" tag is always last, so that its
+// value could be appended once the field is signed.
+func signatureField(name string, tags [][2]string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString(":")
+
+	lineLen := sb.Len()
+	for i, tag := range tags {
+		part := " " + tag[0] + "=" + tag[1]
+		if i < len(tags)-1 {
+			part += ";"
+		}
+
+		if lineLen+len(part) > 76 && i > 0 {
+			sb.WriteString("\r\n\t")
+			part = part[1:]
+			lineLen = 1
+		}
+
+		sb.WriteString(part)
+		lineLen += len(part)
+	}
+
+	return sb.String()
+}
+
+var unfoldReplacer = strings.NewReplacer("\r\n", "", "\n", "")
+
+// unfold removes the folding CRLFs of a header value.
+func unfold(value string) string {
+	return unfoldReplacer.Replace(value)
+}
+
+// collapseWSP replaces all whitespace sequences with a single space.
+func collapseWSP(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' || r == '\r' {
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		sb.WriteRune(r)
+	}
+	if space {
+		sb.WriteByte(' ')
+	}
+
+	return sb.String()
+}
+
+// containsFold reports whether list contains s, ignoring the case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTagList parses a "tag=value; tag=value" list (eg. a DKIM-Signature value).
+func parseTagList(value string) map[string]string {
+	tags := map[string]string{}
+
+	for _, part := range strings.Split(value, ";") {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return tags
+}
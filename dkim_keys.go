@@ -0,0 +1,577 @@
+package mailer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDKIMKeyBits        = 2048
+	defaultDKIMOverlap        = 48 * time.Hour
+	defaultDKIMSelectorFormat = "mailer-20060102"
+
+	// dkimKeysManifest is the file of the store directory listing its keys.
+	dkimKeysManifest = "keys.json"
+)
+
+// DKIMKeysConfig defines the managed DKIM keys of multiple domains.
+//
+// Each domain has a single active key at a time. When rotation is enabled,
+// the next key is generated Overlap before it becomes active, so that its
+// DNS record could be published in time, and the previous key is kept
+// (ie. should stay published) for Overlap after it has been replaced.
+type DKIMKeysConfig struct {
+	Dir            string        `mapstructure:"dir" json:"dir,omitempty" bson:"dir,omitempty"`                                     // the keys directory
+	Domains        []string      `mapstructure:"domains" json:"domains,omitempty" bson:"domains,omitempty"`                         // the signing domains
+	Algorithm      string        `mapstructure:"algorithm" json:"algorithm,omitempty" bson:"algorithm,omitempty"`                   // "rsa" (default) or "ed25519"
+	KeyBits        int           `mapstructure:"key_bits" json:"key_bits,omitempty" bson:"key_bits,omitempty"`                      // the RSA key size, default to 2048
+	Rotation       time.Duration `mapstructure:"rotation" json:"rotation,omitempty" bson:"rotation,omitempty"`                      // the keys lifetime, 0 disables the rotation
+	Overlap        time.Duration `mapstructure:"overlap" json:"overlap,omitempty" bson:"overlap,omitempty"`                         // default to 48h
+	SelectorFormat string        `mapstructure:"selector_format" json:"selector_format,omitempty" bson:"selector_format,omitempty"` // time layout of the selectors, default to "mailer-20060102"
+	Expiration     time.Duration `mapstructure:"expiration" json:"expiration,omitempty" bson:"expiration,omitempty"`                // optional signatures lifetime ("x=" tag)
+
+	// Headers are the signed header fields (when present), default
+	// to the common ones. From and BIMI-Selector are always signed.
+	Headers []string `mapstructure:"headers" json:"headers,omitempty" bson:"headers,omitempty"`
+
+	// OnRotate is an optional hook called with every newly generated key,
+	// eg. to publish its DNS record (see [DKIMKey.RecordValue]).
+	OnRotate func(key DKIMKey) `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when a due rotation fails
+	// while the messages are still signed with the current key.
+	OnError func(err error) `mapstructure:"-" json:"-" bson:"-"`
+
+	// Clock is the time source of the rotation schedule and
+	// the signatures timestamps (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the DKIM keys configuration for common mistakes.
+func (c DKIMKeysConfig) Validate() error {
+	var errs []error
+
+	if c.Dir == "" {
+		errs = append(errs, errors.New("dkim_keys: dir is required"))
+	}
+
+	if len(c.Domains) == 0 {
+		errs = append(errs, errors.New("dkim_keys: at least one domain is required"))
+	}
+	for i, domain := range c.Domains {
+		if strings.TrimSpace(domain) == "" || strings.ContainsAny(domain, "/\\ ") {
+			errs = append(errs, fmt.Errorf("dkim_keys: domains[%d] invalid domain %q", i, domain))
+		}
+	}
+
+	switch c.Algorithm {
+	case "", "rsa", "ed25519":
+	default:
+		errs = append(errs, fmt.Errorf("dkim_keys: unknown algorithm %q, expected rsa or ed25519", c.Algorithm))
+	}
+
+	if c.KeyBits != 0 && c.KeyBits < 1024 {
+		errs = append(errs, fmt.Errorf("dkim_keys: key_bits must be at least 1024, got %d", c.KeyBits))
+	}
+
+	if c.Rotation < 0 {
+		errs = append(errs, fmt.Errorf("dkim_keys: rotation must be positive, got %s", c.Rotation))
+	}
+
+	if c.Overlap < 0 {
+		errs = append(errs, fmt.Errorf("dkim_keys: overlap must be positive, got %s", c.Overlap))
+	}
+
+	if c.Rotation > 0 && c.overlap() >= c.Rotation {
+		errs = append(errs, fmt.Errorf("dkim_keys: overlap %s must be shorter than the rotation %s", c.overlap(), c.Rotation))
+	}
+
+	if c.SelectorFormat != "" && !isDKIMSelector(time.Now().Format(c.SelectorFormat)) {
+		errs = append(errs, fmt.Errorf("dkim_keys: selector_format %q doesn't produce valid selectors", c.SelectorFormat))
+	}
+
+	if c.Expiration < 0 {
+		errs = append(errs, fmt.Errorf("dkim_keys: expiration must be positive, got %s", c.Expiration))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c DKIMKeysConfig) overlap() time.Duration {
+	if c.Overlap == 0 {
+		return defaultDKIMOverlap
+	}
+
+	return c.Overlap
+}
+
+// DKIMKey is a single managed DKIM key.
+type DKIMKey struct {
+	Domain     string    `json:"domain"`
+	Selector   string    `json:"selector"`
+	ActiveFrom time.Time `json:"active_from"` // when the key starts signing the messages
+
+	key *signingKey
+}
+
+// RecordName returns the name of the key DNS TXT record.
+func (k DKIMKey) RecordName() string {
+	return k.Selector + "._domainkey." + k.Domain
+}
+
+// RecordValue returns the value of the key DNS TXT record, eg.
+// "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA...".
+func (k DKIMKey) RecordValue() string {
+	if pub, ok := k.key.signer.Public().(ed25519.PublicKey); ok {
+		// RFC 8463: the raw public key rather than the SubjectPublicKeyInfo
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(k.key.signer.Public())
+
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+// CheckRecord checks that the key DNS TXT record is published, with the
+// public key of the key, using the provided resolver (default to the system one).
+func (k DKIMKey) CheckRecord(ctx context.Context, resolver DNSResolver) error {
+	records, err := defaultResolver(resolver).LookupTXT(ctx, k.RecordName())
+	if err != nil {
+		return fmt.Errorf("dkim: failed to look up %s: %w", k.RecordName(), err)
+	}
+
+	expected := parseTagList(k.RecordValue())["p"]
+	for _, record := range records {
+		tags := parseTagList(record)
+		if v, ok := tags["v"]; ok && v != "DKIM1" {
+			continue
+		}
+
+		published, ok := tags["p"]
+		if !ok {
+			continue
+		}
+		if published = strings.Join(strings.Fields(published), ""); published == expected {
+			return nil
+		}
+		if published == "" {
+			return fmt.Errorf("dkim: the key of %s is revoked (empty p= tag)", k.RecordName())
+		}
+
+		return fmt.Errorf("dkim: the key published at %s doesn't match the configured one, expected %q", k.RecordName(), k.RecordValue())
+	}
+
+	return fmt.Errorf("dkim: no key is published at %s, expected %q", k.RecordName(), k.RecordValue())
+}
+
+// ZoneRecord returns the key DNS TXT record in the zone file format,
+// with its value split into the 255 characters long strings.
+func (k DKIMKey) ZoneRecord() string {
+	value := k.RecordValue()
+
+	var chunks []string
+	for len(value) > 255 {
+		chunks = append(chunks, strconv.Quote(value[:255]))
+		value = value[255:]
+	}
+	chunks = append(chunks, strconv.Quote(value))
+
+	return k.RecordName() + ". IN TXT ( " + strings.Join(chunks, " ") + " )"
+}
+
+// DKIMKeyStore is a [Signer] that manages the DKIM keys of multiple
+// domains in a directory, rotating them on schedule, and signs the
+// messages with the active key of their From domain (or of its closest
+// parent domain). The messages of the other domains are not signed.
+//
+// The due rotations are performed on the store creation and before
+// signing, but they could also be triggered with [DKIMKeyStore.Rotate]
+// (eg. periodically, so that the next keys are generated in time even
+// if no messages are sent).
+//
+// The directory holds the "keys.json" manifest and the PEM encoded keys
+// named "{domain}/{selector}.pem". Existing keys could be imported by
+// adding them to the manifest.
+type DKIMKeyStore struct {
+	config  DKIMKeysConfig
+	headers []string
+
+	mu   sync.Mutex
+	keys []*DKIMKey // sorted by domain and activation
+}
+
+var _ Signer = (*DKIMKeyStore)(nil)
+
+// NewDKIMKeyStore opens (or initializes) the DKIM keys store
+// of the config, generating all due keys.
+func NewDKIMKeyStore(config DKIMKeysConfig) (*DKIMKeyStore, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &DKIMKeyStore{config: config, headers: dkimHeaders(config.Headers)}
+
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("dkim_keys: %w", err)
+	}
+
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Keys returns all keys of the store, ie. the ones which should
+// be published, sorted by domain and activation.
+func (s *DKIMKeyStore) Keys() []DKIMKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]DKIMKey, len(s.keys))
+	for i, key := range s.keys {
+		keys[i] = *key
+	}
+
+	return keys
+}
+
+// Rotate generates the missing and due keys of all domains
+// and removes the keys replaced more than Overlap ago.
+func (s *DKIMKeyStore) Rotate() error {
+	s.mu.Lock()
+	generated, err := s.rotate(now(s.config.Clock))
+	s.mu.Unlock()
+
+	if s.config.OnRotate != nil {
+		for _, key := range generated {
+			s.config.OnRotate(key)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("dkim_keys: %w", err)
+	}
+
+	return nil
+}
+
+// Sign implements [Signer] interface.
+func (s *DKIMKeyStore) Sign(raw []byte) ([]byte, error) {
+	fields, _ := splitRawMessage(raw)
+
+	var domain string
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "From") {
+			if address, err := mail.ParseAddress(f.value()); err == nil {
+				_, domain, _ = strings.Cut(address.Address, "@")
+			}
+			break
+		}
+	}
+
+	if err := s.Rotate(); err != nil {
+		if s.active(domain) == nil {
+			return nil, err
+		}
+		if s.config.OnError != nil {
+			s.config.OnError(err)
+		}
+	}
+
+	key := s.active(domain)
+	if key == nil {
+		return nil, nil
+	}
+
+	signer := &DKIMSigner{
+		config: DKIMConfig{
+			Domain:     key.Domain,
+			Selector:   key.Selector,
+			Expiration: s.config.Expiration,
+			Headers:    s.headers,
+			Clock:      s.config.Clock,
+		},
+		key: key.key,
+	}
+
+	return signer.Sign(raw)
+}
+
+// active returns the active key of the domain or of its closest parent domain (if any).
+func (s *DKIMKeyStore) active(domain string) *DKIMKey {
+	t := now(s.config.Clock)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for domain != "" {
+		var active *DKIMKey
+		for _, key := range s.keys {
+			if strings.EqualFold(key.Domain, domain) && !key.ActiveFrom.After(t) {
+				active = key
+			}
+		}
+		if active != nil {
+			return active
+		}
+
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+
+	return nil
+}
+
+// rotate generates the missing and due keys as of t and removes the retired ones.
+func (s *DKIMKeyStore) rotate(t time.Time) ([]DKIMKey, error) {
+	var generated []DKIMKey
+	var retired []*DKIMKey
+
+	overlap := s.config.overlap()
+
+	for _, domain := range s.config.Domains {
+		var active, pending *DKIMKey
+		var previous []*DKIMKey
+		for _, key := range s.keys {
+			if !strings.EqualFold(key.Domain, domain) {
+				continue
+			}
+			if key.ActiveFrom.After(t) {
+				pending = key
+				continue
+			}
+			if active != nil {
+				previous = append(previous, active)
+			}
+			active = key
+		}
+
+		var activeFrom time.Time
+		switch {
+		case active == nil && pending == nil:
+			activeFrom = t // the very first key (its record must be published right away)
+		case active != nil && pending == nil && s.config.Rotation > 0 &&
+			!t.Before(active.ActiveFrom.Add(s.config.Rotation-overlap)):
+			activeFrom = active.ActiveFrom.Add(s.config.Rotation)
+			if earliest := t.Add(overlap); activeFrom.Before(earliest) {
+				activeFrom = earliest // leave enough time to publish the record
+			}
+		}
+
+		if !activeFrom.IsZero() {
+			key, err := s.generate(domain, activeFrom)
+			if err != nil {
+				return generated, err
+			}
+			generated = append(generated, *key)
+		}
+
+		if active != nil && !t.Before(active.ActiveFrom.Add(overlap)) {
+			retired = append(retired, previous...)
+		}
+	}
+
+	if len(retired) > 0 {
+		keys := s.keys[:0]
+		for _, key := range s.keys {
+			if !containsKey(retired, key) {
+				keys = append(keys, key)
+			}
+		}
+		s.keys = keys
+	}
+
+	if len(generated) == 0 && len(retired) == 0 {
+		return nil, nil
+	}
+
+	if err := s.save(); err != nil {
+		return generated, err
+	}
+
+	for _, key := range retired {
+		_ = os.Remove(s.keyFile(key))
+	}
+
+	return generated, nil
+}
+
+// generate creates a new key of the domain active from the specified time.
+func (s *DKIMKeyStore) generate(domain string, activeFrom time.Time) (*DKIMKey, error) {
+	var private any
+	var err error
+	if s.config.Algorithm == "ed25519" {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		bits := s.config.KeyBits
+		if bits == 0 {
+			bits = defaultDKIMKeyBits
+		}
+		private, err = rsa.GenerateKey(rand.Reader, bits)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the %s key: %w", domain, err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	format := s.config.SelectorFormat
+	if format == "" {
+		format = defaultDKIMSelectorFormat
+	}
+
+	dkimKey := &DKIMKey{Domain: strings.ToLower(domain), ActiveFrom: activeFrom.UTC(), key: key}
+
+	// suffix the selectors of the keys generated within the same format period
+	base := activeFrom.UTC().Format(format)
+	dkimKey.Selector = base
+	for i := 2; s.hasSelector(domain, dkimKey.Selector); i++ {
+		dkimKey.Selector = base + "-" + strconv.Itoa(i)
+	}
+
+	file := s.keyFile(dkimKey)
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		return nil, err
+	}
+
+	s.keys = append(s.keys, dkimKey)
+	sort.SliceStable(s.keys, func(i, j int) bool {
+		if s.keys[i].Domain != s.keys[j].Domain {
+			return s.keys[i].Domain < s.keys[j].Domain
+		}
+		return s.keys[i].ActiveFrom.Before(s.keys[j].ActiveFrom)
+	})
+
+	return dkimKey, nil
+}
+
+func (s *DKIMKeyStore) hasSelector(domain, selector string) bool {
+	for _, key := range s.keys {
+		if strings.EqualFold(key.Domain, domain) && key.Selector == selector {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *DKIMKeyStore) keyFile(key *DKIMKey) string {
+	return filepath.Join(s.config.Dir, strings.ToLower(key.Domain), key.Selector+".pem")
+}
+
+// load reads the manifest and the keys of the store directory (if any).
+func (s *DKIMKeyStore) load() error {
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, dkimKeysManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys []*DKIMKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid %s: %w", dkimKeysManifest, err)
+	}
+
+	for _, key := range keys {
+		if !isDKIMSelector(key.Selector) || strings.ContainsAny(key.Domain, "/\\") {
+			return fmt.Errorf("invalid %s key %q of %q", dkimKeysManifest, key.Selector, key.Domain)
+		}
+		key.Domain = strings.ToLower(key.Domain)
+		if key.key, err = loadSigningKey("", s.keyFile(key)); err != nil {
+			return fmt.Errorf("failed to load the %s key of %s: %w", key.Selector, key.Domain, err)
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Domain != keys[j].Domain {
+			return keys[i].Domain < keys[j].Domain
+		}
+		return keys[i].ActiveFrom.Before(keys[j].ActiveFrom)
+	})
+	s.keys = keys
+
+	return nil
+}
+
+// save writes the store manifest.
+func (s *DKIMKeyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(s.config.Dir, dkimKeysManifest)
+	if err := os.MkdirAll(s.config.Dir, 0o700); err != nil {
+		return err
+	}
+
+	// write to a temp file first so that the manifest is never left partially written
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func containsKey(keys []*DKIMKey, key *DKIMKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDKIMSelector reports whether s is a valid DKIM selector,
+// ie. dot separated labels of letters, digits and hyphens.
+func isDKIMSelector(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,216 @@
+package mailer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMKeyStore(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	current := start
+	day := 24 * time.Hour
+
+	var rotated []string
+	config := DKIMKeysConfig{
+		Dir:       t.TempDir(),
+		Domains:   []string{"Example.com", "acme.example"},
+		Algorithm: "ed25519",
+		Rotation:  30 * day,
+		Overlap:   2 * day,
+		OnRotate:  func(key DKIMKey) { rotated = append(rotated, key.Domain+"/"+key.Selector) },
+		Clock:     ClockFunc(func() time.Time { return current }),
+	}
+
+	store, err := NewDKIMKeyStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name              string
+		advance           time.Duration
+		reopen            bool
+		from              string
+		expectedSelector  string // empty for no signature
+		expectedSelectors []string
+	}{
+		{"first key", 0, false, "info@example.com", "mailer-20240101", []string{"mailer-20240101"}},
+		{"subdomain", 0, false, "info@news.example.com", "mailer-20240101", []string{"mailer-20240101"}},
+		{"unmanaged domain", 0, false, "info@example.org", "", []string{"mailer-20240101"}},
+		{"before pre-publishing", 27 * day, false, "info@example.com", "mailer-20240101", []string{"mailer-20240101"}},
+		{"pre-published", day, false, "info@example.com", "mailer-20240101", []string{"mailer-20240101", "mailer-20240131"}},
+		{"reopened", 0, true, "info@example.com", "mailer-20240101", []string{"mailer-20240101", "mailer-20240131"}},
+		{"rotated", 2 * day, false, "info@example.com", "mailer-20240131", []string{"mailer-20240101", "mailer-20240131"}},
+		{"previous key retired", 2 * day, false, "info@example.com", "mailer-20240131", []string{"mailer-20240131"}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			current = current.Add(s.advance)
+
+			if s.reopen {
+				if store, err = NewDKIMKeyStore(config); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var raw []byte
+			next := MailerFunc(func(m *Message) error {
+				var err error
+				raw, err = m.Render()
+				return err
+			})
+
+			m := &Message{
+				From:    mail.Address{Address: s.from},
+				To:      []mail.Address{{Address: "john@example.net"}},
+				Subject: "Hello",
+				Text:    "Hello world",
+			}
+			if err := Chain(next, Signing(store)).Send(m); err != nil {
+				t.Fatal(err)
+			}
+
+			var selectors []string
+			keys := map[string]DKIMKey{}
+			for _, key := range store.Keys() {
+				if key.Domain == "example.com" {
+					selectors = append(selectors, key.Selector)
+					keys[key.Selector] = key
+				}
+			}
+			if strings.Join(selectors, ",") != strings.Join(s.expectedSelectors, ",") {
+				t.Fatalf("Expected keys %v, got %v", s.expectedSelectors, selectors)
+			}
+
+			fields, _ := splitRawMessage(raw)
+			if s.expectedSelector == "" {
+				if fields[0].name == "DKIM-Signature" {
+					t.Fatalf("Expected no signature, got %s", fields[0].field)
+				}
+				return
+			}
+
+			if fields[0].name != "DKIM-Signature" {
+				t.Fatalf("Expected the message to be signed, got\n%s", raw)
+			}
+
+			tags := parseTagList(fields[0].value())
+			if tags["d"] != "example.com" || tags["s"] != s.expectedSelector {
+				t.Fatalf("Expected d=example.com s=%s, got %v", s.expectedSelector, tags)
+			}
+
+			// verify with the public key of the published record
+			record := parseTagList(keys[s.expectedSelector].RecordValue())
+			pub, err := base64.StdEncoding.DecodeString(record["p"])
+			if err != nil || record["k"] != "ed25519" {
+				t.Fatalf("Invalid record %v", record)
+			}
+
+			var data string
+			signed, _ := selectHeaders(fields, strings.Split(tags["h"], ":"))
+			for _, f := range signed {
+				data += relaxedHeader(f.field)
+			}
+			verifySignatureField(t, crypto.PublicKey(ed25519.PublicKey(pub)), fields[0], data)
+		})
+	}
+
+	expectedRotated := "example.com/mailer-20240101,acme.example/mailer-20240101,example.com/mailer-20240131,acme.example/mailer-20240131"
+	if got := strings.Join(rotated, ","); got != expectedRotated {
+		t.Fatalf("Expected rotated keys %s, got %s", expectedRotated, got)
+	}
+}
+
+func TestDKIMKeyZoneRecord(t *testing.T) {
+	store, err := NewDKIMKeyStore(DKIMKeysConfig{Dir: t.TempDir(), Domains: []string{"example.com"}, KeyBits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := store.Keys()[0]
+
+	record := key.ZoneRecord()
+	if !strings.HasPrefix(record, key.RecordName()+". IN TXT ( \"v=DKIM1; k=rsa; p=MIIB") {
+		t.Fatalf("Unexpected zone record %s", record)
+	}
+
+	value := strings.NewReplacer("\" \"", "").Replace(record[strings.Index(record, "(")+3 : strings.LastIndex(record, ")")-2])
+	if value != key.RecordValue() || strings.Count(record, "\"") != 4 {
+		t.Fatalf("Expected the value split into 2 strings, got %s", record)
+	}
+}
+
+// fakeResolver resolves the records of the maps, keyed by the name.
+type fakeResolver struct {
+	txt map[string][]string
+	mx  map[string][]*net.MX
+	ips map[string][]net.IPAddr
+}
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return fakeLookup(r.txt, name)
+}
+
+func (r fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return fakeLookup(r.mx, name)
+}
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return fakeLookup(r.ips, strings.TrimSuffix(host, "."))
+}
+
+func fakeLookup[T any](records map[string][]T, name string) ([]T, error) {
+	values, ok := records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return values, nil
+}
+
+func TestDKIMKeyCheckRecord(t *testing.T) {
+	store, err := NewDKIMKeyStore(DKIMKeysConfig{Dir: t.TempDir(), Domains: []string{"example.com"}, Algorithm: "ed25519"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := store.Keys()[0]
+	value := key.RecordValue()
+
+	scenarios := []struct {
+		name     string
+		records  []string
+		expected string // empty for no error
+	}{
+		{"published", []string{"v=spf1 -all", value}, ""},
+		{"published folded", []string{strings.Replace(value, "p=", "p= ", 1)}, ""},
+		{"revoked", []string{"v=DKIM1; p="}, "revoked"},
+		{"mismatch", []string{"v=DKIM1; k=ed25519; p=AAAA"}, "doesn't match"},
+		{"missing", []string{"v=spf1 -all"}, "no key is published"},
+		{"not found", nil, "failed to look up"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			resolver := fakeResolver{txt: map[string][]string{}}
+			if s.records != nil {
+				resolver.txt[key.RecordName()] = s.records
+			}
+
+			err := key.CheckRecord(context.Background(), resolver)
+			if s.expected == "" && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if s.expected != "" && (err == nil || !strings.Contains(err.Error(), s.expected)) {
+				t.Fatalf("Expected error %q, got %v", s.expected, err)
+			}
+		})
+	}
+}
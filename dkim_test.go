@@ -0,0 +1,105 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewDKIMSigner(DKIMConfig{
+		Domain:     "example.com",
+		Selector:   "mail",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		Expiration: time.Hour,
+		Headers:    []string{"Subject"},
+		Clock:      ClockFunc(func() time.Time { return time.Unix(1700000000, 0) }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []byte
+	next := MailerFunc(func(m *Message) error {
+		var err error
+		raw, err = m.Render()
+		return err
+	})
+
+	m := &Message{
+		From:    mail.Address{Address: "info@example.com"},
+		To:      []mail.Address{{Address: "john@example.org"}},
+		Subject: "Hello",
+		HTML:    "<p>Hello   world</p>",
+		Text:    "Hello world \n\n\n",
+	}
+
+	mailer := Chain(next, Signing(signer), BIMI(BIMIConfig{Selector: "brand"}))
+	if err := mailer.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Headers != nil {
+		t.Fatalf("Expected the original message to be unchanged, got %v", m.Headers)
+	}
+	if !strings.HasPrefix(string(raw), "DKIM-Signature: v=1; a=rsa-sha256;") {
+		t.Fatalf("Expected the message to start with the DKIM signature, got\n%s", raw)
+	}
+	if !strings.Contains(string(raw), "\r\nBIMI-Selector: v=BIMI1; s=brand\r\n") {
+		t.Fatalf("Expected the BIMI-Selector header, got\n%s", raw)
+	}
+
+	fields, body := splitRawMessage(raw)
+
+	tags := parseTagList(fields[0].value())
+	if tags["h"] != "subject:from:bimi-selector" {
+		t.Fatalf("Expected the required headers to be signed, got h=%s", tags["h"])
+	}
+	if tags["x"] != "1700003600" || tags["bh"] != bodyHash(body) {
+		t.Fatalf("Unexpected signature tags %v", tags)
+	}
+
+	var data string
+	signed, _ := selectHeaders(fields, strings.Split(tags["h"], ":"))
+	for _, f := range signed {
+		data += relaxedHeader(f.field)
+	}
+	verifySignatureField(t, &key.PublicKey, fields[0], data)
+}
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	if v := relaxedHeader("SUBJect: \t Hello \r\n   World  \r\n"); v != "subject:Hello World\r\n" {
+		t.Fatalf("Unexpected relaxed header %q", v)
+	}
+
+	body := relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))
+	if string(body) != " C\r\nD E\r\n" {
+		t.Fatalf("Unexpected relaxed body %q", body)
+	}
+
+	if body := relaxedBody([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Fatalf("Expected empty relaxed body, got %q", body)
+	}
+}
+
+func TestBIMIConfigValidate(t *testing.T) {
+	if err := (BIMIConfig{Selector: "brand-1"}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, selector := range []string{"", "-brand", "brand.sub", "a b"} {
+		if err := (BIMIConfig{Selector: selector}).Validate(); err == nil {
+			t.Fatalf("Expected selector %q to be invalid", selector)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package mailer
+
+import (
+	"context"
+	"net"
+)
+
+var _ DNSResolver = (*net.Resolver)(nil)
+
+// DNSResolver looks up the DNS records, as [net.Resolver] does
+// (eg. to check the published records of the sending domains).
+type DNSResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func defaultResolver(resolver DNSResolver) DNSResolver {
+	if resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return resolver
+}
@@ -0,0 +1,128 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BodyEncoding is the Content-Transfer-Encoding of the text body parts.
+type BodyEncoding string
+
+const (
+	// BodyEncodingQuotedPrintable encodes all bodies as quoted-printable (the default).
+	BodyEncodingQuotedPrintable BodyEncoding = "quoted-printable"
+
+	// BodyEncodingBase64 encodes all bodies as base64.
+	BodyEncodingBase64 BodyEncoding = "base64"
+
+	// BodyEncoding8Bit sends the bodies unencoded, which requires the
+	// 8BITMIME SMTP extension. Bodies with lines longer than the
+	// RFC 5322 limit are still sent as quoted-printable.
+	BodyEncoding8Bit BodyEncoding = "8bit"
+
+	// BodyEncodingAuto picks the smallest 7bit-safe encoding of each body:
+	// 7bit for the plain ASCII ones, base64 for the mostly non-ASCII ones
+	// (eg. Cyrillic or CJK texts) and quoted-printable otherwise.
+	BodyEncodingAuto BodyEncoding = "auto"
+)
+
+// maxLineLength is the max line length without the CRLF (RFC 5322 section 2.1.1).
+const maxLineLength = 998
+
+// validate checks whether the encoding is a supported one.
+func (e BodyEncoding) validate() error {
+	switch e {
+	case "", BodyEncodingQuotedPrintable, BodyEncodingBase64, BodyEncoding8Bit, BodyEncodingAuto:
+		return nil
+	default:
+		return fmt.Errorf("unsupported body encoding %q, expected %q, %q, %q or %q", e, BodyEncodingQuotedPrintable, BodyEncodingBase64, BodyEncoding8Bit, BodyEncodingAuto)
+	}
+}
+
+// transferEncoding returns the Content-Transfer-Encoding of the body.
+func (e BodyEncoding) transferEncoding(body string) string {
+	switch e {
+	case BodyEncodingBase64:
+		return "base64"
+	case BodyEncoding8Bit:
+		if longestLine(body) > maxLineLength {
+			return "quoted-printable"
+		}
+		if isASCII(body) {
+			return "7bit"
+		}
+		return "8bit"
+	case BodyEncodingAuto:
+		nonASCII := 0
+		for i := 0; i < len(body); i++ {
+			if body[i] >= 0x80 {
+				nonASCII++
+			}
+		}
+
+		switch {
+		case nonASCII == 0 && longestLine(body) <= maxLineLength:
+			return "7bit"
+		// every non-ASCII byte is 3 quoted-printable characters, while
+		// base64 costs ~37% of the whole body (including the line breaks)
+		case nonASCII > len(body)/6:
+			return "base64"
+		default:
+			return "quoted-printable"
+		}
+	default:
+		return "quoted-printable"
+	}
+}
+
+// writeEncodedBody writes the body with the specified Content-Transfer-Encoding.
+func writeEncodedBody(w io.Writer, encoding, body string) error {
+	switch encoding {
+	case "base64":
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w, max: 76})
+		if _, err := io.WriteString(encoder, body); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\r\n")
+		return err
+	case "7bit", "8bit":
+		_, err := io.WriteString(w, normalizeCRLF(body))
+		return err
+	default:
+		return writeQuotedPrintable(w, body)
+	}
+}
+
+// normalizeCRLF converts all bare CR and LF line breaks into CRLF.
+func normalizeCRLF(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func longestLine(s string) int {
+	longest := 0
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r", "\n"), "\n") {
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+
+	return longest
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBodyEncodingTransferEncoding(t *testing.T) {
+	scenarios := []struct {
+		encoding BodyEncoding
+		body     string
+		expected string
+	}{
+		{"", "hello", "quoted-printable"},
+		{BodyEncodingBase64, "hello", "base64"},
+		{BodyEncoding8Bit, "hello", "7bit"},
+		{BodyEncoding8Bit, "héllo", "8bit"},
+		{BodyEncoding8Bit, strings.Repeat("a", 999), "quoted-printable"},
+		{BodyEncodingAuto, "hello\r\nworld", "7bit"},
+		{BodyEncodingAuto, strings.Repeat("a", 999), "quoted-printable"},
+		{BodyEncodingAuto, "Hello wörld, this is mostly ASCII", "quoted-printable"},
+		{BodyEncodingAuto, "Здравей, свят", "base64"},
+	}
+
+	for i, s := range scenarios {
+		if v := s.encoding.transferEncoding(s.body); v != s.expected {
+			t.Errorf("(%d) Expected %q, got %q", i, s.expected, v)
+		}
+	}
+
+	if err := BodyEncoding("7bit").validate(); err == nil {
+		t.Fatal("Expected unsupported encoding error")
+	}
+}
@@ -0,0 +1,137 @@
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// DeliveryStatus is the status reported by a [DeliveryEvent].
+type DeliveryStatus string
+
+const (
+	DeliveryQueued     DeliveryStatus = "queued"     // the message was accepted by the queue
+	DeliveryScheduled  DeliveryStatus = "scheduled"  // the message was accepted by the queue and deferred (see [WithSendAt])
+	DeliverySending    DeliveryStatus = "sending"    // a delivery attempt started
+	DeliverySent       DeliveryStatus = "sent"       // the message was delivered
+	DeliveryRetrying   DeliveryStatus = "retrying"   // a retry was scheduled or a dead letter was requeued
+	DeliveryFailed     DeliveryStatus = "failed"     // the delivery attempt failed and the message is a dead letter
+	DeliveryExpired    DeliveryStatus = "expired"    // the message expired before being delivered and is a dead letter (see [WithExpiration])
+	DeliveryDiscarded  DeliveryStatus = "discarded"  // the message was discarded in dry-run mode (see [ErrDryRun])
+	DeliveryBounced    DeliveryStatus = "bounced"    // the recipient bounced after the message was accepted (see [BouncePoller])
+	DeliveryComplained DeliveryStatus = "complained" // the recipient reported the message as spam (see [ParseComplaint])
+)
+
+// eventsBufferSize is the buffer size of every subscription channel.
+const eventsBufferSize = 64
+
+// DeliveryEvent describes a single delivery progress step of a queued message.
+type DeliveryEvent struct {
+	ID            string // the queue message id (the same as the related [DeadLetter] one)
+	CorrelationID string // the id set with [WithCorrelationID]
+	Status        DeliveryStatus
+	Attempt       int   // the delivery attempt number, starting from 1 (0 for DeliveryQueued)
+	Err           error // the delivery error, set for DeliveryFailed, DeliveryExpired, DeliveryDiscarded and the scheduled DeliveryRetrying
+	At            time.Time
+
+	// Recipient is the address the event is about, set for DeliveryBounced and DeliveryComplained.
+	Recipient string
+
+	// Result is the final response of the relay, set for DeliverySent
+	// if the backend reports it (see [SendWithResult]).
+	Result *SendResult
+
+	// Message is the queued message. It is shared between all subscribers
+	// and must not be modified. It is nil for the events reported after
+	// the delivery (ie. DeliveryBounced and DeliveryComplained).
+	Message *Message
+}
+
+// eventHub fans out the delivery events to all subscribers.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan DeliveryEvent]struct{}
+	closed bool
+}
+
+func (h *eventHub) subscribe() <-chan DeliveryEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan DeliveryEvent, eventsBufferSize)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+
+	if h.subs == nil {
+		h.subs = map[chan DeliveryEvent]struct{}{}
+	}
+	h.subs[ch] = struct{}{}
+
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch <-chan DeliveryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if sub == ch {
+			delete(h.subs, sub)
+			close(sub)
+			return
+		}
+	}
+}
+
+// emit sends the event to all subscribers without blocking,
+// dropping it for the subscribers whose buffer is full.
+func (h *eventHub) emit(event DeliveryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.send(event)
+}
+
+// emitAfter runs fn and emits the event only if it succeeds, preventing any
+// other event to be emitted in between (eg. to keep "queued" before "sending").
+func (h *eventHub) emitAfter(fn func() error, event DeliveryEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+	h.send(event)
+
+	return nil
+}
+
+func (h *eventHub) send(event DeliveryEvent) {
+	if h.closed {
+		return
+	}
+
+	for sub := range h.subs {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
+
+// close closes all subscription channels.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+
+	for sub := range h.subs {
+		close(sub)
+	}
+	h.subs = nil
+}
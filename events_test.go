@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueueSubscribe(t *testing.T) {
+	failErr := errors.New("failure")
+
+	next := MailerFunc(func(m *Message) error {
+		if m.Subject == "fail" {
+			return failErr
+		}
+		return nil
+	})
+
+	queue := NewQueue(next, QueueConfig{Workers: 1, Size: 10})
+	events := queue.Subscribe()
+	queue.Start()
+
+	for _, subject := range []string{"ok", "fail"} {
+		if err := queue.Send(&Message{Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var statuses []DeliveryStatus
+	for len(statuses) < 6 {
+		select {
+		case event := <-events:
+			statuses = append(statuses, event.Status)
+			if event.Status == DeliveryFailed && (!errors.Is(event.Err, failErr) || event.Attempt != 1) {
+				t.Fatalf("Unexpected failed event %+v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for the events, got %v", statuses)
+		}
+	}
+
+	// the events of the 2 messages could interleave
+	counts := map[DeliveryStatus]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if statuses[0] != DeliveryQueued || counts[DeliveryQueued] != 2 || counts[DeliverySending] != 2 ||
+		counts[DeliverySent] != 1 || counts[DeliveryFailed] != 1 {
+		t.Fatalf("Unexpected events %v", statuses)
+	}
+
+	if _, err := queue.RequeueFailed(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Status != DeliveryRetrying || event.Message.Subject != "fail" || event.Attempt != 1 {
+			t.Fatalf("Expected retrying event, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the retrying event")
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// drain the remaining events, the channel must be closed on stop
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the events channel to be closed")
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	netrpc "net/rpc"
+	"net/rpc/jsonrpc"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ Mailer    = (*ExternalMailer)(nil)
+	_ Pinger    = (*ExternalMailer)(nil)
+	_ Capable   = (*ExternalMailer)(nil)
+	_ io.Closer = (*ExternalMailer)(nil)
+)
+
+const (
+	// externalProtocolEnv is set for the backend processes to the protocol
+	// version, so that they refuse to run when started directly.
+	externalProtocolEnv     = "MAILER_BACKEND_PROTOCOL"
+	externalProtocolVersion = "3"
+
+	// externalService is the RPC service name of the backend processes.
+	externalService = "Backend"
+
+	defaultExternalTimeout      = 30 * time.Second
+	defaultExternalStartTimeout = 10 * time.Second
+
+	// externalStopTimeout is the time a backend process has to exit
+	// after its connection is closed, before it is killed.
+	externalStopTimeout = 5 * time.Second
+)
+
+// ExternalConfig defines an out-of-process mail backend, ie. a command
+// serving a mailer with [ServeBackend] (eg. a proprietary transport
+// built as a separate binary).
+//
+// The protocol is JSON-RPC rather than gRPC (as hashicorp/go-plugin),
+// so that neither the module nor the backends depend on gRPC and the
+// backends could be written in any language with a JSON library.
+//
+// The backends written in other languages implement the JSON-RPC 1.0
+// protocol over their stdin and stdout (one JSON object per request and
+// reply), started with the MAILER_BACKEND_PROTOCOL environment variable
+// set to "3". Each request has a single parameter:
+//
+//   - "Backend.Capabilities" with true, replying the [Capabilities] object
+//   - "Backend.Send" with an [ExternalMessage] object, replying an
+//     [ExternalSendReply] object, with the [ExternalError] of a failed send
+//   - "Backend.Ping" with the timeout in milliseconds, replying true
+//
+// The other failures are replied as the error string. The backend must
+// exit when its stdin is closed.
+type ExternalConfig struct {
+	Cmd          string        `mapstructure:"cmd" json:"cmd,omitempty" bson:"cmd,omitempty"`                               // backend command path
+	Args         []string      `mapstructure:"args" json:"args,omitempty" bson:"args,omitempty"`                            // backend command arguments
+	Env          []string      `mapstructure:"env" json:"env,omitempty" bson:"env,omitempty"`                               // extra "KEY=value" environment entries
+	Timeout      time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`                   // max send time, default to 30s
+	StartTimeout time.Duration `mapstructure:"start_timeout" json:"start_timeout,omitempty" bson:"start_timeout,omitempty"` // max process start time, default to 10s
+}
+
+// Validate checks the external backend configuration for common mistakes.
+func (c ExternalConfig) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(c.Cmd) == "" {
+		errs = append(errs, errors.New("external: cmd is required"))
+	}
+
+	for i, env := range c.Env {
+		if !strings.Contains(env, "=") {
+			errs = append(errs, fmt.Errorf("external: env[%d] must be in the KEY=value format, got %q", i, env))
+		}
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("external: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.StartTimeout < 0 {
+		errs = append(errs, fmt.Errorf("external: start_timeout must be positive, got %s", c.StartTimeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ExternalMessage is a rendered message sent to an external backend.
+type ExternalMessage struct {
+	From string   `json:"from"` // envelope sender
+	To   []string `json:"to"`   // envelope recipients (including the Bcc ones)
+	Data []byte   `json:"data"` // base64 encoded RFC 5322 message, including the signatures (eg. DKIM)
+}
+
+// ExternalSendReply is the reply of an external backend to a send.
+type ExternalSendReply struct {
+	Error *ExternalError `json:"error,omitempty"` // nil if the message was sent
+}
+
+// ExternalError is the failure of a send replied by an external backend,
+// so that the temporary and deferred failures are retried by the plugin
+// (see [IsTemporary] and [RetryAt]).
+type ExternalError struct {
+	Message string     `json:"message"`            // the error message, or the SMTP reply text with a code
+	Code    int        `json:"code,omitempty"`     // the SMTP reply code (eg. 421), if any
+	RetryAt *time.Time `json:"retry_at,omitempty"` // the time the send was deferred to, if any
+}
+
+// newExternalError returns the external error of the send error.
+func newExternalError(err error) *ExternalError {
+	e := &ExternalError{Message: err.Error()}
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		e.Message, e.Code = smtpErr.Msg, smtpErr.Code
+	}
+
+	if at, ok := RetryAt(err); ok {
+		e.RetryAt = &at
+	}
+
+	return e
+}
+
+// err returns the send error of the external error, ie. a [textproto.Error]
+// with a code and a deferred send error with a retry time.
+func (e *ExternalError) err() error {
+	err := errors.New(e.Message)
+	if e.Code != 0 {
+		err = &textproto.Error{Code: e.Code, Msg: e.Message}
+	}
+
+	if e.RetryAt != nil {
+		return &externalDeferredError{err: err, retryAt: *e.RetryAt}
+	}
+
+	return err
+}
+
+// externalDeferredError is the send deferred by an external backend (see [RetryAt]).
+type externalDeferredError struct {
+	err     error
+	retryAt time.Time
+}
+
+func (e *externalDeferredError) Error() string {
+	return e.err.Error()
+}
+
+func (e *externalDeferredError) Unwrap() error {
+	return e.err
+}
+
+// RetryTime returns the time the send was deferred to.
+func (e *externalDeferredError) RetryTime() time.Time {
+	return e.retryAt
+}
+
+// RawMailer is optionally implemented by the mailers served with
+// [ServeBackend] to send the messages exactly as they were rendered
+// by the plugin, instead of parsing them back into a [Message]
+// (which would break their DKIM signatures, if any).
+type RawMailer interface {
+	SendRaw(m *ExternalMessage) error
+}
+
+// ExternalMailer implements [mailer.Mailer] interface and sends the
+// messages through an out-of-process backend, talking with it over the
+// process stdin and stdout (the process stderr is logged).
+//
+// The process is started by [NewExternalMailer] and restarted on the
+// first send after it has exited. It is safe for concurrent use.
+type ExternalMailer struct {
+	config ExternalConfig
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	process *externalProcess
+	caps    Capabilities
+}
+
+// externalProcess is a running backend process with its RPC client.
+type externalProcess struct {
+	cmd    *exec.Cmd
+	client *netrpc.Client
+	exited chan struct{} // closed once the process has exited
+}
+
+// NewExternalMailer starts the configured backend process and returns
+// the mailer sending through it. A nil logger discards the process stderr.
+func NewExternalMailer(config ExternalConfig, logger *slog.Logger) (*ExternalMailer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	path, err := exec.LookPath(config.Cmd)
+	if err != nil {
+		return nil, fmt.Errorf("external: %w", err)
+	}
+	config.Cmd = path
+
+	if config.Timeout == 0 {
+		config.Timeout = defaultExternalTimeout
+	}
+	if config.StartTimeout == 0 {
+		config.StartTimeout = defaultExternalStartTimeout
+	}
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	e := &ExternalMailer{config: config, logger: logger}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := e.start(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// start starts the backend process, retrieving its capabilities as
+// handshake. It must be called with the mutex locked.
+func (e *ExternalMailer) start() (*externalProcess, error) {
+	cmd := exec.Command(e.config.Cmd, e.config.Args...)
+	cmd.Env = append(append(os.Environ(), e.config.Env...), externalProtocolEnv+"="+externalProtocolVersion)
+	// don't wait forever for the I/O of orphaned child processes after a kill
+	cmd.WaitDelay = time.Second
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("external: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("external: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("external: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("external: %w", err)
+	}
+
+	process := &externalProcess{
+		cmd:    cmd,
+		client: jsonrpc.NewClient(stdioConn{Reader: stdout, Writer: stdin}),
+		exited: make(chan struct{}),
+	}
+
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			e.logger.Info("external backend output", "cmd", e.config.Cmd, "output", scanner.Text())
+		}
+	}()
+
+	go func() {
+		<-logged // the pipes must be read before Wait closes them
+		err := cmd.Wait()
+		close(process.exited)
+		e.logger.Debug("external backend exited", "cmd", e.config.Cmd, "error", err)
+	}()
+
+	var caps Capabilities
+	if err := process.call(externalService+".Capabilities", true, &caps, e.config.StartTimeout, true); err != nil {
+		process.stop()
+		return nil, fmt.Errorf("external: failed to start %s: %w", e.config.Cmd, err)
+	}
+
+	e.process = process
+	e.caps = caps
+
+	return process, nil
+}
+
+// running returns the backend process, restarting it if it has exited.
+func (e *ExternalMailer) running() (*externalProcess, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.process != nil {
+		select {
+		case <-e.process.exited:
+			e.process.stop()
+			e.process = nil
+		default:
+			return e.process, nil
+		}
+	}
+
+	return e.start()
+}
+
+// call invokes the RPC method, killing the process if it doesn't reply in
+// time and kill is set (ie. the process is stuck), or leaving its late reply
+// discarded otherwise.
+func (p *externalProcess) call(method string, args, reply any, timeout time.Duration, kill bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	call := p.client.Go(method, args, reply, make(chan *netrpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-p.exited:
+		select {
+		case <-call.Done: // replied just before exiting
+			return call.Error
+		default:
+			return errors.New("backend process exited")
+		}
+	case <-timer.C:
+		if kill {
+			_ = p.cmd.Process.Kill()
+		}
+		return fmt.Errorf("%s timed out after %s", method, timeout)
+	}
+}
+
+// stop closes the process connection (its stdin), letting the process exit,
+// and kills it if it hasn't exited in time.
+func (p *externalProcess) stop() error {
+	err := p.client.Close()
+	if errors.Is(err, netrpc.ErrShutdown) {
+		err = nil
+	}
+
+	select {
+	case <-p.exited:
+	case <-time.After(externalStopTimeout):
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+
+	return err
+}
+
+// Send implements `mailer.Mailer` interface.
+//
+// The message is rendered and passed to the backend process along with
+// its envelope (see [ExternalMessage]).
+func (e *ExternalMailer) Send(m *Message) error {
+	data, err := m.Render()
+	if err != nil {
+		return err
+	}
+
+	process, err := e.running()
+	if err != nil {
+		return err
+	}
+
+	msg := &ExternalMessage{From: envelopeSender(m), To: envelopeRecipients(m), Data: data}
+
+	var reply ExternalSendReply
+	if err := process.call(externalService+".Send", msg, &reply, e.config.Timeout, true); err != nil {
+		return fmt.Errorf("external: %w", err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("external: %w", reply.Error.err())
+	}
+
+	return nil
+}
+
+// Ping implements `mailer.Pinger` interface.
+//
+// It checks that the backend process is running (restarting it if not)
+// and pings its mailer, if it implements [Pinger].
+func (e *ExternalMailer) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	process, err := e.running()
+	if err != nil {
+		return err
+	}
+
+	timeout := e.config.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	// a slow ping (eg. with a short deadline) doesn't stop the in-flight sends
+	var ok bool
+	if err := process.call(externalService+".Ping", timeout.Milliseconds(), &ok, timeout, false); err != nil {
+		return fmt.Errorf("external: %w", err)
+	}
+
+	return nil
+}
+
+// Capabilities implements `mailer.Capable` interface, reporting
+// the capabilities of the backend process mailer.
+func (e *ExternalMailer) Capabilities() Capabilities {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.caps
+}
+
+// Close stops the backend process.
+func (e *ExternalMailer) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.process == nil {
+		return nil
+	}
+
+	err := e.process.stop()
+	e.process = nil
+
+	return err
+}
+
+// stdioConn is the connection over the stdin and stdout of a process.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (c stdioConn) Close() error {
+	var errs []error
+	for _, v := range []any{c.Reader, c.Writer} {
+		if closer, ok := v.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ServeBackend serves the mailer as an external backend of the plugin,
+// until the plugin closes the connection. It is meant to be called from
+// the main function of the backend command (see [ExternalConfig]):
+//
+//	func main() {
+//		if err := mailer.ServeBackend(&sesMailer{}); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+//
+// The process stdout is used for the connection, so everything written
+// to [os.Stdout] afterwards is redirected to stderr (and logged by the plugin).
+func ServeBackend(m Mailer) error {
+	if version := os.Getenv(externalProtocolEnv); version != externalProtocolVersion {
+		return fmt.Errorf("not started as a mailer backend (%s is %q, expected %q)", externalProtocolEnv, version, externalProtocolVersion)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	return serveBackend(m, stdioConn{Reader: os.Stdin, Writer: stdout})
+}
+
+// serveBackend serves the mailer over the JSON-RPC connection until it is closed.
+func serveBackend(m Mailer, conn io.ReadWriteCloser) error {
+	server := netrpc.NewServer()
+	if err := server.RegisterName(externalService, &externalServer{mailer: m}); err != nil {
+		return err
+	}
+
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+
+	return nil
+}
+
+// externalServer exposes a mailer to the plugin over RPC.
+type externalServer struct {
+	mailer Mailer
+}
+
+// Send sends the message with the served mailer, replying its failure.
+func (s *externalServer) Send(msg *ExternalMessage, reply *ExternalSendReply) error {
+	if err := s.send(msg); err != nil {
+		reply.Error = newExternalError(err)
+	}
+
+	return nil
+}
+
+func (s *externalServer) send(msg *ExternalMessage) error {
+	if raw, isRaw := s.mailer.(RawMailer); isRaw {
+		return raw.SendRaw(msg)
+	}
+
+	m, err := ParseMessage(bytes.NewReader(msg.Data))
+	if err != nil {
+		return err
+	}
+
+	restoreEnvelope(m, msg.From, msg.To)
+
+	return s.mailer.Send(m)
+}
+
+// restoreEnvelope restores the envelope of a parsed rendered message,
+// which is not part of it (ie. the Return-Path, including the null sender,
+// and the Bcc recipients).
+func restoreEnvelope(m *Message, from string, to []string) {
+	switch {
+	case from == "" && m.From.Address != "":
+		m.NullSender = true
+	case from != m.From.Address:
+		m.ReturnPath = from
+	}
+
+	visible := envelopeRecipients(m)
+	for _, addr := range to {
+		if !slices.Contains(visible, addr) {
+			m.Bcc = append(m.Bcc, mail.Address{Address: addr})
+		}
+	}
+}
+
+// Ping pings the served mailer, if it implements [Pinger].
+func (s *externalServer) Ping(timeoutMs int64, ok *bool) error {
+	if pinger, isPinger := s.mailer.(Pinger); isPinger {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+		defer cancel()
+
+		if err := pinger.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	*ok = true
+
+	return nil
+}
+
+// Capabilities returns the capabilities of the served mailer.
+func (s *externalServer) Capabilities(_ bool, caps *Capabilities) error {
+	*caps = CapabilitiesOf(s.mailer)
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package mailer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/rpc/jsonrpc"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestServeBackendJSONRPC(t *testing.T) {
+	var sent *Message
+	mailer := MailerFunc(func(m *Message) error {
+		sent = m
+		return nil
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() { _ = serveBackend(mailer, server) }()
+
+	// the requests of a backend client written in another language
+	data := base64.StdEncoding.EncodeToString([]byte("From: app@example.com\r\nTo: john@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"))
+	requests := []string{
+		`{"method":"Backend.Capabilities","params":[true],"id":1}`,
+		`{"method":"Backend.Send","params":[{"from":"app@example.com","to":["john@example.com","hidden@example.com"],"data":"` + data + `"}],"id":2}`,
+		`{"method":"Backend.Ping","params":[1000],"id":3}`,
+	}
+
+	r := bufio.NewReader(client)
+	for i, request := range requests {
+		if _, err := client.Write([]byte(request + "\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		var reply struct {
+			ID     int             `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  any             `json:"error"`
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(line, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.ID != i+1 || reply.Error != nil {
+			t.Fatalf("Expected the reply of request %d, got %s", i+1, line)
+		}
+
+		if i == 0 {
+			var caps Capabilities
+			if err := json.Unmarshal(reply.Result, &caps); err != nil || caps != renderedCapabilities {
+				t.Fatalf("Expected the rendered capabilities, got %s", reply.Result)
+			}
+		}
+	}
+
+	if sent == nil || sent.Subject != "Hello" || len(sent.Bcc) != 1 || sent.Bcc[0].Address != "hidden@example.com" {
+		t.Fatalf("Expected the sent message with its envelope, got %+v", sent)
+	}
+}
+
+func TestServeBackendErrors(t *testing.T) {
+	retryAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	var err error
+	mailer := MailerFunc(func(*Message) error { return err })
+
+	conn, server := net.Pipe()
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+
+	go func() { _ = serveBackend(mailer, server) }()
+
+	send := func() error {
+		t.Helper()
+
+		var reply ExternalSendReply
+		msg := &ExternalMessage{From: "app@example.com", To: []string{"john@example.com"}, Data: []byte("Subject: Hello\r\n\r\nHello\r\n")}
+		if err := client.Call(externalService+".Send", msg, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Error == nil {
+			return nil
+		}
+		return reply.Error.err()
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("Expected the message to be sent, got %v", err)
+	}
+
+	err = &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}
+	var smtpErr *textproto.Error
+	if got := send(); !errors.As(got, &smtpErr) || smtpErr.Code != 421 || !IsTemporary(got) || got.Error() != err.Error() {
+		t.Fatalf("Expected the temporary SMTP error, got %v", got)
+	}
+
+	err = &ThrottleError{Domain: "example.com", RetryAt: retryAt}
+	if got := send(); got == nil || got.Error() != err.Error() {
+		t.Fatalf("Expected the throttle error, got %v", got)
+	} else if at, ok := RetryAt(got); !ok || !at.Equal(retryAt) {
+		t.Fatalf("Expected the send to be deferred to %s, got %s", retryAt, at)
+	}
+
+	err = errors.New("invalid credentials")
+	if got := send(); got == nil || got.Error() != "invalid credentials" || IsTemporary(got) {
+		t.Fatalf("Expected the permanent error, got %v", got)
+	} else if _, ok := RetryAt(got); ok {
+		t.Fatal("Expected the permanent error not to be deferred")
+	}
+}
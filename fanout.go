@@ -0,0 +1,271 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFanOutWorkers = 8
+
+// FanOutConfig defines the separate delivery settings of the messages
+// with [Message.Separate] set.
+type FanOutConfig struct {
+	// Workers is the max number of the copies sent concurrently, default to 8.
+	Workers int `mapstructure:"workers" json:"workers,omitempty" bson:"workers,omitempty"`
+
+	// KeyHeaders are the headers holding the message keys (eg. the
+	// [Idempotent] one), suffixed with the recipient address in every
+	// copy so that they are not skipped as duplicates. Default to
+	// "Idempotency-Key". The copies Message-ID is always regenerated.
+	KeyHeaders []string `mapstructure:"key_headers" json:"key_headers,omitempty" bson:"key_headers,omitempty"`
+}
+
+// Validate checks the fan-out configuration for common mistakes.
+func (c FanOutConfig) Validate() error {
+	var errs []error
+
+	if c.Workers < 0 {
+		errs = append(errs, fmt.Errorf("fan_out: workers must be positive, got %d", c.Workers))
+	}
+
+	for _, name := range c.KeyHeaders {
+		if sanitizeHeaderName(name) != name || name == "" {
+			errs = append(errs, fmt.Errorf("fan_out: invalid key header name %q", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// FanOutResult is the result of the copy sent to a single recipient.
+type FanOutResult struct {
+	Recipient mail.Address
+	Result    *SendResult // the final relay response, if reported by the backend (see [SendWithResult])
+	Err       error
+}
+
+// FanOutError is the error of the separate delivery with failed recipients,
+// holding the results of all the recipients in their order.
+type FanOutError struct {
+	Results []FanOutResult
+
+	// Message is the copy of the message to the recipients failed temporarily
+	// or deferred only (see [IsTemporary] and [RetryAt]), retried by the
+	// [Queue] instead of the message to all of them. Nil if none of them.
+	Message *Message
+
+	// Permanent is the copy of the message to the permanently failed
+	// recipients, reported apart by the [Queue]. Nil if none of them.
+	Permanent *Message
+}
+
+// Failed returns the results of the failed recipients.
+func (e *FanOutError) Failed() []FanOutResult {
+	var failed []FanOutResult
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+// Retryable returns the results of the recipients failed temporarily or deferred.
+func (e *FanOutError) Retryable() []FanOutResult {
+	var retryable []FanOutResult
+	for _, r := range e.Results {
+		if r.Err != nil && isRetryable(r.Err) {
+			retryable = append(retryable, r)
+		}
+	}
+
+	return retryable
+}
+
+// PermanentlyFailed returns the results of the permanently failed recipients.
+func (e *FanOutError) PermanentlyFailed() []FanOutResult {
+	var failed []FanOutResult
+	for _, r := range e.Results {
+		if r.Err != nil && !isRetryable(r.Err) {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+// isRetryable reports whether the send error is a temporary failure or a deferral.
+func isRetryable(err error) bool {
+	_, deferred := deferralDelay(err, time.Now())
+
+	return deferred || IsTemporary(err)
+}
+
+// retryable returns the error of the recipients failed temporarily or deferred.
+func (e *FanOutError) retryable() error {
+	return &FanOutError{Results: e.Retryable(), Message: e.Message}
+}
+
+func (e *FanOutError) Error() string {
+	failed := e.Failed()
+
+	parts := make([]string, len(failed))
+	for i, r := range failed {
+		parts[i] = fmt.Sprintf("%s: %v", r.Recipient.Address, r.Err)
+	}
+
+	return fmt.Sprintf("%d of %d recipients failed: %s", len(failed), len(e.Results), strings.Join(parts, "; "))
+}
+
+func (e *FanOutError) Unwrap() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+
+	return errs
+}
+
+// FanOut returns a middleware sending an individual copy of the messages
+// with [Message.Separate] set to every To, Cc and Bcc recipient (see
+// [SendSeparately]), so that every one sees only their own address.
+// The other messages are passed through.
+//
+// The returned error is a [FanOutError] if any recipient failed. When
+// chained inside the [Queue], the copies are sent concurrently and only
+// the recipients failed temporarily or deferred are retried, so that the
+// others get a single copy.
+func FanOut(config FanOutConfig) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if !m.Separate {
+				return next.Send(m)
+			}
+
+			m, results, err := sendSeparately(next, m, config)
+			if err != nil {
+				return err
+			}
+
+			fanOutErr := &FanOutError{Results: results}
+			if len(fanOutErr.Failed()) == 0 {
+				return nil
+			}
+
+			fanOutErr.Message = m.recipientsCopy(fanOutErr.Retryable())
+			fanOutErr.Permanent = m.recipientsCopy(fanOutErr.PermanentlyFailed())
+
+			return fanOutErr
+		})
+	}
+}
+
+// recipientsCopy returns the copy of the message to the recipients of the
+// results only, or nil if there is none.
+func (m *Message) recipientsCopy(results []FanOutResult) *Message {
+	if len(results) == 0 {
+		return nil
+	}
+
+	c := m.Clone()
+	c.To, c.Cc, c.Bcc = make([]mail.Address, len(results)), nil, nil
+	for i, r := range results {
+		c.To[i] = r.Recipient
+	}
+
+	return c
+}
+
+// SendSeparately sends an individual copy of the message to every unique
+// To, Cc and Bcc recipient with the mailer, with up to config.Workers
+// concurrent sends, returning the results of all the recipients in their
+// order. The error is returned only if the message couldn't be copied.
+func SendSeparately(mailer Mailer, m *Message, config FanOutConfig) ([]FanOutResult, error) {
+	_, results, err := sendSeparately(mailer, m, config)
+
+	return results, err
+}
+
+// sendSeparately sends the copies of the message, returning
+// its clone with the buffered attachments along with the results.
+func sendSeparately(mailer Mailer, m *Message, config FanOutConfig) (*Message, []FanOutResult, error) {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = defaultFanOutWorkers
+	}
+
+	keyHeaders := config.KeyHeaders
+	if keyHeaders == nil {
+		keyHeaders = []string{defaultIdempotencyHeader}
+	}
+
+	// every copy gets its own copy of the attachments
+	m = m.Clone()
+	if err := m.bufferAttachments(); err != nil {
+		return nil, nil, err
+	}
+
+	var recipients []mail.Address
+	lists, _ := normalizeRecipients([][]mail.Address{m.To, m.Cc, m.Bcc}, false)
+	for _, list := range lists {
+		recipients = append(recipients, list...)
+	}
+	results := make([]FanOutResult, len(recipients))
+
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	for i, rcpt := range recipients {
+		results[i].Recipient = rcpt
+
+		msg := m.Clone()
+		msg.To, msg.Cc, msg.Bcc = []mail.Address{rcpt}, nil, nil
+		msg.Separate = false
+		msg.recipientKeys(rcpt.Address, keyHeaders)
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *FanOutResult, msg *Message) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			result, ok, err := SendWithResult(mailer, msg)
+			if ok {
+				r.Result = &result
+			}
+			r.Err = err
+		}(&results[i], msg)
+	}
+	wg.Wait()
+
+	return m, results, nil
+}
+
+// recipientKeys makes the message keys unique per recipient, suffixing
+// the key headers with the address and removing the Message-ID header.
+func (m *Message) recipientKeys(address string, keyHeaders []string) {
+	if len(m.Headers) == 0 {
+		return
+	}
+
+	headers := make(map[string]string, len(m.Headers))
+	for k, v := range m.Headers {
+		switch {
+		case strings.EqualFold(k, "Message-ID"):
+			continue
+		case v != "" && containsFold(keyHeaders, k):
+			v += ":" + strings.ToLower(address)
+		}
+		headers[k] = v
+	}
+	m.Headers = headers
+}
@@ -0,0 +1,205 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	var mu sync.Mutex
+	var sent []*Message
+	var active, maxActive int32
+
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			peak := atomic.LoadInt32(&maxActive)
+			if n <= peak || atomic.CompareAndSwapInt32(&maxActive, peak, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		sent = append(sent, m)
+		mu.Unlock()
+
+		if m.To[0].Address == "bob@example.com" {
+			return &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}
+		}
+		m.setResult(SendResult{Code: 250, QueueID: m.To[0].Address})
+		return nil
+	}), FanOut(FanOutConfig{Workers: 2}))
+
+	m := &Message{
+		To:          []mail.Address{{Address: "jane@example.com"}, {Address: "bob@example.com"}},
+		Cc:          []mail.Address{{Address: "JANE@example.com"}, {Address: "joe@example.com"}},
+		Bcc:         []mail.Address{{Address: "ann@example.com"}},
+		Subject:     "Notification",
+		Text:        "Hello",
+		Headers:     map[string]string{"Idempotency-Key": "notification-1", "Message-ID": "<1@example.com>"},
+		Attachments: map[string]io.Reader{"a.txt": strings.NewReader("attachment")},
+		Separate:    true,
+	}
+
+	err := mailer.Send(m)
+
+	var fanOutErr *FanOutError
+	if !errors.As(err, &fanOutErr) {
+		t.Fatalf("Expected FanOutError, got %v", err)
+	}
+	if len(fanOutErr.Results) != 4 || len(fanOutErr.Failed()) != 1 || fanOutErr.Failed()[0].Recipient.Address != "bob@example.com" {
+		t.Fatalf("Expected 4 results with the bob failure, got %+v", fanOutErr.Results)
+	}
+	if retry := fanOutErr.Message; retry == nil || len(retry.To) != 1 || retry.To[0].Address != "bob@example.com" || len(retry.Cc)+len(retry.Bcc) != 0 || !retry.Separate {
+		t.Fatalf("Expected the copy to the failed recipient to retry, got %+v", retry)
+	}
+	if fanOutErr.Permanent != nil {
+		t.Fatalf("Expected no permanently failed recipient, got %+v", fanOutErr.Permanent)
+	}
+	if r := fanOutErr.Results[0]; r.Recipient.Address != "jane@example.com" || r.Result == nil || r.Result.QueueID != "jane@example.com" {
+		t.Fatalf("Expected the jane result first, got %+v", r)
+	}
+	if peak := atomic.LoadInt32(&maxActive); peak > 2 {
+		t.Fatalf("Expected at most 2 concurrent sends, got %d", peak)
+	}
+
+	for _, c := range sent {
+		if len(c.To) != 1 || len(c.Cc) != 0 || len(c.Bcc) != 0 || c.Separate {
+			t.Fatalf("Expected a single recipient copy, got %+v", c)
+		}
+		if key := c.Headers["Idempotency-Key"]; key != "notification-1:"+c.To[0].Address {
+			t.Fatalf("Expected the per recipient idempotency key, got %q", key)
+		}
+		if _, ok := c.Headers["Message-ID"]; ok {
+			t.Fatal("Expected the Message-ID to be regenerated")
+		}
+		if data, _ := io.ReadAll(c.Attachments["a.txt"]); string(data) != "attachment" {
+			t.Fatalf("Expected every copy to have the attachment, got %q", data)
+		}
+	}
+
+	if m.Headers["Idempotency-Key"] != "notification-1" || len(m.To) != 2 {
+		t.Fatal("Expected the original message not to be modified")
+	}
+
+	sent = nil
+	if err := mailer.Send(&Message{To: m.To, Subject: "Group"}); err != nil || len(sent) != 1 {
+		t.Fatalf("Expected the messages without Separate to be passed through, got %d sends", len(sent))
+	}
+}
+
+func TestQueueFanOutRetry(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]int{}
+
+	next := Chain(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		rcpt := m.To[0].Address
+		if sent[rcpt]++; rcpt == "bob@example.com" && sent[rcpt] == 1 {
+			return &textproto.Error{Code: 421, Msg: "busy"}
+		}
+		return nil
+	}), FanOut(FanOutConfig{}))
+
+	queue := NewQueue(next, QueueConfig{Workers: 1, Size: 10, MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	err := queue.Send(&Message{
+		To:       []mail.Address{{Address: "jane@example.com"}, {Address: "bob@example.com"}},
+		Subject:  "Notification",
+		Separate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent["bob@example.com"] == 2
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent["jane@example.com"] != 1 {
+		t.Fatalf("Expected only the failed recipient to be retried, got %v", sent)
+	}
+}
+
+func TestQueueFanOutMixedFailures(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]int{}
+
+	next := Chain(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		rcpt := m.To[0].Address
+		sent[rcpt]++
+		switch {
+		case rcpt == "ann@example.com":
+			return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+		case rcpt == "bob@example.com" && sent[rcpt] == 1:
+			return &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}
+		}
+		return nil
+	}), FanOut(FanOutConfig{}))
+
+	var failed []*Message
+	queue := NewQueue(next, QueueConfig{Workers: 1, Size: 10, MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	queue.OnError = func(m *Message, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, m)
+	}
+	queue.Start()
+
+	err := queue.Send(&Message{
+		To:       []mail.Address{{Address: "ann@example.com"}, {Address: "bob@example.com"}, {Address: "joe@example.com"}},
+		Subject:  "Notification",
+		Separate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent["bob@example.com"] == 2
+	})
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent["ann@example.com"] != 1 || sent["joe@example.com"] != 1 {
+		t.Fatalf("Expected only the temporarily failed recipient to be retried, got %v", sent)
+	}
+	if len(failed) != 1 || len(failed[0].To) != 1 || failed[0].To[0].Address != "ann@example.com" {
+		t.Fatalf("Expected the permanently failed recipient to be reported, got %+v", failed)
+	}
+
+	dls := queue.DeadLetters()
+	if len(dls) != 1 || len(dls[0].Message.To) != 1 || dls[0].Message.To[0].Address != "ann@example.com" {
+		t.Fatalf("Expected the dead letter of the permanently failed recipient, got %+v", dls)
+	}
+	var fanOutErr *FanOutError
+	if !errors.As(dls[0].Err, &fanOutErr) || len(fanOutErr.Failed()) != 1 || IsTemporary(dls[0].Err) {
+		t.Fatalf("Expected the permanent failure, got %v", dls[0].Err)
+	}
+}
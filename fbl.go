@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+const (
+	// jmrpRecipientHeader is the header added by Microsoft JMRP to the reported
+	// message, with the address of the complaining recipient.
+	jmrpRecipientHeader = "X-HmXmrOriginalRecipient"
+
+	// jmrpUserAgent is the user agent of the non-ARF Microsoft JMRP reports.
+	jmrpUserAgent = "Microsoft JMRP"
+)
+
+// ParseComplaint parses a feedback loop complaint, handling the
+// quirks of the major mailbox providers on top of the standard
+// ARF reports (see [ParseFeedbackReport]):
+//
+//   - Microsoft JMRP reports are plain messages with the reported message
+//     attached, the recipient being in its X-HmXmrOriginalRecipient header;
+//   - Yahoo (and others) redact the recipient addresses, so the optional
+//     recipientHeader of the reported message (eg. "X-Recipient", added
+//     by the app to every sent message) is used instead.
+//
+// The recipients are taken from the first source with non-redacted
+// addresses: the Original-Rcpt-To fields and the X-HmXmrOriginalRecipient
+// and recipientHeader headers of the reported message (not its To header,
+// which may list other recipients). It fails with [ErrNotReport] for the
+// other messages.
+func ParseComplaint(r io.Reader, recipientHeader string) (*FeedbackReport, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var report *FeedbackReport
+
+	parts, err := readReport(bytes.NewReader(raw), "message/feedback-report")
+	switch {
+	case err == nil:
+		if report, err = parseFeedbackReport(parts); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, ErrNotReport):
+		if parts, err = readReportParts(bytes.NewReader(raw), true, nil); err != nil {
+			return nil, err
+		}
+		if parts.original == nil || parts.original.Get(jmrpRecipientHeader) == "" {
+			return nil, ErrNotReport
+		}
+
+		report = &FeedbackReport{
+			FeedbackType:      "abuse",
+			UserAgent:         jmrpUserAgent,
+			OriginalMessageID: parts.originalMessageID(),
+			OriginalMailFrom:  reportAddress(parts.original.Get("Return-Path")),
+			ArrivalDate:       reportFieldDate(parts.original.Get("Date")),
+		}
+	default:
+		return nil, err
+	}
+
+	recipients := unredactedAddresses(report.OriginalRecipients)
+
+	if len(recipients) == 0 && parts.original != nil {
+		for _, name := range []string{jmrpRecipientHeader, recipientHeader} {
+			if name == "" {
+				continue
+			}
+			if addr, err := mail.ParseAddress(parts.original.Get(name)); err == nil {
+				recipients = unredactedAddresses([]string{addr.Address})
+			}
+			if len(recipients) > 0 {
+				break
+			}
+		}
+	}
+
+	report.OriginalRecipients = recipients
+
+	return report, nil
+}
+
+// IsComplaint reports whether the feedback report is a spam complaint.
+func (r *FeedbackReport) IsComplaint() bool {
+	return r.FeedbackType == "abuse"
+}
+
+// unredactedAddresses returns the addresses without the redacted ones (eg. "redacted@example.com" or "xxxxx@example.com").
+func unredactedAddresses(addresses []string) []string {
+	var unredacted []string
+	for _, address := range addresses {
+		local, domain, ok := strings.Cut(address, "@")
+		if !ok || local == "" || domain == "" || strings.Contains(strings.ToLower(local), "redacted") || strings.Trim(strings.ToLower(local), "x*") == "" {
+			continue
+		}
+		unredacted = append(unredacted, address)
+	}
+
+	return unredacted
+}
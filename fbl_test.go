@@ -0,0 +1,78 @@
+package mailer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sampleJMRPReport is a non-ARF Microsoft JMRP complaint of user@outlook.com.
+const sampleJMRPReport = "From: staff@hotmail.com\r\n" +
+	"To: fbl@example.com\r\n" +
+	"Subject: complaint about message from 192.0.2.1\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b3\"\r\n" +
+	"\r\n" +
+	"--b3\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"This is a Junk Mail Reporting Program report.\r\n" +
+	"--b3\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"X-HmXmrOriginalRecipient: <user@outlook.com>\r\n" +
+	"Return-Path: <bounces@example.com>\r\n" +
+	"From: app@example.com\r\n" +
+	"To: redacted@outlook.com\r\n" +
+	"Message-ID: <3@example.com>\r\n" +
+	"Date: Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--b3--\r\n"
+
+func TestParseComplaint(t *testing.T) {
+	// Yahoo redacts the recipient of both the report and the reported message
+	yahoo := strings.NewReplacer(
+		"Original-Rcpt-To: <user@example.com>\r\n", "",
+		"To: user@example.com\r\n", "To: redacted@yahoo.com\r\nX-Recipient: Jane <jane@yahoo.com>\r\n",
+		"User-Agent: SomeGenerator/1.0", "User-Agent: Yahoo!-Mail-Feedback/2.0",
+	).Replace(sampleFeedbackReport)
+
+	scenarios := []struct {
+		name            string
+		raw             string
+		recipientHeader string
+		messageID       string
+		recipients      []string
+	}{
+		{"arf", sampleFeedbackReport, "", "<2@example.com>", []string{"user@example.com"}},
+		{"arf redacted recipients", yahoo, "X-Recipient", "<2@example.com>", []string{"jane@yahoo.com"}},
+		{"arf redacted without recipient header", yahoo, "", "<2@example.com>", nil},
+		{"arf without recipient", strings.Replace(sampleFeedbackReport, "Original-Rcpt-To: <user@example.com>\r\n", "", 1), "", "<2@example.com>", nil},
+		{"jmrp", sampleJMRPReport, "", "<3@example.com>", []string{"user@outlook.com"}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			report, err := ParseComplaint(strings.NewReader(s.raw), s.recipientHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !report.IsComplaint() || report.OriginalMessageID != s.messageID {
+				t.Fatalf("Expected a complaint about %s, got %+v", s.messageID, report)
+			}
+			if strings.Join(report.OriginalRecipients, ",") != strings.Join(s.recipients, ",") {
+				t.Fatalf("Expected recipients %v, got %v", s.recipients, report.OriginalRecipients)
+			}
+		})
+	}
+
+	t.Run("not a complaint", func(t *testing.T) {
+		for _, raw := range []string{sampleDeliveryReport, "Subject: Hello\r\n\r\nHello\r\n"} {
+			if _, err := ParseComplaint(strings.NewReader(raw), ""); !errors.Is(err, ErrNotReport) {
+				t.Fatalf("Expected ErrNotReport, got %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AttachmentGenerator produces attachments content at send time
+// (eg. renders an invoice PDF) from a lightweight reference.
+type AttachmentGenerator interface {
+	// Generate returns the content of the attachment identified by ref (eg. "invoice:42").
+	Generate(ctx context.Context, ref string) ([]byte, error)
+}
+
+// AttachmentGeneratorFunc is an adapter to allow the use of ordinary functions as [AttachmentGenerator].
+type AttachmentGeneratorFunc func(ctx context.Context, ref string) ([]byte, error)
+
+// Generate implements [AttachmentGenerator] interface.
+func (f AttachmentGeneratorFunc) Generate(ctx context.Context, ref string) ([]byte, error) {
+	return f(ctx, ref)
+}
+
+const (
+	// generateAttachmentTimeout bounds the generation of an attachment.
+	generateAttachmentTimeout = time.Minute
+
+	defaultAttachmentCacheTTL  = 5 * time.Minute
+	defaultAttachmentCacheSize = 100
+)
+
+// GeneratedAttachment returns an attachment reader that calls the
+// generator with ref on its first Read, with a 1 minute timeout.
+//
+// Unlike the other readers, it is cloned with the message (see
+// [Message.Clone]) and never buffered by the middlewares, so the queue
+// and the dead letters hold only the reference. Note that every clone
+// generates the content again, so the generator should be wrapped with
+// [CacheAttachments] if the message is rendered more than once (eg. by
+// the spam check, archive or tee).
+func GeneratedAttachment(generator AttachmentGenerator, ref string) io.Reader {
+	return &generatedAttachment{generator: generator, ref: ref}
+}
+
+type generatedAttachment struct {
+	generator AttachmentGenerator
+	ref       string
+
+	r   *bytes.Reader
+	err error
+}
+
+func (a *generatedAttachment) Read(p []byte) (int, error) {
+	if a.r == nil && a.err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), generateAttachmentTimeout)
+		data, err := a.generator.Generate(ctx, a.ref)
+		cancel()
+
+		if err != nil {
+			a.err = fmt.Errorf("failed to generate attachment %q: %w", a.ref, err)
+		} else {
+			a.r = bytes.NewReader(data)
+		}
+	}
+
+	if a.err != nil {
+		return 0, a.err
+	}
+
+	return a.r.Read(p)
+}
+
+// clone returns a new not generated yet reader of the same attachment.
+func (a *generatedAttachment) clone() io.Reader {
+	return &generatedAttachment{generator: a.generator, ref: a.ref}
+}
+
+// AttachmentCacheConfig defines the generated attachments cache settings.
+type AttachmentCacheConfig struct {
+	TTL  time.Duration // default to 5m
+	Size int           // max cached attachments, default to 100
+
+	// Clock is used for the cache expiration (default to the system clock).
+	Clock Clock
+}
+
+// CacheAttachments wraps the generator with an in-memory cache of the
+// generated attachments, keyed by their references and kept for the
+// config TTL. The expired attachments and then the oldest ones are
+// evicted when the cache is full.
+//
+// The concurrent generations of the same reference wait for the first
+// one instead of calling the generator again.
+func CacheAttachments(generator AttachmentGenerator, config AttachmentCacheConfig) AttachmentGenerator {
+	if config.TTL <= 0 {
+		config.TTL = defaultAttachmentCacheTTL
+	}
+	if config.Size <= 0 {
+		config.Size = defaultAttachmentCacheSize
+	}
+
+	return &attachmentCache{
+		generator: generator,
+		config:    config,
+		entries:   map[string]attachmentCacheEntry{},
+		calls:     map[string]*attachmentCall{},
+	}
+}
+
+type attachmentCache struct {
+	generator AttachmentGenerator
+	config    AttachmentCacheConfig
+
+	mu      sync.Mutex
+	entries map[string]attachmentCacheEntry
+	calls   map[string]*attachmentCall // the generations in flight
+}
+
+type attachmentCacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// attachmentCall is a generation in flight, done being closed once it returns.
+type attachmentCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (c *attachmentCache) Generate(ctx context.Context, ref string) ([]byte, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[ref]; ok && now(c.config.Clock).Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.data, nil
+	}
+
+	call, ok := c.calls[ref]
+	if !ok {
+		call = &attachmentCall{done: make(chan struct{})}
+		c.calls[ref] = call
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			return call.data, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call.data, call.err = c.generator.Generate(ctx, ref)
+
+	c.mu.Lock()
+	delete(c.calls, ref)
+	if call.err == nil {
+		c.add(ref, call.data)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.data, call.err
+}
+
+// add caches the attachment, evicting the expired ones and then
+// the oldest one when the cache is full. It must be called locked.
+func (c *attachmentCache) add(ref string, data []byte) {
+	current := now(c.config.Clock)
+
+	if _, ok := c.entries[ref]; !ok && len(c.entries) >= c.config.Size {
+		oldest := ""
+		for key, entry := range c.entries {
+			if !current.Before(entry.expires) {
+				delete(c.entries, key)
+			} else if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+
+		if len(c.entries) >= c.config.Size {
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[ref] = attachmentCacheEntry{data: data, expires: current.Add(c.config.TTL)}
+}
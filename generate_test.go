@@ -0,0 +1,127 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGeneratedAttachment(t *testing.T) {
+	var calls atomic.Int32
+
+	generator := AttachmentGeneratorFunc(func(ctx context.Context, ref string) ([]byte, error) {
+		calls.Add(1)
+		if ref == "invoice:missing" {
+			return nil, errors.New("not found")
+		}
+		return []byte("%PDF " + ref), nil
+	})
+
+	msg, err := NewMessage().
+		From("from@example.com").
+		To("to@example.com").
+		Text("See the attached invoice").
+		AttachGenerated("invoice.pdf", CacheAttachments(generator, AttachmentCacheConfig{TTL: time.Minute}), "invoice:42").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cloned and buffered without generating
+	clone := msg.Clone()
+	if err := clone.bufferAttachments(); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("Expected no generation before rendering, got %d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		raw, err := newTestRenderer().Render(clone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(parsed.Attachments["invoice.pdf"])
+		if string(data) != "%PDF invoice:42" {
+			t.Fatalf("Expected the generated attachment, got %q", data)
+		}
+	}
+
+	// cached
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("Expected a single generation, got %d", n)
+	}
+
+	_, err = (&Message{
+		From:        msg.From,
+		To:          msg.To,
+		Text:        "test",
+		Attachments: map[string]io.Reader{"missing.pdf": GeneratedAttachment(generator, "invoice:missing")},
+	}).Render()
+	if err == nil || !strings.Contains(err.Error(), "invoice:missing") {
+		t.Fatalf("Expected the generation error, got %v", err)
+	}
+}
+
+func TestCacheAttachments(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	generator := AttachmentGeneratorFunc(func(ctx context.Context, ref string) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte(ref), nil
+	})
+
+	current := time.Unix(1700000000, 0)
+	cache := CacheAttachments(generator, AttachmentCacheConfig{
+		TTL:   time.Minute,
+		Size:  2,
+		Clock: ClockFunc(func() time.Time { return current }),
+	}).(*attachmentCache)
+
+	// the concurrent generations of the same reference call the generator once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := cache.Generate(context.Background(), "invoice:1"); err != nil || string(data) != "invoice:1" {
+				t.Errorf("Expected the generated attachment, got %q, %v", data, err)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return calls.Load() == 1 })
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("Expected a single generation, got %d", n)
+	}
+
+	// the oldest attachment is evicted when the cache is full
+	current = current.Add(time.Second)
+	_, _ = cache.Generate(context.Background(), "invoice:2")
+	_, _ = cache.Generate(context.Background(), "invoice:3")
+	if _, ok := cache.entries["invoice:1"]; ok || len(cache.entries) != 2 {
+		t.Fatalf("Expected the oldest attachment to be evicted, got %v", cache.entries)
+	}
+
+	// expired
+	current = current.Add(time.Minute)
+	_, _ = cache.Generate(context.Background(), "invoice:2")
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("Expected the expired attachment to be generated again, got %d generations", n)
+	}
+}
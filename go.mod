@@ -3,7 +3,6 @@ module github.com/rumorshub/mailer
 go 1.21.0
 
 require (
-	github.com/domodwyer/mailyak/v3 v3.6.2
 	github.com/roadrunner-server/endure/v2 v2.4.2
 	github.com/roadrunner-server/errors v1.3.0
 )
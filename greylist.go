@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// greylistRegex matches the typical greylisting response texts.
+var greylistRegex = regexp.MustCompile(`(?i)gr[ae]y[- ]?list|try again later|please retry later|come back later`)
+
+// IsGreylisted reports whether err is a classic greylisting SMTP
+// response, eg. "451 4.7.1 Greylisting in action, please come back later".
+func IsGreylisted(err error) bool {
+	var smtpErr *textproto.Error
+	if !errors.As(err, &smtpErr) {
+		return false
+	}
+
+	if smtpErr.Code != 450 && smtpErr.Code != 451 {
+		return false
+	}
+
+	msg := strings.TrimSpace(smtpErr.Msg)
+
+	return greylistRegex.MatchString(msg) ||
+		strings.HasPrefix(msg, "4.7.1") && strings.Contains(strings.ToLower(msg), "later") ||
+		strings.HasPrefix(msg, "4.2.0") && strings.Contains(strings.ToLower(msg), "later")
+}
+
+// IsTemporary reports whether err is a transient failure worth retrying,
+// ie. a 4xx SMTP response or a network timeout.
+func IsTemporary(err error) bool {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	return false
+}
+
+// deferredError is implemented by the errors of the sends deferred to
+// a later time rather than failed (eg. [ThrottleError]).
+type deferredError interface {
+	error
+	RetryTime() time.Time
+}
+
+// isDeferred reports whether err is a deferred send error (see [RetryAt]).
+func isDeferred(err error) bool {
+	_, ok := RetryAt(err)
+
+	return ok
+}
+
+// RetryAt returns the time a deferred send should be retried at (eg. the
+// [ThrottleError] one), or false if err is not a deferred send error.
+func RetryAt(err error) (time.Time, bool) {
+	var deferred deferredError
+	if !errors.As(err, &deferred) {
+		return time.Time{}, false
+	}
+
+	return deferred.RetryTime(), true
+}
@@ -0,0 +1,35 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestIsGreylisted(t *testing.T) {
+	scenarios := []struct {
+		err         error
+		greylisted  bool
+		isTemporary bool
+	}{
+		{&textproto.Error{Code: 451, Msg: "4.7.1 Greylisting in action, please come back later"}, true, true},
+		{&textproto.Error{Code: 450, Msg: "4.2.0 <a@example.com>: Recipient address rejected: Greylisted"}, true, true},
+		{&textproto.Error{Code: 451, Msg: "4.7.1 Please try again later"}, true, true},
+		{fmt.Errorf("rcpt: %w", &textproto.Error{Code: 451, Msg: "Temporary graylist block"}), true, true},
+		{&textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}, false, true},
+		{&textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}, false, true},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Greylisted forever"}, false, false},
+		{errors.New("greylisted"), false, false},
+		{nil, false, false},
+	}
+
+	for i, s := range scenarios {
+		if v := IsGreylisted(s.err); v != s.greylisted {
+			t.Errorf("(%d) Expected IsGreylisted %v, got %v", i, s.greylisted, v)
+		}
+		if v := IsTemporary(s.err); v != s.isTemporary {
+			t.Errorf("(%d) Expected IsTemporary %v, got %v", i, s.isTemporary, v)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdempotencyHeader  = "Idempotency-Key"
+	defaultIdempotencyTTL     = 24 * time.Hour
+	defaultIdempotencyTimeout = 5 * time.Second
+)
+
+var (
+	_ IdempotencyStore = (*MemoryIdempotencyStore)(nil)
+	_ IdempotencyStore = (*RedisIdempotencyStore)(nil)
+)
+
+// IdempotencyStore records the keys of the sent messages.
+type IdempotencyStore interface {
+	// Claim records the key for ttl, returning false if it is already recorded.
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Release forgets the key, so that it can be claimed again.
+	Release(ctx context.Context, key string) error
+}
+
+// IdempotencyConfig defines the duplicate sends detection settings.
+type IdempotencyConfig struct {
+	Header  string        `mapstructure:"header" json:"header,omitempty" bson:"header,omitempty"`    // the key header, default to "Idempotency-Key"
+	TTL     time.Duration `mapstructure:"ttl" json:"ttl,omitempty" bson:"ttl,omitempty"`             // how long the keys are remembered, default to 24h
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"` // store operations timeout, default to 5s
+
+	// Redis shares the keys between the instances (in-memory if not set).
+	Redis *RedisConfig `mapstructure:"redis" json:"redis,omitempty" bson:"redis,omitempty"`
+
+	// Clock is the time source of the keys expiration (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnDuplicate is an optional hook called with the skipped duplicate messages.
+	OnDuplicate func(m *Message, key string) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the idempotency configuration for common mistakes.
+func (c IdempotencyConfig) Validate() error {
+	var errs []error
+
+	if c.Header != "" && sanitizeHeaderName(c.Header) != c.Header {
+		errs = append(errs, fmt.Errorf("idempotency: invalid header name %q", c.Header))
+	}
+
+	if c.TTL < 0 {
+		errs = append(errs, fmt.Errorf("idempotency: ttl must be positive, got %s", c.TTL))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("idempotency: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.Redis != nil {
+		if err := c.Redis.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("idempotency: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c IdempotencyConfig) Redacted() IdempotencyConfig {
+	if c.Redis != nil {
+		redis := c.Redis.Redacted()
+		c.Redis = &redis
+	}
+	c.OnDuplicate = nil
+
+	return c
+}
+
+// Store returns the IdempotencyStore described by the config.
+func (c IdempotencyConfig) Store() IdempotencyStore {
+	if c.Redis != nil {
+		return NewRedisIdempotencyStore(*c.Redis)
+	}
+
+	return &MemoryIdempotencyStore{Clock: c.Clock}
+}
+
+// Idempotent returns a middleware that skips the duplicate sends of the
+// messages with the same idempotency key, ie. the value of the configured
+// header (which is removed from the sent messages) or, if not set, the
+// Message-ID header. Messages without any of them are always sent.
+//
+// The key is claimed before the send and released if it fails, so that
+// the message can be retried (eg. when chained inside the [Queue], every
+// retry claims it again). The duplicates are not sent but don't fail.
+func Idempotent(store IdempotencyStore, config IdempotencyConfig) Middleware {
+	if config.Header == "" {
+		config.Header = defaultIdempotencyHeader
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaultIdempotencyTTL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultIdempotencyTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			key := headerValue(m, config.Header)
+			if key != "" {
+				m = m.Clone()
+				for k := range m.Headers {
+					if strings.EqualFold(k, config.Header) {
+						delete(m.Headers, k)
+					}
+				}
+			} else {
+				key = messageIDHeader(m)
+			}
+
+			key = strings.TrimSpace(key)
+			if key == "" {
+				return next.Send(m)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			claimed, err := store.Claim(ctx, "idempotency:"+key, config.TTL)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to claim the idempotency key %s: %w", key, err)
+			}
+
+			if !claimed {
+				if config.OnDuplicate != nil {
+					config.OnDuplicate(m, key)
+				}
+				return nil
+			}
+
+			sendErr := next.Send(m)
+			if sendErr != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+				defer cancel()
+
+				if err := store.Release(ctx, "idempotency:"+key); err != nil {
+					return errors.Join(sendErr, fmt.Errorf("failed to release the idempotency key %s: %w", key, err))
+				}
+			}
+
+			return sendErr
+		})
+	}
+}
+
+// MemoryIdempotencyStore is an in-memory [IdempotencyStore], suitable for a single instance.
+//
+// The zero value is ready to use.
+type MemoryIdempotencyStore struct {
+	// Clock is the time source of the keys expiration (default to the system clock).
+	Clock Clock
+
+	mu   sync.Mutex
+	keys map[string]time.Time // the keys expiration
+}
+
+// Claim implements [IdempotencyStore] interface.
+func (s *MemoryIdempotencyStore) Claim(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	t := now(s.Clock)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		s.keys = map[string]time.Time{}
+	}
+
+	for k, expires := range s.keys {
+		if !t.Before(expires) {
+			delete(s.keys, k)
+		}
+	}
+
+	if _, ok := s.keys[key]; ok {
+		return false, nil
+	}
+	s.keys[key] = t.Add(ttl)
+
+	return true, nil
+}
+
+// Release implements [IdempotencyStore] interface.
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+
+	return nil
+}
+
+// RedisIdempotencyStore is an [IdempotencyStore] backed by Redis,
+// sharing the keys between multiple instances.
+type RedisIdempotencyStore struct {
+	client *redisClient
+}
+
+// NewRedisIdempotencyStore creates a new Redis idempotency store.
+func NewRedisIdempotencyStore(config RedisConfig) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{client: newRedisClient(config)}
+}
+
+// Claim implements [IdempotencyStore] interface.
+func (s *RedisIdempotencyStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	reply, err := s.client.do(ctx, "SET", s.client.config.prefix()+key, "1", "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// Release implements [IdempotencyStore] interface.
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.client.do(ctx, "DEL", s.client.config.prefix()+key)
+
+	return err
+}
+
+// Close closes the Redis connection.
+func (s *RedisIdempotencyStore) Close() error {
+	return s.client.close()
+}
@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	var sent []*Message
+	var sendErr error
+	var duplicates []string
+
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, m)
+		return nil
+	}), Idempotent(&MemoryIdempotencyStore{}, IdempotencyConfig{
+		OnDuplicate: func(m *Message, key string) { duplicates = append(duplicates, key) },
+	}))
+
+	m, _ := NewMessage().From("app@example.com").To("user@example.com").Subject("Hello").Text("Hello").
+		Header("Idempotency-Key", "order-42").Build()
+
+	if err := mailer.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || headerValue(sent[0], "Idempotency-Key") != "" {
+		t.Fatalf("Expected the message to be sent without the key header, got %+v", sent)
+	}
+	if headerValue(m, "Idempotency-Key") != "order-42" {
+		t.Fatal("Expected the original message to be left unchanged")
+	}
+
+	if err := mailer.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || len(duplicates) != 1 || duplicates[0] != "order-42" {
+		t.Fatalf("Expected the duplicate to be skipped, got %d sent, %v", len(sent), duplicates)
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		failed, _ := NewMessage().From("app@example.com").To("user@example.com").Subject("Hello").Text("Hello").
+			Header("Message-ID", "<1@example.com>").Build()
+
+		sendErr = errors.New("unavailable")
+		if err := mailer.Send(failed); !errors.Is(err, sendErr) {
+			t.Fatalf("Expected the send error, got %v", err)
+		}
+
+		sendErr = nil
+		if err := mailer.Send(failed); err != nil || len(sent) != 2 {
+			t.Fatalf("Expected the retry to be sent, got %d sent, %v", len(sent), err)
+		}
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		plain, _ := NewMessage().From("app@example.com").To("user@example.com").Subject("Hello").Text("Hello").Build()
+
+		for i := 0; i < 2; i++ {
+			if err := mailer.Send(plain); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(sent) != 4 {
+			t.Fatalf("Expected the messages without key to be always sent, got %d", len(sent))
+		}
+	})
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	clock := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	store := &MemoryIdempotencyStore{Clock: ClockFunc(func() time.Time { return clock })}
+
+	if ok, _ := store.Claim(ctx, "key", time.Hour); !ok {
+		t.Fatal("Expected the key to be claimed")
+	}
+	if ok, _ := store.Claim(ctx, "key", time.Hour); ok {
+		t.Fatal("Expected the key to be already claimed")
+	}
+
+	clock = clock.Add(time.Hour)
+	if ok, _ := store.Claim(ctx, "key", time.Hour); !ok {
+		t.Fatal("Expected the expired key to be claimed again")
+	}
+
+	_ = store.Release(ctx, "key")
+	if ok, _ := store.Claim(ctx, "key", time.Hour); !ok {
+		t.Fatal("Expected the released key to be claimed again")
+	}
+}
+
+func TestRedisIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	address, _ := newTestRedis(t, "secret")
+
+	store := NewRedisIdempotencyStore(RedisConfig{Address: address, Password: "secret"})
+	defer store.Close()
+	other := NewRedisIdempotencyStore(RedisConfig{Address: address, Password: "secret"})
+	defer other.Close()
+
+	if ok, err := store.Claim(ctx, "idempotency:order-42", time.Hour); !ok || err != nil {
+		t.Fatalf("Expected the key to be claimed, got %v, %v", ok, err)
+	}
+	if ok, err := other.Claim(ctx, "idempotency:order-42", time.Hour); ok || err != nil {
+		t.Fatalf("Expected the key to be claimed by the first instance, got %v, %v", ok, err)
+	}
+
+	if err := store.Release(ctx, "idempotency:order-42"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := other.Claim(ctx, "idempotency:order-42", time.Hour); !ok {
+		t.Fatal("Expected the released key to be claimed")
+	}
+}
+
+func TestIdempotencyConfigValidate(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config IdempotencyConfig
+		valid  bool
+	}{
+		{"zero", IdempotencyConfig{}, true},
+		{"redis", IdempotencyConfig{Header: "X-Request-ID", TTL: time.Hour, Redis: &RedisConfig{Address: "127.0.0.1:6379"}}, true},
+		{"invalid header", IdempotencyConfig{Header: "Idempotency Key"}, false},
+		{"negative ttl", IdempotencyConfig{TTL: -time.Hour}, false},
+		{"negative timeout", IdempotencyConfig{Timeout: -time.Second}, false},
+		{"invalid redis", IdempotencyConfig{Redis: &RedisConfig{Address: "localhost"}}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.config.Validate(); (err == nil) != s.valid {
+				t.Fatalf("Expected valid %v, got %v", s.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,547 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	defaultIMAPFolder     = "Sent"
+	defaultIMAPTimeout    = 30 * time.Second
+	defaultIMAPMaxPending = 1000
+)
+
+// ErrIMAPBusy is reported for the copies dropped because the
+// [IMAPAppender] has MaxPending copies waiting to be appended.
+var ErrIMAPBusy = errors.New("imap: too many pending copies")
+
+// errIMAPClosed is reported for the copies of the sends after Close.
+var errIMAPClosed = errors.New("imap: appender closed")
+
+// IMAPConfig defines an IMAP mailbox settings, eg. of the Sent folder
+// the copies of the sent messages are appended to (see [IMAPAppend]).
+type IMAPConfig struct {
+	Host     string        `mapstructure:"host" json:"host,omitempty" bson:"host,omitempty"`
+	Port     int           `mapstructure:"port" json:"port,omitempty" bson:"port,omitempty"` // default to 993 with tls, 143 otherwise
+	Username string        `mapstructure:"username" json:"username,omitempty" bson:"username,omitempty"`
+	Password string        `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"`
+	Tls      bool          `mapstructure:"tls" json:"tls,omitempty" bson:"tls,omitempty"`             // implicit TLS, STARTTLS is used otherwise when supported
+	Folder   string        `mapstructure:"folder" json:"folder,omitempty" bson:"folder,omitempty"`    // default to "Sent"
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"` // dial and per operation timeout, default to 30s
+
+	// MaxPending is the max number of copies waiting to be appended,
+	// the next ones being dropped (see [ErrIMAPBusy]), default to 1000.
+	MaxPending int `mapstructure:"max_pending" json:"max_pending,omitempty" bson:"max_pending,omitempty"`
+
+	// OnError is an optional hook called when a copy
+	// of a sent message could not be appended.
+	OnError func(m *Message, err error) `mapstructure:"-" json:"-" bson:"-"`
+
+	// TLSConfig is an optional TLS configuration (eg. with custom root CAs).
+	TLSConfig *tls.Config `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the IMAP configuration for common mistakes.
+func (c IMAPConfig) Validate() error {
+	var errs []error
+
+	if c.Host == "" {
+		errs = append(errs, errors.New("imap: host is required"))
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("imap: port must be between 0 and 65535, got %d", c.Port))
+	}
+
+	if c.Username == "" {
+		errs = append(errs, errors.New("imap: username is required"))
+	}
+
+	if strings.ContainsAny(c.Username+c.Password, "\r\n") {
+		errs = append(errs, errors.New("imap: username and password must not contain line breaks"))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("imap: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.MaxPending < 0 {
+		errs = append(errs, fmt.Errorf("imap: max_pending must be positive, got %d", c.MaxPending))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c IMAPConfig) Redacted() IMAPConfig {
+	c.Password = redact(c.Password)
+	c.OnError = nil
+	c.TLSConfig = nil
+
+	return c
+}
+
+func (c IMAPConfig) folder() string {
+	if c.Folder == "" {
+		return defaultIMAPFolder
+	}
+
+	return c.Folder
+}
+
+func (c IMAPConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultIMAPTimeout
+	}
+
+	return c.Timeout
+}
+
+// imapCopy is a sent message copy waiting to be appended.
+type imapCopy struct {
+	message *Message
+	raw     []byte
+}
+
+// IMAPAppender appends the copies of the sent messages (see [IMAPAppend])
+// to the configured IMAP folder in the background, one at a time.
+type IMAPAppender struct {
+	config IMAPConfig
+
+	mu      sync.RWMutex
+	closed  bool
+	pending chan imapCopy
+	wg      sync.WaitGroup
+}
+
+// NewIMAPAppender creates a new IMAP appender, starting its worker.
+func NewIMAPAppender(config IMAPConfig) *IMAPAppender {
+	if config.MaxPending <= 0 {
+		config.MaxPending = defaultIMAPMaxPending
+	}
+
+	a := &IMAPAppender{config: config, pending: make(chan imapCopy, config.MaxPending)}
+
+	a.wg.Add(1)
+	go a.work()
+
+	return a
+}
+
+// Append queues the raw sent message to be appended, without waiting for
+// it. The copies that could not be queued are reported to the OnError hook.
+func (a *IMAPAppender) Append(m *Message, raw []byte) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		a.failed(m, errIMAPClosed)
+		return
+	}
+
+	select {
+	case a.pending <- imapCopy{message: m, raw: raw}:
+	default:
+		a.failed(m, ErrIMAPBusy)
+	}
+}
+
+// Close stops accepting the copies, waiting for the pending ones to be appended.
+func (a *IMAPAppender) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.pending)
+	}
+	a.mu.Unlock()
+
+	a.wg.Wait()
+
+	return nil
+}
+
+func (a *IMAPAppender) work() {
+	defer a.wg.Done()
+
+	for c := range a.pending {
+		if err := appendSentCopy(a.config, c.message.Date, c.raw); err != nil {
+			a.failed(c.message, err)
+		}
+	}
+}
+
+func (a *IMAPAppender) failed(m *Message, err error) {
+	if a.config.OnError != nil {
+		a.config.OnError(m, fmt.Errorf("imap: failed to append the sent message to %s: %w", a.config.folder(), err))
+	}
+}
+
+// IMAPAppend returns a middleware that appends a copy of every sent
+// message to the appender IMAP folder (flagged as seen), so that
+// the messages sent by the app show up in the mail client history.
+//
+// The copy holds the exact bytes sent by the backend (eg. with its DKIM
+// signature) and is appended in the background, without delaying the
+// send. Failing to append it doesn't fail the already sent message,
+// the error is reported to the OnError hook instead.
+//
+// The messages of the backends that don't render them are rendered
+// after the send, so those without Message-ID header and Date get ones
+// assigned, so that the copy matches the sent one.
+func IMAPAppend(appender *IMAPAppender) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			// buffer the attachments so that the message could be both sent and rendered
+			m = m.Clone()
+			if err := m.bufferAttachments(); err != nil {
+				return err
+			}
+
+			if m.Date.IsZero() {
+				m.Date = time.Now()
+			}
+			ensureMessageID(m)
+
+			rendered := m.captureRendered()
+			if err := next.Send(m); err != nil {
+				return err
+			}
+
+			raw := rendered.bytes()
+			if raw == nil {
+				var err error
+				if raw, err = m.Render(); err != nil {
+					appender.failed(m, err)
+					return nil
+				}
+			}
+
+			appender.Append(m, raw)
+
+			return nil
+		})
+	}
+}
+
+func appendSentCopy(cfg IMAPConfig, date time.Time, raw []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout())
+	defer cancel()
+
+	c, err := dialIMAP(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Append(cfg.folder(), []string{`\Seen`}, date, raw)
+}
+
+// imapConn is a minimal IMAP4rev1 (RFC 3501) client connection.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is an untagged response line, with its literals.
+type imapResponse struct {
+	Line     string
+	Literals [][]byte
+}
+
+// dialIMAP connects (upgrading the connection with STARTTLS when supported) and logs in.
+func dialIMAP(ctx context.Context, cfg IMAPConfig) (*imapConn, error) {
+	port := cfg.Port
+	if port == 0 {
+		port = 143
+		if cfg.Tls {
+			port = 993
+		}
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+
+	tlsConfig := cfg.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.Host
+	}
+
+	var conn net.Conn
+	var err error
+	if cfg.Tls {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.ToUpper(greeting.Line), "* OK") && !strings.HasPrefix(strings.ToUpper(greeting.Line), "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", greeting.Line)
+	}
+
+	secure := cfg.Tls
+	if !secure {
+		responses, err := c.Command("CAPABILITY")
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		if imapHasCapability(responses, "STARTTLS") {
+			if _, err := c.Command("STARTTLS"); err != nil {
+				c.Close()
+				return nil, err
+			}
+
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+			secure = true
+		}
+	}
+
+	// like net/smtp, the credentials are only sent encrypted or to localhost
+	if !secure && !isLocalhost(cfg.Host) {
+		c.Close()
+		return nil, errors.New("unencrypted connection, the server doesn't support STARTTLS")
+	}
+
+	if !strings.HasPrefix(strings.ToUpper(greeting.Line), "* PREAUTH") {
+		if _, err := c.Command("LOGIN " + imapQuote(cfg.Username) + " " + imapQuote(cfg.Password)); err != nil {
+			c.Close()
+			return nil, redactError(err, cfg.Password)
+		}
+	}
+
+	return c, nil
+}
+
+// Command sends the command, returning its untagged responses,
+// or an error if it doesn't complete with an OK response.
+func (c *imapConn) Command(command string) ([]imapResponse, error) {
+	tag, err := c.send(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readTagged(tag)
+}
+
+// Append appends the raw message to the folder.
+func (c *imapConn) Append(folder string, flags []string, date time.Time, raw []byte) error {
+	command := "APPEND " + imapQuote(imapMailboxName(folder))
+	if len(flags) > 0 {
+		command += " (" + strings.Join(flags, " ") + ")"
+	}
+	if !date.IsZero() {
+		command += ` "` + date.Format("_2-Jan-2006 15:04:05 -0700") + `"`
+	}
+
+	tag, err := c.send(command + " {" + strconv.Itoa(len(raw)) + "}")
+	if err != nil {
+		return err
+	}
+
+	// wait for the continuation request (or the rejection) of the literal
+	for {
+		response, err := c.readResponse()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(response.Line, "+") {
+			break
+		}
+		if strings.HasPrefix(response.Line, tag+" ") {
+			return imapStatusError(strings.TrimPrefix(response.Line, tag+" "))
+		}
+	}
+
+	if _, err := c.conn.Write(append(raw, '\r', '\n')); err != nil {
+		return err
+	}
+
+	_, err = c.readTagged(tag)
+
+	return err
+}
+
+// Close logs out and closes the connection.
+func (c *imapConn) Close() error {
+	_, _ = c.Command("LOGOUT")
+
+	return c.conn.Close()
+}
+
+// errIMAPLineBreak is the error of the commands with line breaks (eg. in
+// a quoted string), which would otherwise inject other commands.
+var errIMAPLineBreak = errors.New("imap: the command arguments must not contain line breaks")
+
+func (c *imapConn) send(command string) (string, error) {
+	if strings.ContainsAny(command, "\r\n") {
+		return "", errIMAPLineBreak
+	}
+
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+
+	if _, err := io.WriteString(c.conn, tag+" "+command+"\r\n"); err != nil {
+		return "", err
+	}
+
+	return tag, nil
+}
+
+// readTagged reads the responses up to the tagged one.
+func (c *imapConn) readTagged(tag string) ([]imapResponse, error) {
+	var responses []imapResponse
+	for {
+		response, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(response.Line, tag+" ") {
+			if err := imapStatusError(strings.TrimPrefix(response.Line, tag+" ")); err != nil {
+				return nil, err
+			}
+			return responses, nil
+		}
+
+		if strings.HasPrefix(response.Line, "*") {
+			responses = append(responses, response)
+		}
+	}
+}
+
+// readResponse reads a response line, with the literals it contains (eg. "{123}").
+func (c *imapConn) readResponse() (imapResponse, error) {
+	var response imapResponse
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return response, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		response.Line += line
+
+		i := strings.LastIndexByte(line, '{')
+		if i < 0 || !strings.HasSuffix(line, "}") {
+			return response, nil
+		}
+		size, err := strconv.Atoi(line[i+1 : len(line)-1])
+		if err != nil {
+			return response, nil
+		}
+
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return response, err
+		}
+		response.Literals = append(response.Literals, literal)
+	}
+}
+
+// imapStatusError returns the error of a NO or BAD status response.
+func imapStatusError(status string) error {
+	if strings.HasPrefix(strings.ToUpper(status), "OK") {
+		return nil
+	}
+
+	return fmt.Errorf("imap: %s", status)
+}
+
+func imapHasCapability(responses []imapResponse, capability string) bool {
+	for _, response := range responses {
+		fields := strings.Fields(strings.ToUpper(response.Line))
+		if len(fields) < 2 || fields[1] != "CAPABILITY" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			if field == capability {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// imapQuote returns the IMAP quoted string.
+//
+// The line breaks can't be quoted, the commands with
+// ones are rejected instead (see [imapConn.send]).
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// imapMailboxName encodes the mailbox name with the modified UTF-7 (RFC 3501, section 5.1.3).
+func imapMailboxName(name string) string {
+	var b strings.Builder
+	var pending []rune
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		units := utf16.Encode(pending)
+		data := make([]byte, 0, len(units)*2)
+		for _, u := range units {
+			data = append(data, byte(u>>8), byte(u))
+		}
+
+		b.WriteByte('&')
+		b.WriteString(strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(data), "/", ","))
+		b.WriteByte('-')
+		pending = nil
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e {
+			pending = append(pending, r)
+			continue
+		}
+
+		flush()
+		if r == '&' {
+			b.WriteString("&-")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	flush()
+
+	return b.String()
+}
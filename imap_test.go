@@ -0,0 +1,305 @@
+package mailer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIMAPServer is a minimal IMAP server for the IMAP client tests.
+type fakeIMAPServer struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	commands []string
+	appended map[string][]string // the appended messages by folder
+	inbox    []*fakeIMAPMessage  // the messages of the selected folder
+}
+
+type fakeIMAPMessage struct {
+	uid   int
+	raw   string
+	flags []string
+}
+
+func newFakeIMAPServer(t *testing.T, password string) *fakeIMAPServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeIMAPServer{ln: ln, password: password, appended: map[string][]string{}}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeIMAPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeIMAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		_, _ = conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+
+	reply("* OK IMAP4rev1 ready")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		name, args, _ := strings.Cut(command, " ")
+
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.ToUpper(name))
+		s.mu.Unlock()
+
+		switch strings.ToUpper(name) {
+		case "CAPABILITY":
+			reply("* CAPABILITY IMAP4rev1 AUTH=PLAIN", tag+" OK CAPABILITY completed")
+		case "LOGIN":
+			if !strings.HasSuffix(args, " "+imapQuote(s.password)) {
+				reply(tag + " NO [AUTHENTICATIONFAILED] Invalid credentials")
+				continue
+			}
+			reply(tag + " OK LOGIN completed")
+		case "APPEND":
+			quoted, _ := strconv.QuotedPrefix(args)
+			folder, _ := strconv.Unquote(quoted)
+			size, _ := strconv.Atoi(args[strings.LastIndexByte(args, '{')+1 : len(args)-1])
+			if folder == "Missing" {
+				reply(tag + " NO [TRYCREATE] Mailbox doesn't exist")
+				continue
+			}
+			reply("+ Ready for literal data")
+
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			_, _ = r.ReadString('\n')
+
+			s.mu.Lock()
+			s.appended[folder] = append(s.appended[folder], string(data))
+			s.mu.Unlock()
+
+			reply(tag + " OK APPEND completed")
+		case "SELECT":
+			s.mu.Lock()
+			exists := len(s.inbox)
+			s.mu.Unlock()
+			reply("* "+strconv.Itoa(exists)+" EXISTS", tag+" OK [READ-WRITE] SELECT completed")
+		case "UID":
+			reply(s.uidCommand(tag, args)...)
+		case "EXPUNGE":
+			s.mu.Lock()
+			var kept []*fakeIMAPMessage
+			for _, m := range s.inbox {
+				if !slices.Contains(m.flags, `\Deleted`) {
+					kept = append(kept, m)
+				}
+			}
+			s.inbox = kept
+			s.mu.Unlock()
+			reply(tag + " OK EXPUNGE completed")
+		case "LOGOUT":
+			reply("* BYE Logging out", tag+" OK LOGOUT completed")
+			return
+		default:
+			reply(tag + " BAD Unknown command")
+		}
+	}
+}
+
+// uidCommand handles the UID SEARCH UNSEEN, UID FETCH n BODY.PEEK[] and UID STORE n +FLAGS commands.
+func (s *fakeIMAPServer) uidCommand(tag, args string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return []string{tag + " BAD Missing arguments"}
+	}
+
+	if strings.EqualFold(fields[0], "SEARCH") {
+		result := "* SEARCH"
+		for _, m := range s.inbox {
+			if !slices.Contains(m.flags, `\Seen`) && !slices.Contains(m.flags, `\Deleted`) {
+				result += " " + strconv.Itoa(m.uid)
+			}
+		}
+		return []string{result, tag + " OK SEARCH completed"}
+	}
+
+	uid, _ := strconv.Atoi(fields[1])
+	for i, m := range s.inbox {
+		if m.uid != uid {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "FETCH":
+			return []string{
+				"* " + strconv.Itoa(i+1) + " FETCH (UID " + fields[1] + " BODY[] {" + strconv.Itoa(len(m.raw)) + "}\r\n" + m.raw + ")",
+				tag + " OK FETCH completed",
+			}
+		case "STORE":
+			m.flags = append(m.flags, strings.Trim(fields[len(fields)-1], "()"))
+			return []string{tag + " OK STORE completed"}
+		}
+	}
+
+	return []string{tag + " OK UID completed"}
+}
+
+func TestIMAPAppend(t *testing.T) {
+	server := newFakeIMAPServer(t, `p"ss`)
+
+	scenarios := []struct {
+		name     string
+		config   IMAPConfig
+		render   bool // whether the backend renders the message
+		sendErr  error
+		folder   string
+		expected string // the expected OnError error, empty for no error
+	}{
+		{"appended", IMAPConfig{Password: `p"ss`}, true, nil, "Sent", ""},
+		{"rendered after the send", IMAPConfig{Password: `p"ss`}, false, nil, "Sent", ""},
+		{"non-ascii folder", IMAPConfig{Password: `p"ss`, Folder: "Envoyés & Co"}, true, nil, "Envoy&AOk-s &- Co", ""},
+		{"send failure", IMAPConfig{Password: `p"ss`}, true, errors.New("rejected"), "", ""},
+		{"invalid credentials", IMAPConfig{Password: "invalid"}, true, nil, "", "AUTHENTICATIONFAILED"},
+		{"line break", IMAPConfig{Password: "p\r\na2 DELETE INBOX"}, true, nil, "", "line breaks"},
+		{"missing folder", IMAPConfig{Password: `p"ss`, Folder: "Missing"}, true, nil, "", "TRYCREATE"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			server.mu.Lock()
+			server.commands, server.appended = nil, map[string][]string{}
+			server.mu.Unlock()
+
+			var onError error
+			s.config.Host, s.config.Port, s.config.Username = "127.0.0.1", server.port(), "app@example.com"
+			s.config.OnError = func(_ *Message, err error) { onError = err }
+
+			appender := NewIMAPAppender(s.config)
+
+			// the signature differs on every rendering, so that only the sent bytes match
+			var signatures int
+			signer := SignerFunc(func([]byte) ([]byte, error) {
+				signatures++
+				return []byte("X-Signature: " + strconv.Itoa(signatures) + "\r\n"), nil
+			})
+
+			var sent []byte
+			mailer := Chain(MailerFunc(func(m *Message) error {
+				if s.render {
+					sent, _ = m.Render()
+				}
+				return s.sendErr
+			}), Signing(signer), IMAPAppend(appender))
+
+			m, _ := NewMessage().From("app@example.com").To("user@example.com").Subject("Hello").Text("Hello").Build()
+			if err := mailer.Send(m); !errors.Is(err, s.sendErr) {
+				t.Fatalf("Expected the send error %v, got %v", s.sendErr, err)
+			}
+
+			// wait for the copy to be appended
+			_ = appender.Close()
+
+			if s.expected == "" && onError != nil {
+				t.Fatalf("Expected no error, got %v", onError)
+			}
+			if s.expected != "" && (onError == nil || !strings.Contains(onError.Error(), s.expected) || strings.Contains(onError.Error(), s.config.Password)) {
+				t.Fatalf("Expected redacted error %q, got %v", s.expected, onError)
+			}
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+
+			if slices.Contains(server.commands, "DELETE") {
+				t.Fatalf("Expected no injected command, got %v", server.commands)
+			}
+
+			if s.folder == "" {
+				if len(server.appended) > 0 {
+					t.Fatalf("Expected no appended message, got %v", server.appended)
+				}
+				return
+			}
+
+			copies := server.appended[s.folder]
+			if len(copies) != 1 {
+				t.Fatalf("Expected 1 copy in %s, got %v", s.folder, server.appended)
+			}
+			if s.render && copies[0] != string(sent) {
+				t.Fatalf("Expected the exact sent bytes %q, got %q", sent, copies[0])
+			}
+			if !s.render && (!strings.Contains(copies[0], "Message-ID: ") || !strings.Contains(copies[0], "Subject: Hello")) {
+				t.Fatalf("Expected the copy of the sent message, got %s", copies[0])
+			}
+		})
+	}
+}
+
+func TestIMAPAppenderBusy(t *testing.T) {
+	var errs []error
+	appender := &IMAPAppender{
+		config:  IMAPConfig{OnError: func(_ *Message, err error) { errs = append(errs, err) }},
+		pending: make(chan imapCopy, 1),
+	}
+
+	appender.Append(&Message{}, []byte("first"))
+	appender.Append(&Message{}, []byte("second"))
+
+	if len(errs) != 1 || !errors.Is(errs[0], ErrIMAPBusy) {
+		t.Fatalf("Expected the second copy to be dropped, got %v", errs)
+	}
+}
+
+func TestIMAPConfigValidate(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config IMAPConfig
+		valid  bool
+	}{
+		{"valid", IMAPConfig{Host: "imap.example.com", Username: "app", Password: "secret"}, true},
+		{"missing host", IMAPConfig{Username: "app"}, false},
+		{"missing username", IMAPConfig{Host: "imap.example.com"}, false},
+		{"invalid port", IMAPConfig{Host: "imap.example.com", Username: "app", Port: 70000}, false},
+		{"line break", IMAPConfig{Host: "imap.example.com", Username: "app", Password: "a\r\nb"}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.config.Validate(); (err == nil) != s.valid {
+				t.Fatalf("Expected valid %v, got %v", s.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,635 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInboundMaxMessageSize = 25 << 20
+	defaultInboundMaxRecipients  = 100
+	defaultInboundTimeout        = 5 * time.Minute
+	inboundMaxLineLength         = 4096
+)
+
+// InboundProtocol is the protocol of the inbound listener.
+type InboundProtocol string
+
+const (
+	InboundSMTP InboundProtocol = "smtp"
+	// InboundLMTP is the Local Mail Transfer Protocol (RFC 2033) of the
+	// delivery from a local MTA (eg. Postfix "lmtp:inet:127.0.0.1:2424"),
+	// with a result per recipient.
+	InboundLMTP InboundProtocol = "lmtp"
+)
+
+// InboundConfig defines the inbound mail listener settings.
+type InboundConfig struct {
+	Address        string          `mapstructure:"address" json:"address,omitempty" bson:"address,omitempty"`                            // listen "host:port", eg. "127.0.0.1:2525"
+	Protocol       InboundProtocol `mapstructure:"protocol" json:"protocol,omitempty" bson:"protocol,omitempty"`                         // either "smtp" (default) or "lmtp"
+	Hostname       string          `mapstructure:"hostname" json:"hostname,omitempty" bson:"hostname,omitempty"`                         // the greeting name, default to the system host name
+	Domains        []string        `mapstructure:"domains" json:"domains,omitempty" bson:"domains,omitempty"`                            // the accepted recipient domains, any if empty
+	MaxMessageSize int64           `mapstructure:"max_message_size" json:"max_message_size,omitempty" bson:"max_message_size,omitempty"` // in bytes, default to 25MB
+	MaxRecipients  int             `mapstructure:"max_recipients" json:"max_recipients,omitempty" bson:"max_recipients,omitempty"`       // per message, default to 100
+	Timeout        time.Duration   `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`                            // the idle connection timeout, default to 5m
+
+	// OnError is an optional hook called when a received message
+	// could not be parsed or was rejected by a handler.
+	OnError func(msg *InboundMessage, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the inbound configuration for common mistakes.
+func (c InboundConfig) Validate() error {
+	var errs []error
+
+	if c.Address == "" {
+		errs = append(errs, errors.New("inbound: address is required"))
+	} else if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		errs = append(errs, fmt.Errorf("inbound: invalid address %q: %w", c.Address, err))
+	}
+
+	switch c.Protocol {
+	case "", InboundSMTP, InboundLMTP:
+	default:
+		errs = append(errs, fmt.Errorf("inbound: protocol must be either smtp or lmtp, got %q", c.Protocol))
+	}
+
+	for i, domain := range c.Domains {
+		if strings.TrimSpace(domain) == "" {
+			errs = append(errs, fmt.Errorf("inbound: domains[%d] must not be empty", i))
+		}
+	}
+
+	if c.MaxMessageSize < 0 {
+		errs = append(errs, fmt.Errorf("inbound: max_message_size must be positive, got %d", c.MaxMessageSize))
+	}
+	if c.MaxRecipients < 0 {
+		errs = append(errs, fmt.Errorf("inbound: max_recipients must be positive, got %d", c.MaxRecipients))
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("inbound: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// InboundMessage is a message received by the [InboundServer].
+type InboundMessage struct {
+	MailFrom   string   // the MAIL FROM address, empty for the bounces
+	Recipients []string // the RCPT TO addresses (a single one with LMTP)
+	RemoteAddr net.Addr
+	Helo       string // the HELO/EHLO/LHLO name of the client
+
+	Message *Message // the parsed message
+	Raw     []byte   // the raw message with the Received header
+}
+
+// InboundHandler handles the received messages. The *textproto.Error
+// errors are replied as they are (eg. "550 5.1.1 No such user"), the
+// other temporary ones (see [IsTemporary]) with 451 and the rest with 550.
+type InboundHandler interface {
+	HandleInbound(ctx context.Context, msg *InboundMessage) error
+}
+
+// InboundHandlerFunc is an adapter to use ordinary functions as [InboundHandler].
+type InboundHandlerFunc func(ctx context.Context, msg *InboundMessage) error
+
+// HandleInbound implements [InboundHandler] interface.
+func (f InboundHandlerFunc) HandleInbound(ctx context.Context, msg *InboundMessage) error {
+	return f(ctx, msg)
+}
+
+// InboundServer is a minimal SMTP or LMTP listener accepting the messages
+// for the configured domains, parsing them and dispatching them to the
+// registered handlers (eg. to process the replies to the notifications).
+//
+// It doesn't authenticate the clients nor relay the messages, so it
+// should only be reachable by a trusted MTA or behind one.
+type InboundServer struct {
+	config InboundConfig
+
+	mu       sync.Mutex
+	handlers []InboundHandler
+	ln       net.Listener
+	conns    map[net.Conn]bool // the connections, true while a message is handled
+	closed   bool
+
+	ctx    context.Context // canceled when the server is stopped
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewInboundServer creates a new inbound listener, started with [InboundServer.Start].
+func NewInboundServer(config InboundConfig) *InboundServer {
+	if config.Protocol == "" {
+		config.Protocol = InboundSMTP
+	}
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+		if config.Hostname == "" {
+			config.Hostname = "localhost"
+		}
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = defaultInboundMaxMessageSize
+	}
+	if config.MaxRecipients <= 0 {
+		config.MaxRecipients = defaultInboundMaxRecipients
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultInboundTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &InboundServer{config: config, conns: map[net.Conn]bool{}, ctx: ctx, cancel: cancel}
+}
+
+// Handle registers a handler of the received messages. The handlers
+// are called in the registration order, until one of them fails.
+func (s *InboundServer) Handle(handler InboundHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers = append(s.handlers, handler)
+}
+
+// Start starts listening on the configured address.
+func (s *InboundServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ln != nil || s.closed {
+		return errors.New("inbound: server already started")
+	}
+
+	ln, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		return fmt.Errorf("inbound: %w", err)
+	}
+	s.ln = ln
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = false
+			s.wg.Add(1)
+			s.mu.Unlock()
+
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the listener address, or nil if the server is not started.
+func (s *InboundServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ln == nil {
+		return nil
+	}
+
+	return s.ln.Addr()
+}
+
+// Stop stops accepting the connections, closes the idle ones and waits
+// for the messages being handled (up to the ctx deadline, when their
+// handlers context is canceled) before closing the remaining ones.
+func (s *InboundServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn, busy := range s.conns {
+		if !busy {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.cancel()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	<-done
+
+	return err
+}
+
+// setBusy marks the connection handling a message, so that it's not
+// closed by Stop, returning false if the server is being stopped. The
+// connection is closed once its message is handled if it is.
+func (s *InboundServer) setBusy(conn net.Conn, busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		if !busy {
+			conn.Close()
+		}
+		return false
+	}
+	s.conns[conn] = busy
+
+	return true
+}
+
+// inboundSession is the state of a single connection.
+type inboundSession struct {
+	conn net.Conn
+	r    *bufio.Reader
+	helo string
+
+	mailFrom   *string // the current transaction sender
+	recipients []string
+}
+
+func (ss *inboundSession) reply(lines ...string) {
+	_, _ = ss.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+func (ss *inboundSession) reset() {
+	ss.mailFrom, ss.recipients = nil, nil
+}
+
+var errInboundLineTooLong = errors.New("line too long")
+
+// readLine reads a command line, limited to inboundMaxLineLength.
+func (ss *inboundSession) readLine() (string, error) {
+	line, err := ss.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errInboundLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (s *InboundServer) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	ss := &inboundSession{conn: conn, r: bufio.NewReaderSize(conn, inboundMaxLineLength)}
+
+	greeting := "ESMTP"
+	if s.config.Protocol == InboundLMTP {
+		greeting = "LMTP"
+	}
+	ss.reply("220 " + s.config.Hostname + " " + greeting + " ready")
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(s.config.Timeout))
+
+		line, err := ss.readLine()
+		if errors.Is(err, errInboundLineTooLong) {
+			ss.reply("500 5.5.2 Line too long")
+			return
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				ss.reply("421 4.4.2 " + s.config.Hostname + " Idle timeout, closing connection")
+			}
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd, arg = strings.ToUpper(cmd), strings.TrimSpace(arg)
+
+		switch cmd {
+		case "HELO", "EHLO", "LHLO":
+			if (cmd == "LHLO") != (s.config.Protocol == InboundLMTP) {
+				ss.reply("500 5.5.1 Command not recognized")
+				continue
+			}
+			if arg == "" {
+				ss.reply("501 5.5.4 Syntax error, " + cmd + " requires a domain")
+				continue
+			}
+			ss.helo = arg
+			ss.reset()
+			if cmd == "HELO" {
+				ss.reply("250 " + s.config.Hostname)
+				continue
+			}
+			ss.reply(
+				"250-"+s.config.Hostname,
+				"250-8BITMIME",
+				"250-ENHANCEDSTATUSCODES",
+				"250 SIZE "+strconv.FormatInt(s.config.MaxMessageSize, 10),
+			)
+		case "MAIL":
+			if ss.helo == "" {
+				ss.reply("503 5.5.1 Send " + s.hello() + " first")
+				continue
+			}
+			if ss.mailFrom != nil {
+				ss.reply("503 5.5.1 Nested MAIL command")
+				continue
+			}
+			address, params, ok := parseInboundPath(arg, "FROM:")
+			if !ok {
+				ss.reply("501 5.5.4 Syntax error in MAIL command")
+				continue
+			}
+			if size, ok := params["SIZE"]; ok {
+				if n, err := strconv.ParseInt(size, 10, 64); err == nil && n > s.config.MaxMessageSize {
+					ss.reply("552 5.3.4 Message size exceeds the limit")
+					continue
+				}
+			}
+			ss.mailFrom = &address
+			ss.reply("250 2.1.0 OK")
+		case "RCPT":
+			if ss.mailFrom == nil {
+				ss.reply("503 5.5.1 Send MAIL first")
+				continue
+			}
+			address, _, ok := parseInboundPath(arg, "TO:")
+			if !ok || address == "" {
+				ss.reply("501 5.5.4 Syntax error in RCPT command")
+				continue
+			}
+			if !s.accepts(address) {
+				ss.reply("550 5.1.1 Recipient domain not accepted")
+				continue
+			}
+			if len(ss.recipients) >= s.config.MaxRecipients {
+				ss.reply("452 4.5.3 Too many recipients")
+				continue
+			}
+			ss.recipients = append(ss.recipients, address)
+			ss.reply("250 2.1.5 OK")
+		case "DATA":
+			if ss.mailFrom == nil || len(ss.recipients) == 0 {
+				ss.reply("503 5.5.1 Send MAIL and RCPT first")
+				continue
+			}
+			ss.reply("354 End data with <CR><LF>.<CR><LF>")
+
+			if !s.data(ss) {
+				return
+			}
+			ss.reset()
+		case "RSET":
+			ss.reset()
+			ss.reply("250 2.0.0 OK")
+		case "NOOP":
+			ss.reply("250 2.0.0 OK")
+		case "VRFY":
+			ss.reply("252 2.5.0 Cannot verify the user")
+		case "QUIT":
+			ss.reply("221 2.0.0 Bye")
+			return
+		default:
+			ss.reply("500 5.5.1 Command not recognized")
+		}
+	}
+}
+
+// hello returns the greeting command of the protocol.
+func (s *InboundServer) hello() string {
+	if s.config.Protocol == InboundLMTP {
+		return "LHLO"
+	}
+
+	return "EHLO"
+}
+
+// data receives and dispatches the message, returning false if the connection should be closed.
+func (s *InboundServer) data(ss *inboundSession) bool {
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "Received: from %s (%s)\r\n\tby %s with %s; %s\r\n",
+		ss.helo, ss.conn.RemoteAddr(), s.config.Hostname, strings.ToUpper(string(s.config.Protocol)), time.Now().Format(time.RFC1123Z))
+
+	_ = ss.conn.SetReadDeadline(time.Now().Add(s.config.Timeout))
+
+	if err := readInboundData(ss.r, &raw, s.config.MaxMessageSize+int64(raw.Len())); err != nil {
+		if !errors.Is(err, errInboundTooLarge) {
+			return false
+		}
+		s.replyAll(ss, "552 5.3.4 Message size exceeds the limit")
+		return true
+	}
+
+	msg := &InboundMessage{
+		MailFrom:   *ss.mailFrom,
+		Recipients: ss.recipients,
+		RemoteAddr: ss.conn.RemoteAddr(),
+		Helo:       ss.helo,
+		Raw:        raw.Bytes(),
+	}
+
+	m, err := ParseMessage(bytes.NewReader(msg.Raw))
+	if err != nil {
+		s.onError(msg, fmt.Errorf("inbound: invalid message: %w", err))
+		s.replyAll(ss, "550 5.6.0 Invalid message")
+		return true
+	}
+	msg.Message = m
+
+	if !s.setBusy(ss.conn, true) {
+		s.replyAll(ss, "421 4.3.2 Service shutting down")
+		return false
+	}
+	defer s.setBusy(ss.conn, false)
+
+	if s.config.Protocol == InboundSMTP {
+		ss.reply(s.dispatch(msg))
+		return true
+	}
+
+	// LMTP replies the result of every recipient
+	for _, recipient := range ss.recipients {
+		rcptMsg := *msg
+		rcptMsg.Recipients = []string{recipient}
+		ss.reply(s.dispatch(&rcptMsg))
+	}
+
+	return true
+}
+
+// replyAll replies once, or once per recipient with LMTP.
+func (s *InboundServer) replyAll(ss *inboundSession, reply string) {
+	if s.config.Protocol == InboundSMTP {
+		ss.reply(reply)
+		return
+	}
+
+	for range ss.recipients {
+		ss.reply(reply)
+	}
+}
+
+// dispatch calls the handlers, returning the reply.
+func (s *InboundServer) dispatch(msg *InboundMessage) string {
+	s.mu.Lock()
+	handlers := s.handlers
+	s.mu.Unlock()
+
+	if len(handlers) == 0 {
+		return "451 4.3.0 No handler is registered, try again later"
+	}
+
+	for _, handler := range handlers {
+		if err := handler.HandleInbound(s.ctx, msg); err != nil {
+			s.onError(msg, err)
+
+			var smtpErr *textproto.Error
+			switch {
+			case errors.As(err, &smtpErr):
+				return fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Msg)
+			case IsTemporary(err) || isDeferred(err) || errors.Is(err, ErrQueueFull) || errors.Is(err, context.Canceled):
+				return "451 4.3.0 Temporary failure, try again later"
+			default:
+				return "550 5.7.0 Message rejected"
+			}
+		}
+	}
+
+	return "250 2.0.0 OK"
+}
+
+func (s *InboundServer) onError(msg *InboundMessage, err error) {
+	if s.config.OnError != nil {
+		s.config.OnError(msg, err)
+	}
+}
+
+// accepts checks the recipient domain.
+func (s *InboundServer) accepts(address string) bool {
+	if len(s.config.Domains) == 0 {
+		return true
+	}
+
+	_, domain, _ := strings.Cut(address, "@")
+	for _, accepted := range s.config.Domains {
+		if strings.EqualFold(domain, accepted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseInboundPath parses the "FROM:<address> PARAM=value" arguments of the MAIL and RCPT commands.
+func parseInboundPath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+
+	path, rest, _ := strings.Cut(strings.TrimSpace(arg[len(prefix):]), " ")
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", nil, false
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Fields(rest) {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(key)] = value
+	}
+
+	return path[1 : len(path)-1], params, true
+}
+
+var errInboundTooLarge = errors.New("message too large")
+
+// readInboundData reads the dot-stuffed message data up to the terminating
+// ".\r\n" line into w, failing with errInboundTooLarge (after reading
+// it all) if w would grow over limit bytes.
+func readInboundData(r *bufio.Reader, w *bytes.Buffer, limit int64) error {
+	lineStart := true
+	tooLarge := false
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+		complete := err == nil
+
+		if lineStart && chunk[0] == '.' {
+			if complete && (string(chunk) == ".\r\n" || string(chunk) == ".\n") {
+				break
+			}
+			chunk = chunk[1:]
+		}
+		lineStart = complete
+
+		if int64(w.Len()+len(chunk)) > limit {
+			tooLarge = true
+		}
+		if !tooLarge {
+			if complete && !bytes.HasSuffix(chunk, []byte("\r\n")) {
+				w.Write(chunk[:len(chunk)-1])
+				w.WriteString("\r\n")
+			} else {
+				w.Write(chunk)
+			}
+		}
+	}
+
+	if tooLarge {
+		return errInboundTooLarge
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startInboundServer(t *testing.T, config InboundConfig, handler InboundHandlerFunc) *InboundServer {
+	t.Helper()
+
+	config.Address = "127.0.0.1:0"
+	config.Hostname = "inbound.test"
+
+	s := NewInboundServer(config)
+	s.Handle(handler)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Stop(context.Background()) })
+
+	return s
+}
+
+func TestInboundServerSMTP(t *testing.T) {
+	var mu sync.Mutex
+	var received []*InboundMessage
+
+	server := startInboundServer(t, InboundConfig{Domains: []string{"reply.example.com"}, MaxMessageSize: 1024}, func(_ context.Context, msg *InboundMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		received = append(received, msg)
+
+		switch msg.Message.Subject {
+		case "temporary":
+			return &textproto.Error{Code: 421, Msg: "4.3.0 busy"}
+		case "unknown":
+			return &textproto.Error{Code: 550, Msg: "5.1.1 No such thread"}
+		case "reject":
+			return errors.New("invalid reply")
+		}
+		return nil
+	})
+
+	scenarios := []struct {
+		name     string
+		from     string
+		to       string
+		body     string
+		code     int    // the expected reply code, 0 for no error
+		expected string // the expected reply message
+	}{
+		{"accepted", "user@example.com", "thread+42@reply.example.com", "Subject: Re: hello\r\n\r\n.dotted line\r\n", 0, ""},
+		{"bounce", "", "thread+42@reply.example.com", "Subject: Undelivered\r\n\r\nbounce\r\n", 0, ""},
+		{"other domain", "user@example.com", "user@other.example.com", "", 550, "5.1.1"},
+		{"too large", "user@example.com", "thread+42@reply.example.com", "Subject: large\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n", 552, "5.3.4"},
+		{"handler temporary", "user@example.com", "thread+42@reply.example.com", "Subject: temporary\r\n\r\nx\r\n", 421, "4.3.0 busy"},
+		{"handler smtp error", "user@example.com", "thread+42@reply.example.com", "Subject: unknown\r\n\r\nx\r\n", 550, "5.1.1 No such thread"},
+		{"handler error", "user@example.com", "thread+42@reply.example.com", "Subject: reject\r\n\r\nx\r\n", 550, "5.7.0"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			err := smtp.SendMail(server.Addr().String(), nil, s.from, []string{s.to}, []byte(s.body))
+			if s.code == 0 {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+
+			var smtpErr *textproto.Error
+			if !errors.As(err, &smtpErr) || smtpErr.Code != s.code || !strings.HasPrefix(smtpErr.Msg, s.expected) {
+				t.Fatalf("Expected error %d %s, got %v", s.code, s.expected, err)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 5 {
+		t.Fatalf("Expected 5 handled messages, got %d", len(received))
+	}
+
+	msg := received[0]
+	if msg.MailFrom != "user@example.com" || strings.Join(msg.Recipients, ",") != "thread+42@reply.example.com" || msg.Helo == "" {
+		t.Fatalf("Unexpected envelope %+v", msg)
+	}
+	if msg.Message.Subject != "Re: hello" || !strings.Contains(msg.Message.Text, ".dotted line") || strings.Contains(msg.Message.Text, "..dotted") {
+		t.Fatalf("Unexpected message %+v", msg.Message)
+	}
+	if !strings.HasPrefix(string(msg.Raw), "Received: from ") || !strings.Contains(string(msg.Raw), "by inbound.test with SMTP") {
+		t.Fatalf("Expected the Received header, got %q", msg.Raw)
+	}
+	if received[1].MailFrom != "" {
+		t.Fatalf("Expected the null sender, got %q", received[1].MailFrom)
+	}
+}
+
+func TestInboundServerLMTP(t *testing.T) {
+	s := startInboundServer(t, InboundConfig{Protocol: InboundLMTP}, func(_ context.Context, msg *InboundMessage) error {
+		if msg.Recipients[0] == "unknown@example.com" {
+			return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+		}
+		return nil
+	})
+
+	conn, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	steps := []struct {
+		cmd  string
+		code int
+	}{
+		{"", 220},
+		{"EHLO client.test", 500},
+		{"LHLO client.test", 250},
+		{"MAIL FROM:<sender@example.com>", 250},
+		{"RCPT TO:<user@example.com>", 250},
+		{"RCPT TO:<unknown@example.com>", 250},
+		{"DATA", 354},
+		{"Subject: Hello\r\n\r\nHello\r\n.", 250},
+		{"", 550},
+		{"QUIT", 221},
+	}
+
+	for _, step := range steps {
+		if step.cmd != "" {
+			if err := conn.PrintfLine("%s", step.cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := conn.ReadResponse(step.code); err != nil {
+			t.Fatalf("%q: %v", step.cmd, err)
+		}
+	}
+}
+
+func TestInboundServerStop(t *testing.T) {
+	handling := make(chan struct{})
+	release := make(chan struct{})
+
+	s := startInboundServer(t, InboundConfig{}, func(ctx context.Context, _ *InboundMessage) error {
+		close(handling)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	idle, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- smtp.SendMail(s.Addr().String(), nil, "user@example.com", []string{"to@example.com"}, []byte("Subject: hi\r\n\r\nhi\r\n"))
+	}()
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := s.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the in-flight message to delay the stop, got %v", err)
+	}
+	close(release)
+
+	if err := <-sent; err == nil {
+		t.Fatal("Expected the connection of the canceled handler to be closed")
+	}
+	if _, _, err := idle.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idle.ReadLine(); err == nil {
+		t.Fatal("Expected the idle connection to be closed")
+	}
+}
+
+func TestInboundConfigValidate(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config InboundConfig
+		valid  bool
+	}{
+		{"valid", InboundConfig{Address: "127.0.0.1:2525", Protocol: InboundLMTP, Domains: []string{"example.com"}}, true},
+		{"missing address", InboundConfig{}, false},
+		{"invalid address", InboundConfig{Address: "localhost"}, false},
+		{"invalid protocol", InboundConfig{Address: ":25", Protocol: "imap"}, false},
+		{"empty domain", InboundConfig{Address: ":25", Domains: []string{""}}, false},
+		{"negative size", InboundConfig{Address: ":25", MaxMessageSize: -1}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.config.Validate(); (err == nil) != s.valid {
+				t.Fatalf("Expected valid %v, got %v", s.valid, err)
+			}
+		})
+	}
+}
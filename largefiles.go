@@ -0,0 +1,417 @@
+package mailer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLargeFileThreshold = 10 << 20
+	defaultLargeFileExpiry    = 7 * 24 * time.Hour
+	defaultLargeFileTimeout   = 30 * time.Second
+)
+
+var bodyCloseTagRegex = regexp.MustCompile(`(?i)</body\s*>`)
+
+// LargeFileStore persists the attachments handed off as download links.
+type LargeFileStore interface {
+	// Put stores data under the specified slash separated key.
+	Put(ctx context.Context, key string, data []byte) error
+
+	// URL returns the download url of the key, valid until expires.
+	URL(key string, expires time.Time) (string, error)
+}
+
+// LargeFilesConfig defines the large attachments handoff settings.
+//
+// Exactly one of Local or S3 must be set.
+type LargeFilesConfig struct {
+	Threshold int64           `mapstructure:"threshold" json:"threshold,omitempty" bson:"threshold,omitempty"` // attachments size in bytes above which they are linked, default to 10MB
+	Expiry    time.Duration   `mapstructure:"expiry" json:"expiry,omitempty" bson:"expiry,omitempty"`          // download links lifetime, default to 7 days
+	Prefix    string          `mapstructure:"prefix" json:"prefix,omitempty" bson:"prefix,omitempty"`          // optional keys prefix, eg. "files/"
+	Timeout   time.Duration   `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`       // upload timeout, default to 30s
+	Local     *LocalFileStore `mapstructure:"local" json:"local,omitempty" bson:"local,omitempty"`             // local directory served over HTTP
+	S3        *S3ArchiveStore `mapstructure:"s3" json:"s3,omitempty" bson:"s3,omitempty"`                      // S3-compatible bucket
+
+	// Clock is an optional time source used for the links expiry (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the large files configuration for common mistakes.
+func (c LargeFilesConfig) Validate() error {
+	var errs []error
+
+	if c.Local == nil && c.S3 == nil {
+		errs = append(errs, errors.New("large_files: either local or s3 must be set"))
+	}
+
+	if c.Local != nil && c.S3 != nil {
+		errs = append(errs, errors.New("large_files: local and s3 are mutually exclusive"))
+	}
+
+	if c.Local != nil {
+		if err := c.Local.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.S3 != nil {
+		if err := c.S3.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Expiry > s3MaxPresignExpiry*time.Second {
+			errs = append(errs, fmt.Errorf("large_files: s3 expiry must be at most 168h, got %s", c.Expiry))
+		}
+	}
+
+	if c.Threshold < 0 {
+		errs = append(errs, fmt.Errorf("large_files: threshold must be positive, got %d", c.Threshold))
+	}
+
+	if c.Expiry < 0 {
+		errs = append(errs, fmt.Errorf("large_files: expiry must be positive, got %s", c.Expiry))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("large_files: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c LargeFilesConfig) Redacted() LargeFilesConfig {
+	if c.Local != nil {
+		local := *c.Local
+		local.Secret = redact(local.Secret)
+		c.Local = &local
+	}
+	if c.S3 != nil {
+		s3 := *c.S3
+		s3.SecretKey = redact(s3.SecretKey)
+		c.S3 = &s3
+	}
+
+	return c
+}
+
+// Store returns the LargeFileStore described by the config.
+func (c LargeFilesConfig) Store() (LargeFileStore, error) {
+	switch {
+	case c.Local != nil:
+		return c.Local, nil
+	case c.S3 != nil:
+		return c.S3, nil
+	default:
+		return nil, errors.New("either local or s3 must be set")
+	}
+}
+
+// LargeFile describes an attachment handed off as download link.
+type LargeFile struct {
+	Name string
+	Size int64
+	URL  string
+}
+
+// LargeFiles returns a middleware that uploads the attachments larger than
+// the threshold to the store and replaces them with their download links,
+// listed at the end of the text and HTML bodies, instead of having the
+// message bounced by the relays for its size.
+//
+// The files are stored as "{prefix}{yyyy}/{mm}/{dd}/{random}/{name}" and the
+// links expire after the configured expiry. The inline attachments are never
+// linked, since the HTML body references them.
+func LargeFiles(store LargeFileStore, cfg LargeFilesConfig) Middleware {
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = defaultLargeFileThreshold
+	}
+
+	expiry := cfg.Expiry
+	if expiry <= 0 {
+		expiry = defaultLargeFileExpiry
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultLargeFileTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if len(m.Attachments) == 0 {
+				return next.Send(m)
+			}
+
+			// buffer the attachments so that they could be both measured and sent
+			m = m.Clone()
+			if err := m.bufferAttachments(); err != nil {
+				return err
+			}
+
+			names := make([]string, 0, len(m.Attachments))
+			for name := range m.Attachments {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			t := now(cfg.Clock)
+			expires := t.Add(expiry)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			var files []LargeFile
+			for _, name := range names {
+				data, err := io.ReadAll(cloneReader(m.Attachments[name]))
+				if err != nil {
+					return err
+				}
+				if int64(len(data)) <= threshold {
+					continue
+				}
+
+				key := cfg.Prefix + t.UTC().Format("2006/01/02") + "/" + largeFileToken() + "/" + largeFileName(name)
+
+				if err := store.Put(ctx, key, data); err != nil {
+					return fmt.Errorf("failed to upload the attachment %q: %w", name, err)
+				}
+
+				link, err := store.URL(key, expires)
+				if err != nil {
+					return fmt.Errorf("failed to link the attachment %q: %w", name, err)
+				}
+
+				files = append(files, LargeFile{Name: name, Size: int64(len(data)), URL: link})
+				delete(m.Attachments, name)
+			}
+
+			if len(files) > 0 {
+				m.linkLargeFiles(files, expires)
+			}
+
+			return next.Send(m)
+		})
+	}
+}
+
+// linkLargeFiles appends the download links of the files to the message bodies.
+func (m *Message) linkLargeFiles(files []LargeFile, expires time.Time) {
+	until := expires.UTC().Format("January 2, 2006 15:04 MST")
+
+	if m.Text != "" || m.HTML == "" {
+		var sb strings.Builder
+		if text := strings.TrimRight(m.Text, "\n"); text != "" {
+			sb.WriteString(text + "\n\n")
+		}
+		sb.WriteString("The following files are available for download until " + until + ":\n")
+		for _, f := range files {
+			fmt.Fprintf(&sb, "\n- %s (%s): %s", f.Name, formatFileSize(f.Size), f.URL)
+		}
+		sb.WriteString("\n")
+
+		m.Text = sb.String()
+	}
+
+	if m.HTML != "" {
+		var sb strings.Builder
+		sb.WriteString("<p>The following files are available for download until " + html.EscapeString(until) + ":</p><ul>")
+		for _, f := range files {
+			fmt.Fprintf(&sb, `<li><a href="%s">%s</a> (%s)</li>`, html.EscapeString(f.URL), html.EscapeString(f.Name), formatFileSize(f.Size))
+		}
+		sb.WriteString("</ul>")
+
+		if loc := bodyCloseTagRegex.FindStringIndex(m.HTML); loc != nil {
+			m.HTML = m.HTML[:loc[0]] + sb.String() + m.HTML[loc[0]:]
+		} else {
+			m.HTML += sb.String()
+		}
+	}
+}
+
+// largeFileToken returns a random unguessable key segment,
+// so that the linked files of different messages never collide.
+func largeFileToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return PseudorandomString(32)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// largeFileName converts the attachment name into a safe key name.
+func largeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', '?', '#', '%':
+			return '_'
+		}
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+
+	return name
+}
+
+// formatFileSize formats the size in bytes with its binary unit, eg. "12.5 MB".
+func formatFileSize(size int64) string {
+	const unit = 1 << 10
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+var _ LargeFileStore = (*LocalFileStore)(nil)
+
+// LocalFileStore is a [LargeFileStore] that stores the files in a local
+// directory and serves them over HTTP (see [LocalFileStore.Middleware])
+// under BaseURL, with HMAC signed links that expire.
+type LocalFileStore struct {
+	Dir     string `mapstructure:"dir" json:"dir,omitempty" bson:"dir,omitempty"`          // the files directory
+	BaseURL string `mapstructure:"url" json:"url,omitempty" bson:"url,omitempty"`          // the public base url of the files, eg. https://example.com/files
+	Secret  string `mapstructure:"secret" json:"secret,omitempty" bson:"secret,omitempty"` // the links signing secret
+
+	// Clock is an optional time source used for the links expiry.
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the local store configuration for common mistakes.
+func (s *LocalFileStore) Validate() error {
+	var errs []error
+
+	if s.Dir == "" {
+		errs = append(errs, errors.New("large_files: local dir is required"))
+	}
+
+	if u, err := url.Parse(s.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("large_files: invalid local url %q", s.BaseURL))
+	}
+
+	if s.Secret == "" {
+		errs = append(errs, errors.New("large_files: local secret is required"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Put implements [LargeFileStore] interface.
+func (s *LocalFileStore) Put(ctx context.Context, key string, data []byte) error {
+	return DirArchiveStore(s.Dir).Put(ctx, key, data)
+}
+
+// URL implements [LargeFileStore] interface.
+func (s *LocalFileStore) URL(key string, expires time.Time) (string, error) {
+	base, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return "", err
+	}
+
+	key = strings.TrimLeft(path.Clean("/"+key), "/")
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	link := base.JoinPath(key)
+	link.RawQuery = url.Values{"expires": {exp}, "signature": {s.signature(key, exp)}}.Encode()
+
+	return link.String(), nil
+}
+
+// Middleware returns a handler serving the files under the
+// configured url path and everything else with next.
+func (s *LocalFileStore) Middleware(next http.Handler) http.Handler {
+	prefix := "/"
+	if base, err := url.Parse(s.BaseURL); err == nil {
+		prefix = strings.TrimRight(base.Path, "/") + "/"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.serve(w, r, strings.TrimPrefix(r.URL.Path, prefix))
+	})
+}
+
+// serve serves the key file if the request link is valid.
+func (s *LocalFileStore) serve(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key = strings.TrimLeft(path.Clean("/"+key), "/")
+	exp := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(s.signature(key, exp))) != 1 {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || !now(s.Clock).Before(time.Unix(expires, 0)) {
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	name := path.Base(key)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (s *LocalFileStore) signature(key, expires string) string {
+	h := hmac.New(sha256.New, []byte(s.Secret))
+	h.Write([]byte(key + "\n" + expires))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
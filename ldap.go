@@ -0,0 +1,962 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLDAPUserFilter      = "(&(|(objectClass=person)(objectClass=user))(|(uid={name})(sAMAccountName={name})))"
+	defaultLDAPGroupFilter     = "(&(|(objectClass=groupOfNames)(objectClass=group))(cn={name}))"
+	defaultLDAPMailAttribute   = "mail"
+	defaultLDAPNameAttribute   = "displayName"
+	defaultLDAPMemberAttribute = "member"
+	defaultLDAPCacheTTL        = 5 * time.Minute
+	defaultLDAPCacheSize       = 1000
+	defaultLDAPTimeout         = 10 * time.Second
+
+	// maxLDAPGroupDepth limits the nested groups expansion.
+	maxLDAPGroupDepth = 5
+)
+
+// LDAPConfig defines the LDAP (or Active Directory) recipient resolver settings.
+type LDAPConfig struct {
+	URL              string `mapstructure:"url" json:"url,omitempty" bson:"url,omitempty"` // ldap://host:389 or ldaps://host:636
+	StartTLS         bool   `mapstructure:"start_tls" json:"start_tls,omitempty" bson:"start_tls,omitempty"`
+	InsecureBind     bool   `mapstructure:"insecure_bind" json:"insecure_bind,omitempty" bson:"insecure_bind,omitempty"` // allows the bind password to be sent over a plaintext ldap:// connection
+	BindDN           string `mapstructure:"bind_dn" json:"bind_dn,omitempty" bson:"bind_dn,omitempty"`                   // anonymous bind if empty
+	BindPassword     string `mapstructure:"bind_password" json:"bind_password,omitempty" bson:"bind_password,omitempty"`
+	BindPasswordFile string `mapstructure:"bind_password_file" json:"bind_password_file,omitempty" bson:"bind_password_file,omitempty"` // path to a file holding the bind password (eg. Docker/K8s secret)
+	BaseDN           string `mapstructure:"base_dn" json:"base_dn,omitempty" bson:"base_dn,omitempty"`
+
+	// UserFilter and GroupFilter are the search filters of the "user:{name}"
+	// and "group:{name}" recipients, where the "{name}" placeholder is
+	// replaced with the escaped recipient name. The defaults match both
+	// the OpenLDAP and Active Directory schemas.
+	UserFilter  string `mapstructure:"user_filter" json:"user_filter,omitempty" bson:"user_filter,omitempty"`
+	GroupFilter string `mapstructure:"group_filter" json:"group_filter,omitempty" bson:"group_filter,omitempty"`
+
+	MailAttribute   string `mapstructure:"mail_attribute" json:"mail_attribute,omitempty" bson:"mail_attribute,omitempty"`       // default to "mail"
+	NameAttribute   string `mapstructure:"name_attribute" json:"name_attribute,omitempty" bson:"name_attribute,omitempty"`       // default to "displayName"
+	MemberAttribute string `mapstructure:"member_attribute" json:"member_attribute,omitempty" bson:"member_attribute,omitempty"` // group members DNs, default to "member"
+
+	CacheTTL  time.Duration `mapstructure:"cache_ttl" json:"cache_ttl,omitempty" bson:"cache_ttl,omitempty"`    // default to 5m, negative disables the caching
+	CacheSize int           `mapstructure:"cache_size" json:"cache_size,omitempty" bson:"cache_size,omitempty"` // max cached recipients, default to 1000
+	Timeout   time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`          // dial and lookup timeout, default to 10s
+
+	// TLSConfig optionally overrides the ldaps and StartTLS
+	// settings (eg. to trust a private CA).
+	TLSConfig *tls.Config `mapstructure:"-" json:"-" bson:"-"`
+
+	// Clock is used for the cache expiration (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the LDAP configuration for common mistakes.
+func (c LDAPConfig) Validate() error {
+	var errs []error
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("recipients: invalid ldap url %q, expected ldap://host[:port] or ldaps://host[:port]", c.URL))
+	} else if c.StartTLS && u.Scheme == "ldaps" {
+		errs = append(errs, errors.New("recipients: ldap start_tls cannot be used with an ldaps url"))
+	} else if u.Scheme == "ldap" && !c.StartTLS && c.BindDN != "" && !c.InsecureBind {
+		errs = append(errs, errors.New("recipients: ldap bind over a plaintext connection requires start_tls, an ldaps url or insecure_bind"))
+	}
+
+	if c.BaseDN == "" {
+		errs = append(errs, errors.New("recipients: ldap base_dn is required"))
+	}
+
+	if c.BindPassword != "" && c.BindPasswordFile != "" {
+		errs = append(errs, errors.New("recipients: ldap bind_password and bind_password_file are mutually exclusive"))
+	}
+	if c.BindDN == "" && (c.BindPassword != "" || c.BindPasswordFile != "") {
+		errs = append(errs, errors.New("recipients: ldap bind_password requires a bind_dn"))
+	}
+
+	for _, filter := range [][2]string{{"user_filter", c.UserFilter}, {"group_filter", c.GroupFilter}} {
+		if filter[1] == "" {
+			continue
+		}
+		if !strings.Contains(filter[1], "{name}") {
+			errs = append(errs, fmt.Errorf("recipients: ldap %s must contain the {name} placeholder", filter[0]))
+		} else if _, err := compileLDAPFilter(strings.ReplaceAll(filter[1], "{name}", "x")); err != nil {
+			errs = append(errs, fmt.Errorf("recipients: invalid ldap %s: %w", filter[0], err))
+		}
+	}
+
+	if c.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("recipients: ldap cache_size must be positive, got %d", c.CacheSize))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("recipients: ldap timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c LDAPConfig) Redacted() LDAPConfig {
+	c.BindPassword = redact(c.BindPassword)
+	c.TLSConfig = nil
+	c.Clock = nil
+
+	return c
+}
+
+// LDAPResolver is a [RecipientResolver] that looks up the "user:{name}"
+// and "group:{name}" recipients in an LDAP directory.
+//
+// The group members are resolved recursively (up to 5 levels of
+// nested groups) and the members without an email address are skipped.
+// Every lookup uses a new connection and the results are cached, the
+// expired ones and then the oldest ones being evicted when the cache is full.
+type LDAPResolver struct {
+	config   LDAPConfig
+	password string
+
+	mu    sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	addresses []mail.Address
+	expires   time.Time
+}
+
+// NewLDAPResolver creates a new LDAP recipient resolver from the provided config.
+func NewLDAPResolver(config LDAPConfig) (*LDAPResolver, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	password := config.BindPassword
+	if config.BindPasswordFile != "" {
+		var err error
+		if password, err = readSecretFile(config.BindPasswordFile); err != nil {
+			return nil, fmt.Errorf("recipients: failed to read ldap bind_password_file: %w", err)
+		}
+	}
+
+	if config.UserFilter == "" {
+		config.UserFilter = defaultLDAPUserFilter
+	}
+	if config.GroupFilter == "" {
+		config.GroupFilter = defaultLDAPGroupFilter
+	}
+	if config.MailAttribute == "" {
+		config.MailAttribute = defaultLDAPMailAttribute
+	}
+	if config.NameAttribute == "" {
+		config.NameAttribute = defaultLDAPNameAttribute
+	}
+	if config.MemberAttribute == "" {
+		config.MemberAttribute = defaultLDAPMemberAttribute
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultLDAPCacheTTL
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultLDAPCacheSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultLDAPTimeout
+	}
+
+	return &LDAPResolver{
+		config:   config,
+		password: password,
+		cache:    map[string]ldapCacheEntry{},
+	}, nil
+}
+
+// Resolve implements [RecipientResolver] interface.
+func (r *LDAPResolver) Resolve(ctx context.Context, recipient string) ([]mail.Address, error) {
+	kind, name, _ := strings.Cut(recipient, ":")
+	kind = strings.ToLower(kind)
+
+	var filter string
+	switch kind {
+	case "user":
+		filter = r.config.UserFilter
+	case "group":
+		filter = r.config.GroupFilter
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownRecipient, recipient)
+	}
+
+	key := strings.ToLower(recipient)
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now(r.config.Clock).Before(entry.expires) {
+		return entry.addresses, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	addresses, err := r.lookup(ctx, strings.ReplaceAll(filter, "{name}", ldapEscape(name)), kind != "user")
+	if err != nil {
+		if errors.Is(err, ErrUnknownRecipient) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownRecipient, recipient)
+		}
+		return nil, err
+	}
+
+	if r.config.CacheTTL > 0 {
+		r.cacheAddresses(key, addresses)
+	}
+
+	return addresses, nil
+}
+
+// cacheAddresses caches the recipient addresses, evicting the expired
+// entries and then the oldest one when the cache is full.
+func (r *LDAPResolver) cacheAddresses(key string, addresses []mail.Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := now(r.config.Clock)
+
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= r.config.CacheSize {
+		oldest := ""
+		for other, entry := range r.cache {
+			if !current.Before(entry.expires) {
+				delete(r.cache, other)
+			} else if oldest == "" || entry.expires.Before(r.cache[oldest].expires) {
+				oldest = other
+			}
+		}
+
+		if len(r.cache) >= r.config.CacheSize {
+			delete(r.cache, oldest)
+		}
+	}
+
+	r.cache[key] = ldapCacheEntry{addresses: addresses, expires: current.Add(r.config.CacheTTL)}
+}
+
+func (r *LDAPResolver) lookup(ctx context.Context, filter string, group bool) ([]mail.Address, error) {
+	compiled, err := compileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	attributes := []string{r.config.MailAttribute, r.config.NameAttribute, r.config.MemberAttribute}
+
+	entries, err := conn.search(r.config.BaseDN, ldapScopeSubtree, compiled, attributes)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrUnknownRecipient
+	}
+
+	var addresses []mail.Address
+	seen := map[string]struct{}{}
+
+	if !group {
+		for _, entry := range entries {
+			r.appendAddress(&addresses, seen, entry)
+		}
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("ldap entry %q has no %s attribute", entries[0].dn, r.config.MailAttribute)
+		}
+
+		return addresses, nil
+	}
+
+	visited := map[string]struct{}{}
+	for _, entry := range entries {
+		if err := r.expandGroup(conn, entry, visited, seen, &addresses, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return addresses, nil
+}
+
+func (r *LDAPResolver) expandGroup(conn *ldapConn, group ldapEntry, visited, seen map[string]struct{}, addresses *[]mail.Address, depth int) error {
+	visited[strings.ToLower(group.dn)] = struct{}{}
+
+	if depth > maxLDAPGroupDepth {
+		return fmt.Errorf("ldap group %q exceeds the max nesting depth of %d", group.dn, maxLDAPGroupDepth)
+	}
+
+	attributes := []string{r.config.MailAttribute, r.config.NameAttribute, r.config.MemberAttribute}
+	present, _ := compileLDAPFilter("(objectClass=*)")
+
+	for _, dn := range group.attr(r.config.MemberAttribute) {
+		if _, ok := visited[strings.ToLower(dn)]; ok {
+			continue
+		}
+		visited[strings.ToLower(dn)] = struct{}{}
+
+		members, err := conn.search(dn, ldapScopeBase, present, attributes)
+		if err != nil {
+			var ldapErr *ldapResultError
+			if errors.As(err, &ldapErr) && ldapErr.code == ldapResultNoSuchObject {
+				continue // stale member reference
+			}
+			return err
+		}
+
+		for _, member := range members {
+			if r.appendAddress(addresses, seen, member) {
+				continue
+			}
+			if len(member.attr(r.config.MemberAttribute)) > 0 {
+				if err := r.expandGroup(conn, member, visited, seen, addresses, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// appendAddress appends the entry address (if any) and reports whether the entry has one.
+func (r *LDAPResolver) appendAddress(addresses *[]mail.Address, seen map[string]struct{}, entry ldapEntry) bool {
+	values := entry.attr(r.config.MailAttribute)
+	if len(values) == 0 {
+		return false
+	}
+
+	addr := mail.Address{Address: values[0]}
+	if names := entry.attr(r.config.NameAttribute); len(names) > 0 {
+		addr.Name = names[0]
+	}
+
+	if _, ok := seen[strings.ToLower(addr.Address)]; !ok {
+		seen[strings.ToLower(addr.Address)] = struct{}{}
+		*addresses = append(*addresses, addr)
+	}
+
+	return true
+}
+
+func (r *LDAPResolver) dial(ctx context.Context) (*ldapConn, error) {
+	u, err := url.Parse(r.config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "ldaps" {
+			address = net.JoinHostPort(u.Hostname(), "636")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "389")
+		}
+	}
+
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+
+	tlsConfig := &tls.Config{ServerName: u.Hostname()}
+	if r.config.TLSConfig != nil {
+		tlsConfig = r.config.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+	}
+
+	if u.Scheme == "ldaps" {
+		netConn = tls.Client(netConn, tlsConfig)
+	}
+
+	conn := newLDAPConn(netConn)
+
+	if r.config.StartTLS {
+		if err := conn.startTLS(tlsConfig); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+
+	if r.config.BindDN != "" {
+		if err := conn.bind(r.config.BindDN, r.password); err != nil {
+			conn.close()
+			return nil, redactError(err, r.password)
+		}
+	}
+
+	return conn, nil
+}
+
+// -------------------------------------------------------------------
+// LDAPv3 protocol (RFC 4511)
+// -------------------------------------------------------------------
+
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+)
+
+const (
+	ldapTagBindRequest      = 0x60
+	ldapTagBindResponse     = 0x61
+	ldapTagUnbindRequest    = 0x42
+	ldapTagSearchRequest    = 0x63
+	ldapTagSearchEntry      = 0x64
+	ldapTagSearchDone       = 0x65
+	ldapTagSearchReference  = 0x73
+	ldapTagExtendedRequest  = 0x77
+	ldapTagExtendedResponse = 0x78
+	ldapTagSimpleAuth       = 0x80
+	ldapTagExtendedName     = 0x80
+
+	ldapStartTLSOID        = "1.3.6.1.4.1.1466.20037"
+	ldapScopeBase          = 0
+	ldapScopeSubtree       = 2
+	ldapResultNoSuchObject = 32
+	maxLDAPMessageLength   = 16 << 20
+)
+
+const (
+	ldapFilterAnd            = 0xa0
+	ldapFilterOr             = 0xa1
+	ldapFilterNot            = 0xa2
+	ldapFilterEquality       = 0xa3
+	ldapFilterSubstrings     = 0xa4
+	ldapFilterGreaterOrEqual = 0xa5
+	ldapFilterLessOrEqual    = 0xa6
+	ldapFilterPresent        = 0x87
+	ldapFilterApprox         = 0xa8
+)
+
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string // lowercased attribute names
+}
+
+func (e ldapEntry) attr(name string) []string {
+	return e.attributes[strings.ToLower(name)]
+}
+
+type ldapResultError struct {
+	op      string
+	code    int
+	message string
+}
+
+func (e *ldapResultError) Error() string {
+	return fmt.Sprintf("ldap %s failed with result code %d: %s", e.op, e.code, e.message)
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int
+}
+
+func newLDAPConn(conn net.Conn) *ldapConn {
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *ldapConn) close() {
+	_ = c.send(berAppend(nil, ldapTagUnbindRequest, nil))
+	_ = c.conn.Close()
+}
+
+func (c *ldapConn) startTLS(config *tls.Config) error {
+	if err := c.send(berAppend(nil, ldapTagExtendedRequest, berAppend(nil, ldapTagExtendedName, []byte(ldapStartTLSOID)))); err != nil {
+		return err
+	}
+
+	if err := c.result("starttls", ldapTagExtendedResponse); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+
+	return nil
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	request := berInteger(berTagInteger, 3)
+	request = berAppend(request, berTagOctetString, []byte(dn))
+	request = berAppend(request, ldapTagSimpleAuth, []byte(password))
+
+	if err := c.send(berAppend(nil, ldapTagBindRequest, request)); err != nil {
+		return err
+	}
+
+	return c.result("bind", ldapTagBindResponse)
+}
+
+func (c *ldapConn) search(base string, scope int, filter []byte, attributes []string) ([]ldapEntry, error) {
+	var attrs []byte
+	for _, attr := range attributes {
+		attrs = berAppend(attrs, berTagOctetString, []byte(attr))
+	}
+
+	request := berAppend(nil, berTagOctetString, []byte(base))
+	request = append(request, berInteger(berTagEnumerated, scope)...)
+	request = append(request, berInteger(berTagEnumerated, 0)...) // neverDerefAliases
+	request = append(request, berInteger(berTagInteger, 0)...)    // no size limit
+	request = append(request, berInteger(berTagInteger, 0)...)    // no time limit
+	request = berAppend(request, berTagBoolean, []byte{0})        // attribute values too, not only their types
+	request = append(request, filter...)
+	request = berAppend(request, berTagSequence, attrs)
+
+	if err := c.send(berAppend(nil, ldapTagSearchRequest, request)); err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case ldapTagSearchEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapTagSearchReference:
+			// referrals are not followed
+		case ldapTagSearchDone:
+			if err := parseLDAPResult("search", op); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("ldap: unexpected search response 0x%02x", tag)
+		}
+	}
+}
+
+// send writes a new LDAPMessage with the provided protocol operation.
+func (c *ldapConn) send(op []byte) error {
+	c.messageID++
+
+	message := append(berInteger(berTagInteger, c.messageID), op...)
+	_, err := c.conn.Write(berAppend(nil, berTagSequence, message))
+
+	return err
+}
+
+// receive reads the next LDAPMessage of the last sent request
+// and returns its protocol operation tag and content.
+func (c *ldapConn) receive() (byte, []byte, error) {
+	message, err := berRead(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tag, id, rest, err := berNext(message)
+	if err != nil || tag != berTagInteger {
+		return 0, nil, errors.New("ldap: malformed response message id")
+	}
+	if n := berUint(id); n != c.messageID {
+		if n == 0 {
+			return 0, nil, errors.New("ldap: the server closed the connection")
+		}
+		return 0, nil, fmt.Errorf("ldap: unexpected response message id %d", n)
+	}
+
+	tag, op, _, err := berNext(rest)
+	if err != nil {
+		return 0, nil, fmt.Errorf("ldap: malformed response: %w", err)
+	}
+
+	return tag, op, nil
+}
+
+// result reads a single LDAPResult response with the expected tag.
+func (c *ldapConn) result(op string, expected byte) error {
+	tag, content, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != expected {
+		return fmt.Errorf("ldap: unexpected %s response 0x%02x", op, tag)
+	}
+
+	return parseLDAPResult(op, content)
+}
+
+func parseLDAPResult(op string, content []byte) error {
+	_, code, rest, err := berNext(content)
+	if err != nil {
+		return fmt.Errorf("ldap: malformed %s result: %w", op, err)
+	}
+	_, _, rest, err = berNext(rest) // matched DN
+	if err != nil {
+		return fmt.Errorf("ldap: malformed %s result: %w", op, err)
+	}
+	_, message, _, err := berNext(rest)
+	if err != nil {
+		return fmt.Errorf("ldap: malformed %s result: %w", op, err)
+	}
+
+	if n := berUint(code); n != 0 {
+		return &ldapResultError{op: op, code: n, message: string(message)}
+	}
+
+	return nil
+}
+
+func parseLDAPEntry(content []byte) (ldapEntry, error) {
+	entry := ldapEntry{attributes: map[string][]string{}}
+
+	_, dn, rest, err := berNext(content)
+	if err != nil {
+		return entry, fmt.Errorf("ldap: malformed search entry: %w", err)
+	}
+	entry.dn = string(dn)
+
+	_, attributes, _, err := berNext(rest)
+	if err != nil {
+		return entry, fmt.Errorf("ldap: malformed search entry: %w", err)
+	}
+
+	for len(attributes) > 0 {
+		var attribute []byte
+		if _, attribute, attributes, err = berNext(attributes); err != nil {
+			return entry, fmt.Errorf("ldap: malformed search entry attribute: %w", err)
+		}
+
+		_, name, values, err := berNext(attribute)
+		if err != nil {
+			return entry, fmt.Errorf("ldap: malformed search entry attribute: %w", err)
+		}
+		if _, values, _, err = berNext(values); err != nil {
+			return entry, fmt.Errorf("ldap: malformed search entry attribute: %w", err)
+		}
+
+		key := strings.ToLower(string(name))
+		for len(values) > 0 {
+			var value []byte
+			if _, value, values, err = berNext(values); err != nil {
+				return entry, fmt.Errorf("ldap: malformed search entry value: %w", err)
+			}
+			entry.attributes[key] = append(entry.attributes[key], string(value))
+		}
+	}
+
+	return entry, nil
+}
+
+// -------------------------------------------------------------------
+// BER encoding (only the subset used by LDAP)
+// -------------------------------------------------------------------
+
+// berAppend appends to dst a single tag-length-value element.
+func berAppend(dst []byte, tag byte, content []byte) []byte {
+	dst = append(dst, tag)
+
+	n := len(content)
+	switch {
+	case n < 0x80:
+		dst = append(dst, byte(n))
+	case n <= 0xff:
+		dst = append(dst, 0x81, byte(n))
+	case n <= 0xffff:
+		dst = append(dst, 0x82, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	return append(dst, content...)
+}
+
+// berInteger encodes a non-negative integer with the specified tag.
+func berInteger(tag byte, n int) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(n)}, content...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+
+	return berAppend(nil, tag, content)
+}
+
+func berUint(content []byte) int {
+	n := 0
+	for _, b := range content {
+		n = n<<8 | int(b)
+	}
+
+	return n
+}
+
+// berNext splits the first element of data.
+func berNext(data []byte) (tag byte, content []byte, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+
+	tag = data[0]
+	n, offset := int(data[1]), 2
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(data) < 2+size {
+			return 0, nil, nil, errors.New("invalid ber length")
+		}
+		n = berUint(data[2 : 2+size])
+		offset += size
+	}
+
+	if n > len(data)-offset {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+
+	return tag, data[offset : offset+n], data[offset+n:], nil
+}
+
+// berRead reads a single SEQUENCE element from r and returns its content.
+func berRead(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != berTagSequence {
+		return nil, fmt.Errorf("ldap: unexpected message tag 0x%02x", header[0])
+	}
+
+	n := int(header[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return nil, errors.New("ldap: invalid message length")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		n = berUint(buf)
+	}
+
+	if n > maxLDAPMessageLength {
+		return nil, fmt.Errorf("ldap: message exceeds %d octets", maxLDAPMessageLength)
+	}
+
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// -------------------------------------------------------------------
+// Search filters (RFC 4515)
+// -------------------------------------------------------------------
+
+// ldapEscape escapes the filter special characters of value.
+func ldapEscape(value string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\\' || c == '*' || c == '(' || c == ')' || c == 0 {
+			fmt.Fprintf(&sb, "\\%02x", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String()
+}
+
+// compileLDAPFilter encodes the filter string representation
+// (eg. "(&(objectClass=person)(uid=jdoe))") in its BER format.
+func compileLDAPFilter(filter string) ([]byte, error) {
+	result, rest, err := parseLDAPFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after the filter end", rest)
+	}
+
+	return result, nil
+}
+
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") || len(s) < 2 {
+		return nil, "", fmt.Errorf("expected a parenthesized filter, got %q", s)
+	}
+	s = s[1:]
+
+	switch s[0] {
+	case '&', '|':
+		tag := byte(ldapFilterAnd)
+		if s[0] == '|' {
+			tag = ldapFilterOr
+		}
+
+		var items []byte
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			item, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item...)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("unterminated filter list")
+		}
+
+		return berAppend(nil, tag, items), s[1:], nil
+	case '!':
+		item, rest, err := parseLDAPFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("unterminated not filter")
+		}
+
+		return berAppend(nil, ldapFilterNot, item), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("unterminated filter item")
+	}
+
+	item, err := parseLDAPFilterItem(s[:end])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return item, s[end+1:], nil
+}
+
+func parseLDAPFilterItem(s string) ([]byte, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid filter item %q", s)
+	}
+	attr, value := s[:i], s[i+1:]
+
+	tag := byte(ldapFilterEquality)
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = ldapFilterApprox
+	case '>':
+		tag = ldapFilterGreaterOrEqual
+	case '<':
+		tag = ldapFilterLessOrEqual
+	}
+	if tag != ldapFilterEquality {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" || strings.ContainsAny(attr, " ()") {
+		return nil, fmt.Errorf("invalid filter attribute in %q", s)
+	}
+
+	if tag == ldapFilterEquality && value == "*" {
+		return berAppend(nil, ldapFilterPresent, []byte(attr)), nil
+	}
+
+	if tag == ldapFilterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+
+		var substrings []byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := ldapUnescape(part)
+			if err != nil {
+				return nil, err
+			}
+
+			switch i {
+			case 0:
+				substrings = berAppend(substrings, 0x80, unescaped) // initial
+			case len(parts) - 1:
+				substrings = berAppend(substrings, 0x82, unescaped) // final
+			default:
+				substrings = berAppend(substrings, 0x81, unescaped) // any
+			}
+		}
+
+		content := berAppend(nil, berTagOctetString, []byte(attr))
+		return berAppend(nil, ldapFilterSubstrings, berAppend(content, berTagSequence, substrings)), nil
+	}
+
+	unescaped, err := ldapUnescape(value)
+	if err != nil {
+		return nil, err
+	}
+
+	content := berAppend(nil, berTagOctetString, []byte(attr))
+	return berAppend(nil, tag, berAppend(content, berTagOctetString, unescaped)), nil
+}
+
+func ldapUnescape(value string) ([]byte, error) {
+	result := make([]byte, 0, len(value))
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			result = append(result, value[i])
+			continue
+		}
+
+		if i+3 > len(value) {
+			return nil, fmt.Errorf("invalid filter escape in %q", value)
+		}
+		b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter escape in %q", value)
+		}
+		result = append(result, byte(b))
+		i += 2
+	}
+
+	return result, nil
+}
@@ -0,0 +1,320 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLDAPServer is a minimal LDAP server supporting
+// simple binds and the base/subtree searches.
+type testLDAPServer struct {
+	listener net.Listener
+	entries  []ldapEntry
+	password string
+	searches atomic.Int32
+}
+
+func newTestLDAPServer(t *testing.T, password string, entries ...ldapEntry) *testLDAPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testLDAPServer{listener: listener, entries: entries, password: password}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		message, err := berRead(r)
+		if err != nil {
+			return
+		}
+		_, id, rest, _ := berNext(message)
+		tag, op, _, _ := berNext(rest)
+
+		reply := func(tag byte, content []byte) {
+			_, _ = conn.Write(berAppend(nil, berTagSequence, append(berInteger(berTagInteger, berUint(id)), berAppend(nil, tag, content)...)))
+		}
+		result := func(code int) []byte {
+			content := berInteger(berTagEnumerated, code)
+			content = berAppend(content, berTagOctetString, nil)
+			return berAppend(content, berTagOctetString, nil)
+		}
+
+		switch tag {
+		case ldapTagBindRequest:
+			_, _, rest, _ := berNext(op)
+			_, _, rest, _ = berNext(rest)
+			_, password, _, _ := berNext(rest)
+			if string(password) != s.password {
+				reply(ldapTagBindResponse, result(49))
+			} else {
+				reply(ldapTagBindResponse, result(0))
+			}
+		case ldapTagSearchRequest:
+			s.searches.Add(1)
+
+			_, base, rest, _ := berNext(op)
+			_, scope, rest, _ := berNext(rest)
+			for i := 0; i < 4; i++ {
+				_, _, rest, _ = berNext(rest)
+			}
+
+			found := false
+			for _, entry := range s.entries {
+				var match bool
+				if berUint(scope) == ldapScopeBase {
+					match = strings.EqualFold(entry.dn, string(base))
+				} else {
+					match = strings.HasSuffix(strings.ToLower(entry.dn), strings.ToLower(string(base))) && testLDAPMatch(entry, rest)
+				}
+				if !match {
+					continue
+				}
+				found = true
+
+				var attributes []byte
+				for name, values := range entry.attributes {
+					var set []byte
+					for _, v := range values {
+						set = berAppend(set, berTagOctetString, []byte(v))
+					}
+					attribute := berAppend(nil, berTagOctetString, []byte(name))
+					attributes = berAppend(attributes, berTagSequence, berAppend(attribute, 0x31, set))
+				}
+				reply(ldapTagSearchEntry, berAppend(berAppend(nil, berTagOctetString, []byte(entry.dn)), berTagSequence, attributes))
+			}
+
+			if !found && berUint(scope) == ldapScopeBase {
+				reply(ldapTagSearchDone, result(ldapResultNoSuchObject))
+			} else {
+				reply(ldapTagSearchDone, result(0))
+			}
+		case ldapTagUnbindRequest:
+			return
+		}
+	}
+}
+
+// testLDAPMatch evaluates the and/or/not/equality/present BER filter.
+func testLDAPMatch(entry ldapEntry, filter []byte) bool {
+	tag, content, _, _ := berNext(filter)
+
+	switch tag {
+	case ldapFilterAnd, ldapFilterOr:
+		for len(content) > 0 {
+			_, _, rest, _ := berNext(content)
+			match := testLDAPMatch(entry, content[:len(content)-len(rest)])
+			if tag == ldapFilterAnd && !match {
+				return false
+			}
+			if tag == ldapFilterOr && match {
+				return true
+			}
+			content = rest
+		}
+		return tag == ldapFilterAnd
+	case ldapFilterNot:
+		return !testLDAPMatch(entry, content)
+	case ldapFilterPresent:
+		return len(entry.attr(string(content))) > 0
+	case ldapFilterEquality:
+		_, attr, rest, _ := berNext(content)
+		_, value, _, _ := berNext(rest)
+		for _, v := range entry.attr(string(attr)) {
+			if strings.EqualFold(v, string(value)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func testLDAPEntry(dn string, attributes map[string][]string) ldapEntry {
+	entry := ldapEntry{dn: dn, attributes: map[string][]string{}}
+	for k, v := range attributes {
+		entry.attributes[strings.ToLower(k)] = v
+	}
+
+	return entry
+}
+
+func TestLDAPResolver(t *testing.T) {
+	server := newTestLDAPServer(t, "secret",
+		testLDAPEntry("uid=jdoe,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "uid": {"jdoe"}, "mail": {"jdoe@example.com"}, "displayName": {"John Doe"},
+		}),
+		testLDAPEntry("uid=amy,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "uid": {"amy"}, "mail": {"amy@example.com"},
+		}),
+		testLDAPEntry("uid=nomail,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "uid": {"nomail"},
+		}),
+		testLDAPEntry("cn=ops,ou=groups,dc=example,dc=com", map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"ops"},
+			"member": {"uid=jdoe,ou=people,dc=example,dc=com", "uid=nomail,ou=people,dc=example,dc=com", "cn=dba,ou=groups,dc=example,dc=com", "uid=deleted,ou=people,dc=example,dc=com"},
+		}),
+		testLDAPEntry("cn=dba,ou=groups,dc=example,dc=com", map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"dba"},
+			"member": {"uid=amy,ou=people,dc=example,dc=com", "uid=jdoe,ou=people,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+		}),
+	)
+
+	resolver, err := NewLDAPResolver(LDAPConfig{
+		URL:          server.url(),
+		BindDN:       "cn=mailer,dc=example,dc=com",
+		BindPassword: "secret",
+		InsecureBind: true,
+		BaseDN:       "dc=example,dc=com",
+		Timeout:      time.Second,
+		CacheSize:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	addresses, err := resolver.Resolve(ctx, "user:jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0].String() != `"John Doe" <jdoe@example.com>` {
+		t.Fatalf("Expected John Doe address, got %v", addresses)
+	}
+
+	addresses, err = resolver.Resolve(ctx, "group:ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"jdoe@example.com", "amy@example.com"}
+	if list := addressesToStrings(addresses, false); !reflect.DeepEqual(list, expected) {
+		t.Fatalf("Expected the group members %v, got %v", expected, list)
+	}
+
+	// cached
+	searches := server.searches.Load()
+	if _, err := resolver.Resolve(ctx, "Group:OPS"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.searches.Load(); n != searches {
+		t.Fatalf("Expected the cached group members, got %d new searches", n-searches)
+	}
+
+	// the oldest entry is evicted when the cache is full
+	if _, err := resolver.Resolve(ctx, "user:amy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resolver.cache["user:jdoe"]; ok || len(resolver.cache) != 2 {
+		t.Fatalf("Expected the oldest entry to be evicted, got %v", resolver.cache)
+	}
+
+	if _, err := resolver.Resolve(ctx, "user:missing"); !errors.Is(err, ErrUnknownRecipient) {
+		t.Fatalf("Expected ErrUnknownRecipient, got %v", err)
+	}
+	if _, err := resolver.Resolve(ctx, "team:ops"); !errors.Is(err, ErrUnknownRecipient) {
+		t.Fatalf("Expected ErrUnknownRecipient for an unsupported kind, got %v", err)
+	}
+	if _, err := resolver.Resolve(ctx, "user:nomail"); err == nil || errors.Is(err, ErrUnknownRecipient) {
+		t.Fatalf("Expected a missing mail attribute error, got %v", err)
+	}
+
+	// the filter special characters are escaped
+	if _, err := resolver.Resolve(ctx, "user:*"); !errors.Is(err, ErrUnknownRecipient) {
+		t.Fatalf("Expected ErrUnknownRecipient for a wildcard name, got %v", err)
+	}
+}
+
+func TestLDAPResolverInvalidCredentials(t *testing.T) {
+	server := newTestLDAPServer(t, "secret")
+
+	resolver, err := NewLDAPResolver(LDAPConfig{
+		URL:          server.url(),
+		BindDN:       "cn=mailer,dc=example,dc=com",
+		BindPassword: "invalid",
+		InsecureBind: true,
+		BaseDN:       "dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = resolver.Resolve(context.Background(), "user:jdoe")
+
+	var ldapErr *ldapResultError
+	if !errors.As(err, &ldapErr) || ldapErr.code != 49 {
+		t.Fatalf("Expected invalid credentials error, got %v", err)
+	}
+}
+
+func TestCompileLDAPFilter(t *testing.T) {
+	scenarios := []struct {
+		filter   string
+		expected []byte
+	}{
+		{"(uid=jdoe)", []byte{0xa3, 0x0b, 0x04, 0x03, 'u', 'i', 'd', 0x04, 0x04, 'j', 'd', 'o', 'e'}},
+		{"(mail=*)", []byte{0x87, 0x04, 'm', 'a', 'i', 'l'}},
+		{"(cn=a\\2a)", []byte{0xa3, 0x08, 0x04, 0x02, 'c', 'n', 0x04, 0x02, 'a', '*'}},
+		{"(cn=a*b*)", []byte{0xa4, 0x0c, 0x04, 0x02, 'c', 'n', 0x30, 0x06, 0x80, 0x01, 'a', 0x81, 0x01, 'b'}},
+		{"(!(n>=5))", []byte{0xa2, 0x08, 0xa5, 0x06, 0x04, 0x01, 'n', 0x04, 0x01, '5'}},
+		{"(&(a=1)(|(b=2)))", []byte{0xa0, 0x12, 0xa3, 0x06, 0x04, 0x01, 'a', 0x04, 0x01, '1', 0xa1, 0x08, 0xa3, 0x06, 0x04, 0x01, 'b', 0x04, 0x01, '2'}},
+		{"uid=jdoe", nil},
+		{"(uid=jdoe", nil},
+		{"(&(uid=jdoe)", nil},
+		{"(=jdoe)", nil},
+		{"(uid=\\zz)", nil},
+		{"(uid=jdoe))", nil},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.filter, func(t *testing.T) {
+			result, err := compileLDAPFilter(s.filter)
+			if s.expected == nil {
+				if err == nil {
+					t.Fatalf("Expected an error, got %x", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, s.expected) {
+				t.Fatalf("Expected %x, got %x", s.expected, result)
+			}
+		})
+	}
+
+	if escaped := ldapEscape(`a*(b)\`); escaped != `a\2a\28b\29\5c` {
+		t.Fatalf("Unexpected escaped value %q", escaped)
+	}
+}
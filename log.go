@@ -0,0 +1,129 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	_ Mailer  = (*LogMailer)(nil)
+	_ Capable = (*LogMailer)(nil)
+)
+
+const defaultLogMaxBodyLength = 500
+
+// LogMailer implements [mailer.Mailer] interface and defines a mail
+// client that only logs the messages instead of delivering them.
+//
+// This client is intended for local development and CI.
+type LogMailer struct {
+	MaxBodyLength int `mapstructure:"max_body_length" json:"max_body_length,omitempty" bson:"max_body_length,omitempty"` // bodies are truncated after it, default to 500 characters, -1 disables the truncation
+
+	// Logger is the logger used to print the messages (default to slog.Default()).
+	Logger *slog.Logger `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Send implements `mailer.Mailer` interface.
+func (c LogMailer) Send(m *Message) error {
+	logger := c.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	maxLength := c.MaxBodyLength
+	if maxLength == 0 {
+		maxLength = defaultLogMaxBodyLength
+	}
+
+	attrs := []any{
+		slog.String("from", m.From.String()),
+		slog.String("to", joinAddresses(m.To)),
+		slog.String("subject", m.Subject),
+	}
+	if len(m.Cc) > 0 {
+		attrs = append(attrs, slog.String("cc", joinAddresses(m.Cc)))
+	}
+	if len(m.Bcc) > 0 {
+		attrs = append(attrs, slog.String("bcc", joinAddresses(m.Bcc)))
+	}
+
+	headers := m.tagHeaders()
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	if len(headers) > 0 {
+		headerAttrs := make([]any, 0, len(headers))
+		for _, kv := range sortedHeaders(headers) {
+			headerAttrs = append(headerAttrs, slog.String(kv[0], kv[1]))
+		}
+		attrs = append(attrs, slog.Group("headers", headerAttrs...))
+	}
+
+	if m.Preheader != "" {
+		attrs = append(attrs, slog.String("preheader", m.Preheader))
+	}
+	if m.Text != "" {
+		attrs = append(attrs, slog.String("text", truncateBody(m.Text, maxLength)))
+	}
+	if m.AMP != "" {
+		attrs = append(attrs, slog.String("amp", truncateBody(m.AMP, maxLength)))
+	}
+	if m.HTML != "" {
+		attrs = append(attrs, slog.String("html", truncateBody(m.HTML, maxLength)))
+	}
+
+	if len(m.Attachments) > 0 {
+		names := make([]string, 0, len(m.Attachments))
+		for name := range m.Attachments {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		attachments := make([]string, 0, len(names))
+		for _, name := range names {
+			size, err := readerSize(m.Attachments[name])
+			if err != nil {
+				return fmt.Errorf("failed to read attachment %q: %w", name, err)
+			}
+			attachments = append(attachments, fmt.Sprintf("%s (%d bytes)", name, size))
+		}
+		attrs = append(attrs, slog.String("attachments", strings.Join(attachments, ", ")))
+	}
+
+	logger.Log(context.Background(), slog.LevelInfo, "mail message", attrs...)
+
+	return nil
+}
+
+// Capabilities implements `mailer.Capable` interface.
+//
+// Only the attachment names and sizes are logged, not their content.
+func (c LogMailer) Capabilities() Capabilities {
+	return Capabilities{Tags: true}
+}
+
+// truncateBody truncates s to max characters (if max is positive).
+func truncateBody(s string, max int) string {
+	if max < 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	runes := []rune(s)
+
+	return string(runes[:max]) + fmt.Sprintf("... (%d more characters)", len(runes)-max)
+}
+
+// readerSize returns the size of the attachment reader, consuming
+// it only if it is not a sized one (see [Message.Clone]).
+func readerSize(r io.Reader) (int64, error) {
+	if sr, ok := r.(sizedReaderAt); ok {
+		return sr.Size(), nil
+	}
+
+	return io.Copy(io.Discard, r)
+}
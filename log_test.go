@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestLogMailerSend(t *testing.T) {
+	var buf bytes.Buffer
+
+	client := LogMailer{
+		MaxBodyLength: 10,
+		Logger:        slog.New(slog.NewTextHandler(&buf, nil)),
+	}
+
+	err := client.Send(&Message{
+		From:        mail.Address{Address: "sender@example.com"},
+		To:          []mail.Address{{Address: "to@example.com"}},
+		Subject:     "test",
+		Text:        "0123456789abcdef",
+		Headers:     map[string]string{"X-Custom": "custom"},
+		Attachments: map[string]io.Reader{"a.txt": strings.NewReader("attachment")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		"from=<sender@example.com>",
+		"to=to@example.com",
+		"subject=test",
+		"headers.X-Custom=custom",
+		`text="0123456789... (6 more characters)"`,
+		`attachments="a.txt (10 bytes)"`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the log output:\n%s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	_ Mailer  = (*MaildirMailer)(nil)
+	_ Capable = (*MaildirMailer)(nil)
+)
+
+// maildirCounter guarantees unique file names within the process.
+var maildirCounter atomic.Uint64
+
+// MaildirMailer implements [mailer.Mailer] interface and defines a mail
+// client that delivers the messages into a local Maildir directory
+// (eg. to be served by Dovecot or inspected by test harnesses).
+//
+// The tmp, new and cur subdirectories are created if missing.
+type MaildirMailer struct {
+	Path string `mapstructure:"path" json:"path,omitempty" bson:"path,omitempty"` // the Maildir root directory
+
+	// Clock is an optional time source used for the Date header
+	// and the unique file names (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Send implements `mailer.Mailer` interface.
+//
+// The message is written in "tmp" and then atomically moved in "new",
+// as the Maildir specification requires.
+func (c MaildirMailer) Send(m *Message) error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(c.Path, dir), 0o700); err != nil {
+			return err
+		}
+	}
+
+	renderer := Renderer{Clock: c.Clock}
+
+	raw, err := renderer.Render(m)
+	if err != nil {
+		return err
+	}
+
+	name := c.uniqueName()
+	tmp := filepath.Join(c.Path, "tmp", name)
+
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(c.Path, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Capabilities implements `mailer.Capable` interface.
+func (c MaildirMailer) Capabilities() Capabilities {
+	return renderedCapabilities
+}
+
+// Validate checks the Maildir configuration for common mistakes.
+func (c MaildirMailer) Validate() error {
+	if strings.TrimSpace(c.Path) == "" {
+		return errors.New("maildir: path is required")
+	}
+
+	return nil
+}
+
+// uniqueName returns a new Maildir unique file name in the
+// "{seconds}.M{microseconds}P{pid}Q{counter}.{hostname}" format.
+func (c MaildirMailer) uniqueName() string {
+	t := now(c.Clock)
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", t.Unix(), t.Nanosecond()/1000, os.Getpid(), maildirCounter.Add(1), host)
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirMailerSend(t *testing.T) {
+	client := MaildirMailer{Path: filepath.Join(t.TempDir(), "Maildir")}
+	if err := client.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := client.Send(&Message{
+			From:    mail.Address{Address: "sender@example.com"},
+			To:      []mail.Address{{Address: "to@example.com"}},
+			Subject: "test",
+			Text:    "text",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for dir, expected := range map[string]int{"tmp": 0, "new": 2, "cur": 0} {
+		entries, err := os.ReadDir(filepath.Join(client.Path, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != expected {
+			t.Fatalf("Expected %d files in %s, got %d", expected, dir, len(entries))
+		}
+
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(client.Path, dir, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "Subject: test") {
+				t.Fatalf("Unexpected message content:\n%s", data)
+			}
+		}
+	}
+}
@@ -18,8 +18,14 @@
 package mailer
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"mime"
 	"net/mail"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Message defines a generic email message struct.
@@ -33,24 +39,421 @@ type Message struct {
 	Text        string
 	Headers     map[string]string
 	Attachments map[string]io.Reader
+
+	// Preheader is the optional inbox preview text shown by most clients
+	// next to the subject. It is injected as hidden element at the start
+	// of the HTML body and as first paragraph of the text body.
+	Preheader string
+
+	// Charset is the optional charset of the message texts, one of
+	// [CharsetUTF8] (the default), [CharsetLatin1] or [CharsetASCII],
+	// for the legacy receivers that can't handle UTF-8.
+	//
+	// Sending texts that are not representable in the charset
+	// fails unless Transliterate is set.
+	Charset string
+
+	// Transliterate replaces the characters not representable in the
+	// message Charset with their ASCII approximations (eg. "é" with "e",
+	// "ж" with "zh") or "?" if there is none.
+	Transliterate bool
+
+	// Inline are the optional inline attachments (eg. images), referenced
+	// from the HTML body by their name as "cid:{name}".
+	Inline map[string]io.Reader
+
+	// Layout controls the nesting of the rendered MIME parts
+	// (default to [MIMELayoutDefault]).
+	Layout MIMELayout
+
+	// AMP is the optional AMP for Email (https://amp.dev/about/email) body,
+	// sent as "text/x-amp-html" alternative between the Text and HTML ones.
+	// The receivers without AMP support fall back to the HTML body, so it
+	// should always be set too.
+	AMP string
+
+	// Tags are free-form labels for downstream analytics.
+	// They are sent as a comma separated "X-Tags" header.
+	Tags []string
+
+	// Metadata holds arbitrary key-value pairs attached to the message.
+	// Each pair is sent as a "X-Metadata-{key}" header.
+	Metadata map[string]string
+
+	// Date is the optional message "Date" header value.
+	// If not set, the current time at the moment of rendering is used.
+	Date time.Time
+
+	// InReplyTo is the optional Message-ID of the message this one replies to.
+	// It is sent as "In-Reply-To" header (see also [Message.Thread]).
+	InReplyTo string
+
+	// References is the optional list of Message-IDs of the thread
+	// this message belongs to. It is sent as "References" header.
+	References []string
+
+	// Auto marks the message as automatically generated (eg. notifications),
+	// adding the "Auto-Submitted", "Precedence" and "X-Auto-Response-Suppress"
+	// headers that prevent vacation auto-replies and backscatter.
+	Auto bool
+
+	// Locale is the optional BCP 47 language tag of the message texts
+	// (eg. "de-AT"), sent as "Content-Language" header. It also selects
+	// the template variant of [MessageBuilder.Template].
+	Locale string
+
+	// ReturnPath is the optional envelope sender (SMTP "MAIL FROM"),
+	// ie. the address the bounces are sent to. Default to the From address.
+	ReturnPath string
+
+	// NullSender sends the message with the null envelope sender ("MAIL
+	// FROM:<>"), eg. the bounces and auto-replies (see [ParseMessage]),
+	// so that they are never bounced back. It takes precedence over ReturnPath.
+	NullSender bool
+
+	// Separate requests an individual copy per recipient, so that every
+	// one sees only their own address (see [FanOut]).
+	Separate bool
+
+	// HideRecipients sends the message to the To recipients as to the Bcc
+	// ones, ie. they are only part of the envelope and the To header is
+	// "undisclosed-recipients:;" (the Cc recipients stay visible).
+	HideRecipients bool
+
+	// Via is the optional name of the backend the message must be sent
+	// through (eg. "smtp" for the compliance mail that must go via the
+	// internal relay), instead of the active one (see [SwitchMailer]).
+	// The tenant messages can't select it (see [TenantMailer]).
+	Via string
+
+	// signers sign the rendered message (see [Signing]).
+	signers []Signer
+
+	// rendered keeps the bytes rendered by the backend (see [Message.captureRendered]).
+	rendered *renderCapture
+
+	// test marks the test messages (see [MessageBuilder.Test]).
+	test bool
+
+	// result collects the send result (see [SendWithResult]).
+	result *resultSink
+
+	// tenantID is the tenant the message is sent on behalf of, set only
+	// by the trusted [TenantMailer.For] mailers (never from the tags).
+	tenantID string
+
+	// bccHeader renders the hidden recipients as Bcc header, for the
+	// sendmail reading them from the message (see [SendMail.Args]).
+	bccHeader bool
+
+	// queueOptions are the options of the queued message (see [Plugin.Enqueue]).
+	queueOptions []QueueOption
+}
+
+// Clone returns a deep copy of the message.
+//
+// Attachments readers that implement io.ReaderAt and have a known
+// size (eg. *bytes.Reader, *strings.Reader, *io.SectionReader) and the
+// [GeneratedAttachment] ones are cloned into independent readers.
+// All other readers are shared between the original and the cloned message.
+func (m *Message) Clone() *Message {
+	clone := *m
+
+	if m.To != nil {
+		clone.To = append([]mail.Address(nil), m.To...)
+	}
+	if m.Cc != nil {
+		clone.Cc = append([]mail.Address(nil), m.Cc...)
+	}
+	if m.Bcc != nil {
+		clone.Bcc = append([]mail.Address(nil), m.Bcc...)
+	}
+	if m.Tags != nil {
+		clone.Tags = append([]string(nil), m.Tags...)
+	}
+	if m.References != nil {
+		clone.References = append([]string(nil), m.References...)
+	}
+	if m.signers != nil {
+		clone.signers = append([]Signer(nil), m.signers...)
+	}
+	if m.queueOptions != nil {
+		clone.queueOptions = append([]QueueOption(nil), m.queueOptions...)
+	}
+
+	if m.Headers != nil {
+		clone.Headers = make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			clone.Headers[k] = v
+		}
+	}
+
+	if m.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(m.Metadata))
+		for k, v := range m.Metadata {
+			clone.Metadata[k] = v
+		}
+	}
+
+	if m.Attachments != nil {
+		clone.Attachments = cloneAttachments(m.Attachments)
+	}
+	if m.Inline != nil {
+		clone.Inline = cloneAttachments(m.Inline)
+	}
+
+	return &clone
+}
+
+// bufferAttachments replaces in place all attachments readers that
+// cannot be cloned with in-memory ones, so that the message could be
+// rendered and sent multiple times.
+//
+// It is intended to be used only on already cloned messages.
+func (m *Message) bufferAttachments() error {
+	for _, attachments := range []map[string]io.Reader{m.Attachments, m.Inline} {
+		for name, r := range attachments {
+			if isCloneableReader(r) {
+				continue
+			}
+
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			attachments[name] = bytes.NewReader(data)
+		}
+	}
+
+	return nil
+}
+
+func cloneAttachments(attachments map[string]io.Reader) map[string]io.Reader {
+	result := make(map[string]io.Reader, len(attachments))
+	for name, r := range attachments {
+		result[name] = cloneReader(r)
+	}
+
+	return result
+}
+
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// cloneReader returns an independent reader for the sized io.ReaderAt
+// and the generated attachments readers, positioned at their start,
+// or r itself otherwise.
+func cloneReader(r io.Reader) io.Reader {
+	switch v := r.(type) {
+	case sizedReaderAt:
+		return io.NewSectionReader(v, 0, v.Size())
+	case *generatedAttachment:
+		return v.clone()
+	}
+
+	return r
+}
+
+// isCloneableReader reports whether cloneReader returns independent readers for r.
+func isCloneableReader(r io.Reader) bool {
+	switch r.(type) {
+	case sizedReaderAt, *generatedAttachment:
+		return true
+	}
+
+	return false
 }
 
 // Mailer defines a base mail client interface.
+//
+// All mailers and middlewares in this package are safe for concurrent use
+// and third-party implementations are expected to be so too, since the
+// plugin shares a single Mailer instance between all its consumers.
 type Mailer interface {
 	// Send sends an email with the provided Message.
+	//
+	// Implementations must not modify the provided message,
+	// working on a [Message.Clone] instead if needed.
 	Send(message *Message) error
 }
 
+// Pinger is implemented by the mailers that can verify
+// their backend connectivity and credentials without sending.
+type Pinger interface {
+	// Ping checks whether the mailer backend is reachable and usable.
+	Ping(ctx context.Context) error
+}
+
+// Verifier is implemented by the mailers that can verify, without
+// sending, that their backend accepts a recipient (eg. with a dry
+// SMTP RCPT command).
+type Verifier interface {
+	// Verify checks whether the mailer backend is reachable and usable
+	// and, if the recipient is not empty, whether it accepts the recipient.
+	Verify(ctx context.Context, recipient string) error
+}
+
+// formatAddress formats the address like [mail.Address.String], but
+// B-encodes the non-ASCII names with a backslash, which it Q-encodes
+// as they are, so that the parsers fail to read them back (the names
+// with the other specials are B-encoded already).
+func formatAddress(addr mail.Address) string {
+	s := addr.String()
+	if strings.HasPrefix(s, "=?utf-8?q?") && strings.Contains(addr.Name, `\`) {
+		return mime.BEncoding.Encode("utf-8", addr.Name) + " " + (&mail.Address{Address: addr.Address}).String()
+	}
+
+	return s
+}
+
 func addressesToStrings(addresses []mail.Address, withName bool) []string {
 	result := make([]string, len(addresses))
 
 	for i, addr := range addresses {
-		if withName && addr.Name != "" {
-			result[i] = addr.String()
-		} else {
+		switch {
+		case withName && addr.Name != "":
+			result[i] = formatAddress(addr)
+		case withName && strings.Contains(addr.Address, "@"):
+			// quotes the local part if needed (eg. "john doe"@example.com)
+			s := addr.String()
+			result[i] = s[1 : len(s)-1]
+		default:
 			result[i] = addr.Address
 		}
 	}
 
 	return result
 }
+
+// alternatives returns the non-empty message bodies as {content-type, body}
+// pairs, ordered from the simplest to the richest as required by the
+// multipart/alternative receivers (RFC 2046 section 5.1.4).
+func (m *Message) alternatives() [][2]string {
+	result := make([][2]string, 0, 3)
+
+	for _, body := range [][2]string{{"text/plain", m.Text}, {"text/x-amp-html", m.AMP}, {"text/html", m.HTML}} {
+		if body[1] != "" {
+			result = append(result, body)
+		}
+	}
+
+	return result
+}
+
+// tagHeaders returns the headers derived from the message Tags and Metadata.
+func (m *Message) tagHeaders() map[string]string {
+	result := make(map[string]string, len(m.Metadata)+1)
+
+	tags := make([]string, 0, len(m.Tags))
+	for _, tag := range m.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !isControlTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		result["X-Tags"] = strings.Join(tags, ", ")
+	}
+
+	keys := make([]string, 0, len(m.Metadata))
+	for k := range m.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := sanitizeHeaderName(k)
+		if name == "" {
+			continue
+		}
+		result["X-Metadata-"+name] = m.Metadata[k]
+	}
+
+	return result
+}
+
+// controlTagPrefixes mark the tags driving the delivery (eg. "lane:bulk"),
+// which are not sent to the recipients.
+var controlTagPrefixes = []string{tenantTagPrefix, laneTagPrefix, variantTagPrefix}
+
+// isControlTag reports whether the tag is a delivery control one.
+func isControlTag(tag string) bool {
+	for _, prefix := range controlTagPrefixes {
+		if len(tag) >= len(prefix) && strings.EqualFold(tag[:len(prefix)], prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// autoHeaders returns the headers marking the message as automatically generated
+// (RFC 3834), or nil if the message is not flagged as [Message.Auto].
+func (m *Message) autoHeaders() map[string]string {
+	if !m.Auto {
+		return nil
+	}
+
+	return map[string]string{
+		"Auto-Submitted":           "auto-generated",
+		"Precedence":               "bulk",
+		"X-Auto-Response-Suppress": "All",
+	}
+}
+
+// headerValue returns the message custom header value, ignoring the name case.
+func headerValue(m *Message, name string) string {
+	for k, v := range m.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// sanitizeHeaderName replaces all characters that are not allowed
+// in a header field name (RFC 5322 section 2.2) with a dash.
+func sanitizeHeaderName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 || r == ':' {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(name))
+}
+
+// envelopeSender returns the message envelope sender address.
+func envelopeSender(m *Message) string {
+	if m.NullSender {
+		return ""
+	}
+
+	if m.ReturnPath != "" {
+		return m.ReturnPath
+	}
+
+	return m.From.Address
+}
+
+// hiddenRecipients returns the recipients not disclosed in the message headers,
+// ie. the Bcc ones and the To ones of the messages with HideRecipients set.
+func (m *Message) hiddenRecipients() []mail.Address {
+	if !m.HideRecipients {
+		return m.Bcc
+	}
+
+	return append(append([]mail.Address(nil), m.To...), m.Bcc...)
+}
+
+// envelopeRecipients returns the addresses of all To, Cc and Bcc recipients.
+func envelopeRecipients(m *Message) []string {
+	result := make([]string, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+
+	result = append(result, addressesToStrings(m.To, false)...)
+	result = append(result, addressesToStrings(m.Cc, false)...)
+	result = append(result, addressesToStrings(m.Bcc, false)...)
+
+	return result
+}
@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessageTagHeaders(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		message  *Message
+		expected map[string]string
+	}{
+		{
+			"empty",
+			&Message{},
+			map[string]string{},
+		},
+		{
+			"tags only",
+			&Message{Tags: []string{"welcome", " ", " onboarding "}},
+			map[string]string{"X-Tags": "welcome, onboarding"},
+		},
+		{
+			"control tags",
+			&Message{Tags: []string{"tenant:acme", "Lane:bulk", "welcome", "variant:welcome_b"}},
+			map[string]string{"X-Tags": "welcome"},
+		},
+		{
+			"metadata only",
+			&Message{Metadata: map[string]string{"user_id": "42", "bad key:": "x", "": "skip"}},
+			map[string]string{"X-Metadata-user_id": "42", "X-Metadata-bad-key-": "x"},
+		},
+	}
+
+	for _, s := range scenarios {
+		headers := s.message.tagHeaders()
+
+		if len(headers) != len(s.expected) {
+			t.Fatalf("[%s] Expected %d headers, got %v", s.name, len(s.expected), headers)
+		}
+
+		for k, v := range s.expected {
+			if headers[k] != v {
+				t.Fatalf("[%s] Expected header %s to be %q, got %q", s.name, k, v, headers[k])
+			}
+		}
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	original := &Message{
+		To:          []mail.Address{{Address: "a@example.com"}},
+		Headers:     map[string]string{"X-Test": "1"},
+		Metadata:    map[string]string{"id": "1"},
+		Tags:        []string{"a"},
+		Attachments: map[string]io.Reader{"a.txt": strings.NewReader("test")},
+	}
+	original.queueOptions = append(make([]QueueOption, 0, 2), WithUrgent())
+
+	clone := original.Clone()
+	clone.queueOptions = append(clone.queueOptions, WithTimezone("Europe/Paris"))
+	if original.queueOptions[:2][1] != nil {
+		t.Fatal("Expected the clone queue options not to share the original ones")
+	}
+
+	clone.To[0].Address = "changed@example.com"
+	clone.Headers["X-Test"] = "changed"
+	clone.Metadata["id"] = "changed"
+	clone.Tags[0] = "changed"
+
+	if original.To[0].Address != "a@example.com" ||
+		original.Headers["X-Test"] != "1" ||
+		original.Metadata["id"] != "1" ||
+		original.Tags[0] != "a" {
+		t.Fatalf("Expected the original message to remain unchanged, got %+v", original)
+	}
+
+	cloneData, _ := io.ReadAll(clone.Attachments["a.txt"])
+	originalData, _ := io.ReadAll(original.Attachments["a.txt"])
+	if string(cloneData) != "test" || string(originalData) != "test" {
+		t.Fatalf("Expected independent attachments readers, got %q and %q", cloneData, originalData)
+	}
+}
@@ -0,0 +1,323 @@
+package mailertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rumorshub/mailer"
+)
+
+// MailerFactory creates a new mailer to test, along with a function
+// returning the messages it has delivered so far (in their order).
+//
+// The delivered messages of the backends without an envelope (eg. a Maildir)
+// may have only their Data set, in which case the envelope is not checked.
+type MailerFactory func(t *testing.T) (m mailer.Mailer, delivered func() []Message)
+
+// RunMailerTests runs the conformance test suite against the mailers
+// created by the factory (a new one for every subtest), verifying that
+// they deliver the messages as the package backends do.
+func RunMailerTests(t *testing.T, factory MailerFactory) {
+	scenarios := []struct {
+		name string
+		test func(t *testing.T, m mailer.Mailer, delivered func() []Message)
+	}{
+		{"defaults", testDefaults},
+		{"unchanged message", testUnchangedMessage},
+		{"bodies", testBodies},
+		{"attachments", testAttachments},
+		{"headers", testHeaders},
+		{"hidden recipients", testHiddenRecipients},
+		{"unicode", testUnicode},
+		{"failed attachment", testFailedAttachment},
+		{"concurrent sends", testConcurrentSends},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			m, delivered := factory(t)
+			s.test(t, m, delivered)
+		})
+	}
+}
+
+func newMessage() *mailer.Message {
+	return &mailer.Message{
+		From:    mail.Address{Name: "Sender", Address: "sender@example.com"},
+		To:      []mail.Address{{Name: "John Doe", Address: "john@example.com"}},
+		Subject: "Hello",
+		Text:    "Hello world",
+	}
+}
+
+// sendOne sends the message and returns it parsed back from the single delivered one.
+func sendOne(t *testing.T, m mailer.Mailer, delivered func() []Message, msg *mailer.Message) (Message, *mailer.Message) {
+	t.Helper()
+
+	if err := m.Send(msg); err != nil {
+		t.Fatalf("Unexpected send error %v", err)
+	}
+
+	messages := delivered()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 delivered message, got %d", len(messages))
+	}
+
+	parsed, err := mailer.ParseMessage(bytes.NewReader(messages[0].Data))
+	if err != nil {
+		t.Fatalf("Failed to parse the delivered message: %v\n%s", err, messages[0].Data)
+	}
+
+	return messages[0], parsed
+}
+
+// normalizeBody converts the body new lines to LF and trims the trailing ones.
+func normalizeBody(body string) string {
+	return strings.TrimRight(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+}
+
+func testDefaults(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.Cc = []mail.Address{{Address: "cc@example.com"}}
+	msg.Bcc = []mail.Address{{Address: "bcc@example.com"}}
+
+	raw, parsed := sendOne(t, m, delivered, msg)
+
+	header, err := mail.ReadMessage(bytes.NewReader(raw.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := header.Header.Date(); err != nil {
+		t.Fatalf("Expected a valid Date header, got %v", err)
+	}
+	for _, name := range []string{"Message-Id", "Mime-Version"} {
+		if header.Header.Get(name) == "" {
+			t.Fatalf("Expected a %s header:\n%s", name, raw.Data)
+		}
+	}
+	if header.Header.Get("Bcc") != "" || bytes.Contains(raw.Data, []byte("bcc@example.com")) {
+		t.Fatalf("Expected the Bcc recipient to not be in the message:\n%s", raw.Data)
+	}
+
+	if parsed.From != msg.From {
+		t.Fatalf("Expected From %v, got %v", msg.From, parsed.From)
+	}
+	if !reflect.DeepEqual(parsed.To, msg.To) || !reflect.DeepEqual(parsed.Cc, msg.Cc) {
+		t.Fatalf("Expected To %v and Cc %v, got %v and %v", msg.To, msg.Cc, parsed.To, parsed.Cc)
+	}
+	if parsed.Subject != msg.Subject || normalizeBody(parsed.Text) != msg.Text {
+		t.Fatalf("Expected subject %q and text %q, got %q and %q", msg.Subject, msg.Text, parsed.Subject, parsed.Text)
+	}
+
+	if raw.From == "" && raw.To == nil {
+		return // no envelope
+	}
+
+	expectedTo := []string{"john@example.com", "cc@example.com", "bcc@example.com"}
+	if raw.From != "sender@example.com" || !reflect.DeepEqual(raw.To, expectedTo) {
+		t.Fatalf("Expected the envelope from %s to %v, got from %s to %v", "sender@example.com", expectedTo, raw.From, raw.To)
+	}
+}
+
+func testHiddenRecipients(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.Bcc = []mail.Address{{Address: "bcc@example.com"}}
+	msg.Headers = map[string]string{"Bcc": "header@example.com"}
+	msg.HideRecipients = true
+
+	raw, parsed := sendOne(t, m, delivered, msg)
+
+	for _, address := range []string{"john@example.com", "bcc@example.com", "header@example.com"} {
+		if bytes.Contains(raw.Data, []byte(address)) {
+			t.Fatalf("Expected the %s recipient to not be in the message:\n%s", address, raw.Data)
+		}
+	}
+	if len(parsed.To) != 0 || len(parsed.Bcc) != 0 {
+		t.Fatalf("Expected no To and Bcc header recipients, got %v and %v", parsed.To, parsed.Bcc)
+	}
+
+	if raw.From == "" && raw.To == nil {
+		return // no envelope
+	}
+
+	expectedTo := []string{"john@example.com", "bcc@example.com"}
+	if !reflect.DeepEqual(raw.To, expectedTo) {
+		t.Fatalf("Expected the envelope recipients %v, got %v", expectedTo, raw.To)
+	}
+}
+
+func testUnchangedMessage(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.HTML = "<p>Hello world</p>"
+	msg.Headers = map[string]string{"X-Custom": "custom"}
+	msg.Tags = []string{"welcome"}
+
+	original := msg.Clone()
+
+	sendOne(t, m, delivered, msg)
+
+	if !reflect.DeepEqual(msg, original) {
+		t.Fatalf("Expected the message to be unchanged, got %+v", msg)
+	}
+}
+
+func testBodies(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.Text = "first line\n.\n.second line\n" + strings.Repeat("long line ", 100)
+	msg.HTML = "<p>Hello</p>\n<p>" + strings.Repeat("x", 2000) + "</p>"
+
+	_, parsed := sendOne(t, m, delivered, msg)
+
+	if normalizeBody(parsed.Text) != msg.Text {
+		t.Fatalf("Expected text\n%q\ngot\n%q", msg.Text, parsed.Text)
+	}
+	if normalizeBody(parsed.HTML) != msg.HTML {
+		t.Fatalf("Expected html\n%q\ngot\n%q", msg.HTML, parsed.HTML)
+	}
+}
+
+func testAttachments(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	binary := make([]byte, 5000)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+
+	msg := newMessage()
+	msg.HTML = `<p><img src="cid:logo.png"></p>`
+	msg.Attachments = map[string]io.Reader{
+		"report.pdf":  bytes.NewReader(binary),
+		"Смета 1.txt": strings.NewReader("unicode name"),
+	}
+	msg.Inline = map[string]io.Reader{"logo.png": bytes.NewReader(binary[:100])}
+
+	_, parsed := sendOne(t, m, delivered, msg)
+
+	expected := map[string][]byte{"report.pdf": binary, "Смета 1.txt": []byte("unicode name")}
+	if len(parsed.Attachments) != len(expected) {
+		t.Fatalf("Expected %d attachments, got %v", len(expected), parsed.Attachments)
+	}
+	for name, data := range expected {
+		if got := readAll(t, parsed.Attachments[name]); !bytes.Equal(got, data) {
+			t.Fatalf("Expected attachment %q with %d bytes, got %d", name, len(data), len(got))
+		}
+	}
+
+	if got := readAll(t, parsed.Inline["logo.png"]); !bytes.Equal(got, binary[:100]) {
+		t.Fatalf("Expected the inline logo.png with 100 bytes, got %d", len(got))
+	}
+}
+
+func readAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+
+	if r == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func testHeaders(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.Headers = map[string]string{"X-Custom": "custom value", "Reply-To": "support@example.com"}
+	msg.Tags = []string{"welcome", "onboarding"}
+	msg.Metadata = map[string]string{"User-Id": "123"} // canonical, as the header names
+	msg.InReplyTo = "<parent@example.com>"
+
+	_, parsed := sendOne(t, m, delivered, msg)
+
+	for name, value := range msg.Headers {
+		if parsed.Headers[name] != value {
+			t.Fatalf("Expected header %s %q, got %q", name, value, parsed.Headers[name])
+		}
+	}
+	if !reflect.DeepEqual(parsed.Tags, msg.Tags) || !reflect.DeepEqual(parsed.Metadata, msg.Metadata) {
+		t.Fatalf("Expected tags %v and metadata %v, got %v and %v", msg.Tags, msg.Metadata, parsed.Tags, parsed.Metadata)
+	}
+	if parsed.InReplyTo != msg.InReplyTo {
+		t.Fatalf("Expected In-Reply-To %q, got %q", msg.InReplyTo, parsed.InReplyTo)
+	}
+}
+
+func testUnicode(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.From.Name = "Jörg Müller"
+	msg.To[0].Name = "Иван Петров"
+	msg.Subject = "Здравей, свят 🎉 " + strings.Repeat("ünïcødé ", 10)
+	msg.Text = "日本語のテキスト\nЗдравей, свят 🎉"
+	msg.HTML = "<p>日本語のテキスト</p>"
+
+	_, parsed := sendOne(t, m, delivered, msg)
+
+	if parsed.From.Name != msg.From.Name || parsed.To[0].Name != msg.To[0].Name {
+		t.Fatalf("Expected the names %q and %q, got %q and %q", msg.From.Name, msg.To[0].Name, parsed.From.Name, parsed.To[0].Name)
+	}
+	if parsed.Subject != msg.Subject {
+		t.Fatalf("Expected subject %q, got %q", msg.Subject, parsed.Subject)
+	}
+	if normalizeBody(parsed.Text) != msg.Text || normalizeBody(parsed.HTML) != msg.HTML {
+		t.Fatalf("Expected the bodies %q and %q, got %q and %q", msg.Text, msg.HTML, parsed.Text, parsed.HTML)
+	}
+}
+
+var errAttachment = errors.New("attachment read failure")
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errAttachment
+}
+
+func testFailedAttachment(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	msg := newMessage()
+	msg.Attachments = map[string]io.Reader{"broken.bin": failingReader{}}
+
+	if err := m.Send(msg); err == nil {
+		t.Fatal("Expected the attachment read error to fail the send")
+	}
+
+	if messages := delivered(); len(messages) != 0 {
+		t.Fatalf("Expected no delivered messages, got %d", len(messages))
+	}
+}
+
+func testConcurrentSends(t *testing.T, m mailer.Mailer, delivered func() []Message) {
+	const sends = 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			msg := newMessage()
+			msg.Subject = fmt.Sprintf("Message %d", i)
+			if err := m.Send(msg); err != nil {
+				t.Errorf("Unexpected send error %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	subjects := map[string]bool{}
+	for _, d := range delivered() {
+		if parsed, err := mailer.ParseMessage(bytes.NewReader(d.Data)); err == nil {
+			subjects[parsed.Subject] = true
+		}
+	}
+	if len(subjects) != sends {
+		t.Fatalf("Expected %d distinct delivered messages, got %v", sends, subjects)
+	}
+}
@@ -0,0 +1,560 @@
+// Package mailertest provides utilities for testing the mailers: an
+// in-process SMTP server (instead of an external one, eg. MailHog) and
+// a conformance test suite for the Mailer implementations.
+package mailertest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a message received by the [Server].
+type Message struct {
+	From     string   // the MAIL FROM address
+	Params   []string // the MAIL FROM parameters (eg. "BODY=8BITMIME")
+	To       []string // the RCPT TO addresses
+	Data     []byte   // the raw message, without the dot-stuffing
+	Username string   // the authenticated user (if any)
+	TLS      bool     // whether the message was received over an encrypted connection
+}
+
+// Parse parses the raw message headers and body.
+func (m Message) Parse() (*mail.Message, error) {
+	return mail.ReadMessage(bytes.NewReader(m.Data))
+}
+
+// Server is a minimal SMTP server listening on a system-chosen port
+// on the loopback interface, capturing the received messages.
+//
+// The exported fields must be set before starting the server.
+type Server struct {
+	// Hostname is the server name used in the greeting (default to "localhost").
+	Hostname string
+
+	// Extensions are extra EHLO extensions to advertise (eg. "8BITMIME").
+	Extensions []string
+
+	// Replies overrides the default replies per command (eg. "RCPT": "550 5.1.1 No such user").
+	Replies map[string]string
+
+	// DataReply overrides the final reply to the received message data
+	// (default to "250 2.0.0 OK queued").
+	DataReply string
+
+	// Users are the accepted credentials by username (the token for XOAUTH2).
+	// Any credentials are accepted when nil.
+	Users map[string]string
+
+	// StartTLS advertises the STARTTLS extension, upgrading the connections
+	// with a generated self-signed certificate (see [Server.ClientTLSConfig]).
+	StartTLS bool
+
+	ln   net.Listener
+	cert *x509.Certificate
+	tls  *tls.Config
+	wg   sync.WaitGroup
+
+	mu          sync.Mutex
+	closed      bool
+	conns       map[net.Conn]struct{}
+	commands    []string
+	messages    []Message
+	connections int
+}
+
+// NewServer starts and returns a new server.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+
+	return s
+}
+
+// NewUnstartedServer returns a new server that is not started yet,
+// so that its settings can be changed before calling [Server.Start].
+func NewUnstartedServer() *Server {
+	return &Server{Hostname: "localhost"}
+}
+
+// Start starts the server. It panics if the server can't listen or
+// the TLS certificate can't be generated, similar to httptest.
+func (s *Server) Start() {
+	if s.ln != nil {
+		panic("mailertest: server already started")
+	}
+
+	if s.StartTLS {
+		if err := s.generateCertificate(); err != nil {
+			panic("mailertest: failed to generate a certificate: " + err.Error())
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mailertest: failed to listen: " + err.Error())
+	}
+
+	s.ln = ln
+	s.conns = map[net.Conn]struct{}{}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = struct{}{}
+			s.connections++
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+}
+
+// Close shuts down the server, closing its open connections.
+func (s *Server) Close() {
+	if s.ln == nil {
+		return
+	}
+
+	s.ln.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Addr returns the server "host:port" address.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Host returns the server IP address.
+func (s *Server) Host() string {
+	return s.ln.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the server port.
+func (s *Server) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Certificate returns the self-signed certificate of the server,
+// or nil if StartTLS is disabled.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// ClientTLSConfig returns a TLS config trusting the server certificate,
+// or nil if StartTLS is disabled.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	if s.cert == nil {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert)
+
+	return &tls.Config{RootCAs: pool, ServerName: s.Host()}
+}
+
+// Messages returns the received messages in the order of their receiving.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.messages...)
+}
+
+// Commands returns the received commands (eg. "EHLO", "MAIL") in their order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+// Connections returns the number of accepted connections.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections
+}
+
+// DropConnections closes the open connections without stopping the server,
+// as the servers do after their idle timeout.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Reset clears the received messages, commands and connections count.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = nil
+	s.commands = nil
+	s.connections = 0
+}
+
+// session is the state of a single connection.
+type session struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	username string
+	tls      bool
+	message  *Message // the current transaction
+}
+
+func (ss *session) reply(lines ...string) {
+	ss.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+func (ss *session) readLine() (string, error) {
+	line, err := ss.r.ReadString('\n')
+
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	ss := &session{conn: conn, r: bufio.NewReader(conn)}
+	ss.reply("220 " + s.Hostname + " ESMTP")
+
+	for {
+		line, err := ss.readLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			ss.reply("500 5.5.2 Syntax error")
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		arg := strings.TrimSpace(line[len(fields[0]):])
+
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		reply, ok := s.Replies[cmd]
+		s.mu.Unlock()
+
+		if ok {
+			ss.reply(reply)
+			continue
+		}
+
+		switch cmd {
+		case "HELO":
+			ss.message = nil
+			ss.reply("250 " + s.Hostname)
+		case "EHLO":
+			ss.message = nil
+			s.ehlo(ss)
+		case "STARTTLS":
+			if !s.StartTLS || ss.tls {
+				ss.reply("502 5.5.1 Command not implemented")
+				continue
+			}
+			ss.reply("220 2.0.0 Ready to start TLS")
+
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			*ss = session{conn: tlsConn, r: bufio.NewReader(tlsConn), tls: true}
+		case "AUTH":
+			if err := s.auth(ss, arg); err != nil {
+				return
+			}
+		case "MAIL":
+			address, params, ok := parsePath(arg, "FROM:")
+			if !ok {
+				ss.reply("501 5.5.4 Syntax error in MAIL command")
+				continue
+			}
+			ss.message = &Message{From: address, Params: params, Username: ss.username, TLS: ss.tls}
+			ss.reply("250 2.1.0 OK")
+		case "RCPT":
+			if ss.message == nil {
+				ss.reply("503 5.5.1 Bad sequence of commands")
+				continue
+			}
+			address, _, ok := parsePath(arg, "TO:")
+			if !ok {
+				ss.reply("501 5.5.4 Syntax error in RCPT command")
+				continue
+			}
+			ss.message.To = append(ss.message.To, address)
+			ss.reply("250 2.1.5 OK")
+		case "DATA":
+			if ss.message == nil || len(ss.message.To) == 0 {
+				ss.reply("503 5.5.1 Bad sequence of commands")
+				continue
+			}
+			ss.reply("354 Go ahead")
+
+			data, err := readData(ss.r)
+			if err != nil {
+				return
+			}
+			ss.message.Data = data
+
+			s.mu.Lock()
+			s.messages = append(s.messages, *ss.message)
+			s.mu.Unlock()
+
+			ss.message = nil
+			if s.DataReply != "" {
+				ss.reply(s.DataReply)
+			} else {
+				ss.reply("250 2.0.0 OK queued")
+			}
+		case "RSET":
+			ss.message = nil
+			ss.reply("250 2.0.0 OK")
+		case "NOOP":
+			ss.reply("250 2.0.0 OK")
+		case "QUIT":
+			ss.reply("221 2.0.0 Bye")
+			return
+		default:
+			ss.reply("502 5.5.2 Error")
+		}
+	}
+}
+
+func (s *Server) ehlo(ss *session) {
+	lines := []string{s.Hostname}
+	lines = append(lines, s.Extensions...)
+	if s.StartTLS && !ss.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	lines = append(lines, "AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+
+	for i := range lines {
+		if i < len(lines)-1 {
+			lines[i] = "250-" + lines[i]
+		} else {
+			lines[i] = "250 " + lines[i]
+		}
+	}
+
+	ss.reply(lines...)
+}
+
+// auth handles the AUTH exchange, returning an error only if the connection failed.
+func (s *Server) auth(ss *session, arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		ss.reply("501 5.5.4 Syntax error in AUTH command")
+		return nil
+	}
+
+	// challenge returns the initial response or reads the client response to a challenge
+	challenge := func(i int, prompt string) (string, error) {
+		if i < len(fields) {
+			return fields[i], nil
+		}
+
+		ss.reply("334 " + prompt)
+
+		return ss.readLine()
+	}
+
+	var username, password string
+
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		resp, err := challenge(1, "")
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(decodeBase64(resp), "\x00")
+		if len(parts) != 3 {
+			ss.reply("501 5.5.2 Invalid PLAIN response")
+			return nil
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		resp, err := challenge(1, base64.StdEncoding.EncodeToString([]byte("Username:")))
+		if err != nil {
+			return err
+		}
+		username = decodeBase64(resp)
+
+		resp, err = challenge(len(fields), base64.StdEncoding.EncodeToString([]byte("Password:")))
+		if err != nil {
+			return err
+		}
+		password = decodeBase64(resp)
+	case "CRAM-MD5":
+		nonce := fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), s.Hostname)
+		resp, err := challenge(len(fields), base64.StdEncoding.EncodeToString([]byte(nonce)))
+		if err != nil {
+			return err
+		}
+		var digest string
+		username, digest, _ = strings.Cut(decodeBase64(resp), " ")
+
+		// the password is not sent, so the expected one is set if the digest matches
+		mac := hmac.New(md5.New, []byte(s.Users[username]))
+		mac.Write([]byte(nonce))
+		if s.Users != nil && hex.EncodeToString(mac.Sum(nil)) == digest {
+			password = s.Users[username]
+		}
+	case "XOAUTH2":
+		resp, err := challenge(1, "")
+		if err != nil {
+			return err
+		}
+		for _, kv := range strings.Split(decodeBase64(resp), "\x01") {
+			if v, ok := strings.CutPrefix(kv, "user="); ok {
+				username = v
+			} else if v, ok := strings.CutPrefix(kv, "auth=Bearer "); ok {
+				password = v
+			}
+		}
+	default:
+		ss.reply("504 5.5.4 Unrecognized authentication type")
+		return nil
+	}
+
+	if expected, ok := s.Users[username]; s.Users != nil && (!ok || expected != password) {
+		ss.reply("535 5.7.8 Authentication credentials invalid")
+		return nil
+	}
+
+	ss.username = username
+	ss.reply("235 2.7.0 Authentication successful")
+
+	return nil
+}
+
+// generateCertificate generates the self-signed certificate used for STARTTLS.
+func (s *Server) generateCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: s.Hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{s.Hostname},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	s.cert = cert
+	s.tls = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}}
+
+	return nil
+}
+
+// parsePath parses a "FROM:<address> [params]" or "TO:<address> [params]" argument.
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+
+	fields := strings.Fields(arg[len(prefix):])
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "<") || !strings.HasSuffix(fields[0], ">") {
+		return "", nil, false
+	}
+
+	return fields[0][1 : len(fields[0])-1], fields[1:], true
+}
+
+// readData reads the DATA content up to the terminating "." line,
+// removing the dot-stuffing.
+func readData(r *bufio.Reader) ([]byte, error) {
+	var data bytes.Buffer
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading data: %w", err)
+		}
+
+		if line == ".\r\n" || line == ".\n" {
+			return data.Bytes(), nil
+		}
+
+		data.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+func decodeBase64(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+
+	return string(b)
+}
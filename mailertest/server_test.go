@@ -0,0 +1,158 @@
+package mailertest
+
+import (
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func send(t *testing.T, s *Server, startTLS bool, auth smtp.Auth, data string) error {
+	t.Helper()
+
+	client, err := smtp.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if startTLS {
+		if err := client.StartTLS(s.ClientTLSConfig()); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail("from@example.com"); err != nil {
+		return err
+	}
+	for _, rcpt := range []string{"to@example.com", "cc@example.com"} {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func TestServer(t *testing.T) {
+	data := "Subject: Hello\r\n\r\nfirst\r\n.\r\n..second\r\n"
+
+	scenarios := []struct {
+		name             string
+		startTLS         bool
+		auth             smtp.Auth
+		replies          map[string]string
+		expectError      bool
+		expectedUsername string
+	}{
+		{"anonymous", false, nil, nil, false, ""},
+		{"valid credentials", false, smtp.PlainAuth("", "test", "secret", "127.0.0.1"), nil, false, "test"},
+		{"invalid credentials", false, smtp.PlainAuth("", "test", "invalid", "127.0.0.1"), nil, true, ""},
+		{"STARTTLS", true, smtp.PlainAuth("", "test", "secret", "127.0.0.1"), nil, false, "test"},
+		{"rejected recipient", false, nil, map[string]string{"RCPT": "550 5.1.1 No such user"}, true, ""},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			server := NewUnstartedServer()
+			server.StartTLS = s.startTLS
+			server.Users = map[string]string{"test": "secret"}
+			server.Replies = s.replies
+			server.Start()
+			defer server.Close()
+
+			err := send(t, server, s.startTLS, s.auth, data)
+
+			hasErr := err != nil
+			if hasErr != s.expectError {
+				t.Fatalf("Expected hasErr %v, got %v (%v)", s.expectError, hasErr, err)
+			}
+
+			messages := server.Messages()
+			if hasErr {
+				if len(messages) != 0 {
+					t.Fatalf("Expected no messages, got %d", len(messages))
+				}
+				return
+			}
+
+			if len(messages) != 1 {
+				t.Fatalf("Expected 1 message, got %d", len(messages))
+			}
+
+			m := messages[0]
+			if m.From != "from@example.com" || !reflect.DeepEqual(m.To, []string{"to@example.com", "cc@example.com"}) {
+				t.Fatalf("Unexpected envelope %s %v", m.From, m.To)
+			}
+			if m.Username != s.expectedUsername || m.TLS != s.startTLS {
+				t.Fatalf("Expected user %q and TLS %v, got %q and %v", s.expectedUsername, s.startTLS, m.Username, m.TLS)
+			}
+			if string(m.Data) != data {
+				t.Fatalf("Expected the data without the dot-stuffing %q, got %q", data, m.Data)
+			}
+
+			parsed, err := m.Parse()
+			if err != nil || parsed.Header.Get("Subject") != "Hello" {
+				t.Fatalf("Expected the parsed Subject header, got %v (%v)", parsed, err)
+			}
+		})
+	}
+}
+
+func TestServerLoginAuth(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	client, err := smtp.Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Username: and Password: challenges
+	for _, line := range []string{"AUTH LOGIN", "dGVzdA==", "c2VjcmV0"} {
+		if err := client.Text.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if line == "c2VjcmV0" {
+			if _, _, err := client.Text.ReadResponse(235); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, _, err := client.Text.ReadResponse(334); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := client.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if commands := strings.Join(server.Commands(), ","); commands != "EHLO,AUTH,QUIT" {
+		t.Fatalf("Expected EHLO,AUTH,QUIT, got %s", commands)
+	}
+
+	server.Reset()
+	if len(server.Commands()) != 0 || server.Connections() != 0 {
+		t.Fatal("Expected the server records to be cleared")
+	}
+}
@@ -0,0 +1,491 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Configurer = MapConfig(nil)
+
+// MapConfig is a [Configurer] over the decoded config values (eg. a JSON
+// config file or a [ParseDSN] result), to set up the [Plugin] outside of
+// RoadRunner (eg. in the CLI).
+//
+// The values are decoded into the config structs by their "mapstructure"
+// tags with the same weak typing as the RoadRunner config plugin, eg.
+// the "30s" strings into durations and "a,b" strings into slices.
+type MapConfig map[string]any
+
+// Has implements [Configurer] interface.
+func (c MapConfig) Has(name string) bool {
+	_, ok := c.lookup(name)
+	return ok
+}
+
+// UnmarshalKey implements [Configurer] interface.
+func (c MapConfig) UnmarshalKey(name string, out any) error {
+	value, ok := c.lookup(name)
+	if !ok {
+		return nil
+	}
+
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("%s: expected a non-nil pointer, got %T", name, out)
+	}
+
+	return decodeConfigValue(name, value, v.Elem())
+}
+
+// lookup returns the value of the dot separated key (eg. "mailer.smtp").
+func (c MapConfig) lookup(name string) (any, bool) {
+	var value any = map[string]any(c)
+
+	for _, key := range strings.Split(name, ".") {
+		m, ok := configMap(value)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// configMap converts the map values to map[string]any (eg. the map[any]any of the YAML decoders).
+func configMap(value any) (map[string]any, bool) {
+	switch m := value.(type) {
+	case map[string]any:
+		return m, true
+	case MapConfig:
+		return m, true
+	case map[any]any:
+		result := make(map[string]any, len(m))
+		for k, v := range m {
+			result[fmt.Sprint(k)] = v
+		}
+		return result, true
+	}
+
+	return nil, false
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeConfigValue decodes the config value into out, weakly typed.
+func decodeConfigValue(name string, value any, out reflect.Value) error {
+	if value == nil {
+		return nil
+	}
+
+	if out.Type() == durationType {
+		switch v := value.(type) {
+		case string:
+			d, err := time.ParseDuration(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%s: invalid duration %q", name, v)
+			}
+			out.SetInt(int64(d))
+			return nil
+		case time.Duration:
+			out.SetInt(int64(v))
+			return nil
+		}
+	}
+
+	switch out.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(out.Type().Elem())
+		if err := decodeConfigValue(name, value, elem.Elem()); err != nil {
+			return err
+		}
+		out.Set(elem)
+	case reflect.Interface:
+		out.Set(reflect.ValueOf(value))
+	case reflect.Struct:
+		m, ok := configMap(value)
+		if !ok {
+			return fmt.Errorf("%s: expected a map, got %T", name, value)
+		}
+		return decodeConfigStruct(name, m, out)
+	case reflect.Map:
+		m, ok := configMap(value)
+		if !ok {
+			return fmt.Errorf("%s: expected a map, got %T", name, value)
+		}
+		if out.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%s: unsupported map key type %s", name, out.Type().Key())
+		}
+		result := reflect.MakeMapWithSize(out.Type(), len(m))
+		for k, v := range m {
+			elem := reflect.New(out.Type().Elem()).Elem()
+			if err := decodeConfigValue(name+"."+k, v, elem); err != nil {
+				return err
+			}
+			result.SetMapIndex(reflect.ValueOf(k).Convert(out.Type().Key()), elem)
+		}
+		out.Set(result)
+	case reflect.Slice:
+		items := reflect.ValueOf(value)
+		if s, ok := value.(string); ok {
+			items = reflect.ValueOf(strings.Split(s, ","))
+			if s == "" {
+				items = reflect.ValueOf([]string{})
+			}
+		} else if items.Kind() != reflect.Slice && items.Kind() != reflect.Array {
+			items = reflect.ValueOf([]any{value})
+		}
+		result := reflect.MakeSlice(out.Type(), items.Len(), items.Len())
+		for i := 0; i < items.Len(); i++ {
+			if err := decodeConfigValue(name+"["+strconv.Itoa(i)+"]", items.Index(i).Interface(), result.Index(i)); err != nil {
+				return err
+			}
+		}
+		out.Set(result)
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			out.SetString(v)
+		case bool, int, int64, float64, uint64:
+			out.SetString(fmt.Sprint(v))
+		default:
+			return fmt.Errorf("%s: expected a string, got %T", name, value)
+		}
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			out.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil && v != "" {
+				return fmt.Errorf("%s: invalid bool %q", name, v)
+			}
+			out.SetBool(b)
+		default:
+			return fmt.Errorf("%s: expected a bool, got %T", name, value)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := configNumber(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		out.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := configNumber(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: expected a positive number, got %v", name, value)
+		}
+		out.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		n, err := configNumber(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		out.SetFloat(n)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", name, out.Type())
+	}
+
+	return nil
+}
+
+// decodeConfigStruct decodes the map into the struct fields by their
+// "mapstructure" tags (or names), case-insensitive as viper keys are.
+func decodeConfigStruct(name string, m map[string]any, out reflect.Value) error {
+	t := out.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		key, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+
+		for k, v := range m {
+			if strings.EqualFold(k, key) {
+				if err := decodeConfigValue(name+"."+k, v, out.Field(i)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func configNumber(value any) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", v)
+		}
+		return n, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("expected a number, got %T", value)
+}
+
+// checkConfigSections rejects the unknown plugin config sections,
+// ie. the ones neither reserved nor named after a backend.
+func checkConfigSections(cfg Configurer) error {
+	if !cfg.Has(PluginName) {
+		return nil
+	}
+
+	var sections map[string]any
+	if err := cfg.UnmarshalKey(PluginName, &sections); err != nil {
+		return nil // not a map, reported by the sections themselves
+	}
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	known := Backends()
+	for name := range reservedBackendNames {
+		known = append(known, name)
+	}
+
+	var errs []error
+	for _, name := range names {
+		if _, ok := lookupBackend(strings.ToLower(name)); ok || reservedBackendNames[strings.ToLower(name)] {
+			continue
+		}
+		errs = append(errs, unknownConfigKeyError(PluginName, name, known))
+	}
+
+	return errors.Join(errs...)
+}
+
+// unmarshalConfig decodes the config section into out, rejecting its keys
+// unknown to out as typos (see checkConfigKeys).
+func unmarshalConfig(cfg Configurer, key string, out any) error {
+	if err := cfg.UnmarshalKey(key, out); err != nil {
+		return err
+	}
+
+	var raw map[string]any
+	if err := cfg.UnmarshalKey(key, &raw); err != nil {
+		return nil // not a map, eg. an empty block
+	}
+
+	return checkNestedConfigKeys(key, raw, reflect.TypeOf(out))
+}
+
+// checkTenantsConfigKeys rejects the keys of the tenants unknown to
+// [TenantConfig], but their backend blocks (checked by initBackend).
+func checkTenantsConfigKeys(cfg Configurer) error {
+	var tenants map[string]map[string]any
+	if err := cfg.UnmarshalKey(tenantsKey, &tenants); err != nil {
+		return nil // reported by the tenants decoding
+	}
+
+	ids := make([]string, 0, len(tenants))
+	for id := range tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var errs []error
+	for _, id := range ids {
+		settings := map[string]any{}
+		for k, v := range tenants[id] {
+			if _, ok := lookupBackend(strings.ToLower(k)); !ok {
+				settings[k] = v
+			}
+		}
+
+		errs = append(errs, checkConfigKeys(tenantsKey+"."+id, settings, reflect.TypeOf(TenantConfig{})))
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkConfigKeys returns an error for every key of the config map that
+// doesn't match any field of the t struct (or pointer to it) by their
+// "mapstructure" tags (or names), nested ones included, eg. the
+// "auth_metod" typo of the "mailer.smtp" section.
+func checkConfigKeys(section string, m map[string]any, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == durationType {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		field, ok := configField(t, k)
+		if !ok {
+			errs = append(errs, unknownConfigKeyError(section, k, configKeys(t)))
+			continue
+		}
+
+		if err := checkNestedConfigKeys(section+"."+k, m[k], field.Type); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkNestedConfigKeys checks the keys of the value of a t field.
+func checkNestedConfigKeys(section string, value any, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if m, ok := configMap(value); ok {
+			return checkConfigKeys(section, m, t)
+		}
+	case reflect.Map:
+		if m, ok := configMap(value); ok {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			var errs []error
+			for _, k := range keys {
+				errs = append(errs, checkNestedConfigKeys(section+"."+k, m[k], t.Elem()))
+			}
+			return errors.Join(errs...)
+		}
+	case reflect.Slice:
+		items := reflect.ValueOf(value)
+		if value != nil && (items.Kind() == reflect.Slice || items.Kind() == reflect.Array) {
+			var errs []error
+			for i := 0; i < items.Len(); i++ {
+				errs = append(errs, checkNestedConfigKeys(section+"["+strconv.Itoa(i)+"]", items.Index(i).Interface(), t.Elem()))
+			}
+			return errors.Join(errs...)
+		}
+	}
+
+	return nil
+}
+
+// configField returns the t struct field decoded from the key, case-insensitive.
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// configKeys returns the keys decoded into the fields of the t struct.
+func configKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		keys = append(keys, name)
+	}
+
+	return keys
+}
+
+// unknownConfigKeyError describes the unknown key of the config section,
+// suggesting the closest of the known keys (if any is close enough).
+func unknownConfigKeyError(section, key string, known []string) error {
+	best, bestDistance := "", 3 // up to 2 edits away
+	for _, k := range known {
+		if d := editDistance(strings.ToLower(key), k); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+
+	if best != "" {
+		return fmt.Errorf("%s: unknown key %q, did you mean %q?", section, key, best)
+	}
+
+	return fmt.Errorf("%s: unknown key %q", section, key)
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,184 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// mboxFromLineRegex matches the body lines that must be quoted (mboxrd format).
+var mboxFromLineRegex = regexp.MustCompile(`^>*From `)
+
+// MboxWriter writes messages in the mboxrd format.
+//
+// It is not safe for concurrent use.
+type MboxWriter struct {
+	w io.Writer
+
+	// Renderer is used to render the written messages.
+	Renderer Renderer
+}
+
+// NewMboxWriter creates a new mbox writer.
+func NewMboxWriter(w io.Writer) *MboxWriter {
+	return &MboxWriter{w: w}
+}
+
+// Write renders and appends a single message.
+func (w *MboxWriter) Write(m *Message) error {
+	raw, err := w.Renderer.Render(m)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteRaw(m.From.Address, messageDate(m, w.Renderer.Clock), raw)
+}
+
+// WriteRaw appends a single already rendered message.
+//
+// The message lines are converted to LF and the ones starting
+// with "From " (optionally prefixed with ">") are quoted with ">".
+func (w *MboxWriter) WriteRaw(from string, date time.Time, raw []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString("From " + from + " " + date.UTC().Format(time.ANSIC) + "\n")
+
+	for _, line := range bytes.Split(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")), []byte("\n")) {
+		if mboxFromLineRegex.Match(line) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// the messages are separated by an empty line
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+
+	_, err := w.w.Write(buf.Bytes())
+
+	return err
+}
+
+// MboxReader reads messages from a mboxrd (or mboxo) file.
+type MboxReader struct {
+	r       *bufio.Reader
+	started bool // whether the first separator line was read
+	pending bool // whether the separator line of the next message was read
+}
+
+// NewMboxReader creates a new mbox reader.
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r)}
+}
+
+// NextRaw returns the next raw message (with CRLF line endings)
+// or io.EOF when there are no more messages.
+func (r *MboxReader) NextRaw() ([]byte, error) {
+	var lines [][]byte
+
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if r.started {
+				// the separator line of the next message
+				r.pending = true
+				break
+			}
+			r.started = true
+		} else if r.started && (len(line) > 0 || err == nil) {
+			lines = append(lines, bytes.TrimRight(line, "\r\n"))
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if !r.started || (len(lines) == 0 && !r.pending) {
+		return nil, io.EOF
+	}
+	r.pending = false
+
+	// drop the empty line separating the messages
+	if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+		lines = lines[:n-1]
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if mboxFromLineRegex.Match(line) && line[0] == '>' {
+			line = line[1:]
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Next parses and returns the next message (see [ParseMessage])
+// or io.EOF when there are no more messages.
+func (r *MboxReader) Next() (*Message, error) {
+	raw, err := r.NextRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMessage(bytes.NewReader(raw))
+}
+
+// AppendMbox renders and appends the messages to the specified
+// mbox file, creating it if missing.
+func AppendMbox(path string, messages ...*Message) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := NewMboxWriter(f)
+	for _, m := range messages {
+		if err := w.Write(m); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// ReadMbox reads and parses all messages from the specified mbox file.
+func ReadMbox(path string) ([]*Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []*Message
+
+	r := NewMboxReader(f)
+	for {
+		m, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"io"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMboxRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sent.mbox")
+
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	messages := []*Message{
+		{
+			From:    mail.Address{Name: "Sender", Address: "sender@example.com"},
+			To:      []mail.Address{{Address: "to@example.com"}},
+			Subject: "Hello Wörld",
+			Text:    "first line\nFrom the start\n>From quoted\n",
+			HTML:    "<p>html</p>",
+			Date:    date,
+			Tags:    []string{"a", "b"},
+			Auto:    true,
+			Headers: map[string]string{"Message-ID": "<first@example.com>", "X-Custom": "custom"},
+		},
+		{
+			From:        mail.Address{Address: "sender@example.com"},
+			To:          []mail.Address{{Address: "to@example.com"}},
+			Cc:          []mail.Address{{Address: "cc@example.com"}},
+			Subject:     "second",
+			Text:        "text",
+			Date:        date,
+			Attachments: map[string]io.Reader{"a.txt": strings.NewReader("attachment")},
+		},
+	}
+
+	if err := AppendMbox(path, messages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendMbox(path, messages[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReadMbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(result))
+	}
+
+	first := result[0]
+	if first.From.String() != messages[0].From.String() || first.Subject != "Hello Wörld" {
+		t.Fatalf("Unexpected first message %+v", first)
+	}
+	if first.Text != "first line\r\nFrom the start\r\n>From quoted\r\n" {
+		t.Fatalf("Unexpected first message text %q", first.Text)
+	}
+	if first.HTML != "<p>html</p>" || !first.Date.Equal(date) || !first.Auto {
+		t.Fatalf("Unexpected first message %+v", first)
+	}
+	if strings.Join(first.Tags, ",") != "a,b" {
+		t.Fatalf("Unexpected first message tags %v", first.Tags)
+	}
+	if first.Headers["Message-Id"] != "<first@example.com>" || first.Headers["X-Custom"] != "custom" {
+		t.Fatalf("Unexpected first message headers %v", first.Headers)
+	}
+	if _, ok := first.Headers["Precedence"]; ok {
+		t.Fatalf("Expected the auto headers to be parsed into Message.Auto, got %v", first.Headers)
+	}
+
+	second := result[1]
+	if len(second.Cc) != 1 || second.Cc[0].Address != "cc@example.com" {
+		t.Fatalf("Unexpected second message Cc %v", second.Cc)
+	}
+	data, _ := io.ReadAll(second.Attachments["a.txt"])
+	if string(data) != "attachment" {
+		t.Fatalf("Expected attachment content %q, got %q", "attachment", data)
+	}
+}
@@ -0,0 +1,161 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+// JSONMessage is the JSON representation of a message submitted by
+// other services (eg. over a message bus), where the addresses are
+// strings (eg. "App <info@example.com>") and the attachments are
+// base64 encoded.
+type JSONMessage struct {
+	From        string            `json:"from,omitempty"` // default to the tenant or backend one
+	To          []string          `json:"to,omitempty"`
+	Cc          []string          `json:"cc,omitempty"`
+	Bcc         []string          `json:"bcc,omitempty"`
+	Subject     string            `json:"subject,omitempty"`
+	Preheader   string            `json:"preheader,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Text        string            `json:"text,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments map[string][]byte `json:"attachments,omitempty"`
+	Inline      map[string][]byte `json:"inline,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Locale      string            `json:"locale,omitempty"`
+	Date        time.Time         `json:"date,omitempty"`
+	InReplyTo   string            `json:"in_reply_to,omitempty"`
+	References  []string          `json:"references,omitempty"`
+	Auto        bool              `json:"auto,omitempty"`
+	Separate    bool              `json:"separate,omitempty"` // an individual copy per recipient
+
+	HideRecipients bool   `json:"hide_recipients,omitempty"` // the To recipients in the envelope only
+	Via            string `json:"via,omitempty"`             // the backend name, default to the active one (see [JSONMessage.CheckVia])
+
+	// Template is the optional name of the registry template rendered
+	// with TemplateData into the message subject and bodies.
+	Template     string          `json:"template,omitempty"`
+	TemplateData json.RawMessage `json:"template_data,omitempty"`
+}
+
+// DecodeJSONMessage decodes a [JSONMessage] (rejecting the unknown fields)
+// and builds the message with it (see [JSONMessage.Message]).
+func DecodeJSONMessage(data []byte, templates *Templates) (*Message, error) {
+	msg, err := decodeJSONMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Message(templates)
+}
+
+// ErrViaNotAllowed is returned for the JSON messages selecting a backend
+// their submitter is not allowed to send through (see [JSONMessage.CheckVia]).
+var ErrViaNotAllowed = errors.New("backend is not allowed")
+
+// CheckVia returns [ErrViaNotAllowed] if the message selects a backend
+// that is not one of the allowed ones, so that the untrusted submitters
+// can't send eg. through the internal relay. No backend is allowed by default.
+func (j JSONMessage) CheckVia(allowed []string) error {
+	if j.Via == "" || slices.Contains(allowed, j.Via) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrViaNotAllowed, j.Via)
+}
+
+func decodeJSONMessage(r io.Reader) (*JSONMessage, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	var msg JSONMessage
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, fmt.Errorf("invalid json message: %w", err)
+	}
+
+	return &msg, nil
+}
+
+// Message builds the message with the [MessageBuilder], so that all
+// values are validated the same way. The templates are required only
+// if the message has a Template.
+func (j JSONMessage) Message(templates *Templates) (*Message, error) {
+	b := NewMessage()
+
+	if j.From != "" {
+		b.From(j.From)
+	}
+	b.To(j.To...).Cc(j.Cc...).Bcc(j.Bcc...)
+	if j.Locale != "" {
+		b.Locale(j.Locale)
+	}
+	b.Subject(j.Subject).Preheader(j.Preheader).HTML(j.HTML).Text(j.Text)
+
+	if j.Template != "" {
+		if templates == nil {
+			return nil, errors.New("message templates are not configured")
+		}
+
+		var data any
+		if len(j.TemplateData) > 0 {
+			if err := json.Unmarshal(j.TemplateData, &data); err != nil {
+				return nil, fmt.Errorf("invalid template data: %w", err)
+			}
+		}
+		b.Template(templates, j.Template, data)
+	}
+
+	for _, name := range sortedKeys(j.Headers) {
+		b.Header(name, j.Headers[name])
+	}
+	for _, name := range sortedKeys(j.Attachments) {
+		b.Attach(name, bytes.NewReader(j.Attachments[name]))
+	}
+	for _, name := range sortedKeys(j.Inline) {
+		b.Embed(name, bytes.NewReader(j.Inline[name]))
+	}
+	b.Tag(j.Tags...)
+	for _, key := range sortedKeys(j.Metadata) {
+		b.Metadata(key, j.Metadata[key])
+	}
+
+	if !j.Date.IsZero() {
+		b.Date(j.Date)
+	}
+	if j.InReplyTo != "" {
+		b.InReplyTo(j.InReplyTo, j.References...)
+	}
+	if j.Auto {
+		b.Auto()
+	}
+	if j.Separate {
+		b.Separate()
+	}
+	if j.HideRecipients {
+		b.HideRecipients()
+	}
+	if j.Via != "" {
+		b.Via(j.Via)
+	}
+
+	return b.Build()
+}
+
+// sortedKeys returns the map keys sorted, so that the first
+// invalid value is always reported the same.
+func sortedKeys[V string | []byte](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
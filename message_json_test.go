@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"io"
+	"net/mail"
+	"testing"
+)
+
+func TestDecodeJSONMessage(t *testing.T) {
+	m, err := DecodeJSONMessage([]byte(`{
+		"from": "App <info@example.com>",
+		"to": ["John <john@example.com>"],
+		"bcc": ["audit@example.com"],
+		"subject": "Report",
+		"text": "See the attached report",
+		"headers": {"X-Campaign": "weekly"},
+		"attachments": {"report.txt": "aGVsbG8="},
+		"tags": ["report"],
+		"metadata": {"User-Id": "123"}
+	}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.From != (mail.Address{Name: "App", Address: "info@example.com"}) || m.To[0].Name != "John" || m.Bcc[0].Address != "audit@example.com" {
+		t.Fatalf("Unexpected addresses %v %v %v", m.From, m.To, m.Bcc)
+	}
+	if m.Headers["X-Campaign"] != "weekly" || m.Tags[0] != "report" || m.Metadata["User-Id"] != "123" {
+		t.Fatalf("Unexpected headers, tags or metadata %v %v %v", m.Headers, m.Tags, m.Metadata)
+	}
+	if data, _ := io.ReadAll(m.Attachments["report.txt"]); string(data) != "hello" {
+		t.Fatalf("Expected the decoded attachment, got %q", data)
+	}
+
+	scenarios := []struct {
+		name string
+		data string
+	}{
+		{"invalid json", `{"to": [`},
+		{"unknown field", `{"to": ["john@example.com"], "text": "hi", "body": "hi"}`},
+		{"invalid address", `{"to": ["john"], "text": "hi"}`},
+		{"no recipients", `{"text": "hi"}`},
+		{"no body", `{"to": ["john@example.com"]}`},
+		{"template without registry", `{"to": ["john@example.com"], "template": "welcome"}`},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if _, err := DecodeJSONMessage([]byte(s.data), nil); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageIDGenerator generates the Message-ID header value
+// (including the angle brackets) for the provided message.
+type MessageIDGenerator func(m *Message) string
+
+var messageIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// DefaultMessageID is the default [MessageIDGenerator].
+//
+// It generates an RFC 5322 compliant identifier in the format
+// "<{timestamp}.{random}@{domain}>", where the random part is read
+// from crypto/rand and the domain is the one of the sender address
+// (or the machine hostname if the sender is not set).
+func DefaultMessageID(m *Message) string {
+	return NewMessageID(messageIDDomain(m.From.Address))
+}
+
+// NewMessageID generates a new unique Message-ID for the specified domain.
+func NewMessageID(domain string) string {
+	return newMessageID(time.Now(), rand.Reader, domain)
+}
+
+func newMessageID(now time.Time, random io.Reader, domain string) string {
+	b := make([]byte, 15)
+	if _, err := io.ReadFull(random, b); err != nil {
+		// extremely unlikely, fallback to the math/rand generator
+		copy(b, PseudorandomString(len(b)))
+	}
+
+	return "<" + strconv.FormatInt(now.UnixNano(), 36) + "." +
+		strings.ToLower(messageIDEncoding.EncodeToString(b)) + "@" + domain + ">"
+}
+
+// messageIDDomain returns the Message-ID right part for the specified sender address.
+func messageIDDomain(address string) string {
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		if domain := address[i+1:]; isDotAtom(domain) {
+			return domain
+		}
+	}
+
+	if hostname, err := os.Hostname(); err == nil && isDotAtom(hostname) {
+		return hostname
+	}
+
+	return "localhost"
+}
+
+// isDotAtom reports whether s is a valid RFC 5322 dot-atom-text.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-/=?^_`{|}~.", c) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// messageIDHeader returns the message custom Message-ID header (if any).
+func messageIDHeader(m *Message) string {
+	return headerValue(m, "Message-ID")
+}
+
+// ensureMessageID returns the message Message-ID header, generating
+// and setting a default one if missing.
+//
+// It modifies the message, so it must be called only on a clone.
+func ensureMessageID(m *Message) string {
+	messageID := messageIDHeader(m)
+	if messageID == "" {
+		messageID = DefaultMessageID(m)
+		if m.Headers == nil {
+			m.Headers = map[string]string{}
+		}
+		m.Headers["Message-ID"] = messageID
+	}
+
+	return messageID
+}
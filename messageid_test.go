@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"net/mail"
+	"regexp"
+	"testing"
+)
+
+func TestDefaultMessageID(t *testing.T) {
+	format := regexp.MustCompile(`^<[0-9a-z]+\.[0-9a-z]{24}@example\.com>$`)
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := DefaultMessageID(&Message{From: mail.Address{Address: "info@example.com"}})
+
+		if !format.MatchString(id) {
+			t.Fatalf("Invalid Message-ID format %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicated Message-ID %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMessageIDDomain(t *testing.T) {
+	scenarios := []struct {
+		address  string
+		expected string
+	}{
+		{"info@example.com", "example.com"},
+		{"a@b@sub.example.com", "sub.example.com"},
+		{"info@[127.0.0.1]", ""},
+		{"info@invalid..com", ""},
+		{"", ""},
+	}
+
+	for _, s := range scenarios {
+		domain := messageIDDomain(s.address)
+
+		if s.expected != "" && domain != s.expected {
+			t.Fatalf("[%s] Expected %q, got %q", s.address, s.expected, domain)
+		}
+		if !isDotAtom(domain) {
+			t.Fatalf("[%s] Expected a valid dot-atom fallback domain, got %q", s.address, domain)
+		}
+	}
+}
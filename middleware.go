@@ -0,0 +1,26 @@
+package mailer
+
+var _ Mailer = (MailerFunc)(nil)
+
+// MailerFunc is an adapter to allow the use of ordinary functions as [Mailer].
+type MailerFunc func(m *Message) error
+
+// Send implements `mailer.Mailer` interface.
+func (f MailerFunc) Send(m *Message) error {
+	return f(m)
+}
+
+// Middleware wraps a Mailer with additional send pipeline behavior.
+type Middleware func(next Mailer) Mailer
+
+// Chain wraps the mailer with the provided middlewares.
+//
+// The first middleware is the outermost one, aka. it is
+// the first to receive the message on Send.
+func Chain(mailer Mailer, middlewares ...Middleware) Mailer {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		mailer = middlewares[i](mailer)
+	}
+
+	return mailer
+}
@@ -0,0 +1,162 @@
+package mailer
+
+import (
+	"io"
+	"sort"
+)
+
+// MIMELayout controls how the message bodies, inline and regular
+// attachments are nested in the rendered MIME tree.
+type MIMELayout string
+
+const (
+	// MIMELayoutDefault wraps all bodies with their inline attachments
+	// (the most widely supported structure):
+	//
+	//	mixed
+	//	├── related
+	//	│   ├── alternative (text, amp, html)
+	//	│   └── inline...
+	//	└── attachments...
+	MIMELayoutDefault MIMELayout = ""
+
+	// MIMELayoutRelatedHTML relates the inline attachments only to the HTML
+	// body, so that the clients showing the text body don't list them:
+	//
+	//	mixed
+	//	├── alternative
+	//	│   ├── text, amp
+	//	│   └── related
+	//	│       ├── html
+	//	│       └── inline...
+	//	└── attachments...
+	MIMELayoutRelatedHTML MIMELayout = "related_html"
+
+	// MIMELayoutMixed sends the inline attachments (still with Content-ID)
+	// next to the regular ones, for the legacy clients without
+	// multipart/related support:
+	//
+	//	mixed
+	//	├── alternative (text, amp, html)
+	//	├── inline...
+	//	└── attachments...
+	MIMELayoutMixed MIMELayout = "mixed"
+)
+
+// mimeNode is a node of the rendered MIME tree, either
+// a multipart container with children or a leaf part.
+type mimeNode struct {
+	multipart string // eg. "mixed", empty for the leaf parts
+	children  []*mimeNode
+
+	mediaType string // the leaf part media type (used as multipart/related root type)
+	leaf      func(w io.Writer, headers *headerList) error
+}
+
+// mimeTree returns the message MIME tree according to its [MIMELayout].
+//
+// Containers with a single child are collapsed into it.
+func (m *Message) mimeTree(encoding BodyEncoding) *mimeNode {
+	charset := m.charsetName()
+
+	var bodies []*mimeNode
+	var html *mimeNode
+	for _, alt := range m.alternatives() {
+		node := bodyNode(alt[0], encodeCharset(charset, alt[1]), charset, encoding)
+		if alt[0] == "text/html" {
+			html = node
+		}
+		bodies = append(bodies, node)
+	}
+
+	inline := attachmentNodes(m.Inline, true)
+	attachments := attachmentNodes(m.Attachments, false)
+
+	layout := m.Layout
+	if layout == MIMELayoutRelatedHTML && html == nil {
+		layout = MIMELayoutDefault
+	}
+
+	var body *mimeNode
+	switch layout {
+	case MIMELayoutRelatedHTML:
+		bodies[len(bodies)-1] = container("related", append([]*mimeNode{html}, inline...))
+		body = container("alternative", bodies)
+	case MIMELayoutMixed:
+		body = container("alternative", bodies)
+		attachments = append(inline, attachments...)
+	default:
+		body = container("alternative", bodies)
+		if body != nil && len(inline) > 0 {
+			body = container("related", append([]*mimeNode{body}, inline...))
+		} else if body == nil {
+			attachments = append(inline, attachments...)
+		}
+	}
+
+	if len(attachments) == 0 {
+		if body == nil {
+			return bodyNode("text/plain", "", charset, encoding)
+		}
+		return body
+	}
+
+	if body == nil {
+		return &mimeNode{multipart: "mixed", children: attachments}
+	}
+
+	return &mimeNode{multipart: "mixed", children: append([]*mimeNode{body}, attachments...)}
+}
+
+// container returns a multipart node with the specified children,
+// the single child itself or nil if there are no children.
+func container(multipart string, children []*mimeNode) *mimeNode {
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	default:
+		return &mimeNode{multipart: multipart, children: children, mediaType: "multipart/" + multipart}
+	}
+}
+
+// bodyNode returns a text body leaf with the body already encoded in the charset.
+func bodyNode(mediaType, body, charset string, encoding BodyEncoding) *mimeNode {
+	return &mimeNode{
+		mediaType: mediaType,
+		leaf: func(w io.Writer, headers *headerList) error {
+			transferEncoding := encoding.transferEncoding(body)
+
+			headers.set("Content-Type", mediaType+"; charset="+charset)
+			headers.set("Content-Transfer-Encoding", transferEncoding)
+			if err := headers.write(w); err != nil {
+				return err
+			}
+
+			return writeEncodedBody(w, transferEncoding, body)
+		},
+	}
+}
+
+// attachmentNodes returns the attachments leaves sorted by name.
+func attachmentNodes(attachments map[string]io.Reader, inline bool) []*mimeNode {
+	names := make([]string, 0, len(attachments))
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*mimeNode, len(names))
+	for i, name := range names {
+		name, r := name, attachments[name]
+		result[i] = &mimeNode{
+			mediaType: "application/octet-stream",
+			leaf: func(w io.Writer, headers *headerList) error {
+				return writeAttachment(w, headers, name, cloneReader(r), inline)
+			},
+		}
+	}
+
+	return result
+}
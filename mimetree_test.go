@@ -0,0 +1,117 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// mimeStructure returns a compact representation of the raw message MIME tree,
+// eg. "mixed(alternative(text/plain,text/html),application/pdf)".
+func mimeStructure(t *testing.T, raw []byte) string {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var walk func(contentType string, r io.Reader) string
+	walk = func(contentType string, r io.Reader) string {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return mediaType
+		}
+
+		var children []string
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			child := walk(p.Header.Get("Content-Type"), p)
+			if id := p.Header.Get("Content-ID"); id != "" {
+				child += id
+			}
+			children = append(children, child)
+		}
+
+		return strings.TrimPrefix(mediaType, "multipart/") + "(" + strings.Join(children, ",") + ")"
+	}
+
+	return walk(msg.Header.Get("Content-Type"), msg.Body)
+}
+
+func TestMIMELayout(t *testing.T) {
+	scenarios := []struct {
+		layout      MIMELayout
+		text        string
+		attachments bool
+		expected    string
+	}{
+		{
+			MIMELayoutDefault, "text", true,
+			"mixed(related(alternative(text/plain,text/html),image/png<logo.png>),application/pdf)",
+		},
+		{
+			MIMELayoutDefault, "", false,
+			"related(text/html,image/png<logo.png>)",
+		},
+		{
+			MIMELayoutRelatedHTML, "text", true,
+			"mixed(alternative(text/plain,related(text/html,image/png<logo.png>)),application/pdf)",
+		},
+		{
+			MIMELayoutRelatedHTML, "text", false,
+			"alternative(text/plain,related(text/html,image/png<logo.png>))",
+		},
+		{
+			MIMELayoutMixed, "text", true,
+			"mixed(alternative(text/plain,text/html),image/png<logo.png>,application/pdf)",
+		},
+	}
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+
+	for i, s := range scenarios {
+		m := &Message{
+			From:   mail.Address{Address: "sender@example.com"},
+			To:     []mail.Address{{Address: "to@example.com"}},
+			Text:   s.text,
+			HTML:   `<img src="cid:logo.png">`,
+			Inline: map[string]io.Reader{"logo.png": strings.NewReader(png)},
+			Layout: s.layout,
+		}
+		if s.attachments {
+			m.Attachments = map[string]io.Reader{"doc.pdf": strings.NewReader("%PDF-1.4")}
+		}
+
+		raw, err := newTestRenderer().Render(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v := mimeStructure(t, raw); v != s.expected {
+			t.Errorf("(%d) Expected %s, got %s", i, s.expected, v)
+		}
+
+		parsed, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := io.ReadAll(parsed.Inline["logo.png"]); string(data) != png {
+			t.Errorf("(%d) Expected the inline image to be parsed back, got %q", i, data)
+		}
+	}
+}
@@ -0,0 +1,703 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNATSTimeout      = 5 * time.Second
+	defaultNATSWorkers      = 1
+	defaultNATSMaxAttempts  = 3
+	defaultNATSRetryBackoff = time.Second
+
+	// natsMaxReconnectDelay caps the doubled delay between the reconnects.
+	natsMaxReconnectDelay = 30 * time.Second
+
+	// natsMaxPayload is the max size of the consumed messages.
+	natsMaxPayload = 64 << 20
+
+	// natsMaxDeferrals caps the number of the JetStream messages whose
+	// deferred redeliveries are tracked.
+	natsMaxDeferrals = 10000
+
+	// natsMaxPending is the max number of consumed messages waiting for a worker.
+	natsMaxPending = 1024
+
+	// natsProgressInterval is the interval of the in progress acks of the
+	// JetStream messages being delivered, within the default 30s ack wait.
+	natsProgressInterval = 10 * time.Second
+)
+
+// NATSConfig defines the NATS consumer settings.
+type NATSConfig struct {
+	Address  string `mapstructure:"address" json:"address,omitempty" bson:"address,omitempty"` // eg. 127.0.0.1:4222
+	Subject  string `mapstructure:"subject" json:"subject,omitempty" bson:"subject,omitempty"` // eg. "mail.send" or a JetStream consumer deliver subject
+	Queue    string `mapstructure:"queue" json:"queue,omitempty" bson:"queue,omitempty"`       // optional queue group, to share the messages between many workers
+	Username string `mapstructure:"username" json:"username,omitempty" bson:"username,omitempty"`
+	Password string `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"`
+	Token    string `mapstructure:"token" json:"token,omitempty" bson:"token,omitempty"`
+	TLS      bool   `mapstructure:"tls" json:"tls,omitempty" bson:"tls,omitempty"` // also enabled if required by the server
+
+	Workers      int           `mapstructure:"workers" json:"workers,omitempty" bson:"workers,omitempty"`                   // max concurrent deliveries, default to 1
+	MaxAttempts  int           `mapstructure:"max_attempts" json:"max_attempts,omitempty" bson:"max_attempts,omitempty"`    // max delivery attempts of the temporary failures, default to 3
+	RetryBackoff time.Duration `mapstructure:"retry_backoff" json:"retry_backoff,omitempty" bson:"retry_backoff,omitempty"` // the first retry delay, doubled on every attempt, default to 1s
+	Timeout      time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`                   // dial and handshake timeout, default to 5s
+	AllowedVia   []string      `mapstructure:"allowed_via" json:"allowed_via,omitempty" bson:"allowed_via,omitempty"`       // backends the messages may select with "via", none by default
+
+	// Templates is the optional registry of the consumed messages templates.
+	Templates *Templates `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when a consumed message could not
+	// be delivered (or decoded) and when the connection fails, with nil data.
+	OnError func(data []byte, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the NATS configuration for common mistakes.
+func (c NATSConfig) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		errs = append(errs, fmt.Errorf("nats: invalid address %q, expected host:port", c.Address))
+	}
+
+	if c.Subject == "" || strings.ContainsAny(c.Subject, " \t\r\n") {
+		errs = append(errs, fmt.Errorf("nats: invalid subject %q", c.Subject))
+	}
+
+	if strings.ContainsAny(c.Queue, " \t\r\n") {
+		errs = append(errs, fmt.Errorf("nats: invalid queue %q", c.Queue))
+	}
+
+	if c.Workers < 0 {
+		errs = append(errs, fmt.Errorf("nats: workers must be positive, got %d", c.Workers))
+	}
+
+	if c.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("nats: max_attempts must be positive, got %d", c.MaxAttempts))
+	}
+
+	if c.RetryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("nats: retry_backoff must be positive, got %s", c.RetryBackoff))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("nats: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c NATSConfig) Redacted() NATSConfig {
+	c.Password = redact(c.Password)
+	c.Token = redact(c.Token)
+	c.OnError = nil
+
+	return c
+}
+
+// NATSConsumer is a standalone worker that subscribes to a NATS subject
+// and delivers the consumed [JSONMessage] messages through a mailer.
+//
+// The temporary failures (see [IsTemporary]) are retried up to the
+// configured max attempts with an exponential backoff. When the messages
+// have a reply subject (eg. JetStream ones with explicit acks), they are
+// acked once delivered, nacked after a temporary failure (to be
+// redelivered later) and terminated after a permanent one.
+//
+// The JetStream messages are not retried in-process but nacked with the
+// backoff delay (or the deferred send one, see [RetryAt]), their attempts
+// being the server deliveries but the deferred and busy workers ones
+// (tracked in-process), and kept in progress while being delivered.
+// When all the workers are busy, up to 1024 messages wait for one and the
+// next JetStream ones are nacked (the other ones are dropped).
+//
+// The consumer reconnects after connection failures until it is stopped.
+type NATSConsumer struct {
+	mailer Mailer
+	config NATSConfig
+
+	mu      sync.Mutex // guards the conn and its writes
+	conn    net.Conn
+	started bool
+
+	cancel     context.CancelFunc
+	done       chan struct{}
+	deliveries sync.WaitGroup
+
+	deferralsMu sync.Mutex
+	deferrals   map[string]int // the JetStream messages redeliveries not counting as attempts, by their key
+}
+
+// NewNATSConsumer creates a new NATS consumer delivering through mailer.
+func NewNATSConsumer(mailer Mailer, config NATSConfig) *NATSConsumer {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultNATSTimeout
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultNATSWorkers
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultNATSMaxAttempts
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultNATSRetryBackoff
+	}
+
+	return &NATSConsumer{mailer: mailer, config: config}
+}
+
+// Start connects to the server and consumes the messages in the
+// background. It is no-op if the consumer is already started.
+func (c *NATSConsumer) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started {
+		return
+	}
+	c.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	go c.run(ctx)
+}
+
+// Stop unsubscribes, waits for the in-flight deliveries (up to the
+// ctx deadline) to ack them and closes the connection. The messages
+// that are not acked yet are redelivered by the server (eg. JetStream).
+func (c *NATSConsumer) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.started {
+		c.mu.Unlock()
+		return nil
+	}
+	c.cancel()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn != nil {
+		_ = c.write(conn, "UNSUB 1\r\n")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		c.deliveries.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.mu.Unlock()
+
+	if err == nil {
+		<-c.done
+	}
+
+	return err
+}
+
+// run consumes the messages, reconnecting with a backoff until ctx is canceled.
+func (c *NATSConsumer) run(ctx context.Context) {
+	defer close(c.done)
+
+	delay := time.Second
+	for {
+		connected, err := c.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = time.Second
+		}
+		c.onError(nil, fmt.Errorf("nats: %w", err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, natsMaxReconnectDelay)
+	}
+}
+
+// natsInfo is the relevant part of the server INFO.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+// consume connects, subscribes and dispatches the consumed messages
+// until the connection fails. It reports whether the subscription
+// was established.
+func (c *NATSConsumer) consume(ctx context.Context) (bool, error) {
+	dialer := net.Dialer{Timeout: c.config.Timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.config.Address)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(c.config.Timeout)); err != nil {
+		return false, err
+	}
+
+	r := bufio.NewReader(conn)
+
+	line, err := readNATSLine(r)
+	if err != nil {
+		return false, err
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if !strings.EqualFold(op, "INFO") {
+		return false, fmt.Errorf("unexpected server greeting %q", line)
+	}
+
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		return false, fmt.Errorf("invalid server info: %w", err)
+	}
+
+	if c.config.TLS || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(c.config.Address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return false, err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect, err := json.Marshal(map[string]any{
+		"verbose":    false,
+		"pedantic":   false,
+		"name":       PluginName,
+		"lang":       "go",
+		"version":    "1",
+		"protocol":   1,
+		"headers":    info.Headers,
+		"user":       c.config.Username,
+		"pass":       c.config.Password,
+		"auth_token": c.config.Token,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	subscribe := "SUB " + c.config.Subject + " 1\r\n"
+	if c.config.Queue != "" {
+		subscribe = "SUB " + c.config.Subject + " " + c.config.Queue + " 1\r\n"
+	}
+
+	// the subscription is established once the PING is answered
+	if _, err := io.WriteString(conn, "CONNECT "+string(connect)+"\r\nPING\r\n"+subscribe+"PING\r\n"); err != nil {
+		return false, err
+	}
+	for pongs := 0; pongs < 2; {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return false, err
+		}
+		switch op, args, _ := strings.Cut(line, " "); strings.ToUpper(op) {
+		case "PONG":
+			pongs++
+		case "-ERR":
+			return false, errors.New(strings.Trim(args, "'"))
+		}
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return false, err
+	}
+
+	// the workers stop with the connection, leaving the pending messages to be redelivered
+	connCtx, cancel := context.WithCancel(ctx)
+	pending := make(chan natsMessage, natsMaxPending)
+
+	// the stop cancels ctx under the lock, so that no worker is added while waiting for them
+	c.mu.Lock()
+	if ctx.Err() != nil { // stopped while connecting
+		c.mu.Unlock()
+		cancel()
+		return true, ctx.Err()
+	}
+	c.conn = conn
+	c.deliveries.Add(c.config.Workers)
+	c.mu.Unlock()
+
+	defer func() {
+		cancel()
+		c.deliveries.Wait()
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	for i := 0; i < c.config.Workers; i++ {
+		go func() {
+			defer c.deliveries.Done()
+
+			for {
+				select {
+				case <-connCtx.Done():
+					return
+				case msg := <-pending:
+					if connCtx.Err() != nil {
+						return // left to be redelivered
+					}
+					c.deliver(connCtx, conn, msg.reply, msg.data)
+				}
+			}
+		}()
+	}
+
+	// never blocked by the deliveries, so that the server pings are answered
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return true, err
+		}
+
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			if err := c.write(conn, "PONG\r\n"); err != nil {
+				return true, err
+			}
+		case "-ERR":
+			return true, errors.New(strings.Trim(args, "'"))
+		case "MSG", "HMSG":
+			reply, data, status, err := readNATSMessage(r, strings.ToUpper(op) == "HMSG", args)
+			if err != nil {
+				return true, err
+			}
+
+			if status != "" {
+				// JetStream flow control messages must be replied to, the heartbeats not
+				if reply != "" {
+					if err := c.publish(conn, reply, ""); err != nil {
+						return true, err
+					}
+				}
+				continue
+			}
+
+			if ctx.Err() != nil {
+				continue // stopping, left to be redelivered
+			}
+
+			select {
+			case pending <- natsMessage{reply: reply, data: data}:
+			default:
+				if err := c.reject(conn, reply, data); err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// natsMessage is a consumed message waiting for a worker.
+type natsMessage struct {
+	reply string
+	data  []byte
+}
+
+// reject nacks the message consumed while all the workers are
+// busy (to be redelivered later), or drops it if it can't be.
+func (c *NATSConsumer) reject(conn net.Conn, reply string, data []byte) error {
+	if _, ok := jetStreamDeliveries(reply); !ok {
+		c.onError(data, errors.New("nats: too many pending messages, dropped"))
+		return nil
+	}
+	c.addDeferral(reply)
+
+	return c.publish(conn, reply, natsNak(c.config.RetryBackoff))
+}
+
+// deliver sends the message data and acks the outcome to the reply subject (if any).
+func (c *NATSConsumer) deliver(ctx context.Context, conn net.Conn, reply string, data []byte) {
+	deliveries, jetStream := jetStreamDeliveries(reply)
+
+	var err error
+	if jetStream {
+		stop := c.inProgress(conn, reply)
+		err = c.send(ctx, data, 1)
+		stop()
+	} else {
+		err = c.send(ctx, data, c.config.MaxAttempts)
+	}
+
+	ack := "+ACK"
+	if err != nil {
+		ack = "+TERM"
+		if jetStream {
+			if delay, ok := c.retryDelay(err, c.attempts(reply, deliveries)); ok {
+				ack = natsNak(delay)
+				if isDeferred(err) {
+					c.addDeferral(reply)
+				}
+			}
+		} else if IsTemporary(err) || isDeferred(err) {
+			ack = "-NAK"
+		}
+		c.onError(data, err)
+	}
+
+	if jetStream && !strings.HasPrefix(ack, "-NAK") {
+		c.forget(reply)
+	}
+
+	if reply == "" {
+		return
+	}
+
+	if err := c.publish(conn, reply, ack); err != nil {
+		c.onError(data, fmt.Errorf("nats: failed to ack the message: %w", err))
+	}
+}
+
+// retryDelay returns the redelivery delay of the JetStream message failed
+// after the specified deliveries, or false if it should not be retried.
+func (c *NATSConsumer) retryDelay(err error, deliveries int) (time.Duration, bool) {
+	if at, ok := RetryAt(err); ok {
+		return max(time.Until(at), 0), true
+	}
+
+	if !IsTemporary(err) || deliveries >= c.config.MaxAttempts {
+		return 0, false
+	}
+
+	return c.config.RetryBackoff << (deliveries - 1), true
+}
+
+// attempts returns the delivery attempts of the JetStream message,
+// ie. its server deliveries but the deferred ones.
+func (c *NATSConsumer) attempts(reply string, deliveries int) int {
+	c.deferralsMu.Lock()
+	defer c.deferralsMu.Unlock()
+
+	return max(deliveries-c.deferrals[jetStreamKey(reply)], 1)
+}
+
+// addDeferral records the redelivery of the JetStream message as deferred,
+// so that it doesn't count as an attempt.
+func (c *NATSConsumer) addDeferral(reply string) {
+	c.deferralsMu.Lock()
+	defer c.deferralsMu.Unlock()
+
+	key := jetStreamKey(reply)
+	if _, ok := c.deferrals[key]; !ok && len(c.deferrals) >= natsMaxDeferrals {
+		for other := range c.deferrals {
+			delete(c.deferrals, other) // eg. of a message never redelivered
+			break
+		}
+	}
+
+	if c.deferrals == nil {
+		c.deferrals = map[string]int{}
+	}
+	c.deferrals[key]++
+}
+
+// forget stops tracking the deferred redeliveries of the JetStream message.
+func (c *NATSConsumer) forget(reply string) {
+	c.deferralsMu.Lock()
+	defer c.deferralsMu.Unlock()
+
+	delete(c.deferrals, jetStreamKey(reply))
+}
+
+// inProgress acks the JetStream message as in progress at regular
+// intervals until stopped, so that its ack wait is reset while it
+// is being delivered.
+func (c *NATSConsumer) inProgress(conn net.Conn, reply string) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(natsProgressInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = c.publish(conn, reply, "+WPI")
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// send sends the message data, retrying the temporary failures up to maxAttempts.
+func (c *NATSConsumer) send(ctx context.Context, data []byte, maxAttempts int) error {
+	for attempt := 1; ; attempt++ {
+		// decoded on every attempt, since the attachments readers are consumed
+		msg, err := decodeJSONMessage(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if err := msg.CheckVia(c.config.AllowedVia); err != nil {
+			return err
+		}
+		m, err := msg.Message(c.config.Templates)
+		if err != nil {
+			return err
+		}
+
+		err = c.mailer.Send(m)
+		if err == nil || !IsTemporary(err) || attempt >= maxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(c.config.RetryBackoff << (attempt - 1)):
+		}
+	}
+}
+
+func (c *NATSConsumer) publish(conn net.Conn, subject, payload string) error {
+	return c.write(conn, "PUB "+subject+" "+strconv.Itoa(len(payload))+"\r\n"+payload+"\r\n")
+}
+
+func (c *NATSConsumer) write(conn net.Conn, s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(c.config.Timeout)); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(conn, s)
+
+	return err
+}
+
+func (c *NATSConsumer) onError(data []byte, err error) {
+	if c.config.OnError != nil {
+		c.config.OnError(data, err)
+	}
+}
+
+// jetStreamDeliveries returns the number of deliveries of the JetStream
+// message from its ack reply subject, ie. "$JS.ACK.<stream>.<consumer>.
+// <deliveries>.<stream seq>.<consumer seq>.<timestamp>.<pending>" (with
+// the domain and account hash before the stream in the newer servers),
+// or false if it is not a JetStream one.
+func jetStreamDeliveries(reply string) (int, bool) {
+	tokens := strings.Split(reply, ".")
+	if len(tokens) < 9 || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return 0, false
+	}
+
+	index := 4
+	if len(tokens) >= 11 {
+		index = 6
+	}
+
+	deliveries, err := strconv.Atoi(tokens[index])
+	if err != nil || deliveries < 1 {
+		return 0, false
+	}
+
+	return deliveries, true
+}
+
+// jetStreamKey returns the key of the JetStream message of the ack reply
+// subject, ie. its stream, consumer and stream sequence, which are the
+// same for all its deliveries.
+func jetStreamKey(reply string) string {
+	tokens := strings.Split(reply, ".")
+
+	index := 4
+	if len(tokens) >= 11 {
+		index = 6
+	}
+
+	return strings.Join([]string{tokens[index-2], tokens[index-1], tokens[index+1]}, ".")
+}
+
+// natsNak returns the nack of a JetStream message redelivered after the delay.
+func natsNak(delay time.Duration) string {
+	return fmt.Sprintf(`-NAK {"delay": %d}`, delay.Nanoseconds())
+}
+
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readNATSMessage reads the payload of a MSG (or HMSG, with headers) with
+// the provided args, returning its reply subject, data and status (which
+// is set only for the JetStream control messages, eg. "100 Idle Heartbeat").
+func readNATSMessage(r *bufio.Reader, withHeaders bool, args string) (reply string, data []byte, status string, err error) {
+	fields := strings.Fields(args) // subject sid [reply] [header size] size
+
+	headerFields := 0
+	if withHeaders {
+		headerFields = 1
+	}
+	if len(fields) < 3+headerFields || len(fields) > 4+headerFields {
+		return "", nil, "", fmt.Errorf("invalid message %q", args)
+	}
+	if len(fields) == 4+headerFields {
+		reply = fields[2]
+	}
+
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 || size > natsMaxPayload {
+		return "", nil, "", fmt.Errorf("invalid message size %q", args)
+	}
+	headerSize := 0
+	if withHeaders {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize < 0 || headerSize > size {
+			return "", nil, "", fmt.Errorf("invalid message headers size %q", args)
+		}
+	}
+
+	data = make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, "", err
+	}
+
+	// eg. "NATS/1.0 100 Idle Heartbeat\r\n..."
+	headers, _, _ := strings.Cut(string(data[:headerSize]), "\r\n")
+	if _, status, _ = strings.Cut(headers, " "); status != "" {
+		return reply, nil, status, nil
+	}
+
+	return reply, data[headerSize:size], "", nil
+}
@@ -0,0 +1,236 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readNATSCommand reads a client command line, along with its payload for PUB.
+func readNATSCommand(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := readNATSLine(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fields := strings.Fields(line); fields[0] == "PUB" {
+		payload, err := readNATSLine(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fields[1] + " " + payload
+	}
+
+	return line
+}
+
+func TestNATSConsumer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var mu sync.Mutex
+	var subjects []string
+	attempts := map[string]int{}
+
+	consumer := NewNATSConsumer(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts[m.Subject]++
+		switch {
+		case m.Subject == "permanent":
+			return errors.New("rejected")
+		case m.Subject == "temporary" && attempts[m.Subject] == 1:
+			return &textproto.Error{Code: 451, Msg: "try again later"}
+		case m.Subject == "deferred js" && attempts[m.Subject] == 1:
+			return &ThrottleError{Domain: "example.com", RetryAt: time.Now().Add(-time.Minute)}
+		case m.Subject == "deferred js":
+			return &textproto.Error{Code: 451, Msg: "try again later"}
+		case strings.HasPrefix(m.Subject, "always temporary"):
+			return &textproto.Error{Code: 451, Msg: "try again later"}
+		}
+		subjects = append(subjects, m.Subject)
+
+		return nil
+	}), NATSConfig{Address: ln.Addr().String(), Subject: "mail.send", Queue: "workers", Token: "secret", MaxAttempts: 2, RetryBackoff: time.Millisecond})
+	consumer.Start()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "INFO {\"headers\":true}\r\n")
+
+	if cmd := readNATSCommand(t, r); !strings.HasPrefix(cmd, "CONNECT ") || !strings.Contains(cmd, `"auth_token":"secret"`) {
+		t.Fatalf("Expected CONNECT with the auth token, got %q", cmd)
+	}
+	for _, expected := range []string{"PING", "SUB mail.send workers 1", "PING"} {
+		if cmd := readNATSCommand(t, r); cmd != expected {
+			t.Fatalf("Expected %q, got %q", expected, cmd)
+		}
+		if expected == "PING" {
+			fmt.Fprint(conn, "PONG\r\n")
+		}
+	}
+
+	message := func(subject string) string {
+		return `{"from":"sender@example.com","to":["to@example.com"],"subject":"` + subject + `","text":"hello"}`
+	}
+	via := `{"to":["to@example.com"],"subject":"via","text":"hello","via":"smtp"}`
+	heartbeat := "NATS/1.0 100 Idle Heartbeat\r\n\r\n"
+	flowControl := "NATS/1.0 100 FlowControl Request\r\n\r\n"
+
+	scenarios := []struct {
+		name     string
+		frame    string
+		expected string // the published ack
+	}{
+		{"server ping", "PING\r\n", "PONG"},
+		{"delivered", fmt.Sprintf("MSG mail.send 1 ack.1 %d\r\n%s\r\n", len(message("delivered")), message("delivered")), "ack.1 +ACK"},
+		{"with headers", fmt.Sprintf("HMSG mail.send 1 ack.2 12 %d\r\nNATS/1.0\r\n\r\n%s\r\n", 12+len(message("headers")), message("headers")), "ack.2 +ACK"},
+		{"invalid json", "MSG mail.send 1 ack.3 7\r\n{\"to\":[\r\n", "ack.3 +TERM"},
+		{"unknown field", "MSG mail.send 1 ack.4 13\r\n{\"unknown\":1}\r\n", "ack.4 +TERM"},
+		{"backend not allowed", fmt.Sprintf("MSG mail.send 1 ack.8 %d\r\n%s\r\n", len(via), via), "ack.8 +TERM"},
+		{"permanent failure", fmt.Sprintf("MSG mail.send 1 ack.5 %d\r\n%s\r\n", len(message("permanent")), message("permanent")), "ack.5 +TERM"},
+		{"retried temporary failure", fmt.Sprintf("MSG mail.send 1 ack.6 %d\r\n%s\r\n", len(message("temporary")), message("temporary")), "ack.6 +ACK"},
+		{"temporary failure", fmt.Sprintf("MSG mail.send 1 ack.7 %d\r\n%s\r\n", len(message("always temporary")), message("always temporary")), "ack.7 -NAK"},
+		{"jetstream temporary failure", fmt.Sprintf("MSG mail.send 1 $JS.ACK.MAIL.workers.1.10.10.1700000000000000000.0 %d\r\n%s\r\n", len(message("always temporary js")), message("always temporary js")), `$JS.ACK.MAIL.workers.1.10.10.1700000000000000000.0 -NAK {"delay": 1000000}`},
+		{"jetstream last attempt", fmt.Sprintf("MSG mail.send 1 $JS.ACK.hub.ACC.MAIL.workers.2.10.11.1700000000000000000.0.x %d\r\n%s\r\n", len(message("always temporary js")), message("always temporary js")), "$JS.ACK.hub.ACC.MAIL.workers.2.10.11.1700000000000000000.0.x +TERM"},
+		{"jetstream deferred", fmt.Sprintf("MSG mail.send 1 $JS.ACK.MAIL.workers.1.20.12.1700000000000000000.0 %d\r\n%s\r\n", len(message("deferred js")), message("deferred js")), `$JS.ACK.MAIL.workers.1.20.12.1700000000000000000.0 -NAK {"delay": 0}`},
+		{"jetstream failure after deferral", fmt.Sprintf("MSG mail.send 1 $JS.ACK.MAIL.workers.2.20.13.1700000000000000000.0 %d\r\n%s\r\n", len(message("deferred js")), message("deferred js")), `$JS.ACK.MAIL.workers.2.20.13.1700000000000000000.0 -NAK {"delay": 1000000}`},
+		{"jetstream last attempt after deferral", fmt.Sprintf("MSG mail.send 1 $JS.ACK.MAIL.workers.3.20.14.1700000000000000000.0 %d\r\n%s\r\n", len(message("deferred js")), message("deferred js")), "$JS.ACK.MAIL.workers.3.20.14.1700000000000000000.0 +TERM"},
+		{"heartbeat and flow control", fmt.Sprintf("HMSG mail.send 1 %d %d\r\n%s\r\nHMSG mail.send 1 fc.1 %d %d\r\n%s\r\n", len(heartbeat), len(heartbeat), heartbeat, len(flowControl), len(flowControl), flowControl), "fc.1 "},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			fmt.Fprint(conn, s.frame)
+
+			if cmd := readNATSCommand(t, r); cmd != s.expected {
+				t.Fatalf("Expected %q, got %q", s.expected, cmd)
+			}
+		})
+	}
+
+	mu.Lock()
+	if got := strings.Join(subjects, ","); got != "delivered,headers,temporary" {
+		t.Fatalf("Expected the delivered messages, got %s", got)
+	}
+	if attempts["always temporary"] != 2 {
+		t.Fatalf("Expected 2 attempts of the temporary failure, got %d", attempts["always temporary"])
+	}
+	if attempts["always temporary js"] != 2 {
+		t.Fatalf("Expected 1 attempt per JetStream delivery, got %d", attempts["always temporary js"])
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := consumer.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := readNATSCommand(t, r); cmd != "UNSUB 1" {
+		t.Fatalf("Expected UNSUB on stop, got %q", cmd)
+	}
+}
+
+func TestNATSConsumerBusy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	release := make(chan struct{})
+	consumer := NewNATSConsumer(MailerFunc(func(m *Message) error {
+		<-release
+		return nil
+	}), NATSConfig{Address: ln.Addr().String(), Subject: "mail.send"})
+	consumer.Start()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "INFO {}\r\n")
+	for _, expected := range []string{"CONNECT", "PING", "SUB", "PING"} {
+		if cmd := readNATSCommand(t, r); !strings.HasPrefix(cmd, expected) {
+			t.Fatalf("Expected %q, got %q", expected, cmd)
+		}
+		if expected == "PING" {
+			fmt.Fprint(conn, "PONG\r\n")
+		}
+	}
+
+	message := `{"from":"sender@example.com","to":["to@example.com"],"subject":"hello","text":"hello"}`
+	for i := 1; i <= 2; i++ {
+		fmt.Fprintf(conn, "MSG mail.send 1 ack.%d %d\r\n%s\r\n", i, len(message), message)
+	}
+
+	// answered while the only worker is busy
+	fmt.Fprint(conn, "PING\r\n")
+	if cmd := readNATSCommand(t, r); cmd != "PONG" {
+		t.Fatalf("Expected PONG, got %q", cmd)
+	}
+
+	close(release)
+	for i := 1; i <= 2; i++ {
+		if cmd := readNATSCommand(t, r); cmd != fmt.Sprintf("ack.%d +ACK", i) {
+			t.Fatalf("Expected the ack of message %d, got %q", i, cmd)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := consumer.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNATSConfigValidate(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config NATSConfig
+		valid  bool
+	}{
+		{"valid", NATSConfig{Address: "127.0.0.1:4222", Subject: "mail.>", Queue: "workers"}, true},
+		{"empty", NATSConfig{}, false},
+		{"invalid subject", NATSConfig{Address: "127.0.0.1:4222", Subject: "mail send"}, false},
+		{"invalid queue", NATSConfig{Address: "127.0.0.1:4222", Subject: "mail.send", Queue: "a b"}, false},
+		{"negative max attempts", NATSConfig{Address: "127.0.0.1:4222", Subject: "mail.send", MaxAttempts: -1}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			err := s.config.Validate()
+			if s.valid && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !s.valid && err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package mailer
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// NormalizeConfig defines the recipients normalization settings.
+type NormalizeConfig struct {
+	// Canonical compares the addresses by their canonical form when removing
+	// the duplicates, ie. without the "+tag" suffix of the local part for the
+	// providers known to use subaddressing (see subaddressingDomains) and
+	// without the dots of the Gmail ones ("J.Doe+news@gmail.com" is the same
+	// recipient as "jdoe@googlemail.com"). The first address is sent as it is.
+	Canonical bool `mapstructure:"canonical" json:"canonical,omitempty" bson:"canonical,omitempty"`
+}
+
+// NormalizeRecipients returns a middleware normalizing the To, Cc and Bcc
+// recipients of every message before handing it to the next mailer, ie.
+// trimming the whitespaces, lowercasing the address domains and removing
+// the duplicate addresses (compared case-insensitively) of all the lists.
+//
+// The To recipients take precedence over the Cc and Bcc ones, so that
+// a recipient is never sent the same message twice.
+func NormalizeRecipients(config NormalizeConfig) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			lists, changed := normalizeRecipients([][]mail.Address{m.To, m.Cc, m.Bcc}, config.Canonical)
+			if changed {
+				m = m.Clone()
+				m.To, m.Cc, m.Bcc = lists[0], lists[1], lists[2]
+			}
+
+			return next.Send(m)
+		})
+	}
+}
+
+// normalizeRecipients returns the normalized recipient lists without the
+// duplicates and whether any of them has changed.
+func normalizeRecipients(lists [][]mail.Address, canonical bool) ([][]mail.Address, bool) {
+	var changed bool
+
+	seen := map[string]struct{}{}
+	result := make([][]mail.Address, len(lists))
+
+	for i, list := range lists {
+		for _, addr := range list {
+			normalized := normalizeAddress(addr)
+
+			key := strings.ToLower(normalized.Address)
+			if canonical {
+				key = canonicalAddress(key)
+			}
+
+			if _, ok := seen[key]; ok {
+				changed = true
+				continue
+			}
+			seen[key] = struct{}{}
+
+			if normalized != addr {
+				changed = true
+			}
+			result[i] = append(result[i], normalized)
+		}
+	}
+
+	return result, changed
+}
+
+// normalizeAddress trims the address whitespaces and lowercases its domain.
+func normalizeAddress(addr mail.Address) mail.Address {
+	addr.Name = strings.TrimSpace(addr.Name)
+	addr.Address = strings.TrimSpace(addr.Address)
+
+	if i := strings.LastIndexByte(addr.Address, '@'); i >= 0 {
+		addr.Address = addr.Address[:i+1] + strings.ToLower(addr.Address[i+1:])
+	}
+
+	return addr
+}
+
+// subaddressingDomains are the domains of the providers delivering the
+// "local+tag" addresses to the "local" mailbox. Elsewhere, "a+x" and "a+y"
+// could be different mailboxes.
+var subaddressingDomains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+	"outlook.com":    true,
+	"hotmail.com":    true,
+	"live.com":       true,
+	"icloud.com":     true,
+	"me.com":         true,
+	"fastmail.com":   true,
+	"proton.me":      true,
+	"protonmail.com": true,
+}
+
+// canonicalAddress returns the lowercase address without the "+tag"
+// suffix of the subaddressing domains local part and the dots of the
+// Gmail local parts.
+func canonicalAddress(address string) string {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return address // eg. a symbolic recipient
+	}
+
+	local, domain := address[:i], address[i+1:]
+
+	if plus := strings.IndexByte(local, '+'); plus > 0 && subaddressingDomains[domain] {
+		local = local[:plus]
+	}
+
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local, domain = strings.ReplaceAll(local, ".", ""), "gmail.com"
+	}
+
+	return local + "@" + domain
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeRecipients(t *testing.T) {
+	original := &Message{
+		To:  []mail.Address{{Name: " John ", Address: " John@Example.COM "}, {Address: "j.doe+news@gmail.com"}},
+		Cc:  []mail.Address{{Address: "john@example.com"}, {Address: "jdoe@googlemail.com"}},
+		Bcc: []mail.Address{{Address: "JOHN@example.com"}, {Address: "team:oncall"}, {Address: "john+billing@example.com"}, {Address: "jane+a@outlook.com"}, {Address: "jane+b@outlook.com"}},
+	}
+
+	scenarios := []struct {
+		name      string
+		canonical bool
+		expected  [][]mail.Address
+	}{
+		{
+			"default",
+			false,
+			[][]mail.Address{
+				{{Name: "John", Address: "John@example.com"}, {Address: "j.doe+news@gmail.com"}},
+				{{Address: "jdoe@googlemail.com"}},
+				{{Address: "team:oncall"}, {Address: "john+billing@example.com"}, {Address: "jane+a@outlook.com"}, {Address: "jane+b@outlook.com"}},
+			},
+		},
+		{
+			"canonical",
+			true,
+			[][]mail.Address{
+				{{Name: "John", Address: "John@example.com"}, {Address: "j.doe+news@gmail.com"}},
+				nil,
+				{{Address: "team:oncall"}, {Address: "john+billing@example.com"}, {Address: "jane+a@outlook.com"}},
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var sent *Message
+			mailer := Chain(MailerFunc(func(m *Message) error {
+				sent = m
+				return nil
+			}), NormalizeRecipients(NormalizeConfig{Canonical: s.canonical}))
+
+			m := original.Clone()
+			if err := mailer.Send(m); err != nil {
+				t.Fatal(err)
+			}
+
+			if lists := [][]mail.Address{sent.To, sent.Cc, sent.Bcc}; !reflect.DeepEqual(lists, s.expected) {
+				t.Fatalf("Expected recipients %v, got %v", s.expected, lists)
+			}
+			if !reflect.DeepEqual(m, original) {
+				t.Fatalf("Expected the original message to be unchanged, got %+v", m)
+			}
+		})
+	}
+}
+
+func TestNormalizeRecipientsUnchanged(t *testing.T) {
+	m := &Message{To: []mail.Address{{Address: "john@example.com"}}, Cc: []mail.Address{{Address: "jane@example.com"}}}
+
+	var sent *Message
+	mailer := Chain(MailerFunc(func(msg *Message) error {
+		sent = msg
+		return nil
+	}), NormalizeRecipients(NormalizeConfig{}))
+
+	if err := mailer.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if sent != m {
+		t.Fatal("Expected the normalized message to be passed as it is")
+	}
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"sync/atomic"
+)
+
+var (
+	_ Mailer  = (*NullMailer)(nil)
+	_ Capable = (*NullMailer)(nil)
+)
+
+// NullMailer implements [mailer.Mailer] interface and defines a mail
+// client that accepts and discards all messages, only counting them.
+//
+// It is intended for load tests and demo environments.
+type NullMailer struct {
+	count atomic.Int64
+}
+
+// Send implements `mailer.Mailer` interface.
+func (c *NullMailer) Send(m *Message) error {
+	c.count.Add(1)
+
+	return nil
+}
+
+// Capabilities implements `mailer.Capable` interface.
+//
+// All features are reported as supported (except scheduling), so
+// that the load tests exercise the same code paths as in production.
+func (c *NullMailer) Capabilities() Capabilities {
+	caps := renderedCapabilities
+	caps.Batch = true
+
+	return caps
+}
+
+// Count returns the number of the discarded messages.
+func (c *NullMailer) Count() int64 {
+	return c.count.Load()
+}
@@ -0,0 +1,24 @@
+package mailer
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNullMailerCount(t *testing.T) {
+	var client NullMailer
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = client.Send(&Message{Subject: "test"})
+		}()
+	}
+	wg.Wait()
+
+	if v := client.Count(); v != 10 {
+		t.Fatalf("Expected 10 discarded messages, got %d", v)
+	}
+}
@@ -0,0 +1,410 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutboxTable        = "mailer_outbox"
+	defaultOutboxInterval     = time.Second
+	defaultOutboxBatchSize    = 100
+	defaultOutboxMaxAttempts  = 5
+	defaultOutboxRetryBackoff = time.Minute
+	defaultOutboxLease        = 5 * time.Minute
+)
+
+// Outbox message statuses.
+const (
+	OutboxPending   = "pending"
+	OutboxSent      = "sent"
+	OutboxFailed    = "failed"
+	OutboxDiscarded = "discarded" // in dry-run mode (see [ErrDryRun])
+)
+
+// OutboxConfig defines the transactional outbox settings.
+type OutboxConfig struct {
+	Table   string     `mapstructure:"table" json:"table,omitempty" bson:"table,omitempty"`       // default to "mailer_outbox"
+	Dialect SQLDialect `mapstructure:"dialect" json:"dialect,omitempty" bson:"dialect,omitempty"` // postgres (default), mysql or sqlite
+
+	Interval     time.Duration `mapstructure:"interval" json:"interval,omitempty" bson:"interval,omitempty"`                // relay polling interval, default to 1s
+	BatchSize    int           `mapstructure:"batch_size" json:"batch_size,omitempty" bson:"batch_size,omitempty"`          // max messages relayed per poll, default to 100
+	MaxAttempts  int           `mapstructure:"max_attempts" json:"max_attempts,omitempty" bson:"max_attempts,omitempty"`    // max delivery attempts of the temporary failures, default to 5
+	RetryBackoff time.Duration `mapstructure:"retry_backoff" json:"retry_backoff,omitempty" bson:"retry_backoff,omitempty"` // the first retry delay, doubled on every attempt, default to 1m
+	Lease        time.Duration `mapstructure:"lease" json:"lease,omitempty" bson:"lease,omitempty"`                         // how long a claimed message is reserved to its relay, default to 5m
+
+	// OnError is an optional hook called when an outbox message
+	// could not be delivered (with its id) or when the relay fails.
+	OnError func(id string, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the outbox configuration for common mistakes.
+func (c OutboxConfig) Validate() error {
+	errs := validateSQL("outbox", c.Dialect, c.Table)
+
+	if c.Interval < 0 {
+		errs = append(errs, fmt.Errorf("outbox: interval must be positive, got %s", c.Interval))
+	}
+
+	if c.BatchSize < 0 {
+		errs = append(errs, fmt.Errorf("outbox: batch_size must be positive, got %d", c.BatchSize))
+	}
+
+	if c.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("outbox: max_attempts must be positive, got %d", c.MaxAttempts))
+	}
+
+	if c.RetryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("outbox: retry_backoff must be positive, got %s", c.RetryBackoff))
+	}
+
+	if c.Lease < 0 {
+		errs = append(errs, fmt.Errorf("outbox: lease must be positive, got %s", c.Lease))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Outbox implements the transactional outbox pattern: the messages are
+// written to the app SQL database in the same transaction as the business
+// data (see [Outbox.Enqueue]) and delivered by a relay once committed, so
+// that a message is sent if and only if the transaction commits.
+//
+// The messages are rendered when enqueued (keeping their Message-ID
+// across the delivery attempts) and claimed by the relays with a lease,
+// so that many app instances can relay the same outbox. A message might
+// still be sent twice if its relay dies between the delivery and marking
+// it as sent, or if the delivery outlasts the lease.
+type Outbox struct {
+	db     *sql.DB
+	mailer Mailer
+	config OutboxConfig
+
+	// Clock is an optional time source (default to the system clock).
+	Clock Clock
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewOutbox creates a new outbox stored in db and relayed to mailer.
+func NewOutbox(db *sql.DB, mailer Mailer, config OutboxConfig) *Outbox {
+	if config.Table == "" {
+		config.Table = defaultOutboxTable
+	}
+	if config.Dialect == "" {
+		config.Dialect = SQLPostgres
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultOutboxInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultOutboxBatchSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultOutboxMaxAttempts
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultOutboxRetryBackoff
+	}
+	if config.Lease <= 0 {
+		config.Lease = defaultOutboxLease
+	}
+
+	return &Outbox{db: db, mailer: mailer, config: config}
+}
+
+// Schema returns the statement creating the outbox table (if it doesn't exist),
+// to be run with the app migrations. The times are stored as unix milliseconds.
+func (o *Outbox) Schema() string {
+	d := o.config.Dialect
+
+	return "CREATE TABLE IF NOT EXISTS " + o.config.Table + " (" +
+		"id VARCHAR(32) NOT NULL PRIMARY KEY, " +
+		"sender VARCHAR(320) NOT NULL, " +
+		"recipients " + d.textType() + " NOT NULL, " +
+		"data " + d.blobType() + " NOT NULL, " +
+		"status VARCHAR(16) NOT NULL, " +
+		"attempts INTEGER NOT NULL, " +
+		"next_attempt_at BIGINT NOT NULL, " +
+		"last_error " + d.textType() + ", " +
+		"created_at BIGINT NOT NULL, " +
+		"sent_at BIGINT)"
+}
+
+// Enqueue renders and writes the message to the outbox with tx (usually
+// the transaction of the related business data), returning its outbox id.
+//
+// The message is relayed once the transaction commits.
+func (o *Outbox) Enqueue(ctx context.Context, tx SQLExecer, m *Message) (string, error) {
+	m = m.Clone()
+	if m.Date.IsZero() {
+		m.Date = now(o.Clock)
+	}
+	ensureMessageID(m)
+
+	data, err := m.Render()
+	if err != nil {
+		return "", err
+	}
+
+	recipients, err := json.Marshal(envelopeRecipients(m))
+	if err != nil {
+		return "", err
+	}
+
+	id := PseudorandomString(20)
+	at := now(o.Clock).UnixMilli()
+
+	_, err = tx.ExecContext(ctx, o.config.Dialect.bind("INSERT INTO "+o.config.Table+
+		" (id, sender, recipients, data, status, attempts, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		id, envelopeSender(m), string(recipients), data, OutboxPending, 0, at, at)
+	if err != nil {
+		return "", fmt.Errorf("outbox: %w", err)
+	}
+
+	return id, nil
+}
+
+// Mailer returns a mailer enqueueing the messages with tx (see [Outbox.Enqueue]).
+func (o *Outbox) Mailer(ctx context.Context, tx SQLExecer) Mailer {
+	return MailerFunc(func(m *Message) error {
+		_, err := o.Enqueue(ctx, tx, m)
+		return err
+	})
+}
+
+// Start relays the committed messages in the background at the
+// configured interval. It is no-op if the relay is already started.
+func (o *Outbox) Start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.started {
+		return
+	}
+	o.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.done = make(chan struct{})
+
+	go o.run(ctx)
+}
+
+// Stop stops relaying, waiting for the current batch (up to the ctx deadline) to complete.
+// The messages claimed but not delivered yet are relayed again once their lease expires.
+func (o *Outbox) Stop(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.started {
+		return nil
+	}
+	o.started = false
+	o.cancel()
+
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	defer close(o.done)
+
+	for {
+		// relay the next batch right away when the current one was full
+		n, err := o.Relay(ctx)
+		if err != nil && ctx.Err() == nil {
+			o.onError("", err)
+		}
+
+		if n < o.config.BatchSize || err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(o.config.Interval):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// outboxMessage is a claimed outbox message.
+type outboxMessage struct {
+	id         string
+	sender     string
+	recipients string
+	data       []byte
+	attempts   int
+}
+
+// Relay delivers a batch of the due outbox messages, returning the
+// number of the claimed ones. It is called by the relay started with
+// [Outbox.Start], but can be called directly (eg. from a cron job).
+func (o *Outbox) Relay(ctx context.Context) (int, error) {
+	at := now(o.Clock).UnixMilli()
+
+	rows, err := o.db.QueryContext(ctx, o.config.Dialect.bind("SELECT id, next_attempt_at FROM "+o.config.Table+
+		" WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT "+fmt.Sprint(o.config.BatchSize)),
+		OutboxPending, at)
+	if err != nil {
+		return 0, fmt.Errorf("outbox: %w", err)
+	}
+
+	type due struct {
+		id            string
+		nextAttemptAt int64
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.nextAttemptAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("outbox: %w", err)
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("outbox: %w", err)
+	}
+
+	claimed := 0
+	for _, d := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+
+		msg, err := o.claim(ctx, d.id, d.nextAttemptAt)
+		if err != nil {
+			return claimed, fmt.Errorf("outbox: %w", err)
+		}
+		if msg == nil {
+			continue // claimed by another relay
+		}
+		claimed++
+
+		if err := o.deliver(ctx, msg); err != nil {
+			return claimed, fmt.Errorf("outbox: %w", err)
+		}
+	}
+
+	return claimed, nil
+}
+
+// claim reserves the message for the lease duration, returning nil if it was claimed by another relay.
+func (o *Outbox) claim(ctx context.Context, id string, nextAttemptAt int64) (*outboxMessage, error) {
+	result, err := o.db.ExecContext(ctx, o.config.Dialect.bind("UPDATE "+o.config.Table+
+		" SET next_attempt_at = ?, attempts = attempts + 1 WHERE id = ? AND status = ? AND next_attempt_at = ?"),
+		now(o.Clock).Add(o.config.Lease).UnixMilli(), id, OutboxPending, nextAttemptAt)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, err
+	}
+
+	msg := &outboxMessage{id: id}
+	err = o.db.QueryRowContext(ctx, o.config.Dialect.bind("SELECT sender, recipients, data, attempts FROM "+o.config.Table+" WHERE id = ?"), id).
+		Scan(&msg.sender, &msg.recipients, &msg.data, &msg.attempts)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// deliver sends the claimed message and records the result.
+func (o *Outbox) deliver(ctx context.Context, msg *outboxMessage) error {
+	sendErr := o.send(msg)
+
+	table, bind := o.config.Table, o.config.Dialect.bind
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = o.db.ExecContext(ctx, bind("UPDATE "+table+" SET status = ?, sent_at = ?, last_error = NULL WHERE id = ?"),
+			OutboxSent, now(o.Clock).UnixMilli(), msg.id)
+	case errors.Is(sendErr, ErrDryRun):
+		_, err = o.db.ExecContext(ctx, bind("UPDATE "+table+" SET status = ?, last_error = ? WHERE id = ?"),
+			OutboxDiscarded, sendErr.Error(), msg.id)
+	case isDeferred(sendErr):
+		o.onError(msg.id, sendErr)
+
+		at, _ := RetryAt(sendErr)
+		_, err = o.db.ExecContext(ctx, bind("UPDATE "+table+" SET next_attempt_at = ?, last_error = ? WHERE id = ?"),
+			at.UnixMilli(), sendErr.Error(), msg.id)
+	case IsTemporary(sendErr) && msg.attempts < o.config.MaxAttempts:
+		o.onError(msg.id, sendErr)
+
+		backoff := o.config.RetryBackoff << (msg.attempts - 1)
+		_, err = o.db.ExecContext(ctx, bind("UPDATE "+table+" SET next_attempt_at = ?, last_error = ? WHERE id = ?"),
+			now(o.Clock).Add(backoff).UnixMilli(), sendErr.Error(), msg.id)
+	default:
+		o.onError(msg.id, sendErr)
+
+		_, err = o.db.ExecContext(ctx, bind("UPDATE "+table+" SET status = ?, last_error = ? WHERE id = ?"),
+			OutboxFailed, sendErr.Error(), msg.id)
+	}
+
+	return err
+}
+
+func (o *Outbox) send(msg *outboxMessage) error {
+	var recipients []string
+	if err := json.Unmarshal([]byte(msg.recipients), &recipients); err != nil {
+		return fmt.Errorf("invalid recipients: %w", err)
+	}
+
+	m, err := ParseMessage(bytes.NewReader(msg.data))
+	if err != nil {
+		return err
+	}
+	restoreEnvelope(m, msg.sender, recipients)
+
+	return o.mailer.Send(m)
+}
+
+// Retry resets the attempts of a failed outbox message, to be relayed again.
+func (o *Outbox) Retry(ctx context.Context, id string) error {
+	result, err := o.db.ExecContext(ctx, o.config.Dialect.bind("UPDATE "+o.config.Table+
+		" SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?"),
+		OutboxPending, now(o.Clock).UnixMilli(), id, OutboxFailed)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("outbox: failed message %q not found", id)
+	}
+
+	return nil
+}
+
+// Purge deletes the messages sent before the specified time, returning their number.
+func (o *Outbox) Purge(ctx context.Context, before time.Time) (int64, error) {
+	result, err := o.db.ExecContext(ctx, o.config.Dialect.bind("DELETE FROM "+o.config.Table+" WHERE status = ? AND sent_at < ?"),
+		OutboxSent, before.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("outbox: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func (o *Outbox) onError(id string, err error) {
+	if o.config.OnError != nil {
+		o.config.OnError(id, err)
+	}
+}
@@ -0,0 +1,162 @@
+package mailer
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeSQLDB(t)
+
+	clock := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	var sent []*Message
+	var sendErr error
+	outbox := NewOutbox(db, MailerFunc(func(m *Message) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, m)
+		return nil
+	}), OutboxConfig{Dialect: SQLSQLite, MaxAttempts: 2, RetryBackoff: time.Minute})
+	outbox.Clock = ClockFunc(func() time.Time { return clock })
+
+	if _, err := db.ExecContext(ctx, outbox.Schema()); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := NewMessage().From("app@example.com").To("user@example.com").Bcc("audit@example.com").Subject("Hello").Text("Hello").Build()
+	if err := outbox.Mailer(ctx, tx).Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("relayed", func(t *testing.T) {
+		if n, err := outbox.Relay(ctx); err != nil || n != 1 {
+			t.Fatalf("Expected 1 relayed message, got %d, %v", n, err)
+		}
+
+		if len(sent) != 1 {
+			t.Fatalf("Expected 1 sent message, got %d", len(sent))
+		}
+		if sent[0].Subject != "Hello" || len(sent[0].Bcc) != 1 || sent[0].Bcc[0].Address != "audit@example.com" {
+			t.Fatalf("Expected the message with its Bcc recipient, got %+v", sent[0])
+		}
+		if headerValue(sent[0], "Message-ID") == "" || !sent[0].Date.Equal(clock) {
+			t.Fatalf("Expected the Message-ID and the Date to be set when enqueued, got %+v", sent[0])
+		}
+
+		rows := fakeSQLTable(t, db, defaultOutboxTable)
+		if len(rows) != 1 || rows[0]["status"] != OutboxSent || rows[0]["sent_at"] != clock.UnixMilli() {
+			t.Fatalf("Expected the message to be marked as sent, got %v", rows)
+		}
+
+		if n, err := outbox.Relay(ctx); err != nil || n != 0 {
+			t.Fatalf("Expected no message to relay again, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		sent = nil
+		sendErr = &textproto.Error{Code: 451, Msg: "try again later"}
+
+		id, err := outbox.Enqueue(ctx, db, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var failures []string
+		outbox.config.OnError = func(failed string, err error) { failures = append(failures, failed) }
+
+		if n, err := outbox.Relay(ctx); err != nil || n != 1 {
+			t.Fatalf("Expected 1 relayed message, got %d, %v", n, err)
+		}
+
+		// not due yet
+		if n, _ := outbox.Relay(ctx); n != 0 {
+			t.Fatalf("Expected the retry to be delayed, got %d relayed", n)
+		}
+
+		clock = clock.Add(time.Minute)
+		if n, _ := outbox.Relay(ctx); n != 1 {
+			t.Fatalf("Expected the retry to be relayed, got %d", n)
+		}
+
+		row := outboxRow(t, outbox, id)
+		if row["status"] != OutboxFailed || row["attempts"] != int64(2) || !strings.Contains(row["last_error"].(string), "try again later") {
+			t.Fatalf("Expected the message to fail after 2 attempts, got %v", row)
+		}
+		if len(failures) != 2 || failures[0] != id {
+			t.Fatalf("Expected 2 failures of %s, got %v", id, failures)
+		}
+
+		sendErr = nil
+		if err := outbox.Retry(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := outbox.Relay(ctx); n != 1 || len(sent) != 1 {
+			t.Fatalf("Expected the retried message to be sent, got %d relayed", n)
+		}
+		if err := outbox.Retry(ctx, id); err == nil {
+			t.Fatal("Expected an error when retrying a sent message")
+		}
+	})
+
+	t.Run("permanent failure", func(t *testing.T) {
+		sendErr = errors.New("rejected")
+		defer func() { sendErr = nil }()
+
+		id, _ := outbox.Enqueue(ctx, db, m)
+		_, _ = outbox.Relay(ctx)
+
+		if row := outboxRow(t, outbox, id); row["status"] != OutboxFailed || row["attempts"] != int64(1) {
+			t.Fatalf("Expected the message to fail without retry, got %v", row)
+		}
+	})
+
+	t.Run("purged", func(t *testing.T) {
+		n, err := outbox.Purge(ctx, clock.Add(time.Second))
+		if err != nil || n != 2 {
+			t.Fatalf("Expected 2 purged messages, got %d, %v", n, err)
+		}
+		if rows := fakeSQLTable(t, db, defaultOutboxTable); len(rows) != 1 {
+			t.Fatalf("Expected the failed message to be kept, got %v", rows)
+		}
+	})
+}
+
+func outboxRow(t *testing.T, outbox *Outbox, id string) map[string]driver.Value {
+	t.Helper()
+
+	for _, row := range fakeSQLTable(t, outbox.db, outbox.config.Table) {
+		if row["id"] == id {
+			return row
+		}
+	}
+	t.Fatalf("Missing outbox message %s", id)
+
+	return nil
+}
+
+func TestSQLDialectBind(t *testing.T) {
+	query := "UPDATE t SET a = ? WHERE b = ? AND c = ?"
+
+	if bound := SQLPostgres.bind(query); bound != "UPDATE t SET a = $1 WHERE b = $2 AND c = $3" {
+		t.Fatalf("Unexpected postgres query %q", bound)
+	}
+	if bound := SQLMySQL.bind(query); bound != query {
+		t.Fatalf("Unexpected mysql query %q", bound)
+	}
+}
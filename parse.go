@@ -0,0 +1,247 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ParseMessage parses a raw RFC 5322 message (eg. an archived .eml file)
+// back into a [Message].
+//
+// The headers that map to Message fields are converted into them, while
+// all other headers (including the Message-ID) are kept as Headers.
+// The bodies are expected to be UTF-8 (or ISO-8859-1) encoded.
+func ParseMessage(r io.Reader) (*Message, error) {
+	raw, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	header := raw.Header
+
+	if from, err := addressList(header, "From"); err != nil {
+		return nil, err
+	} else if len(from) > 0 {
+		m.From = from[0]
+	}
+	if m.To, err = addressList(header, "To"); err != nil {
+		return nil, err
+	}
+	if m.Cc, err = addressList(header, "Cc"); err != nil {
+		return nil, err
+	}
+	if m.Bcc, err = addressList(header, "Bcc"); err != nil {
+		return nil, err
+	}
+
+	decoder := new(mime.WordDecoder)
+	decode := func(v string) string {
+		if decoded, err := decoder.DecodeHeader(v); err == nil {
+			return decoded
+		}
+		return v
+	}
+
+	m.Subject = decode(header.Get("Subject"))
+
+	if header.Get("Date") != "" {
+		if date, err := header.Date(); err == nil {
+			m.Date = date
+		}
+	}
+
+	// "<>" is the null sender of the bounces and auto-replies, not a missing one
+	if returnPath := strings.TrimSpace(header.Get("Return-Path")); returnPath == "<>" {
+		m.NullSender = true
+	} else {
+		m.ReturnPath = strings.Trim(returnPath, "<>")
+	}
+	m.Locale = strings.TrimSpace(header.Get("Content-Language"))
+	m.InReplyTo = header.Get("In-Reply-To")
+	m.References = strings.Fields(header.Get("References"))
+
+	if v := header.Get("Auto-Submitted"); v != "" && !strings.EqualFold(v, "no") {
+		m.Auto = true
+	}
+
+	if tags := header.Get("X-Tags"); tags != "" {
+		for _, tag := range strings.Split(decode(tags), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				m.Tags = append(m.Tags, tag)
+			}
+		}
+	}
+
+	for name, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(name, "X-Metadata-") {
+			if m.Metadata == nil {
+				m.Metadata = map[string]string{}
+			}
+			m.Metadata[strings.TrimPrefix(name, "X-Metadata-")] = decode(values[0])
+			continue
+		}
+
+		if isParsedHeader(name, m.Auto) {
+			continue
+		}
+
+		if m.Headers == nil {
+			m.Headers = map[string]string{}
+		}
+		m.Headers[name] = decode(values[0])
+	}
+
+	if err := parsePart(m, textproto.MIMEHeader(header), raw.Body); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// isParsedHeader reports whether the header is converted into a Message field.
+func isParsedHeader(name string, auto bool) bool {
+	switch name {
+	case "From", "To", "Cc", "Bcc", "Subject", "Date", "Mime-Version",
+		"Content-Type", "Content-Transfer-Encoding", "In-Reply-To", "References", "X-Tags", "Return-Path", "Content-Language":
+		return true
+	case "Auto-Submitted", "Precedence", "X-Auto-Response-Suppress":
+		return auto
+	}
+
+	return false
+}
+
+// decodeCharset converts the ISO-8859-1 texts to UTF-8,
+// returning all other (expectedly UTF-8 or ASCII) texts as they are.
+func decodeCharset(charset string, data []byte) string {
+	if !strings.EqualFold(charset, CharsetLatin1) {
+		return string(data)
+	}
+
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes)
+}
+
+func addressList(header mail.Header, name string) ([]mail.Address, error) {
+	if header.Get(name) == "" {
+		return nil, nil
+	}
+
+	list, err := header.AddressList(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", name, err)
+	}
+
+	result := make([]mail.Address, len(list))
+	for i, addr := range list {
+		result[i] = *addr
+	}
+
+	return result, nil
+}
+
+// parsePart parses a single (possibly multipart) MIME part into the message bodies and attachments.
+func parsePart(m *Message, header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := parsePart(m, part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if strings.Contains(name, "=?") {
+		// RFC 2047 encoded name (eg. sent by Outlook)
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+
+	if contentID := strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>"); contentID != "" && disposition != "attachment" {
+		if m.Inline == nil {
+			m.Inline = map[string]io.Reader{}
+		}
+		m.Inline[contentID] = bytes.NewReader(data)
+		return nil
+	}
+
+	if disposition != "attachment" && name == "" {
+		switch {
+		case mediaType == "text/plain" && m.Text == "":
+			m.Text = decodeCharset(params["charset"], data)
+			return nil
+		case mediaType == "text/html" && m.HTML == "":
+			m.HTML = decodeCharset(params["charset"], data)
+			return nil
+		case mediaType == "text/x-amp-html" && m.AMP == "":
+			m.AMP = decodeCharset(params["charset"], data)
+			return nil
+		}
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("attachment-%d", len(m.Attachments)+1)
+	}
+	if m.Attachments == nil {
+		m.Attachments = map[string]io.Reader{}
+	}
+	m.Attachments[name] = bytes.NewReader(data)
+
+	return nil
+}
+
+// decodeTransferEncoding returns a reader decoding the specified Content-Transfer-Encoding.
+//
+// Note that multipart.Reader already decodes the quoted-printable parts.
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r) // the new lines are ignored by the decoder
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
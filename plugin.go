@@ -1,7 +1,15 @@
 package mailer
 
 import (
-	"os/exec"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
 
 	"github.com/roadrunner-server/endure/v2/dep"
 	"github.com/roadrunner-server/errors"
@@ -10,48 +18,991 @@ import (
 const (
 	PluginName = "mailer"
 
-	smtpKey     = PluginName + ".smtp"
-	sendmailKey = PluginName + ".sendmail"
+	defaultKey    = PluginName + ".default"
+	verifyKey     = PluginName + ".verify_on_start"
+	verifyRcptKey = PluginName + ".verify_recipient"
+
+	teeKey        = PluginName + ".tee"
+	archiveKey    = PluginName + ".archive"
+	spamCheckKey  = PluginName + ".spam_check"
+	virusScanKey  = PluginName + ".virus_scan"
+	warmUpKey     = PluginName + ".warmup"
+	throttleKey   = PluginName + ".throttle"
+	queueKey      = PluginName + ".queue"
+	webhookKey    = PluginName + ".webhook"
+	srsKey        = PluginName + ".srs"
+	arcKey        = PluginName + ".arc"
+	dkimKey       = PluginName + ".dkim"
+	bimiKey       = PluginName + ".bimi"
+	recipientsKey = PluginName + ".recipients"
+	templatesKey  = PluginName + ".templates"
+	quotaKey      = PluginName + ".quota"
+	tenantsKey    = PluginName + ".tenants"
+	dkimKeysKey   = PluginName + ".dkim_keys"
+	natsKey       = PluginName + ".nats"
+	httpKey       = PluginName + ".http"
+	diagnoseKey   = PluginName + ".diagnostics"
+	inboundKey    = PluginName + ".inbound"
+	sentFolderKey = PluginName + ".sent_folder"
+	bouncesKey    = PluginName + ".bounces"
+	sendLogKey    = PluginName + ".send_log"
+	idempotentKey = PluginName + ".idempotency"
+	digestKey     = PluginName + ".digest"
+	preferenceKey = PluginName + ".preferences"
+	largeFilesKey = PluginName + ".large_files"
+	fanOutKey     = PluginName + ".fan_out"
+	normalizeKey  = PluginName + ".normalize"
+
+	healthCheckTimeout = 10 * time.Second
 )
 
-type Plugin struct {
-	mailer Mailer
-}
+// reservedBackendNames are the plugin config sections that can't be used as backend names.
+var reservedBackendNames = map[string]bool{
+	"tee": true, "archive": true, "spam_check": true, "virus_scan": true, "warmup": true, "throttle": true,
+	"queue": true, "webhook": true, "srs": true, "arc": true, "dkim": true, "bimi": true, "recipients": true,
+	"templates": true, "quota": true, "tenants": true, "dkim_keys": true, "nats": true, "http": true,
+	"diagnostics": true, "inbound": true, "sent_folder": true, "bounces": true,
+	"send_log": true, "idempotency": true, "digest": true, "preferences": true,
+	"large_files": true, "default": true, "verify_on_start": true, "verify_recipient": true, "fan_out": true,
+	"normalize": true,
+}
+
+type Plugin struct {
+	backend          Mailer        // the configured transport without the middlewares
+	switcher         *SwitchMailer // the runtime switchable transport, wrapping the backend
+	mailer           Mailer
+	queue            *Queue
+	templates        *Templates
+	templatesWatcher *TemplatesWatcher
+	tenants          *TenantMailer
+	nats             *NATSConsumer
+	submit           *SubmitHandler
+	largeFiles       *LocalFileStore // the local large files store served over HTTP, if any
+	inbound          *InboundServer
+	bounces          *BouncePoller
+	sendLog          *SQLSendLog
+	digest           *Digest
+	preferences      *SQLPreferences
+	diagnose         DiagnoseConfig
+	dkimKeys         []func() []DKIMKey // the configured signing keys, checked by Diagnose
+	suppress         SuppressionList    // the suppressed recipients, fed by the bounces and complaints
+	closers          []io.Closer        // the middlewares resources released on stop
+	backendName      string             // the configured backend name, reported by the status
+	sends            sendTracker        // the outcome of the last sends, reported by the status
+	verify           bool               // whether the backend is verified on Serve
+	verifyRecipient  string             // the recipient the backend is verified to accept, if any
+	rrVersion        string             // the RoadRunner version, if reported by the configurer
+	configVersion    string             // the RoadRunner config "version"
+	log              *slog.Logger
+}
+
+func (p *Plugin) Init(cfg Configurer) error {
+	const op = errors.Op("mailer_plugin_init")
+
+	p.log = slog.Default().With("plugin", PluginName)
+
+	if err := checkConfigSections(cfg); err != nil {
+		return errors.E(op, err)
+	}
+
+	if v, ok := cfg.(versionedConfigurer); ok {
+		p.rrVersion = v.RRVersion()
+	}
+	if cfg.Has("version") {
+		if err := cfg.UnmarshalKey("version", &p.configVersion); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	p.log.Debug("configuring the mailer", "rr_version", p.rrVersion, "config_version", p.configVersion)
+
+	if cfg.Has(teeKey) {
+		var names []string
+		if err := cfg.UnmarshalKey(teeKey, &names); err != nil {
+			return errors.E(op, err)
+		}
+		if len(names) == 0 {
+			return errors.E(op, errors.Str("tee: at least one backend is required"))
+		}
+
+		mailers := make([]Mailer, 0, len(names))
+		for _, name := range names {
+			key := PluginName + "." + name
+			if _, ok := lookupBackend(name); !ok || !cfg.Has(key) {
+				return errors.E(op, errors.Errorf("tee: backend %q is not configured", name))
+			}
+
+			mailer, err := p.initBackend(cfg, key)
+			if err != nil {
+				return errors.E(op, err)
+			}
+			mailers = append(mailers, mailer)
+		}
+
+		p.backend = NewTeeMailer(mailers...)
+		p.backendName = "tee"
+	} else {
+		for _, name := range Backends() {
+			key := PluginName + "." + name
+			if !cfg.Has(key) {
+				continue
+			}
+
+			mailer, err := p.initBackend(cfg, key)
+			if err != nil {
+				return errors.E(op, err)
+			}
+			p.backend = mailer
+			p.backendName = name
+
+			break
+		}
+	}
+
+	if p.backend == nil && !cfg.Has(tenantsKey) {
+		return errors.E(op, errors.Disabled)
+	}
+
+	if p.backend != nil {
+		p.switcher = NewSwitchMailer(p.backendName, map[string]Mailer{p.backendName: p.backend})
+		p.switcher.Resolve = func(name string) (Mailer, error) {
+			key := PluginName + "." + name
+			if _, ok := lookupBackend(name); !ok || !cfg.Has(key) {
+				return nil, errors.Str("not configured")
+			}
+
+			return p.initBackend(cfg, key)
+		}
+		p.switcher.OnSwitch = func(change BackendSwitch) {
+			p.log.Warn("mailer backend switched", "from", change.From, "to", change.To, "dry_run", change.DryRun,
+				"actor", change.Actor, "reason", change.Reason)
+		}
+	}
+
+	p.mailer = p.transport()
+
+	if cfg.Has(verifyKey) {
+		if err := cfg.UnmarshalKey(verifyKey, &p.verify); err != nil {
+			return errors.E(op, err)
+		}
+		if err := cfg.UnmarshalKey(verifyRcptKey, &p.verifyRecipient); err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	if cfg.Has(tenantsKey) {
+		if err := p.initTenants(cfg); err != nil {
+			return errors.E(op, err)
+		}
+
+		p.mailer = p.tenants
+	}
+
+	// inside all the other middlewares, so that only the backend sends are tracked
+	p.mailer = Chain(p.mailer, p.sends.Middleware)
+
+	if cfg.Has(templatesKey) {
+		var templatesCfg TemplatesConfig
+		if err := unmarshalConfig(cfg, templatesKey, &templatesCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := templatesCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		templatesCfg.OnError = func(err error) {
+			p.log.Error("failed to reload the changed templates", "error", err)
+		}
+
+		templates, err := templatesCfg.Templates()
+		if err != nil {
+			return errors.E(op, err)
+		}
+		p.templates = templates
+		p.templatesWatcher = templatesCfg.Watcher(templates)
+	}
+
+	if cfg.Has(sendLogKey) {
+		var sendLogCfg SendLogConfig
+		if err := unmarshalConfig(cfg, sendLogKey, &sendLogCfg); err != nil {
+			return errors.E(op, err)
+		}
+		sendLogCfg.DSN = expandEnv(sendLogCfg.DSN)
+		if err := sendLogCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		if sendLogCfg.Backend == "" {
+			sendLogCfg.Backend = p.backendName
+		}
+		sendLogCfg.OnError = func(m *Message, err error) {
+			p.log.Error("failed to record the send attempt", "subject", m.Subject, "error", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		sendLog, err := sendLogCfg.Open(ctx)
+		cancel()
+		if err != nil {
+			return errors.E(op, err)
+		}
+		p.sendLog = sendLog
+		p.closers = append(p.closers, sendLog)
+
+		// first, so that every queue attempt is recorded
+		p.mailer = Chain(p.mailer, SendLog(sendLog))
+	}
+
+	if cfg.Has(srsKey) {
+		var srs SRS
+		if err := unmarshalConfig(cfg, srsKey, &srs); err != nil {
+			return errors.E(op, err)
+		}
+		srs.Secret = expandEnv(srs.Secret)
+		if err := srs.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		p.mailer = Chain(p.mailer, SRSRewrite(srs))
+	}
+
+	if cfg.Has(archiveKey) {
+		var archiveCfg ArchiveConfig
+		if err := unmarshalConfig(cfg, archiveKey, &archiveCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if archiveCfg.S3 != nil {
+			archiveCfg.S3.AccessKey = expandEnv(archiveCfg.S3.AccessKey)
+			archiveCfg.S3.SecretKey = expandEnv(archiveCfg.S3.SecretKey)
+		}
+		if err := archiveCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		store, err := archiveCfg.Store()
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		archiveCfg.OnError = func(m *Message, err error) {
+			p.log.Error("failed to archive the sent message", "subject", m.Subject, "error", err)
+		}
+
+		p.mailer = Chain(p.mailer, Archive(store, archiveCfg))
+	}
+
+	if cfg.Has(sentFolderKey) {
+		var imapCfg IMAPConfig
+		if err := unmarshalConfig(cfg, sentFolderKey, &imapCfg); err != nil {
+			return errors.E(op, err)
+		}
+		imapCfg.Password = expandEnv(imapCfg.Password)
+		if err := imapCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		imapCfg.OnError = func(m *Message, err error) {
+			p.log.Error("failed to append the sent message copy", "subject", m.Subject, "error", err)
+		}
+
+		appender := NewIMAPAppender(imapCfg)
+		p.closers = append(p.closers, appender)
+
+		// next to the archive, so that the copies are signed and sealed too
+		p.mailer = Chain(p.mailer, IMAPAppend(appender))
+	}
+
+	if cfg.Has(arcKey) {
+		var arcCfg ARCConfig
+		if err := unmarshalConfig(cfg, arcKey, &arcCfg); err != nil {
+			return errors.E(op, err)
+		}
+		arcCfg.PrivateKey = expandEnv(arcCfg.PrivateKey)
+
+		sealer, err := NewARCSealer(arcCfg)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		// after the archive, so that the archived copies are sealed too
+		p.mailer = Chain(p.mailer, Signing(sealer))
+	}
+
+	if cfg.Has(dkimKey) {
+		var dkimCfg DKIMConfig
+		if err := unmarshalConfig(cfg, dkimKey, &dkimCfg); err != nil {
+			return errors.E(op, err)
+		}
+		dkimCfg.PrivateKey = expandEnv(dkimCfg.PrivateKey)
+
+		signer, err := NewDKIMSigner(dkimCfg)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		// after the arc sealing, so that the messages are signed before being sealed
+		p.mailer = Chain(p.mailer, Signing(signer))
+		p.dkimKeys = append(p.dkimKeys, func() []DKIMKey { return []DKIMKey{signer.Key()} })
+	}
+
+	if cfg.Has(dkimKeysKey) {
+		var dkimKeysCfg DKIMKeysConfig
+		if err := unmarshalConfig(cfg, dkimKeysKey, &dkimKeysCfg); err != nil {
+			return errors.E(op, err)
+		}
+		dkimKeysCfg.OnRotate = func(key DKIMKey) {
+			p.log.Warn("dkim_keys: publish the DNS record of the new key",
+				"record", key.RecordName(), "value", key.RecordValue(), "active_from", key.ActiveFrom)
+		}
+		dkimKeysCfg.OnError = func(err error) {
+			p.log.Error("failed to rotate the dkim keys", "error", err)
+		}
+
+		store, err := NewDKIMKeyStore(dkimKeysCfg)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		// same position as the static key, so that the messages are signed before being sealed
+		p.mailer = Chain(p.mailer, Signing(store))
+		p.dkimKeys = append(p.dkimKeys, store.Keys)
+	}
+
+	if cfg.Has(bimiKey) {
+		var bimiCfg BIMIConfig
+		if err := unmarshalConfig(cfg, bimiKey, &bimiCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := bimiCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		if !cfg.Has(dkimKey) {
+			p.log.Warn("bimi: the BIMI-Selector header must be covered by the DKIM signature of the relay")
+		}
+
+		p.mailer = Chain(p.mailer, BIMI(bimiCfg))
+	}
+
+	if cfg.Has(webhookKey) {
+		var webhookCfg WebhookConfig
+		if err := unmarshalConfig(cfg, webhookKey, &webhookCfg); err != nil {
+			return errors.E(op, err)
+		}
+		webhookCfg.Secret = expandEnv(webhookCfg.Secret)
+		if err := webhookCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		webhookCfg.OnError = func(event *WebhookEvent, err error) {
+			p.log.Error("failed to post the send webhook", "message_id", event.MessageID, "error", err)
+		}
+
+		poster := NewWebhookPoster(webhookCfg)
+		p.closers = append(p.closers, poster)
+
+		p.mailer = Chain(p.mailer, Webhook(poster))
+	}
+
+	if cfg.Has(largeFilesKey) {
+		var largeFilesCfg LargeFilesConfig
+		if err := unmarshalConfig(cfg, largeFilesKey, &largeFilesCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if largeFilesCfg.Local != nil {
+			largeFilesCfg.Local.Secret = expandEnv(largeFilesCfg.Local.Secret)
+		}
+		if largeFilesCfg.S3 != nil {
+			largeFilesCfg.S3.AccessKey = expandEnv(largeFilesCfg.S3.AccessKey)
+			largeFilesCfg.S3.SecretKey = expandEnv(largeFilesCfg.S3.SecretKey)
+		}
+		if err := largeFilesCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		store, err := largeFilesCfg.Store()
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		// inside the spam check and virus scan, so that the files are scanned before the upload
+		p.mailer = Chain(p.mailer, LargeFiles(store, largeFilesCfg))
+		p.largeFiles = largeFilesCfg.Local
+	}
+
+	if cfg.Has(spamCheckKey) {
+		var spamCfg SpamCheckConfig
+		if err := unmarshalConfig(cfg, spamCheckKey, &spamCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := spamCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		checker, err := spamCfg.Checker()
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		p.mailer = Chain(p.mailer, SpamCheck(checker, spamCfg))
+	}
+
+	if cfg.Has(virusScanKey) {
+		var virusCfg VirusScanConfig
+		if err := unmarshalConfig(cfg, virusScanKey, &virusCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := virusCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		scanner, err := virusCfg.Scanner()
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		p.mailer = Chain(p.mailer, VirusScan(scanner, virusCfg))
+	}
+
+	if cfg.Has(warmUpKey) {
+		var warmUpCfg WarmUpConfig
+		if err := unmarshalConfig(cfg, warmUpKey, &warmUpCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if warmUpCfg.Redis != nil {
+			warmUpCfg.Redis.Password = expandEnv(warmUpCfg.Redis.Password)
+		}
+		if err := warmUpCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		scheduler := NewWarmUpScheduler(warmUpCfg)
+		p.closers = append(p.closers, scheduler)
+
+		p.mailer = Chain(p.mailer, WarmUp(scheduler))
+	}
+
+	if cfg.Has(throttleKey) {
+		var throttleCfg ThrottleConfig
+		if err := unmarshalConfig(cfg, throttleKey, &throttleCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if throttleCfg.Redis != nil {
+			throttleCfg.Redis.Password = expandEnv(throttleCfg.Redis.Password)
+		}
+		if err := throttleCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		throttler := NewThrottler(throttleCfg)
+		p.closers = append(p.closers, throttler)
+
+		p.mailer = Chain(p.mailer, Throttle(throttler))
+	}
+
+	if cfg.Has(bouncesKey) {
+		var bouncesCfg BounceMailboxConfig
+		if err := unmarshalConfig(cfg, bouncesKey, &bouncesCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if bouncesCfg.IMAP != nil {
+			bouncesCfg.IMAP.Password = expandEnv(bouncesCfg.IMAP.Password)
+		}
+		if bouncesCfg.POP3 != nil {
+			bouncesCfg.POP3.Password = expandEnv(bouncesCfg.POP3.Password)
+		}
+		if bouncesCfg.Redis != nil {
+			bouncesCfg.Redis.Password = expandEnv(bouncesCfg.Redis.Password)
+		}
+		if err := bouncesCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		if p.sendLog == nil {
+			return errors.E(op, errors.Str("bounces: send_log is required to match the reports with the sent messages"))
+		}
+
+		bouncesCfg.OnBounce = func(report *DeliveryReport, recipient DeliveryReportRecipient) {
+			p.log.Info("bounce received", "message_id", report.OriginalMessageID, "recipient", recipient.Recipient, "status", recipient.Status, "diagnostic", recipient.Diagnostic)
+
+			if p.queue != nil {
+				p.queue.Publish(DeliveryEvent{
+					Status:    DeliveryBounced,
+					Recipient: recipient.Recipient,
+					Err:       errors.Str(strings.TrimSpace(recipient.Status + " " + recipient.Diagnostic)),
+				})
+			}
+		}
+		bouncesCfg.OnComplaint = func(report *FeedbackReport, recipient string) {
+			p.log.Warn("complaint received", "message_id", report.OriginalMessageID, "recipient", recipient, "user_agent", report.UserAgent)
+
+			if p.queue != nil {
+				p.queue.Publish(DeliveryEvent{Status: DeliveryComplained, Recipient: recipient})
+			}
+		}
+		bouncesCfg.OnError = func(err error) {
+			p.log.Error("failed to process the bounces", "error", err)
+		}
+
+		p.suppress = bouncesCfg.SuppressionList()
+		if closer, ok := p.suppress.(io.Closer); ok {
+			p.closers = append(p.closers, closer)
+		}
+		p.bounces = NewBouncePoller(bouncesCfg, p.suppress, p.sendLog)
+
+		// before the recipients resolution, so that the resolved addresses are checked too
+		p.mailer = Chain(p.mailer, Suppressed(p.suppress, func(m *Message, suppressed []Suppression) {
+			for _, s := range suppressed {
+				p.log.Info("suppressed recipient skipped", "subject", m.Subject, "recipient", s.Address, "reason", s.Reason)
+			}
+		}))
+	}
+
+	if cfg.Has(preferenceKey) {
+		var preferencesCfg PreferencesConfig
+		if err := unmarshalConfig(cfg, preferenceKey, &preferencesCfg); err != nil {
+			return errors.E(op, err)
+		}
+		preferencesCfg.DSN = expandEnv(preferencesCfg.DSN)
+		if err := preferencesCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		preferencesCfg.OnDenied = func(m *Message, denials []PreferenceDenial) {
+			for _, d := range denials {
+				p.log.Info("recipient preferences denied the message", "subject", m.Subject, "recipient", d.Address, "reason", d.Reason)
+			}
+		}
+		preferencesCfg.OnError = func(m *Message, err error) {
+			p.log.Error("failed to count the message for the frequency caps", "subject", m.Subject, "error", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		preferences, err := preferencesCfg.Open(ctx)
+		cancel()
+		if err != nil {
+			return errors.E(op, err)
+		}
+		p.preferences = preferences
+		p.closers = append(p.closers, preferences)
+
+		// before the recipients resolution, so that the resolved addresses are checked too
+		p.mailer = Chain(p.mailer, Preferences(preferences, preferencesCfg))
+	}
+
+	if cfg.Has(recipientsKey) {
+		var recipientsCfg RecipientsConfig
+		if err := unmarshalConfig(cfg, recipientsKey, &recipientsCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if recipientsCfg.LDAP != nil {
+			recipientsCfg.LDAP.BindPassword = expandEnv(recipientsCfg.LDAP.BindPassword)
+		}
+		if err := recipientsCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		resolver, err := recipientsCfg.Resolver()
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		p.mailer = Chain(p.mailer, ResolveRecipients(resolver, recipientsCfg))
+	}
+
+	var idempotencyHeader string // the custom idempotency key header, if any
+	if cfg.Has(idempotentKey) {
+		var idempotencyCfg IdempotencyConfig
+		if err := unmarshalConfig(cfg, idempotentKey, &idempotencyCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if idempotencyCfg.Redis != nil {
+			idempotencyCfg.Redis.Password = expandEnv(idempotencyCfg.Redis.Password)
+		}
+		if err := idempotencyCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		idempotencyHeader = idempotencyCfg.Header
+		idempotencyCfg.OnDuplicate = func(m *Message, key string) {
+			p.log.Info("duplicate message skipped", "subject", m.Subject, "key", key)
+		}
+
+		store := idempotencyCfg.Store()
+		if closer, ok := store.(io.Closer); ok {
+			p.closers = append(p.closers, closer)
+		}
+
+		// inside the queue, so that the failed attempts release the key for the retries
+		p.mailer = Chain(p.mailer, Idempotent(store, idempotencyCfg))
+	}
+
+	var normalizeCfg NormalizeConfig
+	if cfg.Has(normalizeKey) {
+		if err := unmarshalConfig(cfg, normalizeKey, &normalizeCfg); err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	if cfg.Has(fanOutKey) {
+		var fanOutCfg FanOutConfig
+		if err := unmarshalConfig(cfg, fanOutKey, &fanOutCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := fanOutCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		if fanOutCfg.KeyHeaders == nil && idempotencyHeader != "" {
+			fanOutCfg.KeyHeaders = []string{idempotencyHeader}
+		}
+
+		// inside the queue, so that the copies are sent concurrently
+		// and only the failed recipients are retried
+		p.mailer = Chain(p.mailer, FanOut(fanOutCfg))
+	}
 
-func (p *Plugin) Init(cfg Configurer) error {
-	const op = errors.Op("mailer_plugin_init")
+	if cfg.Has(queueKey) {
+		var queueCfg QueueConfig
+		if err := unmarshalConfig(cfg, queueKey, &queueCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := queueCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
 
-	if !cfg.Has(smtpKey) && !cfg.Has(sendmailKey) {
-		return errors.E(op, errors.Disabled)
+		p.queue = NewQueue(p.mailer, queueCfg)
+		p.queue.OnError = func(m *Message, err error) {
+			p.log.Error("failed to send queued message", "subject", m.Subject, "error", err)
+		}
+		p.mailer = p.queue
 	}
 
-	if cfg.Has(smtpKey) {
-		var client SmtpClient
-		if err := cfg.UnmarshalKey(smtpKey, &client); err != nil {
+	if cfg.Has(quotaKey) {
+		var quotaCfg QuotaConfig
+		if err := unmarshalConfig(cfg, quotaKey, &quotaCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if quotaCfg.Redis != nil {
+			quotaCfg.Redis.Password = expandEnv(quotaCfg.Redis.Password)
+		}
+		if err := quotaCfg.Validate(); err != nil {
 			return errors.E(op, err)
 		}
 
-		p.mailer = client
-	} else if cfg.Has(sendmailKey) {
-		var sendMail SendMail
-		if err := cfg.UnmarshalKey(sendmailKey, &sendMail); err != nil {
+		store := quotaCfg.Store()
+		if closer, ok := store.(io.Closer); ok {
+			p.closers = append(p.closers, closer)
+		}
+
+		p.mailer = Chain(p.mailer, Quota(store, quotaCfg))
+	}
+
+	// outermost, so that the invalid messages are rejected before they are
+	// queued, validated once their recipients are normalized
+	p.mailer = Chain(p.mailer, NormalizeRecipients(normalizeCfg), Validated())
+
+	if p.tenants != nil {
+		p.tenants.Pipeline = p.mailer
+	}
+
+	if cfg.Has(natsKey) {
+		var natsCfg NATSConfig
+		if err := unmarshalConfig(cfg, natsKey, &natsCfg); err != nil {
 			return errors.E(op, err)
 		}
-		if sendMail.CmdPath == "" {
-			cmdPath, err := findSendmailPath()
-			if err != nil {
-				return errors.E(op, err)
+		natsCfg.Password = expandEnv(natsCfg.Password)
+		natsCfg.Token = expandEnv(natsCfg.Token)
+		if err := natsCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+
+		natsCfg.Templates = p.templates
+		natsCfg.OnError = func(data []byte, err error) {
+			p.log.Error("failed to deliver the nats message", "size", len(data), "error", err)
+		}
+
+		// consumes into the whole pipeline, as the messages sent by the app
+		p.nats = NewNATSConsumer(p.mailer, natsCfg)
+	}
+
+	if cfg.Has(digestKey) {
+		var digestCfg DigestConfig
+		if err := unmarshalConfig(cfg, digestKey, &digestCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if digestCfg.Redis != nil {
+			digestCfg.Redis.Password = expandEnv(digestCfg.Redis.Password)
+		}
+		if err := digestCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		if p.templates == nil {
+			return errors.E(op, errors.Str("digest: the templates are not configured"))
+		}
+
+		digestCfg.Templates = p.templates
+		digestCfg.OnError = func(recipient string, err error) {
+			p.log.Error("failed to send the digest", "recipient", recipient, "error", err)
+		}
+
+		store := digestCfg.Store()
+		if closer, ok := store.(io.Closer); ok {
+			p.closers = append(p.closers, closer)
+		}
+
+		// sends into the whole pipeline, as the messages sent by the app
+		p.digest = NewDigest(p.mailer, store, digestCfg)
+	}
+
+	if cfg.Has(httpKey) {
+		var submitCfg SubmitConfig
+		if err := unmarshalConfig(cfg, httpKey, &submitCfg); err != nil {
+			return errors.E(op, err)
+		}
+		for i, key := range submitCfg.APIKeys {
+			submitCfg.APIKeys[i] = expandEnv(key)
+		}
+		for i := range submitCfg.Keys {
+			submitCfg.Keys[i].Key = expandEnv(submitCfg.Keys[i].Key)
+		}
+		if err := submitCfg.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+		for _, key := range submitCfg.Keys {
+			if key.Tenant == "" {
+				continue
 			}
-			sendMail.CmdPath = cmdPath
-		} else if path, err := exec.LookPath(sendMail.CmdPath); err != nil {
+			if p.tenants == nil {
+				return errors.E(op, errors.Errorf("http: tenant %q of the key is not configured", key.Tenant))
+			}
+			if _, err := p.tenants.For(key.Tenant); err != nil {
+				return errors.E(op, errors.Errorf("http: %v", err))
+			}
+		}
+
+		submitCfg.Templates = p.templates
+		submitCfg.Tenants = p.tenants
+		submitCfg.OnError = func(m *Message, err error) {
+			p.log.Error("failed to send the submitted message", "subject", m.Subject, "error", err)
+		}
+		p.submit = NewSubmitHandler(p.mailer, submitCfg)
+	}
+
+	if cfg.Has(inboundKey) {
+		var inboundCfg InboundConfig
+		if err := unmarshalConfig(cfg, inboundKey, &inboundCfg); err != nil {
+			return errors.E(op, err)
+		}
+		if err := inboundCfg.Validate(); err != nil {
 			return errors.E(op, err)
-		} else {
-			sendMail.CmdPath = path
+		}
+		inboundCfg.OnError = func(msg *InboundMessage, err error) {
+			p.log.Error("failed to handle inbound message", "from", msg.MailFrom, "recipients", msg.Recipients, "error", err)
 		}
 
-		p.mailer = sendMail
-	} else {
-		return errors.E(op, errors.Disabled)
+		p.inbound = NewInboundServer(inboundCfg)
+	}
+
+	if cfg.Has(diagnoseKey) {
+		if err := unmarshalConfig(cfg, diagnoseKey, &p.diagnose); err != nil {
+			return errors.E(op, err)
+		}
+		if err := p.diagnose.Validate(); err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	return nil
+}
+
+// initTenants creates the tenant mailer from the tenants configured under
+// "mailer.tenants", each with its own backend (the default one if
+// it has none), From address and DKIM key.
+func (p *Plugin) initTenants(cfg Configurer) error {
+	var tenantsCfg map[string]TenantConfig
+	if err := cfg.UnmarshalKey(tenantsKey, &tenantsCfg); err != nil {
+		return err
+	}
+	if err := checkTenantsConfigKeys(cfg); err != nil {
+		return err
+	}
+
+	p.tenants = NewTenantMailer(p.transport())
+
+	for id, tenantCfg := range tenantsCfg {
+		if tenantCfg.DKIM != nil {
+			tenantCfg.DKIM.PrivateKey = expandEnv(tenantCfg.DKIM.PrivateKey)
+		}
+		if err := tenantCfg.Validate(); err != nil {
+			return fmt.Errorf("tenants.%s: %w", id, err)
+		}
+
+		mailer := p.transport()
+		for _, name := range Backends() {
+			key := tenantsKey + "." + id + "." + name
+			if !cfg.Has(key) {
+				continue
+			}
+
+			backend, err := p.initBackend(cfg, key)
+			if err != nil {
+				return fmt.Errorf("tenants.%s: %w", id, err)
+			}
+			if closer, ok := backend.(io.Closer); ok {
+				p.closers = append(p.closers, closer)
+			}
+			mailer = backend
+
+			// the tenant backends share the dry-run mode of the switch
+			if p.switcher != nil {
+				mailer = p.switcher.Gate(backend)
+			}
+
+			break
+		}
+		if mailer == nil {
+			return fmt.Errorf("tenants.%s: no backend is configured", id)
+		}
+
+		if tenantCfg.DKIM != nil {
+			signer, err := NewDKIMSigner(*tenantCfg.DKIM)
+			if err != nil {
+				return fmt.Errorf("tenants.%s: %w", id, err)
+			}
+			mailer = Chain(mailer, Signing(signer))
+			p.dkimKeys = append(p.dkimKeys, func() []DKIMKey { return []DKIMKey{signer.Key()} })
+		}
+
+		var from mail.Address
+		if tenantCfg.From != "" {
+			address, _ := mail.ParseAddress(tenantCfg.From)
+			from = *address
+		}
+
+		if err := p.tenants.Add(id, mailer, from); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initBackend creates the backend configured under the specified key,
+// named after the backend (eg. "mailer.smtp" or "mailer.tenants.acme.smtp").
+func (p *Plugin) initBackend(cfg Configurer, key string) (Mailer, error) {
+	name := key[strings.LastIndexByte(key, '.')+1:]
+
+	factory, ok := lookupBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", key)
+	}
+
+	// the backend block is decoded over the shared defaults, so that it
+	// inherits the settings it doesn't override, and its keys unknown to
+	// the backend are rejected as typos (the defaults ones are not, since
+	// they are shared with the backends not supporting them)
+	unmarshal := func(out any) error {
+		if cfg.Has(defaultKey) {
+			if err := cfg.UnmarshalKey(defaultKey, out); err != nil {
+				return err
+			}
+		}
+
+		return unmarshalConfig(cfg, key, out)
+	}
+
+	return factory(unmarshal, p.log)
+}
+
+func (p *Plugin) Serve() chan error {
+	errCh := make(chan error, 1)
+
+	if p.verify {
+		if err := p.verifyBackend(); err != nil {
+			errCh <- errors.E(errors.Op("mailer_plugin_serve"), err)
+			return errCh
+		}
+	}
+
+	if p.queue != nil {
+		// the messages that could not be restored are kept in the spool
+		if err := p.queue.Start(); err != nil {
+			p.log.Error("failed to restore the spooled messages", "error", err)
+		}
+	}
+
+	if p.nats != nil {
+		p.nats.Start()
+	}
+
+	if p.bounces != nil {
+		p.bounces.Start()
+	}
+
+	if p.digest != nil {
+		p.digest.Start()
+	}
+
+	if p.templatesWatcher != nil {
+		p.templatesWatcher.Start()
+	}
+
+	if p.inbound != nil {
+		if err := p.inbound.Start(); err != nil {
+			errCh <- errors.E(errors.Op("mailer_plugin_serve"), err)
+		}
+	}
+
+	return errCh
+}
+
+// Stop stops receiving and consuming (if configured) and accepting new
+// messages, drains the queue (if any) and releases the backend resources.
+func (p *Plugin) Stop(ctx context.Context) error {
+	const op = errors.Op("mailer_plugin_stop")
+
+	var stopErr error
+	if p.inbound != nil {
+		stopErr = p.inbound.Stop(ctx)
+	}
+
+	if p.bounces != nil {
+		if err := p.bounces.Stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	if p.templatesWatcher != nil {
+		if err := p.templatesWatcher.Stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	if p.nats != nil {
+		if err := p.nats.Stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	if p.digest != nil {
+		if err := p.digest.Stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	if p.queue != nil {
+		if err := p.queue.Stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	if closer, ok := p.transport().(io.Closer); ok {
+		if err := closer.Close(); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	for _, closer := range p.closers {
+		if err := closer.Close(); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	if stopErr != nil {
+		return errors.E(op, stopErr)
 	}
 
 	return nil
@@ -63,10 +1014,268 @@ func (p *Plugin) Provides() []*dep.Out {
 	}
 }
 
+// Middleware implements the RoadRunner http plugin middleware interface,
+// serving the submission endpoint (if configured, see [SubmitHandler])
+// and the local large files (if configured, see [LocalFileStore]).
+func (p *Plugin) Middleware(next http.Handler) http.Handler {
+	if p.largeFiles != nil {
+		next = p.largeFiles.Middleware(next)
+	}
+
+	if p.submit == nil {
+		return next
+	}
+
+	return p.submit.Middleware(next)
+}
+
 func (p *Plugin) Mailer() Mailer {
 	return p.mailer
 }
 
+// Enqueue sends the message through the plugin mailer like [Plugin.Mailer],
+// configuring its queued copies with the options, eg. [WithSendAt] or
+// [WithCorrelationID] and [WithDisposition] to track their outcome
+// (called for every copy of the messages sent separately).
+//
+// It fails if the queue is not configured, as the options would be ignored.
+func (p *Plugin) Enqueue(m *Message, opts ...QueueOption) error {
+	if p.queue == nil {
+		return errors.Str("mailer queue is not configured")
+	}
+
+	m = m.Clone()
+	m.queueOptions = append(m.queueOptions, opts...)
+
+	return p.mailer.Send(m)
+}
+
+// transport returns the runtime switchable backend, or the
+// configured one if there is none (eg. only tenant backends).
+func (p *Plugin) transport() Mailer {
+	if p.switcher != nil {
+		return p.switcher
+	}
+
+	return p.backend
+}
+
+// SwitchBackend switches the backend the messages are sent through at
+// runtime, eg. from SES to a backup SMTP relay configured next to it, and
+// the dry-run mode discarding them, auditing the change with the actor
+// and reason (see [SwitchMailer.Switch]). An empty name keeps the active
+// backend, only toggling the dry-run mode.
+func (p *Plugin) SwitchBackend(name string, dryRun bool, actor, reason string) error {
+	if p.switcher == nil {
+		return errors.Str("mailer backend is not configured")
+	}
+
+	return p.switcher.Switch(name, dryRun, actor, reason)
+}
+
+// Inbound returns the inbound mail listener to register the handlers
+// of the received messages with, or nil if it is not configured.
+func (p *Plugin) Inbound() *InboundServer {
+	return p.inbound
+}
+
+// Tenants returns the tenant mailer (nil if there are no tenants configured).
+func (p *Plugin) Tenants() *TenantMailer {
+	return p.tenants
+}
+
+// Templates returns the configured message templates
+// or nil if the templates are not configured.
+func (p *Plugin) Templates() *Templates {
+	return p.templates
+}
+
+// RenderPreview renders the named template in the locale without sending
+// it, eg. to preview the notification templates in an admin UI.
+func (p *Plugin) RenderPreview(name, locale string, data any) (*RenderedTemplate, error) {
+	if p.templates == nil {
+		return nil, errors.Str("mailer templates are not configured")
+	}
+
+	return p.templates.Render(name, locale, data)
+}
+
+// SendTest renders the named template in the locale and sends it to the
+// recipients through the plugin mailer pipeline, marked as a test message
+// (see [MessageBuilder.Test]), so that it bypasses the suppression list.
+func (p *Plugin) SendTest(name, locale string, data any, from string, to ...string) error {
+	if p.templates == nil {
+		return errors.Str("mailer templates are not configured")
+	}
+
+	b := NewMessage().From(from).To(to...)
+	if locale != "" {
+		b.Locale(locale)
+	}
+
+	m, err := b.Template(p.templates, name, data).Test().Build()
+	if err != nil {
+		return err
+	}
+
+	return p.mailer.Send(m)
+}
+
+// LintTemplate checks the named template before deploying it
+// (see [Templates.LintTemplate]).
+func (p *Plugin) LintTemplate(name string, opts TemplateLintOptions) ([]TemplateLintIssue, error) {
+	if p.templates == nil {
+		return nil, errors.Str("mailer templates are not configured")
+	}
+
+	return p.templates.LintTemplate(name, opts)
+}
+
+// AddDigestEvent buffers the event in the recipient digest (see [Digest.Add]).
+func (p *Plugin) AddDigestEvent(e DigestEvent) error {
+	if p.digest == nil {
+		return errors.Str("mailer digest is not configured")
+	}
+
+	return p.digest.Add(e)
+}
+
+// ReplayFromEML resends the archived .eml file at path through the
+// plugin mailer pipeline (see the package level [ReplayFromEML]).
+func (p *Plugin) ReplayFromEML(path string, preserveMessageID bool) error {
+	return ReplayFromEML(p.mailer, path, preserveMessageID)
+}
+
+// RequeueFailed requeues the queue dead letters (see [Queue.RequeueFailed]).
+func (p *Plugin) RequeueFailed() (int, error) {
+	if p.queue == nil {
+		return 0, errors.Str("mailer queue is not configured")
+	}
+
+	return p.queue.RequeueFailed()
+}
+
+// Subscribe returns a channel receiving the queue delivery events
+// (see [Queue.Subscribe]) or nil if the queue is not configured.
+func (p *Plugin) Subscribe() <-chan DeliveryEvent {
+	if p.queue == nil {
+		return nil
+	}
+
+	return p.queue.Subscribe()
+}
+
+// Outbox returns a transactional outbox stored in db and relayed to the
+// plugin mailer pipeline (see [Outbox]), to be started and stopped by the app.
+func (p *Plugin) Outbox(db *sql.DB, config OutboxConfig) *Outbox {
+	return NewOutbox(db, p.mailer, config)
+}
+
+// SendLog returns the send log, or nil if it is not configured.
+func (p *Plugin) SendLog() *SQLSendLog {
+	return p.sendLog
+}
+
+// Preferences returns the recipient preferences store,
+// or nil if the preferences are not configured.
+func (p *Plugin) Preferences() *SQLPreferences {
+	return p.preferences
+}
+
+// Suppressions returns the suppression list fed by the bounces and complaints,
+// or nil if the bounce mailbox is not configured.
+func (p *Plugin) Suppressions() SuppressionList {
+	return p.suppress
+}
+
+// Capabilities returns the features supported by the configured backend
+// (and by all tenant backends, if configured).
+func (p *Plugin) Capabilities() Capabilities {
+	if p.tenants != nil {
+		return p.tenants.Capabilities()
+	}
+
+	return CapabilitiesOf(p.transport())
+}
+
+// Ping checks the configured backend connectivity (if supported by the backend).
+func (p *Plugin) Ping(ctx context.Context) error {
+	if pinger, ok := p.transport().(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+// verifyBackend connects and authenticates to the configured backend (and
+// checks that it accepts the configured recipient, if supported), so that
+// the misconfigured credentials fail the start instead of the first send.
+func (p *Plugin) verifyBackend() error {
+	if p.backend == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	var err error
+	switch backend := p.backend.(type) {
+	case Verifier:
+		err = backend.Verify(ctx, p.verifyRecipient)
+	case Pinger:
+		err = backend.Ping(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("backend %q verification failed: %w", p.backendName, err)
+	}
+
+	p.log.Info("mailer backend verified", "backend", p.backendName, "recipient", p.verifyRecipient)
+
+	return nil
+}
+
+// Diagnose checks the published SPF, DKIM and DMARC records of the sending
+// domain (see [Diagnose]) against the configured diagnostics and DKIM keys.
+func (p *Plugin) Diagnose(ctx context.Context, domain string) Diagnosis {
+	config := p.diagnose
+	for _, keys := range p.dkimKeys {
+		config.DKIMKeys = append(config.DKIMKeys, keys()...)
+	}
+
+	return Diagnose(ctx, domain, config)
+}
+
+// Status reports the backend health to the RoadRunner status plugin,
+// along with the backend name, the queue depth and the last sends outcome.
+func (p *Plugin) Status() (*Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	status := &Status{Code: http.StatusOK, Backend: p.backendName, Version: p.rrVersion}
+	if p.switcher != nil {
+		status.Backend, status.DryRun = p.switcher.Active(), p.switcher.DryRun()
+	}
+	p.sends.report(status)
+	if p.queue != nil {
+		status.QueueDepth = p.queue.Len()
+	}
+
+	if err := p.Ping(ctx); err != nil {
+		status.Code = http.StatusServiceUnavailable
+		status.LastError = err.Error()
+		status.LastErrorAt = time.Now()
+
+		return status, err
+	}
+
+	return status, nil
+}
+
+// Ready reports the plugin readiness to the RoadRunner status plugin.
+func (p *Plugin) Ready() (*Status, error) {
+	return p.Status()
+}
+
 func (p *Plugin) Name() string {
 	return PluginName
 }
@@ -0,0 +1,244 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPOP3Timeout = 30 * time.Second
+
+// POP3Config defines a POP3 mailbox settings, eg. of the bounce mailbox (see [BouncePoller]).
+type POP3Config struct {
+	Host     string        `mapstructure:"host" json:"host,omitempty" bson:"host,omitempty"`
+	Port     int           `mapstructure:"port" json:"port,omitempty" bson:"port,omitempty"` // default to 995 with tls, 110 otherwise
+	Username string        `mapstructure:"username" json:"username,omitempty" bson:"username,omitempty"`
+	Password string        `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"`
+	Tls      bool          `mapstructure:"tls" json:"tls,omitempty" bson:"tls,omitempty"`             // implicit TLS, STLS is used otherwise when supported
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"` // dial and per operation timeout, default to 30s
+
+	// TLSConfig is an optional TLS configuration (eg. with custom root CAs).
+	TLSConfig *tls.Config `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the POP3 configuration for common mistakes.
+func (c POP3Config) Validate() error {
+	var errs []error
+
+	if c.Host == "" {
+		errs = append(errs, errors.New("pop3: host is required"))
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("pop3: port must be between 0 and 65535, got %d", c.Port))
+	}
+
+	if c.Username == "" {
+		errs = append(errs, errors.New("pop3: username is required"))
+	}
+
+	if strings.ContainsAny(c.Username+c.Password, "\r\n") {
+		errs = append(errs, errors.New("pop3: username and password must not contain line breaks"))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("pop3: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c POP3Config) Redacted() POP3Config {
+	c.Password = redact(c.Password)
+	c.TLSConfig = nil
+
+	return c
+}
+
+func (c POP3Config) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultPOP3Timeout
+	}
+
+	return c.Timeout
+}
+
+// pop3Conn is a minimal POP3 (RFC 1939) client connection.
+type pop3Conn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialPOP3 connects (upgrading the connection with STLS when supported) and logs in.
+func dialPOP3(ctx context.Context, cfg POP3Config) (*pop3Conn, error) {
+	port := cfg.Port
+	if port == 0 {
+		port = 110
+		if cfg.Tls {
+			port = 995
+		}
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+
+	tlsConfig := cfg.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.Host
+	}
+
+	var conn net.Conn
+	var err error
+	if cfg.Tls {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c := &pop3Conn{conn: conn, text: textproto.NewConn(conn)}
+
+	if _, err := c.readStatus(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	secure := cfg.Tls
+	if !secure {
+		// CAPA is optional, a server without it doesn't support STLS either
+		if capabilities, err := c.CommandLines("CAPA"); err == nil && pop3HasCapability(capabilities, "STLS") {
+			if _, err := c.Command("STLS"); err != nil {
+				c.Close()
+				return nil, err
+			}
+
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			c.conn, c.text = tlsConn, textproto.NewConn(tlsConn)
+			secure = true
+		}
+	}
+
+	// like net/smtp, the credentials are only sent encrypted or to localhost
+	if !secure && !isLocalhost(cfg.Host) {
+		c.Close()
+		return nil, errors.New("unencrypted connection, the server doesn't support STLS")
+	}
+
+	if _, err := c.Command("USER " + cfg.Username); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := c.Command("PASS " + cfg.Password); err != nil {
+		c.Close()
+		return nil, redactError(err, cfg.Password)
+	}
+
+	return c, nil
+}
+
+// Command sends the command, returning the text of its +OK response.
+func (c *pop3Conn) Command(command string) (string, error) {
+	if err := c.text.PrintfLine("%s", command); err != nil {
+		return "", err
+	}
+
+	return c.readStatus()
+}
+
+// CommandLines sends the command, returning the lines of its multi-line response.
+func (c *pop3Conn) CommandLines(command string) ([]string, error) {
+	if _, err := c.Command(command); err != nil {
+		return nil, err
+	}
+
+	return c.text.ReadDotLines()
+}
+
+// UIDL returns the unique ids of the messages by message number.
+func (c *pop3Conn) UIDL() (map[int]string, error) {
+	lines, err := c.CommandLines("UIDL")
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[int]string, len(lines))
+	for _, line := range lines {
+		number, uid, ok := strings.Cut(strings.TrimSpace(line), " ")
+		n, err := strconv.Atoi(number)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("pop3: malformed UIDL line %q", line)
+		}
+		uids[n] = strings.TrimSpace(uid)
+	}
+
+	return uids, nil
+}
+
+// Retrieve returns the raw message.
+func (c *pop3Conn) Retrieve(n int) ([]byte, error) {
+	if _, err := c.Command("RETR " + strconv.Itoa(n)); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(c.text.DotReader())
+}
+
+// Delete marks the message as deleted, it is removed once the session ends (see [pop3Conn.Close]).
+func (c *pop3Conn) Delete(n int) error {
+	_, err := c.Command("DELE " + strconv.Itoa(n))
+
+	return err
+}
+
+// Close ends the session (removing the deleted messages) and closes the connection.
+func (c *pop3Conn) Close() error {
+	_, err := c.Command("QUIT")
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (c *pop3Conn) readStatus() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+
+	if status, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(status), nil
+	}
+
+	return "", fmt.Errorf("pop3: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+}
+
+func pop3HasCapability(capabilities []string, capability string) bool {
+	for _, line := range capabilities {
+		if fields := strings.Fields(strings.ToUpper(line)); len(fields) > 0 && fields[0] == capability {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,601 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPreferencesTable   = "mailer_preferences"
+	defaultPreferencesPeriod  = 24 * time.Hour
+	defaultPreferencesTimeout = 10 * time.Second
+)
+
+// optOutAll is the opt-out of all the messages (but the bypassing ones).
+const optOutAll = "*"
+
+var (
+	_ PreferenceChecker = (*SQLPreferences)(nil)
+	_ PreferenceCounter = (*SQLPreferences)(nil)
+)
+
+// PreferenceChecker is consulted before sending a message to each of its
+// recipients, honoring their notification settings (see [Preferences]).
+type PreferenceChecker interface {
+	// Check returns why the message must not be sent to the recipient
+	// address, or nil if it can be.
+	Check(ctx context.Context, m *Message, address string) (*PreferenceDenial, error)
+}
+
+// PreferenceCounter is optionally implemented by the [PreferenceChecker]
+// with frequency caps, to count the messages once they are sent.
+type PreferenceCounter interface {
+	// Count counts the message sent to the recipient addresses.
+	Count(ctx context.Context, m *Message, addresses []string) error
+}
+
+// PreferenceCheckerFunc is an adapter to allow the use of ordinary functions as [PreferenceChecker].
+type PreferenceCheckerFunc func(ctx context.Context, m *Message, address string) (*PreferenceDenial, error)
+
+// Check implements [PreferenceChecker] interface.
+func (f PreferenceCheckerFunc) Check(ctx context.Context, m *Message, address string) (*PreferenceDenial, error) {
+	return f(ctx, m, address)
+}
+
+// PreferenceReason is the reason of a [PreferenceDenial].
+type PreferenceReason string
+
+const (
+	PreferenceOptOut       PreferenceReason = "opt_out"       // the recipient opted out of the message tag (channel)
+	PreferenceQuietHours   PreferenceReason = "quiet_hours"   // it is the quiet hours of the recipient
+	PreferenceFrequencyCap PreferenceReason = "frequency_cap" // the recipient got too many messages recently
+)
+
+// PreferenceDenial is a recipient that must not be sent a message.
+type PreferenceDenial struct {
+	Address string           `json:"address"`
+	Reason  PreferenceReason `json:"reason"`
+	Detail  string           `json:"detail,omitempty"` // eg. the opted out tag
+	Until   time.Time        `json:"until,omitempty"`  // when the recipient can be sent again, zero for the opt-outs
+}
+
+// PreferenceDeniedError is returned when all recipients of a message denied it.
+type PreferenceDeniedError struct {
+	Denials []PreferenceDenial
+}
+
+func (e *PreferenceDeniedError) Error() string {
+	addresses := make([]string, len(e.Denials))
+	for i, d := range e.Denials {
+		addresses[i] = d.Address + " (" + string(d.Reason) + ")"
+	}
+
+	return "all recipients denied the message: " + strings.Join(addresses, ", ")
+}
+
+// PreferenceDeferredError is returned when the message was sent to the
+// allowed recipients (if any) but not to the ones in their quiet hours,
+// holding the copy of the message to send them once the quiet hours are
+// over (see [RetryAt]), eg. retried by the [Queue].
+type PreferenceDeferredError struct {
+	Message *Message           // the copy of the message with the deferred recipients only
+	Denials []PreferenceDenial // the quiet hours denials of the deferred recipients
+}
+
+func (e *PreferenceDeferredError) Error() string {
+	addresses := make([]string, len(e.Denials))
+	for i, d := range e.Denials {
+		addresses[i] = d.Address
+	}
+
+	return "message deferred until the end of the quiet hours of " + strings.Join(addresses, ", ")
+}
+
+// RetryTime returns when the quiet hours of all the deferred recipients are over.
+func (e *PreferenceDeferredError) RetryTime() time.Time {
+	var until time.Time
+	for _, d := range e.Denials {
+		if d.Until.After(until) {
+			until = d.Until
+		}
+	}
+
+	return until
+}
+
+// RecipientPreferences are the notification settings of a recipient.
+type RecipientPreferences struct {
+	Address string `json:"address"`
+
+	// OptOuts are the message tags (channels) the recipient opted out
+	// of, eg. "newsletter", or "*" for all messages.
+	OptOuts []string `json:"opt_outs,omitempty"`
+
+	// QuietStart and QuietEnd are the "HH:MM" local times of the quiet
+	// hours of the recipient, eg. "22:00" and "07:00" (disabled if empty).
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+
+	// Timezone is the IANA time zone of the quiet hours, eg. "Europe/Berlin" (default to UTC).
+	Timezone string `json:"timezone,omitempty"`
+
+	// FrequencyCap is the max number of messages per period (see [PreferencesConfig.Period]), unlimited if 0.
+	FrequencyCap int `json:"frequency_cap,omitempty"`
+}
+
+// Validate checks the preferences for common mistakes.
+func (p RecipientPreferences) Validate() error {
+	var errs []error
+
+	if _, err := mail.ParseAddress(p.Address); err != nil {
+		errs = append(errs, fmt.Errorf("preferences: invalid address %q", p.Address))
+	}
+
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		errs = append(errs, errors.New("preferences: both quiet_start and quiet_end are required"))
+	}
+	for _, t := range []string{p.QuietStart, p.QuietEnd} {
+		if _, err := parseClock(t); t != "" && err != nil {
+			errs = append(errs, fmt.Errorf("preferences: invalid quiet hours time %q, expected HH:MM", t))
+		}
+	}
+
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("preferences: invalid timezone %q", p.Timezone))
+	}
+
+	if p.FrequencyCap < 0 {
+		errs = append(errs, fmt.Errorf("preferences: frequency_cap must be positive, got %d", p.FrequencyCap))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Check returns why the message must not be sent at t because of the
+// recipient opt-outs or quiet hours, or nil if it can be.
+// The frequency cap is checked by the store counting the messages.
+func (p RecipientPreferences) Check(m *Message, t time.Time) (*PreferenceDenial, error) {
+	for _, tag := range p.OptOuts {
+		if tag == optOutAll || slices.ContainsFunc(m.Tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			return &PreferenceDenial{Address: p.Address, Reason: PreferenceOptOut, Detail: tag}, nil
+		}
+	}
+
+	if p.QuietStart == "" || p.QuietEnd == "" {
+		return nil, nil
+	}
+
+	start, err := parseClock(p.QuietStart)
+	if err != nil {
+		return nil, fmt.Errorf("preferences: invalid quiet_start %q of %s", p.QuietStart, p.Address)
+	}
+	end, err := parseClock(p.QuietEnd)
+	if err != nil {
+		return nil, fmt.Errorf("preferences: invalid quiet_end %q of %s", p.QuietEnd, p.Address)
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("preferences: invalid timezone %q of %s", p.Timezone, p.Address)
+	}
+
+	if until, quiet := inWindow(t.In(loc), start, end); quiet {
+		return &PreferenceDenial{Address: p.Address, Reason: PreferenceQuietHours, Detail: p.QuietStart + "-" + p.QuietEnd, Until: until}, nil
+	}
+
+	return nil, nil
+}
+
+// parseClock parses the "HH:MM" time of day as the duration since midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inWindow reports whether the local time t is in the [start, end) daily
+// window (wrapping around midnight if end is before start), returning its end.
+func inWindow(t time.Time, start, end time.Duration) (time.Time, bool) {
+	if start == end {
+		return time.Time{}, false
+	}
+
+	day := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	at := func(days int) time.Time { // the window end, days after t
+		return time.Date(t.Year(), t.Month(), t.Day()+days, int(end/time.Hour), int(end%time.Hour/time.Minute), 0, 0, t.Location())
+	}
+
+	switch {
+	case start < end && day >= start && day < end:
+		return at(0), true
+	case start > end && day >= start:
+		return at(1), true
+	case start > end && day < end:
+		return at(0), true
+	}
+
+	return time.Time{}, false
+}
+
+// PreferencesConfig defines the recipient preferences settings,
+// stored in an SQL table (see [SQLPreferences]).
+type PreferencesConfig struct {
+	Driver  string     `mapstructure:"driver" json:"driver,omitempty" bson:"driver,omitempty"`    // the database/sql driver name registered by the app, eg. "pgx", "mysql" or "sqlite"
+	DSN     string     `mapstructure:"dsn" json:"dsn,omitempty" bson:"dsn,omitempty"`             // the driver data source name
+	Dialect SQLDialect `mapstructure:"dialect" json:"dialect,omitempty" bson:"dialect,omitempty"` // postgres (default), mysql or sqlite
+	Table   string     `mapstructure:"table" json:"table,omitempty" bson:"table,omitempty"`       // default to "mailer_preferences"
+	Migrate bool       `mapstructure:"migrate" json:"migrate,omitempty" bson:"migrate,omitempty"` // creates the table if it doesn't exist
+
+	Period  time.Duration `mapstructure:"period" json:"period,omitempty" bson:"period,omitempty"`    // the frequency caps period, default to 24h
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"` // per message checks timeout, default to 10s
+
+	// Bypass are the tags of the messages sent regardless of the
+	// preferences, eg. "transactional" for the password resets.
+	Bypass []string `mapstructure:"bypass" json:"bypass,omitempty" bson:"bypass,omitempty"`
+
+	// Clock is an optional time source (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnDenied is an optional hook called with the removed
+	// recipients of the messages that are still sent.
+	OnDenied func(m *Message, denials []PreferenceDenial) `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when a sent message
+	// could not be counted for the frequency caps.
+	OnError func(m *Message, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the preferences configuration for common mistakes.
+func (c PreferencesConfig) Validate() error {
+	errs := validateSQL("preferences", c.Dialect, c.Table)
+
+	if c.Driver == "" {
+		errs = append(errs, errors.New("preferences: driver is required"))
+	} else if !slices.Contains(sql.Drivers(), c.Driver) {
+		errs = append(errs, fmt.Errorf("preferences: unknown driver %q, it must be imported by the app", c.Driver))
+	}
+
+	if c.DSN == "" {
+		errs = append(errs, errors.New("preferences: dsn is required"))
+	}
+
+	if c.Period < 0 {
+		errs = append(errs, fmt.Errorf("preferences: period must be positive, got %s", c.Period))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("preferences: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c PreferencesConfig) Redacted() PreferencesConfig {
+	c.DSN = redact(c.DSN)
+	c.OnDenied = nil
+	c.OnError = nil
+
+	return c
+}
+
+// Open opens the configured database, creating the table if Migrate is set.
+func (c PreferencesConfig) Open(ctx context.Context) (*SQLPreferences, error) {
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := NewSQLPreferences(db, c)
+	prefs.owned = true
+
+	if c.Migrate {
+		if _, err := db.ExecContext(ctx, prefs.Schema()); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("preferences: failed to create the table: %w", err)
+		}
+	}
+
+	return prefs, nil
+}
+
+// Preferences returns a middleware that removes the recipients denying
+// the messages (see [PreferenceChecker]), failing with a [PreferenceDeniedError]
+// if none is left. The recipients without preferences are always sent.
+//
+// The recipients in their quiet hours are not removed but deferred: the
+// message is sent to the other ones, failing with a [PreferenceDeferredError]
+// holding the copy to send them later. The sent messages are counted for the
+// frequency caps if the checker is a [PreferenceCounter].
+//
+// The test messages (see [MessageBuilder.Test]) and the messages
+// tagged with any of the configured Bypass tags are sent to all recipients.
+func Preferences(checker PreferenceChecker, config PreferencesConfig) Middleware {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultPreferencesTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if m.test || slices.ContainsFunc(m.Tags, func(tag string) bool { return slices.Contains(config.Bypass, tag) }) {
+				return next.Send(m)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			defer cancel()
+
+			var denials, quiet []PreferenceDenial
+			filtered, deferred := m.Clone(), m.Clone()
+
+			lists := []struct{ filtered, deferred *[]mail.Address }{
+				{&filtered.To, &deferred.To}, {&filtered.Cc, &deferred.Cc}, {&filtered.Bcc, &deferred.Bcc},
+			}
+			for _, list := range lists {
+				var kept, later []mail.Address
+				for _, addr := range *list.filtered {
+					denial, err := checker.Check(ctx, m, addr.Address)
+					if err != nil {
+						return fmt.Errorf("failed to check the preferences of %s: %w", addr.Address, err)
+					}
+					switch {
+					case denial == nil:
+						kept = append(kept, addr)
+					case denial.Reason == PreferenceQuietHours:
+						quiet = append(quiet, *denial)
+						later = append(later, addr)
+					default:
+						denials = append(denials, *denial)
+					}
+				}
+				*list.filtered, *list.deferred = kept, later
+			}
+
+			if len(filtered.To)+len(filtered.Cc)+len(filtered.Bcc) == 0 {
+				if len(quiet) == 0 {
+					return &PreferenceDeniedError{Denials: denials}
+				}
+			} else {
+				msg := m
+				if len(denials)+len(quiet) > 0 {
+					msg = filtered
+				}
+
+				if err := next.Send(msg); err != nil {
+					return err
+				}
+
+				// the send may have outlasted the checks timeout
+				ctx, cancel = context.WithTimeout(context.Background(), config.Timeout)
+				defer cancel()
+
+				if counter, ok := checker.(PreferenceCounter); ok {
+					if err := counter.Count(ctx, msg, envelopeRecipients(filtered)); err != nil && config.OnError != nil {
+						config.OnError(msg, err)
+					}
+				}
+			}
+
+			if len(denials) > 0 && config.OnDenied != nil {
+				config.OnDenied(m, denials)
+			}
+
+			if len(quiet) > 0 {
+				return &PreferenceDeferredError{Message: deferred, Denials: quiet}
+			}
+
+			return nil
+		})
+	}
+}
+
+// SQLPreferences stores the recipient preferences in an SQL table,
+// counting the sent messages of the recipients with a frequency cap
+// in fixed periods (starting with their first counted message).
+//
+// The addresses are stored lowercased, the opt-outs as a comma delimited
+// list and the frequency cap periods start as unix milliseconds.
+type SQLPreferences struct {
+	db     *sql.DB
+	config PreferencesConfig
+	owned  bool // whether the db was opened by the preferences
+}
+
+// NewSQLPreferences creates new preferences stored in db.
+func NewSQLPreferences(db *sql.DB, config PreferencesConfig) *SQLPreferences {
+	if config.Table == "" {
+		config.Table = defaultPreferencesTable
+	}
+	if config.Dialect == "" {
+		config.Dialect = SQLPostgres
+	}
+	if config.Period <= 0 {
+		config.Period = defaultPreferencesPeriod
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultPreferencesTimeout
+	}
+
+	return &SQLPreferences{db: db, config: config}
+}
+
+// Schema returns the statement creating the preferences table (if it doesn't exist).
+func (s *SQLPreferences) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + s.config.Table + " (" +
+		"address VARCHAR(320) NOT NULL PRIMARY KEY, " +
+		"opt_outs " + s.config.Dialect.textType() + " NOT NULL, " +
+		"quiet_start VARCHAR(5) NOT NULL, " +
+		"quiet_end VARCHAR(5) NOT NULL, " +
+		"timezone VARCHAR(64) NOT NULL, " +
+		"frequency_cap INTEGER NOT NULL, " +
+		"period_start BIGINT NOT NULL, " +
+		"period_count INTEGER NOT NULL)"
+}
+
+// Get returns the preferences of the address, or nil if it has none.
+func (s *SQLPreferences) Get(ctx context.Context, address string) (*RecipientPreferences, error) {
+	p, _, err := s.get(ctx, address)
+
+	return p, err
+}
+
+// frequencyPeriod is the current frequency cap period of a recipient.
+type frequencyPeriod struct {
+	start int64 // unix milliseconds
+	count int
+}
+
+// get returns the preferences of the address along with its current period.
+func (s *SQLPreferences) get(ctx context.Context, address string) (*RecipientPreferences, frequencyPeriod, error) {
+	row := s.db.QueryRowContext(ctx, s.config.Dialect.bind("SELECT address, opt_outs, quiet_start, quiet_end, timezone, frequency_cap, period_start, period_count FROM "+
+		s.config.Table+" WHERE address = ?"), strings.ToLower(address))
+
+	var p RecipientPreferences
+	var optOuts string
+	var period frequencyPeriod
+	err := row.Scan(&p.Address, &optOuts, &p.QuietStart, &p.QuietEnd, &p.Timezone, &p.FrequencyCap, &period.start, &period.count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, period, nil
+	}
+	if err != nil {
+		return nil, period, fmt.Errorf("preferences: %w", err)
+	}
+	p.OptOuts = parseSendLogList(optOuts)
+
+	return &p, period, nil
+}
+
+// Set stores (or replaces) the preferences of the address,
+// keeping its frequency cap count of the current period.
+func (s *SQLPreferences) Set(ctx context.Context, p RecipientPreferences) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	address := strings.ToLower(p.Address)
+	optOuts := sendLogList(p.OptOuts)
+
+	update := func() (int64, error) {
+		result, err := s.db.ExecContext(ctx, s.config.Dialect.bind("UPDATE "+s.config.Table+
+			" SET opt_outs = ?, quiet_start = ?, quiet_end = ?, timezone = ?, frequency_cap = ? WHERE address = ?"),
+			optOuts, p.QuietStart, p.QuietEnd, p.Timezone, p.FrequencyCap, address)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	n, err := update()
+	if err != nil {
+		return fmt.Errorf("preferences: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	_, err = s.db.ExecContext(ctx, s.config.Dialect.bind("INSERT INTO "+s.config.Table+
+		" (address, opt_outs, quiet_start, quiet_end, timezone, frequency_cap, period_start, period_count)"+
+		" VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		address, optOuts, p.QuietStart, p.QuietEnd, p.Timezone, p.FrequencyCap, 0, 0)
+	if err != nil {
+		// inserted meanwhile, or not updated as unchanged (MySQL)
+		if _, updateErr := update(); updateErr != nil {
+			return fmt.Errorf("preferences: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the preferences of the address, if any.
+func (s *SQLPreferences) Delete(ctx context.Context, address string) error {
+	_, err := s.db.ExecContext(ctx, s.config.Dialect.bind("DELETE FROM "+s.config.Table+" WHERE address = ?"), strings.ToLower(address))
+	if err != nil {
+		return fmt.Errorf("preferences: %w", err)
+	}
+
+	return nil
+}
+
+// Check implements [PreferenceChecker] interface.
+//
+// The messages are counted for the frequency caps only once sent (see [SQLPreferences.Count]).
+func (s *SQLPreferences) Check(ctx context.Context, m *Message, address string) (*PreferenceDenial, error) {
+	p, period, err := s.get(ctx, address)
+	if err != nil || p == nil {
+		return nil, err
+	}
+
+	t := now(s.config.Clock)
+	if denial, err := p.Check(m, t); denial != nil || err != nil {
+		return denial, err
+	}
+
+	if p.FrequencyCap <= 0 {
+		return nil, nil
+	}
+
+	periodEnd := time.UnixMilli(period.start).Add(s.config.Period)
+	if t.Before(periodEnd) && period.count >= p.FrequencyCap {
+		detail := fmt.Sprintf("%d per %s", p.FrequencyCap, s.config.Period)
+		return &PreferenceDenial{Address: p.Address, Reason: PreferenceFrequencyCap, Detail: detail, Until: periodEnd}, nil
+	}
+
+	return nil, nil
+}
+
+// Count implements [PreferenceCounter] interface, counting the message
+// for the recipients with a frequency cap.
+func (s *SQLPreferences) Count(ctx context.Context, m *Message, addresses []string) error {
+	var errs []error
+	for _, address := range addresses {
+		if err := s.count(ctx, address); err != nil {
+			errs = append(errs, fmt.Errorf("preferences: failed to count the message of %s: %w", address, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *SQLPreferences) count(ctx context.Context, address string) error {
+	p, period, err := s.get(ctx, address)
+	if err != nil || p == nil || p.FrequencyCap <= 0 {
+		return err
+	}
+
+	// starts a new period if the current one is over
+	t := now(s.config.Clock)
+	if !t.Before(time.UnixMilli(period.start).Add(s.config.Period)) {
+		result, err := s.db.ExecContext(ctx, s.config.Dialect.bind("UPDATE "+s.config.Table+
+			" SET period_start = ?, period_count = 1 WHERE address = ? AND period_start = ?"),
+			t.UnixMilli(), p.Address, period.start)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		// started meanwhile
+	}
+
+	_, err = s.db.ExecContext(ctx, s.config.Dialect.bind("UPDATE "+s.config.Table+
+		" SET period_count = period_count + 1 WHERE address = ?"), p.Address)
+
+	return err
+}
+
+// Close closes the database if it was opened with [PreferencesConfig.Open].
+func (s *SQLPreferences) Close() error {
+	if !s.owned {
+		return nil
+	}
+
+	return s.db.Close()
+}
@@ -0,0 +1,252 @@
+package mailer
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSQLPreferences(t *testing.T) {
+	ctx := context.Background()
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	db := newFakeSQLDB(t)
+	prefs := NewSQLPreferences(db, PreferencesConfig{Dialect: SQLSQLite, Period: time.Hour, Clock: ClockFunc(func() time.Time { return clock })})
+	if _, err := db.Exec(prefs.Schema()); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := []RecipientPreferences{
+		{Address: "News@example.com", OptOuts: []string{"newsletter"}},
+		{Address: "night@example.com", QuietStart: "22:00", QuietEnd: "07:00", Timezone: "Asia/Tokyo"},
+		{Address: "busy@example.com", FrequencyCap: 2},
+	}
+	for _, s := range settings {
+		if err := prefs.Set(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := prefs.Set(ctx, RecipientPreferences{Address: "news@example.com", OptOuts: []string{"newsletter", "promo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := prefs.Set(ctx, RecipientPreferences{Address: "invalid@example.com", Timezone: "Mars/Olympus"}); err == nil {
+		t.Fatal("Expected the invalid timezone error")
+	}
+
+	got, err := prefs.Get(ctx, "NEWS@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || len(got.OptOuts) != 2 || len(fakeSQLTable(t, db, defaultPreferencesTable)) != 3 {
+		t.Fatalf("Expected the replaced preferences, got %+v", got)
+	}
+
+	check := func(m *Message, address string) *PreferenceDenial {
+		t.Helper()
+
+		denial, err := prefs.Check(ctx, m, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return denial
+	}
+
+	news := &Message{Tags: []string{"Newsletter"}}
+	if d := check(news, "news@example.com"); d == nil || d.Reason != PreferenceOptOut || d.Detail != "newsletter" {
+		t.Fatalf("Expected the opt-out denial, got %+v", d)
+	}
+	if d := check(&Message{}, "news@example.com"); d != nil {
+		t.Fatalf("Expected the untagged message to be allowed, got %+v", d)
+	}
+	if d := check(news, "unknown@example.com"); d != nil {
+		t.Fatalf("Expected the recipient without preferences to be allowed, got %+v", d)
+	}
+
+	// 12:00 UTC is 21:00 in Tokyo
+	if d := check(&Message{}, "night@example.com"); d != nil {
+		t.Fatalf("Expected the message to be allowed before the quiet hours, got %+v", d)
+	}
+	clock = clock.Add(2 * time.Hour)
+	d := check(&Message{}, "night@example.com")
+	if d == nil || d.Reason != PreferenceQuietHours || !d.Until.Equal(time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the quiet hours denial until 07:00 in Tokyo, got %+v", d)
+	}
+
+	for i := 0; i < 2; i++ {
+		if d := check(&Message{}, "busy@example.com"); d != nil {
+			t.Fatalf("Expected the message %d to be allowed, got %+v", i, d)
+		}
+		// not sent
+		if d := check(&Message{}, "busy@example.com"); d != nil {
+			t.Fatalf("Expected the uncounted message %d to be allowed, got %+v", i, d)
+		}
+		if err := prefs.Count(ctx, &Message{}, []string{"Busy@example.com", "unknown@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := check(&Message{}, "busy@example.com"); d == nil || d.Reason != PreferenceFrequencyCap || !d.Until.Equal(clock.Add(time.Hour)) {
+		t.Fatalf("Expected the frequency cap denial, got %+v", d)
+	}
+	clock = clock.Add(time.Hour)
+	if d := check(&Message{}, "busy@example.com"); d != nil {
+		t.Fatalf("Expected the message to be allowed in the next period, got %+v", d)
+	}
+	if err := prefs.Count(ctx, &Message{}, []string{"busy@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if rows := fakeSQLTable(t, db, defaultPreferencesTable); !slices.ContainsFunc(rows, func(row map[string]driver.Value) bool {
+		return row["address"] == "busy@example.com" && fmt.Sprint(row["period_count"]) == "1"
+	}) {
+		t.Fatalf("Expected the next period to start with 1 message, got %v", rows)
+	}
+
+	if err := prefs.Delete(ctx, "news@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := prefs.Get(ctx, "news@example.com"); err != nil || got != nil {
+		t.Fatalf("Expected the preferences to be deleted, got %+v, %v", got, err)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	checker := PreferenceCheckerFunc(func(_ context.Context, m *Message, address string) (*PreferenceDenial, error) {
+		if address == "optout@example.com" {
+			return &PreferenceDenial{Address: address, Reason: PreferenceOptOut}, nil
+		}
+		return nil, nil
+	})
+
+	var sent *Message
+	var denied []PreferenceDenial
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		sent = m
+		return nil
+	}), Preferences(checker, PreferencesConfig{
+		Bypass:   []string{"transactional"},
+		OnDenied: func(m *Message, denials []PreferenceDenial) { denied = denials },
+	}))
+
+	m := &Message{To: []mail.Address{{Address: "optout@example.com"}}, Cc: []mail.Address{{Address: "jane@example.com"}}}
+	if err := mailer.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.To) != 0 || len(sent.Cc) != 1 || len(denied) != 1 || len(m.To) != 1 {
+		t.Fatalf("Expected the opted out recipient to be removed, got %+v (denied %+v)", sent, denied)
+	}
+
+	var deniedErr *PreferenceDeniedError
+	if err := mailer.Send(&Message{To: []mail.Address{{Address: "optout@example.com"}}}); !errors.As(err, &deniedErr) {
+		t.Fatalf("Expected PreferenceDeniedError, got %v", err)
+	}
+
+	for _, m := range []*Message{
+		{To: []mail.Address{{Address: "optout@example.com"}}, Tags: []string{"transactional"}},
+		{To: []mail.Address{{Address: "optout@example.com"}}, test: true},
+	} {
+		if err := mailer.Send(m); err != nil || len(sent.To) != 1 {
+			t.Fatalf("Expected the bypassing message to be sent, got %v", err)
+		}
+	}
+}
+
+func TestPreferencesQuietHours(t *testing.T) {
+	until := time.Date(2024, 1, 2, 7, 0, 0, 0, time.UTC)
+	checker := &countingChecker{check: func(address string) *PreferenceDenial {
+		switch address {
+		case "night@example.com":
+			return &PreferenceDenial{Address: address, Reason: PreferenceQuietHours, Until: until}
+		case "optout@example.com":
+			return &PreferenceDenial{Address: address, Reason: PreferenceOptOut}
+		}
+		return nil
+	}}
+
+	var sent []*Message
+	sendErr := error(nil)
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, m)
+		return nil
+	}), Preferences(checker, PreferencesConfig{}))
+
+	m := &Message{
+		To: []mail.Address{{Address: "jane@example.com"}, {Address: "night@example.com"}},
+		Cc: []mail.Address{{Address: "optout@example.com"}},
+	}
+	err := mailer.Send(m)
+
+	var deferredErr *PreferenceDeferredError
+	if !errors.As(err, &deferredErr) || !deferredErr.RetryTime().Equal(until) {
+		t.Fatalf("Expected PreferenceDeferredError, got %v", err)
+	}
+	if to := deferredErr.Message.To; len(to) != 1 || to[0].Address != "night@example.com" || len(deferredErr.Message.Cc) != 0 {
+		t.Fatalf("Expected the deferred copy of the quiet recipient only, got %+v", deferredErr.Message)
+	}
+	if at, ok := RetryAt(err); !ok || !at.Equal(until) {
+		t.Fatalf("Expected the retry at the end of the quiet hours, got %v", at)
+	}
+
+	if len(sent) != 1 || len(sent[0].To) != 1 || sent[0].To[0].Address != "jane@example.com" || len(sent[0].Cc) != 0 {
+		t.Fatalf("Expected the message to be sent to the allowed recipient, got %+v", sent)
+	}
+	if len(checker.counted) != 1 || checker.counted[0] != "jane@example.com" {
+		t.Fatalf("Expected only the sent recipient to be counted, got %v", checker.counted)
+	}
+
+	// all in quiet hours
+	if err := mailer.Send(deferredErr.Message); !errors.As(err, &deferredErr) || len(sent) != 1 {
+		t.Fatalf("Expected the message to be deferred again, got %v", err)
+	}
+
+	// the failed sends are not counted
+	sendErr = errors.New("unavailable")
+	if err := mailer.Send(&Message{To: []mail.Address{{Address: "jane@example.com"}}}); !errors.Is(err, sendErr) || len(checker.counted) != 1 {
+		t.Fatalf("Expected the failed send not to be counted, got %v (%v)", err, checker.counted)
+	}
+}
+
+// countingChecker is a [PreferenceCounter] recording the counted addresses.
+type countingChecker struct {
+	check   func(address string) *PreferenceDenial
+	counted []string
+}
+
+func (c *countingChecker) Check(_ context.Context, _ *Message, address string) (*PreferenceDenial, error) {
+	return c.check(address), nil
+}
+
+func (c *countingChecker) Count(_ context.Context, _ *Message, addresses []string) error {
+	c.counted = append(c.counted, addresses...)
+	return nil
+}
+
+func TestInWindow(t *testing.T) {
+	scenarios := []struct {
+		at, start, end string
+		until          string // empty if not in the window
+	}{
+		{"2024-01-01T23:00:00Z", "22:00", "07:00", "2024-01-02T07:00:00Z"},
+		{"2024-01-01T03:00:00Z", "22:00", "07:00", "2024-01-01T07:00:00Z"},
+		{"2024-01-01T07:00:00Z", "22:00", "07:00", ""},
+		{"2024-01-01T13:30:00Z", "12:00", "14:00", "2024-01-01T14:00:00Z"},
+		{"2024-01-01T11:59:00Z", "12:00", "14:00", ""},
+	}
+
+	for _, s := range scenarios {
+		at, _ := time.Parse(time.RFC3339, s.at)
+		start, _ := parseClock(s.start)
+		end, _ := parseClock(s.end)
+
+		until, ok := inWindow(at, start, end)
+		if got := until.Format(time.RFC3339); ok != (s.until != "") || (ok && got != s.until) {
+			t.Errorf("%s in %s-%s: expected %q, got %v %s", s.at, s.start, s.end, s.until, ok, got)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// preheaderPadding fills the rest of the inbox preview after the preheader
+// with invisible characters, so that the clients don't append the first
+// visible body text to it.
+var preheaderPadding = strings.Repeat("&#847;&zwnj;&nbsp;", 90)
+
+// preheaderStyle hides the preheader in all major clients (incl. Outlook).
+const preheaderStyle = "display:none;font-size:1px;line-height:1px;max-height:0;max-width:0;" +
+	"opacity:0;overflow:hidden;mso-hide:all;color:transparent;"
+
+var bodyTagRegex = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+// withPreheader returns a copy of the message with its Preheader injected
+// as hidden element right after the HTML <body> opening tag (or at the
+// start of the HTML if there is none) and as first paragraph of the text body.
+//
+// The message itself is returned if there is no preheader.
+func (m *Message) withPreheader() *Message {
+	preheader := strings.Join(strings.Fields(m.Preheader), " ")
+	if preheader == "" {
+		return m
+	}
+
+	m = m.Clone()
+
+	if m.HTML != "" {
+		element := `<div style="` + preheaderStyle + `">` + html.EscapeString(preheader) + preheaderPadding + `</div>`
+
+		if loc := bodyTagRegex.FindStringIndex(m.HTML); loc != nil {
+			m.HTML = m.HTML[:loc[1]] + element + m.HTML[loc[1]:]
+		} else {
+			m.HTML = element + m.HTML
+		}
+	}
+
+	if m.Text != "" {
+		m.Text = preheader + "\n\n" + m.Text
+	}
+
+	return m
+}
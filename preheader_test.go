@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMessagePreheader(t *testing.T) {
+	scenarios := []struct {
+		name         string
+		html         string
+		expectPrefix string
+		expectSuffix string
+	}{
+		{"body tag", `<html><BODY class="x"><p>Hi</p></BODY></html>`, `<html><BODY class="x"><div style="display:none;`, `</div><p>Hi</p></BODY></html>`},
+		{"fragment", `<p>Hi</p>`, `<div style="display:none;`, `</div><p>Hi</p>`},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			m := &Message{HTML: s.html, Text: "Hi", Preheader: " Your order <#42>\tshipped "}
+
+			result := m.withPreheader()
+
+			if !strings.HasPrefix(result.HTML, s.expectPrefix) {
+				t.Fatalf("Expected the HTML to start with %q, got %q", s.expectPrefix, result.HTML)
+			}
+			if !strings.Contains(result.HTML, ">Your order &lt;#42&gt; shipped&#847;") || !strings.HasSuffix(result.HTML, s.expectSuffix) {
+				t.Fatalf("Unexpected HTML %q", result.HTML)
+			}
+			if result.Text != "Your order <#42> shipped\n\nHi" {
+				t.Fatalf("Unexpected text %q", result.Text)
+			}
+
+			// the original message is not modified
+			if m.HTML != s.html || m.Text != "Hi" {
+				t.Fatalf("Expected the original message to be untouched, got %+v", m)
+			}
+		})
+	}
+
+	m := &Message{HTML: "<p>Hi</p>"}
+	if m.withPreheader() != m {
+		t.Fatal("Expected the same message without preheader")
+	}
+}
@@ -0,0 +1,800 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Mailer = (*Queue)(nil)
+
+const (
+	defaultQueueWorkers      = 1
+	defaultQueueSize         = 100
+	defaultQueueDrainTimeout = 30 * time.Second
+	defaultQueueDeadLetters  = 100
+	defaultQueueMaxAttempts  = 1
+	defaultQueueRetryBackoff = time.Minute
+	defaultQueueGreylistWait = 5 * time.Minute
+	defaultQueueLane         = "default"
+)
+
+// laneTagPrefix marks the message tag holding its queue lane (eg. "lane:bulk").
+const laneTagPrefix = "lane:"
+
+var (
+	ErrQueueClosed = errors.New("mailer queue is closed")
+	ErrQueueFull   = errors.New("mailer queue is full")
+)
+
+// QueueConfig defines the async send queue settings.
+type QueueConfig struct {
+	Workers      int           `mapstructure:"workers" json:"workers,omitempty" bson:"workers,omitempty"`                   // the default lane workers, default to 1
+	Size         int           `mapstructure:"size" json:"size,omitempty" bson:"size,omitempty"`                            // the lanes default size, default to 100
+	DrainTimeout time.Duration `mapstructure:"drain_timeout" json:"drain_timeout,omitempty" bson:"drain_timeout,omitempty"` // default to 30s
+	DeadLetters  int           `mapstructure:"dead_letters" json:"dead_letters,omitempty" bson:"dead_letters,omitempty"`    // max failed messages to keep, default to 100, -1 disables
+
+	MaxAttempts   int           `mapstructure:"max_attempts" json:"max_attempts,omitempty" bson:"max_attempts,omitempty"`       // max delivery attempts of the temporary failures, default to 1 (no retries)
+	RetryBackoff  time.Duration `mapstructure:"retry_backoff" json:"retry_backoff,omitempty" bson:"retry_backoff,omitempty"`    // the first retry delay, doubled on every attempt, default to 1m
+	GreylistDelay time.Duration `mapstructure:"greylist_delay" json:"greylist_delay,omitempty" bson:"greylist_delay,omitempty"` // the retry delay of the greylisted messages, default to 5m
+
+	// Lanes are the optional priority lanes, ordered from the highest priority.
+	// The messages are routed by their "lane:{name}" tag, the other ones to the
+	// "default" lane, which has the queue workers and size and, unless listed
+	// among the lanes, the lowest priority.
+	Lanes []QueueLane `mapstructure:"lanes" json:"lanes,omitempty" bson:"lanes,omitempty"`
+
+	// Window is the optional local daytime the non-urgent messages are sent in.
+	Window *DeliveryWindow `mapstructure:"window" json:"window,omitempty" bson:"window,omitempty"`
+
+	// Spool is the optional directory the messages that were not sent
+	// (eg. the deferred ones) are saved to when the queue stops, and
+	// restored from when it starts, so that they survive the restarts.
+	Spool string `mapstructure:"spool" json:"spool,omitempty" bson:"spool,omitempty"`
+}
+
+// QueueLane defines the settings of a queue priority lane.
+//
+// The workers of a lane don't send while any higher priority
+// lane has messages waiting, so that they always preempt it.
+type QueueLane struct {
+	Name      string `mapstructure:"name" json:"name" bson:"name"`
+	Workers   int    `mapstructure:"workers" json:"workers,omitempty" bson:"workers,omitempty"`          // max concurrent sends, default to 1
+	Size      int    `mapstructure:"size" json:"size,omitempty" bson:"size,omitempty"`                   // default to the queue size
+	PerMinute int    `mapstructure:"per_minute" json:"per_minute,omitempty" bson:"per_minute,omitempty"` // max messages per minute, 0 means unlimited
+}
+
+// Validate checks the queue configuration for common mistakes.
+func (c QueueConfig) Validate() error {
+	var errs []error
+
+	if c.Workers < 0 {
+		errs = append(errs, fmt.Errorf("queue: workers must be positive, got %d", c.Workers))
+	}
+
+	if c.Size < 0 {
+		errs = append(errs, fmt.Errorf("queue: size must be positive, got %d", c.Size))
+	}
+
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("queue: drain_timeout must be positive, got %s", c.DrainTimeout))
+	}
+
+	if c.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("queue: max_attempts must be positive, got %d", c.MaxAttempts))
+	}
+
+	if c.RetryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("queue: retry_backoff must be positive, got %s", c.RetryBackoff))
+	}
+
+	if c.GreylistDelay < 0 {
+		errs = append(errs, fmt.Errorf("queue: greylist_delay must be positive, got %s", c.GreylistDelay))
+	}
+
+	if c.DeadLetters < -1 {
+		errs = append(errs, fmt.Errorf("queue: dead_letters must be positive or -1, got %d", c.DeadLetters))
+	}
+
+	seen := make(map[string]struct{}, len(c.Lanes))
+	for i, lane := range c.Lanes {
+		name := strings.TrimSpace(lane.Name)
+		if name == "" {
+			errs = append(errs, fmt.Errorf("queue: lanes[%d] name is required", i))
+		} else if _, ok := seen[name]; ok {
+			errs = append(errs, fmt.Errorf("queue: duplicated lane %q", lane.Name))
+		}
+		seen[name] = struct{}{}
+
+		if lane.Workers < 0 {
+			errs = append(errs, fmt.Errorf("queue: lanes[%d] workers must be positive, got %d", i, lane.Workers))
+		}
+		if lane.Size < 0 {
+			errs = append(errs, fmt.Errorf("queue: lanes[%d] size must be positive, got %d", i, lane.Size))
+		}
+		if lane.PerMinute < 0 {
+			errs = append(errs, fmt.Errorf("queue: lanes[%d] per_minute must be positive, got %d", i, lane.PerMinute))
+		} else if lane.PerMinute > maxPerMinute {
+			errs = append(errs, fmt.Errorf("queue: lanes[%d] per_minute must be at most %d, got %d", i, maxPerMinute, lane.PerMinute))
+		}
+	}
+
+	if c.Window != nil {
+		errs = append(errs, c.Window.validate()...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Queue is an async [Mailer] that buffers the messages in memory
+// and delivers them in the background through the next mailer.
+//
+// The temporary failures (see [IsTemporary]) are retried up to the
+// configured max attempts, after the greylist delay for the greylisted
+// messages (see [IsGreylisted]) or with an exponential backoff otherwise.
+// The deferred sends (see [RetryAt]) are retried at their retry time.
+//
+// The messages that failed to be delivered are kept as dead letters
+// (up to the configured limit, dropping the oldest ones) so that they
+// could be requeued with [Queue.RequeueFailed].
+//
+// The messages can be split into priority lanes (see [QueueLane]),
+// eg. to send the transactional ones before the newsletters, and deferred
+// to a specific time (see [WithSendAt]) or to the recipient daytime (see
+// [DeliveryWindow]). The messages denied by the recipient preferences
+// until a specific time (see [PreferenceDeniedError]) are retried then,
+// regardless of the max attempts.
+type Queue struct {
+	// OnError is called (if set) with every message that failed to be delivered.
+	OnError func(m *Message, err error)
+
+	// Clock is an optional time source (default to the system clock).
+	Clock Clock
+
+	// Timezone is an optional hook resolving the IANA timezone of the message
+	// recipient (eg. from the user profile) for the delivery window, unless
+	// set with [WithTimezone]. An empty timezone falls back to the window one.
+	Timezone func(m *Message) string
+
+	next   Mailer
+	config QueueConfig
+	lanes  []*queueLane // ordered by priority
+
+	mu      sync.RWMutex
+	started bool
+	closed  bool
+	wg      sync.WaitGroup
+
+	deadMu      sync.Mutex
+	deadLetters []*queueJob
+	retries     map[*queueJob]*time.Timer // the scheduled retries and deferred jobs
+
+	pauseMu sync.Mutex          // guards the lanes pending and held jobs
+	paused  map[string]struct{} // the paused tags (see [Queue.Pause])
+
+	taken *sync.Cond // broadcast when jobs are taken out of the lanes (see [Queue.yield])
+
+	events eventHub
+}
+
+// NewQueue creates a new async queue that delivers through next.
+func NewQueue(next Mailer, config QueueConfig) *Queue {
+	if config.Workers <= 0 {
+		config.Workers = defaultQueueWorkers
+	}
+	if config.Size <= 0 {
+		config.Size = defaultQueueSize
+	}
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = defaultQueueDrainTimeout
+	}
+	if config.DeadLetters == 0 {
+		config.DeadLetters = defaultQueueDeadLetters
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultQueueMaxAttempts
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultQueueRetryBackoff
+	}
+	if config.GreylistDelay <= 0 {
+		config.GreylistDelay = defaultQueueGreylistWait
+	}
+
+	q := &Queue{next: next, config: config, taken: sync.NewCond(&sync.Mutex{})}
+
+	hasDefault := false
+	for _, lane := range config.Lanes {
+		lane.Name = strings.TrimSpace(lane.Name)
+		if lane.Name == defaultQueueLane {
+			hasDefault = true
+			if lane.Workers <= 0 {
+				lane.Workers = config.Workers
+			}
+		}
+		q.lanes = append(q.lanes, newQueueLane(lane, config))
+	}
+	if !hasDefault {
+		q.lanes = append(q.lanes, newQueueLane(QueueLane{Name: defaultQueueLane, Workers: config.Workers, Size: config.Size}, config))
+	}
+
+	return q
+}
+
+// queueLane is a queue priority lane with its own workers.
+//
+// The paused jobs are held by the lane and still count toward its
+// size, so that it fills up with [ErrQueueFull] while paused.
+type queueLane struct {
+	config  QueueLane
+	jobs    chan *queueJob
+	rate    *domainThrottle // the lane rate limit
+	held    []*queueJob     // the paused jobs (see [Queue.Pause])
+	pending int             // the waiting and held jobs
+}
+
+func newQueueLane(config QueueLane, queue QueueConfig) *queueLane {
+	if config.Workers <= 0 {
+		config.Workers = defaultQueueWorkers
+	}
+	if config.Size <= 0 {
+		config.Size = queue.Size
+	}
+
+	return &queueLane{
+		config: config,
+		jobs:   make(chan *queueJob, config.Size),
+		rate:   &domainThrottle{limit: DomainLimit{PerMinute: config.PerMinute}},
+	}
+}
+
+// lane returns the lane of the message, ie. of its "lane:{name}"
+// tag, falling back to the default lane for the unknown ones.
+func (q *Queue) lane(m *Message) *queueLane {
+	name := defaultQueueLane
+	for _, tag := range m.Tags {
+		if strings.HasPrefix(tag, laneTagPrefix) {
+			name = tag[len(laneTagPrefix):]
+			break
+		}
+	}
+
+	var fallback *queueLane
+	for _, lane := range q.lanes {
+		if lane.config.Name == name {
+			return lane
+		}
+		if lane.config.Name == defaultQueueLane {
+			fallback = lane
+		}
+	}
+
+	return fallback
+}
+
+// Start starts the queue workers and restores the spooled messages
+// (if configured). It is no-op if the queue is already started.
+//
+// The spooled messages that could not be restored (eg. the lane is full)
+// are reported by the error and kept in the spool for the next start.
+func (q *Queue) Start() error {
+	q.mu.Lock()
+	if q.started || q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.started = true
+
+	for i, lane := range q.lanes {
+		for j := 0; j < lane.config.Workers; j++ {
+			q.wg.Add(1)
+			go q.work(lane, q.lanes[:i])
+		}
+	}
+	q.mu.Unlock()
+
+	if q.config.Spool == "" {
+		return nil
+	}
+
+	return q.restore()
+}
+
+// Send implements `mailer.Mailer` interface.
+//
+// It enqueues a copy of the message and returns immediately.
+// The attachments that cannot be cloned are read into memory,
+// so that the message could be retried if it fails.
+func (q *Queue) Send(m *Message) error {
+	_, err := q.Enqueue(m)
+
+	return err
+}
+
+// Enqueue enqueues a copy of the message like [Queue.Send], configured
+// with the options (eg. [WithDisposition]), and returns its queue id.
+//
+// The options set with [Plugin.Enqueue] are applied first.
+func (q *Queue) Enqueue(m *Message, opts ...QueueOption) (string, error) {
+	m = m.Clone()
+	if err := m.bufferAttachments(); err != nil {
+		return "", err
+	}
+
+	job := &queueJob{id: PseudorandomString(20), message: m}
+	job.lane = q.lane(m)
+	for _, opt := range append(m.queueOptions, opts...) {
+		opt(job)
+	}
+	m.queueOptions = nil
+
+	if err := q.add(job); err != nil {
+		return "", err
+	}
+
+	return job.id, nil
+}
+
+// add enqueues the job, or defers it to its send time or delivery window.
+func (q *Queue) add(job *queueJob) error {
+	t := now(q.Clock)
+	at := t
+	if job.sendAt.After(at) {
+		at = job.sendAt
+	}
+	at, err := q.deliverAt(job, at)
+	if err != nil {
+		return err
+	}
+	if at.After(t) {
+		return q.deferJob(job, at)
+	}
+
+	return q.enqueue(job, DeliveryQueued)
+}
+
+// Subscribe returns a channel receiving the delivery events of all
+// queued messages.
+//
+// The events are dropped (instead of blocking the delivery) when the
+// channel buffer is full, so subscribers should drain it promptly.
+// The channel is closed on [Queue.Unsubscribe] or when the queue stops.
+func (q *Queue) Subscribe() <-chan DeliveryEvent {
+	return q.events.subscribe()
+}
+
+// Unsubscribe stops and closes the specified subscription channel.
+func (q *Queue) Unsubscribe(ch <-chan DeliveryEvent) {
+	q.events.unsubscribe(ch)
+}
+
+// Publish sends the event to the subscribers, eg. a bounce reported after the delivery.
+func (q *Queue) Publish(event DeliveryEvent) {
+	if event.At.IsZero() {
+		event.At = now(q.Clock)
+	}
+
+	q.events.emit(event)
+}
+
+func (q *Queue) emit(job *queueJob, status DeliveryStatus, err error) {
+	q.events.emit(q.event(job, status, err))
+}
+
+func (q *Queue) event(job *queueJob, status DeliveryStatus, err error) DeliveryEvent {
+	attempt := len(job.attempts)
+	if status == DeliverySending || status == DeliverySent {
+		attempt++
+	}
+
+	return DeliveryEvent{
+		ID:            job.id,
+		CorrelationID: job.correlationID,
+		Status:        status,
+		Attempt:       attempt,
+		Err:           err,
+		At:            now(q.Clock),
+		Message:       job.message,
+	}
+}
+
+// queueJob is a single queued message with its delivery history.
+type queueJob struct {
+	id       string
+	message  *Message
+	lane     *queueLane
+	attempts []DeliveryAttempt
+
+	correlationID string
+	expires       time.Time
+	sendAt        time.Time // see [WithSendAt]
+	retryAt       time.Time // the scheduled retry or deferred send time
+	timezone      string    // see [WithTimezone]
+	urgent        bool      // see [WithUrgent]
+	onDisposition func(Disposition)
+	disposeOnce   sync.Once
+}
+
+// enqueue pushes the job into the queue, emitting the specified status event on success.
+func (q *Queue) enqueue(job *queueJob, status DeliveryStatus) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	return q.events.emitAfter(func() error {
+		q.pauseMu.Lock()
+		defer q.pauseMu.Unlock()
+
+		if job.lane.pending >= cap(job.lane.jobs) {
+			return ErrQueueFull
+		}
+
+		select {
+		case job.lane.jobs <- job:
+			job.lane.pending++
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}, q.event(job, status, nil))
+}
+
+// Len returns the number of messages waiting to be delivered, including the paused ones.
+func (q *Queue) Len() int {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+
+	n := 0
+	for _, lane := range q.lanes {
+		n += len(lane.jobs) + len(lane.held)
+	}
+
+	return n
+}
+
+// LaneLen returns the number of messages waiting to be delivered
+// in the lane, including the paused ones.
+func (q *Queue) LaneLen(name string) int {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+
+	n := 0
+	for _, lane := range q.lanes {
+		if lane.config.Name == name {
+			n += len(lane.jobs) + len(lane.held)
+		}
+	}
+
+	return n
+}
+
+// Stop stops accepting new messages and waits for the already enqueued
+// ones to be delivered, but no longer than the configured drain timeout
+// (or the ctx deadline, if sooner).
+//
+// The messages that were not sent (see [Queue.Shutdown]) are reported by the error.
+func (q *Queue) Stop(ctx context.Context) error {
+	unsent, err := q.Shutdown(ctx)
+	if err == nil && len(unsent) > 0 {
+		err = fmt.Errorf("mailer queue stopped, %d messages were not sent", len(unsent))
+	}
+
+	return err
+}
+
+// Shutdown stops the queue like [Queue.Stop] and returns the messages that
+// were not sent, ie. the held, deferred and scheduled for retry ones, along
+// with the waiting ones if the drain was interrupted, so that the caller
+// could persist or send them again. They are returned as dead letters with
+// the [ErrQueueClosed] error, but are not kept by the queue.
+//
+// With a spool directory (see [QueueConfig]), they are saved there instead
+// (without their [WithDisposition] callback) and only the ones that could
+// not be saved are returned.
+func (q *Queue) Shutdown(ctx context.Context) ([]*DeadLetter, error) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, nil
+	}
+	q.closed = true
+	for _, lane := range q.lanes {
+		close(lane.jobs)
+	}
+	started := q.started
+	q.mu.Unlock()
+
+	defer q.events.close()
+
+	if !started {
+		return q.spoolUnsent(q.unsent())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.config.DrainTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return q.spoolUnsent(q.unsent())
+	case <-ctx.Done():
+		unsent, err := q.spoolUnsent(q.unsent())
+		return unsent, errors.Join(fmt.Errorf("mailer queue drain interrupted, %d messages were not sent: %w", len(unsent), ctx.Err()), err)
+	}
+}
+
+// spoolUnsent saves the unsent jobs in the spool (if configured),
+// returning the dead letters of the ones that were not saved.
+func (q *Queue) spoolUnsent(jobs []*queueJob) ([]*DeadLetter, error) {
+	if q.config.Spool != "" {
+		return q.spoolAll(jobs)
+	}
+
+	unsent := make([]*DeadLetter, len(jobs))
+	for i, job := range jobs {
+		unsent[i] = q.takeOut(job, ErrQueueClosed)
+	}
+
+	return unsent, nil
+}
+
+// unsent takes out all the jobs of the closed queue that are not being sent.
+func (q *Queue) unsent() []*queueJob {
+	jobs := q.takeRetries()
+
+	q.pauseMu.Lock()
+	for _, lane := range q.lanes {
+		jobs = append(jobs, lane.held...)
+		lane.held = nil
+
+		for job := range lane.jobs {
+			jobs = append(jobs, job)
+		}
+	}
+	q.pauseMu.Unlock()
+	q.tookOut()
+
+	return jobs
+}
+
+// work delivers the jobs of the lane, waiting for the higher priority lanes to be empty.
+func (q *Queue) work(lane *queueLane, higher []*queueLane) {
+	defer q.wg.Done()
+
+	for job := range lane.jobs {
+		q.tookOut()
+		q.yield(higher)
+
+		if q.hold(job) {
+			continue
+		}
+
+		// the lane rate only delays the sends (without practical deadline)
+		_, _ = lane.rate.reserve(lane.config.Name, now(q.Clock).AddDate(1, 0, 0), q.Clock)
+
+		if job.expired(now(q.Clock)) {
+			q.expire(job)
+			continue
+		}
+
+		attempt := DeliveryAttempt{At: now(q.Clock)}
+		q.emit(job, DeliverySending, nil)
+
+		// send a copy so that the job attachments could be reused on retry
+		result, ok, err := SendWithResult(q.next, job.message)
+		if err == nil {
+			event := q.event(job, DeliverySent, nil)
+			if ok {
+				event.Result = &result
+			}
+			q.events.emit(event)
+			q.dispose(job, DeliverySent, nil)
+			continue
+		}
+
+		// sent to the other recipients, the permanently failed ones are
+		// reported apart and the retry is chosen by the retryable ones only
+		var fanOutErr *FanOutError
+		if errors.As(err, &fanOutErr) && fanOutErr.Message != nil {
+			if fanOutErr.Permanent != nil {
+				q.failRecipients(job, fanOutErr)
+			}
+			job.message, err = fanOutErr.Message, fanOutErr.retryable()
+		}
+
+		// the deferred sends are not failures, so they don't count as attempts
+		attempt.Err = err
+		if _, ok := deferralDelay(err, now(q.Clock)); !ok {
+			job.attempts = append(job.attempts, attempt)
+		}
+
+		// neither sent nor failed
+		if errors.Is(err, ErrDryRun) {
+			q.emit(job, DeliveryDiscarded, err)
+			q.dispose(job, DeliveryDiscarded, err)
+			continue
+		}
+
+		// sent to the other recipients, only the deferred ones are left
+		var deferred *PreferenceDeferredError
+		if errors.As(err, &deferred) && deferred.Message != nil {
+			job.message = deferred.Message
+		}
+
+		if delay, ok := q.retryDelay(job, err); ok {
+			t := now(q.Clock)
+			if at, err := q.deliverAt(job, t.Add(delay)); err == nil {
+				delay = at.Sub(t)
+			}
+
+			if job.expired(t.Add(delay)) {
+				q.expire(job)
+				continue
+			}
+
+			q.scheduleRetry(job, delay, err)
+			continue
+		}
+
+		q.fail(job, err)
+	}
+}
+
+// yield waits until all the specified lanes have no message waiting.
+func (q *Queue) yield(lanes []*queueLane) {
+	if len(lanes) == 0 {
+		return
+	}
+
+	q.taken.L.Lock()
+	defer q.taken.L.Unlock()
+
+	for slices.ContainsFunc(lanes, func(lane *queueLane) bool { return len(lane.jobs) > 0 }) {
+		q.taken.Wait()
+	}
+}
+
+// tookOut wakes up the workers waiting for the lanes to be empty (see [Queue.yield]).
+//
+// It must be called after taking jobs out of the lanes, the jobs being
+// added meanwhile only making the lanes busy.
+func (q *Queue) tookOut() {
+	q.taken.L.Lock()
+	q.taken.Broadcast()
+	q.taken.L.Unlock()
+}
+
+// fail moves the job in the dead letters, recording the error
+// as its attempt if it was never attempted (eg. a deferred job).
+func (q *Queue) fail(job *queueJob, err error) {
+	if len(job.attempts) == 0 {
+		job.attempts = append(job.attempts, DeliveryAttempt{At: now(q.Clock), Err: err})
+	}
+
+	q.addDeadLetter(job)
+	q.emit(job, DeliveryFailed, err)
+	q.dispose(job, DeliveryFailed, err)
+
+	if q.OnError != nil {
+		q.OnError(job.message, err)
+	}
+}
+
+// failRecipients moves the copy of the job message to the permanently
+// failed recipients of its separate delivery in the dead letters (with
+// its own id and the job correlation id), the job being retried for the
+// other ones.
+func (q *Queue) failRecipients(job *queueJob, fanOutErr *FanOutError) {
+	err := &FanOutError{Results: fanOutErr.PermanentlyFailed(), Permanent: fanOutErr.Permanent}
+
+	failed := &queueJob{
+		id:            PseudorandomString(20),
+		message:       fanOutErr.Permanent,
+		lane:          job.lane,
+		correlationID: job.correlationID,
+		attempts:      append(slices.Clone(job.attempts), DeliveryAttempt{At: now(q.Clock), Err: err}),
+	}
+	q.addDeadLetter(failed)
+
+	if q.OnError != nil {
+		q.OnError(failed.message, err)
+	}
+}
+
+// retryDelay returns the delay of the next job delivery attempt
+// or false if the error should not be retried.
+func (q *Queue) retryDelay(job *queueJob, err error) (time.Duration, bool) {
+	if delay, ok := deferralDelay(err, now(q.Clock)); ok {
+		return delay, true
+	}
+
+	attempts := len(job.attempts)
+	if attempts >= q.config.MaxAttempts {
+		return 0, false
+	}
+
+	if IsGreylisted(err) {
+		return q.config.GreylistDelay, true
+	}
+
+	if IsTemporary(err) {
+		return q.config.RetryBackoff << (attempts - 1), true
+	}
+
+	return 0, false
+}
+
+// deferralDelay returns the delay of the deferred sends, ie. delayed by the
+// recipient preferences or deferred to their RetryAt time (see [RetryAt]),
+// or false if the error is not a deferral.
+func deferralDelay(err error, t time.Time) (time.Duration, bool) {
+	if delay, ok := preferenceDelay(err, t); ok {
+		return delay, true
+	}
+
+	if at, ok := RetryAt(err); ok {
+		return max(at.Sub(t), 0), true
+	}
+
+	return 0, false
+}
+
+// scheduleRetry enqueues the job again after the specified delay.
+// The retries scheduled while the queue stops are returned by [Queue.Shutdown].
+func (q *Queue) scheduleRetry(job *queueJob, delay time.Duration, err error) {
+	q.after(job, delay)
+	q.emit(job, DeliveryRetrying, err)
+}
+
+// after enqueues the job after the specified delay.
+func (q *Queue) after(job *queueJob, delay time.Duration) {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	if q.retries == nil {
+		q.retries = map[*queueJob]*time.Timer{}
+	}
+	job.retryAt = now(q.Clock).Add(delay)
+
+	q.retries[job] = time.AfterFunc(delay, func() {
+		q.deadMu.Lock()
+		_, ok := q.retries[job]
+		delete(q.retries, job)
+		q.deadMu.Unlock()
+
+		if !ok {
+			return // canceled on stop
+		}
+
+		if err := q.enqueue(job, DeliveryQueued); err != nil {
+			q.fail(job, err)
+		}
+	})
+}
+
+// takeRetries stops all scheduled retries and returns their jobs.
+func (q *Queue) takeRetries() []*queueJob {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+
+	jobs := make([]*queueJob, 0, len(q.retries))
+	for job, timer := range q.retries {
+		timer.Stop()
+		jobs = append(jobs, job)
+	}
+	q.retries = nil
+
+	return jobs
+}
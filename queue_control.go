@@ -0,0 +1,223 @@
+package mailer
+
+import (
+	"errors"
+	"slices"
+	"sort"
+)
+
+// ErrQueueDrained is the error of the drained messages (see [Queue.Drain]).
+var ErrQueueDrained = errors.New("mailer queue drained")
+
+// pauseAll is the paused tag holding all messages.
+const pauseAll = "*"
+
+// Pause holds the queued messages with any of the specified tags (eg.
+// "newsletter" or "lane:bulk" for a whole lane), or all messages if none
+// is specified, until they are resumed. The held messages are not sent
+// but still counted by [Queue.Len].
+func (q *Queue) Pause(tags ...string) {
+	if len(tags) == 0 {
+		tags = []string{pauseAll}
+	}
+
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+
+	if q.paused == nil {
+		q.paused = map[string]struct{}{}
+	}
+	for _, tag := range tags {
+		q.paused[tag] = struct{}{}
+	}
+}
+
+// Resume resumes the specified paused tags (or all of them if none is
+// specified), requeuing the held messages that are not paused anymore.
+// It returns the number of the requeued messages.
+func (q *Queue) Resume(tags ...string) int {
+	q.pauseMu.Lock()
+	if len(tags) == 0 {
+		q.paused = nil
+	}
+	for _, tag := range tags {
+		delete(q.paused, tag)
+	}
+
+	// the resumed jobs keep their lane slot, so that they can always be requeued
+	var resumed []*queueJob
+	for _, lane := range q.lanes {
+		held := lane.held[:0:0]
+		for _, job := range lane.held {
+			if q.isPaused(job) {
+				held = append(held, job)
+			} else {
+				resumed = append(resumed, job)
+			}
+		}
+		lane.held = held
+	}
+	q.pauseMu.Unlock()
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	n := 0
+	for _, job := range resumed {
+		err := ErrQueueClosed
+		if !q.closed {
+			err = q.events.emitAfter(func() error {
+				select {
+				case job.lane.jobs <- job:
+					return nil
+				default:
+					return ErrQueueFull
+				}
+			}, q.event(job, DeliveryQueued, nil))
+		}
+
+		if err != nil {
+			// held again, so that it is returned on stop
+			q.pauseMu.Lock()
+			job.lane.held = append(job.lane.held, job)
+			q.pauseMu.Unlock()
+			continue
+		}
+		n++
+	}
+
+	return n
+}
+
+// Paused returns the paused tags, sorted, where "*" means all messages.
+func (q *Queue) Paused() []string {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+
+	tags := make([]string, 0, len(q.paused))
+	for tag := range q.paused {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags
+}
+
+// Drain removes the waiting messages (including the held and the
+// scheduled retries) with any of the specified tags, or all of them
+// if none is specified, and returns them as dead letters with the
+// [ErrQueueDrained] error, so that the caller could still send them.
+// They are not kept by the queue.
+//
+// The messages being sent when it is called are not affected.
+func (q *Queue) Drain(tags ...string) []*DeadLetter {
+	match := func(job *queueJob) bool {
+		return len(tags) == 0 || slices.ContainsFunc(job.tags(), func(tag string) bool {
+			return slices.Contains(tags, tag)
+		})
+	}
+
+	var drained []*queueJob
+
+	q.deadMu.Lock()
+	for job, timer := range q.retries {
+		if match(job) {
+			timer.Stop()
+			delete(q.retries, job)
+			drained = append(drained, job)
+		}
+	}
+	q.deadMu.Unlock()
+
+	q.mu.RLock()
+	q.pauseMu.Lock()
+	for _, lane := range q.lanes {
+		held := lane.held[:0:0]
+		for _, job := range lane.held {
+			if match(job) {
+				drained = append(drained, job)
+				lane.pending--
+			} else {
+				held = append(held, job)
+			}
+		}
+		lane.held = held
+
+		if q.closed {
+			continue
+		}
+
+		// the jobs put back keep their slot, so that the lane cannot fill up meanwhile
+		for i, n := 0, len(lane.jobs); i < n; i++ {
+			var job *queueJob
+			select {
+			case job = <-lane.jobs:
+			default:
+			}
+			if job == nil {
+				break // taken by a worker meanwhile
+			}
+
+			if match(job) {
+				drained = append(drained, job)
+				lane.pending--
+				continue
+			}
+			lane.jobs <- job
+		}
+	}
+	q.pauseMu.Unlock()
+	q.mu.RUnlock()
+	q.tookOut()
+
+	result := make([]*DeadLetter, len(drained))
+	for i, job := range drained {
+		result[i] = q.takeOut(job, ErrQueueDrained)
+	}
+
+	return result
+}
+
+// hold sets aside the job if it is paused, returning whether it was held.
+// Otherwise the job leaves its lane, freeing its slot.
+func (q *Queue) hold(job *queueJob) bool {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+
+	if !q.isPaused(job) {
+		job.lane.pending--
+		return false
+	}
+	job.lane.held = append(job.lane.held, job)
+
+	return true
+}
+
+// isPaused reports whether the job is paused, the pauseMu must be held.
+func (q *Queue) isPaused(job *queueJob) bool {
+	if _, ok := q.paused[pauseAll]; ok {
+		return true
+	}
+
+	for _, tag := range job.tags() {
+		if _, ok := q.paused[tag]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tags returns the job message tags along with its lane one,
+// so that the messages of the default lane match "lane:default".
+func (job *queueJob) tags() []string {
+	return append([]string{laneTagPrefix + job.lane.config.Name}, job.message.Tags...)
+}
+
+// takeOut records the error as a job attempt and returns its dead letter,
+// without keeping it (see [Queue.Drain]).
+func (q *Queue) takeOut(job *queueJob, err error) *DeadLetter {
+	job.attempts = append(job.attempts, DeliveryAttempt{At: now(q.Clock), Err: err})
+
+	return newDeadLetter(job)
+}
@@ -0,0 +1,161 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueuePause(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		sent = append(sent, m.Subject)
+		mu.Unlock()
+		return nil
+	}), QueueConfig{Size: 10, Lanes: []QueueLane{{Name: "bulk"}}})
+	queue.Start()
+
+	sentSubjects := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(sent)
+	}
+
+	queue.Pause("newsletter", "lane:bulk")
+	if paused := queue.Paused(); !slices.Equal(paused, []string{"lane:bulk", "newsletter"}) {
+		t.Fatalf("Expected the paused tags, got %v", paused)
+	}
+
+	messages := []*Message{
+		{Subject: "otp"},
+		{Subject: "news", Tags: []string{"newsletter"}},
+		{Subject: "bulk", Tags: []string{"lane:bulk"}},
+	}
+	for _, m := range messages {
+		if err := queue.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool { return len(sentSubjects()) == 1 && queue.Len() == 2 })
+	if s := sentSubjects(); s[0] != "otp" {
+		t.Fatalf("Expected only the not paused message to be sent, got %v", s)
+	}
+	if n := queue.LaneLen("bulk"); n != 1 {
+		t.Fatalf("Expected 1 held bulk message, got %d", n)
+	}
+
+	if n := queue.Resume("newsletter"); n != 1 {
+		t.Fatalf("Expected 1 resumed message, got %d", n)
+	}
+	waitFor(t, func() bool { return len(sentSubjects()) == 2 })
+
+	queue.Pause()
+	if err := queue.Send(&Message{Subject: "later"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return queue.Len() == 2 })
+
+	if n := queue.Resume(); n != 2 {
+		t.Fatalf("Expected 2 resumed messages, got %d", n)
+	}
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := sentSubjects(); len(s) != 4 || len(queue.Paused()) != 0 {
+		t.Fatalf("Expected all messages to be sent, got %v", s)
+	}
+}
+
+func TestQueuePausedOnStop(t *testing.T) {
+	queue := NewQueue(MailerFunc(func(m *Message) error { return nil }), QueueConfig{Size: 1})
+	queue.Start()
+	queue.Pause()
+
+	if err := queue.Send(&Message{Subject: "held"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		queue.pauseMu.Lock()
+		defer queue.pauseMu.Unlock()
+		return len(queue.lanes[0].held) == 1
+	})
+
+	// the held message still takes its lane slot
+	if err := queue.Send(&Message{Subject: "full"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+
+	unsent, err := queue.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unsent) != 1 || unsent[0].Message.Subject != "held" || !errors.Is(unsent[0].Err, ErrQueueClosed) {
+		t.Fatalf("Expected the held message to be returned, got %+v", unsent)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected no dead letter, got %+v", dls)
+	}
+}
+
+func TestQueueDrain(t *testing.T) {
+	var sent []string
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		sent = append(sent, m.Subject)
+		return nil
+	}), QueueConfig{Size: 10})
+
+	messages := []*Message{
+		{Subject: "otp"},
+		{Subject: "news1", Tags: []string{"newsletter"}},
+		{Subject: "promo", Tags: []string{"marketing"}},
+		{Subject: "news2", Tags: []string{"newsletter"}},
+	}
+	for _, m := range messages {
+		if err := queue.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	drained := queue.Drain("newsletter", "marketing")
+	if len(drained) != 3 || !errors.Is(drained[0].Err, ErrQueueDrained) {
+		t.Fatalf("Expected 3 drained messages, got %+v", drained)
+	}
+	if n := queue.Len(); n != 1 {
+		t.Fatalf("Expected 1 waiting message, got %d", n)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected no dead letter, got %+v", dls)
+	}
+
+	queue.Start()
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 1 || sent[0] != "otp" {
+		t.Fatalf("Expected only the not drained message to be sent, got %v", sent)
+	}
+}
+
+// waitFor polls the condition for up to 1s.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DeliveryWindow defines the local daytime the queued messages are sent in,
+// the non-urgent messages enqueued (or retried) outside of it being deferred
+// to its next start in the timezone of their recipient, eg. from 08:00 to 21:00.
+//
+// The recipient timezone is set with [WithTimezone], or resolved by the
+// [Queue] Timezone hook, falling back to the window one.
+type DeliveryWindow struct {
+	Start    string   `mapstructure:"start" json:"start" bson:"start"`                              // the "HH:MM" local start time, eg. "08:00"
+	End      string   `mapstructure:"end" json:"end" bson:"end"`                                    // the "HH:MM" local end time, eg. "21:00"
+	Timezone string   `mapstructure:"timezone" json:"timezone,omitempty" bson:"timezone,omitempty"` // the default IANA timezone of the recipients, default to UTC
+	Urgent   []string `mapstructure:"urgent" json:"urgent,omitempty" bson:"urgent,omitempty"`       // the tags of the messages sent anytime, eg. "otp"
+}
+
+// validate checks the delivery window for common mistakes.
+func (w DeliveryWindow) validate() []error {
+	var errs []error
+
+	for _, t := range []string{w.Start, w.End} {
+		if _, err := parseClock(t); err != nil {
+			errs = append(errs, fmt.Errorf("queue: invalid window time %q, expected HH:MM", t))
+		}
+	}
+	if w.Start != "" && w.Start == w.End {
+		errs = append(errs, errors.New("queue: window start and end must differ"))
+	}
+
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("queue: invalid window timezone %q", w.Timezone))
+	}
+
+	return errs
+}
+
+// Next returns the first time from t in the window, in the specified
+// timezone (the window one if empty), ie. t itself if it is in the window.
+func (w DeliveryWindow) Next(t time.Time, timezone string) (time.Time, error) {
+	if timezone == "" {
+		timezone = w.Timezone
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timezone %q", timezone)
+	}
+
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return time.Time{}, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// the window is closed from its end to its start
+	if next, closed := inWindow(t.In(loc), end, start); closed {
+		return next, nil
+	}
+
+	return t, nil
+}
+
+// WithSendAt defers the message delivery to the specified time.
+// The deferred messages are saved in the queue spool (if configured)
+// or returned by [Queue.Shutdown] when the queue stops.
+func WithSendAt(at time.Time) QueueOption {
+	return func(job *queueJob) {
+		job.sendAt = at
+	}
+}
+
+// WithTimezone sets the IANA timezone of the message recipient,
+// eg. "Europe/Berlin", for the queue delivery window (see [DeliveryWindow]).
+func WithTimezone(timezone string) QueueOption {
+	return func(job *queueJob) {
+		job.timezone = timezone
+	}
+}
+
+// WithUrgent sends the message regardless of the queue delivery window (see [DeliveryWindow]).
+func WithUrgent() QueueOption {
+	return func(job *queueJob) {
+		job.urgent = true
+	}
+}
+
+// deliverAt returns the first time from t the job can be delivered at, according
+// to the delivery window (if any) in the timezone of its recipient.
+func (q *Queue) deliverAt(job *queueJob, t time.Time) (time.Time, error) {
+	window := q.config.Window
+	if window == nil || job.urgent || slices.ContainsFunc(job.message.Tags, func(tag string) bool { return slices.Contains(window.Urgent, tag) }) {
+		return t, nil
+	}
+
+	timezone := job.timezone
+	if timezone == "" && q.Timezone != nil {
+		timezone = q.Timezone(job.message)
+	}
+
+	return window.Next(t, timezone)
+}
+
+// deferJob schedules the job delivery at the specified time.
+func (q *Queue) deferJob(job *queueJob, at time.Time) error {
+	q.mu.RLock()
+	closed := q.closed
+	q.mu.RUnlock()
+
+	if closed {
+		return ErrQueueClosed
+	}
+
+	q.after(job, at.Sub(now(q.Clock)))
+	q.emit(job, DeliveryScheduled, nil)
+
+	return nil
+}
+
+// preferenceDelay returns the delay until the recipients of the message
+// denied by their preferences (eg. in their quiet hours) can be sent again,
+// or false if any of them denied it permanently (eg. opted out).
+func preferenceDelay(err error, t time.Time) (time.Duration, bool) {
+	var denied *PreferenceDeniedError
+	if !errors.As(err, &denied) || len(denied.Denials) == 0 {
+		return 0, false
+	}
+
+	var until time.Time
+	for _, d := range denied.Denials {
+		if d.Until.IsZero() {
+			return 0, false
+		}
+		if d.Until.After(until) {
+			until = d.Until
+		}
+	}
+
+	return max(until.Sub(t), 0), true
+}
@@ -0,0 +1,330 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueSendAt(t *testing.T) {
+	var mu sync.Mutex
+	var sent []time.Time
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		sent = append(sent, time.Now())
+		mu.Unlock()
+		return nil
+	}), QueueConfig{})
+	events := queue.Subscribe()
+	queue.Start()
+
+	at := time.Now().Add(50 * time.Millisecond)
+	if _, err := queue.Enqueue(&Message{Subject: "later"}, WithSendAt(at)); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Status != DeliveryScheduled {
+		t.Fatalf("Expected the scheduled event, got %+v", e)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 1
+	})
+	if sent[0].Before(at) {
+		t.Fatalf("Expected the message to be sent after %s, got %s", at, sent[0])
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueDeliveryWindow(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		sent = append(sent, m.Subject)
+		mu.Unlock()
+		return nil
+	}), QueueConfig{Window: &DeliveryWindow{Start: "08:00", End: "21:00", Urgent: []string{"otp"}}})
+	queue.Clock = ClockFunc(func() time.Time { return time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC) })
+	queue.Timezone = func(m *Message) string { return m.Headers["X-Timezone"] }
+	queue.Start()
+
+	enqueue := func(m *Message, opts ...QueueOption) {
+		t.Helper()
+		if _, err := queue.Enqueue(m, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enqueue(&Message{Subject: "digest"})
+	enqueue(&Message{Subject: "otp", Tags: []string{"otp"}})
+	enqueue(&Message{Subject: "alert"}, WithUrgent())
+	enqueue(&Message{Subject: "tokyo"}, WithTimezone("Asia/Tokyo")) // 08:00 in Tokyo
+	enqueue(&Message{Subject: "osaka", Headers: map[string]string{"X-Timezone": "Asia/Tokyo"}})
+
+	if _, err := queue.Enqueue(&Message{Subject: "invalid"}, WithTimezone("Mars/Olympus")); err == nil {
+		t.Fatal("Expected the invalid timezone error")
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 4
+	})
+
+	if drained := queue.Drain(); len(drained) != 1 || drained[0].Message.Subject != "digest" {
+		t.Fatalf("Expected the deferred message to be drained, got %+v", drained)
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueuePreferenceRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			return &PreferenceDeniedError{Denials: []PreferenceDenial{
+				{Address: "jane@example.com", Reason: PreferenceQuietHours, Until: time.Now().Add(30 * time.Millisecond)},
+			}}
+		}
+		return nil
+	}), QueueConfig{})
+	queue.Start()
+
+	if err := queue.Send(&Message{Subject: "quiet"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 2
+	})
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected the message to be sent after the quiet hours, got %+v", dls)
+	}
+
+	// only the deferred recipients are retried
+	var sent []*Message
+	queue = NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent = append(sent, m)
+		if len(sent) == 1 {
+			deferred := m.Clone()
+			deferred.To = m.To[1:]
+			return &PreferenceDeferredError{Message: deferred, Denials: []PreferenceDenial{
+				{Address: "night@example.com", Reason: PreferenceQuietHours, Until: time.Now().Add(30 * time.Millisecond)},
+			}}
+		}
+		return nil
+	}), QueueConfig{MaxAttempts: 1})
+	queue.Start()
+
+	if err := queue.Send(&Message{Subject: "quiet", To: []mail.Address{{Address: "jane@example.com"}, {Address: "night@example.com"}}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 2
+	})
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if to := sent[1].To; len(to) != 1 || to[0].Address != "night@example.com" {
+		t.Fatalf("Expected the retry to the deferred recipient only, got %+v", to)
+	}
+
+	if _, ok := preferenceDelay(&PreferenceDeniedError{Denials: []PreferenceDenial{{Reason: PreferenceOptOut}}}, time.Now()); ok {
+		t.Fatal("Expected the opt-outs not to be retried")
+	}
+	if _, ok := preferenceDelay(errors.New("other"), time.Now()); ok {
+		t.Fatal("Expected the other errors not to be retried")
+	}
+}
+
+func TestQueueDeferredRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts < 3 {
+			return &ThrottleError{Domain: "example.com", RetryAt: time.Now().Add(20 * time.Millisecond)}
+		}
+		return nil
+	}), QueueConfig{MaxAttempts: 1})
+	queue.Start()
+
+	if err := queue.Send(&Message{Subject: "throttled"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 3
+	})
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected the throttled message to be deferred beyond the max attempts, got %+v", dls)
+	}
+}
+
+func TestQueueDeferredRetryAttempts(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+
+	queue := NewQueue(MailerFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		switch attempts {
+		case 1, 2, 4:
+			return &ThrottleError{Domain: "example.com", RetryAt: time.Now().Add(10 * time.Millisecond)}
+		case 3, 5:
+			return &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}
+		}
+		return nil
+	}), QueueConfig{MaxAttempts: 3, RetryBackoff: 10 * time.Millisecond})
+	queue.Start()
+	events := queue.Subscribe()
+
+	if err := queue.Send(&Message{Subject: "throttled"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 6
+	})
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected the deferrals not to count as attempts, got %+v", dls)
+	}
+
+	var last DeliveryEvent
+	for e := range events {
+		last = e
+	}
+	if last.Status != DeliverySent || last.Attempt != 3 {
+		t.Fatalf("Expected the message to be sent at the third attempt, got %+v", last)
+	}
+}
+
+func TestDeliveryWindowNext(t *testing.T) {
+	window := DeliveryWindow{Start: "08:00", End: "21:00", Timezone: "Europe/Berlin"}
+
+	scenarios := []struct {
+		at, timezone, next string
+	}{
+		{"2024-01-01T10:00:00Z", "", "2024-01-01T10:00:00Z"},
+		{"2024-01-01T20:30:00Z", "", "2024-01-02T07:00:00Z"}, // 21:30 in Berlin
+		{"2024-01-01T06:00:00Z", "", "2024-01-01T07:00:00Z"},
+		{"2024-01-01T06:00:00Z", "UTC", "2024-01-01T08:00:00Z"},
+	}
+
+	for _, s := range scenarios {
+		at, _ := time.Parse(time.RFC3339, s.at)
+
+		next, err := window.Next(at, s.timezone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, _ := time.Parse(time.RFC3339, s.next); !next.Equal(expected) {
+			t.Errorf("Expected the next time of %s (%s) to be %s, got %s", s.at, s.timezone, s.next, next.UTC())
+		}
+	}
+
+	if errs := (DeliveryWindow{Start: "8am", End: "21:00", Timezone: "Mars/Olympus"}).validate(); len(errs) != 2 {
+		t.Fatalf("Expected the invalid start and timezone errors, got %v", errs)
+	}
+}
+
+func TestQueueSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	queue := NewQueue(MailerFunc(func(m *Message) error { return nil }), QueueConfig{Spool: dir})
+	queue.Start()
+
+	m := &Message{
+		From:     mail.Address{Address: "sender@example.com"},
+		To:       []mail.Address{{Address: "john@example.com"}},
+		Bcc:      []mail.Address{{Address: "audit@example.com"}},
+		Subject:  "later",
+		Text:     "Hello",
+		Tags:     []string{"lane:bulk", "newsletter"},
+		tenantID: "acme",
+	}
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	id, err := queue.Enqueue(m, WithSendAt(at), WithCorrelationID("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+".json")); err != nil {
+		t.Fatalf("Expected the deferred message to be spooled, got %v", err)
+	}
+
+	restored := NewQueue(MailerFunc(func(m *Message) error { return nil }), QueueConfig{Spool: dir})
+	if err := restored.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := restored.Drain()
+	if len(drained) != 1 || drained[0].ID != id || drained[0].CorrelationID != "order-1" {
+		t.Fatalf("Expected the spooled message to be restored, got %+v", drained)
+	}
+
+	dm := drained[0].Message
+	if dm.Subject != "later" || dm.tenantID != "acme" || !slices.Equal(dm.Tags, m.Tags) || !slices.Equal(envelopeRecipients(dm), envelopeRecipients(m)) {
+		t.Fatalf("Expected the restored message to match, got %+v", dm)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Fatalf("Expected the spool to be emptied, got %v", files)
+	}
+
+	if err := restored.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
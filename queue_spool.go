@@ -0,0 +1,163 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// spooledJob is the JSON file of a queued message saved in the queue
+// spool directory when the queue stops (see [QueueConfig]).
+//
+// The message is saved rendered, along with its envelope and the
+// settings that are not part of the rendered message.
+type spooledJob struct {
+	ID            string    `json:"id"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Sender        string    `json:"sender"`
+	Recipients    []string  `json:"recipients"`
+	Tags          []string  `json:"tags,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Via           string    `json:"via,omitempty"`
+	Test          bool      `json:"test,omitempty"`
+	SendAt        time.Time `json:"send_at,omitempty"` // the deferred or retry time
+	Expires       time.Time `json:"expires,omitempty"`
+	Timezone      string    `json:"timezone,omitempty"`
+	Urgent        bool      `json:"urgent,omitempty"`
+	Data          []byte    `json:"data"`
+}
+
+// spool saves the job in the spool directory, to be restored on the next start.
+func (q *Queue) spool(job *queueJob) error {
+	m := job.message.Clone()
+	if m.Date.IsZero() {
+		m.Date = now(q.Clock)
+	}
+	ensureMessageID(m)
+
+	data, err := m.Render()
+	if err != nil {
+		return err
+	}
+
+	sendAt := job.sendAt
+	if job.retryAt.After(sendAt) {
+		sendAt = job.retryAt
+	}
+
+	file, err := json.Marshal(spooledJob{
+		ID:            job.id,
+		CorrelationID: job.correlationID,
+		Sender:        envelopeSender(m),
+		Recipients:    envelopeRecipients(m),
+		Tags:          m.Tags,
+		Tenant:        m.tenantID,
+		Via:           m.Via,
+		Test:          m.test,
+		SendAt:        sendAt,
+		Expires:       job.expires,
+		Timezone:      job.timezone,
+		Urgent:        job.urgent,
+		Data:          data,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(q.config.Spool, 0o700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(q.config.Spool, job.id+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, file, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// spoolAll saves the jobs in the spool directory, returning
+// the dead letters of the ones that could not be saved.
+func (q *Queue) spoolAll(jobs []*queueJob) ([]*DeadLetter, error) {
+	var unsent []*DeadLetter
+	var errs []error
+
+	for _, job := range jobs {
+		if err := q.spool(job); err != nil {
+			unsent = append(unsent, q.takeOut(job, ErrQueueClosed))
+			errs = append(errs, fmt.Errorf("failed to spool message %s: %w", job.id, err))
+		}
+	}
+
+	return unsent, errors.Join(errs...)
+}
+
+// restore enqueues the messages saved in the spool directory, removing
+// their files. The ones that could not be enqueued (eg. the lane is
+// full) are kept for the next start.
+func (q *Queue) restore() error {
+	paths, err := filepath.Glob(filepath.Join(q.config.Spool, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, path := range paths {
+		job, err := q.unspool(path)
+		if err == nil {
+			err = q.add(job)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", filepath.Base(path), err))
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// unspool reads the job of the spool file.
+func (q *Queue) unspool(path string) (*queueJob, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var spooled spooledJob
+	if err := json.Unmarshal(file, &spooled); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(spooled.ID, `/\`) || spooled.ID+".json" != filepath.Base(path) {
+		return nil, fmt.Errorf("invalid spooled message id %q", spooled.ID)
+	}
+
+	m, err := ParseMessage(bytes.NewReader(spooled.Data))
+	if err != nil {
+		return nil, err
+	}
+	restoreEnvelope(m, spooled.Sender, spooled.Recipients)
+	m.Tags, m.tenantID, m.Via, m.test = spooled.Tags, spooled.Tenant, spooled.Via, spooled.Test
+
+	job := &queueJob{
+		id:            spooled.ID,
+		message:       m,
+		correlationID: spooled.CorrelationID,
+		sendAt:        spooled.SendAt,
+		expires:       spooled.Expires,
+		timezone:      spooled.Timezone,
+		urgent:        spooled.Urgent,
+	}
+	job.lane = q.lane(m)
+
+	return job, nil
+}
@@ -0,0 +1,393 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueDrainOnStop(t *testing.T) {
+	var sent atomic.Int32
+
+	next := MailerFunc(func(m *Message) error {
+		time.Sleep(5 * time.Millisecond)
+		sent.Add(1)
+		return nil
+	})
+
+	queue := NewQueue(next, QueueConfig{Workers: 2, Size: 10})
+	queue.Start()
+
+	for i := 0; i < 10; i++ {
+		if err := queue.Send(&Message{}); err != nil {
+			t.Fatalf("Unexpected enqueue error %v", err)
+		}
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatalf("Unexpected stop error %v", err)
+	}
+
+	if n := sent.Load(); n != 10 {
+		t.Fatalf("Expected 10 sent messages, got %d", n)
+	}
+
+	if err := queue.Send(&Message{}); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("Expected ErrQueueClosed, got %v", err)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	queue := NewQueue(MailerFunc(func(m *Message) error { return nil }), QueueConfig{Size: 1})
+
+	if err := queue.Send(&Message{}); err != nil {
+		t.Fatalf("Unexpected enqueue error %v", err)
+	}
+
+	if err := queue.Send(&Message{}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestQueueDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	next := MailerFunc(func(m *Message) error {
+		<-release
+		return nil
+	})
+
+	queue := NewQueue(next, QueueConfig{Size: 5, DrainTimeout: 20 * time.Millisecond})
+	queue.Start()
+
+	for i := 0; i < 3; i++ {
+		if err := queue.Send(&Message{}); err != nil {
+			t.Fatalf("Unexpected enqueue error %v", err)
+		}
+	}
+
+	if err := queue.Stop(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected drain timeout error, got %v", err)
+	}
+}
+
+func TestQueueRequeueFailed(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+
+	sent := make(chan string, 10)
+	next := MailerFunc(func(m *Message) error {
+		data, err := io.ReadAll(m.Attachments["a.txt"])
+		if err != nil {
+			return err
+		}
+		if fail.Load() {
+			return errors.New("temporary failure")
+		}
+		sent <- string(data)
+		return nil
+	})
+
+	queue := NewQueue(next, QueueConfig{Workers: 1, Size: 10, DeadLetters: 1})
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	for i := 0; i < 2; i++ {
+		err := queue.Send(&Message{
+			Attachments: map[string]io.Reader{"a.txt": io.MultiReader(strings.NewReader("attachment"))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for queue.Len() > 0 || len(queue.DeadLetters()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the dead letters")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// only the newest dead letter is kept
+	if n := len(queue.DeadLetters()); n != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", n)
+	}
+
+	fail.Store(false)
+
+	if n, err := queue.RequeueFailed(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 requeued message, got %d (%v)", n, err)
+	}
+
+	select {
+	case data := <-sent:
+		if data != "attachment" {
+			t.Fatalf("Expected the requeued message attachment, got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the requeued message")
+	}
+
+	if n := len(queue.DeadLetters()); n != 0 {
+		t.Fatalf("Expected no dead letters, got %d", n)
+	}
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	var attempts atomic.Int32
+
+	next := MailerFunc(func(m *Message) error {
+		attempts.Add(1)
+		return errors.New("failure")
+	})
+
+	queue := NewQueue(next, QueueConfig{Workers: 1, Size: 10})
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	waitDeadLetters := func(n int) []*DeadLetter {
+		deadline := time.Now().Add(time.Second)
+		for {
+			if dls := queue.DeadLetters(); len(dls) == n && queue.Len() == 0 {
+				return dls
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timeout waiting for %d dead letters", n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	for _, subject := range []string{"a", "b"} {
+		if err := queue.Send(&Message{Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dls := waitDeadLetters(2)
+
+	if err := queue.RetryDeadLetter(dls[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for attempts.Load() < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitDeadLetters(2)
+
+	dl, err := queue.DeadLetter(dls[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dl.Attempts) != 2 || dl.Err == nil || dl.Message.Subject != "a" {
+		t.Fatalf("Expected 2 attempts of the retried message, got %+v", dl)
+	}
+
+	if n := queue.PurgeDeadLetters(dls[1].ID); n != 1 {
+		t.Fatalf("Expected 1 purged dead letter, got %d", n)
+	}
+	if _, err := queue.DeadLetter(dls[1].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("Expected ErrDeadLetterNotFound, got %v", err)
+	}
+	if n := queue.PurgeDeadLetters(); n != 1 {
+		t.Fatalf("Expected 1 purged dead letter, got %d", n)
+	}
+}
+
+func TestQueueGreylistRetry(t *testing.T) {
+	var attempts atomic.Int32
+
+	sent := make(chan time.Time, 1)
+	next := MailerFunc(func(m *Message) error {
+		if attempts.Add(1) == 1 {
+			return &textproto.Error{Code: 451, Msg: "4.7.1 Greylisting in action, please come back later"}
+		}
+		sent <- time.Now()
+		return nil
+	})
+
+	queue := NewQueue(next, QueueConfig{
+		Workers:       1,
+		Size:          10,
+		MaxAttempts:   3,
+		RetryBackoff:  time.Hour,
+		GreylistDelay: 50 * time.Millisecond,
+	})
+	events := queue.Subscribe()
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	start := time.Now()
+	if err := queue.Send(&Message{Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case at := <-sent:
+		if d := at.Sub(start); d < 50*time.Millisecond {
+			t.Fatalf("Expected the retry after the greylist delay, got %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the retried message")
+	}
+
+	var statuses []DeliveryStatus
+	for len(statuses) < 6 {
+		select {
+		case e := <-events:
+			statuses = append(statuses, e.Status)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for the events, got %v", statuses)
+		}
+	}
+
+	expected := []DeliveryStatus{DeliveryQueued, DeliverySending, DeliveryRetrying, DeliveryQueued, DeliverySending, DeliverySent}
+	for i, status := range expected {
+		if statuses[i] != status {
+			t.Fatalf("Expected events %v, got %v", expected, statuses)
+		}
+	}
+}
+
+func TestQueueRetryCanceledOnStop(t *testing.T) {
+	next := MailerFunc(func(m *Message) error {
+		return &textproto.Error{Code: 421, Msg: "4.3.2 Service not available"}
+	})
+
+	queue := NewQueue(next, QueueConfig{Workers: 1, Size: 10, MaxAttempts: 2, RetryBackoff: time.Hour})
+	queue.Start()
+
+	if err := queue.Send(&Message{Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		queue.deadMu.Lock()
+		n := len(queue.retries)
+		queue.deadMu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the scheduled retry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	unsent, err := queue.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(unsent) != 1 || !errors.Is(unsent[0].Err, ErrQueueClosed) || !IsTemporary(unsent[0].Attempts[0].Err) {
+		t.Fatalf("Expected the pending retry to be returned, got %+v", unsent)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected no dead letter, got %+v", dls)
+	}
+}
+
+func TestQueueLanes(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+
+	next := MailerFunc(func(m *Message) error {
+		mu.Lock()
+		sent = append(sent, m.Subject)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+
+	queue := NewQueue(next, QueueConfig{
+		Size:  10,
+		Lanes: []QueueLane{{Name: "transactional"}, {Name: "bulk", Size: 3}},
+	})
+
+	messages := []*Message{
+		{Subject: "default"},
+		{Subject: "bulk1", Tags: []string{"lane:bulk"}},
+		{Subject: "bulk2", Tags: []string{"lane:bulk"}},
+		{Subject: "bulk3", Tags: []string{"lane:bulk"}},
+		{Subject: "otp1", Tags: []string{"lane:transactional"}},
+		{Subject: "otp2", Tags: []string{"lane:transactional"}},
+	}
+	for _, m := range messages {
+		if err := queue.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := queue.Send(&Message{Tags: []string{"lane:bulk"}}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected the bulk lane to be full, got %v", err)
+	}
+	if n := queue.LaneLen("bulk"); n != 3 {
+		t.Fatalf("Expected 3 bulk messages, got %d", n)
+	}
+
+	queue.Start()
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 6 || sent[0] != "otp1" {
+		t.Fatalf("Expected the transactional messages to be sent first, got %v", sent)
+	}
+	// the default lane waits for the bulk one, but may be sent along with its last message
+	if i := slices.Index(sent, "default"); i < 4 {
+		t.Fatalf("Expected the default lane to be sent last, got %v", sent)
+	}
+}
+
+func TestQueueLaneRate(t *testing.T) {
+	queue := NewQueue(MailerFunc(func(m *Message) error { return nil }), QueueConfig{
+		Lanes: []QueueLane{{Name: "bulk", Workers: 2, PerMinute: 600}}, // 1 message every 100ms
+	})
+	queue.Start()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := queue.Send(&Message{Tags: []string{"lane:bulk"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("Expected the second send to be delayed, took %s", elapsed)
+	}
+}
+
+func TestQueueConfigValidateLanes(t *testing.T) {
+	scenarios := []struct {
+		name  string
+		lanes []QueueLane
+		valid bool
+	}{
+		{"valid", []QueueLane{{Name: "transactional", Workers: 4}, {Name: "default"}, {Name: "bulk", PerMinute: 100}}, true},
+		{"missing name", []QueueLane{{Workers: 1}}, false},
+		{"duplicated name", []QueueLane{{Name: "bulk"}, {Name: "bulk"}}, false},
+		{"negative workers", []QueueLane{{Name: "bulk", Workers: -1}}, false},
+		{"negative size", []QueueLane{{Name: "bulk", Size: -1}}, false},
+		{"negative rate", []QueueLane{{Name: "bulk", PerMinute: -1}}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := (QueueConfig{Lanes: s.lanes}).Validate(); (err == nil) != s.valid {
+				t.Fatalf("Expected valid %v, got %v", s.valid, err)
+			}
+		})
+	}
+}
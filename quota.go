@@ -0,0 +1,336 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQuotaWindow  = 24 * time.Hour
+	defaultQuotaTimeout = 5 * time.Second
+)
+
+// QuotaStore keeps the quota counters.
+type QuotaStore interface {
+	// Add adds delta to the counter with the specified key and returns its
+	// new value. A new counter starts at zero and expires after ttl.
+	Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+// QuotaExceededError is returned by the quota middleware when a message
+// exceeds the quota of its sender or tenant. The message should be
+// retried (eg. re-queued) at ResetAt.
+type QuotaExceededError struct {
+	Key     string // the exceeded quota key, eg. "sender:alice@example.com" or "tenant:acme"
+	Limit   int
+	ResetAt time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota of %d messages for %s exceeded, resets at %s", e.Limit, e.Key, e.ResetAt.Format(time.RFC3339))
+}
+
+// RetryTime returns ResetAt, so that the send is deferred (see [RetryAt]).
+func (e *QuotaExceededError) RetryTime() time.Time {
+	return e.ResetAt
+}
+
+// QuotaLimit overrides the default limit of a single quota key.
+type QuotaLimit struct {
+	Key   string `mapstructure:"key" json:"key" bson:"key"` // "sender:{address}" or "tenant:{id}"
+	Limit int    `mapstructure:"limit" json:"limit" bson:"limit"`
+}
+
+// QuotaConfig defines the per-sender and per-tenant send quotas.
+//
+// The sender of a message is its From address and its tenant is
+// the one of the [TenantMailer.For] mailer it is sent with (if any). A zero limit means
+// no quota for that dimension.
+type QuotaConfig struct {
+	PerSender int           `mapstructure:"per_sender" json:"per_sender,omitempty" bson:"per_sender,omitempty"` // max messages per window per From address
+	PerTenant int           `mapstructure:"per_tenant" json:"per_tenant,omitempty" bson:"per_tenant,omitempty"` // max messages per window per tenant
+	Limits    []QuotaLimit  `mapstructure:"limits" json:"limits,omitempty" bson:"limits,omitempty"`             // per-key overrides of the defaults above
+	Window    time.Duration `mapstructure:"window" json:"window,omitempty" bson:"window,omitempty"`             // default to 24h
+	Timeout   time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`          // store operations timeout, default to 5s
+
+	// Redis shares the counters between the instances (in-memory if not set).
+	Redis *RedisConfig `mapstructure:"redis" json:"redis,omitempty" bson:"redis,omitempty"`
+
+	// Clock is the time source of the quota windows (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the quota configuration for common mistakes.
+func (c QuotaConfig) Validate() error {
+	var errs []error
+
+	if c.PerSender < 0 {
+		errs = append(errs, fmt.Errorf("quota: per_sender must be positive, got %d", c.PerSender))
+	}
+
+	if c.PerTenant < 0 {
+		errs = append(errs, fmt.Errorf("quota: per_tenant must be positive, got %d", c.PerTenant))
+	}
+
+	if c.PerSender == 0 && c.PerTenant == 0 && len(c.Limits) == 0 {
+		errs = append(errs, errors.New("quota: at least one of per_sender, per_tenant or limits must be set"))
+	}
+
+	for i, l := range c.Limits {
+		if !strings.HasPrefix(l.Key, "sender:") && !strings.HasPrefix(l.Key, tenantTagPrefix) {
+			errs = append(errs, fmt.Errorf("quota: limits[%d] invalid key %q, expected sender:{address} or tenant:{id}", i, l.Key))
+		}
+		if l.Limit < 0 {
+			errs = append(errs, fmt.Errorf("quota: limits[%d] limit must be positive, got %d", i, l.Limit))
+		}
+	}
+
+	if c.Window < 0 {
+		errs = append(errs, fmt.Errorf("quota: window must be positive, got %s", c.Window))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("quota: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.Redis != nil {
+		if err := c.Redis.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("quota: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c QuotaConfig) Redacted() QuotaConfig {
+	if c.Redis != nil {
+		redis := c.Redis.Redacted()
+		c.Redis = &redis
+	}
+
+	return c
+}
+
+// Store returns the QuotaStore described by the config.
+func (c QuotaConfig) Store() QuotaStore {
+	if c.Redis != nil {
+		return NewRedisQuotaStore(*c.Redis)
+	}
+
+	return &MemoryQuotaStore{Clock: c.Clock}
+}
+
+// limit returns the limit of the specified quota key (0 if there is none).
+func (c QuotaConfig) limit(key string) int {
+	for _, l := range c.Limits {
+		if strings.EqualFold(l.Key, key) {
+			return l.Limit
+		}
+	}
+
+	if strings.HasPrefix(key, tenantTagPrefix) {
+		return c.PerTenant
+	}
+
+	return c.PerSender
+}
+
+// Quota returns a middleware that enforces the per-sender and per-tenant
+// quotas of the config, counting the messages in fixed windows.
+//
+// Messages over any of their quotas are rejected with [QuotaExceededError].
+// Neither the rejected nor the failed messages are counted.
+func Quota(store QuotaStore, cfg QuotaConfig) Middleware {
+	window := cfg.Window
+	if window <= 0 {
+		window = defaultQuotaWindow
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultQuotaTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			keys := quotaKeys(m)
+			if len(keys) == 0 {
+				return next.Send(m)
+			}
+
+			t := now(cfg.Clock)
+			start := t.Truncate(window)
+			resetAt := start.Add(window)
+			suffix := ":" + strconv.FormatInt(start.Unix(), 10)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			var counted []string
+			rollback := func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+
+				for _, key := range counted {
+					_, _ = store.Add(ctx, key, -1, 0)
+				}
+			}
+
+			for _, key := range keys {
+				limit := cfg.limit(key)
+				if limit <= 0 {
+					continue
+				}
+
+				n, err := store.Add(ctx, "quota:"+key+suffix, 1, resetAt.Sub(t))
+				if err != nil {
+					rollback()
+					return fmt.Errorf("failed to count the %s quota: %w", key, err)
+				}
+				counted = append(counted, "quota:"+key+suffix)
+
+				if n > int64(limit) {
+					rollback()
+					return &QuotaExceededError{Key: key, Limit: limit, ResetAt: resetAt}
+				}
+			}
+
+			if err := next.Send(m); err != nil {
+				rollback()
+				return err
+			}
+
+			return nil
+		})
+	}
+}
+
+// quotaKeys returns the quota keys of the message, ie. its sender and tenant (if any).
+func quotaKeys(m *Message) []string {
+	var keys []string
+
+	if m.From.Address != "" {
+		keys = append(keys, "sender:"+strings.ToLower(m.From.Address))
+	}
+
+	if tenant := m.tenant(); tenant != "" {
+		keys = append(keys, tenantTagPrefix+tenant)
+	}
+
+	return keys
+}
+
+// -------------------------------------------------------------------
+// stores
+// -------------------------------------------------------------------
+
+var (
+	_ QuotaStore = (*MemoryQuotaStore)(nil)
+	_ QuotaStore = (*RedisQuotaStore)(nil)
+)
+
+// MemoryQuotaStore is an in-memory [QuotaStore], suitable for a single instance.
+//
+// The counters are grouped by their expiration second, so that the
+// expired ones are dropped without scanning all the counters.
+// The zero value is ready to use.
+type MemoryQuotaStore struct {
+	// Clock is the time source of the counters expiration (default to the system clock).
+	Clock Clock
+
+	mu       sync.Mutex
+	counters map[string]quotaCounter
+	buckets  map[int64][]string // the counter keys by expiration second
+}
+
+type quotaCounter struct {
+	value   int64
+	expires time.Time
+}
+
+// Add implements [QuotaStore] interface.
+func (s *MemoryQuotaStore) Add(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	t := now(s.Clock)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counters == nil {
+		s.counters, s.buckets = map[string]quotaCounter{}, map[int64][]string{}
+	}
+
+	for second, keys := range s.buckets {
+		if second > t.Unix() {
+			continue
+		}
+
+		for _, k := range keys {
+			// the key may have been expired and counted again since
+			if c, ok := s.counters[k]; ok && !t.Before(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+		delete(s.buckets, second)
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !t.Before(c.expires) {
+		c = quotaCounter{expires: t.Add(ttl)}
+
+		second := c.expires.Unix()
+		if c.expires.Nanosecond() > 0 {
+			second++
+		}
+		s.buckets[second] = append(s.buckets[second], key)
+	}
+	c.value += delta
+	s.counters[key] = c
+
+	return c.value, nil
+}
+
+// RedisQuotaStore is a [QuotaStore] backed by Redis,
+// sharing the counters between multiple instances.
+type RedisQuotaStore struct {
+	client *redisClient
+}
+
+// redisAddScript increments the counter and sets its
+// expiration (in milliseconds) if it doesn't have one yet.
+const redisAddScript = `local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return v`
+
+// NewRedisQuotaStore creates a new Redis quota store.
+func NewRedisQuotaStore(config RedisConfig) *RedisQuotaStore {
+	return &RedisQuotaStore{client: newRedisClient(config)}
+}
+
+// Add implements [QuotaStore] interface.
+func (s *RedisQuotaStore) Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := s.client.do(ctx, "EVAL", redisAddScript, "1", s.client.config.prefix()+key,
+		strconv.FormatInt(delta, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	return value, nil
+}
+
+// Close closes the Redis connection.
+func (s *RedisQuotaStore) Close() error {
+	return s.client.close()
+}
@@ -0,0 +1,398 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	current := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := ClockFunc(func() time.Time { return current })
+
+	cfg := QuotaConfig{
+		PerSender: 2,
+		PerTenant: 3,
+		Limits:    []QuotaLimit{{Key: "sender:vip@example.com", Limit: 0}},
+		Clock:     clock,
+	}
+
+	var sent int
+	var sendErr error
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent++
+		return nil
+	}), Quota(&MemoryQuotaStore{Clock: clock}, cfg))
+
+	message := func(from string, tenant ...string) *Message {
+		m := &Message{From: mail.Address{Address: from}}
+		if len(tenant) > 0 {
+			m.tenantID = tenant[0]
+		}
+		return m
+	}
+
+	scenarios := []struct {
+		name        string
+		message     *Message
+		sendErr     error
+		advance     time.Duration
+		expectedKey string
+	}{
+		{"sender #1", message("alice@example.com"), nil, 0, ""},
+		{"sender #2 (case-insensitive)", message("Alice@Example.com"), nil, 0, ""},
+		{"sender over quota", message("alice@example.com"), nil, 0, "sender:alice@example.com"},
+		{"other sender", message("bob@example.com", "acme"), nil, 0, ""},
+		{"failed send is not counted", message("carol@example.com", "acme"), errors.New("failure"), 0, ""},
+		{"tenant #2", message("carol@example.com", "acme"), nil, 0, ""},
+		{"unlimited sender, tenant #3", message("vip@example.com", "acme"), nil, 0, ""},
+		{"tenant over quota", message("vip@example.com", "acme"), nil, 0, "tenant:acme"},
+		{"rejected message is not counted", message("dave@example.com"), nil, 0, ""},
+		{"next window", message("alice@example.com", "acme"), nil, 24 * time.Hour, ""},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			current = current.Add(s.advance)
+			sendErr = s.sendErr
+
+			err := mailer.Send(s.message)
+
+			if s.sendErr != nil {
+				if !errors.Is(err, s.sendErr) {
+					t.Fatalf("Expected send error, got %v", err)
+				}
+				return
+			}
+
+			if s.expectedKey == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				return
+			}
+
+			var quotaErr *QuotaExceededError
+			if !errors.As(err, &quotaErr) {
+				t.Fatalf("Expected QuotaExceededError, got %v", err)
+			}
+			if quotaErr.Key != s.expectedKey {
+				t.Fatalf("Expected key %q, got %q", s.expectedKey, quotaErr.Key)
+			}
+			if expected := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC); !quotaErr.ResetAt.Equal(expected) {
+				t.Fatalf("Expected reset at %v, got %v", expected, quotaErr.ResetAt)
+			}
+		})
+	}
+
+	if sent != 7 {
+		t.Fatalf("Expected 7 sent messages, got %d", sent)
+	}
+}
+
+// newTestRedis starts a fake Redis server supporting AUTH, GET, SET,
+// DEL and the quota, throttle and idempotency stores EVAL scripts.
+// The scripts counters are returned, without expiration.
+func newTestRedis(t *testing.T, password string) (string, map[string]int64) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	counters := map[string]int64{}
+	values := map[string]string{}
+	released := map[string]int{} // the slot release notifications
+	lists := map[string][]string{}
+	sets := map[string]map[string]struct{}{}
+
+	// trim drops the oldest list items over the limit, counting them
+	trim := func(list, dropped string, limit int) {
+		if over := len(lists[list]) - limit; over > 0 {
+			lists[list] = lists[list][over:]
+			counters[dropped] += int64(over)
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				authenticated := password == ""
+
+				for {
+					reply, err := readRedisReply(r)
+					if err != nil {
+						return
+					}
+					args, _ := reply.([]any)
+					if len(args) == 0 {
+						return
+					}
+
+					switch {
+					case args[0] == "AUTH" && len(args) == 2 && args[1] == password:
+						authenticated = true
+						_, _ = io.WriteString(conn, "+OK\r\n")
+					case args[0] == "AUTH":
+						_, _ = io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+					case !authenticated:
+						_, _ = io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+					case args[0] == "EVAL" && len(args) >= 7 && (args[1] == redisDigestAddScript || args[1] == redisDigestTakeScript || args[1] == redisDigestRestoreScript):
+						list, dropped, set := args[3].(string), args[4].(string), args[5].(string)
+						member := args[6].(string)
+						argv := args[6:]
+
+						mu.Lock()
+						if sets[set] == nil {
+							sets[set] = map[string]struct{}{}
+						}
+						switch args[1] {
+						case redisDigestAddScript:
+							member = args[8].(string)
+							lists[list] = append(lists[list], argv[0].(string))
+							sets[set][member] = struct{}{}
+							limit, _ := strconv.Atoi(argv[1].(string))
+							trim(list, dropped, limit)
+							_, _ = fmt.Fprintf(conn, ":%d\r\n", len(lists[list]))
+						case redisDigestTakeScript:
+							items := append([]string{strconv.FormatInt(counters[dropped], 10)}, lists[list]...)
+							delete(lists, list)
+							delete(counters, dropped)
+							delete(sets[set], member)
+
+							_, _ = fmt.Fprintf(conn, "*%d\r\n", len(items))
+							for _, item := range items {
+								_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(item), item)
+							}
+						case redisDigestRestoreScript:
+							var restored []string
+							for _, item := range argv[3:] {
+								restored = append(restored, item.(string))
+							}
+							lists[list] = append(restored, lists[list]...)
+							sets[set][member] = struct{}{}
+							limit, _ := strconv.Atoi(argv[1].(string))
+							n, _ := strconv.ParseInt(argv[2].(string), 10, 64)
+							counters[dropped] += n
+							trim(list, dropped, limit)
+							_, _ = io.WriteString(conn, ":0\r\n")
+						}
+						mu.Unlock()
+					case args[0] == "SMEMBERS" && len(args) == 2:
+						mu.Lock()
+						members := make([]string, 0, len(sets[args[1].(string)]))
+						for member := range sets[args[1].(string)] {
+							members = append(members, member)
+						}
+						mu.Unlock()
+
+						_, _ = fmt.Fprintf(conn, "*%d\r\n", len(members))
+						for _, member := range members {
+							_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(member), member)
+						}
+					case args[0] == "EVAL" && len(args) >= 4:
+						numKeys, _ := strconv.Atoi(args[2].(string))
+						key := args[3].(string)
+						argv := make([]int64, max(len(args)-3-numKeys, 0))
+						for i := range argv {
+							argv[i], _ = strconv.ParseInt(args[i+3+numKeys].(string), 10, 64)
+						}
+
+						mu.Lock()
+						var value int64
+						switch args[1] {
+						case redisAddScript:
+							counters[key] += argv[0]
+							value = counters[key]
+						case redisAcquireScript:
+							if counters[key] < argv[0] {
+								counters[key]++
+							} else {
+								value = argv[1] // until the lease expires
+							}
+						case redisReleaseScript:
+							if counters[key]--; counters[key] <= 0 {
+								delete(counters, key)
+							}
+							released[args[4].(string)]++
+						case redisReserveScript:
+							now := time.Now().UnixMilli()
+							at := max(counters[key], now)
+							if value = at - now; value > argv[1] {
+								value = -value - 1
+							} else {
+								counters[key] = at + argv[0]
+							}
+						}
+						mu.Unlock()
+
+						_, _ = fmt.Fprintf(conn, ":%d\r\n", value)
+					case args[0] == "BLPOP" && len(args) == 3:
+						key := args[1].(string)
+						timeout, _ := strconv.ParseFloat(args[2].(string), 64)
+						deadline := time.Now().Add(time.Duration(timeout * float64(time.Second)))
+
+						var notified bool
+						for !notified && time.Now().Before(deadline) {
+							mu.Lock()
+							if notified = released[key] > 0; notified {
+								released[key]--
+							}
+							mu.Unlock()
+
+							if !notified {
+								time.Sleep(time.Millisecond)
+							}
+						}
+
+						if notified {
+							_, _ = fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+						} else {
+							_, _ = io.WriteString(conn, "*-1\r\n")
+						}
+					case args[0] == "GET" && len(args) == 2:
+						mu.Lock()
+						value, ok := values[args[1].(string)]
+						mu.Unlock()
+
+						if !ok {
+							_, _ = io.WriteString(conn, "$-1\r\n")
+						} else {
+							_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+						}
+					case args[0] == "SET" && len(args) >= 3:
+						key := args[1].(string)
+
+						mu.Lock()
+						_, exists := values[key]
+						nx := len(args) > 3 && args[3] == "NX"
+						if !exists || !nx {
+							values[key] = args[2].(string)
+						}
+						mu.Unlock()
+
+						if exists && nx {
+							_, _ = io.WriteString(conn, "$-1\r\n")
+						} else {
+							_, _ = io.WriteString(conn, "+OK\r\n")
+						}
+					case args[0] == "DEL" && len(args) == 2:
+						mu.Lock()
+						_, exists := values[args[1].(string)]
+						delete(values, args[1].(string))
+						mu.Unlock()
+
+						if exists {
+							_, _ = io.WriteString(conn, ":1\r\n")
+						} else {
+							_, _ = io.WriteString(conn, ":0\r\n")
+						}
+					default:
+						_, _ = io.WriteString(conn, "-ERR unknown command\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), counters
+}
+
+func TestMemoryQuotaStore(t *testing.T) {
+	current := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := &MemoryQuotaStore{Clock: ClockFunc(func() time.Time { return current })}
+
+	ctx := context.Background()
+	_, _ = store.Add(ctx, "a", 1, time.Minute)
+	_, _ = store.Add(ctx, "b", 1, time.Hour)
+
+	current = current.Add(time.Minute)
+
+	if value, _ := store.Add(ctx, "a", 1, time.Minute); value != 1 {
+		t.Fatalf("Expected the expired counter to restart, got %d", value)
+	}
+	if value, _ := store.Add(ctx, "b", 1, time.Hour); value != 2 {
+		t.Fatalf("Expected 2, got %d", value)
+	}
+	if len(store.counters) != 2 || len(store.buckets) != 2 {
+		t.Fatalf("Expected 2 counters in 2 buckets, got %d in %d", len(store.counters), len(store.buckets))
+	}
+
+	current = current.Add(time.Hour)
+	_, _ = store.Add(ctx, "c", 1, time.Minute)
+
+	if len(store.counters) != 1 || len(store.buckets) != 1 {
+		t.Fatalf("Expected the expired counters to be dropped, got %v", store.counters)
+	}
+}
+
+func TestRedisQuotaStore(t *testing.T) {
+	address, counters := newTestRedis(t, "secret")
+
+	store := NewRedisQuotaStore(RedisConfig{Address: address, Password: "secret", Prefix: "test:"})
+	defer store.Close()
+
+	for i, delta := range []int64{1, 1, -1, 5} {
+		value, err := store.Add(context.Background(), "quota:sender:alice@example.com", delta, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []int64{1, 2, 1, 6}[i]; value != expected {
+			t.Fatalf("[%d] Expected %d, got %d", i, expected, value)
+		}
+	}
+
+	if _, ok := counters["test:quota:sender:alice@example.com"]; !ok {
+		t.Fatalf("Expected prefixed key, got %v", counters)
+	}
+
+	// the concurrent commands share the pooled connections
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Add(context.Background(), "quota:sender:bob@example.com", 1, time.Hour); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if idle := len(store.client.idle); idle == 0 || idle > defaultRedisPoolSize {
+		t.Fatalf("Expected at most %d idle connections, got %d", defaultRedisPoolSize, idle)
+	}
+	if value, err := store.Add(context.Background(), "quota:sender:bob@example.com", 0, time.Hour); err != nil || value != 20 {
+		t.Fatalf("Expected 20, got %d (%v)", value, err)
+	}
+
+	wrong := NewRedisQuotaStore(RedisConfig{Address: address, Password: "wrong"})
+	defer wrong.Close()
+
+	_, err := wrong.Add(context.Background(), "quota:sender:alice@example.com", 1, time.Hour)
+	if err == nil || err.Error() != "redis: WRONGPASS invalid password" {
+		t.Fatalf("Expected WRONGPASS error, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package mailer
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -10,13 +11,48 @@ const defaultRandomAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvw
 var mr *rand.Rand
 
 func init() {
-	mr = rand.New(rand.NewSource(time.Now().UnixNano()))
+	mr = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
 }
 
+// lockedSource is a goroutine safe rand.Source64
+// (the sources created with rand.NewSource are not).
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.src.Seed(seed)
+}
+
+// PseudorandomString generates a pseudorandom string with the specified length.
+//
+// It is safe for concurrent use.
 func PseudorandomString(length int) string {
 	return PseudorandomStringWithAlphabet(length, defaultRandomAlphabet)
 }
 
+// PseudorandomStringWithAlphabet generates a pseudorandom string
+// with the specified length and characters set.
+//
+// It is safe for concurrent use.
 func PseudorandomStringWithAlphabet(length int, alphabet string) string {
 	b := make([]byte, length)
 	m := len(alphabet)
@@ -0,0 +1,25 @@
+package mailer
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPseudorandomStringConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				if str := PseudorandomString(15); len(str) != 15 {
+					t.Errorf("Expected 15 characters, got %q", str)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
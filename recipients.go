@@ -0,0 +1,268 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const defaultResolveTimeout = 10 * time.Second
+
+// ErrUnknownRecipient is returned by the recipient resolvers
+// when a symbolic recipient cannot be resolved.
+var ErrUnknownRecipient = errors.New("unknown recipient")
+
+// RecipientResolver expands symbolic recipients (eg. "team:oncall"
+// or "role:billing-admins") to concrete email addresses.
+type RecipientResolver interface {
+	// Resolve returns the addresses of the symbolic recipient
+	// or an error wrapping [ErrUnknownRecipient] if there is none.
+	Resolve(ctx context.Context, recipient string) ([]mail.Address, error)
+}
+
+// RecipientResolverFunc is an adapter to allow the use of ordinary functions as [RecipientResolver].
+type RecipientResolverFunc func(ctx context.Context, recipient string) ([]mail.Address, error)
+
+// Resolve implements [RecipientResolver] interface.
+func (f RecipientResolverFunc) Resolve(ctx context.Context, recipient string) ([]mail.Address, error) {
+	return f(ctx, recipient)
+}
+
+// StaticRecipients is a [RecipientResolver] backed by a static map
+// of symbolic recipients, matched case-insensitively.
+type StaticRecipients map[string][]mail.Address
+
+// Resolve implements [RecipientResolver] interface.
+func (s StaticRecipients) Resolve(_ context.Context, recipient string) ([]mail.Address, error) {
+	if addresses, ok := s[recipient]; ok {
+		return addresses, nil
+	}
+
+	for name, addresses := range s {
+		if strings.EqualFold(name, recipient) {
+			return addresses, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownRecipient, recipient)
+}
+
+// RecipientsConfig defines the symbolic recipients expansion settings.
+type RecipientsConfig struct {
+	// Static maps the symbolic recipients to their addresses, eg.
+	// "team:oncall": ["alice@example.com", "Bob <bob@example.com>"].
+	Static map[string][]string `mapstructure:"static" json:"static,omitempty" bson:"static,omitempty"`
+
+	// LDAP resolves the "user:{name}" and "group:{name}" recipients
+	// not found in the static map from an LDAP directory.
+	LDAP *LDAPConfig `mapstructure:"ldap" json:"ldap,omitempty" bson:"ldap,omitempty"`
+
+	// Timeout limits the resolution of the recipients of a single message (default to 10s).
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`
+}
+
+// Validate checks the recipients configuration for common mistakes.
+func (c RecipientsConfig) Validate() error {
+	var errs []error
+
+	if len(c.Static) == 0 && c.LDAP == nil {
+		errs = append(errs, errors.New("recipients: at least one resolver must be configured"))
+	}
+
+	if c.LDAP != nil {
+		if err := c.LDAP.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for name, addresses := range c.Static {
+		if !isSymbolicRecipient(name) {
+			errs = append(errs, fmt.Errorf("recipients: invalid symbolic recipient %q, expected \"{kind}:{name}\"", name))
+		}
+		for _, address := range addresses {
+			if _, err := mail.ParseAddress(address); err != nil {
+				errs = append(errs, fmt.Errorf("recipients: invalid %q address %q: %w", name, address, err))
+			}
+		}
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("recipients: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c RecipientsConfig) Redacted() RecipientsConfig {
+	if c.LDAP != nil {
+		ldap := c.LDAP.Redacted()
+		c.LDAP = &ldap
+	}
+
+	return c
+}
+
+// Resolver returns the RecipientResolver described by the config.
+func (c RecipientsConfig) Resolver() (RecipientResolver, error) {
+	var resolvers recipientResolvers
+
+	if len(c.Static) > 0 {
+		static := make(StaticRecipients, len(c.Static))
+		for name, addresses := range c.Static {
+			for _, address := range addresses {
+				addr, err := mail.ParseAddress(address)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %q address %q: %w", name, address, err)
+				}
+				static[name] = append(static[name], *addr)
+			}
+		}
+		resolvers = append(resolvers, static)
+	}
+
+	if c.LDAP != nil {
+		ldap, err := NewLDAPResolver(*c.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, ldap)
+	}
+
+	if len(resolvers) == 1 {
+		return resolvers[0], nil
+	}
+
+	return resolvers, nil
+}
+
+// recipientResolvers tries the resolvers in order until
+// one of them knows the recipient.
+type recipientResolvers []RecipientResolver
+
+func (rs recipientResolvers) Resolve(ctx context.Context, recipient string) ([]mail.Address, error) {
+	for _, r := range rs {
+		addresses, err := r.Resolve(ctx, recipient)
+		if !errors.Is(err, ErrUnknownRecipient) {
+			return addresses, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownRecipient, recipient)
+}
+
+// ResolveRecipients returns a middleware that expands the symbolic
+// To, Cc and Bcc recipients of every message with the provided
+// resolver before handing it to the next mailer.
+//
+// The concrete addresses are passed as they are and the duplicated
+// addresses of the same recipients list are sent only once.
+func ResolveRecipients(resolver RecipientResolver, cfg RecipientsConfig) Middleware {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultResolveTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if !hasSymbolicRecipients(m) {
+				return next.Send(m)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			m = m.Clone()
+
+			for _, list := range []*[]mail.Address{&m.To, &m.Cc, &m.Bcc} {
+				resolved, err := resolveRecipients(ctx, resolver, *list)
+				if err != nil {
+					return err
+				}
+				*list = resolved
+			}
+
+			if len(m.To)+len(m.Cc)+len(m.Bcc) == 0 {
+				return errors.New("no recipients left after the symbolic recipients expansion")
+			}
+
+			return next.Send(m)
+		})
+	}
+}
+
+func resolveRecipients(ctx context.Context, resolver RecipientResolver, list []mail.Address) ([]mail.Address, error) {
+	if list == nil {
+		return nil, nil
+	}
+
+	result := make([]mail.Address, 0, len(list))
+	seen := make(map[string]struct{}, len(list))
+
+	add := func(addr mail.Address) {
+		key := strings.ToLower(addr.Address)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			result = append(result, addr)
+		}
+	}
+
+	for _, addr := range list {
+		if !isSymbolicRecipient(addr.Address) {
+			add(addr)
+			continue
+		}
+
+		addresses, err := resolver.Resolve(ctx, addr.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve recipient %q: %w", addr.Address, err)
+		}
+
+		for _, resolved := range addresses {
+			if isSymbolicRecipient(resolved.Address) {
+				return nil, fmt.Errorf("recipient %q resolved to another symbolic recipient %q", addr.Address, resolved.Address)
+			}
+			add(resolved)
+		}
+	}
+
+	return result, nil
+}
+
+func hasSymbolicRecipients(m *Message) bool {
+	for _, list := range [][]mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, addr := range list {
+			if isSymbolicRecipient(addr.Address) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isSymbolicRecipient reports whether the address is in the
+// "{kind}:{name}" format, where kind is an alphanumeric identifier
+// (dashes and underscores allowed) and name is not empty.
+func isSymbolicRecipient(address string) bool {
+	if strings.ContainsAny(address, "@ \t\r\n") {
+		return false
+	}
+
+	kind, name, ok := strings.Cut(address, ":")
+	if !ok || kind == "" || name == "" {
+		return false
+	}
+
+	for i := 0; i < len(kind); i++ {
+		c := kind[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestResolveRecipients(t *testing.T) {
+	resolver := StaticRecipients{
+		"team:oncall": {{Name: "Alice", Address: "alice@example.com"}, {Address: "bob@example.com"}},
+		"role:admins": {{Address: "Bob@example.com"}, {Address: "carol@example.com"}},
+	}
+
+	var sent *Message
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		sent = m
+		return nil
+	}), ResolveRecipients(resolver, RecipientsConfig{}))
+
+	msg, err := NewMessage().
+		To("Team:OnCall", "dave@example.com").
+		Cc("role:admins", "carol@example.com").
+		Text("test").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTo := []string{"alice@example.com", "bob@example.com", "dave@example.com"}
+	if to := addressesToStrings(sent.To, false); !reflect.DeepEqual(to, expectedTo) {
+		t.Fatalf("Expected To %v, got %v", expectedTo, to)
+	}
+	expectedCc := []string{"Bob@example.com", "carol@example.com"}
+	if cc := addressesToStrings(sent.Cc, false); !reflect.DeepEqual(cc, expectedCc) {
+		t.Fatalf("Expected Cc %v, got %v", expectedCc, cc)
+	}
+	if sent.To[0].Name != "Alice" {
+		t.Fatalf("Expected the resolved address name, got %q", sent.To[0].Name)
+	}
+
+	// the original message is not modified
+	if msg.To[0].Address != "Team:OnCall" {
+		t.Fatalf("Expected the original message to be untouched, got %v", msg.To)
+	}
+
+	err = mailer.Send(&Message{To: []mail.Address{{Address: "team:unknown"}}, Text: "test"})
+	if !errors.Is(err, ErrUnknownRecipient) {
+		t.Fatalf("Expected ErrUnknownRecipient, got %v", err)
+	}
+}
+
+func TestResolveRecipientsEmpty(t *testing.T) {
+	resolver := RecipientResolverFunc(func(ctx context.Context, recipient string) ([]mail.Address, error) {
+		return nil, nil
+	})
+
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		t.Fatal("Expected the message not to be sent")
+		return nil
+	}), ResolveRecipients(resolver, RecipientsConfig{}))
+
+	if err := mailer.Send(&Message{To: []mail.Address{{Address: "team:empty"}}}); err == nil {
+		t.Fatal("Expected an error for a message without recipients")
+	}
+}
+
+func TestRecipientsConfigValidate(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config RecipientsConfig
+		valid  bool
+	}{
+		{"empty", RecipientsConfig{}, false},
+		{"valid", RecipientsConfig{Static: map[string][]string{"team:oncall": {"Alice <alice@example.com>"}}}, true},
+		{"not symbolic", RecipientsConfig{Static: map[string][]string{"oncall@example.com": {"alice@example.com"}}}, false},
+		{"invalid address", RecipientsConfig{Static: map[string][]string{"team:oncall": {"alice"}}}, false},
+		{"ldap", RecipientsConfig{LDAP: &LDAPConfig{URL: "ldaps://ldap.example.com", BaseDN: "dc=example,dc=com"}}, true},
+		{"ldap invalid url", RecipientsConfig{LDAP: &LDAPConfig{URL: "http://ldap.example.com", BaseDN: "dc=example,dc=com"}}, false},
+		{"ldap plaintext bind", RecipientsConfig{LDAP: &LDAPConfig{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com", BindDN: "cn=mailer"}}, false},
+		{"ldap insecure bind", RecipientsConfig{LDAP: &LDAPConfig{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com", BindDN: "cn=mailer", InsecureBind: true}}, true},
+		{"ldap start_tls bind", RecipientsConfig{LDAP: &LDAPConfig{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com", BindDN: "cn=mailer", StartTLS: true}}, true},
+		{"ldap invalid filter", RecipientsConfig{LDAP: &LDAPConfig{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com", UserFilter: "(&(uid={name})"}}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			err := s.config.Validate()
+			if s.valid && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !s.valid && err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
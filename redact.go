@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+const redactedMask = "******"
+
+// redact returns the mask for non-empty secrets.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return redactedMask
+}
+
+// credentialSecrets returns the password and token of the credentials,
+// along with the base64 forms of the PLAIN and XOAUTH2 initial responses
+// embedding them (the LOGIN ones being the base64 of the secrets).
+func credentialSecrets(creds *Credentials) []string {
+	if creds == nil {
+		return nil
+	}
+
+	var secrets []string
+	for _, secret := range []string{creds.Password, creds.Token} {
+		if secret == "" {
+			continue
+		}
+
+		secrets = append(secrets,
+			secret,
+			base64.StdEncoding.EncodeToString([]byte("\x00"+creds.Username+"\x00"+secret)),
+			base64.StdEncoding.EncodeToString([]byte("user="+creds.Username+"\x01auth=Bearer "+secret+"\x01\x01")),
+		)
+	}
+
+	return secrets
+}
+
+// redactedError wraps an error, masking the secrets in its message
+// while still allowing the original error to be unwrapped.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError masks all occurrences of the provided secrets (including
+// their base64 form, as sent by the SMTP AUTH commands) in the error message.
+func redactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	redacted := msg
+
+	for _, secret := range secrets {
+		if len(secret) < 3 {
+			continue // too short to be masked without mangling the message
+		}
+		redacted = strings.ReplaceAll(redacted, secret, redactedMask)
+		redacted = strings.ReplaceAll(redacted, base64.StdEncoding.EncodeToString([]byte(secret)), redactedMask)
+	}
+
+	if redacted == msg {
+		return err
+	}
+
+	return &redactedError{err: err, msg: redacted}
+}
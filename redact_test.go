@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSmtpClientRedacted(t *testing.T) {
+	client := SmtpClient{Host: "example.com", Username: "user", Password: "s3cr3t"}
+
+	redacted := client.Redacted()
+	if redacted.Password != redactedMask {
+		t.Fatalf("Expected masked password, got %q", redacted.Password)
+	}
+	if client.Password != "s3cr3t" {
+		t.Fatal("Expected the original config to remain unchanged")
+	}
+
+	for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+		if str := fmt.Sprintf(format, client); strings.Contains(str, "s3cr3t") {
+			t.Fatalf("[%s] Expected the password to be masked, got %s", format, str)
+		}
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	if err := redactError(nil, "s3cr3t"); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	original := errors.New("535 invalid credentials")
+	if err := redactError(original, "s3cr3t"); err != original {
+		t.Fatalf("Expected the same error instance, got %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("s3cr3t"))
+	original = fmt.Errorf("auth failed for s3cr3t (%s)", encoded)
+
+	err := redactError(original, "s3cr3t")
+	if strings.Contains(err.Error(), "s3cr3t") || strings.Contains(err.Error(), encoded) {
+		t.Fatalf("Expected the secret to be masked, got %v", err)
+	}
+	if !errors.Is(err, original) {
+		t.Fatal("Expected the redacted error to wrap the original one")
+	}
+}
+
+func TestCredentialSecrets(t *testing.T) {
+	if secrets := credentialSecrets(nil); secrets != nil {
+		t.Fatalf("Expected no secrets, got %v", secrets)
+	}
+
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00s3cr3t"))
+	xoauth2 := base64.StdEncoding.EncodeToString([]byte("user=user\x01auth=Bearer t0k3n\x01\x01"))
+	original := fmt.Errorf("AUTH PLAIN %s, AUTH XOAUTH2 %s: token t0k3n rejected", plain, xoauth2)
+
+	err := redactError(original, credentialSecrets(&Credentials{Username: "user", Password: "s3cr3t", Token: "t0k3n"})...)
+	for _, secret := range []string{"s3cr3t", "t0k3n", plain, xoauth2} {
+		if strings.Contains(err.Error(), secret) {
+			t.Fatalf("Expected %q to be masked, got %v", secret, err)
+		}
+	}
+}
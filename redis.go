@@ -0,0 +1,282 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisTimeout  = 5 * time.Second
+	defaultRedisPoolSize = 10
+)
+
+// RedisConfig defines the connection settings of the Redis backed stores.
+type RedisConfig struct {
+	Address  string        `mapstructure:"address" json:"address,omitempty" bson:"address,omitempty"` // eg. 127.0.0.1:6379
+	Username string        `mapstructure:"username" json:"username,omitempty" bson:"username,omitempty"`
+	Password string        `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"`
+	DB       int           `mapstructure:"db" json:"db,omitempty" bson:"db,omitempty"`
+	TLS      bool          `mapstructure:"tls" json:"tls,omitempty" bson:"tls,omitempty"`
+	Prefix   string        `mapstructure:"prefix" json:"prefix,omitempty" bson:"prefix,omitempty"`          // keys prefix, default to "mailer:"
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`       // dial and command timeout, default to 5s
+	PoolSize int           `mapstructure:"pool_size" json:"pool_size,omitempty" bson:"pool_size,omitempty"` // max idle connections, default to 10
+}
+
+// Validate checks the Redis configuration for common mistakes.
+func (c RedisConfig) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		errs = append(errs, fmt.Errorf("redis: invalid address %q, expected host:port", c.Address))
+	}
+
+	if c.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis: db must be positive, got %d", c.DB))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("redis: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.PoolSize < 0 {
+		errs = append(errs, fmt.Errorf("redis: pool_size must be positive, got %d", c.PoolSize))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c RedisConfig) Redacted() RedisConfig {
+	c.Password = redact(c.Password)
+
+	return c
+}
+
+func (c RedisConfig) prefix() string {
+	if c.Prefix == "" {
+		return "mailer:"
+	}
+
+	return c.Prefix
+}
+
+// redisError is a Redis error reply.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// errRedisClosed is returned by the commands sent after the client was closed.
+var errRedisClosed = errors.New("redis: client closed")
+
+// redisClient is a minimal RESP2 client with a pool of lazily established
+// connections. The connections are discarded on every I/O error, so that
+// the concurrent commands don't wait for each other.
+type redisClient struct {
+	config RedisConfig
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+// redisConn is a single connection of the redisClient pool.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(config RedisConfig) *redisClient {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRedisTimeout
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = defaultRedisPoolSize
+	}
+
+	return &redisClient{config: config}
+}
+
+// do sends a single command and returns its reply, which is either
+// nil, int64, string (for both the simple and bulk strings) or []any.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, redactError(err, c.config.Password)
+	}
+
+	reply, err := conn.roundTrip(ctx, c.config.Timeout, args)
+
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = conn.conn.Close()
+		return reply, err
+	}
+
+	c.put(conn)
+
+	return reply, err
+}
+
+// get returns an idle connection of the pool or establishes a new one.
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errRedisClosed
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	return c.connect(ctx)
+}
+
+// put returns the connection to the pool, closing it if the pool is full.
+func (c *redisClient) put(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || len(c.idle) >= c.config.PoolSize {
+		_ = conn.conn.Close()
+		return
+	}
+
+	c.idle = append(c.idle, conn)
+}
+
+func (c *redisConn) roundTrip(ctx context.Context, timeout time.Duration, args []string) (any, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+
+	if _, err := io.WriteString(c.conn, sb.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.r)
+}
+
+func (c *redisClient) connect(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: c.config.Timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.config.TLS {
+		host, _, _ := net.SplitHostPort(c.config.Address)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if c.config.Password != "" {
+		if c.config.Username != "" {
+			setup = append(setup, []string{"AUTH", c.config.Username, c.config.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.config.Password})
+		}
+	}
+	if c.config.DB > 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.config.DB)})
+	}
+
+	for _, args := range setup {
+		if _, err := rc.roundTrip(ctx, c.config.Timeout, args); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk string length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (c *redisClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, conn := range c.idle {
+		errs = append(errs, conn.conn.Close())
+	}
+	c.idle, c.closed = nil, true
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,663 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Render renders the message in its RFC 5322 wire format,
+// exactly as it would be composed by the SMTP client.
+//
+// The message itself is not modified, but note that the attachments
+// readers that cannot be cloned (see [Message.Clone]) are consumed.
+func (m *Message) Render() ([]byte, error) {
+	var r Renderer
+
+	return r.Render(m)
+}
+
+// EstimateSize returns the size in octets of the message wire format
+// (headers, MIME structure and transfer encoding overhead included)
+// without sending it, eg. to check it against the relay size limit.
+//
+// The result could differ by a few octets from the actual sent message
+// due to the generated Date, Message-ID and MIME boundaries. As with
+// [Message.Render], the attachments readers that cannot be cloned are consumed.
+func (m *Message) EstimateSize() (int64, error) {
+	var r Renderer
+
+	return r.Size(m)
+}
+
+// Renderer renders messages in their RFC 5322 wire format.
+//
+// The zero value is ready to use and relies on the system clock,
+// crypto/rand and [DefaultMessageID]. Setting Clock and Rand to
+// deterministic implementations makes the Date header, the MIME
+// boundaries and the default Message-ID reproducible (eg. for golden tests).
+type Renderer struct {
+	// Clock is used for the Date header and the default Message-ID.
+	Clock Clock
+
+	// Rand is used for the MIME boundaries and the default Message-ID.
+	Rand io.Reader
+
+	// MessageID generates the Message-ID header of the messages without one.
+	MessageID MessageIDGenerator
+
+	// BodyEncoding is the text bodies transfer encoding
+	// (default to [BodyEncodingQuotedPrintable]).
+	BodyEncoding BodyEncoding
+}
+
+// Render renders the message and returns its raw bytes.
+func (r *Renderer) Render(m *Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := r.Write(&buf, m); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Size returns the size in octets of the rendered message without
+// keeping it in memory (see [Message.EstimateSize]).
+func (r *Renderer) Size(m *Message) (int64, error) {
+	var w countingWriter
+
+	m = m.Clone()
+	m.rendered = nil // not a send
+
+	if err := r.Write(&w, m); err != nil {
+		return 0, err
+	}
+
+	return w.n, nil
+}
+
+// countingWriter discards the written data, counting only its length.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+
+	return len(p), nil
+}
+
+// Write renders the message into w.
+//
+// The message is not modified, but its attachments readers
+// that cannot be cloned (see [Message.Clone]) are consumed.
+//
+// Messages with signers (see [Signing]) are rendered in memory
+// first and the signature headers are prepended to them, as are
+// the ones whose rendering is captured (see [Message.captureRendered]).
+func (r *Renderer) Write(w io.Writer, m *Message) error {
+	if len(m.signers) == 0 && m.rendered == nil {
+		return r.write(w, m)
+	}
+
+	var buf bytes.Buffer
+	if err := r.write(&buf, m); err != nil {
+		return err
+	}
+
+	raw, err := sign(buf.Bytes(), m.signers)
+	if err != nil {
+		return err
+	}
+
+	if m.rendered != nil {
+		m.rendered.set(raw)
+	}
+
+	_, err = w.Write(raw)
+
+	return err
+}
+
+// renderCapture keeps the last rendering of a message and its clones.
+type renderCapture struct {
+	mu  sync.Mutex
+	raw []byte
+}
+
+func (c *renderCapture) set(raw []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.raw = raw
+}
+
+// bytes returns the last rendered bytes, nil if the message was not rendered.
+func (c *renderCapture) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.raw
+}
+
+// captureRendered makes the next renderings of the message and its clones
+// (eg. by the backend right before the SMTP DATA command) kept, so that
+// the exact bytes sent could be retrieved after a successful send. The
+// last rendering is kept, ie. the one of the backend that sent the message
+// when a failover tried several ones.
+//
+// The message must not be shared, eg. it must be a clone.
+func (m *Message) captureRendered() *renderCapture {
+	if m.rendered == nil {
+		m.rendered = &renderCapture{}
+	}
+
+	return m.rendered
+}
+
+func (r *Renderer) write(w io.Writer, m *Message) error {
+	m, err := m.withPreheader().applyCharset()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	if err := r.writeNode(bw, r.headers(m), m.mimeTree(r.BodyEncoding)); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// writeNode writes the MIME tree node prefixed with the provided headers.
+func (r *Renderer) writeNode(w io.Writer, headers *headerList, node *mimeNode) error {
+	if node.leaf != nil {
+		return node.leaf(w, headers)
+	}
+
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(r.boundary()); err != nil {
+		return err
+	}
+
+	contentType := "multipart/" + node.multipart + "; boundary=" + mw.Boundary()
+	if node.multipart == "related" {
+		// the root part type (RFC 2387)
+		contentType = "multipart/related; type=\"" + node.children[0].mediaType + "\"; boundary=" + mw.Boundary()
+	}
+
+	headers.set("Content-Type", contentType)
+	if err := headers.write(w); err != nil {
+		return err
+	}
+
+	for _, child := range node.children {
+		partHeaders := &headerList{}
+		pw := &deferredPartWriter{parent: mw, headers: partHeaders}
+		if err := r.writeNode(pw, partHeaders, child); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// undisclosedRecipients is the empty group To header of the messages
+// with hidden recipients (RFC 5322 section 3.4).
+const undisclosedRecipients = "undisclosed-recipients:;"
+
+// headers returns the message top level headers (without the content ones).
+func (r *Renderer) headers(m *Message) *headerList {
+	h := &headerList{}
+
+	h.set("From", stripNewLines(formatAddress(m.From)))
+	switch {
+	case m.HideRecipients:
+		h.set("To", undisclosedRecipients)
+	case len(m.To) > 0:
+		h.set("To", joinAddresses(m.To))
+	}
+	if len(m.Cc) > 0 {
+		h.set("Cc", joinAddresses(m.Cc))
+	}
+	if m.bccHeader {
+		if bcc := m.hiddenRecipients(); len(bcc) > 0 {
+			h.set("Bcc", joinAddresses(bcc))
+		}
+	}
+	charset := m.charsetName()
+
+	h.set("Subject", encodeHeaderValue(charset, m.Subject))
+	h.set("Date", messageDate(m, r.Clock).Format(time.RFC1123Z))
+	h.set("Message-ID", r.messageID(m))
+	h.set("MIME-Version", "1.0")
+
+	if m.Locale != "" {
+		h.set("Content-Language", stripNewLines(m.Locale))
+	}
+
+	for _, kv := range sortedHeaders(m.threadHeaders()) {
+		h.set(kv[0], kv[1])
+	}
+
+	for _, kv := range sortedHeaders(m.autoHeaders()) {
+		h.set(kv[0], kv[1])
+	}
+
+	for _, kv := range sortedHeaders(m.tagHeaders()) {
+		h.set(kv[0], encodeHeaderValue(charset, kv[1]))
+	}
+
+	// custom headers replace the generated ones with the same name,
+	// except the Bcc one that would disclose the hidden recipients
+	for _, kv := range sortedHeaders(m.Headers) {
+		if name := sanitizeHeaderName(kv[0]); name != "" && !strings.EqualFold(name, "Bcc") {
+			h.set(name, encodeHeaderValue(charset, kv[1]))
+		}
+	}
+
+	return h
+}
+
+// messageDate returns the message Date override or the current clock time.
+func messageDate(m *Message, clock Clock) time.Time {
+	if !m.Date.IsZero() {
+		return m.Date
+	}
+
+	return now(clock)
+}
+
+func (r *Renderer) messageID(m *Message) string {
+	if r.MessageID != nil {
+		return r.MessageID(m)
+	}
+
+	return newMessageID(now(r.Clock), r.rand(), messageIDDomain(m.From.Address))
+}
+
+func (r *Renderer) rand() io.Reader {
+	if r.Rand == nil {
+		return rand.Reader
+	}
+
+	return r.Rand
+}
+
+// boundary returns a new random MIME boundary.
+func (r *Renderer) boundary() string {
+	b := make([]byte, 15)
+	if _, err := io.ReadFull(r.rand(), b); err != nil {
+		// extremely unlikely, fallback to the math/rand generator
+		return PseudorandomString(30)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// -------------------------------------------------------------------
+// Headers
+// -------------------------------------------------------------------
+
+// headerList is an ordered list of header fields.
+type headerList struct {
+	fields [][2]string
+}
+
+// set replaces the value of the first field with the specified
+// name (case-insensitive) or appends a new one if there is none.
+func (h *headerList) set(name, value string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f[0], name) {
+			h.fields[i][1] = value
+			return
+		}
+	}
+
+	h.fields = append(h.fields, [2]string{name, value})
+}
+
+// write writes the folded header fields followed by the empty line separating them from the body.
+func (h *headerList) write(w io.Writer) error {
+	var buf bytes.Buffer
+
+	for _, f := range h.fields {
+		field, err := foldHeader(f[0], f[1])
+		if err != nil {
+			return err
+		}
+		buf.WriteString(field)
+	}
+	buf.WriteString("\r\n")
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// foldedLineLength is the recommended max header line length (RFC 5322 section 2.1.1).
+const foldedLineLength = 78
+
+// foldHeader formats a CRLF terminated header field, folding its value
+// before the whitespaces so that the lines don't exceed the recommended
+// 78 characters whenever possible.
+//
+// It returns an error if a line still exceeds the 998 octets limit
+// (eg. a long value without any whitespace).
+func foldHeader(name, value string) (string, error) {
+	var sb strings.Builder
+	sb.Grow(len(name) + len(value) + 8)
+
+	sb.WriteString(name)
+	sb.WriteString(":")
+	if value != "" {
+		sb.WriteString(" ")
+	}
+
+	lineStart := 0 // the current line offset within sb
+
+	for value != "" {
+		// the next whitespace separated chunk (including its leading whitespace)
+		end := strings.IndexAny(value[1:], " \t") + 1
+		if end == 0 {
+			end = len(value)
+		}
+		chunk := value[:end]
+		value = value[end:]
+
+		line := sb.String()[lineStart:]
+
+		// fold only before a whitespace followed by some text, so that no
+		// whitespace-only line is produced
+		foldable := (chunk[0] == ' ' || chunk[0] == '\t') && strings.TrimSpace(chunk) != "" &&
+			strings.TrimSpace(line) != "" && !strings.HasSuffix(line, ": ")
+
+		if foldable && len(line)+len(chunk) > foldedLineLength {
+			sb.WriteString("\r\n")
+			lineStart = sb.Len()
+		}
+		sb.WriteString(chunk)
+
+		if sb.Len()-lineStart > maxLineLength {
+			return "", fmt.Errorf("header %s exceeds the max line length of %d octets", name, maxLineLength)
+		}
+	}
+
+	sb.WriteString("\r\n")
+
+	return sb.String(), nil
+}
+
+// deferredPartWriter creates a new multipart part with the
+// provided headers on the first Write call.
+//
+// It allows writeNode to be used both for a top level and a nested part.
+type deferredPartWriter struct {
+	parent  *multipart.Writer
+	headers *headerList
+	part    io.Writer
+}
+
+func (w *deferredPartWriter) Write(p []byte) (int, error) {
+	if w.part == nil {
+		// the first write is always the headers block, which is replaced
+		// by the multipart.Writer serialized part headers (written as is,
+		// so the values are folded in advance)
+		header := make(textproto.MIMEHeader, len(w.headers.fields))
+		for _, f := range w.headers.fields {
+			field, err := foldHeader(f[0], f[1])
+			if err != nil {
+				return 0, err
+			}
+			field = strings.TrimPrefix(field, f[0]+":")
+			header.Set(f[0], strings.TrimSuffix(strings.TrimPrefix(field, " "), "\r\n"))
+		}
+
+		part, err := w.parent.CreatePart(header)
+		if err != nil {
+			return 0, err
+		}
+		w.part = part
+
+		return len(p), nil
+	}
+
+	return w.part.Write(p)
+}
+
+func sortedHeaders(headers map[string]string) [][2]string {
+	result := make([][2]string, 0, len(headers))
+	for k, v := range headers {
+		result = append(result, [2]string{k, v})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i][0] < result[j][0]
+	})
+
+	return result
+}
+
+// encodeHeaderValue strips the new lines from the header value and
+// Q-encodes it (RFC 2047) in the charset if it contains non-ASCII characters.
+func encodeHeaderValue(charset, value string) string {
+	value = stripNewLines(value)
+	if isASCII(value) {
+		return value
+	}
+
+	return mime.QEncoding.Encode(charset, encodeCharset(charset, value))
+}
+
+var newLinesReplacer = strings.NewReplacer("\r\n", "", "\r", "", "\n", "")
+
+func stripNewLines(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+
+	return newLinesReplacer.Replace(s)
+}
+
+// joinAddresses formats the addresses list of a header field.
+//
+// The new lines are stripped, as [mail.Address.String] quotes (but
+// keeps) them in the address local part.
+func joinAddresses(addresses []mail.Address) string {
+	return stripNewLines(strings.Join(addressesToStrings(addresses, true), ", "))
+}
+
+// -------------------------------------------------------------------
+// Parts
+// -------------------------------------------------------------------
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+// writeAttachment writes a single base64 encoded attachment part, prefixed
+// with the provided headers. Inline attachments are sent with a Content-ID
+// matching their name, so that they could be referenced as "cid:{name}".
+func writeAttachment(w io.Writer, headers *headerList, name string, r io.Reader, inline bool) error {
+	// sniff the content type from the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+
+	mediaType, params, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+		headers.set("Content-ID", "<"+name+">")
+	}
+
+	headers.set("Content-Type", mime.FormatMediaType(mediaType, params)+"; "+fileNameParam("name", name, false))
+	headers.set("Content-Disposition", disposition+"; "+fileNameParam("filename", name, true))
+	headers.set("Content-Transfer-Encoding", "base64")
+	if err := headers.write(w); err != nil {
+		return err
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w, max: 76})
+	if _, err := encoder.Write(head); err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, r); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("\r\n"))
+
+	return err
+}
+
+// maxParamChunk is the max length of a single RFC 2231 parameter continuation value.
+const maxParamChunk = 60
+
+// fileNameParam formats a "name" or "filename" media type parameter.
+//
+// The non-ASCII names are sent both RFC 2047 encoded (understood by
+// Outlook and the other legacy clients) and, with extended set, also
+// RFC 2231 encoded as "filename*" (which takes precedence for the
+// compliant clients), eg. for "Смета 2024.pdf":
+//
+//	filename="=?UTF-8?B?0KHQvNC10YLQsCAyMDI0LnBkZg==?=";
+//	 filename*=UTF-8''%D0%A1%D0%BC%D0%B5%D1%82%D0%B0%202024.pdf
+//
+// Long extended values are split into RFC 2231 continuations
+// ("filename*0*", "filename*1*", ...), so that they could be folded.
+func fileNameParam(key, name string, extended bool) string {
+	name = stripNewLines(name)
+
+	if isASCII(name) {
+		// quoted only when needed
+		return strings.TrimPrefix(mime.FormatMediaType("x", map[string]string{key: name}), "x; ")
+	}
+
+	param := key + "=" + quoteParamValue(mime.BEncoding.Encode("UTF-8", name))
+	if !extended {
+		return param
+	}
+
+	encoded := percentEncode2231(name)
+	if len(encoded) <= maxParamChunk {
+		return param + "; " + key + "*=UTF-8''" + encoded
+	}
+
+	for i := 0; encoded != ""; i++ {
+		end := maxParamChunk
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		// don't split a percent-encoded octet
+		if j := strings.LastIndexByte(encoded[:end], '%'); j >= 0 && j > end-3 && end < len(encoded) {
+			end = j
+		}
+
+		chunk := encoded[:end]
+		if i == 0 {
+			chunk = "UTF-8''" + chunk
+		}
+		param += "; " + key + "*" + strconv.Itoa(i) + "*=" + chunk
+		encoded = encoded[end:]
+	}
+
+	return param
+}
+
+var quoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoteParamValue returns the value as quoted-string.
+func quoteParamValue(value string) string {
+	return `"` + quoteReplacer.Replace(value) + `"`
+}
+
+// percentEncode2231 percent-encodes all octets except the RFC 2231 attribute-char ones.
+func percentEncode2231(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c > ' ' && c < 0x7f && !strings.ContainsRune(`*'%()<>@,;:\"/[]?=`, rune(c)) {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[c>>4])
+		sb.WriteByte(hex[c&15])
+	}
+
+	return sb.String()
+}
+
+var crlf = []byte("\r\n")
+
+// lineWrapper inserts a CRLF after every max written bytes.
+type lineWrapper struct {
+	w       io.Writer
+	max     int
+	written int
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	total := 0
+
+	for len(p) > 0 {
+		if lw.written == lw.max {
+			if _, err := lw.w.Write(crlf); err != nil {
+				return total, err
+			}
+			lw.written = 0
+		}
+
+		chunk := lw.max - lw.written
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+
+		n, err := lw.w.Write(p[:chunk])
+		total += n
+		lw.written += n
+		if err != nil {
+			return total, err
+		}
+
+		p = p[chunk:]
+	}
+
+	return total, nil
+}
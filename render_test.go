@@ -0,0 +1,621 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func newTestRenderer() *Renderer {
+	return &Renderer{
+		Clock: ClockFunc(func() time.Time {
+			return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		}),
+		Rand: rand.New(rand.NewSource(1)),
+	}
+}
+
+func newTestRenderMessage() *Message {
+	return &Message{
+		From:    mail.Address{Name: "Sender", Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Cc:      []mail.Address{{Name: "Ünicode", Address: "cc@example.com"}},
+		Bcc:     []mail.Address{{Address: "bcc@example.com"}},
+		Subject: "Hello Wörld",
+		Text:    "text body",
+		HTML:    "<p>html body</p>",
+		Headers: map[string]string{"X-Custom": "custom"},
+		Attachments: map[string]io.Reader{
+			"b.txt": strings.NewReader("attachment b"),
+			"a.txt": strings.NewReader("attachment a"),
+		},
+	}
+}
+
+func TestRendererDeterministic(t *testing.T) {
+	raw1, err := newTestRenderer().Render(newTestRenderMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw2, err := newTestRenderer().Render(newTestRenderMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(raw1, raw2) {
+		t.Fatalf("Expected identical renders, got\n%s\n\n%s", raw1, raw2)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{
+		"Date":     "Tue, 02 Jan 2024 03:04:05 +0000",
+		"Subject":  "=?UTF-8?q?Hello_W=C3=B6rld?=",
+		"X-Custom": "custom",
+		"Bcc":      "",
+	}
+	for name, expected := range headers {
+		if v := msg.Header.Get(name); v != expected {
+			t.Errorf("Expected %s header %q, got %q", name, expected, v)
+		}
+	}
+
+	idPrefix := "<" + strconv.FormatInt(newTestRenderer().Clock.Now().UnixNano(), 36) + "."
+	if id := msg.Header.Get("Message-Id"); !strings.HasPrefix(id, idPrefix) || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Expected Message-ID derived from the fixed clock, got %q", id)
+	}
+}
+
+func TestRendererStructure(t *testing.T) {
+	raw, err := newTestRenderer().Render(newTestRenderMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("Expected multipart/mixed, got %q", mediaType)
+	}
+
+	var parts []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name := p.FileName(); name != "" {
+			body, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+			parts = append(parts, name+":"+string(body))
+			continue
+		}
+
+		altType, altParams, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if altType != "multipart/alternative" {
+			t.Fatalf("Expected multipart/alternative body, got %q", altType)
+		}
+
+		alt := multipart.NewReader(p, altParams["boundary"])
+		for {
+			ap, err := alt.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(ap)
+			parts = append(parts, strings.SplitN(ap.Header.Get("Content-Type"), ";", 2)[0]+":"+string(body))
+		}
+	}
+
+	expected := []string{
+		"text/plain:text body",
+		"text/html:<p>html body</p>",
+		"a.txt:attachment a",
+		"b.txt:attachment b",
+	}
+	if strings.Join(parts, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Expected parts %v, got %v", expected, parts)
+	}
+}
+
+func TestRendererSinglePart(t *testing.T) {
+	raw, err := newTestRenderer().Render(&Message{
+		From:    mail.Address{Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Subject: "test",
+		HTML:    "<p>html</p>",
+		Headers: map[string]string{"message-id": "<custom@example.com>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := msg.Header.Get("Content-Type"); v != "text/html; charset=UTF-8" {
+		t.Fatalf("Expected text/html content type, got %q", v)
+	}
+	if v := msg.Header["Message-Id"]; len(v) != 1 || v[0] != "<custom@example.com>" {
+		t.Fatalf("Expected the custom Message-ID to replace the default one, got %v", v)
+	}
+}
+
+func TestRendererDateOverride(t *testing.T) {
+	date := time.Date(2020, 5, 6, 7, 8, 9, 0, time.FixedZone("", 2*60*60))
+
+	raw, err := newTestRenderer().Render(&Message{
+		From: mail.Address{Address: "sender@example.com"},
+		To:   []mail.Address{{Address: "to@example.com"}},
+		Text: "test",
+		Date: date,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := msg.Header.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(date) {
+		t.Fatalf("Expected Date %v, got %v", date, parsed)
+	}
+}
+
+func TestRendererAutoHeaders(t *testing.T) {
+	raw, err := newTestRenderer().Render(&Message{
+		From:    mail.Address{Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Text:    "test",
+		Auto:    true,
+		Headers: map[string]string{"Precedence": "list"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{
+		"Auto-Submitted":           "auto-generated",
+		"Precedence":               "list", // custom headers take precedence
+		"X-Auto-Response-Suppress": "All",
+	}
+	for name, expected := range headers {
+		if v := msg.Header.Get(name); v != expected {
+			t.Errorf("Expected %s header %q, got %q", name, expected, v)
+		}
+	}
+}
+
+func TestRendererAMP(t *testing.T) {
+	m := &Message{
+		From:    mail.Address{Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Subject: "test",
+		Text:    "text body",
+		HTML:    "<p>html body</p>",
+		AMP:     "<html amp4email><body>amp body</body></html>",
+	}
+
+	raw, err := newTestRenderer().Render(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected multipart/alternative, got %q (%v)", mediaType, err)
+	}
+
+	var types []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, strings.SplitN(p.Header.Get("Content-Type"), ";", 2)[0])
+	}
+
+	// some clients render only the last part, so the html fallback must come after the amp one
+	if v := strings.Join(types, ","); v != "text/plain,text/x-amp-html,text/html" {
+		t.Fatalf("Unexpected alternatives order %q", v)
+	}
+
+	parsed, err := ParseMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.AMP != m.AMP || parsed.HTML != m.HTML || parsed.Text != m.Text {
+		t.Fatalf("Expected the bodies to be parsed back, got %+v", parsed)
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	scenarios := []struct {
+		name, value string
+		expected    string
+	}{
+		{"Subject", "short", "Subject: short\r\n"},
+		{"Subject", "", "Subject:\r\n"},
+		{
+			"To",
+			"aaaaaaaaaa@example.com, bbbbbbbbbb@example.com, cccccccccc@example.com, dddddddddd@example.com",
+			"To: aaaaaaaaaa@example.com, bbbbbbbbbb@example.com, cccccccccc@example.com,\r\n dddddddddd@example.com\r\n",
+		},
+		{
+			// no whitespace to fold at
+			"X-Long", strings.Repeat("a", 100),
+			"X-Long: " + strings.Repeat("a", 100) + "\r\n",
+		},
+		{
+			// no whitespace-only lines
+			"X-Spaces", strings.Repeat("a", 80) + "   ",
+			"X-Spaces: " + strings.Repeat("a", 80) + "   \r\n",
+		},
+	}
+
+	for i, s := range scenarios {
+		v, err := foldHeader(s.name, s.value)
+		if err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		if v != s.expected {
+			t.Errorf("(%d) Expected\n%q\ngot\n%q", i, s.expected, v)
+		}
+	}
+
+	if _, err := foldHeader("X-Long", strings.Repeat("a", 1000)); err == nil {
+		t.Fatal("Expected line length error")
+	}
+}
+
+// checkWireFormat checks that all raw lines are CRLF terminated and within the RFC 5322 limit.
+func checkWireFormat(t *testing.T, raw []byte) {
+	t.Helper()
+
+	for i, line := range strings.SplitAfter(string(raw), "\r\n") {
+		content := strings.TrimSuffix(line, "\r\n")
+		if strings.ContainsAny(content, "\r\n") {
+			t.Fatalf("Line %d contains a bare CR or LF: %q", i, line)
+		}
+		if len(content) > maxLineLength {
+			t.Fatalf("Line %d exceeds %d octets: %d", i, maxLineLength, len(content))
+		}
+	}
+}
+
+func FuzzRenderBody(f *testing.F) {
+	f.Add("hello\nworld", "<p>hello</p>", "subject", uint8(0))
+	f.Add(strings.Repeat("a", 2000), strings.Repeat("<b>x</b>", 500), strings.Repeat("word ", 100), uint8(2))
+	f.Add(".\r\n.hidden\r\n..\n", "\r\r\n\n", "Ünïcødé 🎉 "+strings.Repeat("ж", 80), uint8(3))
+	f.Add("Здравей\rсвят", "<p>"+strings.Repeat("日本語", 400)+"</p>", "", uint8(4))
+
+	encodings := []BodyEncoding{"", BodyEncodingQuotedPrintable, BodyEncodingBase64, BodyEncoding8Bit, BodyEncodingAuto}
+
+	f.Fuzz(func(t *testing.T, text, html, subject string, encoding uint8) {
+		r := newTestRenderer()
+		r.BodyEncoding = encodings[int(encoding)%len(encodings)]
+
+		raw, err := r.Render(&Message{
+			From:    mail.Address{Address: "from@example.com"},
+			To:      []mail.Address{{Address: "to@example.com"}},
+			Subject: subject,
+			Text:    text,
+			HTML:    html,
+		})
+		if err != nil {
+			if strings.Contains(err.Error(), "max line length") {
+				return // unfoldable header values are rejected
+			}
+			t.Fatal(err)
+		}
+
+		checkWireFormat(t, raw)
+
+		if _, err := ParseMessage(bytes.NewReader(raw)); err != nil {
+			t.Fatalf("Failed to parse the rendered message: %v", err)
+		}
+	})
+}
+
+// headerNames returns the field names of the raw message top level headers.
+func headerNames(raw []byte) []string {
+	block, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+
+	var names []string
+	for _, line := range strings.Split(block, "\r\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(line, ":")
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func FuzzRenderHeaders(f *testing.F) {
+	f.Add("Hello 🎉 Wörld", "Ünïcødé Sender", "to@example.com", "X-Custom", "custom")
+	f.Add("line\r\nBcc: victim@example.com", "Name\r\nBcc: victim@example.com", "to@example.com\r\nBcc: victim@example.com", "X-A: b\r\nBcc", "v\nBcc: victim@example.com")
+	f.Add(`"quoted" \\ subject`, `"Doe, John" (comment)`, `"john..doe"@example.com`, "Subject", "=?UTF-8?q?encoded?=")
+	f.Add(strings.Repeat("долга тема ", 20), strings.Repeat("Name ", 30), "a@b", "", "\x00\x7f\t")
+
+	allowed := map[string]bool{}
+	for _, name := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		allowed[strings.ToLower(name)] = true
+	}
+
+	f.Fuzz(func(t *testing.T, subject, name, to, headerName, headerValue string) {
+		m := &Message{
+			From:    mail.Address{Name: name, Address: "from@example.com"},
+			To:      []mail.Address{{Address: to}},
+			Subject: subject,
+			Text:    "text",
+			Headers: map[string]string{headerName: headerValue},
+		}
+
+		raw, err := newTestRenderer().Render(m)
+		if err != nil {
+			if strings.Contains(err.Error(), "max line length") {
+				return // unfoldable header values are rejected
+			}
+			t.Fatal(err)
+		}
+
+		checkWireFormat(t, raw)
+
+		// no header field could be injected through the values and names
+		expected := sanitizeHeaderName(headerName)
+		for _, field := range headerNames(raw) {
+			if !allowed[strings.ToLower(field)] && !strings.EqualFold(field, expected) {
+				t.Fatalf("Unexpected header field %q in\n%s", field, raw)
+			}
+		}
+
+		parsed, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			if strings.Contains(err.Error(), "invalid ") {
+				return // the fuzzed addresses are mostly invalid
+			}
+			t.Fatalf("Failed to parse the rendered message: %v", err)
+		}
+
+		// the encoded-word lookalikes are decoded by the parser, and
+		// the unfolding collapses the whitespaces
+		if utf8.ValidString(subject) && !strings.Contains(subject, "=?") && !strings.EqualFold(expected, "Subject") {
+			if got, want := strings.Fields(parsed.Subject), strings.Fields(stripNewLines(subject)); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Fatalf("Expected subject %q, got %q", want, got)
+			}
+		}
+	})
+}
+
+func FuzzRenderAddress(f *testing.F) {
+	f.Add("John Doe <john@example.com>")
+	f.Add(`"Doe, John" <john.doe@example.com>`)
+	f.Add(`=?UTF-8?q?J=C3=B6rg?= <jorg@example.com>`)
+	f.Add(`"quoted\"name" <"local part"@example.com>`)
+	f.Add("john@example.com (comment)")
+	f.Add("Ünïcødé 🎉 <unicode@example.com>")
+	f.Add(`<" "@0>`)       // quoted local part without name
+	f.Add("0@0(\\\\\x0f)") // non-ASCII name with a backslash
+
+	f.Fuzz(func(t *testing.T, address string) {
+		m, err := NewMessage().From(address).To(address).Text("text").Build()
+		if err != nil {
+			return // invalid addresses are rejected by the builder
+		}
+
+		raw, err := newTestRenderer().Render(m)
+		if err != nil {
+			if strings.Contains(err.Error(), "max line length") {
+				return
+			}
+			t.Fatal(err)
+		}
+
+		checkWireFormat(t, raw)
+
+		parsed, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Failed to parse the rendered address %q: %v\n%s", address, err, raw)
+		}
+
+		// the unfolding may collapse the whitespaces of a long name
+		normalize := func(a mail.Address) string {
+			return strings.Join(strings.Fields(a.Name), " ") + " <" + a.Address + ">"
+		}
+		if normalize(parsed.From) != normalize(m.From) || len(parsed.To) != 1 || normalize(parsed.To[0]) != normalize(m.To[0]) {
+			t.Fatalf("Expected %q, got From %q and To %v", normalize(m.From), normalize(parsed.From), parsed.To)
+		}
+	})
+}
+
+func TestRendererAttachmentFileNames(t *testing.T) {
+	longName := strings.Repeat("Отчет ", 20) + ".pdf"
+
+	for _, name := range []string{"report 2024.pdf", "Смета 2024.pdf", longName} {
+		raw, err := newTestRenderer().Render(&Message{
+			From:        mail.Address{Address: "sender@example.com"},
+			To:          []mail.Address{{Address: "to@example.com"}},
+			Text:        "text",
+			Attachments: map[string]io.Reader{name: strings.NewReader("%PDF-1.4")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkWireFormat(t, raw)
+
+		if !isASCII(name) {
+			if !bytes.Contains(raw, []byte(`filename="=?UTF-8?b?`)) || !bytes.Contains(raw, []byte(`name="=?UTF-8?b?`)) {
+				t.Fatalf("Expected the RFC 2047 encoded names, got\n%s", raw)
+			}
+			if !bytes.Contains(raw, []byte("filename*=UTF-8''")) && !bytes.Contains(raw, []byte("filename*0*=UTF-8''")) {
+				t.Fatalf("Expected the RFC 2231 encoded filename, got\n%s", raw)
+			}
+		}
+
+		parsed, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := parsed.Attachments[name]; !ok {
+			t.Fatalf("Expected attachment %q, got %v", name, parsed.Attachments)
+		}
+	}
+
+	// legacy RFC 2047 only names
+	raw := "From: a@example.com\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: application/pdf; name=\"=?UTF-8?B?0KHQvNC10YLQsCAyMDI0LnBkZg==?=\"\r\n" +
+		"Content-Disposition: attachment\r\n\r\ndata\r\n--b--\r\n"
+	parsed, err := ParseMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsed.Attachments["Смета 2024.pdf"]; !ok {
+		t.Fatalf("Expected the RFC 2047 encoded name to be decoded, got %v", parsed.Attachments)
+	}
+}
+
+func TestParseMessageNullSender(t *testing.T) {
+	raw := "From: MAILER-DAEMON@example.com\r\nReturn-Path: <>\r\nTo: john@example.com\r\nSubject: bounce\r\n\r\nhello\r\n"
+
+	parsed, err := ParseMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.NullSender || envelopeSender(parsed) != "" {
+		t.Fatalf("Expected the null sender to be kept, got %q", envelopeSender(parsed))
+	}
+
+	// eg. the outbox and queue spool envelope
+	restored := &Message{From: parsed.From}
+	restoreEnvelope(restored, envelopeSender(parsed), nil)
+	if !restored.NullSender {
+		t.Fatal("Expected the null sender to be restored")
+	}
+}
+
+func TestMessageEstimateSize(t *testing.T) {
+	newMessage := func() *Message {
+		m := newTestRenderMessage()
+		m.Attachments = map[string]io.Reader{"data.bin": bytes.NewReader(bytes.Repeat([]byte{0xff}, 30000))}
+		return m
+	}
+
+	m := newMessage()
+
+	size, err := newTestRenderer().Size(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the attachment reader is not consumed
+	raw, err := newTestRenderer().Render(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(raw)) {
+		t.Fatalf("Expected size %d, got %d", len(raw), size)
+	}
+
+	// base64 with 76 chars lines
+	if size < 40000+40000/76*2 {
+		t.Fatalf("Expected the size to include the base64 overhead, got %d", size)
+	}
+
+	estimated, err := newMessage().EstimateSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := estimated - size; d < -50 || d > 50 {
+		t.Fatalf("Expected an estimated size close to %d, got %d", size, estimated)
+	}
+}
+
+func benchmarkMessage() *Message {
+	return &Message{
+		From:    mail.Address{Name: "Test", Address: "test@example.com"},
+		To:      []mail.Address{{Name: "John Doe", Address: "john@example.com"}},
+		Cc:      []mail.Address{{Address: "jane@example.com"}},
+		Subject: "Your invoice for the month of September",
+		HTML:    strings.Repeat("<p>Lorem ipsum dolor sit amet, consectetur adipiscing elit.</p>\n", 50),
+		Text:    strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\n", 50),
+		Headers: map[string]string{"X-Campaign": "september"},
+	}
+}
+
+func BenchmarkRendererRender(b *testing.B) {
+	scenarios := []struct {
+		name        string
+		attachments map[string]io.Reader
+	}{
+		{"bodies", nil},
+		{"attachment", map[string]io.Reader{"invoice.pdf": bytes.NewReader(bytes.Repeat([]byte("%PDF-1.4 "), 10<<10))}},
+	}
+
+	for _, s := range scenarios {
+		b.Run(s.name, func(b *testing.B) {
+			m := benchmarkMessage()
+			m.Attachments = s.attachments
+
+			var r Renderer
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := r.Render(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
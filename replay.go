@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// ReplayFromEML parses the archived .eml file at path (see [Archive])
+// and sends it again through the provided mailer.
+//
+// If preserveMessageID is false, the original Message-ID and Date are
+// dropped so that new ones are generated; otherwise the message is resent
+// as it is, letting the recipients mail clients deduplicate it.
+//
+// Note that the Bcc recipients are not part of the rendered messages,
+// so they are not replayed.
+func ReplayFromEML(mailer Mailer, path string, preserveMessageID bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := ParseMessage(f)
+	if err != nil {
+		return err
+	}
+
+	if !preserveMessageID {
+		for k := range m.Headers {
+			if strings.EqualFold(k, "Message-ID") {
+				delete(m.Headers, k)
+			}
+		}
+		m.Date = time.Time{}
+	}
+
+	return mailer.Send(m)
+}
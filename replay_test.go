@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplayFromEML(t *testing.T) {
+	raw, err := (&Message{
+		From:    mail.Address{Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Subject: "test",
+		Text:    "text",
+		Headers: map[string]string{"Message-ID": "<original@example.com>"},
+	}).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "message.eml")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, preserve := range []bool{true, false} {
+		var replayed *Message
+		mailer := MailerFunc(func(m *Message) error {
+			replayed = m
+			return nil
+		})
+
+		if err := ReplayFromEML(mailer, path, preserve); err != nil {
+			t.Fatal(err)
+		}
+
+		if replayed.Subject != "test" || replayed.To[0].Address != "to@example.com" {
+			t.Fatalf("Unexpected replayed message %+v", replayed)
+		}
+
+		if id := messageIDHeader(replayed); (id == "<original@example.com>") != preserve {
+			t.Fatalf("Expected preserved Message-ID %v, got %q", preserve, id)
+		}
+	}
+}
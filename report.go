@@ -0,0 +1,331 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrNotReport is returned when parsing a message that is not the expected report.
+var ErrNotReport = errors.New("the message is not a report")
+
+// DeliveryReport is a parsed delivery status notification (RFC 3464),
+// ie. a standard bounce or delay report.
+type DeliveryReport struct {
+	OriginalMessageID string    `json:"original_message_id,omitempty"` // the Message-ID of the bounced message, if returned
+	ReportingMTA      string    `json:"reporting_mta,omitempty"`
+	ArrivalDate       time.Time `json:"arrival_date,omitempty"`
+
+	Recipients []DeliveryReportRecipient `json:"recipients"`
+}
+
+// DeliveryReportRecipient is the delivery status of a single recipient of a [DeliveryReport].
+type DeliveryReportRecipient struct {
+	Recipient         string    `json:"recipient"`                    // the Final-Recipient address
+	OriginalRecipient string    `json:"original_recipient,omitempty"` // the Original-Recipient address, if any
+	Action            string    `json:"action"`                       // either "failed", "delayed", "delivered", "relayed" or "expanded"
+	Status            string    `json:"status"`                       // the enhanced status code, eg. "5.1.1"
+	RemoteMTA         string    `json:"remote_mta,omitempty"`
+	Diagnostic        string    `json:"diagnostic,omitempty"` // the remote MTA response, eg. "550 5.1.1 User unknown"
+	LastAttempt       time.Time `json:"last_attempt,omitempty"`
+}
+
+// Permanent reports whether the delivery permanently failed, ie. a hard bounce.
+func (r DeliveryReportRecipient) Permanent() bool {
+	return strings.EqualFold(r.Action, "failed") && strings.HasPrefix(r.Status, "5")
+}
+
+// ParseDeliveryReport parses a delivery status notification (RFC 3464),
+// ie. a "multipart/report; report-type=delivery-status" message (possibly
+// nested in another multipart), failing with [ErrNotReport] for the other
+// messages (eg. the non-standard bounces or the auto-replies).
+func ParseDeliveryReport(r io.Reader) (*DeliveryReport, error) {
+	parts, err := readReport(r, "message/delivery-status", "message/global-delivery-status")
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := readHeaderBlocks(parts.report)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) < 2 {
+		return nil, errors.New("the delivery status has no recipient fields")
+	}
+
+	report := &DeliveryReport{
+		OriginalMessageID: parts.originalMessageID(),
+		ReportingMTA:      reportFieldValue(blocks[0].Get("Reporting-MTA")),
+		ArrivalDate:       reportFieldDate(blocks[0].Get("Arrival-Date")),
+	}
+
+	for _, block := range blocks[1:] {
+		recipient := DeliveryReportRecipient{
+			Recipient:         reportAddress(block.Get("Final-Recipient")),
+			OriginalRecipient: reportAddress(block.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(block.Get("Action"))),
+			Status:            strings.TrimSpace(strings.SplitN(block.Get("Status"), " ", 2)[0]),
+			RemoteMTA:         reportFieldValue(block.Get("Remote-MTA")),
+			Diagnostic:        reportFieldValue(block.Get("Diagnostic-Code")),
+			LastAttempt:       reportFieldDate(block.Get("Last-Attempt-Date")),
+		}
+		if recipient.Recipient == "" {
+			continue
+		}
+
+		report.Recipients = append(report.Recipients, recipient)
+	}
+
+	if len(report.Recipients) == 0 {
+		return nil, errors.New("the delivery status has no recipient fields")
+	}
+
+	return report, nil
+}
+
+// reportParts are the relevant parts of a multipart/report message.
+type reportParts struct {
+	report   []byte               // the decoded machine-readable part, eg. the message/delivery-status one
+	original textproto.MIMEHeader // the header of the original message, if included
+}
+
+// readReport reads the multipart/report message (possibly nested
+// in another multipart), with the first machine-readable part of
+// one of the specified content types.
+func readReport(r io.Reader, contentTypes ...string) (*reportParts, error) {
+	parts, err := readReportParts(r, false, contentTypes)
+	if err != nil {
+		return nil, err
+	}
+	if parts.report == nil {
+		return nil, ErrNotReport
+	}
+
+	return parts, nil
+}
+
+// readReportParts reads the report parts of the message, the multipart/report
+// ones only unless anyMultipart (eg. for the non-standard reports).
+func readReportParts(r io.Reader, anyMultipart bool, contentTypes []string) (*reportParts, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := &reportParts{}
+	if err := parts.walk(textproto.MIMEHeader(msg.Header), msg.Body, contentTypes, anyMultipart); err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+func (p *reportParts) walk(header textproto.MIMEHeader, body io.Reader, contentTypes []string, inReport bool) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		inReport = inReport || mediaType == "multipart/report"
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := p.walk(part.Header, part, contentTypes, inReport); err != nil {
+				return err
+			}
+		}
+	case !inReport:
+	case p.report == nil && slices.Contains(contentTypes, mediaType):
+		data, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+		if err != nil {
+			return err
+		}
+		p.report = data
+	case p.original == nil && slices.Contains(originalMessageTypes, mediaType):
+		// a malformed original message doesn't fail the report
+		r := textproto.NewReader(bufio.NewReader(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)))
+		if original, _ := r.ReadMIMEHeader(); len(original) > 0 {
+			p.original = original
+		}
+	}
+
+	return nil
+}
+
+// originalMessageTypes are the content types of the report part returning the original message.
+var originalMessageTypes = []string{"message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers"}
+
+// originalRecipients returns the To addresses of the original message, if included.
+func (p *reportParts) originalRecipients() []string {
+	if p.original == nil {
+		return nil
+	}
+
+	addresses, err := mail.ParseAddressList(p.original.Get("To"))
+	if err != nil {
+		return nil
+	}
+
+	recipients := make([]string, len(addresses))
+	for i, addr := range addresses {
+		recipients[i] = addr.Address
+	}
+
+	return recipients
+}
+
+// originalMessageID returns the Message-ID of the original message, if included.
+func (p *reportParts) originalMessageID() string {
+	if p.original == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(p.original.Get("Message-ID"))
+}
+
+// FeedbackReport is a parsed abuse feedback report (ARF, RFC 5965),
+// eg. a spam complaint sent by a mailbox provider feedback loop.
+type FeedbackReport struct {
+	FeedbackType string `json:"feedback_type"` // eg. "abuse", "fraud" or "not-spam"
+	UserAgent    string `json:"user_agent,omitempty"`
+
+	OriginalMessageID  string   `json:"original_message_id,omitempty"` // the Message-ID of the reported message, if returned
+	OriginalMailFrom   string   `json:"original_mail_from,omitempty"`
+	OriginalRecipients []string `json:"original_recipients,omitempty"` // the complaining recipients, if not redacted
+
+	ReportingMTA          string    `json:"reporting_mta,omitempty"`
+	ArrivalDate           time.Time `json:"arrival_date,omitempty"`
+	SourceIP              string    `json:"source_ip,omitempty"`
+	AuthenticationResults string    `json:"authentication_results,omitempty"`
+	ReportedDomains       []string  `json:"reported_domains,omitempty"`
+}
+
+// ParseFeedbackReport parses an abuse feedback report (ARF, RFC 5965),
+// ie. a "multipart/report; report-type=feedback-report" message,
+// failing with [ErrNotReport] for the other messages.
+//
+// When the report has no Original-Rcpt-To field, the recipients
+// default to the To header of the returned original message.
+func ParseFeedbackReport(r io.Reader) (*FeedbackReport, error) {
+	parts, err := readReport(r, "message/feedback-report")
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := parseFeedbackReport(parts)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.OriginalRecipients) == 0 {
+		report.OriginalRecipients = parts.originalRecipients()
+	}
+
+	return report, nil
+}
+
+// parseFeedbackReport parses the feedback report part, with
+// the recipients of the Original-Rcpt-To fields only.
+func parseFeedbackReport(parts *reportParts) (*FeedbackReport, error) {
+	blocks, err := readHeaderBlocks(parts.report)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 || blocks[0].Get("Feedback-Type") == "" {
+		return nil, errors.New("the feedback report has no Feedback-Type field")
+	}
+	fields := blocks[0]
+
+	report := &FeedbackReport{
+		FeedbackType:          strings.ToLower(strings.TrimSpace(fields.Get("Feedback-Type"))),
+		UserAgent:             strings.TrimSpace(fields.Get("User-Agent")),
+		OriginalMessageID:     parts.originalMessageID(),
+		OriginalMailFrom:      reportAddress(fields.Get("Original-Mail-From")),
+		ReportingMTA:          reportFieldValue(fields.Get("Reporting-MTA")),
+		ArrivalDate:           reportFieldDate(fields.Get("Arrival-Date")),
+		SourceIP:              strings.TrimSpace(fields.Get("Source-IP")),
+		AuthenticationResults: strings.Join(strings.Fields(fields.Get("Authentication-Results")), " "),
+	}
+	if report.ArrivalDate.IsZero() {
+		report.ArrivalDate = reportFieldDate(fields.Get("Received-Date"))
+	}
+
+	for _, value := range fields.Values("Original-Rcpt-To") {
+		if address := reportAddress(value); address != "" {
+			report.OriginalRecipients = append(report.OriginalRecipients, address)
+		}
+	}
+
+	for _, value := range fields.Values("Reported-Domain") {
+		if domain := strings.TrimSpace(value); domain != "" {
+			report.ReportedDomains = append(report.ReportedDomains, domain)
+		}
+	}
+
+	return report, nil
+}
+
+// readHeaderBlocks reads the blank line separated header blocks (eg. of a delivery status).
+func readHeaderBlocks(data []byte) ([]textproto.MIMEHeader, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(bytes.TrimLeft(data, "\r\n"))))
+
+	var blocks []textproto.MIMEHeader
+	for {
+		header, err := r.ReadMIMEHeader()
+		if len(header) > 0 {
+			blocks = append(blocks, header)
+		}
+		if errors.Is(err, io.EOF) {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// skip the extra blank lines between the blocks
+		for {
+			b, err := r.R.Peek(1)
+			if err != nil || (b[0] != '\r' && b[0] != '\n') {
+				break
+			}
+			_, _ = r.R.ReadByte()
+		}
+	}
+}
+
+// reportFieldValue returns the field value without its type,
+// eg. "mx.example.com" for "dns; mx.example.com".
+func reportFieldValue(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		value = v
+	}
+
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func reportAddress(value string) string {
+	return strings.Trim(reportFieldValue(value), "<>")
+}
+
+func reportFieldDate(value string) time.Time {
+	date, _ := mail.ParseDate(strings.TrimSpace(value))
+
+	return date
+}
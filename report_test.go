@@ -0,0 +1,174 @@
+package mailer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sampleDeliveryReport is a hard bounce of user@example.com and a delay of other@example.com.
+const sampleDeliveryReport = "From: MAILER-DAEMON@mx.example.net\r\n" +
+	"To: bounces@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.net\r\n" +
+	"Arrival-Date: Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; <User@example.com>\r\n" +
+	"Original-Recipient: rfc822;user@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1 (bad destination mailbox address)\r\n" +
+	"Remote-MTA: dns; mx.example.com\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <user@example.com>:\r\n" +
+	"    Recipient address rejected: User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; other@example.com\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"Subject: Hello\r\n" +
+	"--b1--\r\n"
+
+func TestParseDeliveryReport(t *testing.T) {
+	report, err := ParseDeliveryReport(strings.NewReader(sampleDeliveryReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.OriginalMessageID != "<1@example.com>" || report.ReportingMTA != "mx.example.net" || report.ArrivalDate.Year() != 2006 {
+		t.Fatalf("Unexpected report fields %+v", report)
+	}
+
+	if len(report.Recipients) != 2 {
+		t.Fatalf("Expected 2 recipients, got %+v", report.Recipients)
+	}
+
+	failed := report.Recipients[0]
+	expected := DeliveryReportRecipient{
+		Recipient:         "User@example.com",
+		OriginalRecipient: "user@example.com",
+		Action:            "failed",
+		Status:            "5.1.1",
+		RemoteMTA:         "mx.example.com",
+		Diagnostic:        "550 5.1.1 <user@example.com>: Recipient address rejected: User unknown",
+	}
+	if failed != expected {
+		t.Fatalf("Expected\n%+v\ngot\n%+v", expected, failed)
+	}
+	if !failed.Permanent() {
+		t.Fatal("Expected a permanent failure")
+	}
+
+	if delayed := report.Recipients[1]; delayed.Recipient != "other@example.com" || delayed.Permanent() {
+		t.Fatalf("Expected a delay of other@example.com, got %+v", delayed)
+	}
+}
+
+// sampleFeedbackReport is a spam complaint of user@example.com.
+const sampleFeedbackReport = "From: fbl@isp.example.net\r\n" +
+	"To: abuse@example.com\r\n" +
+	"Subject: FW: Hello\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=feedback-report; boundary=\"b2\"\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"This is an email abuse report.\r\n" +
+	"--b2\r\n" +
+	"Content-Type: message/feedback-report\r\n" +
+	"\r\n" +
+	"Feedback-Type: abuse\r\n" +
+	"User-Agent: SomeGenerator/1.0\r\n" +
+	"Version: 1\r\n" +
+	"Original-Mail-From: <bounces@example.com>\r\n" +
+	"Original-Rcpt-To: <user@example.com>\r\n" +
+	"Arrival-Date: Thu, 8 Mar 2005 14:00:00 EDT\r\n" +
+	"Reporting-MTA: dns; mail.isp.example.net\r\n" +
+	"Source-IP: 192.0.2.1\r\n" +
+	"Authentication-Results: mail.isp.example.net;\r\n" +
+	"    spf=pass smtp.mail=bounces@example.com\r\n" +
+	"Reported-Domain: example.com\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"Content-Disposition: inline\r\n" +
+	"\r\n" +
+	"From: app@example.com\r\n" +
+	"To: user@example.com\r\n" +
+	"Message-ID: <2@example.com>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--b2--\r\n"
+
+func TestParseFeedbackReport(t *testing.T) {
+	report, err := ParseFeedbackReport(strings.NewReader(sampleFeedbackReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.FeedbackType != "abuse" || report.OriginalMessageID != "<2@example.com>" || report.OriginalMailFrom != "bounces@example.com" {
+		t.Fatalf("Unexpected report fields %+v", report)
+	}
+	if len(report.OriginalRecipients) != 1 || report.OriginalRecipients[0] != "user@example.com" {
+		t.Fatalf("Expected the user@example.com complaint, got %v", report.OriginalRecipients)
+	}
+	if report.SourceIP != "192.0.2.1" || report.ReportingMTA != "mail.isp.example.net" || report.ArrivalDate.Year() != 2005 {
+		t.Fatalf("Unexpected report fields %+v", report)
+	}
+	if report.AuthenticationResults != "mail.isp.example.net; spf=pass smtp.mail=bounces@example.com" {
+		t.Fatalf("Unexpected authentication results %q", report.AuthenticationResults)
+	}
+	if len(report.ReportedDomains) != 1 || report.ReportedDomains[0] != "example.com" {
+		t.Fatalf("Unexpected reported domains %v", report.ReportedDomains)
+	}
+
+	// the recipients default to the original message ones when redacted
+	redacted := strings.Replace(sampleFeedbackReport, "Original-Rcpt-To: <user@example.com>\r\n", "", 1)
+	if report, err := ParseFeedbackReport(strings.NewReader(redacted)); err != nil || len(report.OriginalRecipients) != 1 {
+		t.Fatalf("Expected the original message recipient, got %+v, %v", report, err)
+	}
+
+	// a delivery report is not a feedback report
+	if _, err := ParseFeedbackReport(strings.NewReader(sampleDeliveryReport)); !errors.Is(err, ErrNotReport) {
+		t.Fatalf("Expected ErrNotReport, got %v", err)
+	}
+}
+
+func TestParseDeliveryReportErrors(t *testing.T) {
+	scenarios := []struct {
+		name      string
+		raw       string
+		notReport bool
+	}{
+		{"plain message", "Subject: Out of office\r\nContent-Type: text/plain\r\n\r\nI'm away\r\n", true},
+		{"status outside of a report", "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: message/delivery-status\r\n\r\nReporting-MTA: dns; mx\r\n\r\nFinal-Recipient: rfc822; a@example.com\r\n--b--\r\n", true},
+		{"missing recipients", "Content-Type: multipart/report; boundary=b\r\n\r\n--b\r\nContent-Type: message/delivery-status\r\n\r\nReporting-MTA: dns; mx\r\n--b--\r\n", false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			_, err := ParseDeliveryReport(strings.NewReader(s.raw))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if errors.Is(err, ErrNotReport) != s.notReport {
+				t.Fatalf("Expected not report %v, got %v", s.notReport, err)
+			}
+		})
+	}
+}
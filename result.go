@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// enhancedCodeRegex matches the RFC 3463 enhanced status code prefix of the responses, eg. "2.0.0".
+	enhancedCodeRegex = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(?:\s+|$)`)
+
+	// queueIDRegexes match the queue ids the common relays return, in order.
+	queueIDRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\bqueued as ([^\s;,]+)`),             // Postfix, SendGrid, Sendmail
+		regexp.MustCompile(`(?i)\bInternalId=([^\s;,\]]+)`),          // Exchange
+		regexp.MustCompile(`(?i)\bid=([^\s;,]+)`),                    // Exim, Haraka
+		regexp.MustCompile(`(?i)^ok\s+([0-9a-f][0-9a-f-]{15,})\s*$`), // Amazon SES
+	}
+)
+
+// SendResult is the final response of the relay to a successful send
+// (eg. "250 2.0.0 Ok: queued as 4BX3Yq1FzGz9sWQ"), holding the queue id
+// many relays return for the correlation with their logs.
+type SendResult struct {
+	Code         int    `json:"code"`                    // the reply code, eg. 250
+	EnhancedCode string `json:"enhanced_code,omitempty"` // the RFC 3463 status code, eg. "2.0.0"
+	Response     string `json:"response"`                // the reply text without the codes, eg. "Ok: queued as 4BX3Yq1FzGz9sWQ"
+	QueueID      string `json:"queue_id,omitempty"`      // the relay queue id, eg. "4BX3Yq1FzGz9sWQ"
+}
+
+// String returns the response as received, eg. "250 2.0.0 Ok: queued as 4BX3Yq1FzGz9sWQ".
+func (r SendResult) String() string {
+	s := r.Response
+	if r.EnhancedCode != "" {
+		s = strings.TrimSpace(r.EnhancedCode + " " + s)
+	}
+
+	if r.Code == 0 {
+		return s
+	}
+
+	return strings.TrimSpace(strconv.Itoa(r.Code) + " " + s)
+}
+
+// parseSendResult parses the reply code and text of the relay response.
+func parseSendResult(code int, msg string) SendResult {
+	// only the last line of the multiline responses is relevant
+	lines := strings.Split(strings.TrimSpace(msg), "\n")
+	msg = strings.TrimSpace(lines[len(lines)-1])
+
+	result := SendResult{Code: code, Response: msg}
+
+	if m := enhancedCodeRegex.FindStringSubmatch(msg); m != nil {
+		result.EnhancedCode = m[1]
+		result.Response = strings.TrimSpace(msg[len(m[0]):])
+	}
+
+	for _, re := range queueIDRegexes {
+		if m := re.FindStringSubmatch(result.Response); m != nil {
+			result.QueueID = strings.Trim(m[1], "<>.")
+			break
+		}
+	}
+
+	return result
+}
+
+// resultSink collects the result of a send, shared by the message clones.
+type resultSink struct {
+	mu     sync.Mutex
+	result SendResult
+	ok     bool
+}
+
+// setResult records the send result of the message, if requested
+// with [SendWithResult] (the last recorded one wins).
+func (m *Message) setResult(result SendResult) {
+	if m.result == nil {
+		return
+	}
+
+	m.result.mu.Lock()
+	m.result.result, m.result.ok = result, true
+	m.result.mu.Unlock()
+}
+
+// SendWithResult sends the message with the mailer, returning the final
+// response of the relay (see [SendResult]) if the backend reports it (eg.
+// [SmtpClient]) and the sent message reached it through the middlewares.
+// The boolean result reports whether the response is known.
+func SendWithResult(mailer Mailer, m *Message) (SendResult, bool, error) {
+	m = m.Clone()
+	m.result = &resultSink{}
+
+	err := mailer.Send(m)
+
+	m.result.mu.Lock()
+	defer m.result.mu.Unlock()
+
+	return m.result.result, m.result.ok, err
+}
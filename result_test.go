@@ -0,0 +1,25 @@
+package mailer
+
+import "testing"
+
+func TestParseSendResult(t *testing.T) {
+	scenarios := []struct {
+		msg      string
+		enhanced string
+		queueID  string
+	}{
+		{"2.0.0 Ok: queued as 4BX3Yq1FzGz9sWQ", "2.0.0", "4BX3Yq1FzGz9sWQ"},
+		{"OK id=1rX2aB-0004Kq-3Z", "", "1rX2aB-0004Kq-3Z"},
+		{"2.6.0 <CAF1@mail.example.com> [InternalId=12345678901234, Hostname=EX01] Queued mail for delivery", "2.6.0", "12345678901234"},
+		{"Ok 0100018c1f5e2b7a-3d2c1b0a-9f8e-4d7c-b6a5-0123456789ab-000000", "", "0100018c1f5e2b7a-3d2c1b0a-9f8e-4d7c-b6a5-0123456789ab-000000"},
+		{"Accepted\n2.0.0 OK 1700000000 abc.123 - gsmtp", "2.0.0", ""},
+		{"Message accepted for delivery", "", ""},
+	}
+
+	for _, s := range scenarios {
+		result := parseSendResult(250, s.msg)
+		if result.EnhancedCode != s.enhanced || result.QueueID != s.queueID {
+			t.Errorf("Expected %q to have the %q code and %q queue id, got %+v", s.msg, s.enhanced, s.queueID, result)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// diagnoseTimeout limits the DNS lookups of the Diagnose call.
+const diagnoseTimeout = 30 * time.Second
+
+// rpc exposes the plugin management methods to the RoadRunner RPC plugin.
+type rpc struct {
+	p *Plugin
+}
+
+// DeadLetterInfo is the RPC representation of a [DeadLetter].
+type DeadLetterInfo struct {
+	ID            string                `json:"id"`
+	CorrelationID string                `json:"correlation_id,omitempty"`
+	From          string                `json:"from"`
+	Recipients    []string              `json:"recipients"`
+	Subject       string                `json:"subject"`
+	LastError     string                `json:"last_error"`
+	FailedAt      time.Time             `json:"failed_at"`
+	Attempts      []DeliveryAttemptInfo `json:"attempts"`
+}
+
+// DeliveryAttemptInfo is the RPC representation of a [DeliveryAttempt].
+type DeliveryAttemptInfo struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+func newDeadLetterInfo(dl *DeadLetter) DeadLetterInfo {
+	info := DeadLetterInfo{
+		ID:            dl.ID,
+		CorrelationID: dl.CorrelationID,
+		From:          dl.Message.From.Address,
+		Recipients:    envelopeRecipients(dl.Message),
+		Subject:       dl.Message.Subject,
+		FailedAt:      dl.FailedAt,
+		Attempts:      make([]DeliveryAttemptInfo, len(dl.Attempts)),
+	}
+	if dl.Err != nil {
+		info.LastError = dl.Err.Error()
+	}
+	for i, attempt := range dl.Attempts {
+		info.Attempts[i] = DeliveryAttemptInfo{At: attempt.At}
+		if attempt.Err != nil {
+			info.Attempts[i].Error = attempt.Err.Error()
+		}
+	}
+
+	return info
+}
+
+// RPC returns the plugin RPC service.
+func (p *Plugin) RPC() any {
+	return &rpc{p: p}
+}
+
+func (r *rpc) queue() (*Queue, error) {
+	if r.p.queue == nil {
+		return nil, errors.New("mailer queue is not configured")
+	}
+
+	return r.p.queue, nil
+}
+
+// DeadLetters lists all dead letters.
+func (r *rpc) DeadLetters(_ bool, out *[]DeadLetterInfo) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	deadLetters := queue.DeadLetters()
+
+	*out = make([]DeadLetterInfo, len(deadLetters))
+	for i, dl := range deadLetters {
+		(*out)[i] = newDeadLetterInfo(dl)
+	}
+
+	return nil
+}
+
+// DeadLetter returns a single dead letter.
+func (r *rpc) DeadLetter(id string, out *DeadLetterInfo) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	dl, err := queue.DeadLetter(id)
+	if err != nil {
+		return err
+	}
+	*out = newDeadLetterInfo(dl)
+
+	return nil
+}
+
+// RetryDeadLetter moves a single dead letter back into the queue.
+func (r *rpc) RetryDeadLetter(id string, out *bool) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	if err := queue.RetryDeadLetter(id); err != nil {
+		return err
+	}
+	*out = true
+
+	return nil
+}
+
+// RequeueFailed moves all dead letters back into the queue.
+func (r *rpc) RequeueFailed(_ bool, out *int) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	*out, err = queue.RequeueFailed()
+
+	return err
+}
+
+// PurgeDeadLetters removes the specified (or all) dead letters.
+func (r *rpc) PurgeDeadLetters(ids []string, out *int) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	*out = queue.PurgeDeadLetters(ids...)
+
+	return nil
+}
+
+// Pause holds the queued messages with any of the tags (eg. "lane:bulk"),
+// or all of them if none is specified, and returns the paused tags.
+func (r *rpc) Pause(tags []string, out *[]string) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	queue.Pause(tags...)
+	*out = queue.Paused()
+
+	return nil
+}
+
+// Resume resumes the paused tags (or all of them) and returns the number of the requeued messages.
+func (r *rpc) Resume(tags []string, out *int) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	*out = queue.Resume(tags...)
+
+	return nil
+}
+
+// Paused returns the paused tags, where "*" means all messages.
+func (r *rpc) Paused(_ bool, out *[]string) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	*out = queue.Paused()
+
+	return nil
+}
+
+// Drain removes the waiting messages with any of the tags (or all of them)
+// from the queue and returns them.
+func (r *rpc) Drain(tags []string, out *[]DeadLetterInfo) error {
+	queue, err := r.queue()
+	if err != nil {
+		return err
+	}
+
+	drained := queue.Drain(tags...)
+
+	*out = make([]DeadLetterInfo, len(drained))
+	for i, dl := range drained {
+		(*out)[i] = newDeadLetterInfo(dl)
+	}
+
+	return nil
+}
+
+// QueuedMessage is the RPC request of a message enqueued with queue options (see [Plugin.Enqueue]).
+type QueuedMessage struct {
+	JSONMessage
+
+	CorrelationID string    `json:"correlation_id,omitempty"` // see [WithCorrelationID]
+	Expires       time.Time `json:"expires,omitempty"`        // see [WithExpiration]
+	SendAt        time.Time `json:"send_at,omitempty"`        // see [WithSendAt]
+	Timezone      string    `json:"timezone,omitempty"`       // see [WithTimezone]
+	Urgent        bool      `json:"urgent,omitempty"`         // see [WithUrgent]
+}
+
+// Enqueue sends the message through the queue with the options.
+func (r *rpc) Enqueue(req QueuedMessage, out *bool) error {
+	m, err := req.Message(r.p.templates)
+	if err != nil {
+		return err
+	}
+
+	var opts []QueueOption
+	if req.CorrelationID != "" {
+		opts = append(opts, WithCorrelationID(req.CorrelationID))
+	}
+	if !req.Expires.IsZero() {
+		opts = append(opts, WithExpiration(req.Expires))
+	}
+	if !req.SendAt.IsZero() {
+		opts = append(opts, WithSendAt(req.SendAt))
+	}
+	if req.Timezone != "" {
+		opts = append(opts, WithTimezone(req.Timezone))
+	}
+	if req.Urgent {
+		opts = append(opts, WithUrgent())
+	}
+
+	if err := r.p.Enqueue(m, opts...); err != nil {
+		return err
+	}
+	*out = true
+
+	return nil
+}
+
+// TemplateTest is the RPC request of a template preview or test send.
+type TemplateTest struct {
+	Template string         `json:"template"`
+	Locale   string         `json:"locale,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+	From     string         `json:"from,omitempty"` // required by SendTest
+	To       []string       `json:"to,omitempty"`   // required by SendTest
+}
+
+// RenderPreview renders the template without sending it.
+func (r *rpc) RenderPreview(req TemplateTest, out *RenderedTemplate) error {
+	rendered, err := r.p.RenderPreview(req.Template, req.Locale, req.Data)
+	if err != nil {
+		return err
+	}
+	*out = *rendered
+
+	return nil
+}
+
+// SendTest sends the template as a test message, bypassing the suppression list.
+func (r *rpc) SendTest(req TemplateTest, out *bool) error {
+	if err := r.p.SendTest(req.Template, req.Locale, req.Data, req.From, req.To...); err != nil {
+		return err
+	}
+	*out = true
+
+	return nil
+}
+
+// TemplateLint is the RPC request of a template lint.
+type TemplateLint struct {
+	Template string `json:"template"`
+	TemplateLintOptions
+}
+
+// LintTemplate checks the template, returning the found issues.
+func (r *rpc) LintTemplate(req TemplateLint, out *[]TemplateLintIssue) error {
+	issues, err := r.p.LintTemplate(req.Template, req.TemplateLintOptions)
+	if err != nil {
+		return err
+	}
+	*out = issues
+
+	return nil
+}
+
+// Digest buffers the event in the recipient digest.
+func (r *rpc) Digest(event DigestEvent, out *bool) error {
+	if err := r.p.AddDigestEvent(event); err != nil {
+		return err
+	}
+	*out = true
+
+	return nil
+}
+
+// Capabilities returns the features supported by the configured backend.
+func (r *rpc) Capabilities(_ bool, out *Capabilities) error {
+	*out = r.p.Capabilities()
+
+	return nil
+}
+
+// Status reports the backend health, the queue depth and the last sends outcome.
+// The backend errors are reported in the status rather than failing the call.
+func (r *rpc) Status(_ bool, out *Status) error {
+	status, _ := r.p.Status()
+	*out = *status
+
+	return nil
+}
+
+// SwitchBackend switches the active backend (or keeps it, if To is empty)
+// and sets the dry-run mode at runtime, logging the change with its actor and reason.
+func (r *rpc) SwitchBackend(req BackendSwitch, out *bool) error {
+	if err := r.p.SwitchBackend(strings.TrimSpace(req.To), req.DryRun, req.Actor, req.Reason); err != nil {
+		return err
+	}
+
+	*out = true
+
+	return nil
+}
+
+// Diagnose checks the published SPF, DKIM and DMARC records of the sending domain.
+func (r *rpc) Diagnose(domain string, out *Diagnosis) error {
+	if strings.TrimSpace(domain) == "" {
+		return errors.New("domain is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+
+	*out = r.p.Diagnose(ctx, domain)
+
+	return nil
+}
+
+// SendLog lists the recorded send attempts matching the query, the most recent first.
+func (r *rpc) SendLog(query SendLogQuery, out *[]SendLogEntry) error {
+	if r.p.sendLog == nil {
+		return errors.New("mailer send log is not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.p.sendLog.config.Timeout)
+	defer cancel()
+
+	entries, err := r.p.sendLog.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	*out = entries
+
+	return nil
+}
+
+// Preferences returns the notification preferences of the address (empty if it has none).
+func (r *rpc) Preferences(address string, out *RecipientPreferences) error {
+	if r.p.preferences == nil {
+		return errors.New("mailer preferences are not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.p.preferences.config.Timeout)
+	defer cancel()
+
+	prefs, err := r.p.preferences.Get(ctx, address)
+	if err != nil {
+		return err
+	}
+	if prefs == nil {
+		prefs = &RecipientPreferences{Address: address}
+	}
+	*out = *prefs
+
+	return nil
+}
+
+// SetPreferences stores the notification preferences of the recipient.
+func (r *rpc) SetPreferences(prefs RecipientPreferences, out *bool) error {
+	if r.p.preferences == nil {
+		return errors.New("mailer preferences are not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.p.preferences.config.Timeout)
+	defer cancel()
+
+	if err := r.p.preferences.Set(ctx, prefs); err != nil {
+		return err
+	}
+	*out = true
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envPlaceholderRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces the ${NAME} and ${NAME:-default} placeholders
+// in s with the related environment variable values.
+//
+// Unlike os.ExpandEnv, a bare $NAME is left as it is so that
+// secrets containing a dollar sign are not accidentally mangled.
+func expandEnv(s string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+
+	return envPlaceholderRegex.ReplaceAllStringFunc(s, func(match string) string {
+		parts := envPlaceholderRegex.FindStringSubmatch(match)
+		if v, ok := os.LookupEnv(parts[1]); ok && v != "" {
+			return v
+		}
+		return parts[2]
+	})
+}
+
+// readSecretFile reads a single secret value from the specified file
+// (eg. a Docker or Kubernetes mounted secret), trimming the trailing new line.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(expandEnv(path))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
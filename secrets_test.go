@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("MAILER_TEST_HOST", "smtp.example.com")
+
+	scenarios := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"${MAILER_TEST_HOST}", "smtp.example.com"},
+		{"mx.${MAILER_TEST_HOST}:25", "mx.smtp.example.com:25"},
+		{"${MAILER_TEST_MISSING}", ""},
+		{"${MAILER_TEST_MISSING:-fallback}", "fallback"},
+		{"pa$$word$MAILER_TEST_HOST", "pa$$word$MAILER_TEST_HOST"},
+	}
+
+	for _, s := range scenarios {
+		if v := expandEnv(s.value); v != s.expected {
+			t.Fatalf("[%s] Expected %q, got %q", s.value, s.expected, v)
+		}
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := readSecretFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if v != "s3cr3t" {
+		t.Fatalf("Expected s3cr3t, got %q", v)
+	}
+
+	if _, err := readSecretFile(path + "_missing"); err == nil {
+		t.Fatal("Expected error for missing secret file")
+	}
+}
@@ -0,0 +1,379 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSendLogTable   = "mailer_send_log"
+	defaultSendLogTimeout = 10 * time.Second
+	defaultSendLogLimit   = 100
+)
+
+// SendLogConfig defines the SQL send log settings.
+type SendLogConfig struct {
+	Driver  string     `mapstructure:"driver" json:"driver,omitempty" bson:"driver,omitempty"`    // the database/sql driver name registered by the app, eg. "pgx", "mysql" or "sqlite"
+	DSN     string     `mapstructure:"dsn" json:"dsn,omitempty" bson:"dsn,omitempty"`             // the driver data source name
+	Dialect SQLDialect `mapstructure:"dialect" json:"dialect,omitempty" bson:"dialect,omitempty"` // postgres (default), mysql or sqlite
+	Table   string     `mapstructure:"table" json:"table,omitempty" bson:"table,omitempty"`       // default to "mailer_send_log"
+	Migrate bool       `mapstructure:"migrate" json:"migrate,omitempty" bson:"migrate,omitempty"` // creates the table if it doesn't exist
+	Backend string     `mapstructure:"backend" json:"backend,omitempty" bson:"backend,omitempty"` // the backend name recorded with the entries, default to the configured one
+
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"` // per record timeout, default to 10s
+
+	// Clock is an optional time source (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when a send attempt could not be recorded.
+	OnError func(m *Message, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the send log configuration for common mistakes.
+func (c SendLogConfig) Validate() error {
+	errs := validateSQL("send_log", c.Dialect, c.Table)
+
+	if c.Driver == "" {
+		errs = append(errs, errors.New("send_log: driver is required"))
+	} else if !slices.Contains(sql.Drivers(), c.Driver) {
+		errs = append(errs, fmt.Errorf("send_log: unknown driver %q, it must be imported by the app", c.Driver))
+	}
+
+	if c.DSN == "" {
+		errs = append(errs, errors.New("send_log: dsn is required"))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("send_log: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c SendLogConfig) Redacted() SendLogConfig {
+	c.DSN = redact(c.DSN)
+	c.OnError = nil
+
+	return c
+}
+
+// Open opens the configured database, creating the table if Migrate is set.
+func (c SendLogConfig) Open(ctx context.Context) (*SQLSendLog, error) {
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	log := NewSQLSendLog(db, c)
+	log.owned = true
+
+	if c.Migrate {
+		if _, err := db.ExecContext(ctx, log.Schema()); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("send_log: failed to create the table: %w", err)
+		}
+	}
+
+	return log, nil
+}
+
+// SendLogEntry is a recorded send attempt.
+type SendLogEntry struct {
+	ID         string         `json:"id"`
+	MessageID  string         `json:"message_id"`
+	From       string         `json:"from"`
+	Recipients []string       `json:"recipients"`
+	Subject    string         `json:"subject"`
+	Tags       []string       `json:"tags,omitempty"`
+	Backend    string         `json:"backend,omitempty"`
+	Status     DeliveryStatus `json:"status"` // either DeliverySent, DeliveryFailed or DeliveryDiscarded (dry-run)
+	Error      string         `json:"error,omitempty"`
+	Duration   time.Duration  `json:"duration"`
+	At         time.Time      `json:"at"`
+}
+
+// SendLogQuery filters the send log entries, the zero value matching all of them.
+type SendLogQuery struct {
+	MessageID string         `json:"message_id,omitempty"`
+	Recipient string         `json:"recipient,omitempty"` // matched case-insensitively
+	Tag       string         `json:"tag,omitempty"`
+	Status    DeliveryStatus `json:"status,omitempty"`
+	Since     time.Time      `json:"since,omitempty"` // inclusive
+	Until     time.Time      `json:"until,omitempty"` // exclusive
+	Limit     int            `json:"limit,omitempty"` // default to 100
+	Offset    int            `json:"offset,omitempty"`
+}
+
+// SQLSendLog records the send attempts in an SQL table and
+// queries them (eg. to answer "did the user get the email?").
+//
+// The times are stored as unix milliseconds and the recipients and
+// tags as comma delimited lists, matched with LIKE.
+type SQLSendLog struct {
+	db     *sql.DB
+	config SendLogConfig
+	owned  bool // whether the db was opened by the send log
+}
+
+// NewSQLSendLog creates a new send log stored in db.
+func NewSQLSendLog(db *sql.DB, config SendLogConfig) *SQLSendLog {
+	if config.Table == "" {
+		config.Table = defaultSendLogTable
+	}
+	if config.Dialect == "" {
+		config.Dialect = SQLPostgres
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultSendLogTimeout
+	}
+
+	return &SQLSendLog{db: db, config: config}
+}
+
+// Schema returns the statement creating the send log table (if it doesn't exist).
+func (l *SQLSendLog) Schema() string {
+	text := l.config.Dialect.textType()
+
+	return "CREATE TABLE IF NOT EXISTS " + l.config.Table + " (" +
+		"id VARCHAR(32) NOT NULL PRIMARY KEY, " +
+		"message_id VARCHAR(255) NOT NULL, " +
+		"sender VARCHAR(320) NOT NULL, " +
+		"recipients " + text + " NOT NULL, " +
+		"subject " + text + " NOT NULL, " +
+		"tags " + text + " NOT NULL, " +
+		"backend VARCHAR(64) NOT NULL, " +
+		"status VARCHAR(16) NOT NULL, " +
+		"error " + text + ", " +
+		"duration_ms BIGINT NOT NULL, " +
+		"created_at BIGINT NOT NULL)"
+}
+
+// Record stores the send log entry, assigning its id if not set.
+func (l *SQLSendLog) Record(ctx context.Context, entry *SendLogEntry) error {
+	if entry.ID == "" {
+		entry.ID = PseudorandomString(20)
+	}
+
+	var sendErr any
+	if entry.Error != "" {
+		sendErr = entry.Error
+	}
+
+	_, err := l.db.ExecContext(ctx, l.config.Dialect.bind("INSERT INTO "+l.config.Table+
+		" (id, message_id, sender, recipients, subject, tags, backend, status, error, duration_ms, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		entry.ID, entry.MessageID, entry.From, sendLogList(entry.Recipients), entry.Subject, sendLogList(entry.Tags),
+		entry.Backend, string(entry.Status), sendErr, entry.Duration.Milliseconds(), entry.At.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("send_log: %w", err)
+	}
+
+	return nil
+}
+
+// Query returns the entries matching the query, the most recent first.
+func (l *SQLSendLog) Query(ctx context.Context, q SendLogQuery) ([]SendLogEntry, error) {
+	var conditions []string
+	var args []any
+
+	if q.MessageID != "" {
+		conditions = append(conditions, "message_id = ?")
+		args = append(args, q.MessageID)
+	}
+	if q.Recipient != "" {
+		conditions = append(conditions, "recipients LIKE ?")
+		args = append(args, "%"+sendLogList([]string{q.Recipient})+"%")
+	}
+	if q.Tag != "" {
+		conditions = append(conditions, "tags LIKE ?")
+		args = append(args, "%"+sendLogList([]string{q.Tag})+"%")
+	}
+	if q.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, string(q.Status))
+	}
+	if !q.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, q.Since.UnixMilli())
+	}
+	if !q.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, q.Until.UnixMilli())
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSendLogLimit
+	}
+
+	query := "SELECT id, message_id, sender, recipients, subject, tags, backend, status, error, duration_ms, created_at FROM " + l.config.Table
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT %d OFFSET %d", limit, max(q.Offset, 0))
+
+	rows, err := l.db.QueryContext(ctx, l.config.Dialect.bind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("send_log: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []SendLogEntry
+	for rows.Next() {
+		var entry SendLogEntry
+		var recipients, tags, status string
+		var sendErr sql.NullString
+		var duration, at int64
+
+		err := rows.Scan(&entry.ID, &entry.MessageID, &entry.From, &recipients, &entry.Subject, &tags,
+			&entry.Backend, &status, &sendErr, &duration, &at)
+		if err != nil {
+			return nil, fmt.Errorf("send_log: %w", err)
+		}
+
+		entry.Recipients = parseSendLogList(recipients)
+		entry.Tags = parseSendLogList(tags)
+		entry.Status = DeliveryStatus(status)
+		entry.Error = sendErr.String
+		entry.Duration = time.Duration(duration) * time.Millisecond
+		entry.At = time.UnixMilli(at)
+
+		// LIKE matches "_" with any character
+		if q.Recipient != "" && !slices.Contains(entry.Recipients, strings.ToLower(q.Recipient)) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("send_log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// ByRecipient returns the latest entries of the recipient address, the most recent first.
+func (l *SQLSendLog) ByRecipient(ctx context.Context, address string, limit int) ([]SendLogEntry, error) {
+	return l.Query(ctx, SendLogQuery{Recipient: address, Limit: limit})
+}
+
+// ByTag returns the latest entries of the messages with the tag, the most recent first.
+func (l *SQLSendLog) ByTag(ctx context.Context, tag string, limit int) ([]SendLogEntry, error) {
+	return l.Query(ctx, SendLogQuery{Tag: tag, Limit: limit})
+}
+
+// Between returns the entries recorded in the [since, until) range, the most recent first.
+func (l *SQLSendLog) Between(ctx context.Context, since, until time.Time, limit int) ([]SendLogEntry, error) {
+	return l.Query(ctx, SendLogQuery{Since: since, Until: until, Limit: limit})
+}
+
+// SentRecipients returns the recipients the message with the Message-ID was
+// successfully sent to (eg. by any of its retries), implementing [SentMessages].
+func (l *SQLSendLog) SentRecipients(ctx context.Context, messageID string) ([]string, error) {
+	entries, err := l.Query(ctx, SendLogQuery{MessageID: messageID, Status: DeliverySent})
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []string
+	for _, entry := range entries {
+		for _, recipient := range entry.Recipients {
+			if !slices.Contains(recipients, recipient) {
+				recipients = append(recipients, recipient)
+			}
+		}
+	}
+
+	return recipients, nil
+}
+
+// Purge deletes the entries recorded before the specified time, returning their number.
+func (l *SQLSendLog) Purge(ctx context.Context, before time.Time) (int64, error) {
+	result, err := l.db.ExecContext(ctx, l.config.Dialect.bind("DELETE FROM "+l.config.Table+" WHERE created_at < ?"), before.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("send_log: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// Close closes the database if it was opened with [SendLogConfig.Open].
+func (l *SQLSendLog) Close() error {
+	if !l.owned {
+		return nil
+	}
+
+	return l.db.Close()
+}
+
+// SendLog returns a middleware that records every send attempt
+// of the next mailer (eg. every queue retry) to the send log.
+//
+// Failing to record an attempt doesn't fail it, the error is reported
+// to the OnError hook instead. Messages without Message-ID header get
+// one assigned, so that the entries match the sent messages.
+func SendLog(log *SQLSendLog) Middleware {
+	cfg := log.config
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			m = m.Clone()
+			messageID := ensureMessageID(m)
+
+			start := now(cfg.Clock)
+			sendErr := next.Send(m)
+
+			entry := &SendLogEntry{
+				MessageID:  messageID,
+				From:       envelopeSender(m),
+				Recipients: envelopeRecipients(m),
+				Subject:    m.Subject,
+				Tags:       m.Tags,
+				Backend:    cfg.Backend,
+				Status:     DeliverySent,
+				Duration:   now(cfg.Clock).Sub(start),
+				At:         start,
+			}
+			if sendErr != nil {
+				entry.Status = DeliveryFailed
+				if errors.Is(sendErr, ErrDryRun) {
+					entry.Status = DeliveryDiscarded
+				}
+				entry.Error = sendErr.Error()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+			defer cancel()
+
+			if err := log.Record(ctx, entry); err != nil && cfg.OnError != nil {
+				cfg.OnError(m, err)
+			}
+
+			return sendErr
+		})
+	}
+}
+
+// sendLogList returns the comma delimited list of the lowercased values, eg. ",a,b,".
+func sendLogList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	return "," + strings.ToLower(strings.Join(values, ",")) + ","
+}
+
+func parseSendLogList(list string) []string {
+	list = strings.Trim(list, ",")
+	if list == "" {
+		return nil
+	}
+
+	return strings.Split(list, ",")
+}
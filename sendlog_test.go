@@ -0,0 +1,194 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendLog(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeSQLDB(t)
+
+	clock := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	log := NewSQLSendLog(db, SendLogConfig{
+		Dialect: SQLSQLite,
+		Backend: "smtp",
+		Clock:   ClockFunc(func() time.Time { return clock }),
+	})
+	if _, err := db.ExecContext(ctx, log.Schema()); err != nil {
+		t.Fatal(err)
+	}
+
+	var sendErr error
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		clock = clock.Add(250 * time.Millisecond)
+		return sendErr
+	}), SendLog(log))
+
+	welcome, _ := NewMessage().From("app@example.com").To("User@Example.com").Subject("Welcome").Text("Hello").Build()
+	welcome.Tags = []string{"welcome"}
+	if err := mailer.Send(welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	clock = clock.Add(time.Hour)
+	sendErr = errors.New("mailbox unavailable")
+	reset, _ := NewMessage().From("app@example.com").To("user@example.com", "other@example.com").Subject("Reset").Text("Hello").Build()
+	reset.Tags = []string{"password", "security"}
+	if err := mailer.Send(reset); !errors.Is(err, sendErr) {
+		t.Fatalf("Expected the send error, got %v", err)
+	}
+
+	t.Run("by recipient", func(t *testing.T) {
+		entries, err := log.ByRecipient(ctx, "user@example.com", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Subject != "Reset" || entries[1].Subject != "Welcome" {
+			t.Fatalf("Expected the 2 entries, the most recent first, got %+v", entries)
+		}
+
+		failed := entries[0]
+		if failed.Status != DeliveryFailed || failed.Error != "mailbox unavailable" || failed.Backend != "smtp" {
+			t.Fatalf("Expected the failed attempt, got %+v", failed)
+		}
+		if failed.MessageID == "" || failed.From != "app@example.com" || len(failed.Recipients) != 2 {
+			t.Fatalf("Expected the message details, got %+v", failed)
+		}
+
+		sent := entries[1]
+		if sent.Status != DeliverySent || sent.Error != "" || sent.Duration != 250*time.Millisecond {
+			t.Fatalf("Expected the sent attempt, got %+v", sent)
+		}
+
+		if entries, _ := log.ByRecipient(ctx, "other@example.com", 0); len(entries) != 1 {
+			t.Fatalf("Expected 1 entry of the other recipient, got %+v", entries)
+		}
+		if entries, _ := log.ByRecipient(ctx, "user", 0); len(entries) != 0 {
+			t.Fatalf("Expected no entry of a partial address, got %+v", entries)
+		}
+	})
+
+	t.Run("by tag", func(t *testing.T) {
+		entries, err := log.ByTag(ctx, "security", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Subject != "Reset" || len(entries[0].Tags) != 2 {
+			t.Fatalf("Expected the tagged entry, got %+v", entries)
+		}
+	})
+
+	t.Run("between", func(t *testing.T) {
+		since := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+
+		entries, err := log.Between(ctx, since, since.Add(time.Hour), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Subject != "Welcome" || !entries[0].At.Equal(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)) {
+			t.Fatalf("Expected the first entry, got %+v", entries)
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		entries, err := log.Query(ctx, SendLogQuery{Status: DeliverySent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Subject != "Welcome" {
+			t.Fatalf("Expected the sent entry, got %+v", entries)
+		}
+
+		if entries, _ := log.Query(ctx, SendLogQuery{Limit: 1, Offset: 1}); len(entries) != 1 || entries[0].Subject != "Welcome" {
+			t.Fatalf("Expected the second entry, got %+v", entries)
+		}
+	})
+
+	t.Run("sent recipients", func(t *testing.T) {
+		entries, _ := log.ByRecipient(ctx, "user@example.com", 0)
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 entries, got %+v", entries)
+		}
+
+		if entries, _ := log.Query(ctx, SendLogQuery{MessageID: entries[1].MessageID}); len(entries) != 1 || entries[0].Subject != "Welcome" {
+			t.Fatalf("Expected the entry of the Message-ID, got %+v", entries)
+		}
+
+		recipients, err := log.SentRecipients(ctx, entries[1].MessageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recipients) != 1 || recipients[0] != "user@example.com" {
+			t.Fatalf("Expected the sent recipient, got %v", recipients)
+		}
+
+		if recipients, _ := log.SentRecipients(ctx, entries[0].MessageID); len(recipients) != 0 {
+			t.Fatalf("Expected no recipient of the failed message, got %v", recipients)
+		}
+	})
+
+	t.Run("purged", func(t *testing.T) {
+		n, err := log.Purge(ctx, clock.Add(-time.Minute))
+		if err != nil || n != 1 {
+			t.Fatalf("Expected 1 purged entry, got %d, %v", n, err)
+		}
+		if rows := fakeSQLTable(t, db, defaultSendLogTable); len(rows) != 1 {
+			t.Fatalf("Expected 1 entry to be kept, got %v", rows)
+		}
+	})
+}
+
+func TestSendLogRecordError(t *testing.T) {
+	db := newFakeSQLDB(t) // without the table
+
+	var recordErr error
+	log := NewSQLSendLog(db, SendLogConfig{
+		Dialect: SQLSQLite,
+		OnError: func(m *Message, err error) { recordErr = err },
+	})
+
+	m, _ := NewMessage().From("app@example.com").To("user@example.com").Subject("Hello").Text("Hello").Build()
+	if err := Chain(MailerFunc(func(*Message) error { return nil }), SendLog(log)).Send(m); err != nil {
+		t.Fatalf("Expected the message to be sent, got %v", err)
+	}
+	if recordErr == nil {
+		t.Fatal("Expected the record error to be reported")
+	}
+}
+
+func TestSendLogConfigValidate(t *testing.T) {
+	db := newFakeSQLDB(t)
+	var driver string
+	for _, name := range sql.Drivers() {
+		if d, ok := fakeSQLDrivers.Load(name); ok && d == db.Driver() {
+			driver = name
+		}
+	}
+
+	scenarios := []struct {
+		name   string
+		config SendLogConfig
+		valid  bool
+	}{
+		{"valid", SendLogConfig{Driver: driver, DSN: "file::memory:"}, true},
+		{"missing driver", SendLogConfig{DSN: "file::memory:"}, false},
+		{"unknown driver", SendLogConfig{Driver: "unknown", DSN: "file::memory:"}, false},
+		{"missing dsn", SendLogConfig{Driver: driver}, false},
+		{"unknown dialect", SendLogConfig{Driver: driver, DSN: "file::memory:", Dialect: "oracle"}, false},
+		{"invalid table", SendLogConfig{Driver: driver, DSN: "file::memory:", Table: "log; DROP"}, false},
+		{"negative timeout", SendLogConfig{Driver: driver, DSN: "file::memory:", Timeout: -time.Second}, false},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.config.Validate(); (err == nil) != s.valid {
+				t.Fatalf("Expected valid %v, got %v", s.valid, err)
+			}
+		})
+	}
+}
@@ -19,62 +19,285 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"mime"
-	"net/http"
+	"fmt"
 	"os/exec"
 	"strings"
+	"time"
 )
 
-var _ Mailer = (*SendMail)(nil)
+var (
+	_ Mailer  = (*SendMail)(nil)
+	_ Pinger  = (*SendMail)(nil)
+	_ Capable = (*SendMail)(nil)
+)
 
 // SendMail implements [mailer.Mailer] interface and defines a mail
 // client that sends emails via the "sendmail" *nix command.
 //
 // This client is usually recommended only for development and testing.
+//
+// It is safe for concurrent use since every Send runs a separate command.
 type SendMail struct {
-	CmdPath string `mapstructure:"cmd_path" json:"cmd_path,omitempty" bson:"cmd_path,omitempty"` // sendmail cmd path
+	CmdPath string        `mapstructure:"cmd_path" json:"cmd_path,omitempty" bson:"cmd_path,omitempty"` // sendmail cmd path
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`    // max command run time, default to 30s
+
+	// Args are the command arguments passed before the recipients,
+	// default to the Flavor ones (eg. ["-i"]).
+	//
+	// When "-t" is present, the recipients are read by sendmail from the
+	// message headers (including a Bcc header, which sendmail removes)
+	// instead of being passed as arguments.
+	Args []string `mapstructure:"args" json:"args,omitempty" bson:"args,omitempty"`
+
+	// EnvelopeFrom passes the message From address as envelope sender ("-f").
+	// Messages with [Message.ReturnPath] always pass it as envelope sender
+	// and the ones with [Message.NullSender] the null sender ("-f <>").
+	EnvelopeFrom bool `mapstructure:"envelope_from" json:"envelope_from,omitempty" bson:"envelope_from,omitempty"`
+
+	// Flavor selects the defaults of a sendmail-compatible binary
+	// (see the SendmailFlavor* constants), default to [SendmailFlavorSendmail].
+	Flavor SendmailFlavor `mapstructure:"flavor" json:"flavor,omitempty" bson:"flavor,omitempty"`
 }
 
-// Send implements `mailer.Mailer` interface.
-func (c SendMail) Send(m *Message) error {
-	toAddresses := addressesToStrings(m.To, false)
+// SendmailFlavor is a sendmail-compatible binary preset.
+type SendmailFlavor string
 
-	headers := make(http.Header)
-	headers.Set("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
-	headers.Set("From", m.From.String())
-	headers.Set("Content-Type", "text/html; charset=UTF-8")
-	headers.Set("To", strings.Join(toAddresses, ","))
+const (
+	SendmailFlavorSendmail SendmailFlavor = "sendmail"
+	SendmailFlavorPostfix  SendmailFlavor = "postfix"
+	SendmailFlavorExim     SendmailFlavor = "exim"
+	SendmailFlavorMsmtp    SendmailFlavor = "msmtp"
+)
 
-	var buffer bytes.Buffer
+// sendmailPreset holds the defaults of a [SendmailFlavor].
+type sendmailPreset struct {
+	paths []string // candidate command paths, in order of preference
+	args  []string
+}
 
-	if err := headers.Write(&buffer); err != nil {
-		return err
-	}
-	if _, err := buffer.Write([]byte("\r\n")); err != nil {
-		return err
+var sendmailPresets = map[SendmailFlavor]sendmailPreset{
+	SendmailFlavorSendmail: {
+		paths: []string{"/usr/sbin/sendmail", "/usr/bin/sendmail", "sendmail"},
+		args:  []string{"-i"},
+	},
+	SendmailFlavorPostfix: {
+		paths: []string{"/usr/sbin/sendmail.postfix", "/usr/sbin/sendmail", "sendmail"},
+		args:  []string{"-i"},
+	},
+	SendmailFlavorExim: {
+		paths: []string{"/usr/sbin/exim4", "/usr/sbin/exim", "exim4", "exim"},
+		// -oi: same as -i, the only form recognized by older exim versions
+		args: []string{"-oi"},
+	},
+	SendmailFlavorMsmtp: {
+		paths: []string{"/usr/bin/msmtp", "msmtp"},
+		// msmtp uses the account default sender unless it is told to use the From header
+		args: []string{"-i", "--read-envelope-from"},
+	},
+}
+
+// preset returns the configured flavor preset.
+func (c SendMail) preset() sendmailPreset {
+	flavor := SendmailFlavor(strings.ToLower(string(c.Flavor)))
+	if flavor == "" {
+		flavor = SendmailFlavorSendmail
 	}
-	if m.HTML != "" {
-		if _, err := buffer.Write([]byte(m.HTML)); err != nil {
+
+	return sendmailPresets[flavor]
+}
+
+// applyDefaults resolves the command path (looking for the flavor
+// binaries if not set) and fills the flavor default args.
+func (c *SendMail) applyDefaults() error {
+	preset := c.preset()
+
+	if c.CmdPath == "" {
+		path, err := findSendmailPath(preset.paths...)
+		if err != nil {
 			return err
 		}
+		c.CmdPath = path
 	} else {
-		if _, err := buffer.Write([]byte(m.Text)); err != nil {
+		path, err := exec.LookPath(c.CmdPath)
+		if err != nil {
 			return err
 		}
+		c.CmdPath = path
+	}
+
+	if c.Args == nil {
+		c.Args = append([]string(nil), preset.args...)
+	}
+
+	return nil
+}
+
+const (
+	defaultSendmailTimeout = 30 * time.Second
+
+	// maxSendmailStderr is the max number of stderr bytes kept in [SendMailError].
+	maxSendmailStderr = 4 << 10
+)
+
+// SendMailError is returned when the sendmail command fails.
+type SendMailError struct {
+	// ExitCode is the command exit code or -1 if the
+	// command was killed (eg. on timeout) or failed to start.
+	ExitCode int
+
+	// Stderr is the (possibly truncated) command error output.
+	Stderr string
+
+	Err error
+}
+
+func (e *SendMailError) Error() string {
+	msg := "sendmail: " + e.Err.Error()
+	if e.ExitCode > 0 {
+		msg = fmt.Sprintf("sendmail: exit code %d", e.ExitCode)
+	}
+
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+
+	return msg
+}
+
+func (e *SendMailError) Unwrap() error {
+	return e.Err
+}
+
+// Send implements `mailer.Mailer` interface.
+//
+// The message is rendered in the same RFC 5322 format as the SMTP client
+// one, while all To, Cc and Bcc recipients are passed as separate command
+// arguments (unless "-t" is configured, see [SendMail.Args], in which case
+// the Bcc and the hidden To recipients are rendered as Bcc header).
+func (c SendMail) Send(m *Message) error {
+	args, readRecipients := c.args(m)
+
+	if readRecipients && len(m.hiddenRecipients()) > 0 {
+		m = m.Clone()
+		m.bccHeader = true
+	}
+
+	raw, err := m.Render()
+	if err != nil {
+		return err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultSendmailTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stderr := &limitedBuffer{max: maxSendmailStderr}
+
+	sendmail := exec.CommandContext(ctx, c.CmdPath, args...)
+	sendmail.Stdin = bytes.NewReader(raw)
+	sendmail.Stderr = stderr
+	// don't wait forever for the I/O of orphaned child processes after a kill
+	sendmail.WaitDelay = time.Second
+
+	if err := sendmail.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+
+		return &SendMailError{
+			ExitCode: exitCode,
+			Stderr:   strings.TrimSpace(stderr.String()),
+			Err:      err,
+		}
+	}
+
+	return nil
+}
+
+// Capabilities implements `mailer.Capable` interface.
+func (c SendMail) Capabilities() Capabilities {
+	return renderedCapabilities
+}
+
+// args returns the command arguments for the specified message and
+// whether sendmail is expected to read the recipients from the headers.
+func (c SendMail) args(m *Message) ([]string, bool) {
+	args := c.Args
+	if args == nil {
+		// eg. -i: don't treat a line with only a dot as the end of the message
+		args = c.preset().args
+	}
+	args = append([]string(nil), args...)
+
+	if m.NullSender {
+		args = append(args, "-f", "<>")
+	} else if from := envelopeSender(m); from != "" && (c.EnvelopeFrom || m.ReturnPath != "") {
+		args = append(args, "-f", from)
 	}
 
-	sendmail := exec.Command(c.CmdPath, strings.Join(toAddresses, ","))
-	sendmail.Stdin = &buffer
+	for _, arg := range args {
+		if arg == "-t" {
+			return args, true
+		}
+	}
 
-	return sendmail.Run()
+	// -- ends the options, so that no recipient could be treated as such
+	return append(append(args, "--"), envelopeRecipients(m)...), false
 }
 
-func findSendmailPath() (string, error) {
-	options := []string{
-		"/usr/sbin/sendmail",
-		"/usr/bin/sendmail",
-		"sendmail",
+// Ping implements `mailer.Pinger` interface.
+//
+// It only checks that the configured sendmail command is still executable.
+func (c SendMail) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := exec.LookPath(c.CmdPath)
+
+	return err
+}
+
+// Validate checks the sendmail configuration for common mistakes.
+func (c SendMail) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(c.CmdPath) == "" {
+		errs = append(errs, errors.New("sendmail: cmd_path is required"))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("sendmail: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if _, ok := sendmailPresets[SendmailFlavor(strings.ToLower(string(c.Flavor)))]; !ok && c.Flavor != "" {
+		errs = append(errs, fmt.Errorf("sendmail: unsupported flavor %q, expected %q, %q, %q or %q", c.Flavor, SendmailFlavorSendmail, SendmailFlavorPostfix, SendmailFlavorExim, SendmailFlavorMsmtp))
+	}
+
+	for i, arg := range c.Args {
+		if strings.TrimSpace(arg) == "" {
+			errs = append(errs, fmt.Errorf("sendmail: args[%d] must not be empty", i))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func findSendmailPath(options ...string) (string, error) {
+	if len(options) == 0 {
+		options = sendmailPresets[SendmailFlavorSendmail].paths
 	}
 
 	for _, option := range options {
@@ -86,3 +309,21 @@ func findSendmailPath() (string, error) {
 
 	return "", errors.New("failed to locate a sendmail executable path")
 }
+
+// limitedBuffer is a bytes.Buffer that silently discards everything after max bytes.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSendmail creates a fake sendmail executable that
+// stores its arguments and stdin in the returned directory.
+func newTestSendmail(t *testing.T, script string) (SendMail, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sendmail")
+
+	content := "#!/bin/sh\nprintf '%s\\n' \"$@\" > \"" + dir + "/args\"\ncat > \"" + dir + "/stdin\"\n" + script + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	return SendMail{CmdPath: path}, dir
+}
+
+func TestSendMailSend(t *testing.T) {
+	client, dir := newTestSendmail(t, "")
+
+	err := client.Send(&Message{
+		From:        mail.Address{Address: "sender@example.com"},
+		To:          []mail.Address{{Address: "to@example.com"}},
+		Cc:          []mail.Address{{Address: "cc@example.com"}},
+		Bcc:         []mail.Address{{Address: "bcc@example.com"}},
+		Subject:     "test",
+		Text:        "text",
+		HTML:        "<p>html</p>",
+		Headers:     map[string]string{"X-Custom": "custom"},
+		Attachments: map[string]io.Reader{"a.txt": strings.NewReader("attachment")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	expectedArgs := "-i\n--\nto@example.com\ncc@example.com\nbcc@example.com\n"
+	if string(args) != expectedArgs {
+		t.Fatalf("Expected args %q, got %q", expectedArgs, args)
+	}
+
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+	raw := string(stdin)
+	for _, expected := range []string{"Cc: cc@example.com", "X-Custom: custom", "multipart/mixed", "multipart/alternative", "filename=a.txt"} {
+		if !strings.Contains(raw, expected) {
+			t.Errorf("Expected %q in the rendered message:\n%s", expected, raw)
+		}
+	}
+	if strings.Contains(raw, "bcc@example.com") {
+		t.Errorf("Bcc recipients must not be in the message headers:\n%s", raw)
+	}
+}
+
+func TestSendMailSendError(t *testing.T) {
+	client, _ := newTestSendmail(t, "echo 'invalid recipient' >&2\nexit 67")
+
+	err := client.Send(&Message{
+		From: mail.Address{Address: "sender@example.com"},
+		To:   []mail.Address{{Address: "to@example.com"}},
+		Text: "test",
+	})
+
+	var sendErr *SendMailError
+	if !errors.As(err, &sendErr) {
+		t.Fatalf("Expected SendMailError, got %v", err)
+	}
+	if sendErr.ExitCode != 67 {
+		t.Fatalf("Expected exit code 67, got %d", sendErr.ExitCode)
+	}
+	if sendErr.Stderr != "invalid recipient" {
+		t.Fatalf("Expected stderr %q, got %q", "invalid recipient", sendErr.Stderr)
+	}
+	if err.Error() != "sendmail: exit code 67: invalid recipient" {
+		t.Fatalf("Unexpected error message %q", err.Error())
+	}
+}
+
+func TestSendMailSendTimeout(t *testing.T) {
+	client, _ := newTestSendmail(t, "sleep 10")
+	client.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err := client.Send(&Message{
+		From: mail.Address{Address: "sender@example.com"},
+		To:   []mail.Address{{Address: "to@example.com"}},
+		Text: "test",
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the command to be killed on timeout, took %s", elapsed)
+	}
+}
+
+func TestSendMailArgs(t *testing.T) {
+	m := &Message{
+		From: mail.Address{Address: "sender@example.com"},
+		To:   []mail.Address{{Address: "to@example.com"}},
+		Bcc:  []mail.Address{{Address: "bcc@example.com"}},
+		Text: "test",
+	}
+
+	scenarios := []struct {
+		name         string
+		client       SendMail
+		expectedArgs string
+		expectedBcc  bool
+	}{
+		{
+			"custom args with envelope sender",
+			SendMail{Args: []string{"-oi", "-oem"}, EnvelopeFrom: true},
+			"-oi\n-oem\n-f\nsender@example.com\n--\nto@example.com\nbcc@example.com\n",
+			false,
+		},
+		{
+			"read recipients from headers",
+			SendMail{Args: []string{"-i", "-t"}},
+			"-i\n-t\n",
+			true,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			client, dir := newTestSendmail(t, "")
+			s.client.CmdPath = client.CmdPath
+
+			if err := s.client.Send(m); err != nil {
+				t.Fatal(err)
+			}
+
+			args, _ := os.ReadFile(filepath.Join(dir, "args"))
+			if string(args) != s.expectedArgs {
+				t.Fatalf("Expected args %q, got %q", s.expectedArgs, args)
+			}
+
+			stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+			if hasBcc := strings.Contains(string(stdin), "Bcc: bcc@example.com"); hasBcc != s.expectedBcc {
+				t.Fatalf("Expected Bcc header %v, got %v", s.expectedBcc, hasBcc)
+			}
+		})
+	}
+
+	if len(m.Headers) > 0 {
+		t.Fatalf("Expected the original message to be unchanged, got headers %v", m.Headers)
+	}
+
+	bounce := &Message{From: m.From, To: m.To, NullSender: true}
+	if args, _ := (SendMail{Args: []string{"-i"}, EnvelopeFrom: true}).args(bounce); strings.Join(args, " ") != "-i -f <> -- to@example.com" {
+		t.Fatalf("Expected the null envelope sender, got %q", args)
+	}
+}
+
+func TestSendMailHideRecipients(t *testing.T) {
+	m := &Message{
+		From:           mail.Address{Address: "sender@example.com"},
+		To:             []mail.Address{{Address: "to@example.com"}},
+		Bcc:            []mail.Address{{Address: "bcc@example.com"}},
+		Text:           "test",
+		HideRecipients: true,
+	}
+
+	client, dir := newTestSendmail(t, "")
+	client.Args = []string{"-i", "-t"}
+
+	if err := client.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+	for _, expected := range []string{"To: undisclosed-recipients:;\r\n", "Bcc: to@example.com, bcc@example.com\r\n"} {
+		if !strings.Contains(string(stdin), expected) {
+			t.Fatalf("Expected %q in the message:\n%s", expected, stdin)
+		}
+	}
+}
+
+func TestSendMailFlavor(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msmtp")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	client := SendMail{Flavor: "MSMTP"}
+	if err := client.applyDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.CmdPath != path {
+		t.Fatalf("Expected cmd path %q, got %q", path, client.CmdPath)
+	}
+	if v := strings.Join(client.Args, " "); v != "-i --read-envelope-from" {
+		t.Fatalf("Expected msmtp args, got %q", v)
+	}
+
+	if err := (SendMail{CmdPath: path, Flavor: "unknown"}).Validate(); err == nil {
+		t.Fatal("Expected unsupported flavor error")
+	}
+}
@@ -0,0 +1,49 @@
+package mailer
+
+import "fmt"
+
+// Signer signs the rendered messages (eg. [ARCSealer]).
+type Signer interface {
+	// Sign returns the CRLF terminated header fields (eg. signatures)
+	// to prepend to the provided raw RFC 5322 message.
+	Sign(raw []byte) ([]byte, error)
+}
+
+// SignerFunc is an adapter to allow the use of ordinary functions as [Signer].
+type SignerFunc func(raw []byte) ([]byte, error)
+
+// Sign implements [Signer] interface.
+func (f SignerFunc) Sign(raw []byte) ([]byte, error) {
+	return f(raw)
+}
+
+// Signing returns a middleware that attaches the provided signers to the
+// messages, so that they sign the messages whenever they are rendered by
+// the next mailers (eg. right before the SMTP DATA command).
+//
+// The signers are applied in order, each one signing the output of the
+// previous, so the sealing signers (eg. ARC) should come last.
+func Signing(signers ...Signer) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			m = m.Clone()
+			m.signers = append(m.signers, signers...)
+
+			return next.Send(m)
+		})
+	}
+}
+
+// sign applies the signers to the raw message in order.
+func sign(raw []byte, signers []Signer) ([]byte, error) {
+	for _, signer := range signers {
+		headers, err := signer.Sign(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign the message: %w", err)
+		}
+
+		raw = append(headers, raw...)
+	}
+
+	return raw, nil
+}
@@ -18,21 +18,61 @@
 package mailer
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ Mailer    = (*SmtpClient)(nil)
+	_ Pinger    = (*SmtpClient)(nil)
+	_ Verifier  = (*SmtpClient)(nil)
+	_ Capable   = (*SmtpClient)(nil)
+	_ io.Closer = (*SmtpClient)(nil)
+)
 
-	"github.com/domodwyer/mailyak/v3"
+const (
+	defaultSmtpTimeout = 30 * time.Second
+
+	// maxPooledRenderBuffer is the max capacity of the render buffers
+	// kept for reuse, so that a few large messages don't pin their memory.
+	maxPooledRenderBuffer = 1 << 20
 )
 
-var _ Mailer = (*SmtpClient)(nil)
+// renderBuffers are the reused buffers the messages are rendered into before being sent.
+var renderBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func putRenderBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledRenderBuffer {
+		renderBuffers.Put(buf)
+	}
+}
 
 type SmtpAuth string
 
 const (
-	SmtpAuthPlain SmtpAuth = "PLAIN"
-	SmtpAuthLogin SmtpAuth = "LOGIN"
+	SmtpAuthPlain   SmtpAuth = "PLAIN"
+	SmtpAuthLogin   SmtpAuth = "LOGIN"
+	SmtpAuthXOAuth2 SmtpAuth = "XOAUTH2"
+	SmtpAuthNTLM    SmtpAuth = "NTLM"
+	SmtpAuthGSSAPI  SmtpAuth = "GSSAPI"
+	SmtpAuthCramMD5 SmtpAuth = "CRAM-MD5"
+
+	// SmtpAuthAuto picks the strongest mechanism advertised by the server
+	// (CRAM-MD5 > PLAIN > LOGIN, or XOAUTH2 for the OAuth2 tokens).
+	SmtpAuthAuto SmtpAuth = "AUTO"
 )
 
 type AddressConfig struct {
@@ -42,18 +82,108 @@ type AddressConfig struct {
 
 // SmtpClient defines a SMTP mail client structure that implements
 // `mailer.Mailer` interface.
+//
+// A configured client is safe for concurrent Send calls (including in
+// pooled mode), as long as the client fields are not changed afterwards
+// and the optional Credentials provider and hooks are goroutine safe too.
 type SmtpClient struct {
-	Host       string        `mapstructure:"host" json:"host,omitempty" bson:"host,omitempty"`
-	Port       int           `mapstructure:"port" json:"port,omitempty" bson:"port,omitempty"`
-	Username   string        `mapstructure:"username" json:"username,omitempty" bson:"username,omitempty"`
-	Password   string        `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"`
-	Tls        bool          `mapstructure:"tls" json:"tls,omitempty" bson:"tls,omitempty"`
-	AuthMethod SmtpAuth      `mapstructure:"auth" json:"auth_method,omitempty" bson:"auth_method,omitempty"` // default to "PLAIN"
-	From       AddressConfig `mapstructure:"from" json:"from,omitempty" bson:"from,omitempty"`
+	Host         string        `mapstructure:"host" json:"host,omitempty" bson:"host,omitempty"`
+	Port         int           `mapstructure:"port" json:"port,omitempty" bson:"port,omitempty"`
+	Username     string        `mapstructure:"username" json:"username,omitempty" bson:"username,omitempty"`
+	Password     string        `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"`
+	UsernameFile string        `mapstructure:"username_file" json:"username_file,omitempty" bson:"username_file,omitempty"` // path to a file holding the username (eg. Docker/K8s secret)
+	PasswordFile string        `mapstructure:"password_file" json:"password_file,omitempty" bson:"password_file,omitempty"` // path to a file holding the password (eg. Docker/K8s secret)
+	Tls          bool          `mapstructure:"tls" json:"tls,omitempty" bson:"tls,omitempty"`
+	AuthMethod   SmtpAuth      `mapstructure:"auth" json:"auth_method,omitempty" bson:"auth_method,omitempty"` // default to "PLAIN"
+	From         AddressConfig `mapstructure:"from" json:"from,omitempty" bson:"from,omitempty"`
+
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`       // dial and per message timeout, default to 30s
+	PoolSize int           `mapstructure:"pool_size" json:"pool_size,omitempty" bson:"pool_size,omitempty"` // max idle connections to keep, 0 disables the pooling
+
+	// PoolIdleTimeout is the max idle time of the pooled connections (default
+	// to 4m). The connections idle for over a second are checked with NOOP
+	// before reuse, reconnecting transparently when the server dropped them.
+	// PoolKeepAlive is the interval of the NOOP sent to the idle connections
+	// to keep them open (0 disables the keep-alive).
+	PoolIdleTimeout time.Duration `mapstructure:"pool_idle_timeout" json:"pool_idle_timeout,omitempty" bson:"pool_idle_timeout,omitempty"`
+	PoolKeepAlive   time.Duration `mapstructure:"pool_keep_alive" json:"pool_keep_alive,omitempty" bson:"pool_keep_alive,omitempty"`
+
+	// AddressFamily is the address family preference of the hosts having both
+	// AAAA and A records (default to "auto", the resolver order). The other
+	// family is dialed in parallel after FallbackDelay (default to 300ms,
+	// negative to dial all the addresses serially), see RFC 8305.
+	AddressFamily AddressFamily `mapstructure:"address_family" json:"address_family,omitempty" bson:"address_family,omitempty"`
+	FallbackDelay time.Duration `mapstructure:"fallback_delay" json:"fallback_delay,omitempty" bson:"fallback_delay,omitempty"`
+
+	// Hosts are the failover relays ("host" or "host:port") tried in order
+	// after Host, or instead of it when MX is enabled and resolves the Host
+	// (smarthost) domain MX hosts, each one dialed within HostTimeout
+	// (default to Timeout), so that a single dead relay doesn't stop the sends.
+	Hosts       []string      `mapstructure:"hosts" json:"hosts,omitempty" bson:"hosts,omitempty"`
+	MX          bool          `mapstructure:"mx" json:"mx,omitempty" bson:"mx,omitempty"`
+	HostTimeout time.Duration `mapstructure:"host_timeout" json:"host_timeout,omitempty" bson:"host_timeout,omitempty"`
+
+	// BodyEncoding is the text bodies transfer encoding (default to "quoted-printable").
+	// The "8bit" bodies are sent with BODY=8BITMIME, falling back to
+	// quoted-printable when the server doesn't advertise the extension.
+	BodyEncoding BodyEncoding `mapstructure:"body_encoding" json:"body_encoding,omitempty" bson:"body_encoding,omitempty"`
+
+	// Credentials is an optional provider used to fetch the credentials
+	// on every connection, taking precedence over Username and Password.
+	Credentials CredentialsProvider `mapstructure:"-" json:"-" bson:"-"`
+
+	// Kerberos configures the credentials of the GSSAPI auth.
+	Kerberos GSSAPIConfig `mapstructure:"kerberos" json:"kerberos,omitempty" bson:"kerberos,omitempty"`
+
+	// GSSAPI is an optional provider of the GSSAPI auth security contexts
+	// (default to the one set with [RegisterGSSAPIProvider]).
+	GSSAPI GSSAPIProvider `mapstructure:"-" json:"-" bson:"-"`
+
+	// MessageIDGenerator is an optional hook used to generate the Message-ID
+	// header of the messages without one (default to [DefaultMessageID]).
+	MessageIDGenerator MessageIDGenerator `mapstructure:"-" json:"-" bson:"-"`
+
+	// Clock is an optional time source used for the Date header
+	// and the default Message-ID (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// Rand is an optional randomness source used for the MIME boundaries
+	// and the default Message-ID (default to crypto/rand).
+	Rand io.Reader `mapstructure:"-" json:"-" bson:"-"`
+
+	// BeforeSend is an optional hook called before every send.
+	// Returning an error aborts the send.
+	BeforeSend func(m *Message) error `mapstructure:"-" json:"-" bson:"-"`
+
+	// AfterSend is an optional hook called after every send attempt.
+	AfterSend func(m *Message, err error) `mapstructure:"-" json:"-" bson:"-"`
+
+	// Debug enables the recording of the SMTP dialogue of every send (with
+	// the credentials masked and without the message content). The failed
+	// sends return [SmtpTranscriptError] holding the transcript.
+	Debug bool `mapstructure:"debug" json:"debug,omitempty" bson:"debug,omitempty"`
+
+	// OnTranscript is an optional hook called with the SMTP dialogue
+	// transcript after every send attempt when Debug is enabled.
+	OnTranscript func(m *Message, transcript string) `mapstructure:"-" json:"-" bson:"-"`
+
+	// Resolver is an optional resolver of the host addresses (default to [net.DefaultResolver]).
+	Resolver DNSResolver `mapstructure:"-" json:"-" bson:"-"`
+
+	// TLSConfig is an optional config of the TLS and STARTTLS connections
+	// (eg. with custom root CAs). The ServerName defaults to Host.
+	TLSConfig *tls.Config `mapstructure:"-" json:"-" bson:"-"`
+
+	pool *smtpPool
 }
 
 // Send implements `mailer.Mailer` interface.
-func (c SmtpClient) Send(m *Message) error {
+//
+// The provided message is not modified, the client defaults
+// are applied to a copy of it.
+func (c SmtpClient) Send(m *Message) (err error) {
+	m = m.Clone()
+
 	if m.From.Name == "" {
 		m.From.Name = c.From.Name
 	}
@@ -61,76 +191,393 @@ func (c SmtpClient) Send(m *Message) error {
 		m.From.Address = c.From.Address
 	}
 
-	var smtpAuth smtp.Auth
-	if c.Username != "" || c.Password != "" {
-		switch c.AuthMethod {
-		case SmtpAuthLogin:
-			smtpAuth = &smtpLoginAuth{c.Username, c.Password}
-		default:
-			smtpAuth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	if c.BeforeSend != nil {
+		if err := c.BeforeSend(m); err != nil {
+			return err
+		}
+	}
+	if c.AfterSend != nil {
+		defer func() {
+			c.AfterSend(m, err)
+		}()
+	}
+
+	renderer := Renderer{Clock: c.Clock, Rand: c.Rand, MessageID: c.MessageIDGenerator, BodyEncoding: c.BodyEncoding}
+
+	buf := renderBuffers.Get().(*bytes.Buffer)
+	defer putRenderBuffer(buf)
+
+	render := func(eightBitMIME bool) ([]byte, error) {
+		r := renderer
+		if r.BodyEncoding == BodyEncoding8Bit && !eightBitMIME {
+			r.BodyEncoding = BodyEncodingQuotedPrintable
+		}
+
+		buf.Reset()
+		if err := r.Write(buf, m); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	var transcript *smtpTranscript
+	if c.Debug {
+		transcript = &smtpTranscript{}
+	}
+
+	result, err := c.deliver(context.Background(), envelopeSender(m), envelopeRecipients(m), render, transcript)
+	if err == nil {
+		m.setResult(result)
+	}
+
+	if transcript != nil {
+		if c.OnTranscript != nil {
+			c.OnTranscript(m, transcript.String())
+		}
+		if err != nil {
+			err = &SmtpTranscriptError{Err: err, Transcript: transcript.String()}
+		}
+	}
+
+	return c.redactError(err)
+}
+
+// Capabilities implements `mailer.Capable` interface.
+//
+// The pooled clients support the batch sends over their kept connections.
+func (c SmtpClient) Capabilities() Capabilities {
+	caps := renderedCapabilities
+	caps.Batch = c.PoolSize > 0
+
+	return caps
+}
+
+// Ping implements `mailer.Pinger` interface.
+//
+// It dials the SMTP server, greets it (upgrading the connection
+// with STARTTLS when supported), authenticates with the configured
+// credentials (if any) and quits without sending anything.
+func (c SmtpClient) Ping(ctx context.Context) error {
+	sc, err := c.dial(ctx, nil)
+	if err != nil {
+		return c.redactError(err)
+	}
+
+	return c.redactError(sc.quit())
+}
+
+// Verify implements [Verifier] interface, checking the server connectivity
+// and credentials like [SmtpClient.Ping] and, if the recipient is not empty,
+// that the server accepts it from the From address, resetting the
+// transaction after the RCPT command so that nothing is sent.
+func (c SmtpClient) Verify(ctx context.Context, recipient string) error {
+	if recipient == "" {
+		return c.Ping(ctx)
+	}
+
+	sc, err := c.dial(ctx, nil)
+	if err != nil {
+		return c.redactError(err)
+	}
+
+	if err := sc.client.Mail(c.From.Address); err != nil {
+		sc.close()
+		return c.redactError(fmt.Errorf("sender %q rejected: %w", c.From.Address, err))
+	}
+
+	if err := sc.client.Rcpt(recipient); err != nil {
+		sc.close()
+		return c.redactError(fmt.Errorf("recipient %q rejected: %w", recipient, err))
+	}
+
+	if err := sc.client.Reset(); err != nil {
+		sc.close()
+		return c.redactError(err)
+	}
+
+	return c.redactError(sc.quit())
+}
+
+// Close closes the pooled idle connections (if any).
+func (c SmtpClient) Close() error {
+	if c.pool == nil {
+		return nil
+	}
+
+	return c.pool.close()
+}
+
+// Redacted returns a copy of the client config with the secrets masked,
+// safe to be logged or dumped.
+func (c SmtpClient) Redacted() SmtpClient {
+	c.Password = redact(c.Password)
+	c.Credentials = nil
+	c.MessageIDGenerator = nil
+	c.Clock = nil
+	c.Rand = nil
+	c.BeforeSend = nil
+	c.AfterSend = nil
+	c.OnTranscript = nil
+	c.pool = nil
+
+	return c
+}
+
+// String implements [fmt.Stringer] interface, printing the redacted config.
+func (c SmtpClient) String() string {
+	type plain SmtpClient // prevents String recursion
+
+	return fmt.Sprintf("%+v", plain(c.Redacted()))
+}
+
+// GoString implements [fmt.GoStringer] interface, printing the redacted config.
+func (c SmtpClient) GoString() string {
+	return "mailer.SmtpClient" + c.String()
+}
+
+func (c SmtpClient) redactError(err error) error {
+	return redactError(err, credentialSecrets(&Credentials{Username: c.Username, Password: c.Password})...)
+}
+
+// deliver renders and sends the message to the specified envelope recipients,
+// reusing a pooled connection when available.
+//
+// A pooled connection dropped by the server since its last use (ie. failing
+// before the transaction is started) is retried once on a fresh connection,
+// since the NOOP check is skipped for the ones idle for less than a second.
+//
+// The dialogue is recorded in the transcript (if any).
+func (c SmtpClient) deliver(ctx context.Context, from string, to []string, render func(eightBitMIME bool) ([]byte, error), transcript *smtpTranscript) (SendResult, error) {
+	if sc := c.pooled(transcript); sc != nil {
+		result, err := c.transmit(sc, from, to, render)
+		if !errors.Is(err, errSmtpConnLost) {
+			return result, err
+		}
+	}
+
+	sc, err := c.dial(ctx, transcript)
+	if err != nil {
+		return SendResult{}, err
+	}
+
+	return c.transmit(sc, from, to, render)
+}
+
+// transmit renders and sends the message over the connection, releasing it.
+//
+// The message is rendered once the connection is established, so that the
+// body encoding could depend on the server 8BITMIME extension support.
+func (c SmtpClient) transmit(sc *smtpConn, from string, to []string, render func(eightBitMIME bool) ([]byte, error)) (SendResult, error) {
+	if err := sc.extendDeadline(c.Timeout); err != nil {
+		sc.close()
+		return SendResult{}, err
+	}
+
+	eightBitMIME, _ := sc.client.Extension("8BITMIME")
+
+	raw, err := render(eightBitMIME)
+	if err != nil {
+		c.release(sc)
+		return SendResult{}, err
+	}
+
+	result, err := sc.transmit(from, to, raw)
+	if err != nil {
+		sc.close()
+		return SendResult{}, err
+	}
+
+	return result, c.release(sc)
+}
+
+// release returns the still usable connection to the pool (if any)
+// or gracefully ends its session otherwise.
+func (c SmtpClient) release(sc *smtpConn) error {
+	if c.pool != nil {
+		c.pool.put(sc)
+		return nil
+	}
+
+	return sc.quit()
+}
+
+// applyDefaults fills the zero config values with their defaults
+// and initializes the connections pool (if enabled).
+func (c *SmtpClient) applyDefaults() {
+	if c.Port == 0 {
+		if c.Tls {
+			c.Port = 465
+		} else {
+			c.Port = 587
+		}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultSmtpTimeout
+	}
+
+	if c.PoolSize > 0 && c.pool == nil {
+		c.pool = newSmtpPool(c.PoolSize)
+		if c.PoolKeepAlive > 0 {
+			go c.pool.keepAlive(c.PoolKeepAlive, c.poolIdleTimeout(), c.Timeout)
 		}
 	}
+}
 
-	// create mail instance
-	var yak *mailyak.MailYak
-	if c.Tls {
-		var tlsErr error
-		yak, tlsErr = mailyak.NewWithTLS(fmt.Sprintf("%s:%d", c.Host, c.Port), smtpAuth, nil)
-		if tlsErr != nil {
-			return tlsErr
+// resolveSecrets expands the ${ENV_VAR} placeholders in the client
+// settings and loads the credentials from their secret files (if any).
+func (c *SmtpClient) resolveSecrets() error {
+	c.Host = expandEnv(c.Host)
+	if c.Hosts != nil {
+		hosts := make([]string, len(c.Hosts))
+		for i, host := range c.Hosts {
+			hosts[i] = expandEnv(host)
 		}
-	} else {
-		yak = mailyak.New(fmt.Sprintf("%s:%d", c.Host, c.Port), smtpAuth)
+		c.Hosts = hosts
 	}
+	c.Username = expandEnv(c.Username)
+	c.Password = expandEnv(c.Password)
+	c.From.Name = expandEnv(c.From.Name)
+	c.From.Address = expandEnv(c.From.Address)
 
-	if m.From.Name != "" {
-		yak.FromName(m.From.Name)
+	if c.UsernameFile != "" {
+		if c.Username != "" {
+			return errors.New("smtp: username and username_file are mutually exclusive")
+		}
+
+		username, err := readSecretFile(c.UsernameFile)
+		if err != nil {
+			return fmt.Errorf("smtp: failed to read username_file: %w", err)
+		}
+		c.Username = username
 	}
-	yak.From(m.From.Address)
-	yak.Subject(m.Subject)
-	yak.HTML().Set(m.HTML)
 
-	if m.Text != "" {
-		yak.Plain().Set(m.Text)
+	if c.PasswordFile != "" {
+		if c.Password != "" {
+			return errors.New("smtp: password and password_file are mutually exclusive")
+		}
+
+		password, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("smtp: failed to read password_file: %w", err)
+		}
+		c.Password = password
 	}
 
-	if len(m.To) > 0 {
-		yak.To(addressesToStrings(m.To, true)...)
+	return nil
+}
+
+// Validate checks the client configuration for common mistakes.
+func (c SmtpClient) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(c.Host) == "" && len(c.Hosts) == 0 {
+		errs = append(errs, errors.New("smtp: host is required"))
 	}
 
-	if len(m.Bcc) > 0 {
-		yak.Bcc(addressesToStrings(m.Bcc, true)...)
+	for _, host := range c.Hosts {
+		if strings.TrimSpace(host) == "" {
+			errs = append(errs, errors.New("smtp: hosts must not be empty"))
+		} else if _, err := c.parseRelay(host); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.MX && c.Host == "" {
+		errs = append(errs, errors.New("smtp: mx requires the host domain"))
 	}
 
-	if len(m.Cc) > 0 {
-		yak.Cc(addressesToStrings(m.Cc, true)...)
+	if c.HostTimeout < 0 {
+		errs = append(errs, fmt.Errorf("smtp: host_timeout must be positive, got %s", c.HostTimeout))
 	}
 
-	// add attachements (if any)
-	for name, data := range m.Attachments {
-		yak.Attach(name, data)
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("smtp: port must be between 1 and 65535, got %d", c.Port))
 	}
 
-	// add custom headers (if any)
-	var hasMessageId bool
-	for k, v := range m.Headers {
-		if strings.EqualFold(k, "Message-ID") {
-			hasMessageId = true
+	switch SmtpAuth(strings.ToUpper(string(c.AuthMethod))) {
+	case "", SmtpAuthPlain, SmtpAuthLogin, SmtpAuthXOAuth2, SmtpAuthNTLM, SmtpAuthCramMD5, SmtpAuthAuto:
+	case SmtpAuthGSSAPI:
+		if c.gssapi() == nil {
+			errs = append(errs, errors.New("smtp: GSSAPI auth requires a Kerberos provider (see RegisterGSSAPIProvider)"))
 		}
-		yak.AddHeader(k, v)
+	default:
+		errs = append(errs, fmt.Errorf("smtp: unsupported auth method %q, expected %q, %q, %q, %q, %q, %q or %q", c.AuthMethod, SmtpAuthPlain, SmtpAuthLogin, SmtpAuthXOAuth2, SmtpAuthNTLM, SmtpAuthGSSAPI, SmtpAuthCramMD5, SmtpAuthAuto))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("smtp: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.PoolSize < 0 {
+		errs = append(errs, fmt.Errorf("smtp: pool_size must be positive, got %d", c.PoolSize))
+	}
+
+	if c.PoolIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("smtp: pool_idle_timeout must be positive, got %s", c.PoolIdleTimeout))
+	}
+
+	if c.PoolKeepAlive < 0 {
+		errs = append(errs, fmt.Errorf("smtp: pool_keep_alive must be positive, got %s", c.PoolKeepAlive))
 	}
-	if !hasMessageId {
-		// add a default message id if missing
-		fromParts := strings.Split(m.From.Address, "@")
-		if len(fromParts) == 2 {
-			yak.AddHeader("Message-ID", fmt.Sprintf("<%s@%s>",
-				PseudorandomString(15),
-				fromParts[1],
-			))
+
+	if err := c.BodyEncoding.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("smtp: %w", err))
+	}
+
+	if err := c.AddressFamily.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("smtp: %w", err))
+	}
+
+	if c.From.Address != "" {
+		if _, err := mail.ParseAddress(c.From.Address); err != nil {
+			errs = append(errs, fmt.Errorf("smtp: invalid from address %q: %w", c.From.Address, err))
 		}
 	}
 
-	return yak.Send()
+	return errors.Join(errs...)
+}
+
+func (c SmtpClient) address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (c SmtpClient) auth(ctx context.Context) (smtp.Auth, *Credentials, error) {
+	// the Kerberos credentials are acquired by the provider
+	if SmtpAuth(strings.ToUpper(string(c.AuthMethod))) == SmtpAuthGSSAPI {
+		auth, err := c.gssapiAuth(ctx)
+		return auth, nil, err
+	}
+
+	creds := &Credentials{Username: c.Username, Password: c.Password}
+	if c.Credentials != nil {
+		var err error
+		if creds, err = c.Credentials.Credentials(ctx); err != nil {
+			return nil, nil, fmt.Errorf("smtp: failed to fetch credentials: %w", err)
+		}
+	}
+
+	if creds.Token != "" {
+		return &smtpXOAuth2Auth{creds.Username, creds.Token}, creds, nil
+	}
+
+	if creds.Username == "" && creds.Password == "" {
+		return nil, nil, nil
+	}
+
+	switch SmtpAuth(strings.ToUpper(string(c.AuthMethod))) {
+	case SmtpAuthLogin:
+		return &smtpLoginAuth{creds.Username, creds.Password}, creds, nil
+	case SmtpAuthXOAuth2:
+		return &smtpXOAuth2Auth{creds.Username, creds.Password}, creds, nil
+	case SmtpAuthNTLM:
+		return &smtpNTLMAuth{username: creds.Username, password: creds.Password}, creds, nil
+	case SmtpAuthCramMD5:
+		return smtp.CRAMMD5Auth(creds.Username, creds.Password), creds, nil
+	default:
+		return smtp.PlainAuth("", creds.Username, creds.Password, c.Host), creds, nil
+	}
 }
 
 // -------------------------------------------------------------------
@@ -188,3 +635,42 @@ func (a *smtpLoginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 func isLocalhost(name string) bool {
 	return name == "localhost" || name == "127.0.0.1" || name == "::1"
 }
+
+// -------------------------------------------------------------------
+// AUTH XOAUTH2
+// -------------------------------------------------------------------
+
+var _ smtp.Auth = (*smtpXOAuth2Auth)(nil)
+
+// smtpXOAuth2Auth defines an AUTH that implements the XOAUTH2 mechanism
+// used by Gmail and Office365 to authenticate with an OAuth2 access token.
+//
+// Similar to the LOGIN auth, the token is sent only over TLS or to localhost.
+type smtpXOAuth2Auth struct {
+	username, token string
+}
+
+// Start initializes an authentication with the server.
+//
+// It is part of the [smtp.Auth] interface.
+func (a *smtpXOAuth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next "continues" the auth process by feeding the server with the requested data.
+//
+// On failure the server sends a base64 encoded JSON error and
+// expects an empty response before replying with the final error code.
+//
+// It is part of the [smtp.Auth] interface.
+func (a *smtpXOAuth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// smtpAutoMechanisms are the mechanisms of the AUTO auth, strongest first.
+// XOAUTH2 is chosen only for the credentials holding an OAuth2 token.
+var smtpAutoMechanisms = []SmtpAuth{SmtpAuthCramMD5, SmtpAuthPlain, SmtpAuthLogin}
+
+// smtpAuthCache caches the AUTO auth mechanism chosen per server and
+// user, skipping the ones rejected by the server on the next connections.
+var smtpAuthCache = &authCache{chosen: map[string]SmtpAuth{}, rejected: map[string][]SmtpAuth{}}
+
+type authCache struct {
+	mu       sync.Mutex
+	chosen   map[string]SmtpAuth
+	rejected map[string][]SmtpAuth
+}
+
+// negotiate returns the mechanism to use with the server advertising the
+// AUTH extension params (eg. "PLAIN LOGIN CRAM-MD5"), default to PLAIN.
+func (a *authCache) negotiate(key, params string) SmtpAuth {
+	advertised := strings.Fields(strings.ToUpper(params))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if method, ok := a.chosen[key]; ok && slices.Contains(advertised, string(method)) {
+		return method
+	}
+
+	// start over once all the mechanisms were rejected (eg. after a password change)
+	rejected := a.rejected[key]
+	if !slices.ContainsFunc(smtpAutoMechanisms, func(m SmtpAuth) bool {
+		return slices.Contains(advertised, string(m)) && !slices.Contains(rejected, m)
+	}) {
+		delete(a.rejected, key)
+		rejected = nil
+	}
+
+	for _, method := range smtpAutoMechanisms {
+		if slices.Contains(advertised, string(method)) && !slices.Contains(rejected, method) {
+			a.chosen[key] = method
+			return method
+		}
+	}
+
+	return SmtpAuthPlain
+}
+
+// reject evicts the mechanism the server doesn't support, so that
+// the next strongest one is chosen on the next connection.
+func (a *authCache) reject(key string, method SmtpAuth) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.chosen[key] == method {
+		delete(a.chosen, key)
+	}
+	if !slices.Contains(a.rejected[key], method) {
+		a.rejected[key] = append(a.rejected[key], method)
+	}
+}
+
+// authCacheKey returns the AUTO auth cache key of the client server and user.
+func (c SmtpClient) authCacheKey() string {
+	return c.address() + " " + c.Username
+}
+
+// isAuthMechanismUnsupported reports whether the error is the server
+// rejection of the auth mechanism itself (504), rather than of the
+// credentials (eg. 535), which must not downgrade the mechanism.
+func isAuthMechanismUnsupported(err error) bool {
+	var tpErr *textproto.Error
+
+	return errors.As(err, &tpErr) && tpErr.Code == 504
+}
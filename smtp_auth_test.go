@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestAuthCacheNegotiate(t *testing.T) {
+	cache := &authCache{chosen: map[string]SmtpAuth{}, rejected: map[string][]SmtpAuth{}}
+
+	scenarios := []struct {
+		params   string
+		reject   SmtpAuth
+		expected SmtpAuth
+	}{
+		{"LOGIN PLAIN CRAM-MD5", "", SmtpAuthCramMD5},
+		{"LOGIN PLAIN CRAM-MD5", SmtpAuthCramMD5, SmtpAuthPlain},
+		{"LOGIN PLAIN CRAM-MD5", SmtpAuthPlain, SmtpAuthLogin},
+		{"LOGIN PLAIN CRAM-MD5", SmtpAuthLogin, SmtpAuthCramMD5}, // all rejected, start over
+		{"login", "", SmtpAuthLogin},
+		{"", "", SmtpAuthPlain},
+	}
+
+	for i, s := range scenarios {
+		if s.reject != "" {
+			cache.reject("smtp.example.com:587 test", s.reject)
+		}
+		if method := cache.negotiate("smtp.example.com:587 test", s.params); method != s.expected {
+			t.Errorf("[%d] Expected %s to be chosen of %q, got %s", i, s.expected, s.params, method)
+		}
+	}
+
+	if method := cache.negotiate("other.example.com:587 test", "PLAIN CRAM-MD5"); method != SmtpAuthCramMD5 {
+		t.Fatalf("Expected the cache to be per server, got %s", method)
+	}
+}
+
+func TestIsAuthMechanismUnsupported(t *testing.T) {
+	scenarios := []struct {
+		err      error
+		expected bool
+	}{
+		{&textproto.Error{Code: 504, Msg: "5.5.4 Unrecognized authentication type"}, true},
+		{fmt.Errorf("auth: %w", &textproto.Error{Code: 504}), true},
+		{&textproto.Error{Code: 535, Msg: "5.7.8 Authentication credentials invalid"}, false},
+		{&textproto.Error{Code: 534, Msg: "5.7.9 Authentication mechanism is too weak"}, false},
+		{fmt.Errorf("connection reset"), false},
+	}
+
+	for i, s := range scenarios {
+		if unsupported := isAuthMechanismUnsupported(s.err); unsupported != s.expected {
+			t.Errorf("[%d] Expected %v for %v, got %v", i, s.expected, s.err, unsupported)
+		}
+	}
+}
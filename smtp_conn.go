@@ -0,0 +1,428 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpConn is a single (optionally pooled) authenticated SMTP connection.
+type smtpConn struct {
+	conn      net.Conn
+	client    *smtp.Client
+	recorder  *transcriptConn // the transcript recorder (debug mode only)
+	idleSince time.Time       // when the connection was returned to the pool
+	checkedAt time.Time       // when the connection was last checked by the pool keep-alive
+}
+
+// errSmtpConnLost wraps the I/O errors of the transaction first command,
+// ie. the connection was dropped before anything was sent.
+var errSmtpConnLost = errors.New("smtp: connection lost")
+
+// close closes the connection without waiting for the server QUIT reply.
+func (sc *smtpConn) close() error {
+	return sc.client.Close()
+}
+
+// quit gracefully ends the SMTP session.
+func (sc *smtpConn) quit() error {
+	if err := sc.client.Quit(); err != nil {
+		sc.client.Close()
+		return err
+	}
+
+	return nil
+}
+
+// noop checks that the connection is still alive within the timeout (if any).
+func (sc *smtpConn) noop(timeout time.Duration) error {
+	if timeout <= 0 || timeout > smtpNoopTimeout {
+		timeout = smtpNoopTimeout
+	}
+	if err := sc.extendDeadline(timeout); err != nil {
+		return err
+	}
+
+	return sc.client.Noop()
+}
+
+// extendDeadline sets the connection deadline to now+timeout (if any).
+func (sc *smtpConn) extendDeadline(timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+
+	return sc.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// transmit sends a single message over the connection,
+// returning the final response of the server to its data.
+func (sc *smtpConn) transmit(from string, to []string, raw []byte) (SendResult, error) {
+	if err := sc.client.Mail(from); err != nil {
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) {
+			return SendResult{}, fmt.Errorf("%w: %w", errSmtpConnLost, err)
+		}
+		return SendResult{}, err
+	}
+
+	for _, addr := range to {
+		if err := sc.client.Rcpt(addr); err != nil {
+			return SendResult{}, err
+		}
+	}
+
+	// the DATA command is issued directly, since the net/smtp
+	// data writer discards the final response of the server
+	text := sc.client.Text
+
+	id, err := text.Cmd("DATA")
+	if err != nil {
+		return SendResult{}, err
+	}
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(354)
+	text.EndResponse(id)
+	if err != nil {
+		return SendResult{}, err
+	}
+
+	// the dot writer is buffered already
+	w := text.DotWriter()
+	if _, err := w.Write(raw); err != nil {
+		return SendResult{}, err
+	}
+	if err := w.Close(); err != nil {
+		return SendResult{}, err
+	}
+
+	code, msg, err := text.ReadResponse(250)
+	if err != nil {
+		return SendResult{}, err
+	}
+
+	return parseSendResult(code, msg), nil
+}
+
+// tlsConfig returns the TLS config of the connections.
+func (c SmtpClient) tlsConfig() *tls.Config {
+	if c.TLSConfig == nil {
+		return &tls.Config{ServerName: c.Host}
+	}
+
+	config := c.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = c.Host
+	}
+
+	return config
+}
+
+// dial opens a new SMTP connection to the first available relay (see
+// [SmtpClient.Hosts]), each one dialed within HostTimeout.
+//
+// The dialogue is recorded in the transcript (if any).
+func (c SmtpClient) dial(ctx context.Context, transcript *smtpTranscript) (*smtpConn, error) {
+	relays, err := c.relays(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(relays) == 1 {
+		c.Host, c.Port = relays[0].host, relays[0].port
+		return c.dialRelay(ctx, transcript)
+	}
+
+	var errs []error
+	for _, relay := range relays {
+		rc := c
+		rc.Host, rc.Port = relay.host, relay.port
+		if c.HostTimeout > 0 {
+			rc.Timeout = c.HostTimeout
+		}
+
+		sc, err := rc.dialRelay(ctx, transcript)
+		if err == nil {
+			return sc, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", rc.address(), err))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dialRelay opens a new SMTP connection to the client host, upgrading it
+// with STARTTLS (when supported) and authenticating with the configured
+// credentials.
+//
+// The dialogue is recorded in the transcript (if any).
+func (c SmtpClient) dialRelay(ctx context.Context, transcript *smtpTranscript) (*smtpConn, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	conn, err := c.dialHost(ctx, c.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if c.Tls {
+		conn = tls.Client(conn, c.tlsConfig())
+	}
+
+	var recorder *transcriptConn
+	if transcript != nil {
+		recorder = &transcriptConn{Conn: conn, transcript: transcript, tls: c.Tls}
+		conn = recorder
+	}
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sc := &smtpConn{conn: conn, client: client, recorder: recorder}
+
+	if !c.Tls {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if recorder != nil {
+				client, err = c.startTLS(client, recorder)
+			} else {
+				err = client.StartTLS(c.tlsConfig())
+			}
+			if err != nil {
+				sc.close()
+				return nil, err
+			}
+			sc.client = client
+		}
+	}
+
+	auto := SmtpAuth(strings.ToUpper(string(c.AuthMethod))) == SmtpAuthAuto
+	if auto {
+		_, params := client.Extension("AUTH")
+		c.AuthMethod = smtpAuthCache.negotiate(c.authCacheKey(), params)
+	}
+
+	smtpAuth, creds, err := c.auth(ctx)
+	if err != nil {
+		sc.close()
+		return nil, err
+	}
+	if smtpAuth != nil {
+		if recorder != nil && recorder.tls {
+			smtpAuth = smtpTLSAuth{smtpAuth}
+		}
+		if err := client.Auth(smtpAuth); err != nil {
+			if auto && isAuthMechanismUnsupported(err) {
+				smtpAuthCache.reject(c.authCacheKey(), c.AuthMethod)
+			}
+			sc.close()
+			// the provider credentials are not known to the client redactError
+			return nil, redactError(err, credentialSecrets(creds)...)
+		}
+	}
+
+	return sc, nil
+}
+
+// -------------------------------------------------------------------
+// Connections pool
+// -------------------------------------------------------------------
+
+const (
+	// smtpNoopTimeout is the max time of the pooled connections NOOP check.
+	smtpNoopTimeout = 10 * time.Second
+
+	// smtpNoopAfter is the idle time after which the pooled connections are
+	// checked with NOOP before reuse, so that the busy ones are not slowed down.
+	smtpNoopAfter = time.Second
+
+	// defaultPoolIdleTimeout is the default max idle time of the pooled
+	// connections, shorter than the usual server timeout (5 minutes).
+	defaultPoolIdleTimeout = 4 * time.Minute
+)
+
+// smtpPool keeps a limited number of idle SMTP connections for reuse.
+type smtpPool struct {
+	mu     sync.Mutex
+	size   int
+	idle   []*smtpConn
+	closed bool
+	done   chan struct{}
+}
+
+func newSmtpPool(size int) *smtpPool {
+	return &smtpPool{size: size, done: make(chan struct{})}
+}
+
+// pooled returns a live idle connection of the pool (if any), closing the
+// ones idle for longer than PoolIdleTimeout and the stale ones, which fail
+// the NOOP check (eg. dropped by the server after a long idle period).
+//
+// The NOOP check is recorded in the transcript (if any).
+func (c SmtpClient) pooled(transcript *smtpTranscript) *smtpConn {
+	if c.pool == nil {
+		return nil
+	}
+
+	for {
+		sc := c.pool.get()
+		if sc == nil {
+			return nil
+		}
+		if sc.recorder != nil {
+			sc.recorder.transcript = transcript
+		}
+
+		idle := time.Since(sc.idleSince)
+		if idle > c.poolIdleTimeout() {
+			sc.close()
+			continue
+		}
+		if idle >= smtpNoopAfter {
+			if err := sc.noop(c.Timeout); err != nil {
+				sc.close()
+				continue
+			}
+		}
+
+		return sc
+	}
+}
+
+// poolIdleTimeout returns the max idle time of the pooled connections.
+func (c SmtpClient) poolIdleTimeout() time.Duration {
+	if c.PoolIdleTimeout > 0 {
+		return c.PoolIdleTimeout
+	}
+
+	return defaultPoolIdleTimeout
+}
+
+// keepAlive sends NOOP to the idle connections every interval until the pool
+// is closed, so that the servers don't drop them, and closes the stale ones
+// and the ones idle for longer than idleTimeout.
+//
+// The connections are checked one at a time, the other ones staying
+// available to the sends meanwhile.
+func (p *smtpPool) keepAlive(interval, idleTimeout, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var round time.Time
+		select {
+		case <-p.done:
+			return
+		case round = <-ticker.C:
+		}
+
+		for sc := p.unchecked(round); sc != nil; sc = p.unchecked(round) {
+			if sc.recorder != nil {
+				sc.recorder.transcript = nil
+			}
+			if time.Since(sc.idleSince) > idleTimeout {
+				sc.quit()
+				continue
+			}
+			if err := sc.noop(timeout); err != nil {
+				sc.close()
+				continue
+			}
+			sc.checkedAt = time.Now()
+			p.restore(sc)
+		}
+	}
+}
+
+// unchecked takes out of the pool the oldest idle connection not used
+// nor checked since the keep-alive round started (if any).
+func (p *smtpPool) unchecked(round time.Time) *smtpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, sc := range p.idle {
+		if sc.idleSince.Before(round) && sc.checkedAt.Before(round) {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return sc
+		}
+	}
+
+	return nil
+}
+
+// get returns an idle connection (if any).
+func (p *smtpPool) get() *smtpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := len(p.idle); n > 0 {
+		sc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return sc
+	}
+
+	return nil
+}
+
+// put returns the connection to the pool or closes it if the pool is full or closed.
+func (p *smtpPool) put(sc *smtpConn) {
+	sc.idleSince = time.Now()
+	p.restore(sc)
+}
+
+// restore returns the connection to the pool keeping its idle time,
+// or closes it if the pool is full or closed.
+func (p *smtpPool) restore(sc *smtpConn) {
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.size {
+		p.idle = append(p.idle, sc)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	sc.quit()
+}
+
+// close closes all idle connections and prevents new ones from being pooled.
+func (p *smtpPool) close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, sc := range idle {
+		if err := sc.quit(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,291 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AddressFamily is the IP address family preference of the SMTP
+// connections to the hosts having both AAAA and A records.
+type AddressFamily string
+
+const (
+	// AddressFamilyAuto dials the addresses in the resolver order (usually
+	// IPv6 first), falling back to the other family (the default).
+	AddressFamilyAuto AddressFamily = "auto"
+
+	// AddressFamilyPreferIPv4 dials the IPv4 addresses first, falling back to IPv6.
+	AddressFamilyPreferIPv4 AddressFamily = "prefer_ipv4"
+
+	// AddressFamilyPreferIPv6 dials the IPv6 addresses first, falling back to IPv4.
+	AddressFamilyPreferIPv6 AddressFamily = "prefer_ipv6"
+
+	// AddressFamilyIPv4 dials the IPv4 addresses only.
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+
+	// AddressFamilyIPv6 dials the IPv6 addresses only.
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+)
+
+// defaultFallbackDelay is the delay of the fallback family dial, as recommended by RFC 8305.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// minDialAttempt is the minimum time given to every dialed address of a host.
+const minDialAttempt = 2 * time.Second
+
+func (f AddressFamily) validate() error {
+	switch f {
+	case "", AddressFamilyAuto, AddressFamilyPreferIPv4, AddressFamilyPreferIPv6, AddressFamilyIPv4, AddressFamilyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("unsupported address family %q, expected %q, %q, %q, %q or %q", f, AddressFamilyAuto, AddressFamilyPreferIPv4, AddressFamilyPreferIPv6, AddressFamilyIPv4, AddressFamilyIPv6)
+	}
+}
+
+// dialHost opens the TCP connection to the host, racing the address families
+// as described by RFC 8305 (happy eyeballs): the addresses of the preferred
+// family are dialed first and those of the other one after the fallback
+// delay, so that a broken IPv6 route doesn't hang the sends.
+func (c SmtpClient) dialHost(ctx context.Context, host string) (net.Conn, error) {
+	port := strconv.Itoa(c.Port)
+
+	var dialer net.Dialer
+
+	if ip := net.ParseIP(host); ip != nil {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+
+	addrs, err := defaultResolver(c.Resolver).LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	primaries, fallbacks := c.AddressFamily.partition(addrs)
+	if len(primaries) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+
+	delay := c.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	return dialParallel(ctx, &dialer, primaries, fallbacks, port, delay)
+}
+
+// partition splits the addresses into the preferred family ones
+// and the fallback family ones, keeping the resolver order.
+func (f AddressFamily) partition(addrs []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	var preferIPv4 bool
+	switch f {
+	case AddressFamilyPreferIPv4, AddressFamilyIPv4:
+		preferIPv4 = true
+	case AddressFamilyPreferIPv6, AddressFamilyIPv6:
+		preferIPv4 = false
+	default:
+		preferIPv4 = addrs[0].IP.To4() != nil
+	}
+
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == preferIPv4 {
+			primaries = append(primaries, addr)
+		} else if f != AddressFamilyIPv4 && f != AddressFamilyIPv6 {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	return primaries, fallbacks
+}
+
+// dialParallel dials the primary addresses, starting the fallback ones after
+// the delay (or as soon as the primary ones failed), returning the first
+// established connection. A negative delay disables the fallback race.
+func dialParallel(ctx context.Context, dialer *net.Dialer, primaries, fallbacks []net.IPAddr, port string, delay time.Duration) (net.Conn, error) {
+	if len(fallbacks) == 0 || delay < 0 {
+		return dialSerial(ctx, dialer, append(primaries, fallbacks...), port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	results := make(chan dialResult, 2)
+	start := func(addrs []net.IPAddr, primary bool) {
+		go func() {
+			conn, err := dialSerial(ctx, dialer, addrs, port)
+			results <- dialResult{conn, err, primary}
+		}()
+	}
+
+	start(primaries, true)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending, fallbackStarted := 1, false
+	var primaryErr, fallbackErr error
+
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks, false)
+			}
+		case r := <-results:
+			pending--
+
+			if r.err == nil {
+				// close the other connection, if established meanwhile
+				if pending > 0 {
+					go func() {
+						if other := <-results; other.conn != nil {
+							other.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+
+			if r.primary {
+				primaryErr = r.err
+			} else {
+				fallbackErr = r.err
+			}
+
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks, false)
+			} else if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// dialSerial dials the addresses in order, giving every one of them
+// a share of the time left (as [net.Dialer] does), so that a single
+// unresponsive address doesn't consume the whole timeout.
+func dialSerial(ctx context.Context, dialer *net.Dialer, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var firstErr error
+
+	for i, addr := range addrs {
+		if err := ctx.Err(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			break
+		}
+
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(addrs)-1 {
+			timeout := time.Until(deadline) / time.Duration(len(addrs)-i)
+			if timeout < minDialAttempt {
+				timeout = minDialAttempt
+			}
+			dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		conn, err := dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(addr.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// smtpRelay is a host of the relays tried in order.
+type smtpRelay struct {
+	host string
+	port int
+}
+
+// relays returns the relays to try in order, ie. Host (or its MX hosts,
+// if MX is enabled) followed by Hosts, without duplicates.
+func (c SmtpClient) relays(ctx context.Context) ([]smtpRelay, error) {
+	var relays []smtpRelay
+
+	add := func(relay smtpRelay) {
+		for _, r := range relays {
+			if strings.EqualFold(r.host, relay.host) && r.port == relay.port {
+				return
+			}
+		}
+		relays = append(relays, relay)
+	}
+
+	if c.MX && c.Host != "" {
+		mxs, err := defaultResolver(c.Resolver).LookupMX(ctx, c.Host)
+		if err != nil && !isNotFound(err) {
+			return nil, fmt.Errorf("smtp: failed to resolve the MX hosts of %s: %w", c.Host, err)
+		}
+
+		// the records are sorted by preference already
+		for _, mx := range mxs {
+			if host := strings.TrimSuffix(mx.Host, "."); host != "" {
+				add(smtpRelay{host, c.Port})
+			}
+		}
+	}
+
+	// the host is its own MX without any record (RFC 5321 section 5.1)
+	if c.Host != "" && len(relays) == 0 {
+		add(smtpRelay{c.Host, c.Port})
+	}
+
+	for _, host := range c.Hosts {
+		relay, err := c.parseRelay(host)
+		if err != nil {
+			return nil, err
+		}
+		add(relay)
+	}
+
+	return relays, nil
+}
+
+// parseRelay parses the "host" or "host:port" relay, default to the client port.
+func (c SmtpClient) parseRelay(s string) (smtpRelay, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// without port (including the bare IPv6 addresses)
+		return smtpRelay{strings.Trim(s, "[]"), c.Port}, nil
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return smtpRelay{}, fmt.Errorf("smtp: invalid port of the host %q", s)
+	}
+
+	return smtpRelay{host, n}, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
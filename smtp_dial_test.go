@@ -0,0 +1,125 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAddressFamilyPartition(t *testing.T) {
+	addrs := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::2")}}
+
+	scenarios := []struct {
+		family               AddressFamily
+		primaries, fallbacks int
+		primary              string
+	}{
+		{"", 2, 1, "2001:db8::1"},
+		{AddressFamilyPreferIPv4, 1, 2, "192.0.2.1"},
+		{AddressFamilyPreferIPv6, 2, 1, "2001:db8::1"},
+		{AddressFamilyIPv4, 1, 0, "192.0.2.1"},
+		{AddressFamilyIPv6, 2, 0, "2001:db8::1"},
+	}
+
+	for _, s := range scenarios {
+		primaries, fallbacks := s.family.partition(addrs)
+		if len(primaries) != s.primaries || len(fallbacks) != s.fallbacks || primaries[0].String() != s.primary {
+			t.Errorf("[%s] Expected %d primaries starting with %s and %d fallbacks, got %v and %v", s.family, s.primaries, s.primary, s.fallbacks, primaries, fallbacks)
+		}
+	}
+
+	if err := AddressFamily("ipv5").validate(); err == nil {
+		t.Fatal("Expected the unsupported address family error")
+	}
+}
+
+func TestSmtpClientDialHostFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	client := SmtpClient{
+		Port:          ln.Addr().(*net.TCPAddr).Port,
+		AddressFamily: AddressFamilyPreferIPv6,
+		FallbackDelay: 50 * time.Millisecond,
+		Resolver: fakeResolver{ips: map[string][]net.IPAddr{
+			// an unreachable IPv6 address (the discard prefix), followed by the reachable IPv4 one
+			"relay.example.com": {{IP: net.ParseIP("100::1")}, {IP: net.ParseIP("127.0.0.1")}},
+			"v6.example.com":    {{IP: net.ParseIP("100::1")}},
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := client.dialHost(ctx, "relay.example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	conn.Close()
+
+	if port := strconv.Itoa(client.Port); conn.RemoteAddr().String() != "127.0.0.1:"+port {
+		t.Fatalf("Expected the IPv4 fallback connection, got %s", conn.RemoteAddr())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the fallback not to wait for the unreachable address, took %s", elapsed)
+	}
+
+	client.AddressFamily = AddressFamilyIPv4
+	if _, err := client.dialHost(ctx, "v6.example.com"); err == nil {
+		t.Fatal("Expected the no suitable address error")
+	}
+}
+
+func TestSmtpClientRelays(t *testing.T) {
+	client := SmtpClient{
+		Host:  "example.com",
+		Port:  587,
+		Hosts: []string{"backup.example.com:2525", "[2001:db8::1]", "MX1.example.com"},
+		MX:    true,
+		Resolver: fakeResolver{mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+		}},
+	}
+
+	relays, err := client.relays(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []smtpRelay{{"mx1.example.com", 587}, {"mx2.example.com", 587}, {"backup.example.com", 2525}, {"2001:db8::1", 587}}
+	if len(relays) != len(expected) {
+		t.Fatalf("Expected the relays %v, got %v", expected, relays)
+	}
+	for i := range expected {
+		if relays[i] != expected[i] {
+			t.Fatalf("Expected the relays %v, got %v", expected, relays)
+		}
+	}
+
+	// the host without MX records is its own MX
+	client.Host, client.Hosts = "smtp.example.com", nil
+	if relays, err := client.relays(context.Background()); err != nil || len(relays) != 1 || relays[0].host != "smtp.example.com" {
+		t.Fatalf("Expected the host relay, got %v (%v)", relays, err)
+	}
+
+	client.Hosts = []string{"relay.example.com:0"}
+	if err := client.Validate(); err == nil {
+		t.Fatal("Expected the invalid host port error")
+	}
+}
@@ -0,0 +1,171 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"sync"
+)
+
+// GSSAPIConfig configures the Kerberos credentials of the GSSAPI
+// authentication (see [GSSAPIProvider]). The zero value uses the
+// default credential cache of the process user.
+type GSSAPIConfig struct {
+	// Service is the server principal name (default to "smtp@{host}").
+	Service string `mapstructure:"service" json:"service,omitempty" bson:"service,omitempty"`
+
+	// Principal is the client principal name (eg. "mailer@EXAMPLE.COM"),
+	// default to the keytab or credential cache one.
+	Principal string `mapstructure:"principal" json:"principal,omitempty" bson:"principal,omitempty"`
+
+	// Keytab is the path of the keytab used to acquire the credentials
+	// (eg. "/etc/krb5.keytab"), instead of the credential cache.
+	Keytab string `mapstructure:"keytab" json:"keytab,omitempty" bson:"keytab,omitempty"`
+
+	// CCache is the path of the credential cache (default to $KRB5CCNAME).
+	CCache string `mapstructure:"ccache" json:"ccache,omitempty" bson:"ccache,omitempty"`
+}
+
+// GSSAPIProvider creates the Kerberos security contexts of the GSSAPI
+// authentication (RFC 4752), eg. an adapter of a Kerberos library.
+type GSSAPIProvider interface {
+	// NewSecContext creates a new security context initiated with the config service.
+	NewSecContext(ctx context.Context, config GSSAPIConfig) (GSSAPIContext, error)
+}
+
+// GSSAPIContext is a client Kerberos security context.
+type GSSAPIContext interface {
+	// Step processes the server token (nil at first), returning the token to
+	// send (if any) and whether the security context is established.
+	Step(token []byte) (out []byte, established bool, err error)
+
+	// Wrap seals the message with the established context (without encryption).
+	Wrap(msg []byte) ([]byte, error)
+
+	// Unwrap verifies the server token, returning its message.
+	Unwrap(token []byte) ([]byte, error)
+}
+
+var (
+	gssapiMu       sync.RWMutex
+	gssapiProvider GSSAPIProvider
+)
+
+// RegisterGSSAPIProvider sets the default provider of the GSSAPI
+// authentication, used by the clients without their own.
+//
+// It is intended to be called from the init function of the package
+// providing the Kerberos implementation, so that it could be selected
+// with the "auth: GSSAPI" option of the plugin configuration.
+func RegisterGSSAPIProvider(provider GSSAPIProvider) {
+	gssapiMu.Lock()
+	defer gssapiMu.Unlock()
+
+	gssapiProvider = provider
+}
+
+// gssapi returns the client GSSAPI provider, or the registered one.
+func (c SmtpClient) gssapi() GSSAPIProvider {
+	if c.GSSAPI != nil {
+		return c.GSSAPI
+	}
+
+	gssapiMu.RLock()
+	defer gssapiMu.RUnlock()
+
+	return gssapiProvider
+}
+
+// gssapiAuth creates the GSSAPI auth of a new security context.
+func (c SmtpClient) gssapiAuth(ctx context.Context) (smtp.Auth, error) {
+	provider := c.gssapi()
+	if provider == nil {
+		return nil, errors.New("smtp: GSSAPI auth requires a Kerberos provider (see RegisterGSSAPIProvider)")
+	}
+
+	config := c.Kerberos
+	if config.Service == "" {
+		config.Service = "smtp@" + c.Host
+	}
+
+	sec, err := provider.NewSecContext(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: failed to acquire the Kerberos credentials: %w", err)
+	}
+
+	return &smtpGSSAPIAuth{sec: sec}, nil
+}
+
+// -------------------------------------------------------------------
+// AUTH GSSAPI
+// -------------------------------------------------------------------
+
+var _ smtp.Auth = (*smtpGSSAPIAuth)(nil)
+
+// gssapiNoSecurityLayer is the RFC 4752 bit of the "no security layer" option,
+// the only one supported since the connection is protected by TLS (if any).
+const gssapiNoSecurityLayer = 0x01
+
+// smtpGSSAPIAuth defines an AUTH that implements the GSSAPI (Kerberos V5)
+// mechanism used by the enterprise relays, without any password.
+//
+// Unlike the LOGIN auth, no secret is sent, so the unencrypted connections
+// are allowed.
+type smtpGSSAPIAuth struct {
+	sec         GSSAPIContext
+	established bool
+}
+
+// Start initializes an authentication with the server, sending the initial context token.
+//
+// It is part of the [smtp.Auth] interface.
+func (a *smtpGSSAPIAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	token, established, err := a.sec.Step(nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("gssapi: %w", err)
+	}
+	a.established = established
+
+	return "GSSAPI", token, nil
+}
+
+// Next "continues" the auth process by completing the security context
+// and then negotiating the security layer with the server.
+//
+// It is part of the [smtp.Auth] interface.
+func (a *smtpGSSAPIAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	if !a.established {
+		token, established, err := a.sec.Step(fromServer)
+		if err != nil {
+			return nil, fmt.Errorf("gssapi: %w", err)
+		}
+		a.established = established
+
+		// the server expects a response (even empty) to every challenge
+		return append([]byte{}, token...), nil
+	}
+
+	msg, err := a.sec.Unwrap(fromServer)
+	if err != nil {
+		return nil, fmt.Errorf("gssapi: %w", err)
+	}
+	if len(msg) != 4 {
+		return nil, fmt.Errorf("gssapi: invalid security layer message of %d bytes", len(msg))
+	}
+	if msg[0]&gssapiNoSecurityLayer == 0 {
+		return nil, errors.New("gssapi: the server requires an unsupported security layer")
+	}
+
+	// no security layer, no max message size and the authenticated identity
+	resp, err := a.sec.Wrap([]byte{gssapiNoSecurityLayer, 0, 0, 0})
+	if err != nil {
+		return nil, fmt.Errorf("gssapi: %w", err)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"net/smtp"
+	"testing"
+)
+
+type testGSSAPIContext struct {
+	steps int
+}
+
+func (c *testGSSAPIContext) Step(token []byte) ([]byte, bool, error) {
+	c.steps++
+	if c.steps == 1 {
+		return []byte("ap-req"), false, nil
+	}
+
+	return nil, string(token) == "ap-rep", nil
+}
+
+func (c *testGSSAPIContext) Wrap(msg []byte) ([]byte, error) {
+	return append([]byte("wrapped:"), msg...), nil
+}
+
+func (c *testGSSAPIContext) Unwrap(token []byte) ([]byte, error) {
+	return bytes.TrimPrefix(token, []byte("wrapped:")), nil
+}
+
+type testGSSAPIProvider struct {
+	config GSSAPIConfig
+}
+
+func (p *testGSSAPIProvider) NewSecContext(_ context.Context, config GSSAPIConfig) (GSSAPIContext, error) {
+	p.config = config
+
+	return &testGSSAPIContext{}, nil
+}
+
+func TestGSSAPIAuth(t *testing.T) {
+	client := SmtpClient{Host: "mail.example.com", Port: 25, AuthMethod: "gssapi"}
+	if err := client.Validate(); err == nil {
+		t.Fatal("Expected the missing Kerberos provider error")
+	}
+
+	provider := &testGSSAPIProvider{}
+	client.GSSAPI = provider
+	client.Kerberos.Keytab = "/etc/krb5.keytab"
+	if err := client.Validate(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	auth, _, err := client.auth(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.config.Service != "smtp@mail.example.com" || provider.config.Keytab != "/etc/krb5.keytab" {
+		t.Fatalf("Expected the default service and the keytab config, got %+v", provider.config)
+	}
+
+	method, token, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "GSSAPI" || string(token) != "ap-req" {
+		t.Fatalf("Expected the GSSAPI initial token, got %s %q", method, token)
+	}
+
+	if resp, err := auth.Next([]byte("ap-rep"), true); err != nil || resp == nil || len(resp) != 0 {
+		t.Fatalf("Expected the empty response to the last context token, got %q (%v)", resp, err)
+	}
+
+	if _, err := auth.Next([]byte("wrapped:\x04\x00\x10\x00"), true); err == nil {
+		t.Fatal("Expected the unsupported security layer error")
+	}
+
+	resp, err := auth.Next([]byte("wrapped:\x07\x00\x10\x00"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "wrapped:\x01\x00\x00\x00" {
+		t.Fatalf("Expected the no security layer response, got %q", resp)
+	}
+}
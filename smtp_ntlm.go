@@ -0,0 +1,277 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/smtp"
+	"strings"
+	"unicode/utf16"
+)
+
+// -------------------------------------------------------------------
+// AUTH NTLM
+// -------------------------------------------------------------------
+
+var _ smtp.Auth = (*smtpNTLMAuth)(nil)
+
+const (
+	ntlmNegotiateUnicode    = 0x00000001
+	ntlmNegotiateOEM        = 0x00000002
+	ntlmRequestTarget       = 0x00000004
+	ntlmNegotiateNTLM       = 0x00000200
+	ntlmNegotiateAlwaysSign = 0x00008000
+	ntlmNegotiateExtended   = 0x00080000 // extended session security
+	ntlmNegotiateTargetInfo = 0x00800000
+	ntlmNegotiate128        = 0x20000000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtended | ntlmNegotiateTargetInfo | ntlmNegotiate128
+
+	ntlmAvEOL       = 0 // the target info list terminator
+	ntlmAvTimestamp = 7 // the server FILETIME
+
+	// ntlmEpochOffset is the number of 100ns intervals between 1601-01-01 (the FILETIME epoch) and the unix epoch.
+	ntlmEpochOffset = 116444736000000000
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// smtpNTLMAuth defines an AUTH that implements the NTLM (NTLMv2) mechanism
+// required by the on-premise Exchange servers not allowing PLAIN or LOGIN.
+//
+// The username is in the "DOMAIN\user" form (or "user@domain.local",
+// leaving the domain to the server).
+//
+// Similar to the LOGIN auth, the response is sent only over TLS or to localhost.
+type smtpNTLMAuth struct {
+	username, password string
+
+	clock     Clock
+	challenge func() []byte // the client challenge, random by default
+}
+
+// Start initializes an authentication with the server, sending the NTLM negotiate message.
+//
+// It is part of the [smtp.Auth] interface.
+func (a *smtpNTLMAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+
+	return "NTLM", msg, nil
+}
+
+// Next "continues" the auth process by answering the server challenge
+// message with the NTLM authenticate message.
+//
+// It is part of the [smtp.Auth] interface.
+func (a *smtpNTLMAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	if len(fromServer) < 32 || !bytes.Equal(fromServer[:8], ntlmSignature) || binary.LittleEndian.Uint32(fromServer[8:]) != 2 {
+		return nil, errors.New("ntlm: invalid challenge message")
+	}
+
+	flags := binary.LittleEndian.Uint32(fromServer[20:])
+	serverChallenge := fromServer[24:32]
+
+	var targetInfo []byte
+	if len(fromServer) >= 48 {
+		var ok bool
+		if targetInfo, ok = ntlmPayload(fromServer, 40); !ok {
+			return nil, errors.New("ntlm: invalid challenge target info")
+		}
+	}
+
+	domain, user := "", a.username
+	if i := strings.IndexByte(a.username, '\\'); i >= 0 {
+		domain, user = a.username[:i], a.username[i+1:]
+	}
+
+	clientChallenge := make([]byte, 8)
+	if a.challenge != nil {
+		copy(clientChallenge, a.challenge())
+	} else if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, fmt.Errorf("ntlm: %w", err)
+	}
+
+	// the server timestamp is preferred to the local one, in which case
+	// the LMv2 response must not be sent (see MS-NLMP 3.1.5.1.2)
+	timestamp, serverTime := ntlmTimestamp(targetInfo)
+	if !serverTime {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(now(a.clock).UnixNano()/100+ntlmEpochOffset))
+	}
+
+	key := ntowfv2(user, a.password, domain)
+	ntResponse, lmResponse := ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo)
+	if serverTime {
+		lmResponse = make([]byte, 24)
+	}
+
+	encode := func(s string) []byte {
+		if flags&ntlmNegotiateUnicode != 0 {
+			return utf16le(s)
+		}
+		return []byte(s)
+	}
+
+	payloads := [][]byte{lmResponse, ntResponse, encode(domain), encode(user), encode(""), nil}
+
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	binary.LittleEndian.PutUint32(msg[60:], flags&ntlmNegotiateFlags)
+
+	for i, payload := range payloads {
+		offset := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[offset:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(msg[offset+2:], uint16(len(payload)))
+		binary.LittleEndian.PutUint32(msg[offset+4:], uint32(len(msg)))
+		msg = append(msg, payload...)
+	}
+
+	return msg, nil
+}
+
+// ntlmPayload returns the message payload referenced by the security buffer at offset.
+func ntlmPayload(msg []byte, offset int) ([]byte, bool) {
+	size := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if size == 0 {
+		return nil, true
+	}
+	if start < 0 || start+size > len(msg) {
+		return nil, false
+	}
+
+	return msg[start : start+size], true
+}
+
+// ntlmTimestamp returns the server timestamp of the challenge target info (if any).
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		size := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAvEOL || 4+size > len(targetInfo) {
+			break
+		}
+		if id == ntlmAvTimestamp && size == 8 {
+			return targetInfo[4:12], true
+		}
+		targetInfo = targetInfo[4+size:]
+	}
+
+	return nil, false
+}
+
+// ntowfv2 returns the NTLMv2 response key of the credentials.
+func ntowfv2(user, password, domain string) []byte {
+	hash := md4Sum(utf16le(password))
+
+	return hmacMD5(hash[:], utf16le(strings.ToUpper(user)+domain))
+}
+
+// ntlmv2Response returns the NTLMv2 and LMv2 responses to the server challenge.
+func ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm []byte) {
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	proof := hmacMD5(key, append(append([]byte{}, serverChallenge...), blob...))
+	lm = hmacMD5(key, append(append([]byte{}, serverChallenge...), clientChallenge...))
+
+	return append(proof, blob...), append(lm, clientChallenge...)
+}
+
+func hmacMD5(key, data []byte) []byte {
+	h := hmac.New(md5.New, key)
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+
+	return b
+}
+
+// md4Sum returns the RFC 1320 MD4 checksum of the data, used by the NT hash
+// (the hash package is deprecated and not part of the standard library).
+func md4Sum(data []byte) [16]byte {
+	size := uint64(len(data)) * 8
+
+	msg := append(append([]byte{}, data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, size)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	var x [16]uint32
+	for len(msg) > 0 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		msg = msg[64:]
+
+		aa, bb, cc, dd := a, b, c, d
+
+		// round 1
+		for _, i := range [4]uint{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+(b&c|^b&d)+x[i], 3)
+			d = bits.RotateLeft32(d+(a&b|^a&c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+(d&a|^d&b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+(c&d|^c&a)+x[i+3], 19)
+		}
+
+		// round 2
+		for i := uint(0); i < 4; i++ {
+			a = bits.RotateLeft32(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+
+		// round 3
+		for _, i := range [4]uint{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	var sum [16]byte
+	binary.LittleEndian.PutUint32(sum[0:], a)
+	binary.LittleEndian.PutUint32(sum[4:], b)
+	binary.LittleEndian.PutUint32(sum[8:], c)
+	binary.LittleEndian.PutUint32(sum[12:], d)
+
+	return sum
+}
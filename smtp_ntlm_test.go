@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net/smtp"
+	"testing"
+)
+
+func TestMD4Sum(t *testing.T) {
+	// RFC 1320 test suite
+	scenarios := map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"a":   "bde52cb31de33e46245e05fbdbd6fb24",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+
+	for data, expected := range scenarios {
+		if sum := md4Sum([]byte(data)); hex.EncodeToString(sum[:]) != expected {
+			t.Errorf("Expected the %q checksum %s, got %x", data, expected, sum)
+		}
+	}
+}
+
+func TestNTLMAuth(t *testing.T) {
+	// MS-NLMP 4.2.4 NTLMv2 authentication test vectors
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+
+	auth := &smtpNTLMAuth{
+		username:  `Domain\User`,
+		password:  "Password",
+		challenge: func() []byte { return bytes.Repeat([]byte{0xaa}, 8) },
+	}
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "example.com"}); err == nil {
+		t.Fatal("Expected the unencrypted connection error")
+	}
+
+	method, negotiate, err := auth.Start(&smtp.ServerInfo{Name: "example.com", TLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "NTLM" || !bytes.HasPrefix(negotiate, []byte("NTLMSSP\x00\x01\x00\x00\x00")) {
+		t.Fatalf("Expected the NTLM negotiate message, got %s %x", method, negotiate)
+	}
+
+	challenge := make([]byte, 48)
+	copy(challenge, "NTLMSSP\x00\x02")
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateFlags)
+	copy(challenge[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(challenge[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	challenge = append(challenge, targetInfo...)
+
+	key := ntowfv2("User", "Password", "Domain")
+	if str := hex.EncodeToString(key); str != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Fatalf("Expected the NTOWFv2 key 0c868a403bfd7a93a3001ef22ef02e3f, got %s", str)
+	}
+
+	nt, lm := ntlmv2Response(key, serverChallenge, bytes.Repeat([]byte{0xaa}, 8), make([]byte, 8), targetInfo)
+	if str := hex.EncodeToString(nt[:16]); str != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Fatalf("Expected the NTProofStr 68cd0ab851e51c96aabc927bebef6a1c, got %s", str)
+	}
+	if str := hex.EncodeToString(lm); str != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Fatalf("Expected the LMv2 response 86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa, got %s", str)
+	}
+
+	authenticate, err := auth.Next(challenge, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := func(offset int) []byte {
+		b, ok := ntlmPayload(authenticate, offset)
+		if !ok {
+			t.Fatalf("Invalid security buffer at %d", offset)
+		}
+		return b
+	}
+	if ntResponse := payload(20); !bytes.Equal(ntResponse[16:24], []byte{1, 1, 0, 0, 0, 0, 0, 0}) || len(ntResponse) != 16+28+len(targetInfo)+4 {
+		t.Fatalf("Expected the NTLMv2 response, got %x", ntResponse)
+	}
+	if domain := payload(28); !bytes.Equal(domain, utf16le("Domain")) {
+		t.Fatalf("Expected the Domain domain, got %x", domain)
+	}
+	if user := payload(36); !bytes.Equal(user, utf16le("User")) {
+		t.Fatalf("Expected the User user, got %x", user)
+	}
+
+	if _, err := auth.Next([]byte("invalid"), true); err == nil {
+		t.Fatal("Expected the invalid challenge error")
+	}
+}
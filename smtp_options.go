@@ -0,0 +1,145 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"io"
+	"time"
+)
+
+// Option configures a [SmtpClient] created with [NewSmtpClient].
+type Option func(c *SmtpClient)
+
+// NewSmtpClient creates a new validated SMTP client for the specified host.
+//
+// Unless changed with the options, the client connects to port 587
+// (or 465 when TLS is enabled) with a 30s timeout and no pooling.
+func NewSmtpClient(host string, opts ...Option) (*SmtpClient, error) {
+	c := &SmtpClient{Host: host}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.applyDefaults()
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// WithPort sets the SMTP server port.
+func WithPort(port int) Option {
+	return func(c *SmtpClient) {
+		c.Port = port
+	}
+}
+
+// WithAuth sets the SMTP authentication method and credentials.
+func WithAuth(method SmtpAuth, username, password string) Option {
+	return func(c *SmtpClient) {
+		c.AuthMethod = method
+		c.Username = username
+		c.Password = password
+	}
+}
+
+// WithCredentials sets a dynamic credentials provider.
+func WithCredentials(provider CredentialsProvider) Option {
+	return func(c *SmtpClient) {
+		c.Credentials = provider
+	}
+}
+
+// WithTLS enables or disables the implicit TLS connection.
+func WithTLS(enabled bool) Option {
+	return func(c *SmtpClient) {
+		c.Tls = enabled
+	}
+}
+
+// WithTLSConfig sets the config of the TLS and STARTTLS connections
+// (eg. trusting a private CA).
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *SmtpClient) {
+		c.TLSConfig = config
+	}
+}
+
+// WithTimeout sets the dial and per message timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *SmtpClient) {
+		c.Timeout = timeout
+	}
+}
+
+// WithPool enables the connections pooling, keeping up to size idle connections.
+func WithPool(size int) Option {
+	return func(c *SmtpClient) {
+		c.PoolSize = size
+	}
+}
+
+// WithPoolKeepAlive sets the max idle time of the pooled connections and
+// the interval of the NOOP keeping them open (0 disables the keep-alive).
+func WithPoolKeepAlive(idleTimeout, keepAlive time.Duration) Option {
+	return func(c *SmtpClient) {
+		c.PoolIdleTimeout = idleTimeout
+		c.PoolKeepAlive = keepAlive
+	}
+}
+
+// WithFrom sets the default message sender.
+func WithFrom(name, address string) Option {
+	return func(c *SmtpClient) {
+		c.From = AddressConfig{Name: name, Address: address}
+	}
+}
+
+// WithBeforeSend registers a hook called before every send.
+func WithBeforeSend(fn func(m *Message) error) Option {
+	return func(c *SmtpClient) {
+		c.BeforeSend = fn
+	}
+}
+
+// WithAfterSend registers a hook called after every send attempt.
+func WithAfterSend(fn func(m *Message, err error)) Option {
+	return func(c *SmtpClient) {
+		c.AfterSend = fn
+	}
+}
+
+// WithTranscript enables the debug mode, calling fn with the
+// SMTP dialogue transcript after every send attempt.
+func WithTranscript(fn func(m *Message, transcript string)) Option {
+	return func(c *SmtpClient) {
+		c.Debug = true
+		c.OnTranscript = fn
+	}
+}
+
+// WithMessageIDGenerator sets a custom Message-ID generator
+// (eg. a deterministic one for tests).
+func WithMessageIDGenerator(fn MessageIDGenerator) Option {
+	return func(c *SmtpClient) {
+		c.MessageIDGenerator = fn
+	}
+}
+
+// WithClock sets the time source used for the Date header
+// and the default Message-ID (eg. a fixed one for tests).
+func WithClock(clock Clock) Option {
+	return func(c *SmtpClient) {
+		c.Clock = clock
+	}
+}
+
+// WithRand sets the randomness source used for the MIME boundaries
+// and the default Message-ID (eg. a seeded one for tests).
+func WithRand(r io.Reader) Option {
+	return func(c *SmtpClient) {
+		c.Rand = r
+	}
+}
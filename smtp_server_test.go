@@ -0,0 +1,595 @@
+package mailer_test
+
+// The tests against the mailertest SMTP server are in the external
+// test package, as mailertest imports the mailer package.
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rumorshub/mailer"
+	"github.com/rumorshub/mailer/mailertest"
+)
+
+// newTestSmtpServer starts a test SMTP server advertising the extra extensions.
+func newTestSmtpServer(t testing.TB, extensions ...string) *mailertest.Server {
+	server := mailertest.NewUnstartedServer()
+	server.Extensions = extensions
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestSmtpClientPing(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client := mailer.SmtpClient{Host: "127.0.0.1", Port: server.Port(), Username: "test", Password: "123456"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if str := strings.Join(server.Commands(), ","); str != "EHLO,AUTH,QUIT" {
+		t.Fatalf("Expected EHLO,AUTH,QUIT commands, got %s", str)
+	}
+}
+
+func TestSmtpClientVerify(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client := mailer.SmtpClient{Host: "127.0.0.1", Port: server.Port(), From: mailer.AddressConfig{Address: "app@example.com"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Verify(ctx, "postmaster@example.com"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if str := strings.Join(server.Commands(), ","); str != "EHLO,MAIL,RCPT,RSET,QUIT" || len(server.Messages()) != 0 {
+		t.Fatalf("Expected EHLO,MAIL,RCPT,RSET,QUIT commands without message, got %s", str)
+	}
+
+	rejecting := mailertest.NewUnstartedServer()
+	rejecting.Replies = map[string]string{"RCPT": "550 5.1.1 No such user"}
+	rejecting.Start()
+	defer rejecting.Close()
+
+	p := &mailer.Plugin{}
+	if err := p.Init(mailer.MapConfig{mailer.PluginName: map[string]any{
+		"smtp":             map[string]any{"host": "127.0.0.1", "port": rejecting.Port()},
+		"verify_on_start":  true,
+		"verify_recipient": "unknown@example.com",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-p.Serve():
+		if err == nil || !strings.Contains(err.Error(), "No such user") {
+			t.Fatalf("Expected the rejected recipient error, got %v", err)
+		}
+	default:
+		t.Fatal("Expected the verification to fail the serve")
+	}
+}
+
+func TestSmtpClientSendResult(t *testing.T) {
+	server := mailertest.NewUnstartedServer()
+	server.DataReply = "250 2.0.0 Ok: queued as 4BX3Yq1FzGz9sWQ"
+	server.Start()
+	defer server.Close()
+
+	client := mailer.SmtpClient{Host: "127.0.0.1", Port: server.Port(), From: mailer.AddressConfig{Address: "app@example.com"}}
+
+	result, ok, err := mailer.SendWithResult(client, &mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	expected := mailer.SendResult{Code: 250, EnhancedCode: "2.0.0", Response: "Ok: queued as 4BX3Yq1FzGz9sWQ", QueueID: "4BX3Yq1FzGz9sWQ"}
+	if !ok || result != expected {
+		t.Fatalf("Expected the %+v result, got %+v (%t)", expected, result, ok)
+	}
+	if str := result.String(); str != "250 2.0.0 Ok: queued as 4BX3Yq1FzGz9sWQ" {
+		t.Fatalf("Expected the response as received, got %q", str)
+	}
+
+	queue := mailer.NewQueue(client, mailer.QueueConfig{})
+	events := queue.Subscribe()
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	if err := queue.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	for e := range events {
+		if e.Status == mailer.DeliverySent {
+			if e.Result == nil || e.Result.QueueID != "4BX3Yq1FzGz9sWQ" {
+				t.Fatalf("Expected the sent event to report the queue id, got %+v", e.Result)
+			}
+			break
+		}
+	}
+}
+
+func TestSmtpClientAutoAuth(t *testing.T) {
+	server := mailertest.NewUnstartedServer()
+	server.Users = map[string]string{"test": "123456"}
+	server.Start()
+	defer server.Close()
+
+	var transcript string
+	client := mailer.SmtpClient{
+		Host:         "127.0.0.1",
+		Port:         server.Port(),
+		Username:     "test",
+		Password:     "123456",
+		AuthMethod:   "auto",
+		From:         mailer.AddressConfig{Address: "app@example.com"},
+		Debug:        true,
+		OnTranscript: func(_ *mailer.Message, str string) { transcript = str },
+	}
+
+	if err := client.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !strings.Contains(transcript, "C: AUTH CRAM-MD5") {
+		t.Fatalf("Expected the CRAM-MD5 auth to be chosen, got\n%s", transcript)
+	}
+	if messages := server.Messages(); len(messages) != 1 || messages[0].Username != "test" {
+		t.Fatalf("Expected the message sent by the authenticated user, got %+v", messages)
+	}
+
+	client.Password = "invalid"
+	if err := client.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err == nil {
+		t.Fatal("Expected the invalid credentials error")
+	}
+}
+
+func TestSmtpClientPoolStaleConnection(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client, err := mailer.NewSmtpClient("127.0.0.1",
+		mailer.WithPort(server.Port()),
+		mailer.WithPool(1),
+		mailer.WithPoolKeepAlive(time.Minute, 100*time.Millisecond),
+		mailer.WithFrom("", "app@example.com"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func() {
+		t.Helper()
+		if err := client.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+
+	send()
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(strings.Join(server.Commands(), ","), "NOOP"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the keep-alive NOOP, got %v", server.Commands())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the server dropped the idle connection, so that the NOOP check before reuse fails
+	server.DropConnections()
+	time.Sleep(1100 * time.Millisecond)
+
+	send()
+	if n := server.Connections(); n != 2 {
+		t.Fatalf("Expected the stale connection to be replaced, got %d connections", n)
+	}
+	if n := len(server.Messages()); n != 2 {
+		t.Fatalf("Expected 2 messages, got %d", n)
+	}
+}
+
+func TestSmtpClientPoolRecentlyDroppedConnection(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client, err := mailer.NewSmtpClient("127.0.0.1",
+		mailer.WithPort(server.Port()),
+		mailer.WithPool(1),
+		mailer.WithFrom("", "app@example.com"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func() {
+		t.Helper()
+		if err := client.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+
+	// the connection is dropped right after its use, so that it is reused without the NOOP check
+	send()
+	server.DropConnections()
+	time.Sleep(50 * time.Millisecond)
+
+	send()
+	if n := server.Connections(); n != 2 {
+		t.Fatalf("Expected the send to be retried on a new connection, got %d connections", n)
+	}
+	if n := len(server.Messages()); n != 2 {
+		t.Fatalf("Expected 2 messages, got %d", n)
+	}
+}
+
+func TestSmtpClientFailover(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	// a dead relay, refusing the connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	client := mailer.SmtpClient{
+		Host:        "127.0.0.1",
+		Port:        dead,
+		Hosts:       []string{"127.0.0.1:" + strconv.Itoa(server.Port())},
+		HostTimeout: time.Second,
+		From:        mailer.AddressConfig{Address: "app@example.com"},
+	}
+
+	if err := client.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if messages := server.Messages(); len(messages) != 1 {
+		t.Fatalf("Expected the message sent through the failover relay, got %d", len(messages))
+	}
+
+	client.Hosts = nil
+	if err := client.Send(&mailer.Message{To: []mail.Address{{Address: "jane@example.com"}}, Subject: "Hi", Text: "Hello"}); err == nil {
+		t.Fatal("Expected the dead relay error")
+	}
+}
+
+func TestSmtpClientSendPooled(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client, err := mailer.NewSmtpClient("127.0.0.1",
+		mailer.WithPort(server.Port()),
+		mailer.WithPool(1),
+		mailer.WithFrom("Test", "test@example.com"),
+		mailer.WithMessageIDGenerator(func(m *mailer.Message) string { return "<fixed@example.com>" }),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		m := &mailer.Message{
+			To:      []mail.Address{{Address: "to@example.com"}},
+			Bcc:     []mail.Address{{Address: "bcc@example.com"}},
+			Subject: "test",
+			Text:    "test",
+		}
+		if err := client.Send(m); err != nil {
+			t.Fatalf("Unexpected send error %v", err)
+		}
+		if m.From.Address != "" {
+			t.Fatalf("Expected the message From to not be modified, got %v", m.From)
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("Unexpected close error %v", err)
+	}
+
+	if connections := server.Connections(); connections != 1 {
+		t.Fatalf("Expected 1 pooled connection, got %d", connections)
+	}
+	messages := server.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+	if !strings.Contains(string(messages[0].Data), "Message-ID: <fixed@example.com>") {
+		t.Fatalf("Expected the custom Message-ID header:\n%s", messages[0].Data)
+	}
+	if strings.Contains(string(messages[0].Data), "bcc@example.com") {
+		t.Fatalf("Expected the Bcc recipient to not be in the message headers:\n%s", messages[0].Data)
+	}
+	if rcpts := strings.Count(strings.Join(server.Commands(), ","), "RCPT"); rcpts != 6 {
+		t.Fatalf("Expected 6 RCPT commands, got %d", rcpts)
+	}
+}
+
+func TestSmtpClientBodyEncoding(t *testing.T) {
+	for _, eightBitMIME := range []bool{false, true} {
+		var extensions []string
+		if eightBitMIME {
+			extensions = append(extensions, "8BITMIME")
+		}
+		server := newTestSmtpServer(t, extensions...)
+
+		client := mailer.SmtpClient{Host: "127.0.0.1", Port: server.Port(), BodyEncoding: mailer.BodyEncoding8Bit}
+
+		err := client.Send(&mailer.Message{
+			From: mail.Address{Address: "from@example.com"},
+			To:   []mail.Address{{Address: "to@example.com"}},
+			Text: "Здравей, свят",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		message := server.Messages()[0]
+
+		expectedEncoding := "Content-Transfer-Encoding: quoted-printable"
+		if eightBitMIME {
+			expectedEncoding = "Content-Transfer-Encoding: 8bit"
+		}
+		if !strings.Contains(string(message.Data), expectedEncoding) {
+			t.Fatalf("[%v] Expected %q, got\n%s", eightBitMIME, expectedEncoding, message.Data)
+		}
+		if containsFold(message.Params, "BODY=8BITMIME") != eightBitMIME {
+			t.Fatalf("[%v] Unexpected MAIL parameters %v", eightBitMIME, message.Params)
+		}
+	}
+}
+
+func TestSmtpClientConcurrentSend(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client, err := mailer.NewSmtpClient("127.0.0.1",
+		mailer.WithPort(server.Port()),
+		mailer.WithPool(2),
+		mailer.WithFrom("", "test@example.com"),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer client.Close()
+
+	// shared message to ensure that Send doesn't modify it
+	m := &mailer.Message{
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Subject: "test",
+		Text:    "test",
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := client.Send(m); err != nil {
+				t.Errorf("Unexpected send error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if messages := server.Messages(); len(messages) != 10 {
+		t.Fatalf("Expected 10 messages, got %d", len(messages))
+	}
+}
+
+func TestSmtpClientDotStuffing(t *testing.T) {
+	server := newTestSmtpServer(t)
+
+	client := mailer.SmtpClient{Host: "127.0.0.1", Port: server.Port(), BodyEncoding: mailer.BodyEncodingAuto}
+
+	err := client.Send(&mailer.Message{
+		From: mail.Address{Address: "from@example.com"},
+		To:   []mail.Address{{Address: "to@example.com"}},
+		Text: "first\n.\n.second\nlast",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server removes the stuffed dots, so an unstuffed line would either
+	// terminate the message early or lose its leading dot
+	if data := string(server.Messages()[0].Data); !strings.HasSuffix(data, "\r\nfirst\r\n.\r\n.second\r\nlast\r\n") {
+		t.Fatalf("Expected the body lines starting with a dot to be stuffed, got\n%s", data)
+	}
+}
+
+func TestSmtpClientTranscript(t *testing.T) {
+	scenarios := []struct {
+		name          string
+		replies       map[string]string
+		expectError   bool
+		expectedLines []string
+	}{
+		{
+			"delivered",
+			nil,
+			false,
+			[]string{
+				"S: 220 localhost ESMTP",
+				"C: EHLO localhost",
+				"C: AUTH PLAIN ******",
+				"S: 235 2.7.0 Authentication successful",
+				"C: MAIL FROM:<from@example.com>",
+				"C: RCPT TO:<to@example.com>",
+				"S: 354 Go ahead",
+				"C: .",
+				"S: 250 2.0.0 OK queued",
+				"C: QUIT",
+			},
+		},
+		{
+			"rejected",
+			map[string]string{"RCPT": "550 5.7.1 Client does not have permissions to send as this sender"},
+			true,
+			[]string{
+				"C: MAIL FROM:<from@example.com>",
+				"C: RCPT TO:<to@example.com>",
+				"S: 550 5.7.1 Client does not have permissions to send as this sender",
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			server := mailertest.NewUnstartedServer()
+			server.Replies = s.replies
+			server.Start()
+			t.Cleanup(server.Close)
+
+			var transcript string
+			client, err := mailer.NewSmtpClient("127.0.0.1",
+				mailer.WithPort(server.Port()),
+				mailer.WithAuth(mailer.SmtpAuthPlain, "test", "secret123"),
+				mailer.WithTranscript(func(m *mailer.Message, tr string) { transcript = tr }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = client.Send(&mailer.Message{
+				From: mail.Address{Address: "from@example.com"},
+				To:   []mail.Address{{Address: "to@example.com"}},
+				Text: "secret content",
+			})
+
+			if s.expectError {
+				var transcriptErr *mailer.SmtpTranscriptError
+				if !errors.As(err, &transcriptErr) {
+					t.Fatalf("Expected mailer.SmtpTranscriptError, got %v", err)
+				}
+				if transcriptErr.Transcript != transcript {
+					t.Fatalf("Expected the error transcript to match the hook one, got\n%s", transcriptErr.Transcript)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			lines := strings.Split(transcript, "\r\n")
+			for _, expected := range s.expectedLines {
+				if !containsFold(lines, expected) {
+					t.Fatalf("Expected line %q, got\n%s", expected, transcript)
+				}
+			}
+
+			secret := base64.StdEncoding.EncodeToString([]byte("\x00test\x00secret123"))
+			if strings.Contains(transcript, secret) || strings.Contains(transcript, "secret content") {
+				t.Fatalf("Expected the credentials and the content to be masked, got\n%s", transcript)
+			}
+		})
+	}
+}
+
+func TestSmtpClientStartTLS(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		t.Run("debug="+strconv.FormatBool(debug), func(t *testing.T) {
+			server := mailertest.NewUnstartedServer()
+			server.StartTLS = true
+			server.Users = map[string]string{"test": "secret123"}
+			server.Start()
+			t.Cleanup(server.Close)
+
+			var transcript string
+			client := mailer.SmtpClient{
+				Host:         server.Host(),
+				Port:         server.Port(),
+				Username:     "test",
+				Password:     "secret123",
+				AuthMethod:   mailer.SmtpAuthLogin,
+				TLSConfig:    server.ClientTLSConfig(),
+				Debug:        debug,
+				OnTranscript: func(m *mailer.Message, tr string) { transcript = tr },
+			}
+
+			err := client.Send(&mailer.Message{
+				From: mail.Address{Address: "from@example.com"},
+				To:   []mail.Address{{Address: "to@example.com"}},
+				Text: "test",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			message := server.Messages()[0]
+			if !message.TLS || message.Username != "test" {
+				t.Fatalf("Expected the message to be sent encrypted by test, got TLS %v and user %q", message.TLS, message.Username)
+			}
+
+			if !debug {
+				return
+			}
+
+			lines := strings.Split(transcript, "\r\n")
+			for _, expected := range []string{"C: STARTTLS", "S: 220 2.0.0 Ready to start TLS", "C: AUTH LOGIN", "S: 235 2.7.0 Authentication successful"} {
+				if !containsFold(lines, expected) {
+					t.Fatalf("Expected line %q, got\n%s", expected, transcript)
+				}
+			}
+			if strings.Count(transcript, "C: EHLO") != 2 {
+				t.Fatalf("Expected EHLO to be sent again over the encrypted connection, got\n%s", transcript)
+			}
+			if strings.Contains(transcript, base64.StdEncoding.EncodeToString([]byte("secret123"))) {
+				t.Fatalf("Expected the password to be masked, got\n%s", transcript)
+			}
+		})
+	}
+}
+
+func BenchmarkSmtpClientSend(b *testing.B) {
+	for _, poolSize := range []int{0, 1} {
+		b.Run("pool_size="+strconv.Itoa(poolSize), func(b *testing.B) {
+			server := newTestSmtpServer(b)
+
+			client, err := mailer.NewSmtpClient("127.0.0.1", mailer.WithPort(server.Port()), mailer.WithPool(poolSize))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+
+			m := &mailer.Message{
+				From:    mail.Address{Name: "Test", Address: "test@example.com"},
+				To:      []mail.Address{{Name: "John Doe", Address: "john@example.com"}},
+				Cc:      []mail.Address{{Address: "jane@example.com"}},
+				Subject: "Your invoice for the month of September",
+				HTML:    strings.Repeat("<p>Lorem ipsum dolor sit amet, consectetur adipiscing elit.</p>\n", 50),
+				Text:    strings.Repeat("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\n", 50),
+				Headers: map[string]string{"X-Campaign": "september"},
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := client.Send(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// containsFold reports whether the list contains the string, ignoring the case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -18,6 +18,7 @@
 package mailer
 
 import (
+	"context"
 	"net/smtp"
 	"testing"
 )
@@ -179,3 +180,100 @@ func TestLoginAuthNext(t *testing.T) {
 		}
 	}
 }
+
+func TestNewSmtpClientDefaults(t *testing.T) {
+	client, err := NewSmtpClient("example.com", WithTLS(true))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if client.Port != 465 {
+		t.Fatalf("Expected default TLS port 465, got %d", client.Port)
+	}
+	if client.Timeout != defaultSmtpTimeout {
+		t.Fatalf("Expected default timeout %s, got %s", defaultSmtpTimeout, client.Timeout)
+	}
+
+	if _, err := NewSmtpClient("", WithPort(25)); err == nil {
+		t.Fatal("Expected validation error for missing host")
+	}
+}
+
+func TestSmtpClientValidate(t *testing.T) {
+	scenarios := []struct {
+		name        string
+		client      SmtpClient
+		expectError bool
+	}{
+		{
+			"valid",
+			SmtpClient{Host: "example.com", Port: 587, AuthMethod: "login", From: AddressConfig{Address: "info@example.com"}},
+			false,
+		},
+		{
+			"missing host",
+			SmtpClient{Port: 587},
+			true,
+		},
+		{
+			"invalid port",
+			SmtpClient{Host: "example.com", Port: 70000},
+			true,
+		},
+		{
+			"unknown auth method",
+			SmtpClient{Host: "example.com", Port: 587, AuthMethod: "CRAM"},
+			true,
+		},
+		{
+			"invalid from address",
+			SmtpClient{Host: "example.com", Port: 587, From: AddressConfig{Address: "invalid"}},
+			true,
+		},
+	}
+
+	for _, s := range scenarios {
+		err := s.client.Validate()
+
+		hasErr := err != nil
+		if hasErr != s.expectError {
+			t.Fatalf("[%s] Expected hasErr %v, got %v (%v)", s.name, s.expectError, hasErr, err)
+		}
+	}
+}
+
+func TestSmtpClientAuthCredentialsProvider(t *testing.T) {
+	client := SmtpClient{
+		Host:     "example.com",
+		Username: "static",
+		Password: "static",
+		Credentials: CredentialsProviderFunc(func(ctx context.Context) (*Credentials, error) {
+			return &Credentials{Username: "test", Token: "abc"}, nil
+		}),
+	}
+
+	auth, _, err := client.auth(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	xoauth2, ok := auth.(*smtpXOAuth2Auth)
+	if !ok {
+		t.Fatalf("Expected XOAUTH2 auth, got %T", auth)
+	}
+
+	method, resp, err := xoauth2.Start(&smtp.ServerInfo{TLS: true, Name: "example.com"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if method != "XOAUTH2" {
+		t.Fatalf("Expected XOAUTH2, got %v", method)
+	}
+	if expected := "user=test\x01auth=Bearer abc\x01\x01"; string(resp) != expected {
+		t.Fatalf("Expected %q, got %q", expected, resp)
+	}
+
+	if _, _, err := xoauth2.Start(&smtp.ServerInfo{TLS: false, Name: "example.com"}); err == nil {
+		t.Fatal("Expected error for unencrypted connection")
+	}
+}
@@ -0,0 +1,177 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// SmtpTranscriptError wraps a send error of a debug enabled [SmtpClient]
+// with the transcript of the SMTP dialogue that led to it.
+type SmtpTranscriptError struct {
+	Err        error
+	Transcript string
+}
+
+func (e *SmtpTranscriptError) Error() string {
+	return e.Err.Error() + "\nSMTP transcript:\n" + e.Transcript
+}
+
+func (e *SmtpTranscriptError) Unwrap() error {
+	return e.Err
+}
+
+// smtpTranscript records a SMTP dialogue as "C: {line}" and "S: {line}"
+// lines, masking the AUTH exchange and summarizing the message content.
+type smtpTranscript struct {
+	sb strings.Builder
+
+	partial  [2]string // the incomplete client and server lines
+	auth     bool      // within the AUTH exchange
+	data     bool      // sending the message content
+	dataSize int
+}
+
+const (
+	transcriptClient = iota
+	transcriptServer
+)
+
+func (t *smtpTranscript) String() string {
+	return t.sb.String()
+}
+
+// record records the dialogue data sent by the client or the server.
+func (t *smtpTranscript) record(side int, p []byte) {
+	data := t.partial[side] + string(p)
+
+	for {
+		i := strings.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimSuffix(data[:i], "\r")
+		data = data[i+1:]
+
+		if side == transcriptServer {
+			t.serverLine(line)
+		} else {
+			t.clientLine(line)
+		}
+	}
+
+	t.partial[side] = data
+}
+
+func (t *smtpTranscript) clientLine(line string) {
+	switch {
+	case t.data && line == ".":
+		t.sb.WriteString("C: <message content, " + strconv.Itoa(t.dataSize) + " bytes>\r\nC: .\r\n")
+		t.data = false
+	case t.data:
+		t.dataSize += len(line) + 2
+	case t.auth:
+		t.sb.WriteString("C: " + redactedMask + "\r\n")
+	case len(line) > 5 && strings.EqualFold(line[:5], "AUTH "):
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			line = fields[0] + " " + fields[1] + " " + redactedMask // the initial response
+		}
+		t.sb.WriteString("C: " + line + "\r\n")
+		t.auth = true
+	default:
+		t.sb.WriteString("C: " + line + "\r\n")
+	}
+}
+
+func (t *smtpTranscript) serverLine(line string) {
+	t.sb.WriteString("S: " + line + "\r\n")
+
+	if t.auth && !strings.HasPrefix(line, "334") {
+		t.auth = false
+	}
+	if strings.HasPrefix(line, "354") {
+		t.data = true
+		t.dataSize = 0
+	}
+}
+
+// transcriptConn records the dialogue of the wrapped connection.
+type transcriptConn struct {
+	net.Conn
+
+	transcript *smtpTranscript // the transcript of the current send
+	tls        bool            // whether the wrapped connection is encrypted
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.transcript != nil {
+		c.transcript.record(transcriptServer, p[:n])
+	}
+
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	if c.transcript != nil {
+		c.transcript.record(transcriptClient, p)
+	}
+
+	return c.Conn.Write(p)
+}
+
+// startTLS upgrades the recorded connection itself (rather than with
+// [smtp.Client.StartTLS], which would wrap the recorder), so that the
+// dialogue is still recorded in plain text, and returns a new client over it.
+func (c SmtpClient) startTLS(client *smtp.Client, rec *transcriptConn) (*smtp.Client, error) {
+	id, err := client.Text.Cmd("STARTTLS")
+	if err != nil {
+		return nil, err
+	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(220)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(rec.Conn, c.tlsConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	rec.Conn = tlsConn
+	rec.tls = true
+
+	// the new client expects a greeting, which the server doesn't send after STARTTLS
+	greeting := strings.NewReader("220 " + c.Host + "\r\n")
+
+	return smtp.NewClient(&greetedConn{Conn: rec, r: io.MultiReader(greeting, rec)}, c.Host)
+}
+
+// greetedConn prepends a synthetic greeting to the connection reads.
+type greetedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *greetedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// smtpTLSAuth reports the connection as encrypted to the wrapped auth,
+// which can't detect the TLS connections behind the transcript recorder.
+type smtpTLSAuth struct {
+	smtp.Auth
+}
+
+func (a smtpTLSAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+
+	return a.Auth.Start(&info)
+}
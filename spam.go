@@ -0,0 +1,348 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpamAction is the action taken on the messages scored above the
+// threshold (see [SpamCheckConfig]).
+type SpamAction string
+
+const (
+	// SpamActionReject fails the send when the score exceeds the threshold.
+	SpamActionReject SpamAction = "reject"
+	// SpamActionFlag only marks the message with the X-Spam-* headers.
+	SpamActionFlag SpamAction = "flag"
+)
+
+const defaultSpamCheckTimeout = 10 * time.Second
+
+// SpamResult describes the outcome of a single spam check.
+type SpamResult struct {
+	Score     float64
+	Threshold float64  // the threshold reported by the scanner (if any)
+	Action    string   // the scanner recommended action (rspamd only)
+	Symbols   []string // matched rules
+}
+
+// SpamChecker scores a rendered RFC 5322 message.
+type SpamChecker interface {
+	Check(ctx context.Context, raw []byte) (*SpamResult, error)
+}
+
+// SpamError is returned by the spam check middleware when
+// a message is rejected because of its score.
+type SpamError struct {
+	Result    *SpamResult
+	Threshold float64
+}
+
+func (e *SpamError) Error() string {
+	return fmt.Sprintf("message rejected as spam (score %.2f, threshold %.2f)", e.Result.Score, e.Threshold)
+}
+
+// SpamCheckConfig defines the spam pre-send check settings.
+type SpamCheckConfig struct {
+	Rspamd    string        `mapstructure:"rspamd" json:"rspamd,omitempty" bson:"rspamd,omitempty"`       // rspamd controller url, eg. http://127.0.0.1:11333
+	Password  string        `mapstructure:"password" json:"password,omitempty" bson:"password,omitempty"` // rspamd controller password
+	Spamd     string        `mapstructure:"spamd" json:"spamd,omitempty" bson:"spamd,omitempty"`          // spamd address, eg. 127.0.0.1:783
+	User      string        `mapstructure:"user" json:"user,omitempty" bson:"user,omitempty"`             // spamd user
+	Threshold float64       `mapstructure:"threshold" json:"threshold,omitempty" bson:"threshold,omitempty"`
+	Action    SpamAction    `mapstructure:"action" json:"action,omitempty" bson:"action,omitempty"` // default to "reject"
+	Timeout   time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`
+}
+
+// Validate checks the spam check configuration for common mistakes.
+func (c SpamCheckConfig) Validate() error {
+	var errs []error
+
+	if c.Rspamd == "" && c.Spamd == "" {
+		errs = append(errs, errors.New("spam_check: either rspamd or spamd address must be set"))
+	}
+
+	if c.Rspamd != "" && c.Spamd != "" {
+		errs = append(errs, errors.New("spam_check: rspamd and spamd are mutually exclusive"))
+	}
+
+	if c.Rspamd != "" {
+		if u, err := url.Parse(c.Rspamd); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("spam_check: invalid rspamd url %q", c.Rspamd))
+		}
+	}
+
+	if c.Threshold < 0 {
+		errs = append(errs, fmt.Errorf("spam_check: threshold must be positive, got %v", c.Threshold))
+	}
+
+	switch c.Action {
+	case "", SpamActionReject, SpamActionFlag:
+	default:
+		errs = append(errs, fmt.Errorf("spam_check: unknown action %q, expected %q or %q", c.Action, SpamActionReject, SpamActionFlag))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("spam_check: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c SpamCheckConfig) Redacted() SpamCheckConfig {
+	c.Password = redact(c.Password)
+
+	return c
+}
+
+// Checker returns the SpamChecker described by the config.
+func (c SpamCheckConfig) Checker() (SpamChecker, error) {
+	switch {
+	case c.Rspamd != "":
+		return &RspamdChecker{URL: c.Rspamd, Password: c.Password}, nil
+	case c.Spamd != "":
+		return &SpamdChecker{Address: c.Spamd, User: c.User}, nil
+	default:
+		return nil, errors.New("either rspamd or spamd address must be set")
+	}
+}
+
+// SpamCheck returns a middleware that scores every message with the
+// provided checker before handing it to the next mailer.
+//
+// Messages above the threshold are either rejected with [SpamError]
+// or flagged with X-Spam-Flag/X-Spam-Score headers, depending on the
+// configured action. A zero threshold falls back to the threshold
+// reported by the scanner.
+func SpamCheck(checker SpamChecker, cfg SpamCheckConfig) Middleware {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultSpamCheckTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			// buffer the attachments so that the message could be both rendered and sent
+			m = m.Clone()
+			if err := m.bufferAttachments(); err != nil {
+				return err
+			}
+
+			raw, err := m.Render()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			result, err := checker.Check(ctx, raw)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("spam check failed: %w", err)
+			}
+
+			threshold := cfg.Threshold
+			if threshold <= 0 {
+				threshold = result.Threshold
+			}
+
+			isSpam := threshold > 0 && result.Score >= threshold
+
+			if isSpam && cfg.Action != SpamActionFlag {
+				return &SpamError{Result: result, Threshold: threshold}
+			}
+
+			if cfg.Action == SpamActionFlag {
+				if m.Headers == nil {
+					m.Headers = map[string]string{}
+				}
+				m.Headers["X-Spam-Score"] = strconv.FormatFloat(result.Score, 'f', 2, 64)
+				if isSpam {
+					m.Headers["X-Spam-Flag"] = "YES"
+				} else {
+					m.Headers["X-Spam-Flag"] = "NO"
+				}
+			}
+
+			return next.Send(m)
+		})
+	}
+}
+
+// -------------------------------------------------------------------
+// rspamd
+// -------------------------------------------------------------------
+
+var _ SpamChecker = (*RspamdChecker)(nil)
+
+// RspamdChecker checks messages via the rspamd controller "/checkv2" endpoint.
+type RspamdChecker struct {
+	URL      string
+	Password string
+	Client   *http.Client // default to http.DefaultClient
+}
+
+// Check implements [SpamChecker] interface.
+func (c *RspamdChecker) Check(ctx context.Context, raw []byte) (*SpamResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.URL, "/")+"/checkv2", bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if c.Password != "" {
+		req.Header.Set("Password", c.Password)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("rspamd responded with %d: %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var data struct {
+		Score         float64                    `json:"score"`
+		RequiredScore float64                    `json:"required_score"`
+		Action        string                     `json:"action"`
+		Symbols       map[string]json.RawMessage `json:"symbols"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	result := &SpamResult{
+		Score:     data.Score,
+		Threshold: data.RequiredScore,
+		Action:    data.Action,
+		Symbols:   make([]string, 0, len(data.Symbols)),
+	}
+	for name := range data.Symbols {
+		result.Symbols = append(result.Symbols, name)
+	}
+	sort.Strings(result.Symbols)
+
+	return result, nil
+}
+
+// -------------------------------------------------------------------
+// spamd (SpamAssassin)
+// -------------------------------------------------------------------
+
+var _ SpamChecker = (*SpamdChecker)(nil)
+
+// SpamdChecker checks messages via the SpamAssassin spamd protocol.
+type SpamdChecker struct {
+	Address string
+	User    string
+}
+
+// Check implements [SpamChecker] interface.
+func (c *SpamdChecker) Check(ctx context.Context, raw []byte) (*SpamResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	var req bytes.Buffer
+	req.WriteString("SYMBOLS SPAMC/1.5\r\n")
+	fmt.Fprintf(&req, "Content-length: %d\r\n", len(raw))
+	if c.User != "" {
+		fmt.Fprintf(&req, "User: %s\r\n", c.User)
+	}
+	req.WriteString("\r\n")
+	req.Write(raw)
+
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+// parseSpamdResponse parses a SPAMD/1.x response, eg.:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 23
+//	Spam: True ; 15.2 / 5.0
+//
+//	RULE_ONE,RULE_TWO
+func parseSpamdResponse(r *bufio.Reader) (*SpamResult, error) {
+	tp := textproto.NewReader(r)
+
+	status, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(status, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SPAMD/") {
+		return nil, fmt.Errorf("invalid spamd response %q", status)
+	}
+	if parts[1] != "0" {
+		return nil, fmt.Errorf("spamd error: %s", status)
+	}
+
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	// Spam: True ; 15.2 / 5.0
+	spam := headers.Get("Spam")
+	if spam == "" {
+		return nil, errors.New("missing spamd Spam header")
+	}
+	_, scores, ok := strings.Cut(spam, ";")
+	if !ok {
+		return nil, fmt.Errorf("invalid spamd Spam header %q", spam)
+	}
+	scoreStr, thresholdStr, ok := strings.Cut(scores, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid spamd Spam header %q", spam)
+	}
+
+	result := &SpamResult{}
+	if result.Score, err = strconv.ParseFloat(strings.TrimSpace(scoreStr), 64); err != nil {
+		return nil, err
+	}
+	if result.Threshold, err = strconv.ParseFloat(strings.TrimSpace(thresholdStr), 64); err != nil {
+		return nil, err
+	}
+
+	body, _ := io.ReadAll(r)
+	for _, symbol := range strings.Split(string(bytes.TrimSpace(body)), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			result.Symbols = append(result.Symbols, symbol)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testSpamChecker struct {
+	score float64
+}
+
+func (c testSpamChecker) Check(_ context.Context, _ []byte) (*SpamResult, error) {
+	return &SpamResult{Score: c.score, Threshold: 5}, nil
+}
+
+func TestParseSpamdResponse(t *testing.T) {
+	raw := "SPAMD/1.1 0 EX_OK\r\nContent-length: 19\r\nSpam: True ; 15.2 / 5.0\r\n\r\nRULE_ONE,RULE_TWO\r\n"
+
+	result, err := parseSpamdResponse(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if result.Score != 15.2 {
+		t.Fatalf("Expected score 15.2, got %v", result.Score)
+	}
+	if result.Threshold != 5 {
+		t.Fatalf("Expected threshold 5, got %v", result.Threshold)
+	}
+	if len(result.Symbols) != 2 || result.Symbols[0] != "RULE_ONE" || result.Symbols[1] != "RULE_TWO" {
+		t.Fatalf("Expected RULE_ONE and RULE_TWO symbols, got %v", result.Symbols)
+	}
+
+	if _, err := parseSpamdResponse(bufio.NewReader(strings.NewReader("SPAMD/1.1 76 EX_PROTOCOL\r\n\r\n"))); err == nil {
+		t.Fatal("Expected error for non EX_OK response")
+	}
+}
+
+func TestRspamdChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			t.Errorf("Expected /checkv2 path, got %s", r.URL.Path)
+		}
+		if r.Header.Get("Password") != "secret" {
+			t.Errorf("Expected password header, got %q", r.Header.Get("Password"))
+		}
+		_, _ = w.Write([]byte(`{"score":7.5,"required_score":15,"action":"add header","symbols":{"B":{},"A":{}}}`))
+	}))
+	defer server.Close()
+
+	checker := &RspamdChecker{URL: server.URL + "/", Password: "secret"}
+
+	result, err := checker.Check(context.Background(), []byte("Subject: test\r\n\r\ntest"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if result.Score != 7.5 || result.Threshold != 15 || result.Action != "add header" {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if strings.Join(result.Symbols, ",") != "A,B" {
+		t.Fatalf("Expected sorted A,B symbols, got %v", result.Symbols)
+	}
+}
+
+func TestSpamCheckMiddleware(t *testing.T) {
+	scenarios := []struct {
+		name         string
+		score        float64
+		cfg          SpamCheckConfig
+		expectReject bool
+		expectFlag   string
+	}{
+		{"below scanner threshold", 1, SpamCheckConfig{}, false, ""},
+		{"above scanner threshold", 6, SpamCheckConfig{}, true, ""},
+		{"above custom threshold", 3, SpamCheckConfig{Threshold: 2}, true, ""},
+		{"flag spam", 6, SpamCheckConfig{Action: SpamActionFlag}, false, "YES"},
+		{"flag ham", 1, SpamCheckConfig{Action: SpamActionFlag}, false, "NO"},
+	}
+
+	for _, s := range scenarios {
+		var sent *Message
+		next := MailerFunc(func(m *Message) error {
+			sent = m
+			return nil
+		})
+
+		mailer := Chain(next, SpamCheck(testSpamChecker{s.score}, s.cfg))
+
+		err := mailer.Send(&Message{Subject: "test", Text: "test"})
+
+		var spamErr *SpamError
+		if isRejected := errors.As(err, &spamErr); isRejected != s.expectReject {
+			t.Fatalf("[%s] Expected rejected %v, got %v (%v)", s.name, s.expectReject, isRejected, err)
+		}
+
+		if s.expectReject {
+			if sent != nil {
+				t.Fatalf("[%s] Expected the message to not be sent", s.name)
+			}
+			continue
+		}
+
+		if sent == nil {
+			t.Fatalf("[%s] Expected the message to be sent", s.name)
+		}
+		if flag := sent.Headers["X-Spam-Flag"]; flag != s.expectFlag {
+			t.Fatalf("[%s] Expected X-Spam-Flag %q, got %q", s.name, s.expectFlag, flag)
+		}
+	}
+}
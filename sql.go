@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SQLDialect is the SQL database flavor, used for the placeholders and the schema types.
+type SQLDialect string
+
+const (
+	SQLPostgres SQLDialect = "postgres"
+	SQLMySQL    SQLDialect = "mysql"
+	SQLSQLite   SQLDialect = "sqlite"
+)
+
+// SQLExecer executes SQL statements, eg. a *sql.DB, *sql.Tx or *sql.Conn.
+type SQLExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// validateSQL checks the dialect and the table name (eg. "name: invalid table").
+func validateSQL(name string, dialect SQLDialect, table string) []error {
+	var errs []error
+
+	switch dialect {
+	case "", SQLPostgres, SQLMySQL, SQLSQLite:
+	default:
+		errs = append(errs, fmt.Errorf("%s: unknown dialect %q, expected postgres, mysql or sqlite", name, dialect))
+	}
+
+	if table != "" && !sqlTableName.MatchString(table) {
+		errs = append(errs, fmt.Errorf("%s: invalid table name %q", name, table))
+	}
+
+	return errs
+}
+
+// bind returns the query with the "?" placeholders replaced with the dialect ones.
+func (d SQLDialect) bind(query string) string {
+	if d != SQLPostgres && d != "" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+// blobType returns the column type of the raw messages.
+func (d SQLDialect) blobType() string {
+	switch d {
+	case SQLMySQL:
+		return "LONGBLOB"
+	case SQLSQLite:
+		return "BLOB"
+	default:
+		return "BYTEA"
+	}
+}
+
+// textType returns the column type of the unbounded texts.
+func (d SQLDialect) textType() string {
+	if d == SQLMySQL {
+		return "MEDIUMTEXT"
+	}
+
+	return "TEXT"
+}
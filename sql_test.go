@@ -0,0 +1,402 @@
+package mailer
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLDriver is an in-memory database/sql driver for the SQL stores tests,
+// supporting the statements of the stores only (with "?" placeholders):
+//
+//	CREATE TABLE [IF NOT EXISTS] t (...)
+//	INSERT INTO t (a, b) VALUES (?, ?)
+//	SELECT a, b FROM t [WHERE ...] [ORDER BY a [DESC]] [LIMIT n [OFFSET n]]
+//	SELECT COUNT(*) FROM t [WHERE ...]
+//	UPDATE t SET a = ?, b = b + 1, c = NULL WHERE ...
+//	DELETE FROM t WHERE ...
+//
+// with the "a = ?" (=, <>, <, <=, >, >=, LIKE) and "a IS NULL" conditions joined with AND.
+type fakeSQLDriver struct {
+	mu     sync.Mutex
+	tables map[string][]map[string]driver.Value
+}
+
+var fakeSQLDrivers sync.Map
+
+// newFakeSQLDB returns a new empty in-memory database.
+func newFakeSQLDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	name := "fake-" + PseudorandomString(10)
+	d := &fakeSQLDriver{tables: map[string][]map[string]driver.Value{}}
+	sql.Register(name, d)
+	fakeSQLDrivers.Store(name, d)
+
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func (d *fakeSQLDriver) Open(string) (driver.Conn, error) {
+	return &fakeSQLConn{d: d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+// Begin implements a no-op transaction, the tests don't roll back.
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return errors.New("fake sql: rollback is not supported") }
+
+type fakeSQLStmt struct {
+	d     *fakeSQLDriver
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return strings.Count(s.query, "?") }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	n, _, _, err := s.d.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.RowsAffected(n), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	_, columns, rows, err := s.d.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeSQLRows{columns: columns, rows: rows}, nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+
+	return nil
+}
+
+var (
+	fakeSQLCreate = regexp.MustCompile(`(?is)^CREATE TABLE (?:IF NOT EXISTS )?(\S+) `)
+	fakeSQLInsert = regexp.MustCompile(`(?is)^INSERT INTO (\S+) \((.+?)\) VALUES \((.+)\)$`)
+	fakeSQLSelect = regexp.MustCompile(`(?is)^SELECT (.+?) FROM (\S+)(?: WHERE (.+?))?(?: ORDER BY (\S+)( DESC)?)?(?: LIMIT (\d+)(?: OFFSET (\d+))?)?$`)
+	fakeSQLUpdate = regexp.MustCompile(`(?is)^UPDATE (\S+) SET (.+?) WHERE (.+)$`)
+	fakeSQLDelete = regexp.MustCompile(`(?is)^DELETE FROM (\S+) WHERE (.+)$`)
+	fakeSQLCond   = regexp.MustCompile(`(?i)^(\w+) (?:(IS NULL)|(=|<>|<=|>=|<|>|LIKE) (\?|\d+|'[^']*'))$`)
+)
+
+// run executes the query, returning the affected rows or the selected columns and rows.
+func (d *fakeSQLDriver) run(query string, args []driver.Value) (int64, []string, [][]driver.Value, error) {
+	query = strings.Join(strings.Fields(query), " ")
+
+	next := func() driver.Value {
+		v := args[0]
+		args = args[1:]
+		return v
+	}
+
+	if m := fakeSQLCreate.FindStringSubmatch(query); m != nil {
+		if _, ok := d.tables[m[1]]; !ok {
+			d.tables[m[1]] = nil
+		}
+		return 0, nil, nil, nil
+	}
+
+	if m := fakeSQLInsert.FindStringSubmatch(query); m != nil {
+		table, ok := d.tables[m[1]]
+		if !ok {
+			return 0, nil, nil, fmt.Errorf("fake sql: unknown table %s", m[1])
+		}
+		row := map[string]driver.Value{}
+		for _, column := range strings.Split(m[2], ",") {
+			row[strings.TrimSpace(column)] = next()
+		}
+		d.tables[m[1]] = append(table, row)
+		return 1, nil, nil, nil
+	}
+
+	if m := fakeSQLSelect.FindStringSubmatch(query); m != nil {
+		matched, err := d.where(m[2], m[3], next)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		if strings.EqualFold(m[1], "COUNT(*)") {
+			return 0, []string{"count"}, [][]driver.Value{{int64(len(matched))}}, nil
+		}
+
+		if m[4] != "" {
+			sort.SliceStable(matched, func(i, j int) bool {
+				if m[5] != "" {
+					i, j = j, i
+				}
+				return fakeSQLCompare(matched[i][m[4]], matched[j][m[4]]) < 0
+			})
+		}
+		if m[7] != "" {
+			offset, _ := strconv.Atoi(m[7])
+			matched = matched[min(offset, len(matched)):]
+		}
+		if m[6] != "" {
+			limit, _ := strconv.Atoi(m[6])
+			matched = matched[:min(limit, len(matched))]
+		}
+
+		columns := strings.Split(m[1], ",")
+		for i := range columns {
+			columns[i] = strings.TrimSpace(columns[i])
+		}
+		rows := make([][]driver.Value, len(matched))
+		for i, row := range matched {
+			for _, column := range columns {
+				rows[i] = append(rows[i], row[column])
+			}
+		}
+		return 0, columns, rows, nil
+	}
+
+	if m := fakeSQLUpdate.FindStringSubmatch(query); m != nil {
+		// the SET values come before the WHERE ones
+		type assignment struct {
+			column string
+			expr   string
+			value  driver.Value
+		}
+		var assignments []assignment
+		for _, set := range strings.Split(m[2], ",") {
+			column, expr, _ := strings.Cut(set, "=")
+			a := assignment{column: strings.TrimSpace(column), expr: strings.TrimSpace(expr)}
+			if a.expr == "?" {
+				a.value = next()
+			}
+			assignments = append(assignments, a)
+		}
+
+		matched, err := d.where(m[1], m[3], next)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		for _, row := range matched {
+			for _, a := range assignments {
+				switch {
+				case a.expr == "?":
+					row[a.column] = a.value
+				case strings.EqualFold(a.expr, "NULL"):
+					row[a.column] = nil
+				case strings.HasSuffix(a.expr, "+ 1"):
+					row[a.column] = fakeSQLInt(row[a.column]) + 1
+				default:
+					n, err := strconv.ParseInt(a.expr, 10, 64)
+					if err != nil {
+						return 0, nil, nil, fmt.Errorf("fake sql: unsupported expression %q", a.expr)
+					}
+					row[a.column] = n
+				}
+			}
+		}
+		return int64(len(matched)), nil, nil, nil
+	}
+
+	if m := fakeSQLDelete.FindStringSubmatch(query); m != nil {
+		matched, err := d.where(m[1], m[2], next)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		var kept []map[string]driver.Value
+		for _, row := range d.tables[m[1]] {
+			if !containsRow(matched, row) {
+				kept = append(kept, row)
+			}
+		}
+		d.tables[m[1]] = kept
+		return int64(len(matched)), nil, nil, nil
+	}
+
+	return 0, nil, nil, fmt.Errorf("fake sql: unsupported query %q", query)
+}
+
+// where returns the table rows matching the conditions.
+func (d *fakeSQLDriver) where(table, conditions string, next func() driver.Value) ([]map[string]driver.Value, error) {
+	rows, ok := d.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("fake sql: unknown table %s", table)
+	}
+
+	type condition struct {
+		column string
+		op     string
+		value  driver.Value
+	}
+	var conds []condition
+	if conditions != "" {
+		for _, cond := range regexp.MustCompile(`(?i) AND `).Split(conditions, -1) {
+			m := fakeSQLCond.FindStringSubmatch(cond)
+			if m == nil {
+				return nil, fmt.Errorf("fake sql: unsupported condition %q", cond)
+			}
+			c := condition{column: m[1], op: strings.ToUpper(m[3])}
+			switch {
+			case m[2] != "":
+				c.op = "IS NULL"
+			case m[4] == "?":
+				c.value = next()
+			case strings.HasPrefix(m[4], "'"):
+				c.value = strings.Trim(m[4], "'")
+			default:
+				c.value, _ = strconv.ParseInt(m[4], 10, 64)
+			}
+			conds = append(conds, c)
+		}
+	}
+
+	var matched []map[string]driver.Value
+	for _, row := range rows {
+		ok := true
+		for _, c := range conds {
+			value := row[c.column]
+			switch c.op {
+			case "IS NULL":
+				ok = value == nil
+			case "LIKE":
+				pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(fmt.Sprint(c.value)), "%", ".*") + "$"
+				ok = value != nil && regexp.MustCompile("(?is)"+pattern).MatchString(fakeSQLString(value))
+			default:
+				if value == nil {
+					ok = false
+					break
+				}
+				cmp := fakeSQLCompare(value, c.value)
+				ok = map[string]bool{"=": cmp == 0, "<>": cmp != 0, "<": cmp < 0, "<=": cmp <= 0, ">": cmp > 0, ">=": cmp >= 0}[c.op]
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+
+	return matched, nil
+}
+
+func containsRow(rows []map[string]driver.Value, row map[string]driver.Value) bool {
+	for _, r := range rows {
+		if fmt.Sprintf("%p", r) == fmt.Sprintf("%p", row) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fakeSQLCompare(a, b driver.Value) int {
+	if ai, ok := a.(int64); ok {
+		bi := fakeSQLInt(b)
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(fakeSQLString(a), fakeSQLString(b))
+}
+
+func fakeSQLInt(v driver.Value) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+
+	return 0
+}
+
+func fakeSQLString(v driver.Value) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// fakeSQLTable returns a copy of the table rows.
+func fakeSQLTable(t *testing.T, db *sql.DB, table string) []map[string]driver.Value {
+	t.Helper()
+
+	var d *fakeSQLDriver
+	fakeSQLDrivers.Range(func(_, value any) bool {
+		if candidate := value.(*fakeSQLDriver); db.Driver() == candidate {
+			d = candidate
+			return false
+		}
+		return true
+	})
+	if d == nil {
+		t.Fatal("Not a fake sql database")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows := make([]map[string]driver.Value, len(d.tables[table]))
+	for i, row := range d.tables[table] {
+		rows[i] = map[string]driver.Value{}
+		for k, v := range row {
+			rows[i][k] = v
+		}
+	}
+
+	return rows
+}
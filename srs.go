@@ -0,0 +1,257 @@
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSRSMaxAge = 21 * 24 * time.Hour
+
+	srsHashLength = 4
+	srsTimeBase32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	srsTimeSlots  = 1024 // 2 base32 characters
+)
+
+// ErrInvalidSRS is returned when an address could not be reversed.
+var ErrInvalidSRS = errors.New("invalid SRS address")
+
+// SRS implements the Sender Rewriting Scheme, which rewrites the envelope
+// senders of the forwarded messages into the forwarder Domain so that the
+// SPF checks of the receivers don't fail, while the bounces could still be
+// routed back to the original sender (see [SRS.Reverse]).
+//
+// The addresses use the libsrs2 compatible format:
+//
+//	SRS0=HHHH=TT=example.com=user@forwarder.com
+//	SRS1=HHHH=first-forwarder.com==HHHH=TT=example.com=user@forwarder.com
+type SRS struct {
+	Domain string        `mapstructure:"domain" json:"domain,omitempty" bson:"domain,omitempty"`    // the forwarder domain
+	Secret string        `mapstructure:"secret" json:"secret,omitempty" bson:"secret,omitempty"`    // the addresses signing secret
+	MaxAge time.Duration `mapstructure:"max_age" json:"max_age,omitempty" bson:"max_age,omitempty"` // max age of the reversed addresses, default to 21 days
+
+	// LocalDomains are the sender domains of the locally originated
+	// messages, which are not rewritten by [SRSRewrite] (required).
+	LocalDomains []string `mapstructure:"local_domains" json:"local_domains,omitempty" bson:"local_domains,omitempty"`
+
+	// Clock is an optional time source of the address timestamps
+	// (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the SRS configuration for common mistakes.
+func (s SRS) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(s.Domain) == "" {
+		errs = append(errs, errors.New("srs: domain is required"))
+	}
+
+	if s.Secret == "" {
+		errs = append(errs, errors.New("srs: secret is required"))
+	}
+
+	if s.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("srs: max_age must be positive, got %s", s.MaxAge))
+	}
+
+	if len(s.LocalDomains) == 0 {
+		errs = append(errs, errors.New("srs: local_domains is required, so that the local messages are not rewritten"))
+	}
+
+	if s.MaxAge >= srsTimeSlots*24*time.Hour {
+		errs = append(errs, fmt.Errorf("srs: max_age must be less than %d days, got %s", srsTimeSlots, s.MaxAge))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (s SRS) Redacted() SRS {
+	s.Secret = redact(s.Secret)
+	s.Clock = nil
+
+	return s
+}
+
+// Forward rewrites the sender address into the SRS domain.
+//
+// Addresses of the SRS domain itself and the null sender ("")
+// are returned unchanged, while SRS0 addresses of other forwarders
+// are rewritten as SRS1 so that the bounces go straight back to them.
+func (s SRS) Forward(sender string) (string, error) {
+	local, domain, ok := splitAddress(sender)
+	if !ok || strings.EqualFold(domain, s.Domain) {
+		return sender, nil
+	}
+
+	switch srsPrefix(local) {
+	case "SRS0":
+		// SRS1=HHHH=forwarder==HHHH=TT=domain=local, the opaque part keeps its separator
+		opaque := local[4:]
+		return "SRS1=" + s.hash(domain, opaque) + "=" + domain + "=" + opaque + "@" + s.Domain, nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSRS, sender)
+		}
+		return "SRS1=" + s.hash(parts[1], parts[2]) + "=" + parts[1] + "=" + parts[2] + "@" + s.Domain, nil
+	}
+
+	ts := srsTimestamp(now(s.Clock))
+
+	return "SRS0=" + s.hash(ts, domain, local) + "=" + ts + "=" + domain + "=" + local + "@" + s.Domain, nil
+}
+
+// Reverse returns the original sender of a [SRS.Forward] rewritten address
+// (or the previous forwarder SRS0 address for the SRS1 ones).
+//
+// It returns an error wrapping [ErrInvalidSRS] if the address is not a SRS one,
+// its hash doesn't match or it is older than the configured max age.
+func (s SRS) Reverse(address string) (string, error) {
+	local, _, ok := splitAddress(address)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidSRS, address)
+	}
+
+	switch srsPrefix(local) {
+	case "SRS0":
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSRS, address)
+		}
+		if !s.checkHash(parts[0], parts[1], parts[2], parts[3]) {
+			return "", fmt.Errorf("%w: hash mismatch of %q", ErrInvalidSRS, address)
+		}
+		if err := s.checkTimestamp(parts[1]); err != nil {
+			return "", fmt.Errorf("%w: %s of %q", ErrInvalidSRS, err, address)
+		}
+		return parts[3] + "@" + parts[2], nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSRS, address)
+		}
+		if !s.checkHash(parts[0], parts[1], parts[2]) {
+			return "", fmt.Errorf("%w: hash mismatch of %q", ErrInvalidSRS, address)
+		}
+		return "SRS0" + parts[2] + "@" + parts[1], nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrInvalidSRS, address)
+}
+
+func (s SRS) hash(data ...string) string {
+	h := hmac.New(sha1.New, []byte(s.Secret))
+	for _, d := range data {
+		h.Write([]byte(strings.ToLower(d)))
+	}
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))[:srsHashLength]
+}
+
+// checkHash compares the hashes case-insensitively,
+// since some MTAs lowercase the address local parts.
+func (s SRS) checkHash(hash string, data ...string) bool {
+	return strings.EqualFold(hash, s.hash(data...))
+}
+
+func (s SRS) checkTimestamp(ts string) error {
+	if len(ts) != 2 {
+		return errors.New("invalid timestamp")
+	}
+
+	var value int
+	for _, c := range strings.ToUpper(ts) {
+		i := strings.IndexRune(srsTimeBase32, c)
+		if i < 0 {
+			return errors.New("invalid timestamp")
+		}
+		value = value<<5 | i
+	}
+
+	maxAge := s.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultSRSMaxAge
+	}
+
+	today := int(now(s.Clock).Unix() / 86400)
+	if age := (today - value) % srsTimeSlots; age < 0 || time.Duration(age)*24*time.Hour > maxAge {
+		return errors.New("expired timestamp")
+	}
+
+	return nil
+}
+
+// srsTimestamp returns the 2 characters base32 day number of t.
+func srsTimestamp(t time.Time) string {
+	day := int(t.Unix()/86400) % srsTimeSlots
+
+	return string([]byte{srsTimeBase32[day>>5&31], srsTimeBase32[day&31]})
+}
+
+// srsPrefix returns "SRS0" or "SRS1" if the local part is a SRS one.
+func srsPrefix(local string) string {
+	if len(local) < 5 || !strings.ContainsRune("=+-", rune(local[4])) {
+		return ""
+	}
+
+	if prefix := strings.ToUpper(local[:4]); prefix == "SRS0" || prefix == "SRS1" {
+		return prefix
+	}
+
+	return ""
+}
+
+// isLocal reports whether the domain is one of the local domains.
+func (s SRS) isLocal(domain string) bool {
+	return slices.ContainsFunc(s.LocalDomains, func(local string) bool {
+		return strings.EqualFold(local, domain)
+	})
+}
+
+// splitAddress splits a bare email address into its local and domain parts.
+func splitAddress(address string) (string, string, bool) {
+	i := strings.LastIndexByte(address, '@')
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+
+	return address[:i], address[i+1:], true
+}
+
+// SRSRewrite returns a middleware that rewrites the envelope sender of
+// the messages (see [Message.ReturnPath]) with [SRS.Forward], so that the
+// relayed or forwarded messages (eg. from [ParseMessage]) pass the SPF checks.
+//
+// Only the forwarded messages are rewritten, ie. the ones with a sender
+// out of the SRS LocalDomains. The null sender is never rewritten.
+func SRSRewrite(srs SRS) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			sender := envelopeSender(m)
+
+			if _, domain, ok := splitAddress(sender); !ok || srs.isLocal(domain) {
+				return next.Send(m)
+			}
+
+			rewritten, err := srs.Forward(sender)
+			if err != nil {
+				return err
+			}
+
+			if rewritten != sender {
+				m = m.Clone()
+				m.ReturnPath = rewritten
+			}
+
+			return next.Send(m)
+		})
+	}
+}
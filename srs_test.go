@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSRSForwardReverse(t *testing.T) {
+	clock := ClockFunc(func() time.Time { return time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC) })
+
+	srs := SRS{Domain: "fwd.example.com", Secret: "secret", Clock: clock}
+	other := SRS{Domain: "other.example.com", Secret: "other", Clock: clock}
+
+	srs0, err := srs.Forward("john@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs0, "SRS0=") || !strings.HasSuffix(srs0, "=example.com=john@fwd.example.com") {
+		t.Fatalf("Unexpected SRS0 address %q", srs0)
+	}
+
+	original, err := srs.Reverse(srs0)
+	if err != nil || original != "john@example.com" {
+		t.Fatalf("Expected john@example.com, got %q (%v)", original, err)
+	}
+
+	// lowercased by a MTA
+	if original, err := srs.Reverse(strings.ToLower(srs0)); err != nil || original != "john@example.com" {
+		t.Fatalf("Expected the lowercased address to be reversed, got %q (%v)", original, err)
+	}
+
+	srs1, err := other.Forward(srs0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=fwd.example.com==") {
+		t.Fatalf("Unexpected SRS1 address %q", srs1)
+	}
+
+	// rewritten again by a third forwarder
+	again, err := SRS{Domain: "third.example.com", Secret: "third"}.Forward(srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(again, "=fwd.example.com==") || !strings.HasSuffix(again, "@third.example.com") {
+		t.Fatalf("Unexpected SRS1 address %q", again)
+	}
+
+	back, err := other.Reverse(srs1)
+	if err != nil || back != srs0 {
+		t.Fatalf("Expected %q, got %q (%v)", srs0, back, err)
+	}
+
+	if _, err := srs.Reverse(strings.Replace(srs0, "john", "jane", 1)); !errors.Is(err, ErrInvalidSRS) {
+		t.Fatalf("Expected hash mismatch, got %v", err)
+	}
+
+	expired := srs
+	expired.Clock = ClockFunc(func() time.Time { return clock.Now().AddDate(0, 0, 22) })
+	if _, err := expired.Reverse(srs0); !errors.Is(err, ErrInvalidSRS) {
+		t.Fatalf("Expected expired address error, got %v", err)
+	}
+
+	if _, err := srs.Reverse("john@example.com"); !errors.Is(err, ErrInvalidSRS) {
+		t.Fatalf("Expected not SRS address error, got %v", err)
+	}
+
+	for _, sender := range []string{"", "info@fwd.example.com"} {
+		if v, err := srs.Forward(sender); err != nil || v != sender {
+			t.Fatalf("Expected %q to be unchanged, got %q (%v)", sender, v, err)
+		}
+	}
+}
+
+func TestSRSRewrite(t *testing.T) {
+	var sender string
+	next := MailerFunc(func(m *Message) error {
+		sender = envelopeSender(m)
+		return nil
+	})
+
+	raw := "From: john@example.com\r\nReturn-Path: <bounce@example.com>\r\nTo: jane@fwd.example.com\r\nSubject: test\r\n\r\nhello\r\n"
+	m, err := ParseMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srs := SRS{Domain: "fwd.example.com", Secret: "secret", LocalDomains: []string{"app.example.com"}}
+	if err := Chain(next, SRSRewrite(srs)).Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ReturnPath != "bounce@example.com" {
+		t.Fatalf("Expected the original message to be unchanged, got %q", m.ReturnPath)
+	}
+
+	if original, err := srs.Reverse(sender); err != nil || original != "bounce@example.com" {
+		t.Fatalf("Expected the rewritten envelope sender, got %q (%q, %v)", sender, original, err)
+	}
+
+	// neither the local messages nor the null sender are rewritten
+	for _, m := range []*Message{
+		{From: mail.Address{Address: "noreply@App.example.com"}},
+		{From: mail.Address{Address: "john@example.com"}, NullSender: true},
+	} {
+		if err := Chain(next, SRSRewrite(srs)).Send(m); err != nil {
+			t.Fatal(err)
+		}
+		if sender != envelopeSender(m) {
+			t.Fatalf("Expected the envelope sender %q to be kept, got %q", envelopeSender(m), sender)
+		}
+	}
+}
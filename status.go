@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// Status mirrors the RoadRunner status plugin response,
+// extended with the mailer state for the health tooling.
+type Status struct {
+	Code int
+
+	Backend     string    `json:"backend,omitempty"`    // the active backend name, eg. "smtp"
+	DryRun      bool      `json:"dry_run,omitempty"`    // whether the messages are discarded (see [Plugin.SwitchBackend])
+	Version     string    `json:"version,omitempty"`    // the RoadRunner version, if known
+	QueueDepth  int       `json:"queue_depth"`          // the messages waiting in the queue (if any)
+	LastSent    time.Time `json:"last_sent"`            // the time of the last successful send
+	LastError   string    `json:"last_error,omitempty"` // the last send (or ping) error
+	LastErrorAt time.Time `json:"last_error_at"`        // the time of the last error
+}
+
+// sendTracker records the outcome of the last sends.
+type sendTracker struct {
+	mu          sync.Mutex
+	lastSent    time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// Middleware records the outcome of the next sends.
+func (s *sendTracker) Middleware(next Mailer) Mailer {
+	return MailerFunc(func(m *Message) error {
+		err := next.Send(m)
+
+		s.mu.Lock()
+		if err != nil {
+			s.lastError, s.lastErrorAt = err.Error(), time.Now()
+		} else {
+			s.lastSent = time.Now()
+		}
+		s.mu.Unlock()
+
+		return err
+	})
+}
+
+// report sets the last sends outcome of the status.
+func (s *sendTracker) report(status *Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.LastSent = s.lastSent
+	status.LastError = s.lastError
+	status.LastErrorAt = s.lastErrorAt
+}
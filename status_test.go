@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/mail"
+	"testing"
+)
+
+func TestPluginStatus(t *testing.T) {
+	p := &Plugin{}
+	if err := p.Init(MapConfig{PluginName: map[string]any{"null": map[string]any{}, "queue": map[string]any{"workers": 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := p.Status()
+	if err != nil || status.Code != http.StatusOK || status.Backend != "null" || !status.LastSent.IsZero() {
+		t.Fatalf("Expected the healthy null backend status, got %+v, %v", status, err)
+	}
+
+	p.queue.Pause()
+	if err := p.Mailer().Send(&Message{To: []mail.Address{{Address: "to@example.com"}}, Subject: "queued"}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := p.Status(); status.QueueDepth != 1 {
+		t.Fatalf("Expected the queued message to be reported, got %+v", status)
+	}
+
+	p.Serve()
+	p.queue.Resume()
+	waitFor(t, func() bool {
+		status, _ := p.Status()
+		return !status.LastSent.IsZero() && status.QueueDepth == 0
+	})
+
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var tracker sendTracker
+	failing := tracker.Middleware(MailerFunc(func(*Message) error { return errors.New("550 rejected") }))
+	if err := failing.Send(&Message{}); err == nil {
+		t.Fatal("Expected the send error")
+	}
+
+	var s Status
+	tracker.report(&s)
+	if s.LastError != "550 rejected" || s.LastErrorAt.IsZero() {
+		t.Fatalf("Expected the last error to be reported, got %+v", s)
+	}
+}
@@ -0,0 +1,352 @@
+package mailer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSubmitPath        = "/send"
+	defaultSubmitMaxBodySize = 25 << 20
+)
+
+// SubmitKey is an API key of the submission endpoint bound to a tenant
+// and to the tags its messages may have.
+type SubmitKey struct {
+	Key    string   `mapstructure:"key" json:"key" bson:"key"`
+	Tenant string   `mapstructure:"tenant" json:"tenant,omitempty" bson:"tenant,omitempty"` // the messages are sent on behalf of the tenant (see [TenantMailer.For])
+	Tags   []string `mapstructure:"tags" json:"tags,omitempty" bson:"tags,omitempty"`       // the allowed message tags, any if empty
+}
+
+// allows reports whether the key allows all the tags.
+func (k SubmitKey) allows(tags []string) bool {
+	if len(k.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range tags {
+		if !slices.ContainsFunc(k.Tags, func(allowed string) bool { return strings.EqualFold(allowed, strings.TrimSpace(tag)) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SubmitConfig defines the HTTP submission endpoint settings.
+type SubmitConfig struct {
+	Path        string      `mapstructure:"path" json:"path,omitempty" bson:"path,omitempty"`                            // default to "/send"
+	APIKeys     []string    `mapstructure:"api_keys" json:"api_keys,omitempty" bson:"api_keys,omitempty"`                // accepted keys, sent as "Authorization: Bearer {key}" or "X-API-Key" header
+	Keys        []SubmitKey `mapstructure:"keys" json:"keys,omitempty" bson:"keys,omitempty"`                            // accepted keys bound to a tenant or tags, sent the same way
+	MaxBodySize int64       `mapstructure:"max_body_size" json:"max_body_size,omitempty" bson:"max_body_size,omitempty"` // max request size in bytes, default to 25MB
+	AllowedVia  []string    `mapstructure:"allowed_via" json:"allowed_via,omitempty" bson:"allowed_via,omitempty"`       // backends the messages may select with "via", none by default
+
+	// Templates is the optional registry of the submitted messages templates.
+	Templates *Templates `mapstructure:"-" json:"-" bson:"-"`
+
+	// Tenants are the tenant mailers the messages of the Keys bound to a tenant are sent with.
+	Tenants *TenantMailer `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when a submitted message could not
+	// be sent, with the error details the client only gets a generic message of.
+	OnError func(m *Message, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the submission endpoint configuration for common mistakes.
+func (c SubmitConfig) Validate() error {
+	var errs []error
+
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		errs = append(errs, fmt.Errorf("http: path must start with /, got %q", c.Path))
+	}
+
+	if len(c.APIKeys)+len(c.Keys) == 0 {
+		errs = append(errs, errors.New("http: at least one api key is required"))
+	}
+	for i, key := range c.APIKeys {
+		if strings.TrimSpace(key) == "" {
+			errs = append(errs, fmt.Errorf("http: api_keys[%d] must not be empty", i))
+		}
+	}
+	for i, key := range c.Keys {
+		if strings.TrimSpace(key.Key) == "" {
+			errs = append(errs, fmt.Errorf("http: keys[%d] key must not be empty", i))
+		}
+	}
+
+	if c.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf("http: max_body_size must be positive, got %d", c.MaxBodySize))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c SubmitConfig) Redacted() SubmitConfig {
+	keys := make([]string, len(c.APIKeys))
+	for i, key := range c.APIKeys {
+		keys[i] = redact(key)
+	}
+	c.APIKeys = keys
+
+	scoped := make([]SubmitKey, len(c.Keys))
+	for i, key := range c.Keys {
+		key.Key = redact(key.Key)
+		scoped[i] = key
+	}
+	c.Keys = scoped
+	c.Tenants, c.OnError = nil, nil
+
+	return c
+}
+
+func (c SubmitConfig) path() string {
+	if c.Path == "" {
+		return defaultSubmitPath
+	}
+
+	return c.Path
+}
+
+// SubmitResponse is the JSON response of the submission endpoint.
+type SubmitResponse struct {
+	Status string `json:"status"` // either "sent" or "failed"
+	Error  string `json:"error,omitempty"`
+}
+
+// SubmitHandler is the HTTP endpoint for the services that can't speak
+// SMTP, sending the [JSONMessage] of the POST requests with a mailer.
+//
+// The message is either the request JSON body or, for the
+// "multipart/form-data" requests, the "message" field, while the
+// "attachments" and "inline" files are attached by their file name.
+//
+// The messages of the [SubmitKey] bound to a tenant are sent with its
+// tenant mailer, and the send errors are reported to the client without
+// their details (eg. the relay responses), which are passed to OnError.
+type SubmitHandler struct {
+	mailer Mailer
+	config SubmitConfig
+}
+
+// NewSubmitHandler creates a new submission endpoint sending with mailer.
+func NewSubmitHandler(mailer Mailer, config SubmitConfig) *SubmitHandler {
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultSubmitMaxBodySize
+	}
+
+	return &SubmitHandler{mailer: mailer, config: config}
+}
+
+// Middleware returns a handler serving the submission endpoint
+// at the configured path and everything else with next.
+func (h *SubmitHandler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != h.config.path() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP implements [http.Handler] interface.
+func (h *SubmitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeSubmitError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	key, ok := h.authorized(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeSubmitError(w, http.StatusUnauthorized, errors.New("invalid api key"))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.config.MaxBodySize)
+
+	msg, err := h.decode(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeSubmitError(w, status, err)
+		return
+	}
+
+	if err := msg.CheckVia(h.config.AllowedVia); err != nil {
+		writeSubmitError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if !key.allows(msg.Tags) {
+		writeSubmitError(w, http.StatusForbidden, errors.New("the message tags are not allowed for the api key"))
+		return
+	}
+
+	m, err := msg.Message(h.config.Templates)
+	if err != nil {
+		writeSubmitError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	mailer := h.mailer
+	if key.Tenant != "" {
+		if mailer, err = h.tenant(key.Tenant); err != nil {
+			h.failed(m, err)
+			writeSubmitError(w, http.StatusInternalServerError, errors.New("the api key tenant is not available"))
+			return
+		}
+	}
+
+	if err := mailer.Send(m); err != nil {
+		h.failed(m, err)
+
+		var validationErr *MessageValidationError
+		switch at, deferred := RetryAt(err); {
+		case errors.As(err, &validationErr):
+			writeSubmitError(w, http.StatusBadRequest, err)
+		case deferred:
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(max(time.Until(at), 0).Seconds())), 10))
+			writeSubmitError(w, http.StatusServiceUnavailable, errors.New("the message is deferred, retry later"))
+		case IsTemporary(err) || errors.Is(err, ErrQueueFull):
+			writeSubmitError(w, http.StatusServiceUnavailable, errors.New("the message could not be sent, retry later"))
+		default:
+			writeSubmitError(w, http.StatusBadGateway, errors.New("the message could not be sent"))
+		}
+		return
+	}
+
+	writeSubmitResponse(w, http.StatusOK, SubmitResponse{Status: string(DeliverySent)})
+}
+
+// tenant returns the mailer of the api key tenant.
+func (h *SubmitHandler) tenant(id string) (Mailer, error) {
+	if h.config.Tenants == nil {
+		return nil, fmt.Errorf("%w %q, the tenants are not configured", ErrUnknownTenant, id)
+	}
+
+	return h.config.Tenants.For(id)
+}
+
+// failed reports the send error details with OnError.
+func (h *SubmitHandler) failed(m *Message, err error) {
+	if h.config.OnError != nil {
+		h.config.OnError(m, err)
+	}
+}
+
+// authorized checks the request api key in constant time,
+// returning the matching key (unbound for the APIKeys).
+func (h *SubmitHandler) authorized(r *http.Request) (SubmitKey, bool) {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		key = auth[7:]
+	}
+	if key == "" {
+		return SubmitKey{}, false
+	}
+
+	authorized := 0
+	for _, apiKey := range h.config.APIKeys {
+		authorized |= subtle.ConstantTimeCompare([]byte(key), []byte(apiKey))
+	}
+
+	var matched SubmitKey
+	for _, scoped := range h.config.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(scoped.Key)) == 1 {
+			matched, authorized = scoped, 1
+		}
+	}
+
+	return matched, authorized == 1
+}
+
+// decode reads the submitted message, either from the JSON body
+// or from the fields and files of a multipart form.
+func (h *SubmitHandler) decode(r *http.Request) (*JSONMessage, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType != "multipart/form-data" {
+		return decodeJSONMessage(r.Body)
+	}
+
+	msg := &JSONMessage{}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]map[string][]byte{}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch field := part.FormName(); field {
+		case "message":
+			if msg, err = decodeJSONMessage(part); err != nil {
+				return nil, err
+			}
+		case "attachments", "inline":
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			if part.FileName() == "" {
+				return nil, fmt.Errorf("the %s files must have a name", field)
+			}
+			if files[field] == nil {
+				files[field] = map[string][]byte{}
+			}
+			files[field][part.FileName()] = data
+		default:
+			return nil, fmt.Errorf("unknown form field %q", field)
+		}
+	}
+
+	for name, data := range files["attachments"] {
+		if msg.Attachments == nil {
+			msg.Attachments = map[string][]byte{}
+		}
+		msg.Attachments[name] = data
+	}
+	for name, data := range files["inline"] {
+		if msg.Inline == nil {
+			msg.Inline = map[string][]byte{}
+		}
+		msg.Inline[name] = data
+	}
+
+	return msg, nil
+}
+
+func writeSubmitError(w http.ResponseWriter, status int, err error) {
+	writeSubmitResponse(w, status, SubmitResponse{Status: string(DeliveryFailed), Error: err.Error()})
+}
+
+func writeSubmitResponse(w http.ResponseWriter, status int, response SubmitResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,174 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestSubmitHandler(t *testing.T) {
+	var sent *Message
+	var sendErr, reported error
+
+	handler := NewSubmitHandler(MailerFunc(func(m *Message) error {
+		sent = m
+		return sendErr
+	}), SubmitConfig{APIKeys: []string{"old", "secret"}, MaxBodySize: 1024, AllowedVia: []string{"ses"}, OnError: func(m *Message, err error) {
+		reported = err
+	}})
+
+	server := httptest.NewServer(handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	defer server.Close()
+
+	message := `{"from":"sender@example.com","to":["to@example.com"],"subject":"Hello","text":"hello"}`
+	via := func(backend string) string {
+		return `{"to":["to@example.com"],"subject":"Hello","text":"hello","via":"` + backend + `"}`
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	_ = mw.WriteField("message", message)
+	file, _ := mw.CreateFormFile("attachments", "report.txt")
+	_, _ = file.Write([]byte("report"))
+	_ = mw.Close()
+
+	scenarios := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		headers     map[string]string
+		sendErr     error
+		status      int
+	}{
+		{"other path", http.MethodPost, "/other", "", "", nil, nil, http.StatusTeapot},
+		{"method not allowed", http.MethodGet, "/send", "", "", map[string]string{"X-API-Key": "secret"}, nil, http.StatusMethodNotAllowed},
+		{"missing api key", http.MethodPost, "/send", "application/json", message, nil, nil, http.StatusUnauthorized},
+		{"invalid api key", http.MethodPost, "/send", "application/json", message, map[string]string{"Authorization": "Bearer invalid"}, nil, http.StatusUnauthorized},
+		{"json", http.MethodPost, "/send", "application/json", message, map[string]string{"Authorization": "Bearer secret"}, nil, http.StatusOK},
+		{"multipart", http.MethodPost, "/send", mw.FormDataContentType(), form.String(), map[string]string{"X-API-Key": "old"}, nil, http.StatusOK},
+		{"allowed backend", http.MethodPost, "/send", "application/json", via("ses"), map[string]string{"X-API-Key": "secret"}, nil, http.StatusOK},
+		{"backend not allowed", http.MethodPost, "/send", "application/json", via("smtp"), map[string]string{"X-API-Key": "secret"}, nil, http.StatusForbidden},
+		{"invalid message", http.MethodPost, "/send", "application/json", `{"to":["to@example.com"]}`, map[string]string{"X-API-Key": "secret"}, nil, http.StatusBadRequest},
+		{"too large", http.MethodPost, "/send", "application/json", `{"text":"` + strings.Repeat("x", 2000) + `"}`, map[string]string{"X-API-Key": "secret"}, nil, http.StatusRequestEntityTooLarge},
+		{"send failure", http.MethodPost, "/send", "application/json", message, map[string]string{"X-API-Key": "secret"}, errors.New("rejected"), http.StatusBadGateway},
+		{"temporary failure", http.MethodPost, "/send", "application/json", message, map[string]string{"X-API-Key": "secret"}, &textproto.Error{Code: 421, Msg: "busy"}, http.StatusServiceUnavailable},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			sent, sendErr, reported = nil, s.sendErr, nil
+
+			req, _ := http.NewRequest(s.method, server.URL+s.path, strings.NewReader(s.body))
+			req.Header.Set("Content-Type", s.contentType)
+			for name, value := range s.headers {
+				req.Header.Set(name, value)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != s.status {
+				body, _ := io.ReadAll(res.Body)
+				t.Fatalf("Expected status %d, got %d: %s", s.status, res.StatusCode, body)
+			}
+			if s.path != "/send" {
+				return
+			}
+
+			var response SubmitResponse
+			if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if expected := s.status == http.StatusOK; (response.Status == "sent") != expected || (response.Error == "") != expected {
+				t.Fatalf("Unexpected response %+v", response)
+			}
+			if s.sendErr != nil && (strings.Contains(response.Error, s.sendErr.Error()) || !errors.Is(reported, s.sendErr)) {
+				t.Fatalf("Expected a generic error with the details reported, got %q (reported %v)", response.Error, reported)
+			}
+			if s.status == http.StatusOK && (sent == nil || sent.Subject != "Hello") {
+				t.Fatalf("Expected the message to be sent, got %+v", sent)
+			}
+			if strings.HasPrefix(s.contentType, "multipart/") {
+				if data, _ := io.ReadAll(sent.Attachments["report.txt"]); string(data) != "report" {
+					t.Fatalf("Expected the attached file, got %q", data)
+				}
+			}
+		})
+	}
+}
+
+func TestSubmitHandlerKeys(t *testing.T) {
+	var sentBy string
+	recorder := func(name string) Mailer {
+		return MailerFunc(func(m *Message) error {
+			sentBy = name
+			return nil
+		})
+	}
+
+	tenants := NewTenantMailer(recorder("default"))
+	if err := tenants.Add("acme", recorder("acme"), mail.Address{Address: "noreply@acme.example"}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewSubmitHandler(tenants, SubmitConfig{
+		APIKeys: []string{"secret"},
+		Keys: []SubmitKey{
+			{Key: "acme", Tenant: "acme", Tags: []string{"welcome"}},
+			{Key: "unknown", Tenant: "initech"},
+		},
+		Tenants: tenants,
+	})
+
+	message := func(tag string) string {
+		return `{"to":["to@example.com"],"subject":"Hello","text":"hello","tags":["` + tag + `"]}`
+	}
+
+	scenarios := []struct {
+		name       string
+		key        string
+		body       string
+		status     int
+		expectedBy string
+	}{
+		{"unbound key", "secret", message("lane:bulk"), http.StatusOK, "default"},
+		{"tenant key", "acme", message("Welcome"), http.StatusOK, "acme"},
+		{"tag not allowed", "acme", message("lane:bulk"), http.StatusForbidden, ""},
+		{"unknown tenant", "unknown", message("welcome"), http.StatusInternalServerError, ""},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			sentBy = ""
+
+			req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(s.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", s.key)
+
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != s.status {
+				t.Fatalf("Expected status %d, got %d: %s", s.status, res.Code, res.Body)
+			}
+			if sentBy != s.expectedBy {
+				t.Fatalf("Expected to be sent by %q, got %q", s.expectedBy, sentBy)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSuppressionTimeout = 10 * time.Second
+
+// testHeader marks the test messages (see [MessageBuilder.Test]).
+const testHeader = "X-Test"
+
+var (
+	_ SuppressionList = (*MemorySuppressionList)(nil)
+	_ SuppressionList = (*RedisSuppressionList)(nil)
+)
+
+// SuppressionReason is the reason of a [Suppression].
+type SuppressionReason string
+
+const (
+	SuppressionBounce    SuppressionReason = "bounce"    // the address hard bounced
+	SuppressionComplaint SuppressionReason = "complaint" // the recipient reported a message as spam
+	SuppressionManual    SuppressionReason = "manual"
+)
+
+// Suppression is a suppressed recipient address.
+type Suppression struct {
+	Address string            `json:"address"`
+	Reason  SuppressionReason `json:"reason"`
+	Detail  string            `json:"detail,omitempty"` // eg. the bounce diagnostic
+	At      time.Time         `json:"at"`
+}
+
+// SuppressionList stores the addresses that must not receive messages
+// anymore (eg. the hard bounced ones), looked up case-insensitively.
+type SuppressionList interface {
+	// Suppress adds (or replaces) the suppression of the address.
+	Suppress(ctx context.Context, s Suppression) error
+	// Lookup returns the suppression of the address, or nil if it is not suppressed.
+	Lookup(ctx context.Context, address string) (*Suppression, error)
+	// Remove removes the suppression of the address, if any.
+	Remove(ctx context.Context, address string) error
+}
+
+// SuppressedError is returned when all recipients of a message are suppressed.
+type SuppressedError struct {
+	Suppressions []Suppression
+}
+
+func (e *SuppressedError) Error() string {
+	addresses := make([]string, len(e.Suppressions))
+	for i, s := range e.Suppressions {
+		addresses[i] = s.Address + " (" + string(s.Reason) + ")"
+	}
+
+	return "all recipients are suppressed: " + strings.Join(addresses, ", ")
+}
+
+// Suppressed returns a middleware that removes the suppressed recipients
+// of the messages, failing with a [SuppressedError] if none is left.
+//
+// The optional onSuppressed hook is called with the removed
+// recipients of the messages that are still sent.
+//
+// The test messages (see [MessageBuilder.Test]) are sent to all recipients.
+func Suppressed(list SuppressionList, onSuppressed func(m *Message, suppressed []Suppression)) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if m.test {
+				return next.Send(m)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), defaultSuppressionTimeout)
+			defer cancel()
+
+			var suppressed []Suppression
+			filtered := m.Clone()
+
+			for _, addresses := range []*[]mail.Address{&filtered.To, &filtered.Cc, &filtered.Bcc} {
+				var kept []mail.Address
+				for _, addr := range *addresses {
+					s, err := list.Lookup(ctx, addr.Address)
+					if err != nil {
+						return fmt.Errorf("failed to look up the suppression of %s: %w", addr.Address, err)
+					}
+					if s != nil {
+						suppressed = append(suppressed, *s)
+						continue
+					}
+					kept = append(kept, addr)
+				}
+				*addresses = kept
+			}
+
+			if len(suppressed) == 0 {
+				return next.Send(m)
+			}
+
+			if len(filtered.To)+len(filtered.Cc)+len(filtered.Bcc) == 0 {
+				return &SuppressedError{Suppressions: suppressed}
+			}
+
+			if onSuppressed != nil {
+				onSuppressed(m, suppressed)
+			}
+
+			return next.Send(filtered)
+		})
+	}
+}
+
+// MemorySuppressionList is an in-memory [SuppressionList], suitable for a single instance.
+//
+// The zero value is ready to use.
+type MemorySuppressionList struct {
+	mu           sync.RWMutex
+	suppressions map[string]Suppression
+}
+
+// Suppress implements [SuppressionList] interface.
+func (l *MemorySuppressionList) Suppress(_ context.Context, s Suppression) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.suppressions == nil {
+		l.suppressions = map[string]Suppression{}
+	}
+	if s.At.IsZero() {
+		s.At = time.Now()
+	}
+	l.suppressions[strings.ToLower(s.Address)] = s
+
+	return nil
+}
+
+// Lookup implements [SuppressionList] interface.
+func (l *MemorySuppressionList) Lookup(_ context.Context, address string) (*Suppression, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	s, ok := l.suppressions[strings.ToLower(address)]
+	if !ok {
+		return nil, nil
+	}
+
+	return &s, nil
+}
+
+// Remove implements [SuppressionList] interface.
+func (l *MemorySuppressionList) Remove(_ context.Context, address string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.suppressions, strings.ToLower(address))
+
+	return nil
+}
+
+// RedisSuppressionList is a [SuppressionList] backed by Redis,
+// sharing the suppressions between multiple instances.
+type RedisSuppressionList struct {
+	client *redisClient
+}
+
+// NewRedisSuppressionList creates a new Redis suppression list.
+func NewRedisSuppressionList(config RedisConfig) *RedisSuppressionList {
+	return &RedisSuppressionList{client: newRedisClient(config)}
+}
+
+func (l *RedisSuppressionList) key(address string) string {
+	return l.client.config.prefix() + "suppression:" + strings.ToLower(address)
+}
+
+// Suppress implements [SuppressionList] interface.
+func (l *RedisSuppressionList) Suppress(ctx context.Context, s Suppression) error {
+	if s.At.IsZero() {
+		s.At = time.Now()
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.client.do(ctx, "SET", l.key(s.Address), string(data))
+
+	return err
+}
+
+// Lookup implements [SuppressionList] interface.
+func (l *RedisSuppressionList) Lookup(ctx context.Context, address string) (*Suppression, error) {
+	reply, err := l.client.do(ctx, "GET", l.key(address))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+
+	var s Suppression
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil, fmt.Errorf("redis: invalid suppression of %s: %w", address, err)
+	}
+
+	return &s, nil
+}
+
+// Remove implements [SuppressionList] interface.
+func (l *RedisSuppressionList) Remove(ctx context.Context, address string) error {
+	_, err := l.client.do(ctx, "DEL", l.key(address))
+
+	return err
+}
+
+// Close closes the Redis connection.
+func (l *RedisSuppressionList) Close() error {
+	return l.client.close()
+}
@@ -0,0 +1,163 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"testing"
+)
+
+func TestSuppressed(t *testing.T) {
+	list := &MemorySuppressionList{}
+	_ = list.Suppress(context.Background(), Suppression{Address: "Bounced@example.com", Reason: SuppressionBounce})
+
+	scenarios := []struct {
+		name       string
+		to         []string
+		cc         []string
+		expected   []string // the expected sent recipients, nil if not sent
+		suppressed int
+	}{
+		{"none suppressed", []string{"user@example.com"}, nil, []string{"user@example.com"}, 0},
+		{"some suppressed", []string{"user@example.com"}, []string{"bounced@example.com"}, []string{"user@example.com"}, 1},
+		{"all suppressed", []string{"bounced@EXAMPLE.com"}, nil, nil, 1},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var sent *Message
+			var hooked []Suppression
+
+			mailer := Chain(MailerFunc(func(m *Message) error {
+				sent = m
+				return nil
+			}), Suppressed(list, func(_ *Message, suppressed []Suppression) { hooked = suppressed }))
+
+			builder := NewMessage().From("app@example.com").Subject("Hello").Text("Hello")
+			for _, to := range s.to {
+				builder = builder.To(to)
+			}
+			for _, cc := range s.cc {
+				builder = builder.Cc(cc)
+			}
+			m, _ := builder.Build()
+
+			err := mailer.Send(m)
+
+			if s.expected == nil {
+				var suppressedErr *SuppressedError
+				if !errors.As(err, &suppressedErr) || len(suppressedErr.Suppressions) != s.suppressed {
+					t.Fatalf("Expected a SuppressedError, got %v", err)
+				}
+				if sent != nil {
+					t.Fatal("Expected the message not to be sent")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var recipients []string
+			for _, addresses := range [][]mail.Address{sent.To, sent.Cc, sent.Bcc} {
+				for _, addr := range addresses {
+					recipients = append(recipients, addr.Address)
+				}
+			}
+			if len(recipients) != len(s.expected) || recipients[0] != s.expected[0] {
+				t.Fatalf("Expected recipients %v, got %v", s.expected, recipients)
+			}
+			if len(hooked) != s.suppressed {
+				t.Fatalf("Expected %d suppressed recipients reported, got %v", s.suppressed, hooked)
+			}
+			if len(m.Cc) != len(s.cc) {
+				t.Fatal("Expected the original message to be left untouched")
+			}
+		})
+	}
+}
+
+func TestMemorySuppressionList(t *testing.T) {
+	ctx := context.Background()
+	list := &MemorySuppressionList{}
+
+	if s, err := list.Lookup(ctx, "user@example.com"); s != nil || err != nil {
+		t.Fatalf("Expected no suppression, got %v, %v", s, err)
+	}
+
+	_ = list.Suppress(ctx, Suppression{Address: "User@example.com", Reason: SuppressionComplaint})
+
+	s, err := list.Lookup(ctx, "user@EXAMPLE.com")
+	if err != nil || s == nil || s.Reason != SuppressionComplaint || s.At.IsZero() {
+		t.Fatalf("Expected the complaint suppression, got %v, %v", s, err)
+	}
+
+	_ = list.Remove(ctx, "USER@example.com")
+	if s, _ := list.Lookup(ctx, "user@example.com"); s != nil {
+		t.Fatalf("Expected the suppression to be removed, got %v", s)
+	}
+}
+
+func TestRedisSuppressionList(t *testing.T) {
+	ctx := context.Background()
+	address, _ := newTestRedis(t, "")
+
+	list := NewRedisSuppressionList(RedisConfig{Address: address})
+	defer list.Close()
+
+	// a second instance sharing the list
+	other := NewRedisSuppressionList(RedisConfig{Address: address})
+	defer other.Close()
+
+	if s, err := list.Lookup(ctx, "user@example.com"); s != nil || err != nil {
+		t.Fatalf("Expected no suppression, got %v, %v", s, err)
+	}
+
+	if err := list.Suppress(ctx, Suppression{Address: "User@example.com", Reason: SuppressionBounce, Detail: "5.1.1 unknown user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := other.Lookup(ctx, "user@EXAMPLE.com")
+	if err != nil || s == nil || s.Reason != SuppressionBounce || s.Detail != "5.1.1 unknown user" || s.At.IsZero() {
+		t.Fatalf("Expected the shared bounce suppression, got %v, %v", s, err)
+	}
+
+	if err := other.Remove(ctx, "USER@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := list.Lookup(ctx, "user@example.com"); s != nil {
+		t.Fatalf("Expected the suppression to be removed, got %v", s)
+	}
+}
+
+func TestSuppressedTestMessage(t *testing.T) {
+	list := &MemorySuppressionList{}
+	_ = list.Suppress(context.Background(), Suppression{Address: "staff@example.com", Reason: SuppressionBounce})
+
+	var sent *Message
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		sent = m
+		return nil
+	}), Suppressed(list, nil))
+
+	m, err := NewMessage().From("app@example.com").To("staff@example.com").Subject("Preview").Text("Hello").Test().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send(m); err != nil {
+		t.Fatalf("Expected the test message to bypass the suppression list, got %v", err)
+	}
+	if sent == nil || headerValue(sent, "X-Test") != "true" {
+		t.Fatalf("Expected the test message to be sent with the X-Test header, got %+v", sent)
+	}
+
+	// the header alone doesn't bypass the suppression list
+	spoofed, _ := NewMessage().From("app@example.com").To("staff@example.com").Subject("Preview").Text("Hello").Header("X-Test", "true").Build()
+
+	var suppressedErr *SuppressedError
+	if err := mailer.Send(spoofed); !errors.As(err, &suppressedErr) {
+		t.Fatalf("Expected SuppressedError, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ErrDryRun is returned by the [SwitchMailer] discarding the messages in
+// dry-run mode, so that they are not recorded as sent (eg. by the [Queue]).
+var ErrDryRun = errors.New("the message was discarded in dry-run mode")
+
+var (
+	_ Mailer    = (*SwitchMailer)(nil)
+	_ Pinger    = (*SwitchMailer)(nil)
+	_ Capable   = (*SwitchMailer)(nil)
+	_ io.Closer = (*SwitchMailer)(nil)
+)
+
+// BackendSwitch describes a runtime change of the [SwitchMailer]
+// active backend or dry-run mode, eg. for the audit log.
+type BackendSwitch struct {
+	From   string `json:"from"`             // the previously active backend
+	To     string `json:"to"`               // the newly active backend
+	DryRun bool   `json:"dry_run"`          // whether the messages are discarded
+	Actor  string `json:"actor,omitempty"`  // who requested the change, eg. "ops@example.com"
+	Reason string `json:"reason,omitempty"` // why the change was requested, eg. "SES outage"
+}
+
+// SwitchMailer implements [mailer.Mailer] interface and sends through one
+// of the named mailers, which can be switched at runtime without redeploying
+// (eg. from SES to a backup SMTP relay), or discards the messages while in
+// dry-run mode.
+type SwitchMailer struct {
+	// Resolve is an optional hook creating the named mailer on its first
+	// switch, for the mailers not provided to [NewSwitchMailer].
+	Resolve func(name string) (Mailer, error)
+
+	// OnSwitch is an optional hook called after every change, eg. to audit it.
+	OnSwitch func(change BackendSwitch)
+
+	mu      sync.RWMutex
+	mailers map[string]Mailer
+	active  string
+	dryRun  bool
+}
+
+// NewSwitchMailer creates a new mailer sending through the named mailers,
+// starting with the active one.
+func NewSwitchMailer(active string, mailers map[string]Mailer) *SwitchMailer {
+	s := &SwitchMailer{mailers: make(map[string]Mailer, len(mailers)), active: active}
+	for name, mailer := range mailers {
+		s.mailers[name] = mailer
+	}
+
+	return s
+}
+
+// Send implements `mailer.Mailer` interface, sending the message through
+// the active mailer, or the one named by [Message.Via] (resolving it first,
+// if it is not created yet), or discarding it in dry-run mode with [ErrDryRun].
+func (s *SwitchMailer) Send(m *Message) error {
+	s.mu.RLock()
+	name, dryRun := s.active, s.dryRun
+	if m.Via != "" {
+		name = m.Via
+	}
+	mailer := s.mailers[name]
+	s.mu.RUnlock()
+
+	if dryRun {
+		return ErrDryRun
+	}
+
+	if mailer == nil {
+		if m.Via == "" {
+			return fmt.Errorf("backend %q is not configured", name)
+		}
+
+		var err error
+
+		s.mu.Lock()
+		mailer, err = s.resolve(name)
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return mailer.Send(m)
+}
+
+// resolve returns the named mailer, creating it with Resolve if
+// it is not created yet. It must be called with the lock held.
+func (s *SwitchMailer) resolve(name string) (Mailer, error) {
+	if mailer, ok := s.mailers[name]; ok {
+		return mailer, nil
+	}
+
+	if s.Resolve == nil {
+		return nil, fmt.Errorf("backend %q is not configured", name)
+	}
+
+	mailer, err := s.Resolve(name)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", name, err)
+	}
+	s.mailers[name] = mailer
+
+	return mailer, nil
+}
+
+// Active returns the name of the active mailer.
+func (s *SwitchMailer) Active() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.active
+}
+
+// Gate returns the mailer sending through next, unless the switch is in
+// dry-run mode, discarding the messages with [ErrDryRun] like the switch
+// itself, eg. for the backends sent through directly (such as the tenant ones).
+func (s *SwitchMailer) Gate(next Mailer) Mailer {
+	return &dryRunGate{switcher: s, next: next}
+}
+
+// dryRunGate is the mailer of [SwitchMailer.Gate].
+type dryRunGate struct {
+	switcher *SwitchMailer
+	next     Mailer
+}
+
+func (g *dryRunGate) Send(m *Message) error {
+	if g.switcher.DryRun() {
+		return ErrDryRun
+	}
+
+	return g.next.Send(m)
+}
+
+// Capabilities implements `mailer.Capable` interface, reporting the next mailer ones.
+func (g *dryRunGate) Capabilities() Capabilities {
+	return CapabilitiesOf(g.next)
+}
+
+// DryRun reports whether the messages are discarded instead of sent.
+func (s *SwitchMailer) DryRun() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dryRun
+}
+
+// Backends returns the names of the mailers created so far, sorted.
+func (s *SwitchMailer) Backends() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.mailers))
+	for name := range s.mailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Switch makes the named mailer the active one (resolving it first, if
+// it is not created yet) and sets the dry-run mode, calling OnSwitch with
+// the actor and reason of the change. The in-flight sends complete with
+// the previously active mailer.
+func (s *SwitchMailer) Switch(name string, dryRun bool, actor, reason string) error {
+	if name == "" {
+		name = s.Active()
+	}
+
+	s.mu.Lock()
+
+	if _, err := s.resolve(name); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	change := BackendSwitch{From: s.active, To: name, DryRun: dryRun, Actor: actor, Reason: reason}
+	s.active, s.dryRun = name, dryRun
+
+	s.mu.Unlock()
+
+	if s.OnSwitch != nil {
+		s.OnSwitch(change)
+	}
+
+	return nil
+}
+
+// Capabilities implements `mailer.Capable` interface, reporting
+// the features supported by the active mailer.
+func (s *SwitchMailer) Capabilities() Capabilities {
+	s.mu.RLock()
+	mailer := s.mailers[s.active]
+	s.mu.RUnlock()
+
+	return CapabilitiesOf(mailer)
+}
+
+// Ping implements `mailer.Pinger` interface by pinging the active mailer (if it supports it).
+func (s *SwitchMailer) Ping(ctx context.Context) error {
+	s.mu.RLock()
+	mailer := s.mailers[s.active]
+	s.mu.RUnlock()
+
+	if pinger, ok := mailer.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+// Close closes all mailers that implement io.Closer.
+func (s *SwitchMailer) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var errs []error
+	for name, mailer := range s.mailers {
+		if closer, ok := mailer.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("backend %q: %w", name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
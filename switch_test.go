@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"testing"
+)
+
+func TestSwitchMailer(t *testing.T) {
+	sent := map[string]int{}
+	backend := func(name string) Mailer {
+		return MailerFunc(func(*Message) error {
+			sent[name]++
+			return nil
+		})
+	}
+
+	var changes []BackendSwitch
+	s := NewSwitchMailer("ses", map[string]Mailer{"ses": backend("ses")})
+	s.Resolve = func(name string) (Mailer, error) { return backend(name), nil }
+	s.OnSwitch = func(change BackendSwitch) { changes = append(changes, change) }
+
+	send := func() {
+		t.Helper()
+		if err := s.Send(&Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send()
+	if err := s.Switch("smtp", false, "ops@example.com", "SES outage"); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	if err := s.Switch("", true, "ops@example.com", "load test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(&Message{}); !errors.Is(err, ErrDryRun) {
+		t.Fatalf("Expected ErrDryRun, got %v", err)
+	}
+
+	if sent["ses"] != 1 || sent["smtp"] != 1 || s.Active() != "smtp" || !s.DryRun() {
+		t.Fatalf("Expected 1 message sent through each backend, got %v", sent)
+	}
+	if len(changes) != 2 || changes[0] != (BackendSwitch{From: "ses", To: "smtp", Actor: "ops@example.com", Reason: "SES outage"}) {
+		t.Fatalf("Expected the audited changes, got %+v", changes)
+	}
+	if names := s.Backends(); len(names) != 2 {
+		t.Fatalf("Expected the resolved backend to be kept, got %v", names)
+	}
+
+	if err := NewSwitchMailer("ses", nil).Switch("smtp", false, "", ""); err == nil {
+		t.Fatal("Expected the not configured backend error")
+	}
+}
+
+func TestSwitchMailerVia(t *testing.T) {
+	sent := map[string]int{}
+	backend := func(name string) Mailer {
+		return MailerFunc(func(*Message) error {
+			sent[name]++
+			return nil
+		})
+	}
+
+	s := NewSwitchMailer("ses", map[string]Mailer{"ses": backend("ses")})
+
+	if err := s.Send(&Message{Via: "relay"}); err == nil {
+		t.Fatal("Expected the not configured backend error")
+	}
+
+	s.Resolve = func(name string) (Mailer, error) { return backend(name), nil }
+
+	for _, via := range []string{"relay", "", "relay"} {
+		if err := s.Send(&Message{Via: via}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sent["ses"] != 1 || sent["relay"] != 2 || s.Active() != "ses" {
+		t.Fatalf("Expected 2 messages sent via the relay without switching, got %v", sent)
+	}
+	if names := s.Backends(); len(names) != 2 {
+		t.Fatalf("Expected the resolved backend to be kept, got %v", names)
+	}
+}
+
+func TestPluginSwitchBackend(t *testing.T) {
+	p := &Plugin{}
+	if err := p.Init(MapConfig{PluginName: map[string]any{"log": map[string]any{}, "null": map[string]any{}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SwitchBackend("smtp", false, "", ""); err == nil {
+		t.Fatal("Expected the not configured backend error")
+	}
+	if err := p.SwitchBackend("null", false, "ops", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Mailer().Send(&Message{To: []mail.Address{{Address: "to@example.com"}}, Subject: "switched"}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := p.Status(); status.Backend != "null" {
+		t.Fatalf("Expected the null backend to be active, got %+v", status)
+	}
+	if p.switcher.mailers["null"].(*NullMailer).Count() != 1 {
+		t.Fatal("Expected the message to be sent through the null backend")
+	}
+}
+
+func TestPluginSwitchBackendDryRunTenants(t *testing.T) {
+	p := &Plugin{}
+	err := p.Init(MapConfig{PluginName: map[string]any{
+		"null":    map[string]any{},
+		"tenants": map[string]any{"acme": map[string]any{"from": "info@acme.example.com", "log": map[string]any{}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SwitchBackend("", true, "ops", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	mailer, err := p.tenants.For("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(&Message{To: []mail.Address{{Address: "to@example.com"}}, Subject: "tenant"}); !errors.Is(err, ErrDryRun) {
+		t.Fatalf("Expected the tenant backend message to be discarded, got %v", err)
+	}
+	if status, _ := p.Status(); !status.DryRun {
+		t.Fatalf("Expected the dry-run mode, got %+v", status)
+	}
+
+	if err := p.SwitchBackend("", false, "ops", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(&Message{To: []mail.Address{{Address: "to@example.com"}}, Subject: "tenant"}); err != nil {
+		t.Fatalf("Expected the tenant backend message to be sent, got %v", err)
+	}
+}
+
+func TestQueueDryRun(t *testing.T) {
+	s := NewSwitchMailer("null", map[string]Mailer{"null": MailerFunc(func(*Message) error { return nil })})
+	if err := s.Switch("", true, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := NewQueue(s, QueueConfig{})
+	queue.Start()
+
+	dispositions := make(chan Disposition, 1)
+	if _, err := queue.Enqueue(&Message{}, WithDisposition(func(d Disposition) { dispositions <- d })); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := <-dispositions; d.Status != DeliveryDiscarded || !errors.Is(d.Err, ErrDryRun) {
+		t.Fatalf("Expected the discarded disposition, got %+v", d)
+	}
+
+	if err := queue.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dls := queue.DeadLetters(); len(dls) != 0 {
+		t.Fatalf("Expected no dead letter, got %+v", dls)
+	}
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	_ Mailer    = (*TeeMailer)(nil)
+	_ Pinger    = (*TeeMailer)(nil)
+	_ Capable   = (*TeeMailer)(nil)
+	_ io.Closer = (*TeeMailer)(nil)
+)
+
+// TeeMailer implements [mailer.Mailer] interface and delivers every
+// message through multiple mailers simultaneously (eg. SMTP and an archive).
+type TeeMailer struct {
+	Mailers []Mailer
+}
+
+// NewTeeMailer creates a new mailer that delivers through all the provided mailers.
+func NewTeeMailer(mailers ...Mailer) *TeeMailer {
+	return &TeeMailer{Mailers: mailers}
+}
+
+// Send implements `mailer.Mailer` interface.
+//
+// The message is sent concurrently through all mailers, waiting for all
+// of them to complete. The returned error joins the errors of all the
+// failed mailers (if any), each wrapped in a [TeeError].
+func (t *TeeMailer) Send(m *Message) error {
+	// every mailer gets its own copy of the attachments
+	m = m.Clone()
+	if err := m.bufferAttachments(); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(t.Mailers))
+
+	var wg sync.WaitGroup
+	for i, mailer := range t.Mailers {
+		wg.Add(1)
+		go func(i int, mailer Mailer, m *Message) {
+			defer wg.Done()
+			if err := mailer.Send(m); err != nil {
+				errs[i] = &TeeError{Index: i, Err: err}
+			}
+		}(i, mailer, m.Clone())
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Capabilities implements `mailer.Capable` interface, reporting
+// the features supported by all mailers.
+func (t *TeeMailer) Capabilities() Capabilities {
+	return commonCapabilities(t.Mailers)
+}
+
+// Ping implements `mailer.Pinger` interface by pinging all mailers that support it.
+func (t *TeeMailer) Ping(ctx context.Context) error {
+	var errs []error
+
+	for i, mailer := range t.Mailers {
+		if pinger, ok := mailer.(Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				errs = append(errs, &TeeError{Index: i, Err: err})
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close closes all mailers that implement io.Closer.
+func (t *TeeMailer) Close() error {
+	var errs []error
+
+	for i, mailer := range t.Mailers {
+		if closer, ok := mailer.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, &TeeError{Index: i, Err: err})
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// TeeError is the error of a single [TeeMailer] mailer.
+type TeeError struct {
+	Index int // the index of the failed mailer
+	Err   error
+}
+
+func (e *TeeError) Error() string {
+	return fmt.Sprintf("tee mailer %d: %v", e.Index, e.Err)
+}
+
+func (e *TeeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTeeMailerSend(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+
+	recorder := MailerFunc(func(m *Message) error {
+		data, err := io.ReadAll(m.Attachments["a.txt"])
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		received = append(received, string(data))
+		mu.Unlock()
+
+		return nil
+	})
+
+	failErr := errors.New("fail")
+	failing := MailerFunc(func(m *Message) error {
+		return failErr
+	})
+
+	tee := NewTeeMailer(recorder, failing, recorder)
+
+	// use a non cloneable reader to check that every mailer gets a copy
+	err := tee.Send(&Message{
+		Attachments: map[string]io.Reader{"a.txt": io.MultiReader(strings.NewReader("attachment"))},
+	})
+
+	var teeErr *TeeError
+	if !errors.As(err, &teeErr) || teeErr.Index != 1 || !errors.Is(err, failErr) {
+		t.Fatalf("Expected TeeError for mailer 1, got %v", err)
+	}
+
+	if len(received) != 2 || received[0] != "attachment" || received[1] != "attachment" {
+		t.Fatalf("Expected both mailers to receive the attachment, got %v", received)
+	}
+}
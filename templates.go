@@ -0,0 +1,486 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// ErrTemplateNotFound is returned when there is no variant of
+// the requested template for any locale of the fallback chain.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// MessageTemplate holds the sources of a single message template variant.
+//
+// Subject and Text are text/template sources and HTML is a
+// html/template one. At least one of the bodies is required.
+type MessageTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// RenderedTemplate is the result of a [Templates] rendering.
+type RenderedTemplate struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+
+	// Locale is the locale of the rendered variant, formatted as
+	// BCP 47 language tag (empty for the locale independent one).
+	Locale string `json:"locale,omitempty"`
+}
+
+// Templates is a registry of named message templates
+// with optional per-locale variants.
+//
+// A template is rendered in the first locale of the requested locale
+// fallback chain it has a variant for (see [Templates.LocaleChain]),
+// falling back to its locale independent variant (if any).
+//
+// The zero value is ready to use. Templates are safe for concurrent use, but
+// DefaultLocale, Fallbacks and Locales must not be changed after the first use.
+type Templates struct {
+	// DefaultLocale is the last locale tried before
+	// the locale independent variants (eg. "en").
+	DefaultLocale string
+
+	// Fallbacks overrides the fallback chains of specific locales,
+	// eg. {"de-AT": ["de-DE", "en"]}.
+	Fallbacks map[string][]string
+
+	// Locales are the extra locales of the loaded template files (see
+	// [Templates.Load]), eg. with a three letters language like "fil".
+	Locales []string
+
+	mu          sync.RWMutex
+	variants    map[string]map[string]*templateVariant // name -> normalized locale -> variant
+	experiments map[string][]ExperimentVariant         // name -> weighted variants (see [Templates.AddExperiment])
+}
+
+type templateVariant struct {
+	locale  string
+	source  MessageTemplate // linted by [Templates.LintTemplate]
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// TemplatesConfig defines the message templates settings.
+type TemplatesConfig struct {
+	// Dir is the directory the templates are loaded from (see [Templates.Load]),
+	// overriding the base ones (see [RegisterTemplates]). It may not exist if
+	// there are base templates, and is required otherwise.
+	Dir string `mapstructure:"dir" json:"dir,omitempty" bson:"dir,omitempty"`
+
+	// Reload is the interval the dir files are checked for changes at, hot
+	// reloading the templates (see [TemplatesConfig.Watcher]), disabled if 0.
+	Reload time.Duration `mapstructure:"reload" json:"reload,omitempty" bson:"reload,omitempty"`
+
+	// DefaultLocale is the last locale tried before the locale independent variants.
+	DefaultLocale string `mapstructure:"default_locale" json:"default_locale,omitempty" bson:"default_locale,omitempty"`
+
+	// Fallbacks overrides the fallback chains of specific locales, eg. {"de-AT": ["de-DE", "en"]}.
+	Fallbacks map[string][]string `mapstructure:"fallbacks" json:"fallbacks,omitempty" bson:"fallbacks,omitempty"`
+
+	// Locales are the extra locales of the template files (see [Templates.Locales]).
+	Locales []string `mapstructure:"locales" json:"locales,omitempty" bson:"locales,omitempty"`
+
+	// Experiments are the A/B experiments rendering one of the weighted variant
+	// templates in place of their name, eg. {"welcome": [{template: "welcome_a"},
+	// {template: "welcome_b", weight: 2}]} (see [Templates.AddExperiment]).
+	Experiments map[string][]ExperimentVariant `mapstructure:"experiments" json:"experiments,omitempty" bson:"experiments,omitempty"`
+
+	// FS are the base templates, default to the registered ones (see [RegisterTemplates]).
+	FS []fs.FS `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when the changed templates could not be reloaded.
+	OnError func(err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the templates configuration for common mistakes.
+func (c TemplatesConfig) Validate() error {
+	var errs []error
+
+	if c.Dir == "" && len(c.base()) == 0 {
+		errs = append(errs, errors.New("templates: dir is required"))
+	}
+
+	if c.Reload < 0 {
+		errs = append(errs, fmt.Errorf("templates: reload must be positive, got %s", c.Reload))
+	}
+
+	if c.DefaultLocale != "" && !isLocale(c.DefaultLocale) {
+		errs = append(errs, fmt.Errorf("templates: invalid default_locale %q", c.DefaultLocale))
+	}
+
+	for locale, fallbacks := range c.Fallbacks {
+		for _, l := range append([]string{locale}, fallbacks...) {
+			if !isLocale(l) {
+				errs = append(errs, fmt.Errorf("templates: invalid fallbacks locale %q", l))
+			}
+		}
+	}
+
+	for _, l := range c.Locales {
+		if !isLocale(l) {
+			errs = append(errs, fmt.Errorf("templates: invalid locales locale %q", l))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Templates loads the templates described by the config.
+func (c TemplatesConfig) Templates() (*Templates, error) {
+	t := &Templates{DefaultLocale: c.DefaultLocale, Fallbacks: c.Fallbacks, Locales: c.Locales}
+
+	if err := t.Load(c.fsys()); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(c.Experiments))
+	for name := range c.Experiments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := t.AddExperiment(name, c.Experiments[name]...); err != nil {
+			return nil, fmt.Errorf("templates: %w", err)
+		}
+	}
+
+	return t, nil
+}
+
+// base returns the base templates.
+func (c TemplatesConfig) base() []fs.FS {
+	if len(c.FS) > 0 {
+		return c.FS
+	}
+
+	return registeredTemplates()
+}
+
+// fsys returns the base templates overridden by the dir ones.
+func (c TemplatesConfig) fsys() fs.FS {
+	base := c.base()
+	if len(base) == 0 {
+		return os.DirFS(c.Dir)
+	}
+
+	layers := overlayFS(base)
+	if c.Dir != "" {
+		layers = append(layers[:len(layers):len(layers)], os.DirFS(c.Dir))
+	}
+
+	return layers
+}
+
+// Add registers (or replaces) the template variant with the specified
+// name and locale. An empty locale registers the locale independent variant.
+func (t *Templates) Add(name, locale string, tpl MessageTemplate) error {
+	if name == "" {
+		return errors.New("template name must not be empty")
+	}
+	if locale != "" && !isLocale(locale) {
+		return fmt.Errorf("template %q has invalid locale %q", name, locale)
+	}
+	if tpl.Text == "" && tpl.HTML == "" {
+		return fmt.Errorf("template %q (%s) requires either html or text body", name, locale)
+	}
+
+	variant := &templateVariant{locale: formatLocale(locale), source: tpl}
+
+	var err error
+	if tpl.Subject != "" {
+		if variant.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(tpl.Subject); err != nil {
+			return fmt.Errorf("invalid template %q (%s) subject: %w", name, locale, err)
+		}
+	}
+	if tpl.Text != "" {
+		if variant.text, err = texttemplate.New("text").Option("missingkey=error").Parse(tpl.Text); err != nil {
+			return fmt.Errorf("invalid template %q (%s) text: %w", name, locale, err)
+		}
+	}
+	if tpl.HTML != "" {
+		if variant.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(tpl.HTML); err != nil {
+			return fmt.Errorf("invalid template %q (%s) html: %w", name, locale, err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.variants == nil {
+		t.variants = map[string]map[string]*templateVariant{}
+	}
+	if t.variants[name] == nil {
+		t.variants[name] = map[string]*templateVariant{}
+	}
+	t.variants[name][normalizeLocale(locale)] = variant
+
+	return nil
+}
+
+// Load registers all templates of fsys (recursively) named
+// "{name}[.{locale}].{subject|txt|html}", eg.:
+//
+//	welcome.subject
+//	welcome.html
+//	welcome.de.subject
+//	welcome.de.html
+//	billing/invoice.de-AT.txt
+//
+// The template name is the file path without the locale and the
+// extension (eg. "billing/invoice"). All other files are ignored.
+//
+// The locale must have an ISO 639-1 two letters language (eg. "de-AT")
+// or be one of the configured ones (DefaultLocale, Fallbacks or Locales),
+// so that the dotted names are not mistaken for locales (eg. the
+// "order.new" template of the "order.new.html" file).
+func (t *Templates) Load(fsys fs.FS) error {
+	type key struct{ name, locale string }
+
+	sources := map[key]*MessageTemplate{}
+	var order []key
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		ext := path.Ext(p)
+		if ext != ".subject" && ext != ".txt" && ext != ".html" {
+			return nil
+		}
+
+		name := strings.TrimSuffix(p, ext)
+		locale := ""
+		if i := strings.LastIndexByte(name, '.'); i > strings.LastIndexByte(name, '/') && t.isFileLocale(name[i+1:]) {
+			name, locale = name[:i], name[i+1:]
+		}
+
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		k := key{name, locale}
+		src := sources[k]
+		if src == nil {
+			src = &MessageTemplate{}
+			sources[k] = src
+			order = append(order, k)
+		}
+
+		switch ext {
+		case ".subject":
+			src.Subject = strings.TrimSpace(string(data))
+		case ".txt":
+			src.Text = string(data)
+		case ".html":
+			src.HTML = string(data)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load the templates: %w", err)
+	}
+
+	var errs []error
+	for _, k := range order {
+		if err := t.Add(k.name, k.locale, *sources[k]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// LocaleChain returns the locales tried, in order, when rendering
+// a template in the specified locale (formatted as BCP 47 language tags).
+//
+// The chain is the locale followed by its configured Fallbacks or,
+// if there are none, by its parent locales (eg. "de-AT" -> "de"),
+// and it always ends with the DefaultLocale (if set).
+func (t *Templates) LocaleChain(locale string) []string {
+	var chain []string
+	seen := map[string]struct{}{}
+
+	add := func(l string) {
+		if n := normalizeLocale(l); n != "" {
+			if _, ok := seen[n]; !ok {
+				seen[n] = struct{}{}
+				chain = append(chain, formatLocale(l))
+			}
+		}
+	}
+
+	add(locale)
+
+	fallbacks, ok := t.Fallbacks[locale]
+	if !ok {
+		for l, f := range t.Fallbacks {
+			if normalizeLocale(l) == normalizeLocale(locale) {
+				fallbacks, ok = f, true
+				break
+			}
+		}
+	}
+
+	if ok {
+		for _, l := range fallbacks {
+			add(l)
+		}
+	} else {
+		parent := normalizeLocale(locale)
+		for {
+			i := strings.LastIndexByte(parent, '-')
+			if i < 0 {
+				break
+			}
+			parent = parent[:i]
+			add(parent)
+		}
+	}
+
+	add(t.DefaultLocale)
+
+	return chain
+}
+
+// Render renders the named template in the specified locale (see [Templates.LocaleChain]).
+func (t *Templates) Render(name, locale string, data any) (*RenderedTemplate, error) {
+	variant, err := t.lookup(name, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RenderedTemplate{Locale: variant.locale}
+
+	var buf bytes.Buffer
+
+	if variant.subject != nil {
+		if err := variant.subject.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render template %q subject: %w", name, err)
+		}
+		result.Subject = strings.Join(strings.Fields(buf.String()), " ")
+		buf.Reset()
+	}
+
+	if variant.text != nil {
+		if err := variant.text.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render template %q text: %w", name, err)
+		}
+		result.Text = buf.String()
+		buf.Reset()
+	}
+
+	if variant.html != nil {
+		if err := variant.html.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to render template %q html: %w", name, err)
+		}
+		result.HTML = buf.String()
+	}
+
+	return result, nil
+}
+
+func (t *Templates) lookup(name, locale string) (*templateVariant, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	variants := t.variants[name]
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("%w %q", ErrTemplateNotFound, name)
+	}
+
+	for _, l := range append(t.LocaleChain(locale), "") {
+		if variant, ok := variants[normalizeLocale(l)]; ok {
+			return variant, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %q for locale %q", ErrTemplateNotFound, name, locale)
+}
+
+// normalizeLocale returns the lowercased locale with "-" subtags separator.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
+
+// formatLocale returns the locale in its conventional BCP 47 casing
+// and separator (eg. "zh_hant_tw" -> "zh-Hant-TW").
+func formatLocale(locale string) string {
+	subtags := strings.Split(normalizeLocale(locale), "-")
+
+	for i, subtag := range subtags {
+		switch {
+		case i > 0 && len(subtag) == 2:
+			subtags[i] = strings.ToUpper(subtag)
+		case i > 0 && len(subtag) == 4:
+			subtags[i] = strings.ToUpper(subtag[:1]) + subtag[1:]
+		}
+	}
+
+	return strings.Join(subtags, "-")
+}
+
+// isFileLocale reports whether s is the locale of a template file
+// name, ie. a locale with a known language or a configured one.
+func (t *Templates) isFileLocale(s string) bool {
+	if !isLocale(s) {
+		return false
+	}
+
+	language, _, _ := strings.Cut(normalizeLocale(s), "-")
+	if strings.Contains(iso639Languages, " "+language+" ") {
+		return true
+	}
+
+	configured := append([]string{t.DefaultLocale}, t.Locales...)
+	for locale, fallbacks := range t.Fallbacks {
+		configured = append(append(configured, locale), fallbacks...)
+	}
+
+	return slices.ContainsFunc(configured, func(l string) bool { return normalizeLocale(l) == normalizeLocale(s) })
+}
+
+// iso639Languages are the ISO 639-1 two letters language codes.
+const iso639Languages = " aa ab ae af ak am an ar as av ay az ba be bg bh bi bm bn bo br bs ca ce ch co cr cs cu cv cy" +
+	" da de dv dz ee el en eo es et eu fa ff fi fj fo fr fy ga gd gl gn gu gv ha he hi ho hr ht hu hy hz" +
+	" ia id ie ig ii ik io is it iu ja jv ka kg ki kj kk kl km kn ko kr ks ku kv kw ky la lb lg li ln lo lt lu lv" +
+	" mg mh mi mk ml mn mr ms mt my na nb nd ne ng nl nn no nr nv ny oc oj om or os pa pi pl ps pt qu" +
+	" rm rn ro ru rw sa sc sd se sg si sk sl sm sn so sq sr ss st su sv sw ta te tg th ti tk tl tn to tr ts tt tw ty" +
+	" ug uk ur uz ve vi vo wa wo xh yi yo za zh zu "
+
+// isLocale reports whether s is a well-formed BCP 47 like language tag
+// (eg. "en", "de-AT", "zh_Hant_TW"), ie. a 2-3 letters language subtag
+// followed by optional 1-8 alphanumeric subtags.
+func isLocale(s string) bool {
+	for i, subtag := range strings.Split(normalizeLocale(s), "-") {
+		if (i == 0 && (len(subtag) < 2 || len(subtag) > 3)) || len(subtag) < 1 || len(subtag) > 8 {
+			return false
+		}
+		for _, c := range subtag {
+			if (c < 'a' || c > 'z') && (i == 0 || c < '0' || c > '9') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,250 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	baseTemplatesMu sync.Mutex
+	baseTemplates   []fs.FS
+)
+
+// RegisterTemplates registers base templates (eg. a go:embed file system)
+// loaded by [TemplatesConfig.Templates] before the files of the configured
+// dir, so that the operators only have to override the customized ones
+// instead of deploying all of them. The later registered base templates
+// override the earlier ones.
+//
+// It is intended to be called from the init function of the package
+// embedding the templates, and panics if fsys is nil.
+func RegisterTemplates(fsys fs.FS) {
+	if fsys == nil {
+		panic("mailer: nil templates fs")
+	}
+
+	baseTemplatesMu.Lock()
+	defer baseTemplatesMu.Unlock()
+
+	baseTemplates = append(baseTemplates, fsys)
+}
+
+// registeredTemplates returns the registered base templates.
+func registeredTemplates() []fs.FS {
+	baseTemplatesMu.Lock()
+	defer baseTemplatesMu.Unlock()
+
+	return append([]fs.FS(nil), baseTemplates...)
+}
+
+// Reload replaces all the templates with the ones of fsys (see [Templates.Load]),
+// so that the removed files are unregistered. The current templates are kept
+// if any of the new ones is invalid.
+func (t *Templates) Reload(fsys fs.FS) error {
+	loaded := &Templates{}
+	if err := loaded.Load(fsys); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.variants = loaded.variants
+
+	return nil
+}
+
+// overlayFS is a read-only file system made of layers,
+// the files of the last layers overriding the ones of the first.
+// The missing layers (eg. a not yet created directory) are ignored.
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	var notExist error
+	for i := len(o) - 1; i >= 0; i-- {
+		f, err := o[i].Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		notExist = err
+	}
+
+	if notExist == nil {
+		notExist = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return nil, notExist
+}
+
+// ReadDir implements [fs.ReadDirFS] interface, merging the layers entries.
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := map[string]fs.DirEntry{}
+	found := false
+
+	for _, layer := range o {
+		list, err := fs.ReadDir(layer, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+
+		for _, e := range list {
+			entries[e.Name()] = e
+		}
+	}
+
+	if !found {
+		if name == "." {
+			return nil, nil // all layers are missing
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	list := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	return list, nil
+}
+
+// TemplatesWatcher hot-reloads the templates when the files of
+// the templates dir change (see [TemplatesConfig.Watcher]).
+type TemplatesWatcher struct {
+	templates *Templates
+	config    TemplatesConfig
+
+	checkMu sync.Mutex // serializes the checks
+	last    string     // the fingerprint of the loaded dir files
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Watcher returns a watcher reloading the templates when the dir files change,
+// or nil if the reload interval or the dir are not configured.
+func (c TemplatesConfig) Watcher(t *Templates) *TemplatesWatcher {
+	if c.Reload <= 0 || c.Dir == "" {
+		return nil
+	}
+
+	return &TemplatesWatcher{templates: t, config: c, last: templatesFingerprint(c.Dir)}
+}
+
+// Start checks the dir files at the configured interval in the background.
+// It is no-op if the watcher is already started.
+func (w *TemplatesWatcher) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.started {
+		return
+	}
+	w.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done = make(chan struct{})
+
+	go w.run(ctx)
+}
+
+// Stop stops watching, waiting for the current reload (up to the ctx deadline) to complete.
+func (w *TemplatesWatcher) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.started {
+		return nil
+	}
+	w.started = false
+	w.cancel()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *TemplatesWatcher) run(ctx context.Context) {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.config.Reload):
+		}
+
+		if _, err := w.Check(); err != nil && w.config.OnError != nil {
+			w.config.OnError(err)
+		}
+	}
+}
+
+// Check reloads the templates if the dir files changed since the last
+// check, returning whether they were reloaded. The templates are checked
+// again on the next call if they could not be reloaded.
+func (w *TemplatesWatcher) Check() (bool, error) {
+	w.checkMu.Lock()
+	defer w.checkMu.Unlock()
+
+	fingerprint := templatesFingerprint(w.config.Dir)
+	if fingerprint == w.last {
+		return false, nil
+	}
+
+	if err := w.templates.Reload(w.config.fsys()); err != nil {
+		return false, fmt.Errorf("templates: failed to reload: %w", err)
+	}
+	w.last = fingerprint
+
+	return true, nil
+}
+
+// templatesFingerprint returns the path, size and modification time of all
+// dir files, or an empty string if it does not exist.
+func templatesFingerprint(dir string) string {
+	var b strings.Builder
+
+	_ = fs.WalkDir(os.DirFS(dir), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil // the unreadable files are reported by the reload
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		b.WriteString(p)
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatInt(info.Size(), 10))
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatInt(info.ModTime().UnixNano(), 10))
+		b.WriteByte('\n')
+
+		return nil
+	})
+
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestTemplatesConfigOverrides(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "overrides") // not created yet
+
+	config := TemplatesConfig{
+		Dir:    dir,
+		Reload: time.Hour,
+		FS: []fs.FS{fstest.MapFS{
+			"welcome.subject": {Data: []byte("Welcome {{.Name}}")},
+			"welcome.txt":     {Data: []byte("Hi {{.Name}}")},
+			"reset.txt":       {Data: []byte("Reset your password")},
+		}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := config.Templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := config.Watcher(templates)
+
+	render := func(name string) *RenderedTemplate {
+		t.Helper()
+
+		rendered, err := templates.Render(name, "", map[string]string{"Name": "Jane"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rendered
+	}
+
+	if r := render("welcome"); r.Subject != "Welcome Jane" || r.Text != "Hi Jane" {
+		t.Fatalf("Expected the base template, got %+v", r)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "billing"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"welcome.txt":         "Hello {{.Name}}",
+		"billing/invoice.txt": "Your invoice",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if reloaded, err := watcher.Check(); err != nil || !reloaded {
+		t.Fatalf("Expected the templates to be reloaded, got %v, %v", reloaded, err)
+	}
+	if r := render("welcome"); r.Subject != "Welcome Jane" || r.Text != "Hello Jane" {
+		t.Fatalf("Expected the overridden template text, got %+v", r)
+	}
+	if r := render("billing/invoice"); r.Text != "Your invoice" {
+		t.Fatalf("Expected the added template, got %+v", r)
+	}
+	if reloaded, _ := watcher.Check(); reloaded {
+		t.Fatal("Expected the unchanged templates not to be reloaded")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "welcome.txt"), []byte("{{.Name"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watcher.Check(); err == nil {
+		t.Fatal("Expected the invalid template error")
+	}
+	if r := render("welcome"); r.Text != "Hello Jane" {
+		t.Fatalf("Expected the current templates to be kept, got %+v", r)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := watcher.Check(); err != nil || !reloaded {
+		t.Fatalf("Expected the templates to be reloaded, got %v, %v", reloaded, err)
+	}
+	if r := render("welcome"); r.Text != "Hi Jane" {
+		t.Fatalf("Expected the base template, got %+v", r)
+	}
+	if _, err := templates.Render("billing/invoice", "", nil); err == nil {
+		t.Fatal("Expected the removed template not to be found")
+	}
+}
+
+func TestTemplatesConfigValidateReload(t *testing.T) {
+	if err := (TemplatesConfig{}).Validate(); err == nil {
+		t.Fatal("Expected the missing dir error")
+	}
+	if err := (TemplatesConfig{Dir: "templates", Reload: -time.Second}).Validate(); err == nil {
+		t.Fatal("Expected the negative reload error")
+	}
+	if w := (TemplatesConfig{Dir: "templates"}).Watcher(&Templates{}); w != nil {
+		t.Fatal("Expected no watcher without reload interval")
+	}
+}
@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	// variantTagPrefix marks the message tag holding its experiment variant (eg. "variant:welcome_b").
+	variantTagPrefix = "variant:"
+
+	experimentMetadata = "experiment" // the metadata key of the experiment name
+	variantMetadata    = "variant"    // the metadata key of the chosen variant
+)
+
+// ExperimentVariant is a weighted template variant of an A/B experiment.
+type ExperimentVariant struct {
+	Template string `mapstructure:"template" json:"template" bson:"template"`               // the variant template name
+	Weight   *int   `mapstructure:"weight" json:"weight,omitempty" bson:"weight,omitempty"` // the relative share of the recipients, default to 1, 0 turning the variant off
+}
+
+// weight returns the variant weight, default to 1.
+func (v ExperimentVariant) weight() int {
+	if v.Weight == nil {
+		return 1
+	}
+
+	return *v.Weight
+}
+
+// AddExperiment registers (or replaces) the A/B experiment name,
+// rendering one of the weighted variant templates in its place
+// (see [Templates.Variant]). The variants must be registered first
+// and at least one of them must have a positive weight.
+func (t *Templates) AddExperiment(name string, variants ...ExperimentVariant) error {
+	if name == "" {
+		return errors.New("experiment name must not be empty")
+	}
+	if len(variants) == 0 {
+		return fmt.Errorf("experiment %q requires at least one variant", name)
+	}
+
+	variants = append([]ExperimentVariant(nil), variants...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := 0
+	for i, v := range variants {
+		if _, ok := t.variants[v.Template]; !ok {
+			return fmt.Errorf("experiment %q: %w %q", name, ErrTemplateNotFound, v.Template)
+		}
+		if v.weight() < 0 {
+			return fmt.Errorf("experiment %q: variant %q weight must not be negative, got %d", name, v.Template, v.weight())
+		}
+		weight := v.weight()
+		variants[i].Weight = &weight // not shared with the caller
+		total += weight
+	}
+	if total == 0 {
+		return fmt.Errorf("experiment %q: all the variants are turned off", name)
+	}
+
+	if t.experiments == nil {
+		t.experiments = map[string][]ExperimentVariant{}
+	}
+	t.experiments[name] = variants
+
+	return nil
+}
+
+// Variant returns the name of the template rendered for the recipient in
+// place of name, ie. the variant of the A/B experiment name (if any) or name
+// itself. The variant is chosen deterministically by the recipient address,
+// so that the recipient always gets the same one, and proportionally to the
+// variants weight.
+func (t *Templates) Variant(name, recipient string) string {
+	t.mu.RLock()
+	variants := t.experiments[name]
+	t.mu.RUnlock()
+
+	if len(variants) == 0 {
+		return name
+	}
+
+	total := 0
+	for _, v := range variants {
+		total += v.weight()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(recipient))))
+
+	n := int(h.Sum64() % uint64(total))
+	for _, v := range variants {
+		if n < v.weight() {
+			return v.Template
+		}
+		n -= v.weight()
+	}
+
+	return variants[len(variants)-1].Template
+}
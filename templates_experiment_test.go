@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTemplatesVariant(t *testing.T) {
+	weight := func(w int) *int { return &w }
+
+	config := TemplatesConfig{
+		FS: []fs.FS{fstest.MapFS{
+			"welcome.txt":   {Data: []byte("Welcome")},
+			"welcome_a.txt": {Data: []byte("Welcome A")},
+			"welcome_b.txt": {Data: []byte("Welcome B")},
+		}},
+		Experiments: map[string][]ExperimentVariant{
+			"welcome": {{Template: "welcome_a"}, {Template: "welcome_b", Weight: weight(3)}},
+		},
+	}
+
+	templates, err := config.Templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		recipient := fmt.Sprintf("user%d@example.com", i)
+
+		variant := templates.Variant("welcome", recipient)
+		if again := templates.Variant("welcome", " USER"+recipient[4:]); again != variant {
+			t.Fatalf("Expected %s to always get %s, got %s", recipient, variant, again)
+		}
+		counts[variant]++
+	}
+	if counts["welcome_a"] < 200 || counts["welcome_a"] > 300 || counts["welcome_a"]+counts["welcome_b"] != 1000 {
+		t.Fatalf("Expected about a quarter of the recipients to get welcome_a, got %v", counts)
+	}
+
+	if v := templates.Variant("reset", "jane@example.com"); v != "reset" {
+		t.Fatalf("Expected the template itself out of experiments, got %s", v)
+	}
+
+	if err := templates.AddExperiment("welcome", ExperimentVariant{Template: "missing"}); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("Expected ErrTemplateNotFound, got %v", err)
+	}
+	if err := templates.AddExperiment("welcome", ExperimentVariant{Template: "welcome_a", Weight: weight(-1)}); err == nil {
+		t.Fatal("Expected the negative weight error")
+	}
+	if err := templates.AddExperiment("welcome", ExperimentVariant{Template: "welcome_a", Weight: weight(0)}); err == nil {
+		t.Fatal("Expected the turned off variants error")
+	}
+
+	// the variant turned off gets no recipient
+	if err := templates.AddExperiment("signup", ExperimentVariant{Template: "welcome_a", Weight: weight(0)}, ExperimentVariant{Template: "welcome_b"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if v := templates.Variant("signup", fmt.Sprintf("user%d@example.com", i)); v != "welcome_b" {
+			t.Fatalf("Expected the turned off variant to get no recipient, got %s", v)
+		}
+	}
+
+	m, err := NewMessage().
+		To("jane@example.com").
+		Template(templates, "welcome", nil).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variant := templates.Variant("welcome", "jane@example.com")
+	if m.Text != map[string]string{"welcome_a": "Welcome A", "welcome_b": "Welcome B"}[variant] {
+		t.Fatalf("Expected the %s text, got %q", variant, m.Text)
+	}
+	if !slices.Contains(m.Tags, "variant:"+variant) || m.Metadata["experiment"] != "welcome" || m.Metadata["variant"] != variant {
+		t.Fatalf("Expected the variant to be recorded, got %v %v", m.Tags, m.Metadata)
+	}
+}
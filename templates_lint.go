@@ -0,0 +1,412 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+const defaultLintMaxInlineSize = 100 << 10
+
+// TemplateLintKind is the kind of a [TemplateLintIssue].
+type TemplateLintKind string
+
+const (
+	LintUndefinedField  TemplateLintKind = "undefined_field"  // the template references a field missing from the schema
+	LintUnusedField     TemplateLintKind = "unused_field"     // the schema field is not referenced by the template
+	LintDeadCID         TemplateLintKind = "dead_cid"         // the "cid:" reference has no inline attachment
+	LintUnusedInline    TemplateLintKind = "unused_inline"    // the inline attachment is not referenced by the HTML body
+	LintOversizedInline TemplateLintKind = "oversized_inline" // the inline image (or data: URI) exceeds the max size
+	LintBrokenLink      TemplateLintKind = "broken_link"      // the link is empty, relative or local
+)
+
+// TemplateLintOptions defines what [Templates.LintTemplate] checks.
+type TemplateLintOptions struct {
+	// Schema lists the data fields available to the template as dotted
+	// paths (eg. "User.Name"). The fields of the ranged elements are
+	// listed under the ranged field (eg. "Items.Price") and a trailing
+	// ".*" allows any sub-field (eg. "Meta.*"). The fields are not
+	// checked if the schema is empty.
+	Schema []string `json:"schema,omitempty"`
+
+	// Inline are the sizes (in bytes) of the inline attachments by name,
+	// referenced from the HTML body as "cid:{name}".
+	Inline map[string]int64 `json:"inline,omitempty"`
+
+	// MaxInlineSize is the max size of an inline image, default to 100KiB.
+	MaxInlineSize int64 `json:"max_inline_size,omitempty"`
+}
+
+// TemplateLintIssue is a problem found by [Templates.LintTemplate].
+type TemplateLintIssue struct {
+	Template string           `json:"template"`
+	Locale   string           `json:"locale,omitempty"` // empty for the locale independent variant
+	Part     string           `json:"part,omitempty"`   // subject, text or html (empty for the schema issues)
+	Kind     TemplateLintKind `json:"kind"`
+	Detail   string           `json:"detail"` // eg. the field path or the link
+}
+
+func (i TemplateLintIssue) String() string {
+	name := i.Template
+	if i.Locale != "" {
+		name += " (" + i.Locale + ")"
+	}
+	if i.Part != "" {
+		name += " " + i.Part
+	}
+
+	return fmt.Sprintf("%s: %s %s", name, i.Kind, i.Detail)
+}
+
+// LintTemplate checks all variants of the named template against the
+// options, eg. before deploying it, and returns the found issues sorted
+// by locale, part and kind. The templates render fine despite them.
+func (t *Templates) LintTemplate(name string, opts TemplateLintOptions) ([]TemplateLintIssue, error) {
+	if opts.MaxInlineSize <= 0 {
+		opts.MaxInlineSize = defaultLintMaxInlineSize
+	}
+
+	t.mu.RLock()
+	variants := make([]*templateVariant, 0, len(t.variants[name]))
+	for _, variant := range t.variants[name] {
+		variants = append(variants, variant)
+	}
+	t.mu.RUnlock()
+
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("%w %q", ErrTemplateNotFound, name)
+	}
+
+	var issues []TemplateLintIssue
+	for _, variant := range variants {
+		found, err := lintTemplateVariant(variant, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lint template %q (%s): %w", name, variant.locale, err)
+		}
+
+		for _, issue := range found {
+			issue.Template = name
+			issue.Locale = variant.locale
+			issues = append(issues, issue)
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.Locale != b.Locale {
+			return a.Locale < b.Locale
+		}
+		if a.Part != b.Part {
+			return a.Part < b.Part
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Detail < b.Detail
+	})
+
+	return issues, nil
+}
+
+func lintTemplateVariant(variant *templateVariant, opts TemplateLintOptions) ([]TemplateLintIssue, error) {
+	var issues []TemplateLintIssue
+	used := map[string]struct{}{} // the referenced fields of all parts
+
+	parts := []struct{ name, source string }{
+		{"subject", variant.source.Subject},
+		{"text", variant.source.Text},
+		{"html", variant.source.HTML},
+	}
+
+	for _, part := range parts {
+		if part.source == "" {
+			continue
+		}
+
+		tpl, err := texttemplate.New(part.name).Parse(part.source)
+		if err != nil {
+			return nil, err
+		}
+
+		refs := &templateRefs{values: map[string]struct{}{}, contexts: map[string]struct{}{}}
+		for _, tree := range tpl.Templates() {
+			if tree.Tree != nil {
+				refs.walk(tree.Tree.Root, "")
+			}
+		}
+
+		for field := range refs.values {
+			used[field] = struct{}{}
+		}
+
+		if len(opts.Schema) > 0 {
+			for _, field := range refs.fields() {
+				if !schemaDefines(opts.Schema, field) {
+					issues = append(issues, TemplateLintIssue{Part: part.name, Kind: LintUndefinedField, Detail: field})
+				}
+			}
+		}
+
+		if part.name == "html" {
+			for _, issue := range lintTemplateHTML(part.source, opts) {
+				issue.Part = part.name
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	for _, field := range opts.Schema {
+		if !schemaFieldUsed(strings.TrimSuffix(field, ".*"), used) {
+			issues = append(issues, TemplateLintIssue{Kind: LintUnusedField, Detail: field})
+		}
+	}
+
+	return issues, nil
+}
+
+// templateRefs collects the data fields referenced by a template,
+// as dotted paths relative to the template data.
+type templateRefs struct {
+	values   map[string]struct{} // the fields whose values are used
+	contexts map[string]struct{} // the fields only used as "range" or "with" dot
+}
+
+// fields returns all referenced fields.
+func (r *templateRefs) fields() []string {
+	var fields []string
+	for field := range r.values {
+		fields = append(fields, field)
+	}
+	for field := range r.contexts {
+		if _, ok := r.values[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// unknownDot is the dot of the blocks whose data is not a field (eg. a function result).
+const unknownDot = "?"
+
+func (r *templateRefs) walk(node parse.Node, dot string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			r.walk(child, dot)
+		}
+	case *parse.ActionNode:
+		r.pipe(n.Pipe, dot, r.values)
+	case *parse.TemplateNode:
+		r.pipe(n.Pipe, dot, r.values)
+	case *parse.IfNode:
+		r.pipe(n.Pipe, dot, r.values)
+		r.walk(n.List, dot)
+		r.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		r.pipe(n.Pipe, dot, r.contexts)
+		r.walk(n.List, r.pipeDot(n.Pipe, dot))
+		r.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		r.pipe(n.Pipe, dot, r.contexts)
+		r.walk(n.List, r.pipeDot(n.Pipe, dot))
+		r.walk(n.ElseList, dot)
+	}
+}
+
+// pipe records the fields referenced by the pipeline in refs (or in the
+// values if they are function arguments or part of a longer pipeline).
+func (r *templateRefs) pipe(pipe *parse.PipeNode, dot string, refs map[string]struct{}) {
+	if pipe == nil {
+		return
+	}
+
+	if len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		refs = r.values
+	}
+
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			r.arg(arg, dot, refs)
+		}
+	}
+}
+
+func (r *templateRefs) arg(arg parse.Node, dot string, refs map[string]struct{}) {
+	switch a := arg.(type) {
+	case *parse.FieldNode:
+		r.add(refs, dot, a.Ident)
+	case *parse.DotNode:
+		r.add(refs, dot, nil)
+	case *parse.VariableNode:
+		if len(a.Ident) > 1 && a.Ident[0] == "$" {
+			r.add(refs, "", a.Ident[1:])
+		}
+	case *parse.ChainNode:
+		if field, ok := a.Node.(*parse.FieldNode); ok {
+			r.add(refs, dot, append(append([]string(nil), field.Ident...), a.Field...))
+		} else {
+			r.arg(a.Node, dot, r.values)
+		}
+	case *parse.PipeNode:
+		r.pipe(a, dot, r.values)
+	}
+}
+
+func (r *templateRefs) add(refs map[string]struct{}, dot string, idents []string) {
+	if dot == unknownDot {
+		return
+	}
+
+	path := strings.Join(idents, ".")
+	if dot != "" && path != "" {
+		path = dot + "." + path
+	} else if path == "" {
+		path = dot
+	}
+
+	if path != "" {
+		refs[path] = struct{}{}
+	}
+}
+
+// pipeDot returns the dot set by the "range" or "with" pipeline.
+func (r *templateRefs) pipeDot(pipe *parse.PipeNode, dot string) string {
+	if dot == unknownDot || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return unknownDot
+	}
+
+	switch a := pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		if dot == "" {
+			return strings.Join(a.Ident, ".")
+		}
+		return dot + "." + strings.Join(a.Ident, ".")
+	case *parse.VariableNode:
+		if len(a.Ident) > 1 && a.Ident[0] == "$" {
+			return strings.Join(a.Ident[1:], ".")
+		}
+	case *parse.DotNode:
+		return dot
+	}
+
+	return unknownDot
+}
+
+// schemaDefines reports whether the field is defined by the schema, ie.
+// it is a schema field, a parent of one or a sub-field of a ".*" one.
+func schemaDefines(schema []string, field string) bool {
+	for _, f := range schema {
+		if prefix, ok := strings.CutSuffix(f, ".*"); ok {
+			if field == prefix || strings.HasPrefix(field, prefix+".") || strings.HasPrefix(prefix, field+".") {
+				return true
+			}
+			continue
+		}
+		if f == field || strings.HasPrefix(f, field+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// schemaFieldUsed reports whether the schema field, one of its
+// sub-fields or one of its parents is used by the template.
+func schemaFieldUsed(field string, used map[string]struct{}) bool {
+	for u := range used {
+		if u == field || strings.HasPrefix(u, field+".") || strings.HasPrefix(field, u+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	lintCIDRegex  = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+	lintLinkRegex = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	lintDataRegex = regexp.MustCompile(`(?i)data:image/[a-z0-9.+-]+;base64,([a-z0-9+/=\s]+)`)
+)
+
+func lintTemplateHTML(html string, opts TemplateLintOptions) []TemplateLintIssue {
+	var issues []TemplateLintIssue
+
+	referenced := map[string]struct{}{}
+	for _, match := range lintCIDRegex.FindAllStringSubmatch(html, -1) {
+		name := match[1]
+		if strings.Contains(name, "{{") {
+			continue // templated reference
+		}
+		referenced[name] = struct{}{}
+
+		if _, ok := opts.Inline[name]; !ok {
+			issues = append(issues, TemplateLintIssue{Kind: LintDeadCID, Detail: "cid:" + name})
+		}
+	}
+
+	for name, size := range opts.Inline {
+		if _, ok := referenced[name]; !ok {
+			issues = append(issues, TemplateLintIssue{Kind: LintUnusedInline, Detail: name})
+		}
+		if size > opts.MaxInlineSize {
+			issues = append(issues, TemplateLintIssue{Kind: LintOversizedInline, Detail: fmt.Sprintf("%s (%d bytes)", name, size)})
+		}
+	}
+
+	for _, match := range lintDataRegex.FindAllStringSubmatch(html, -1) {
+		data := strings.Join(strings.Fields(match[1]), "")
+		if size := int64(base64.StdEncoding.DecodedLen(len(data))); size > opts.MaxInlineSize {
+			issues = append(issues, TemplateLintIssue{Kind: LintOversizedInline, Detail: fmt.Sprintf("data: URI (%d bytes)", size)})
+		}
+	}
+
+	for _, match := range lintLinkRegex.FindAllStringSubmatch(html, -1) {
+		link := strings.TrimSpace(match[1] + match[2])
+		if problem := lintLink(link); problem != "" {
+			issues = append(issues, TemplateLintIssue{Kind: LintBrokenLink, Detail: fmt.Sprintf("%q %s", link, problem)})
+		}
+	}
+
+	return issues
+}
+
+// lintLink returns the problem of the link, or an empty string if it looks fine.
+func lintLink(link string) string {
+	switch {
+	case link == "" || link == "#":
+		return "is empty"
+	case strings.HasPrefix(link, "{{"):
+		return "" // templated link
+	}
+
+	scheme, rest, ok := strings.Cut(link, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return "is relative"
+	}
+
+	if strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https") {
+		host := strings.TrimPrefix(rest, "//")
+		if i := strings.IndexAny(host, "/?#"); i >= 0 {
+			host = host[:i]
+		}
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		if host == "" {
+			return "has no host"
+		}
+		if isLocalhost(strings.Trim(host, "[]")) {
+			return "points to localhost"
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTemplatesLintTemplate(t *testing.T) {
+	templates := &Templates{}
+
+	err := templates.Add("order", "", MessageTemplate{
+		Subject: "Order {{.Order.ID}}",
+		Text:    "Hi {{.User.Name}}, {{range .Order.Items}}{{.Name}} {{.Price}}{{end}} {{.Coupon}}",
+		HTML: `<p>Hi {{.User.Name}}</p><img src="cid:logo.png"><img src="cid:banner.png">` +
+			`{{with .Meta}}<a href="{{.URL}}">track</a>{{end}}` +
+			`<a href="https://example.com/orders">orders</a><a href="/settings">settings</a>` +
+			`<a href="#">top</a><a href="http://localhost:8080/unsubscribe">unsubscribe</a>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := templates.LintTemplate("order", TemplateLintOptions{
+		Schema:        []string{"User.Name", "User.Email", "Order.ID", "Order.Items.Name", "Order.Items.Price", "Meta.*"},
+		Inline:        map[string]int64{"logo.png": 1 << 10, "footer.png": 1 << 20},
+		MaxInlineSize: 100 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, issue := range issues {
+		got = append(got, issue.String())
+	}
+
+	expected := []string{
+		"order: unused_field User.Email",
+		`order html: broken_link "#" is empty`,
+		`order html: broken_link "/settings" is relative`,
+		`order html: broken_link "http://localhost:8080/unsubscribe" points to localhost`,
+		"order html: dead_cid cid:banner.png",
+		"order html: oversized_inline footer.png (1048576 bytes)",
+		"order html: unused_inline footer.png",
+		"order text: undefined_field Coupon",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected the issues %q, got %q", expected, got)
+	}
+
+	if _, err := templates.LintTemplate("missing", TemplateLintOptions{}); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("Expected ErrTemplateNotFound, got %v", err)
+	}
+}
+
+func TestTemplatesLintTemplateClean(t *testing.T) {
+	templates := newTestTemplates(t)
+
+	issues, err := templates.LintTemplate("welcome", TemplateLintOptions{Schema: []string{"Name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(issues) != 0 {
+		t.Fatalf("Expected no issues, got %v", issues)
+	}
+}
@@ -0,0 +1,187 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestTemplates(t *testing.T) *Templates {
+	t.Helper()
+
+	templates := &Templates{
+		DefaultLocale: "en",
+		Fallbacks:     map[string][]string{"de-CH": {"de-AT"}},
+	}
+
+	err := templates.Load(fstest.MapFS{
+		"welcome.subject":           {Data: []byte("Welcome {{.Name}}\n")},
+		"welcome.html":              {Data: []byte("<p>Welcome {{.Name}}</p>")},
+		"welcome.en.subject":        {Data: []byte("Hi {{.Name}}")},
+		"welcome.en.txt":            {Data: []byte("Hi {{.Name}}")},
+		"welcome.de.subject":        {Data: []byte("Willkommen {{.Name}}")},
+		"welcome.de.txt":            {Data: []byte("Willkommen {{.Name}}")},
+		"welcome.de_AT.subject":     {Data: []byte("Servus {{.Name}}")},
+		"welcome.de_AT.txt":         {Data: []byte("Servus {{.Name}}")},
+		"billing/invoice.fr.html":   {Data: []byte("<p>Facture</p>")},
+		"billing/README.md":         {Data: []byte("ignored")},
+		"billing/invoice.fr.backup": {Data: []byte("ignored")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return templates
+}
+
+func TestTemplatesLocaleChain(t *testing.T) {
+	templates := &Templates{
+		DefaultLocale: "en",
+		Fallbacks:     map[string][]string{"de-CH": {"de-AT", "de"}},
+	}
+
+	scenarios := []struct {
+		locale   string
+		expected []string
+	}{
+		{"", []string{"en"}},
+		{"en", []string{"en"}},
+		{"de-AT", []string{"de-AT", "de", "en"}},
+		{"zh_hant_tw", []string{"zh-Hant-TW", "zh-Hant", "zh", "en"}},
+		{"de-ch", []string{"de-CH", "de-AT", "de", "en"}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.locale, func(t *testing.T) {
+			if chain := templates.LocaleChain(s.locale); !reflect.DeepEqual(chain, s.expected) {
+				t.Fatalf("Expected %v, got %v", s.expected, chain)
+			}
+		})
+	}
+}
+
+func TestTemplatesRender(t *testing.T) {
+	templates := newTestTemplates(t)
+
+	scenarios := []struct {
+		name          string
+		locale        string
+		expectSubject string
+		expectLocale  string
+	}{
+		{"welcome", "de-AT", "Servus Ann", "de-AT"},
+		{"welcome", "de-CH", "Servus Ann", "de-AT"},
+		{"welcome", "de-DE", "Willkommen Ann", "de"},
+		{"welcome", "fr", "Hi Ann", "en"},
+		{"welcome", "", "Hi Ann", "en"},
+		{"billing/invoice", "fr-CA", "", "fr"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name+"_"+s.locale, func(t *testing.T) {
+			rendered, err := templates.Render(s.name, s.locale, map[string]string{"Name": "Ann"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rendered.Subject != s.expectSubject || rendered.Locale != s.expectLocale {
+				t.Fatalf("Expected subject %q (%s), got %q (%s)", s.expectSubject, s.expectLocale, rendered.Subject, rendered.Locale)
+			}
+		})
+	}
+
+	if _, err := templates.Render("billing/invoice", "de", nil); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("Expected ErrTemplateNotFound for a missing locale, got %v", err)
+	}
+	if _, err := templates.Render("missing", "en", nil); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("Expected ErrTemplateNotFound, got %v", err)
+	}
+	if _, err := templates.Render("welcome", "en", map[string]string{}); err == nil {
+		t.Fatal("Expected a missing key error")
+	}
+}
+
+func TestTemplatesLoadDottedNames(t *testing.T) {
+	templates := &Templates{Locales: []string{"fil"}}
+
+	err := templates.Load(fstest.MapFS{
+		"order.new.html":     {Data: []byte("<p>New order</p>")},
+		"order.new.fil.html": {Data: []byte("<p>Bagong order</p>")},
+		"order.new.de.html":  {Data: []byte("<p>Neue Bestellung</p>")},
+		"order.csv.html":     {Data: []byte("<p>Export</p>")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name, locale, expected string
+	}{
+		{"order.new", "", "<p>New order</p>"},
+		{"order.new", "fil", "<p>Bagong order</p>"},
+		{"order.new", "de", "<p>Neue Bestellung</p>"},
+		{"order.csv", "", "<p>Export</p>"},
+	}
+
+	for _, s := range scenarios {
+		rendered, err := templates.Render(s.name, s.locale, nil)
+		if err != nil {
+			t.Fatalf("[%s %s] %v", s.name, s.locale, err)
+		}
+		if rendered.HTML != s.expected {
+			t.Fatalf("[%s %s] Expected %q, got %q", s.name, s.locale, s.expected, rendered.HTML)
+		}
+	}
+}
+
+func TestTemplatesLoadInvalid(t *testing.T) {
+	var templates Templates
+
+	err := templates.Load(fstest.MapFS{
+		"a.html":    {Data: []byte("{{.Name")},
+		"b.subject": {Data: []byte("subject only")},
+	})
+	if err == nil || !strings.Contains(err.Error(), `"a"`) || !strings.Contains(err.Error(), `"b"`) {
+		t.Fatalf("Expected the invalid templates errors, got %v", err)
+	}
+}
+
+func TestMessageBuilderTemplate(t *testing.T) {
+	templates := newTestTemplates(t)
+
+	msg, err := NewMessage().
+		From("from@example.com").
+		To("to@example.com").
+		Locale("de-AT").
+		Template(templates, "welcome", map[string]string{"Name": "Ann"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Subject != "Servus Ann" || msg.Text != "Servus Ann" || msg.HTML != "" || msg.Locale != "de-AT" {
+		t.Fatalf("Unexpected templated message %+v", msg)
+	}
+
+	raw, err := newTestRenderer().Render(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte("\r\nContent-Language: de-AT\r\n")) {
+		t.Fatalf("Expected Content-Language header, got\n%s", raw)
+	}
+
+	parsed, err := ParseMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Locale != "de-AT" || parsed.Headers["Content-Language"] != "" {
+		t.Fatalf("Expected the parsed locale, got %q (%v)", parsed.Locale, parsed.Headers)
+	}
+
+	if _, err := NewMessage().Locale("not a locale").Build(); err == nil {
+		t.Fatal("Expected an invalid locale error")
+	}
+}
@@ -0,0 +1,225 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// tenantTagPrefix is the prefix of the tenant quota keys (eg. "tenant:acme"),
+// also reserved as control tag prefix.
+const tenantTagPrefix = "tenant:"
+
+var (
+	_ Mailer  = (*TenantMailer)(nil)
+	_ Capable = (*TenantMailer)(nil)
+)
+
+// ErrUnknownTenant is returned when a message is sent on behalf of a not registered tenant.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// TenantConfig defines the settings of a single tenant, ie. a customer
+// on behalf of whom the messages are sent.
+//
+// The tenant backend is configured under the same keys as the default
+// one (eg. "mailer.tenants.acme.smtp"). The default backend is used
+// if the tenant has none.
+type TenantConfig struct {
+	// From is the default From address of the tenant messages.
+	From string `mapstructure:"from" json:"from,omitempty" bson:"from,omitempty"`
+
+	// DKIM signs the tenant messages with its own key.
+	DKIM *DKIMConfig `mapstructure:"dkim" json:"dkim,omitempty" bson:"dkim,omitempty"`
+}
+
+// Validate checks the tenant configuration for common mistakes.
+func (c TenantConfig) Validate() error {
+	var errs []error
+
+	if c.From != "" {
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			errs = append(errs, fmt.Errorf("tenant: invalid from address %q: %w", c.From, err))
+		}
+	}
+
+	if c.DKIM != nil {
+		if err := c.DKIM.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c TenantConfig) Redacted() TenantConfig {
+	if c.DKIM != nil {
+		dkim := c.DKIM.Redacted()
+		c.DKIM = &dkim
+	}
+
+	return c
+}
+
+// TenantMailer routes the messages to the mailers of their tenants,
+// sent with the [TenantMailer.For] mailers.
+// The messages without tenant are sent with the default mailer.
+//
+// Tenants are safe for concurrent use, but Pipeline must not be
+// changed after the first use.
+type TenantMailer struct {
+	// Pipeline is the mailer the messages of the [TenantMailer.For] mailers
+	// are sent through, typically the middlewares chain wrapping the tenant
+	// mailer (eg. with the queue and the quotas). Default to the tenant mailer itself.
+	Pipeline Mailer
+
+	fallback Mailer
+
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+}
+
+type tenant struct {
+	mailer Mailer
+	from   mail.Address
+}
+
+// NewTenantMailer creates a new tenant mailer sending the messages without
+// tenant with the fallback mailer. A nil fallback rejects such messages.
+func NewTenantMailer(fallback Mailer) *TenantMailer {
+	return &TenantMailer{fallback: fallback, tenants: map[string]*tenant{}}
+}
+
+// Add registers (or replaces) a tenant with its mailer and default From
+// address (an empty address keeps the messages From as it is).
+func (t *TenantMailer) Add(id string, mailer Mailer, from mail.Address) error {
+	if id == "" || strings.ContainsAny(id, " ,") {
+		return fmt.Errorf("invalid tenant id %q", id)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tenants[id] = &tenant{mailer: mailer, from: from}
+
+	return nil
+}
+
+// Tenants returns the ids of the registered tenants.
+func (t *TenantMailer) Tenants() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ids := make([]string, 0, len(t.tenants))
+	for id := range t.tenants {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// For returns the mailer sending on behalf of the specified tenant,
+// ie. marking the messages with its id and defaulting their From
+// address to the tenant one.
+//
+// It is the only way to send with a tenant mailer, so that the untrusted
+// submitters (eg. of the HTTP or NATS messages) can't pick another tenant
+// backend and DKIM key with a tag.
+//
+// It returns an error wrapping [ErrUnknownTenant] if there is no such tenant.
+func (t *TenantMailer) For(id string) (Mailer, error) {
+	tenant, err := t.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return MailerFunc(func(m *Message) error {
+		if err := checkTenantVia(m, id); err != nil {
+			return err
+		}
+
+		m = m.Clone()
+		m.tenantID = id
+
+		if m.From.Address == "" {
+			m.From = tenant.from
+		}
+
+		if t.Pipeline != nil {
+			return t.Pipeline.Send(m)
+		}
+
+		return t.Send(m)
+	}), nil
+}
+
+// Send implements [Mailer] interface, sending the messages of the
+// [TenantMailer.For] mailers with their tenant mailer and the other
+// ones with the fallback mailer.
+func (t *TenantMailer) Send(m *Message) error {
+	id := m.tenant()
+	if id == "" {
+		if t.fallback == nil {
+			return errors.New("message has no tenant")
+		}
+
+		return t.fallback.Send(m)
+	}
+
+	if err := checkTenantVia(m, id); err != nil {
+		return err
+	}
+
+	tenant, err := t.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	return tenant.mailer.Send(m)
+}
+
+// checkTenantVia rejects the tenant messages selecting a backend, since
+// they are sent with their tenant mailer, rather than ignoring it.
+func checkTenantVia(m *Message, id string) error {
+	if m.Via == "" {
+		return nil
+	}
+
+	return fmt.Errorf("backend %q can't be selected for the tenant %q messages", m.Via, id)
+}
+
+func (t *TenantMailer) lookup(id string) (*tenant, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tenant, ok := t.tenants[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTenant, id)
+	}
+
+	return tenant, nil
+}
+
+// Capabilities implements `mailer.Capable` interface, reporting the
+// features supported by the mailers of all tenants and the fallback one.
+func (t *TenantMailer) Capabilities() Capabilities {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	mailers := make([]Mailer, 0, len(t.tenants)+1)
+	if t.fallback != nil {
+		mailers = append(mailers, t.fallback)
+	}
+	for _, tenant := range t.tenants {
+		mailers = append(mailers, tenant.mailer)
+	}
+
+	return commonCapabilities(mailers)
+}
+
+// tenant returns the tenant id of the message (if any).
+func (m *Message) tenant() string {
+	return m.tenantID
+}
@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"errors"
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestTenantMailer(t *testing.T) {
+	var sentBy string
+	var sent *Message
+	recorder := func(name string) Mailer {
+		return MailerFunc(func(m *Message) error {
+			sentBy, sent = name, m
+			return nil
+		})
+	}
+
+	tenants := NewTenantMailer(recorder("default"))
+	if err := tenants.Add("acme", recorder("acme"), mail.Address{Name: "Acme", Address: "noreply@acme.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.Add("globex", recorder("globex"), mail.Address{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var piped int
+	tenants.Pipeline = MailerFunc(func(m *Message) error {
+		piped++
+		return tenants.Send(m)
+	})
+
+	acme, err := tenants.For("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, err := tenants.For("globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name         string
+		mailer       Mailer
+		message      *Message
+		expectedBy   string
+		expectedFrom string
+		expectedTags []string
+	}{
+		{
+			"default From",
+			acme,
+			&Message{Subject: "a", Tags: []string{"welcome"}},
+			"acme",
+			"noreply@acme.example",
+			[]string{"welcome"},
+		},
+		{
+			"explicit From and ignored tenant tag",
+			acme,
+			&Message{From: mail.Address{Address: "billing@acme.example"}, Tags: []string{"tenant:globex"}},
+			"acme",
+			"billing@acme.example",
+			[]string{"tenant:globex"},
+		},
+		{
+			"tenant without From",
+			globex,
+			&Message{From: mail.Address{Address: "app@example.com"}},
+			"globex",
+			"app@example.com",
+			nil,
+		},
+		{
+			"untrusted tenant tag",
+			tenants,
+			&Message{From: mail.Address{Address: "app@example.com"}, Tags: []string{"tenant:globex"}},
+			"default",
+			"app@example.com",
+			[]string{"tenant:globex"},
+		},
+		{
+			"message without tenant",
+			tenants,
+			&Message{From: mail.Address{Address: "app@example.com"}},
+			"default",
+			"app@example.com",
+			nil,
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			original := s.message.Clone()
+
+			if err := s.mailer.Send(s.message); err != nil {
+				t.Fatal(err)
+			}
+
+			if sentBy != s.expectedBy {
+				t.Fatalf("Expected to be sent by %q, got %q", s.expectedBy, sentBy)
+			}
+			if sent.From.Address != s.expectedFrom {
+				t.Fatalf("Expected From %q, got %q", s.expectedFrom, sent.From.Address)
+			}
+			if !reflect.DeepEqual(sent.Tags, s.expectedTags) {
+				t.Fatalf("Expected tags %v, got %v", s.expectedTags, sent.Tags)
+			}
+			if !reflect.DeepEqual(s.message, original) {
+				t.Fatalf("Expected the original message to be unchanged, got %+v", s.message)
+			}
+		})
+	}
+
+	if piped != 3 {
+		t.Fatalf("Expected the For mailers to send through the pipeline 3 times, got %d", piped)
+	}
+
+	if _, err := tenants.For("initech"); !errors.Is(err, ErrUnknownTenant) {
+		t.Fatalf("Expected ErrUnknownTenant, got %v", err)
+	}
+	if err := tenants.Send(&Message{tenantID: "initech"}); !errors.Is(err, ErrUnknownTenant) {
+		t.Fatalf("Expected ErrUnknownTenant, got %v", err)
+	}
+	if err := acme.Send(&Message{Via: "smtp"}); err == nil {
+		t.Fatal("Expected the tenant message selecting a backend to be rejected")
+	}
+	if err := tenants.Send(&Message{tenantID: "acme", Via: "smtp"}); err == nil {
+		t.Fatal("Expected the tenant message selecting a backend to be rejected")
+	}
+	if err := NewTenantMailer(nil).Send(&Message{}); err == nil {
+		t.Fatal("Expected the message without tenant to be rejected without fallback")
+	}
+}
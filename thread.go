@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"strings"
+)
+
+// Thread marks the message as a reply to the message with the specified
+// Message-ID, so that mail clients group them into a single conversation.
+//
+// The optional references are the parent message References (if any),
+// to which the parent Message-ID is appended as RFC 5322 section 3.6.4 requires.
+func (m *Message) Thread(messageID string, references ...string) {
+	messageID = normalizeMessageID(messageID)
+	if messageID == "" {
+		return
+	}
+
+	m.InReplyTo = messageID
+
+	result := make([]string, 0, len(references)+1)
+	seen := make(map[string]struct{}, len(references)+1)
+	for _, id := range append(references[:len(references):len(references)], messageID) {
+		id = normalizeMessageID(id)
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+	m.References = result
+}
+
+// threadHeaders returns the headers derived from the message InReplyTo and References.
+func (m *Message) threadHeaders() map[string]string {
+	result := make(map[string]string, 2)
+
+	if id := normalizeMessageID(m.InReplyTo); id != "" {
+		result["In-Reply-To"] = id
+	}
+
+	references := make([]string, 0, len(m.References))
+	for _, id := range m.References {
+		if id = normalizeMessageID(id); id != "" {
+			references = append(references, id)
+		}
+	}
+	if len(references) > 0 {
+		result["References"] = strings.Join(references, " ")
+	}
+
+	return result
+}
+
+// normalizeMessageID trims the Message-ID and wraps it in angle brackets if missing.
+func normalizeMessageID(id string) string {
+	id = strings.TrimSpace(stripNewLines(id))
+	if id == "" {
+		return ""
+	}
+
+	if !strings.HasPrefix(id, "<") {
+		id = "<" + id
+	}
+	if !strings.HasSuffix(id, ">") {
+		id += ">"
+	}
+
+	return id
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessageThread(t *testing.T) {
+	m := &Message{}
+	m.Thread("parent@example.com", "<root@example.com>", "parent@example.com")
+
+	if m.InReplyTo != "<parent@example.com>" {
+		t.Fatalf("Expected InReplyTo <parent@example.com>, got %q", m.InReplyTo)
+	}
+
+	expected := "<root@example.com> <parent@example.com>"
+	if v := strings.Join(m.References, " "); v != expected {
+		t.Fatalf("Expected References %q, got %q", expected, v)
+	}
+}
+
+func TestRendererThreadHeaders(t *testing.T) {
+	m := &Message{
+		From: mail.Address{Address: "sender@example.com"},
+		To:   []mail.Address{{Address: "to@example.com"}},
+		Text: "test",
+	}
+	m.Thread("<parent@example.com>", "<root@example.com>")
+
+	raw, err := newTestRenderer().Render(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := msg.Header.Get("In-Reply-To"); v != "<parent@example.com>" {
+		t.Fatalf("Expected In-Reply-To header <parent@example.com>, got %q", v)
+	}
+	if v := msg.Header.Get("References"); v != "<root@example.com> <parent@example.com>" {
+		t.Fatalf("Expected References header, got %q", v)
+	}
+}
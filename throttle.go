@@ -0,0 +1,536 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultThrottleMaxWait = time.Minute
+
+	// redisThrottleLease is the expiration of the shared concurrency slots,
+	// releasing the ones held by the instances that exited without doing it.
+	redisThrottleLease = 10 * time.Minute
+
+	// maxPerMinute is the max rate limit, ie. one send per millisecond.
+	maxPerMinute = 60000
+
+	// throttleSlotRetry is the retry delay of the sends that didn't
+	// get a concurrency slot, since when one frees up is unknown.
+	throttleSlotRetry = 30 * time.Second
+
+	// minThrottleSweep is the number of domains from which the idle ones are evicted.
+	minThrottleSweep = 1024
+)
+
+// DomainLimit defines the sending limits of a single recipient domain.
+//
+// A zero value means no limit.
+type DomainLimit struct {
+	Domain      string `mapstructure:"domain" json:"domain,omitempty" bson:"domain,omitempty"`
+	Concurrency int    `mapstructure:"concurrency" json:"concurrency,omitempty" bson:"concurrency,omitempty"` // max concurrent sends
+	PerMinute   int    `mapstructure:"per_minute" json:"per_minute,omitempty" bson:"per_minute,omitempty"`    // max messages per minute (at most 60000)
+}
+
+// ThrottleConfig defines the per recipient domain throttling settings.
+type ThrottleConfig struct {
+	Default DomainLimit   `mapstructure:"default" json:"default,omitempty" bson:"default,omitempty"` // the limits of every domain not listed in Domains
+	Domains []DomainLimit `mapstructure:"domains" json:"domains,omitempty" bson:"domains,omitempty"`
+	MaxWait time.Duration `mapstructure:"max_wait" json:"max_wait,omitempty" bson:"max_wait,omitempty"` // max time to wait for a free slot, default to 1m
+
+	// Redis shares the limits between the instances (in-memory if not set),
+	// so that the instances sending from the same domain don't exceed them together.
+	Redis *RedisConfig `mapstructure:"redis" json:"redis,omitempty" bson:"redis,omitempty"`
+}
+
+// Validate checks the throttle configuration for common mistakes.
+func (c ThrottleConfig) Validate() error {
+	var errs []error
+
+	limits := append([]DomainLimit{c.Default}, c.Domains...)
+	seen := make(map[string]struct{}, len(c.Domains))
+
+	for i, limit := range limits {
+		name := "default"
+		if i > 0 {
+			name = fmt.Sprintf("domains[%d]", i-1)
+
+			domain := strings.ToLower(strings.TrimSpace(limit.Domain))
+			if domain == "" {
+				errs = append(errs, fmt.Errorf("throttle: %s domain is required", name))
+			} else if _, ok := seen[domain]; ok {
+				errs = append(errs, fmt.Errorf("throttle: duplicated domain %q", limit.Domain))
+			}
+			seen[domain] = struct{}{}
+		}
+
+		if limit.Concurrency < 0 {
+			errs = append(errs, fmt.Errorf("throttle: %s concurrency must be positive, got %d", name, limit.Concurrency))
+		}
+		if limit.PerMinute < 0 {
+			errs = append(errs, fmt.Errorf("throttle: %s per_minute must be positive, got %d", name, limit.PerMinute))
+		} else if limit.PerMinute > maxPerMinute {
+			errs = append(errs, fmt.Errorf("throttle: %s per_minute must be at most %d, got %d", name, maxPerMinute, limit.PerMinute))
+		}
+	}
+
+	if c.MaxWait < 0 {
+		errs = append(errs, fmt.Errorf("throttle: max_wait must be positive, got %s", c.MaxWait))
+	}
+
+	if c.Redis != nil {
+		if err := c.Redis.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("throttle: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c ThrottleConfig) Redacted() ThrottleConfig {
+	if c.Redis != nil {
+		redis := c.Redis.Redacted()
+		c.Redis = &redis
+	}
+
+	return c
+}
+
+// ThrottleError is returned when a message could not get a send slot
+// for one of its recipient domains within the max wait time.
+// The message should be retried (eg. re-queued) at RetryAt.
+type ThrottleError struct {
+	Domain  string
+	RetryAt time.Time
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("throttle limit of domain %q reached, retry at %s", e.Domain, e.RetryAt.Format(time.RFC3339))
+}
+
+// RetryTime returns RetryAt, so that the send is deferred (see [RetryAt]).
+func (e *ThrottleError) RetryTime() time.Time {
+	return e.RetryAt
+}
+
+// Throttler limits the concurrency and the rate of the sends per recipient domain,
+// sharing them between the instances if Redis is configured.
+type Throttler struct {
+	// Clock is an optional time source (default to the system clock).
+	Clock Clock
+
+	config  ThrottleConfig
+	redis   *redisClient // the shared state, nil if in-memory
+	mu      sync.Mutex
+	domains map[string]*domainThrottle // the limited domains in use or with a pending rate
+	sweepAt int                        // the number of domains triggering the eviction of the idle ones
+}
+
+// NewThrottler creates a new throttler from the provided config.
+func NewThrottler(config ThrottleConfig) *Throttler {
+	if config.MaxWait <= 0 {
+		config.MaxWait = defaultThrottleMaxWait
+	}
+
+	t := &Throttler{config: config, domains: map[string]*domainThrottle{}, sweepAt: minThrottleSweep}
+	if config.Redis != nil {
+		t.redis = newRedisClient(*config.Redis)
+	}
+
+	return t
+}
+
+// Close closes the Redis connection, if any.
+func (t *Throttler) Close() error {
+	if t.redis == nil {
+		return nil
+	}
+
+	return t.redis.close()
+}
+
+// domainThrottle holds the state of a single domain.
+type domainThrottle struct {
+	limit DomainLimit
+	slots chan struct{} // concurrency semaphore, nil if unlimited
+	users int           // the pending acquisitions, guarded by the throttler mutex
+
+	mu   sync.Mutex
+	next time.Time // the earliest time of the next send (rate limit)
+}
+
+// idle reports whether the domain state could be dropped without
+// losing its limits, ie. it is not used and its rate elapsed.
+func (d *domainThrottle) idle(t time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.users == 0 && !d.next.After(t)
+}
+
+// domain returns the state of the domain, held until it is put back.
+func (t *Throttler) domain(name string) *domainThrottle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.domains[name]; ok {
+		d.users++
+		return d
+	}
+
+	limit := t.config.Default
+	for _, l := range t.config.Domains {
+		if strings.EqualFold(strings.TrimSpace(l.Domain), name) {
+			limit = l
+			break
+		}
+	}
+
+	d := &domainThrottle{limit: limit, users: 1}
+	if limit.Concurrency > 0 {
+		d.slots = make(chan struct{}, limit.Concurrency)
+	}
+
+	// the unlimited domains have no state to keep
+	if limit.Concurrency <= 0 && limit.PerMinute <= 0 {
+		return d
+	}
+
+	if len(t.domains) >= t.sweepAt {
+		current := now(t.Clock)
+		for key, other := range t.domains {
+			if other.idle(current) {
+				delete(t.domains, key)
+			}
+		}
+		t.sweepAt = max(2*len(t.domains), minThrottleSweep)
+	}
+	t.domains[name] = d
+
+	return d
+}
+
+// put gives back the domain state taken with [Throttler.domain].
+func (t *Throttler) put(d *domainThrottle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d.users--
+}
+
+// Acquire waits (up to the configured max wait) for a send slot for each
+// of the provided recipient domains and returns a function releasing them.
+//
+// The concurrency slot of a domain is taken before its rate reservation,
+// and the reservations are given back when a domain can't be acquired, so
+// that the failed sends don't delay the next ones.
+func (t *Throttler) Acquire(domains []string) (release func(), err error) {
+	deadline := now(t.Clock).Add(t.config.MaxWait)
+
+	var used []*domainThrottle     // the domains to put back
+	var acquired []*domainThrottle // the domains holding a local slot
+	var shared []sharedSlot        // the domains holding a shared slot
+	var reserved []rateReservation // the local rate reservations
+	release = func() {
+		for _, d := range acquired {
+			<-d.slots
+		}
+		for _, slot := range shared {
+			t.releaseShared(slot)
+		}
+		for _, d := range used {
+			t.put(d)
+		}
+	}
+	fail := func(err error) (func(), error) {
+		for _, r := range reserved {
+			r.domain.unreserve(r.at)
+		}
+		release()
+		return nil, err
+	}
+
+	// acquire in a fixed order to prevent deadlocks between concurrent sends
+	domains = append([]string(nil), domains...)
+	sort.Strings(domains)
+
+	for _, name := range domains {
+		d := t.domain(name)
+		used = append(used, d)
+
+		if t.redis != nil {
+			slot, err := t.acquireShared(name, d.limit, deadline)
+			if err != nil {
+				return fail(err)
+			}
+			if slot != nil {
+				shared = append(shared, *slot)
+			}
+			continue
+		}
+
+		if d.slots != nil {
+			if !d.take(t.Clock, deadline) {
+				return fail(&ThrottleError{Domain: name, RetryAt: now(t.Clock).Add(throttleSlotRetry)})
+			}
+			acquired = append(acquired, d)
+		}
+
+		at, err := d.reserve(name, deadline, t.Clock)
+		if err != nil {
+			return fail(err)
+		}
+		reserved = append(reserved, rateReservation{domain: d, at: at})
+	}
+
+	return release, nil
+}
+
+// rateReservation is a send reserved at a domain rate (see [domainThrottle.reserve]).
+type rateReservation struct {
+	domain *domainThrottle
+	at     time.Time
+}
+
+// take takes a concurrency slot of the domain, waiting up to the deadline.
+func (d *domainThrottle) take(clock Clock, deadline time.Time) bool {
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timeout, stop := newTimer(clock, deadline.Sub(now(clock)))
+	defer stop()
+
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// reserve reserves a send at the domain rate, sleeping until it is allowed,
+// and returns the reserved time (zero without rate limit).
+func (d *domainThrottle) reserve(name string, deadline time.Time, clock Clock) (time.Time, error) {
+	if d.limit.PerMinute <= 0 {
+		return time.Time{}, nil
+	}
+
+	interval := time.Minute / time.Duration(d.limit.PerMinute)
+
+	d.mu.Lock()
+	current := now(clock)
+	at := d.next
+	if at.Before(current) {
+		at = current
+	}
+	if at.After(deadline) {
+		d.mu.Unlock()
+		return time.Time{}, &ThrottleError{Domain: name, RetryAt: at}
+	}
+	d.next = at.Add(interval)
+	d.mu.Unlock()
+
+	sleep(clock, at.Sub(current))
+
+	return at, nil
+}
+
+// unreserve gives back the send reserved at the specified time, unless
+// the next sends have been reserved after it meanwhile.
+func (d *domainThrottle) unreserve(at time.Time) {
+	if d.limit.PerMinute <= 0 || at.IsZero() {
+		return
+	}
+
+	interval := time.Minute / time.Duration(d.limit.PerMinute)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.next.Equal(at.Add(interval)) {
+		d.next = at
+	}
+}
+
+// redisNowScript sets the now variable to the Redis server time (in unix
+// milliseconds), so that all the instances share the same clock. The
+// commands replication allows writing after reading it (Redis < 5).
+const redisNowScript = `redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+// redisReserveScript reserves a send at the rate of the key, which holds the
+// earliest time of the next send, ARGV[1] milliseconds apart. It returns the
+// wait (in milliseconds) until the reserved send, or its negated value minus
+// one if it exceeds the ARGV[2] max wait (not reserved).
+const redisReserveScript = redisNowScript + `local at = tonumber(redis.call('GET', KEYS[1]) or '0')
+if at < now then at = now end
+if at - now > tonumber(ARGV[2]) then return now - at - 1 end
+local next = at + tonumber(ARGV[1])
+redis.call('SET', KEYS[1], next, 'PX', next - now)
+return at - now`
+
+// redisAcquireScript takes one of the ARGV[1] slots of the key, which holds
+// the ARGV[3] token of every holder scored by the expiration of its ARGV[2]
+// lease, so that the slots of the exited instances expire on their own.
+// It returns 0 if taken, or the wait (in milliseconds) until the earliest
+// lease expires if none is free.
+const redisAcquireScript = redisNowScript + `redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 0
+end
+local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return math.max(tonumber(first[2]) - now, 1)`
+
+// redisReleaseScript gives back the ARGV[1] token slot of the KEYS[1] key
+// (unless it expired meanwhile) and notifies the waiters through the KEYS[2]
+// list, keeping at most ARGV[2] notifications for ARGV[3] milliseconds.
+const redisReleaseScript = `if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('RPUSH', KEYS[2], '1')
+	redis.call('LTRIM', KEYS[2], -tonumber(ARGV[2]), -1)
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+end
+return 0`
+
+// sharedSlot is a concurrency slot of a domain held in Redis.
+type sharedSlot struct {
+	domain string
+	token  string
+	limit  int
+}
+
+// acquireShared reserves a send of the domain in Redis, waiting for a free
+// concurrency slot and for the rate. It returns the held slot, if any.
+//
+// The waits for a slot block on the release notifications (requiring
+// Redis 6 or later), up to the expiration of the earliest lease.
+func (t *Throttler) acquireShared(name string, limit DomainLimit, deadline time.Time) (*sharedSlot, error) {
+	ctx := context.Background()
+	prefix := t.redis.config.prefix() + "throttle:"
+
+	var slot *sharedSlot
+	if limit.Concurrency > 0 {
+		token := PseudorandomString(20)
+		for {
+			reply, err := t.redis.do(ctx, "EVAL", redisAcquireScript, "1", prefix+"slots:"+name,
+				strconv.Itoa(limit.Concurrency), strconv.FormatInt(redisThrottleLease.Milliseconds(), 10), token)
+			if err != nil {
+				return nil, err
+			}
+			wait, ok := reply.(int64)
+			if !ok {
+				return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+			}
+			if wait == 0 {
+				slot = &sharedSlot{domain: name, token: token, limit: limit.Concurrency}
+				break
+			}
+
+			remaining := deadline.Sub(now(t.Clock))
+			if remaining <= 0 {
+				return nil, &ThrottleError{Domain: name, RetryAt: now(t.Clock).Add(throttleSlotRetry)}
+			}
+
+			// within the command timeout, so that the connection is not reset
+			block := max(min(remaining, time.Duration(wait)*time.Millisecond, t.redis.config.Timeout/2), time.Millisecond)
+			if _, err := t.redis.do(ctx, "BLPOP", prefix+"released:"+name, strconv.FormatFloat(block.Seconds(), 'f', 3, 64)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if limit.PerMinute <= 0 {
+		return slot, nil
+	}
+
+	interval := time.Minute / time.Duration(limit.PerMinute)
+	maxWait := max(deadline.Sub(now(t.Clock)), 0)
+
+	reply, err := t.redis.do(ctx, "EVAL", redisReserveScript, "1", prefix+"rate:"+name,
+		strconv.FormatInt(interval.Milliseconds(), 10), strconv.FormatInt(maxWait.Milliseconds(), 10))
+	if err == nil {
+		if _, ok := reply.(int64); !ok {
+			err = fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+	}
+	if err != nil {
+		if slot != nil {
+			t.releaseShared(*slot)
+		}
+		return nil, err
+	}
+
+	wait := reply.(int64)
+	if wait < 0 {
+		if slot != nil {
+			t.releaseShared(*slot)
+		}
+		return nil, &ThrottleError{Domain: name, RetryAt: now(t.Clock).Add(time.Duration(-wait-1) * time.Millisecond)}
+	}
+
+	sleep(t.Clock, time.Duration(wait)*time.Millisecond)
+
+	return slot, nil
+}
+
+// releaseShared gives back the shared concurrency slot of the domain.
+// A failure leaves the slot taken until its lease expires.
+func (t *Throttler) releaseShared(slot sharedSlot) {
+	prefix := t.redis.config.prefix() + "throttle:"
+	_, _ = t.redis.do(context.Background(), "EVAL", redisReleaseScript, "2", prefix+"slots:"+slot.domain, prefix+"released:"+slot.domain,
+		slot.token, strconv.Itoa(slot.limit), strconv.FormatInt(redisThrottleLease.Milliseconds(), 10))
+}
+
+// Throttle returns a middleware that limits the concurrency and the
+// rate of the sends per recipient domain according to the throttler config.
+//
+// Sends wait for a free slot for all their recipient domains and fail
+// with [ThrottleError] if none is available within the max wait time.
+func Throttle(throttler *Throttler) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			release, err := throttler.Acquire(recipientDomains(m))
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			return next.Send(m)
+		})
+	}
+}
+
+// recipientDomains returns the unique lowercased domains of all message recipients.
+func recipientDomains(m *Message) []string {
+	var result []string
+	seen := map[string]struct{}{}
+
+	for _, addr := range envelopeRecipients(m) {
+		i := strings.LastIndexByte(addr, '@')
+		if i < 0 {
+			continue
+		}
+
+		domain := strings.ToLower(addr[i+1:])
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		result = append(result, domain)
+	}
+
+	return result
+}
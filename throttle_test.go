@@ -0,0 +1,333 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottleConcurrency(t *testing.T) {
+	throttler := NewThrottler(ThrottleConfig{
+		Domains: []DomainLimit{{Domain: "Example.com", Concurrency: 2}},
+	})
+
+	var current, max atomic.Int32
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		n := current.Add(1)
+		for {
+			old := max.Load()
+			if n <= old || max.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		current.Add(-1)
+		return nil
+	}), Throttle(throttler))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mailer.Send(&Message{To: []mail.Address{{Address: "user@EXAMPLE.com"}}})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := max.Load(); v != 2 {
+		t.Fatalf("Expected max 2 concurrent sends, got %d", v)
+	}
+}
+
+func TestThrottleRate(t *testing.T) {
+	m := &Message{To: []mail.Address{{Address: "user@example.com"}}}
+
+	t.Run("wait", func(t *testing.T) {
+		throttler := NewThrottler(ThrottleConfig{
+			Default: DomainLimit{PerMinute: 600}, // 1 message every 100ms
+		})
+		mailer := Chain(MailerFunc(func(m *Message) error { return nil }), Throttle(throttler))
+
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			if err := mailer.Send(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+			t.Fatalf("Expected the second send to be delayed, took %s", elapsed)
+		}
+	})
+
+	t.Run("max wait", func(t *testing.T) {
+		throttler := NewThrottler(ThrottleConfig{
+			Default: DomainLimit{PerMinute: 600},
+			MaxWait: 50 * time.Millisecond,
+		})
+		mailer := Chain(MailerFunc(func(m *Message) error { return nil }), Throttle(throttler))
+
+		if err := mailer.Send(m); err != nil {
+			t.Fatal(err)
+		}
+
+		var throttleErr *ThrottleError
+		err := mailer.Send(m)
+		if !errors.As(err, &throttleErr) || throttleErr.Domain != "example.com" {
+			t.Fatalf("Expected ThrottleError, got %v", err)
+		}
+
+		// other domains are not affected
+		if err := mailer.Send(&Message{To: []mail.Address{{Address: "user@example.org"}}}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// jumpClock is a [TimerClock] advancing its time instantly on every wait.
+type jumpClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *jumpClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.t
+}
+
+func (c *jumpClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = c.t.Add(d)
+
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func TestThrottleClock(t *testing.T) {
+	clock := &jumpClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	start := clock.Now()
+
+	throttler := NewThrottler(ThrottleConfig{
+		Default: DomainLimit{PerMinute: 1, Concurrency: 1},
+		MaxWait: 5 * time.Minute,
+	})
+	throttler.Clock = clock
+
+	for i := 0; i < 3; i++ {
+		release, err := throttler.Acquire([]string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 2*time.Minute {
+		t.Fatalf("Expected the sends to wait 2m on the clock, got %s", elapsed)
+	}
+
+	// the concurrency timeout is retried later
+	release, err := throttler.Acquire([]string{"example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	var throttleErr *ThrottleError
+	_, err = throttler.Acquire([]string{"example.org"})
+	if !errors.As(err, &throttleErr) || !throttleErr.RetryAt.After(clock.Now()) {
+		t.Fatalf("Expected a later retry, got %v", err)
+	}
+	if at, ok := RetryAt(err); !ok || !at.Equal(throttleErr.RetryAt) {
+		t.Fatalf("Expected the throttle error to be deferred, got %s", at)
+	}
+}
+
+// frozenClock is a [TimerClock] whose waits end instantly, without advancing its time.
+type frozenClock struct {
+	t time.Time
+}
+
+func (c frozenClock) Now() time.Time {
+	return c.t
+}
+
+func (c frozenClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func TestThrottleFailedAcquire(t *testing.T) {
+	throttler := NewThrottler(ThrottleConfig{
+		Default: DomainLimit{PerMinute: 1, Concurrency: 1},
+		MaxWait: 90 * time.Second,
+	})
+	throttler.Clock = frozenClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	acquire := func(domains ...string) error {
+		release, err := throttler.Acquire(domains)
+		if err == nil {
+			t.Cleanup(release)
+		}
+		return err
+	}
+
+	// the concurrency timeout doesn't reserve a send at the rate
+	release, err := throttler.Acquire([]string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acquire("example.com"); err == nil {
+		t.Fatal("Expected the concurrency timeout")
+	}
+	release()
+	if err := acquire("example.com"); err != nil {
+		t.Fatalf("Expected the next send at the rate, got %v", err)
+	}
+
+	// the reservations of the acquired domains are given back on failure
+	if err := acquire("example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acquire("example.org", "example.net"); err == nil {
+		t.Fatal("Expected the concurrency timeout")
+	}
+	if err := acquire("example.org"); err != nil {
+		t.Fatalf("Expected the example.org reservation to be given back, got %v", err)
+	}
+}
+
+func TestThrottleEviction(t *testing.T) {
+	clock := &jumpClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	throttler := NewThrottler(ThrottleConfig{Default: DomainLimit{Concurrency: 1}})
+	throttler.Clock = clock
+
+	for i := 0; i < 3*minThrottleSweep; i++ {
+		release, err := throttler.Acquire([]string{fmt.Sprintf("example%d.com", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+
+	throttler.mu.Lock()
+	defer throttler.mu.Unlock()
+
+	if n := len(throttler.domains); n > minThrottleSweep {
+		t.Fatalf("Expected the idle domains to be evicted, got %d", n)
+	}
+
+	// the unlimited domains are never kept
+	unlimited := NewThrottler(ThrottleConfig{})
+	release, _ := unlimited.Acquire([]string{"example.com"})
+	release()
+	if len(unlimited.domains) != 0 {
+		t.Fatalf("Expected no unlimited domain state, got %v", unlimited.domains)
+	}
+}
+
+func TestThrottleRedis(t *testing.T) {
+	address, counters := newTestRedis(t, "")
+	m := &Message{To: []mail.Address{{Address: "user@example.com"}}}
+
+	t.Run("concurrency", func(t *testing.T) {
+		config := ThrottleConfig{
+			Default: DomainLimit{Concurrency: 1},
+			MaxWait: 30 * time.Millisecond,
+			Redis:   &RedisConfig{Address: address, Prefix: "concurrency:"},
+		}
+
+		// two instances sharing the limit
+		first := NewThrottler(config)
+		defer first.Close()
+		second := NewThrottler(config)
+		defer second.Close()
+
+		release, err := first.Acquire([]string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var throttleErr *ThrottleError
+		if _, err := second.Acquire([]string{"example.com"}); !errors.As(err, &throttleErr) {
+			t.Fatalf("Expected ThrottleError, got %v", err)
+		}
+
+		release()
+		if _, ok := counters["concurrency:throttle:slots:example.com"]; ok {
+			t.Fatalf("Expected the slot to be released, got %v", counters)
+		}
+
+		release, err = second.Acquire([]string{"example.com"})
+		if err != nil {
+			t.Fatalf("Expected the released slot to be acquired, got %v", err)
+		}
+		release()
+	})
+
+	t.Run("notify", func(t *testing.T) {
+		config := ThrottleConfig{
+			Default: DomainLimit{Concurrency: 1},
+			MaxWait: time.Second,
+			Redis:   &RedisConfig{Address: address, Prefix: "notify:"},
+		}
+
+		first := NewThrottler(config)
+		defer first.Close()
+		second := NewThrottler(config)
+		defer second.Close()
+
+		release, err := first.Acquire([]string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(20*time.Millisecond, release)
+
+		// woken by the release rather than the lease expiration
+		start := time.Now()
+		release, err = second.Acquire([]string{"example.com"})
+		if err != nil {
+			t.Fatalf("Expected the released slot to be acquired, got %v", err)
+		}
+		release()
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("Expected the waiter to be notified, waited %v", elapsed)
+		}
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		config := ThrottleConfig{
+			Default: DomainLimit{PerMinute: 600}, // 1 message every 100ms
+			MaxWait: 50 * time.Millisecond,
+			Redis:   &RedisConfig{Address: address, Prefix: "rate:"},
+		}
+
+		first := NewThrottler(config)
+		defer first.Close()
+		second := NewThrottler(config)
+		defer second.Close()
+
+		if err := Chain(MailerFunc(func(m *Message) error { return nil }), Throttle(first)).Send(m); err != nil {
+			t.Fatal(err)
+		}
+
+		var throttleErr *ThrottleError
+		err := Chain(MailerFunc(func(m *Message) error { return nil }), Throttle(second)).Send(m)
+		if !errors.As(err, &throttleErr) || throttleErr.Domain != "example.com" || throttleErr.RetryAt.IsZero() {
+			t.Fatalf("Expected ThrottleError, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// maxMessagePartSize is the max size of a message body or attachment,
+// ie. the message size limit of the most common relays.
+const maxMessagePartSize = 25 << 20
+
+// MessageIssueKind is the kind of a [MessageIssue].
+type MessageIssueKind string
+
+const (
+	IssueNoRecipients        MessageIssueKind = "no_recipients"        // the message has no To, Cc or Bcc recipient
+	IssueInvalidAddress      MessageIssueKind = "invalid_address"      // the address is not a valid RFC 5322 one
+	IssueDuplicateAttachment MessageIssueKind = "duplicate_attachment" // the attachment names differ only by case
+	IssueOversizedPart       MessageIssueKind = "oversized_part"       // the body or attachment exceeds 25MB
+	IssueEmptySubject        MessageIssueKind = "empty_subject"        // the subject is empty (warning)
+	IssueEmptyBody           MessageIssueKind = "empty_body"           // the message has neither body nor attachment (warning)
+)
+
+// MessageIssue is a problem found by [Message.Validate].
+type MessageIssue struct {
+	Field   string           `json:"field"` // eg. "to", "subject" or "attachments"
+	Kind    MessageIssueKind `json:"kind"`
+	Detail  string           `json:"detail,omitempty"`  // eg. the invalid address or the attachment name
+	Warning bool             `json:"warning,omitempty"` // the message could still be sent
+}
+
+func (i MessageIssue) String() string {
+	s := fmt.Sprintf("%s: %s", i.Field, i.Kind)
+	if i.Detail != "" {
+		s += " " + i.Detail
+	}
+
+	return s
+}
+
+// MessageValidationError is the error of the messages with blocking issues
+// (see [Validated]), holding all the issues found (including the warnings).
+type MessageValidationError struct {
+	Issues []MessageIssue
+}
+
+func (e *MessageValidationError) Error() string {
+	var parts []string
+	for _, issue := range e.Issues {
+		if !issue.Warning {
+			parts = append(parts, issue.String())
+		}
+	}
+
+	return "invalid message: " + strings.Join(parts, "; ")
+}
+
+// Validate checks the message for common mistakes, returning the found
+// issues in their fields order. The issues without the Warning flag
+// prevent the message from being sent by the [Validated] middleware.
+//
+// The symbolic recipients (see [ResolveRecipients]) are valid addresses
+// and only the sized attachment readers (see [Message.Clone]) are checked
+// for their size, so that no reader is consumed.
+func (m *Message) Validate() []MessageIssue {
+	var issues []MessageIssue
+
+	add := func(field string, kind MessageIssueKind, detail string) {
+		issues = append(issues, MessageIssue{Field: field, Kind: kind, Detail: detail})
+	}
+	warn := func(field string, kind MessageIssueKind) {
+		issues = append(issues, MessageIssue{Field: field, Kind: kind, Warning: true})
+	}
+
+	if m.From.Address != "" && !isValidAddress(m.From.Address) {
+		add("from", IssueInvalidAddress, m.From.Address)
+	}
+
+	if len(m.To)+len(m.Cc)+len(m.Bcc) == 0 {
+		add("to", IssueNoRecipients, "")
+	}
+
+	lists := []struct {
+		field     string
+		addresses []mail.Address
+	}{{"to", m.To}, {"cc", m.Cc}, {"bcc", m.Bcc}}
+	for _, list := range lists {
+		for _, addr := range list.addresses {
+			if !isSymbolicRecipient(addr.Address) && !isValidAddress(addr.Address) {
+				add(list.field, IssueInvalidAddress, addr.Address)
+			}
+		}
+	}
+
+	if m.ReturnPath != "" && !isValidAddress(m.ReturnPath) {
+		add("return_path", IssueInvalidAddress, m.ReturnPath)
+	}
+
+	if strings.TrimSpace(m.Subject) == "" {
+		warn("subject", IssueEmptySubject)
+	}
+
+	if m.Text == "" && m.HTML == "" && m.AMP == "" && len(m.Attachments) == 0 {
+		warn("body", IssueEmptyBody)
+	}
+
+	for _, body := range []struct{ field, value string }{{"text", m.Text}, {"html", m.HTML}, {"amp", m.AMP}} {
+		if len(body.value) > maxMessagePartSize {
+			add(body.field, IssueOversizedPart, fmt.Sprintf("%d bytes", len(body.value)))
+		}
+	}
+
+	seen := map[string]string{}
+	for _, attachments := range []struct {
+		field   string
+		readers map[string]io.Reader
+	}{{"attachments", m.Attachments}, {"inline", m.Inline}} {
+		for _, name := range sortedNames(attachments.readers) {
+			key := strings.ToLower(name)
+			if other, ok := seen[key]; ok {
+				add(attachments.field, IssueDuplicateAttachment, fmt.Sprintf("%q (same as %q)", name, other))
+			} else {
+				seen[key] = name
+			}
+
+			if r, ok := attachments.readers[name].(sizedReaderAt); ok && r.Size() > maxMessagePartSize {
+				add(attachments.field, IssueOversizedPart, fmt.Sprintf("%q of %d bytes", name, r.Size()))
+			}
+		}
+	}
+
+	return issues
+}
+
+// isValidAddress reports whether the address is a valid RFC 5322 addr-spec.
+func isValidAddress(address string) bool {
+	_, err := mail.ParseAddress("<" + address + ">")
+
+	return err == nil
+}
+
+func sortedNames(readers map[string]io.Reader) []string {
+	names := make([]string, 0, len(readers))
+	for name := range readers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Validated returns a middleware rejecting the messages with blocking
+// issues (see [Message.Validate]) with a [MessageValidationError],
+// before they are queued or sent.
+func Validated() Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			issues := m.Validate()
+			for _, issue := range issues {
+				if !issue.Warning {
+					return &MessageValidationError{Issues: issues}
+				}
+			}
+
+			return next.Send(m)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"errors"
+	"io"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageValidate(t *testing.T) {
+	m := &Message{
+		From:        mail.Address{Address: "sender@example.com"},
+		To:          []mail.Address{{Address: "john@example.com"}, {Address: "team:oncall"}},
+		Cc:          []mail.Address{{Address: "invalid@"}},
+		Subject:     "Hello",
+		Text:        "Hello world",
+		Attachments: map[string]io.Reader{"Report.pdf": strings.NewReader("a"), "big.bin": io.NewSectionReader(nil, 0, maxMessagePartSize+1)},
+		Inline:      map[string]io.Reader{"report.PDF": strings.NewReader("b")},
+	}
+
+	expected := []MessageIssue{
+		{Field: "cc", Kind: IssueInvalidAddress, Detail: "invalid@"},
+		{Field: "attachments", Kind: IssueOversizedPart, Detail: `"big.bin" of 26214401 bytes`},
+		{Field: "inline", Kind: IssueDuplicateAttachment, Detail: `"report.PDF" (same as "Report.pdf")`},
+	}
+	if issues := m.Validate(); !reflect.DeepEqual(issues, expected) {
+		t.Fatalf("Expected issues %v, got %v", expected, issues)
+	}
+
+	expected = []MessageIssue{
+		{Field: "to", Kind: IssueNoRecipients},
+		{Field: "subject", Kind: IssueEmptySubject, Warning: true},
+		{Field: "body", Kind: IssueEmptyBody, Warning: true},
+	}
+	if issues := (&Message{}).Validate(); !reflect.DeepEqual(issues, expected) {
+		t.Fatalf("Expected issues %v, got %v", expected, issues)
+	}
+}
+
+func TestValidated(t *testing.T) {
+	var sent int
+	mailer := Chain(MailerFunc(func(*Message) error {
+		sent++
+		return nil
+	}), Validated())
+
+	// the warnings don't prevent the send
+	if err := mailer.Send(&Message{To: []mail.Address{{Address: "john@example.com"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := mailer.Send(&Message{To: []mail.Address{{Address: "john"}}, Subject: "Hello"})
+
+	var validationErr *MessageValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Issues) != 2 || err.Error() != "invalid message: to: invalid_address john" {
+		t.Fatalf("Expected the validation error, got %v", err)
+	}
+	if sent != 1 {
+		t.Fatalf("Expected only the valid message to be sent, got %d", sent)
+	}
+}
@@ -0,0 +1,252 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VirusAction is the action taken on the messages with infected
+// attachments (see [VirusScanConfig]).
+type VirusAction string
+
+const (
+	// VirusActionReject fails the send when any attachment is infected.
+	VirusActionReject VirusAction = "reject"
+	// VirusActionStrip removes the infected attachments and sends the rest
+	// of the message, listing the removed ones in the X-Virus-Stripped header.
+	VirusActionStrip VirusAction = "strip"
+)
+
+const (
+	defaultVirusScanTimeout = 30 * time.Second
+
+	// clamdChunkSize is the INSTREAM chunk size (smaller than the clamd StreamMaxLength default).
+	clamdChunkSize = 64 << 10
+)
+
+// VirusScanResult describes the outcome of a single attachment scan.
+type VirusScanResult struct {
+	Infected bool
+	Virus    string // the detected signature name (if infected)
+}
+
+// VirusScanner scans a single attachment content.
+type VirusScanner interface {
+	Scan(ctx context.Context, r io.Reader) (*VirusScanResult, error)
+}
+
+// VirusError is returned by the virus scan middleware when
+// a message is rejected because of infected attachments.
+type VirusError struct {
+	Infected map[string]string // attachment name -> virus name
+}
+
+func (e *VirusError) Error() string {
+	return "message rejected because of infected attachments: " + formatInfected(e.Infected)
+}
+
+// VirusScanConfig defines the attachments virus scan settings.
+type VirusScanConfig struct {
+	Clamd   string        `mapstructure:"clamd" json:"clamd,omitempty" bson:"clamd,omitempty"`    // clamd tcp address (eg. 127.0.0.1:3310) or unix socket path
+	Action  VirusAction   `mapstructure:"action" json:"action,omitempty" bson:"action,omitempty"` // default to "reject"
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`
+}
+
+// Validate checks the virus scan configuration for common mistakes.
+func (c VirusScanConfig) Validate() error {
+	var errs []error
+
+	if c.Clamd == "" {
+		errs = append(errs, errors.New("virus_scan: clamd address is required"))
+	}
+
+	switch c.Action {
+	case "", VirusActionReject, VirusActionStrip:
+	default:
+		errs = append(errs, fmt.Errorf("virus_scan: unknown action %q, expected %q or %q", c.Action, VirusActionReject, VirusActionStrip))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("virus_scan: timeout must be positive, got %s", c.Timeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Scanner returns the VirusScanner described by the config.
+func (c VirusScanConfig) Scanner() (VirusScanner, error) {
+	if c.Clamd == "" {
+		return nil, errors.New("clamd address must be set")
+	}
+
+	if strings.HasPrefix(c.Clamd, "/") || strings.HasPrefix(c.Clamd, "unix:") {
+		return &ClamdScanner{Network: "unix", Address: strings.TrimPrefix(c.Clamd, "unix:")}, nil
+	}
+
+	return &ClamdScanner{Network: "tcp", Address: c.Clamd}, nil
+}
+
+// VirusScan returns a middleware that scans all (incl. the inline)
+// attachments of every message with the provided scanner before
+// handing it to the next mailer.
+//
+// Messages with infected attachments are either rejected with
+// [VirusError] or sent without them, depending on the configured action.
+// Messages without attachments are passed as they are.
+func VirusScan(scanner VirusScanner, cfg VirusScanConfig) Middleware {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultVirusScanTimeout
+	}
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			if len(m.Attachments)+len(m.Inline) == 0 {
+				return next.Send(m)
+			}
+
+			// buffer the attachments so that they could be both scanned and sent
+			m = m.Clone()
+			if err := m.bufferAttachments(); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			infected := map[string]string{}
+
+			for _, attachments := range []map[string]io.Reader{m.Attachments, m.Inline} {
+				for name, r := range attachments {
+					result, err := scanner.Scan(ctx, cloneReader(r))
+					if err != nil {
+						return fmt.Errorf("virus scan of attachment %q failed: %w", name, err)
+					}
+
+					if result.Infected {
+						infected[name] = result.Virus
+						if cfg.Action == VirusActionStrip {
+							delete(attachments, name)
+						}
+					}
+				}
+			}
+
+			if len(infected) > 0 {
+				if cfg.Action != VirusActionStrip {
+					return &VirusError{Infected: infected}
+				}
+
+				if m.Headers == nil {
+					m.Headers = map[string]string{}
+				}
+				m.Headers["X-Virus-Stripped"] = formatInfected(infected)
+			}
+
+			return next.Send(m)
+		})
+	}
+}
+
+// formatInfected formats the infected attachments as sorted
+// "{name} ({virus})" comma separated list.
+func formatInfected(infected map[string]string) string {
+	list := make([]string, 0, len(infected))
+	for name, virus := range infected {
+		list = append(list, stripNewLines(name)+" ("+virus+")")
+	}
+	sort.Strings(list)
+
+	return strings.Join(list, ", ")
+}
+
+// -------------------------------------------------------------------
+// clamd
+// -------------------------------------------------------------------
+
+var _ VirusScanner = (*ClamdScanner)(nil)
+
+// ClamdScanner scans the attachments via the clamd INSTREAM command.
+type ClamdScanner struct {
+	Network string // "tcp" or "unix"
+	Address string
+}
+
+// Scan implements [VirusScanner] interface.
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) (*VirusScanResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return nil, err
+	}
+
+	// each chunk is prefixed with its length as 4 bytes unsigned
+	// integer in network byte order and a zero length ends the stream
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, werr := conn.Write(chunk[:4+n]); werr != nil {
+				return nil, werr
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply parses a clamd scan reply, eg.:
+//
+//	stream: OK
+//	stream: Win.Test.EICAR_HDB-1 FOUND
+//	INSTREAM size limit exceeded. ERROR
+func parseClamdReply(reply string) (*VirusScanResult, error) {
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return &VirusScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		virus := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(virus, ": "); i >= 0 {
+			virus = virus[i+2:]
+		}
+		return &VirusScanResult{Infected: true, Virus: virus}, nil
+	default:
+		return nil, fmt.Errorf("clamd error: %s", reply)
+	}
+}
@@ -0,0 +1,136 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newTestClamd starts a fake clamd server reporting
+// the streams containing "EICAR" as infected.
+func newTestClamd(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					_, _ = io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+					_, _ = io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					_, _ = io.WriteString(conn, "stream: OK\x00")
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	scanner := &ClamdScanner{Network: "tcp", Address: newTestClamd(t)}
+
+	// larger than a single chunk
+	clean := strings.Repeat("a", clamdChunkSize+10)
+
+	result, err := scanner.Scan(context.Background(), strings.NewReader(clean))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected {
+		t.Fatalf("Expected clean result, got %+v", result)
+	}
+
+	result, err = scanner.Scan(context.Background(), strings.NewReader(clean+"EICAR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Virus != "Eicar-Test-Signature" {
+		t.Fatalf("Expected infected result, got %+v", result)
+	}
+
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Fatal("Expected clamd error")
+	}
+}
+
+func TestVirusScanMiddleware(t *testing.T) {
+	scanner := &ClamdScanner{Network: "tcp", Address: newTestClamd(t)}
+
+	newMessage := func() *Message {
+		return &Message{
+			Text: "test",
+			Attachments: map[string]io.Reader{
+				"report.pdf": strings.NewReader("%PDF"),
+				"virus.exe":  io.MultiReader(strings.NewReader("EICAR")),
+			},
+		}
+	}
+
+	var sent *Message
+	next := MailerFunc(func(m *Message) error {
+		sent = m
+		return nil
+	})
+
+	err := Chain(next, VirusScan(scanner, VirusScanConfig{})).Send(newMessage())
+
+	var virusErr *VirusError
+	if !errors.As(err, &virusErr) || virusErr.Infected["virus.exe"] != "Eicar-Test-Signature" || len(virusErr.Infected) != 1 {
+		t.Fatalf("Expected VirusError for virus.exe, got %v", err)
+	}
+	if sent != nil {
+		t.Fatal("Expected the message not to be sent")
+	}
+
+	if err := Chain(next, VirusScan(scanner, VirusScanConfig{Action: VirusActionStrip})).Send(newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sent.Attachments["virus.exe"]; ok || len(sent.Attachments) != 1 {
+		t.Fatalf("Expected only the clean attachment, got %v", sent.Attachments)
+	}
+	if data, _ := io.ReadAll(sent.Attachments["report.pdf"]); string(data) != "%PDF" {
+		t.Fatalf("Expected the unread clean attachment, got %q", data)
+	}
+	if h := sent.Headers["X-Virus-Stripped"]; h != "virus.exe (Eicar-Test-Signature)" {
+		t.Fatalf("Expected X-Virus-Stripped header, got %q", h)
+	}
+}
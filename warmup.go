@@ -0,0 +1,232 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WarmUpConfig defines a sending volume ramp for new IPs/domains.
+//
+// The n-th element of Daily (Hourly) is the maximum number of messages
+// allowed on the n-th day of the ramp (and per hour of that day).
+// A zero value means no limit for that day. Once the ramp is over
+// the volume is no longer capped.
+type WarmUpConfig struct {
+	Start  time.Time `mapstructure:"start" json:"start,omitempty" bson:"start,omitempty"` // the first day of the ramp (required)
+	Daily  []int     `mapstructure:"daily" json:"daily,omitempty" bson:"daily,omitempty"`
+	Hourly []int     `mapstructure:"hourly" json:"hourly,omitempty" bson:"hourly,omitempty"`
+
+	// Redis keeps the sent volume across the restarts and shares it between
+	// the instances (in-memory if not set, ie. reset on restart).
+	Redis *RedisConfig `mapstructure:"redis" json:"redis,omitempty" bson:"redis,omitempty"`
+}
+
+// Validate checks the warm-up configuration for common mistakes.
+func (c WarmUpConfig) Validate() error {
+	var errs []error
+
+	if c.Start.IsZero() {
+		errs = append(errs, errors.New("warmup: start is required"))
+	}
+
+	if len(c.Daily) == 0 && len(c.Hourly) == 0 {
+		errs = append(errs, errors.New("warmup: at least one of daily or hourly ramp must be set"))
+	}
+
+	for i, v := range c.Daily {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("warmup: daily[%d] must be positive, got %d", i, v))
+		}
+	}
+
+	for i, v := range c.Hourly {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("warmup: hourly[%d] must be positive, got %d", i, v))
+		}
+	}
+
+	if c.Redis != nil {
+		if err := c.Redis.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("warmup: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c WarmUpConfig) Redacted() WarmUpConfig {
+	if c.Redis != nil {
+		redis := c.Redis.Redacted()
+		c.Redis = &redis
+	}
+
+	return c
+}
+
+// WarmUpError is returned when a message exceeds the current warm-up
+// volume cap. The message should be retried (eg. re-queued) at RetryAt,
+// as the [Queue] does.
+type WarmUpError struct {
+	Limit   int
+	RetryAt time.Time
+}
+
+func (e *WarmUpError) Error() string {
+	return fmt.Sprintf("warm-up limit of %d messages reached, retry at %s", e.Limit, e.RetryAt.Format(time.RFC3339))
+}
+
+// RetryTime returns RetryAt, so that the send is deferred (see [RetryAt]).
+func (e *WarmUpError) RetryTime() time.Time {
+	return e.RetryAt
+}
+
+// WarmUpScheduler keeps track of the sent volume within the current warm-up day and hour.
+type WarmUpScheduler struct {
+	// Clock is the time source used by the [WarmUp] middleware
+	// (default to the system clock).
+	Clock Clock
+
+	config WarmUpConfig
+	store  QuotaStore
+}
+
+// NewWarmUpScheduler creates a new warm-up scheduler from the provided config,
+// counting the sent volume in Redis if configured (in-memory otherwise).
+func NewWarmUpScheduler(config WarmUpConfig) *WarmUpScheduler {
+	if config.Start.IsZero() {
+		config.Start = time.Now()
+	}
+
+	var store QuotaStore = &MemoryQuotaStore{}
+	if config.Redis != nil {
+		store = NewRedisQuotaStore(*config.Redis)
+	}
+
+	return &WarmUpScheduler{config: config, store: store}
+}
+
+// Close closes the Redis connection, if any.
+func (s *WarmUpScheduler) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// warmUpCounters returns the daily and hourly counter keys of the time,
+// along with their expiration.
+func warmUpCounters(t time.Time) (daily, hourly string, dailyTTL, hourlyTTL time.Duration) {
+	day := truncateDay(t)
+	hour := t.Truncate(time.Hour)
+
+	// kept a bit longer than their period, so that the late rollbacks are harmless
+	return "warmup:day:" + strconv.FormatInt(day.Unix(), 10), "warmup:hour:" + strconv.FormatInt(hour.Unix(), 10),
+		day.AddDate(0, 0, 1).Sub(t) + time.Hour, hour.Add(time.Hour).Sub(t) + time.Hour
+}
+
+// Reserve reserves a single send slot at the specified time.
+//
+// It returns [WarmUpError] if the daily or hourly cap has been reached.
+// The slot of a failed send should be given back with [WarmUpScheduler.Release].
+func (s *WarmUpScheduler) Reserve(now time.Time) error {
+	start := truncateDay(s.config.Start)
+	day := truncateDay(now)
+	hour := now.Truncate(time.Hour)
+
+	index := int(day.Sub(start) / (24 * time.Hour))
+	if index < 0 {
+		index = 0
+	}
+
+	dailyLimit, hourlyLimit := rampLimit(s.config.Daily, index), rampLimit(s.config.Hourly, index)
+	if dailyLimit <= 0 && hourlyLimit <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQuotaTimeout)
+	defer cancel()
+
+	dailyKey, hourlyKey, dailyTTL, hourlyTTL := warmUpCounters(now)
+
+	daily, err := s.store.Add(ctx, dailyKey, 1, dailyTTL)
+	if err != nil {
+		return fmt.Errorf("failed to count the warm-up volume: %w", err)
+	}
+
+	hourly, err := s.store.Add(ctx, hourlyKey, 1, hourlyTTL)
+	if err != nil {
+		_, _ = s.store.Add(ctx, dailyKey, -1, dailyTTL)
+		return fmt.Errorf("failed to count the warm-up volume: %w", err)
+	}
+
+	var exceeded *WarmUpError
+	switch {
+	case dailyLimit > 0 && daily > int64(dailyLimit):
+		exceeded = &WarmUpError{Limit: dailyLimit, RetryAt: day.AddDate(0, 0, 1)}
+	case hourlyLimit > 0 && hourly > int64(hourlyLimit):
+		exceeded = &WarmUpError{Limit: hourlyLimit, RetryAt: hour.Add(time.Hour)}
+	default:
+		return nil
+	}
+
+	s.release(ctx, now)
+
+	return exceeded
+}
+
+// Release gives back the slot reserved at the specified time,
+// eg. after the send failed.
+func (s *WarmUpScheduler) Release(at time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQuotaTimeout)
+	defer cancel()
+
+	s.release(ctx, at)
+}
+
+func (s *WarmUpScheduler) release(ctx context.Context, at time.Time) {
+	dailyKey, hourlyKey, dailyTTL, hourlyTTL := warmUpCounters(at)
+
+	_, _ = s.store.Add(ctx, dailyKey, -1, dailyTTL)
+	_, _ = s.store.Add(ctx, hourlyKey, -1, hourlyTTL)
+}
+
+// WarmUp returns a middleware that caps the sent volume according to the
+// scheduler ramp, deferring the messages over the cap with [WarmUpError].
+// The failed sends don't count.
+func WarmUp(scheduler *WarmUpScheduler) Middleware {
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			t := now(scheduler.Clock)
+			if err := scheduler.Reserve(t); err != nil {
+				return err
+			}
+
+			if err := next.Send(m); err != nil {
+				scheduler.Release(t)
+				return err
+			}
+
+			return nil
+		})
+	}
+}
+
+func rampLimit(ramp []int, index int) int {
+	if index >= len(ramp) {
+		return 0
+	}
+
+	return ramp[index]
+}
+
+func truncateDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,78 @@
+package mailer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWarmUpSchedulerReserve(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	scheduler := NewWarmUpScheduler(WarmUpConfig{
+		Start:  start,
+		Daily:  []int{2, 3},
+		Hourly: []int{0, 2},
+	})
+
+	scenarios := []struct {
+		name          string
+		now           time.Time
+		expectRetryAt time.Time
+	}{
+		{"day 1 #1", start, time.Time{}},
+		{"day 1 #2", start.Add(time.Hour), time.Time{}},
+		{"day 1 #3 (daily cap)", start.Add(2 * time.Hour), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"day 2 #1", start.Add(24 * time.Hour), time.Time{}},
+		{"day 2 #2", start.Add(24 * time.Hour), time.Time{}},
+		{"day 2 #3 (hourly cap)", start.Add(24 * time.Hour), time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC)},
+		{"day 2 #3 (next hour)", start.Add(25 * time.Hour), time.Time{}},
+		{"day 2 #4 (daily cap)", start.Add(26 * time.Hour), time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"day 3 (ramp completed)", start.Add(48 * time.Hour), time.Time{}},
+	}
+
+	for _, s := range scenarios {
+		err := scheduler.Reserve(s.now)
+
+		if s.expectRetryAt.IsZero() {
+			if err != nil {
+				t.Fatalf("[%s] Unexpected error %v", s.name, err)
+			}
+			continue
+		}
+
+		var warmUpErr *WarmUpError
+		if !errors.As(err, &warmUpErr) {
+			t.Fatalf("[%s] Expected WarmUpError, got %v", s.name, err)
+		}
+		if !warmUpErr.RetryAt.Equal(s.expectRetryAt) {
+			t.Fatalf("[%s] Expected retry at %v, got %v", s.name, s.expectRetryAt, warmUpErr.RetryAt)
+		}
+	}
+}
+
+func TestWarmUpRelease(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	scheduler := NewWarmUpScheduler(WarmUpConfig{Start: start, Daily: []int{1}})
+	scheduler.Clock = ClockFunc(func() time.Time { return start })
+
+	sendErr := errors.New("connection refused")
+	failing := Chain(MailerFunc(func(*Message) error { return sendErr }), WarmUp(scheduler))
+	sending := Chain(MailerFunc(func(*Message) error { return nil }), WarmUp(scheduler))
+
+	// the failed send gives its slot back
+	if err := failing.Send(&Message{}); !errors.Is(err, sendErr) {
+		t.Fatalf("Expected the send error, got %v", err)
+	}
+	if err := sending.Send(&Message{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := sending.Send(&Message{})
+
+	retryAt, ok := RetryAt(err)
+	if !ok || !retryAt.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the send to be deferred to the next day, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout    = 5 * time.Second
+	defaultWebhookWorkers    = 2
+	defaultWebhookMaxPending = 1000
+)
+
+// ErrWebhookBusy is reported for the events dropped because the
+// [WebhookPoster] has MaxPending events waiting to be posted.
+var ErrWebhookBusy = errors.New("webhook: too many pending events")
+
+// errWebhookClosed is reported for the events of the sends after Close.
+var errWebhookClosed = errors.New("webhook: poster closed")
+
+// WebhookConfig defines the send outcome webhook settings.
+type WebhookConfig struct {
+	URL     string        `mapstructure:"url" json:"url,omitempty" bson:"url,omitempty"`
+	Secret  string        `mapstructure:"secret" json:"secret,omitempty" bson:"secret,omitempty"` // HMAC-SHA256 signing secret
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty" bson:"timeout,omitempty"`
+
+	// Workers is the number of the concurrent posts, default to 2.
+	Workers int `mapstructure:"workers" json:"workers,omitempty" bson:"workers,omitempty"`
+
+	// MaxPending is the max number of the events waiting to be posted,
+	// the next ones being dropped (see [ErrWebhookBusy]), default to 1000.
+	MaxPending int `mapstructure:"max_pending" json:"max_pending,omitempty" bson:"max_pending,omitempty"`
+
+	// Client is an optional HTTP client (default to http.DefaultClient).
+	Client *http.Client `mapstructure:"-" json:"-" bson:"-"`
+
+	// Clock is an optional time source (default to the system clock).
+	Clock Clock `mapstructure:"-" json:"-" bson:"-"`
+
+	// OnError is an optional hook called when the webhook could not be delivered.
+	OnError func(event *WebhookEvent, err error) `mapstructure:"-" json:"-" bson:"-"`
+}
+
+// Validate checks the webhook configuration for common mistakes.
+func (c WebhookConfig) Validate() error {
+	var errs []error
+
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("webhook: invalid url %q", c.URL))
+	}
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("webhook: timeout must be positive, got %s", c.Timeout))
+	}
+
+	if c.Workers < 0 {
+		errs = append(errs, fmt.Errorf("webhook: workers must be positive, got %d", c.Workers))
+	}
+
+	if c.MaxPending < 0 {
+		errs = append(errs, fmt.Errorf("webhook: max_pending must be positive, got %d", c.MaxPending))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config with the secrets masked.
+func (c WebhookConfig) Redacted() WebhookConfig {
+	c.Secret = redact(c.Secret)
+	c.OnError = nil
+
+	return c
+}
+
+// WebhookEvent is the JSON payload posted after every send attempt.
+type WebhookEvent struct {
+	MessageID  string         `json:"message_id"`
+	From       string         `json:"from"`
+	Recipients []string       `json:"recipients"`
+	Subject    string         `json:"subject"`
+	Status     DeliveryStatus `json:"status"` // either "sent", "failed" or "discarded" (dry-run)
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	DurationMs int64          `json:"duration_ms"`
+}
+
+// WebhookPoster posts the [WebhookEvent] of the sends (see [Webhook])
+// in the background, with up to Workers concurrent posts.
+//
+// When a secret is set, the requests are signed with the
+// "X-Mailer-Timestamp" and "X-Mailer-Signature" headers, the latter
+// being "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+type WebhookPoster struct {
+	config WebhookConfig
+	client *http.Client
+
+	mu      sync.RWMutex
+	closed  bool
+	pending chan *WebhookEvent
+	wg      sync.WaitGroup
+}
+
+// NewWebhookPoster creates a new webhook poster, starting its workers.
+func NewWebhookPoster(config WebhookConfig) *WebhookPoster {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultWebhookWorkers
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = defaultWebhookMaxPending
+	}
+
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	p := &WebhookPoster{config: config, client: client, pending: make(chan *WebhookEvent, config.MaxPending)}
+
+	p.wg.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Post queues the event to be posted, without waiting for it. The events
+// that could not be queued are reported to the OnError hook (if any).
+func (p *WebhookPoster) Post(event *WebhookEvent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		p.failed(event, errWebhookClosed)
+		return
+	}
+
+	select {
+	case p.pending <- event:
+	default:
+		p.failed(event, ErrWebhookBusy)
+	}
+}
+
+// Close stops accepting the events, waiting for the pending ones to be posted.
+func (p *WebhookPoster) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.pending)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return nil
+}
+
+func (p *WebhookPoster) work() {
+	defer p.wg.Done()
+
+	for event := range p.pending {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+		if err := postWebhook(ctx, p.client, p.config, event); err != nil {
+			p.failed(event, err)
+		}
+		cancel()
+	}
+}
+
+func (p *WebhookPoster) failed(event *WebhookEvent, err error) {
+	if p.config.OnError != nil {
+		p.config.OnError(event, err)
+	}
+}
+
+// Webhook returns a middleware that posts a [WebhookEvent] with the poster
+// after every send attempt, without delaying the send.
+//
+// A webhook failure does not fail the send, it is only reported
+// to the OnError hook (if any).
+func Webhook(poster *WebhookPoster) Middleware {
+	clock := poster.config.Clock
+
+	return func(next Mailer) Mailer {
+		return MailerFunc(func(m *Message) error {
+			messageID := messageIDHeader(m)
+			if messageID == "" {
+				// assign a Message-ID so that it could be reported
+				m = m.Clone()
+				messageID = ensureMessageID(m)
+			}
+
+			start := now(clock)
+			sendErr := next.Send(m)
+
+			event := &WebhookEvent{
+				MessageID:  messageID,
+				From:       m.From.Address,
+				Recipients: envelopeRecipients(m),
+				Subject:    m.Subject,
+				Status:     DeliverySent,
+				StartedAt:  start,
+				DurationMs: now(clock).Sub(start).Milliseconds(),
+			}
+			if sendErr != nil {
+				event.Status = DeliveryFailed
+				if errors.Is(sendErr, ErrDryRun) {
+					event.Status = DeliveryDiscarded
+				}
+				event.Error = sendErr.Error()
+			}
+
+			poster.Post(event)
+
+			return sendErr
+		})
+	}
+}
+
+func postWebhook(ctx context.Context, client *http.Client, cfg WebhookConfig, event *WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if cfg.Secret != "" {
+		timestamp := strconv.FormatInt(now(cfg.Clock).Unix(), 10)
+		req.Header.Set("X-Mailer-Timestamp", timestamp)
+		req.Header.Set("X-Mailer-Signature", "sha256="+WebhookSignature(cfg.Secret, timestamp, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook failed with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 signature
+// of a webhook request, to be compared by the receivers with the
+// "X-Mailer-Signature" header value (without the "sha256=" prefix).
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,118 @@
+package mailer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookMiddleware(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	cfg := WebhookConfig{
+		URL:    server.URL,
+		Secret: "secret",
+		Clock: ClockFunc(func() time.Time {
+			return time.Unix(1700000000, 0)
+		}),
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	poster := NewWebhookPoster(cfg)
+	defer poster.Close()
+
+	sendErr := errors.New("send failure")
+	mailer := Chain(MailerFunc(func(m *Message) error {
+		return sendErr
+	}), Webhook(poster))
+
+	err := mailer.Send(&Message{
+		From:    mail.Address{Address: "sender@example.com"},
+		To:      []mail.Address{{Address: "to@example.com"}},
+		Subject: "test",
+		Headers: map[string]string{"Message-ID": "<id@example.com>"},
+	})
+	if !errors.Is(err, sendErr) {
+		t.Fatalf("Expected the send error, got %v", err)
+	}
+
+	// posted after the send returned
+	close(release)
+	req, body := <-requests, <-bodies
+
+	if v := req.Header.Get("X-Mailer-Timestamp"); v != "1700000000" {
+		t.Fatalf("Expected timestamp header 1700000000, got %q", v)
+	}
+	if v := req.Header.Get("X-Mailer-Signature"); v != "sha256="+WebhookSignature("secret", "1700000000", body) {
+		t.Fatalf("Invalid signature header %q", v)
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.MessageID != "<id@example.com>" || event.Status != DeliveryFailed ||
+		event.Error != "send failure" || event.Recipients[0] != "to@example.com" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+}
+
+func TestWebhookPosterBusy(t *testing.T) {
+	release := make(chan struct{})
+	var posted atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		posted.Add(1)
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var errs []error
+	poster := NewWebhookPoster(WebhookConfig{URL: server.URL, Workers: 1, MaxPending: 1, OnError: func(event *WebhookEvent, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}})
+
+	poster.Post(&WebhookEvent{MessageID: "<1@example.com>"})
+	waitFor(t, func() bool { return len(poster.pending) == 0 }) // the worker is posting it
+	poster.Post(&WebhookEvent{MessageID: "<2@example.com>"})
+	poster.Post(&WebhookEvent{MessageID: "<3@example.com>"})
+
+	close(release)
+	if err := poster.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := posted.Load(); n != 2 {
+		t.Fatalf("Expected the pending events to be posted on close, got %d", n)
+	}
+
+	poster.Post(&WebhookEvent{MessageID: "<4@example.com>"})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 2 || !errors.Is(errs[0], ErrWebhookBusy) || errs[1] == nil {
+		t.Fatalf("Expected the dropped and closed events errors, got %v", errs)
+	}
+}